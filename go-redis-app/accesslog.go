@@ -0,0 +1,104 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// accessLogger writes one logfmt line per request. Configured paths are
+// skipped unless they fail with a 5xx, and successful requests are sampled at
+// LOG_SAMPLE_RATE; client errors, server errors and requests slower than
+// LOG_SLOW_THRESHOLD are always logged. The client address is never logged.
+type accessLogger struct {
+	out   io.Writer
+	clock Clock
+	env   string
+	skip  map[string]bool
+	rate  float64
+	slow  time.Duration
+}
+
+// newAccessLogger creates an access logger writing to out
+func newAccessLogger(cfg Config, clock Clock, out io.Writer) *accessLogger {
+	l := &accessLogger{out: out, clock: clock, env: cfg.EnvName, skip: make(map[string]bool), rate: cfg.LogSampleRate, slow: cfg.LogSlowThreshold}
+	for _, path := range cfg.LogSkipPaths {
+		l.skip[path] = true
+	}
+	return l
+}
+
+// logSampled deterministically keeps a rate fraction of requests by ID, so
+// every replica and log line agrees on a request. The ID is hashed with a
+// prefix so the choice is independent of visit sampling.
+func logSampled(requestID string, rate float64) bool {
+	sum := sha256.Sum256([]byte("access-log:" + requestID))
+	return float64(binary.BigEndian.Uint64(sum[:])>>11)/(1<<53) < rate
+}
+
+// decide reports whether a request is logged, and whether it was kept by
+// sampling rather than logged unconditionally
+func (l *accessLogger) decide(path, requestID string, status int, latency time.Duration) (logged, sampled bool) {
+	if l.skip[path] && status < http.StatusInternalServerError {
+		return false, false
+	}
+	if status >= http.StatusBadRequest || (l.slow > 0 && latency >= l.slow) || l.rate >= 1 {
+		return true, false
+	}
+	if logSampled(requestID, l.rate) {
+		return true, true
+	}
+	return false, false
+}
+
+// handle is the access log middleware
+func (l *accessLogger) handle(c *gin.Context) {
+	start := l.clock.Now()
+	path := c.Request.URL.Path
+	query := c.Request.URL.RawQuery
+	c.Next()
+
+	latency := l.clock.Now().Sub(start)
+	status := c.Writer.Status()
+	requestID := c.GetString(requestIDKey)
+	logged, sampled := l.decide(path, requestID, status, latency)
+	if !logged {
+		return
+	}
+
+	if query != "" {
+		path += "?" + query
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "time=%s", start.UTC().Format(time.RFC3339Nano))
+	if l.env != "" {
+		fmt.Fprintf(&b, " env=%s", logfmtValue(l.env))
+	}
+	fmt.Fprintf(&b, " method=%s path=%s route=%s status=%d latency_ms=%.3f bytes=%d request_id=%s sampled=%t",
+		c.Request.Method, logfmtValue(path), logfmtValue(c.FullPath()), status,
+		float64(latency.Microseconds())/1000, max(c.Writer.Size(), 0), logfmtValue(requestID), sampled)
+	if sampled {
+		fmt.Fprintf(&b, " sample_rate=%s", strconv.FormatFloat(l.rate, 'g', -1, 64))
+	}
+	if errs := c.Errors.ByType(gin.ErrorTypePrivate).String(); errs != "" {
+		fmt.Fprintf(&b, " error=%s", logfmtValue(strings.TrimSpace(errs)))
+	}
+	b.WriteByte('\n')
+	io.WriteString(l.out, b.String())
+}
+
+// logfmtValue quotes a value when it is empty or contains spaces, quotes or
+// an equals sign
+func logfmtValue(v string) string {
+	if v == "" || strings.ContainsAny(v, " \"=\t\n\\") {
+		return strconv.Quote(v)
+	}
+	return v
+}
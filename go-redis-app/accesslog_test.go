@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAccessLogSamplingRate(t *testing.T) {
+	l := newAccessLogger(Config{LogSampleRate: 0.1, LogSlowThreshold: time.Second}, systemClock{}, nil)
+	kept := 0
+	for i := 0; i < 10000; i++ {
+		id := fmt.Sprintf("req-%d", i)
+		logged, sampled := l.decide("/visit/home", id, http.StatusOK, time.Millisecond)
+		if logged != sampled {
+			t.Fatalf("Expected sampled 2xx lines to be marked sampled, got logged=%t sampled=%t", logged, sampled)
+		}
+		if again, _ := l.decide("/visit/home", id, http.StatusOK, time.Millisecond); again != logged {
+			t.Fatalf("Expected the decision for %s to be deterministic", id)
+		}
+		if logged {
+			kept++
+		}
+	}
+	if kept < 900 || kept > 1100 {
+		t.Errorf("Expected about 1000 of 10000 requests logged at rate 0.1, got %d", kept)
+	}
+
+	for _, rate := range []float64{0, 1} {
+		l := newAccessLogger(Config{LogSampleRate: rate}, systemClock{}, nil)
+		kept := 0
+		for i := 0; i < 1000; i++ {
+			if logged, sampled := l.decide("/", fmt.Sprintf("req-%d", i), http.StatusOK, 0); logged {
+				kept++
+				if sampled {
+					t.Errorf("Expected rate %g lines to be unsampled", rate)
+				}
+			}
+		}
+		if kept != int(rate*1000) {
+			t.Errorf("Expected %g of requests logged at rate %g, got %d", rate*1000, rate, kept)
+		}
+	}
+}
+
+func TestAccessLogAlwaysLogs(t *testing.T) {
+	l := newAccessLogger(Config{LogSampleRate: 0, LogSlowThreshold: 500 * time.Millisecond, LogSkipPaths: []string{"/health"}}, systemClock{}, nil)
+	tests := []struct {
+		name    string
+		path    string
+		status  int
+		latency time.Duration
+		logged  bool
+	}{
+		{"fast success", "/visit/home", http.StatusOK, time.Millisecond, false},
+		{"client error", "/visit/home", http.StatusNotFound, time.Millisecond, true},
+		{"server error", "/visit/home", http.StatusServiceUnavailable, time.Millisecond, true},
+		{"slow success", "/visit/home", http.StatusOK, 600 * time.Millisecond, true},
+		{"skipped path", "/health", http.StatusOK, time.Second, false},
+		{"skipped path client error", "/health", http.StatusMethodNotAllowed, 0, false},
+		{"skipped path server error", "/health", http.StatusServiceUnavailable, 0, true},
+	}
+	for _, tt := range tests {
+		logged, sampled := l.decide(tt.path, "req-1", tt.status, tt.latency)
+		if logged != tt.logged || sampled {
+			t.Errorf("%s: expected logged=%t unsampled, got logged=%t sampled=%t", tt.name, tt.logged, logged, sampled)
+		}
+	}
+}
+
+func TestAccessLogLines(t *testing.T) {
+	_, redisClient := newTestRedis(t)
+	cfg := testConfig()
+	cfg.EnvName = "staging"
+	cfg.LogSkipPaths = []string{"/health", "/livez", "/readyz", "/metrics"}
+	server := newTestServer(t, cfg, redisClient)
+	var out bytes.Buffer
+	router := server.newEngine()
+	router.Use(newAccessLogger(cfg, systemClock{}, &out).handle)
+	routes := newRouteGroup(router)
+	server.registerPublic(routes)
+	server.registerInternal(routes)
+
+	doRequest(router, "GET", "/health", "", nil)
+	doRequest(router, "GET", "/metrics", "", nil)
+	if out.Len() != 0 {
+		t.Errorf("Expected probe and metrics requests to be suppressed, got:\n%s", out.String())
+	}
+
+	doRequest(router, "GET", "/visit/home?ts=unix", "", map[string]string{"X-Request-ID": "abc123"})
+	doRequest(router, "GET", "/no/such/page", "", nil)
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 access log lines, got:\n%s", out.String())
+	}
+	for _, want := range []string{"env=staging", "method=GET", `path="/visit/home?ts=unix"`, "route=/visit/:page", "status=200", "request_id=abc123", "sampled=false"} {
+		if !strings.Contains(lines[0], want) {
+			t.Errorf("Expected %q in %q", want, lines[0])
+		}
+	}
+	if !strings.Contains(lines[1], "status=404") || !strings.Contains(lines[1], `route=""`) {
+		t.Errorf("Expected the unmatched request logged with an empty route, got %q", lines[1])
+	}
+}
+
+func TestLogfmtValue(t *testing.T) {
+	for in, want := range map[string]string{"abc": "abc", "": `""`, "a b": `"a b"`, `a"b`: `"a\"b"`, "k=v": `"k=v"`} {
+		if got := logfmtValue(in); got != want {
+			t.Errorf("logfmtValue(%q) = %s, want %s", in, got, want)
+		}
+	}
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+// Redis command classes, each with its own latency window and timeout
+const (
+	commandRead     = "read"
+	commandWrite    = "write"
+	commandScript   = "script"
+	commandPipeline = "pipeline"
+)
+
+const (
+	// latencyWindowSize is the number of recent samples the p99 is taken over
+	latencyWindowSize = 1000
+
+	// latencyMinSamples is the number of samples a class needs before its
+	// timeout adapts; until then it is the ceiling
+	latencyMinSamples = 100
+
+	// latencyRecomputeEvery is how many samples pass between recomputations
+	latencyRecomputeEvery = 50
+)
+
+// readCommands are the commands timed as reads; anything else not blocking
+// or a script is a write
+var readCommands = map[string]bool{
+	"get": true, "mget": true, "exists": true, "ttl": true, "pttl": true, "type": true,
+	"hget": true, "hmget": true, "hgetall": true, "hlen": true, "hscan": true,
+	"zscore": true, "zmscore": true, "zrange": true, "zrevrange": true, "zrangebyscore": true, "zcard": true, "zrank": true, "zrevrank": true, "zscan": true,
+	"smembers": true, "sismember": true, "scard": true, "sscan": true,
+	"pfcount": true, "scan": true, "ping": true, "keys": true, "dbsize": true,
+	"xrange": true, "xrevrange": true, "xlen": true, "xinfo": true, "xpending": true,
+	"bf.exists": true, "bf.mexists": true, "cms.query": true, "topk.list": true, "topk.query": true,
+	"json.get": true, "json.mget": true, "ft.search": true, "ft.info": true,
+	"module": true, "info": true,
+}
+
+// untimedCommands wait on the server by design and keep the caller's deadline
+var untimedCommands = map[string]bool{
+	"xread": true, "xreadgroup": true, "blpop": true, "brpop": true, "blmove": true,
+	"bzpopmin": true, "bzpopmax": true, "wait": true,
+}
+
+// commandClass returns the timeout class of a command, or "" for commands
+// that are not given a deadline
+func commandClass(name string) string {
+	switch {
+	case untimedCommands[name]:
+		return ""
+	case readCommands[name]:
+		return commandRead
+	case name == "eval" || name == "evalsha" || name == "eval_ro" || name == "evalsha_ro":
+		return commandScript
+	}
+	return commandWrite
+}
+
+// AdaptiveTimeouts derives per-class Redis deadlines from observed latency:
+// max(floor, multiplier·p99), capped at ceiling. A new deadline only takes
+// effect when it differs from the current one by more than the hysteresis
+// fraction, so small p99 changes don't make it oscillate.
+type AdaptiveTimeouts struct {
+	floor      time.Duration
+	ceiling    time.Duration
+	multiplier float64
+	hysteresis float64
+
+	mu      sync.Mutex
+	classes map[string]*latencyWindow
+}
+
+// latencyWindow is a ring of a class's recent latencies
+type latencyWindow struct {
+	samples     []time.Duration
+	next        int
+	total       int64
+	sinceUpdate int
+	p99         time.Duration
+	timeout     time.Duration
+}
+
+// NewAdaptiveTimeouts creates adaptive timeouts starting at the ceiling
+func NewAdaptiveTimeouts(floor, ceiling time.Duration, multiplier, hysteresis float64) *AdaptiveTimeouts {
+	return &AdaptiveTimeouts{
+		floor:      floor,
+		ceiling:    ceiling,
+		multiplier: multiplier,
+		hysteresis: hysteresis,
+		classes:    make(map[string]*latencyWindow),
+	}
+}
+
+// window returns a class's window, creating it; the caller holds mu
+func (a *AdaptiveTimeouts) window(class string) *latencyWindow {
+	w, ok := a.classes[class]
+	if !ok {
+		w = &latencyWindow{samples: make([]time.Duration, 0, latencyWindowSize), timeout: a.ceiling}
+		a.classes[class] = w
+	}
+	return w
+}
+
+// Timeout returns the current deadline for a class
+func (a *AdaptiveTimeouts) Timeout(class string) time.Duration {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.window(class).timeout
+}
+
+// Observe records a command's latency, recomputing the class's timeout every
+// latencyRecomputeEvery samples
+func (a *AdaptiveTimeouts) Observe(class string, latency time.Duration) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	w := a.window(class)
+	if len(w.samples) < latencyWindowSize {
+		w.samples = append(w.samples, latency)
+	} else {
+		w.samples[w.next] = latency
+		w.next = (w.next + 1) % latencyWindowSize
+	}
+	w.total++
+	w.sinceUpdate++
+	if w.sinceUpdate >= latencyRecomputeEvery && len(w.samples) >= latencyMinSamples {
+		w.sinceUpdate = 0
+		a.recompute(w)
+	}
+}
+
+// recompute updates a window's p99 and, outside the hysteresis band, its
+// timeout; the caller holds mu
+func (a *AdaptiveTimeouts) recompute(w *latencyWindow) {
+	sorted := append([]time.Duration(nil), w.samples...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	w.p99 = sorted[int(math.Ceil(0.99*float64(len(sorted))))-1]
+
+	target := time.Duration(a.multiplier * float64(w.p99))
+	target = min(max(target, a.floor), a.ceiling)
+	current := float64(w.timeout)
+	if float64(target) > current*(1+a.hysteresis) || float64(target) < current*(1-a.hysteresis) {
+		w.timeout = target
+	}
+}
+
+// TimeoutStats is a class's entry in /debug/redis-stats
+type TimeoutStats struct {
+	Class     string  `json:"class"`
+	Samples   int64   `json:"samples"`
+	P99Ms     float64 `json:"p99_ms"`
+	TimeoutMs float64 `json:"timeout_ms"`
+}
+
+// Stats returns every class's latency and current timeout, sorted by class
+func (a *AdaptiveTimeouts) Stats() []TimeoutStats {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	stats := make([]TimeoutStats, 0, len(a.classes))
+	for class, w := range a.classes {
+		stats = append(stats, TimeoutStats{
+			Class:     class,
+			Samples:   w.total,
+			P99Ms:     durationMs(w.p99),
+			TimeoutMs: durationMs(w.timeout),
+		})
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Class < stats[j].Class })
+	return stats
+}
+
+// durationMs converts a duration to fractional milliseconds
+func durationMs(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// timeoutHook gives every timed command and pipeline its class's deadline
+// and records how long it took. The client needs ContextTimeoutEnabled for
+// the deadline to reach the socket.
+type timeoutHook struct {
+	timeouts *AdaptiveTimeouts
+}
+
+func (h timeoutHook) DialHook(next redis.DialHook) redis.DialHook { return next }
+
+func (h timeoutHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		class := commandClass(cmd.Name())
+		if class == "" {
+			return next(ctx, cmd)
+		}
+		return h.timed(ctx, class, func(ctx context.Context) error { return next(ctx, cmd) })
+	}
+}
+
+func (h timeoutHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		for _, cmd := range cmds {
+			if commandClass(cmd.Name()) == "" {
+				return next(ctx, cmds)
+			}
+		}
+		return h.timed(ctx, commandPipeline, func(ctx context.Context) error { return next(ctx, cmds) })
+	}
+}
+
+// timed runs fn under the class's deadline, observing its latency. Timed-out
+// calls count at the deadline, so a slow server pushes the timeout up.
+func (h timeoutHook) timed(ctx context.Context, class string, fn func(context.Context) error) error {
+	ctx, cancel := context.WithTimeout(ctx, h.timeouts.Timeout(class))
+	defer cancel()
+	start := time.Now()
+	err := fn(ctx)
+	h.timeouts.Observe(class, time.Since(start))
+	return err
+}
+
+// RedisStatsResponse represents the /debug/redis-stats API response
+type RedisStatsResponse struct {
+	Adaptive   bool           `json:"adaptive"`
+	FloorMs    float64        `json:"floor_ms,omitempty"`
+	CeilingMs  float64        `json:"ceiling_ms,omitempty"`
+	Multiplier float64        `json:"multiplier,omitempty"`
+	Hysteresis float64        `json:"hysteresis,omitempty"`
+	Classes    []TimeoutStats `json:"classes,omitempty"`
+	Pool       PoolStats      `json:"pool"`
+}
+
+// PoolStats is the connection pool part of /debug/redis-stats
+type PoolStats struct {
+	Hits       uint32 `json:"hits"`
+	Misses     uint32 `json:"misses"`
+	Timeouts   uint32 `json:"timeouts"`
+	TotalConns uint32 `json:"total_conns"`
+	IdleConns  uint32 `json:"idle_conns"`
+}
+
+// handleRedisStats reports the adaptive timeouts and connection pool
+func (s *Server) handleRedisStats(c *gin.Context) {
+	pool := s.redis.client.PoolStats()
+	response := RedisStatsResponse{Pool: PoolStats{
+		Hits:       pool.Hits,
+		Misses:     pool.Misses,
+		Timeouts:   pool.Timeouts,
+		TotalConns: pool.TotalConns,
+		IdleConns:  pool.IdleConns,
+	}}
+	if t := s.redis.timeouts; t != nil {
+		response.Adaptive = true
+		response.FloorMs = durationMs(t.floor)
+		response.CeilingMs = durationMs(t.ceiling)
+		response.Multiplier = t.multiplier
+		response.Hysteresis = t.hysteresis
+		response.Classes = t.Stats()
+	}
+	respondJSON(c, http.StatusOK, response)
+}
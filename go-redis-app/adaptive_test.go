@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// observeN records n samples of latency
+func observeN(a *AdaptiveTimeouts, class string, n int, latency time.Duration) {
+	for i := 0; i < n; i++ {
+		a.Observe(class, latency)
+	}
+}
+
+func TestCommandClass(t *testing.T) {
+	tests := map[string]string{
+		"get":        commandRead,
+		"hgetall":    commandRead,
+		"zrevrange":  commandRead,
+		"incr":       commandWrite,
+		"zincrby":    commandWrite,
+		"xadd":       commandWrite,
+		"evalsha":    commandScript,
+		"eval":       commandScript,
+		"xreadgroup": "",
+		"blpop":      "",
+	}
+	for name, want := range tests {
+		if got := commandClass(name); got != want {
+			t.Errorf("commandClass(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestAdaptiveTimeouts(t *testing.T) {
+	a := NewAdaptiveTimeouts(50*time.Millisecond, 2*time.Second, 3, 0.2)
+
+	// Cold start: the ceiling until enough samples are in
+	if got := a.Timeout(commandRead); got != 2*time.Second {
+		t.Errorf("Expected the ceiling before any samples, got %s", got)
+	}
+	observeN(a, commandRead, latencyMinSamples-1, 100*time.Millisecond)
+	if got := a.Timeout(commandRead); got != 2*time.Second {
+		t.Errorf("Expected the ceiling below %d samples, got %s", latencyMinSamples, got)
+	}
+
+	steps := []struct {
+		name    string
+		n       int
+		latency time.Duration
+		want    time.Duration
+	}{
+		{"k·p99", 101, 100 * time.Millisecond, 300 * time.Millisecond},
+		{"within the hysteresis band", latencyWindowSize, 110 * time.Millisecond, 300 * time.Millisecond},
+		{"above the band", latencyWindowSize, 150 * time.Millisecond, 450 * time.Millisecond},
+		{"below the band", latencyWindowSize, 100 * time.Millisecond, 300 * time.Millisecond},
+		{"floor", latencyWindowSize, time.Millisecond, 50 * time.Millisecond},
+		{"ceiling", latencyWindowSize, time.Second, 2 * time.Second},
+	}
+	for _, step := range steps {
+		observeN(a, commandRead, step.n, step.latency)
+		if got := a.Timeout(commandRead); got != step.want {
+			t.Errorf("%s: after %d samples of %s, expected %s, got %s", step.name, step.n, step.latency, step.want, got)
+		}
+	}
+
+	// Classes adapt independently
+	if got := a.Timeout(commandWrite); got != 2*time.Second {
+		t.Errorf("Expected writes at the ceiling, got %s", got)
+	}
+}
+
+func TestAdaptiveTimeoutsUseP99(t *testing.T) {
+	a := NewAdaptiveTimeouts(time.Millisecond, 10*time.Second, 2, 0.1)
+	// 2% of slow calls set the p99; a single old outlier does not
+	for i := 0; i < latencyWindowSize; i++ {
+		latency := 10 * time.Millisecond
+		if i%50 == 0 {
+			latency = 200 * time.Millisecond
+		}
+		a.Observe(commandScript, latency)
+	}
+	if got := a.Timeout(commandScript); got != 400*time.Millisecond {
+		t.Errorf("Expected 2·p99 = 400ms with 2%% slow calls, got %s", got)
+	}
+
+	b := NewAdaptiveTimeouts(time.Millisecond, 10*time.Second, 2, 0.1)
+	b.Observe(commandScript, 5*time.Second)
+	observeN(b, commandScript, latencyWindowSize, 10*time.Millisecond)
+	if got := b.Timeout(commandScript); got != 20*time.Millisecond {
+		t.Errorf("Expected an old outlier to leave the window, got %s", got)
+	}
+}
+
+func TestAdaptiveTimeoutDeadline(t *testing.T) {
+	// A server that accepts connections and never answers
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	cfg := testConfig()
+	cfg.RedisHost, cfg.RedisPort, _ = net.SplitHostPort(l.Addr().String())
+	cfg.RedisAdaptiveTimeouts = true
+	cfg.RedisTimeoutFloor, cfg.RedisTimeoutCeiling = 100*time.Millisecond, 100*time.Millisecond
+	cfg.RedisTimeoutMultiplier, cfg.RedisTimeoutHysteresis = 3, 0.2
+	redisClient := NewRedisClientFromConfig(cfg)
+	defer redisClient.client.Close()
+
+	start := time.Now()
+	_, err = redisClient.GetVisitCount(context.Background(), "home")
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected the adaptive deadline to cut the call short, took %s", elapsed)
+	}
+	if !errors.Is(err, ErrTimeout) {
+		t.Errorf("Expected a timeout, got %v", err)
+	}
+	if stats := redisClient.timeouts.Stats(); len(stats) != 1 || stats[0].Class != commandRead || stats[0].Samples != 1 {
+		t.Errorf("Expected the timed-out read observed, got %+v", stats)
+	}
+}
+
+func TestDebugRedisStats(t *testing.T) {
+	mr, _ := newTestRedis(t)
+	cfg := testConfig()
+	cfg.RedisHost, cfg.RedisPort, _ = net.SplitHostPort(mr.Addr())
+	cfg.RedisAdaptiveTimeouts = true
+	cfg.RedisTimeoutFloor, cfg.RedisTimeoutCeiling = 50*time.Millisecond, 2*time.Second
+	cfg.RedisTimeoutMultiplier, cfg.RedisTimeoutHysteresis = 3, 0.2
+	redisClient := NewRedisClientFromConfig(cfg)
+	t.Cleanup(func() { redisClient.client.Close() })
+	router := newTestServer(t, cfg, redisClient).Router()
+	doRequest(router, "GET", "/visit/home", "", nil)
+
+	w := doRequest(router, "GET", "/debug/redis-stats", "", nil)
+	var resp RedisStatsResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("Expected the Redis stats, got %d: %s", w.Code, w.Body.String())
+	}
+	if !resp.Adaptive || resp.FloorMs != 50 || resp.CeilingMs != 2000 || resp.Multiplier != 3 || len(resp.Classes) == 0 {
+		t.Errorf("Expected the adaptive settings and classes, got %+v", resp)
+	}
+	for _, class := range resp.Classes {
+		if class.Samples == 0 || class.TimeoutMs != 2000 {
+			t.Errorf("Expected sampled classes still at the ceiling, got %+v", class)
+		}
+	}
+	if resp.Pool.TotalConns == 0 {
+		t.Errorf("Expected pool stats, got %+v", resp.Pool)
+	}
+
+	_, plain := newTestRedis(t)
+	w = doRequest(newTestServer(t, testConfig(), plain).Router(), "GET", "/debug/redis-stats", "", nil)
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || resp.Adaptive {
+		t.Errorf("Expected adaptive timeouts off for a plain client, got %s", w.Body.String())
+	}
+}
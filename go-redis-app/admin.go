@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// actorKey is the context key holding the name of the authenticated API key
+const actorKey = "actor"
+
+// adminUnauthenticated reports whether no admin credentials are configured
+func (s *Server) adminUnauthenticated() bool {
+	return len(s.cfg.AdminAPIKeys) == 0 && s.cfg.AdminHMACSecret == "" && s.jwt == nil
+}
+
+// requireAdminKey authenticates admin requests with a bearer token carrying
+// the admin role, an ADMIN_API_KEYS key, or an ADMIN_HMAC_SECRET signature
+func (s *Server) requireAdminKey(c *gin.Context) {
+	if c.GetBool(authenticatedKey) {
+		requirePermission(PermAdmin)(c)
+		return
+	}
+
+	if s.cfg.AdminHMACSecret != "" && c.GetHeader(signatureHeader) != "" {
+		if err := verifySignature(c.Request, []byte(s.cfg.AdminHMACSecret), s.clock.Now()); err != nil {
+			respondError(c, http.StatusUnauthorized, "invalid_signature", "Invalid request signature: "+err.Error())
+			return
+		}
+		c.Set(actorKey, "hmac")
+		c.Next()
+		return
+	}
+
+	if s.adminUnauthenticated() {
+		c.Set(actorKey, "anonymous")
+		c.Next()
+		return
+	}
+
+	key := c.GetHeader("X-API-Key")
+	if key == "" {
+		key = c.Query("api_key")
+	}
+	name, ok := s.cfg.AdminAPIKeys[key]
+	if !ok {
+		respondError(c, http.StatusUnauthorized, "unauthorized", "Missing or invalid API key")
+		return
+	}
+
+	c.Set(actorKey, name)
+	c.Next()
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// aggregateBatchSize is how many page names are read, and their
+	// counters fetched, per round trip
+	aggregateBatchSize = 1000
+
+	// aggregateMaxPages caps the pages one aggregate may sum, so a broad
+	// pattern fails fast instead of reading the whole index
+	aggregateMaxPages = 10000
+)
+
+// errTooManyPages is returned when a pattern matches over aggregateMaxPages
+var errTooManyPages = fmt.Errorf("pattern matches more than %d pages", aggregateMaxPages)
+
+// AggregateResponse is the summed visit count of the pages a pattern
+// matches, or of a group's pages
+type AggregateResponse struct {
+	Pattern string `json:"pattern,omitempty"`
+	Group   string `json:"group,omitempty"`
+	Visits  int64  `json:"visits"`
+	Pages   int    `json:"pages"`
+	// Breakdown lists each page's count by name, with breakdown=true
+	Breakdown []PageCount `json:"breakdown,omitempty"`
+}
+
+// pagePattern is a page name pattern: a prefix, or a single exact page
+type pagePattern struct {
+	name   string
+	prefix bool
+}
+
+// parsePagePattern parses a glob limited to a single trailing *, so it
+// always resolves to one lexicographic range of the page index
+func parsePagePattern(pattern string) (pagePattern, error) {
+	name, prefix := strings.CutSuffix(pattern, "*")
+	switch {
+	case pattern == "":
+		return pagePattern{}, errors.New("pattern must not be empty")
+	case strings.ContainsAny(name, "*?[]"):
+		return pagePattern{}, errors.New("pattern may only have a single trailing *")
+	}
+	return pagePattern{name: name, prefix: prefix}, nil
+}
+
+// lexRange returns the ZRANGEBYLEX bounds of the names the pattern matches
+func (p pagePattern) lexRange() (string, string) {
+	if !p.prefix {
+		return "[" + p.name, "[" + p.name
+	}
+	if p.name == "" {
+		return "-", "+"
+	}
+	return "[" + p.name, "[" + p.name + "\xff"
+}
+
+// AggregateVisits sums the visit counts of the indexed pages matching the
+// pattern, skipping hidden ones, and lists them with breakdown. Names are
+// read from the page name index a batch at a time, their counters fetched
+// in one pipeline per batch.
+func (r *RedisClient) AggregateVisits(ctx context.Context, pattern pagePattern, hidden map[string]bool, breakdown bool) (AggregateResponse, error) {
+	var resp AggregateResponse
+	lo, hi := pattern.lexRange()
+	for offset := int64(0); ; offset += aggregateBatchSize {
+		names, err := r.client.ZRangeByLex(ctx, pageNamesKey, &redis.ZRangeBy{Min: lo, Max: hi, Offset: offset, Count: aggregateBatchSize}).Result()
+		if err != nil {
+			return AggregateResponse{}, err
+		}
+		if err := r.addPageCounts(ctx, &resp, names, hidden, breakdown); err != nil {
+			return AggregateResponse{}, err
+		}
+		if len(names) < aggregateBatchSize {
+			return resp, nil
+		}
+	}
+}
+
+// AggregateGroupVisits sums the visit counts of the pages assigned to a
+// group like AggregateVisits, reading the group's page set with SSCAN.
+// Breakdown pages are sorted by name.
+func (r *RedisClient) AggregateGroupVisits(ctx context.Context, group string, hidden map[string]bool, breakdown bool) (AggregateResponse, error) {
+	var resp AggregateResponse
+	var cursor uint64
+	seen := make(map[string]bool)
+	for {
+		names, next, err := r.client.SScan(ctx, groupPagesKey(group), cursor, "", aggregateBatchSize).Result()
+		if err != nil {
+			return AggregateResponse{}, err
+		}
+		// SSCAN may return a member more than once
+		batch := names[:0]
+		for _, name := range names {
+			if !seen[name] {
+				seen[name] = true
+				batch = append(batch, name)
+			}
+		}
+		if err := r.addPageCounts(ctx, &resp, batch, hidden, breakdown); err != nil {
+			return AggregateResponse{}, err
+		}
+		if cursor = next; cursor == 0 {
+			sort.Slice(resp.Breakdown, func(i, j int) bool { return resp.Breakdown[i].Page < resp.Breakdown[j].Page })
+			return resp, nil
+		}
+	}
+}
+
+// addPageCounts adds the counters of a batch of names, skipping hidden
+// ones, in one pipeline
+func (r *RedisClient) addPageCounts(ctx context.Context, resp *AggregateResponse, names []string, hidden map[string]bool, breakdown bool) error {
+	pages := names[:0]
+	for _, name := range names {
+		if !hidden[name] {
+			pages = append(pages, name)
+		}
+	}
+	if resp.Pages += len(pages); resp.Pages > aggregateMaxPages {
+		return errTooManyPages
+	}
+	if len(pages) == 0 {
+		return nil
+	}
+
+	pipe := r.client.Pipeline()
+	counts := make([]*redis.StringCmd, len(pages))
+	for i, page := range pages {
+		counts[i] = pipe.Get(ctx, key("visits", page))
+	}
+	if _, err := pipe.Exec(ctx); ignoreMissing(err) != nil {
+		return err
+	}
+	for i, page := range pages {
+		// A page whose counter is gone counts 0
+		count, _ := counts[i].Int64()
+		resp.Visits += count
+		if breakdown {
+			resp.Breakdown = append(resp.Breakdown, PageCount{Page: page, Visits: count})
+		}
+	}
+	return nil
+}
+
+// handleAggregateVisits returns the total visits of the pages matching
+// pattern, or of the pages of group, cached like the other aggregations
+func (s *Server) handleAggregateVisits(c *gin.Context) {
+	raw, group := c.Query("pattern"), c.Query("group")
+	var pattern pagePattern
+	switch {
+	case group != "":
+		if raw != "" {
+			respondError(c, http.StatusBadRequest, "invalid_pattern", "pattern and group are mutually exclusive")
+			return
+		}
+		if !groupNamePattern.MatchString(group) {
+			respondError(c, http.StatusBadRequest, "invalid_group", fmt.Sprintf("invalid group %q", group))
+			return
+		}
+	default:
+		var err error
+		if pattern, err = parsePagePattern(raw); err != nil {
+			respondError(c, http.StatusBadRequest, "invalid_pattern", err.Error())
+			return
+		}
+	}
+	breakdown, _ := strconv.ParseBool(c.Query("breakdown"))
+
+	// Private pages are only excluded for anonymous callers, so they are
+	// cached separately
+	private := canReadPrivate(c)
+	key := fmt.Sprintf("aggregate:%t:%t:%s", breakdown, private, raw)
+	if group != "" {
+		key = fmt.Sprintf("aggregate:%t:%t:group:%s", breakdown, private, group)
+	}
+	load := func(ctx context.Context) (any, error) {
+		var hidden map[string]bool
+		if !private {
+			var err error
+			if hidden, err = s.meta.PrivatePages(ctx); err != nil {
+				return nil, err
+			}
+		}
+		if group != "" {
+			resp, err := s.redis.AggregateGroupVisits(ctx, group, hidden, breakdown)
+			resp.Group = group
+			return resp, err
+		}
+		resp, err := s.redis.AggregateVisits(ctx, pattern, hidden, breakdown)
+		resp.Pattern = raw
+		return resp, err
+	}
+	value, status, err := s.aggregates.Get(c.Request.Context(), key, s.shared.wrap(key, decodeAggregateResponse, load))
+	if errors.Is(err, errTooManyPages) && group != "" {
+		respondError(c, http.StatusBadRequest, "pattern_too_broad", "The group has more than "+strconv.Itoa(aggregateMaxPages)+" pages")
+		return
+	}
+	if errors.Is(err, errTooManyPages) {
+		respondError(c, http.StatusBadRequest, "pattern_too_broad", "The pattern matches more than "+strconv.Itoa(aggregateMaxPages)+" pages")
+		return
+	}
+	if err != nil {
+		log.Printf("Error aggregating visits: %v", err)
+		respondStoreError(c, err, "Failed to aggregate visits")
+		return
+	}
+
+	setCacheStatus(c, status)
+	respondJSON(c, http.StatusOK, value)
+}
+
+// decodeAggregateResponse decodes an aggregate response from the shared cache
+func decodeAggregateResponse(b []byte) (any, error) {
+	var resp AggregateResponse
+	err := json.Unmarshal(b, &resp)
+	return resp, err
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"go-redis-app/internal/clocktest"
+)
+
+func decodeAggregate(t *testing.T, body []byte) AggregateResponse {
+	t.Helper()
+	var resp AggregateResponse
+	if err := json.Unmarshal(body, &resp); err != nil {
+		t.Fatalf("Failed to decode aggregate: %v", err)
+	}
+	return resp
+}
+
+func TestParsePagePattern(t *testing.T) {
+	for pattern, want := range map[string]pagePattern{
+		"blog:*": {name: "blog:", prefix: true},
+		"blog*":  {name: "blog", prefix: true},
+		"*":      {name: "", prefix: true},
+		"home":   {name: "home"},
+	} {
+		if got, err := parsePagePattern(pattern); err != nil || got != want {
+			t.Errorf("parsePagePattern(%q) = %+v, %v, want %+v", pattern, got, err, want)
+		}
+	}
+	for _, pattern := range []string{"", "blog:*:post", "*blog", "blog:**", "blog:?", "blog:[ab]*"} {
+		if _, err := parsePagePattern(pattern); err == nil {
+			t.Errorf("Expected %q rejected", pattern)
+		}
+	}
+}
+
+func TestAggregateVisits(t *testing.T) {
+	_, redisClient := newTestRedis(t)
+	router := newTestServer(t, testConfig(), redisClient).Router()
+	for page, n := range map[string]int{"blog:a": 3, "blog:b": 2, "blog": 1, "blogroll": 4, "home": 5} {
+		for i := 0; i < n; i++ {
+			doRequest(router, "GET", "/visit/"+page, "", nil)
+		}
+	}
+
+	w := doRequest(router, "GET", "/visits/aggregate?pattern=blog:*&breakdown=true", "", nil)
+	resp := decodeAggregate(t, w.Body.Bytes())
+	if w.Code != http.StatusOK || resp.Visits != 5 || resp.Pages != 2 || resp.Pattern != "blog:*" {
+		t.Fatalf("Expected blog:a and blog:b summed, got %d: %s", w.Code, w.Body.String())
+	}
+	if len(resp.Breakdown) != 2 || resp.Breakdown[0] != (PageCount{Page: "blog:a", Visits: 3}) || resp.Breakdown[1] != (PageCount{Page: "blog:b", Visits: 2}) {
+		t.Errorf("Expected the breakdown by name, got %+v", resp.Breakdown)
+	}
+
+	for pattern, want := range map[string]int64{"blog*": 10, "home": 5, "*": 15} {
+		w := doRequest(router, "GET", "/visits/aggregate?pattern="+pattern, "", nil)
+		if resp := decodeAggregate(t, w.Body.Bytes()); resp.Visits != want || resp.Breakdown != nil {
+			t.Errorf("Expected %d visits without a breakdown for %s, got %s", want, pattern, w.Body.String())
+		}
+	}
+
+	// Anonymous callers don't see private pages in the sum
+	if w := doRequest(router, "PUT", "/admin/pages/blog:b/meta", `{"visibility":"private"}`, nil); w.Code != http.StatusOK {
+		t.Fatalf("Set meta: %d %s", w.Code, w.Body.String())
+	}
+	w = doRequest(router, "GET", "/visits/aggregate?pattern=blog:*", "", nil)
+	if resp := decodeAggregate(t, w.Body.Bytes()); resp.Visits != 3 || resp.Pages != 1 {
+		t.Errorf("Expected the private page left out, got %s", w.Body.String())
+	}
+
+	if w := doRequest(router, "GET", "/visits/aggregate?pattern=blog:*:x", "", nil); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected an inner wildcard rejected, got %d", w.Code)
+	}
+	// The route does not shadow the page endpoints next to it
+	if w := doRequest(router, "GET", "/visits/home", "", nil); w.Code != http.StatusOK {
+		t.Errorf("Expected /visits/:page served, got %d", w.Code)
+	}
+}
+
+func TestAggregateVisitsEmptyMatch(t *testing.T) {
+	_, redisClient := newTestRedis(t)
+	router := newTestServer(t, testConfig(), redisClient).Router()
+	doRequest(router, "GET", "/visit/home", "", nil)
+
+	w := doRequest(router, "GET", "/visits/aggregate?pattern=docs:*&breakdown=true", "", nil)
+	resp := decodeAggregate(t, w.Body.Bytes())
+	if w.Code != http.StatusOK || resp.Visits != 0 || resp.Pages != 0 || len(resp.Breakdown) != 0 {
+		t.Errorf("Expected an empty aggregate, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestAggregateVisitsCache(t *testing.T) {
+	_, redisClient := newTestRedis(t)
+	cfg := testConfig()
+	cfg.CacheTTL = time.Minute
+	clock := clocktest.New(time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC))
+	router := newTestServerWithClock(t, cfg, redisClient, clock).Router()
+	doRequest(router, "GET", "/visit/blog:a", "", nil)
+
+	aggregate := func(query string) (AggregateResponse, string) {
+		w := doRequest(router, "GET", "/visits/aggregate?"+query, "", nil)
+		return decodeAggregate(t, w.Body.Bytes()), w.Header().Get("Cache-Status")
+	}
+	if resp, status := aggregate("pattern=blog:*"); status != cacheMiss || resp.Visits != 1 {
+		t.Errorf("Expected a miss with 1 visit, got %q %+v", status, resp)
+	}
+
+	// Visits within the TTL show once it expires
+	doRequest(router, "GET", "/visit/blog:b", "", nil)
+	if resp, status := aggregate("pattern=blog:*"); status != cacheHit || resp.Visits != 1 {
+		t.Errorf("Expected the cached sum, got %q %+v", status, resp)
+	}
+	// The breakdown is cached on its own
+	if resp, status := aggregate("pattern=blog:*&breakdown=true"); status != cacheMiss || resp.Visits != 2 || len(resp.Breakdown) != 2 {
+		t.Errorf("Expected the breakdown computed afresh, got %q %+v", status, resp)
+	}
+	clock.Advance(2*time.Minute + time.Second)
+	if resp, status := aggregate("pattern=blog:*"); status != cacheMiss || resp.Visits != 2 || resp.Pages != 2 {
+		t.Errorf("Expected a fresh sum after the TTL, got %q %+v", status, resp)
+	}
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"sync/atomic"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// pageAliasesKey is the hash of page aliases to the pages they stand for
+	pageAliasesKey = "visits:pages:aliases"
+
+	// resolvedFromKey is the context key holding the alias a request's page
+	// was resolved from
+	resolvedFromKey = "resolved_from"
+)
+
+var (
+	errAliasCycle    = newKindError(ErrConflict, "alias would form a cycle")
+	errAliasChain    = newKindError(ErrConflict, "aliases may only point at pages, not other aliases")
+	errAliasIsPage   = newKindError(ErrConflict, "alias is the name of an existing page")
+	errAliasTarget   = newKindError(ErrNotFound, "target page not found")
+	errAliasNotFound = newKindError(ErrNotFound, "alias not found")
+)
+
+// setAliasScript points an alias at a page, keeping aliases one level deep:
+// the target may not be an alias and the alias may not be a target. It
+// returns -1 for a cycle, -2 for a chain, -3 when the alias is a page and
+// -4 when the target is not.
+//
+// KEYS[1] aliases hash, KEYS[2] page name index, KEYS[3] alias counter,
+// KEYS[4] target counter; ARGV[1] alias, ARGV[2] target
+var setAliasScript = redis.NewScript(`
+local alias, target = ARGV[1], ARGV[2]
+if alias == target or redis.call('HGET', KEYS[1], target) == alias then
+	return -1
+end
+if redis.call('HEXISTS', KEYS[1], target) == 1 then
+	return -2
+end
+for _, pointed in ipairs(redis.call('HVALS', KEYS[1])) do
+	if pointed == alias then
+		return -2
+	end
+end
+if redis.call('ZSCORE', KEYS[2], alias) or redis.call('EXISTS', KEYS[3]) == 1 then
+	return -3
+end
+if not redis.call('ZSCORE', KEYS[2], target) and redis.call('EXISTS', KEYS[4]) == 0 then
+	return -4
+end
+redis.call('HSET', KEYS[1], alias, target)
+return 1
+`)
+
+// PageAlias is an alias and the page it stands for
+type PageAlias struct {
+	Alias  string `json:"alias"`
+	Target string `json:"target"`
+	// Dangling is set in listings when the target page no longer exists
+	Dangling bool `json:"dangling,omitempty"`
+}
+
+// AliasRequest is the body of PUT /admin/aliases/:alias
+type AliasRequest struct {
+	Target string `json:"target"`
+}
+
+// AliasListResponse represents the GET /admin/aliases API response
+type AliasListResponse struct {
+	Aliases []PageAlias `json:"aliases"`
+	Total   int         `json:"total"`
+}
+
+// SetAlias points alias at target, replacing where it pointed before
+func (r *RedisClient) SetAlias(ctx context.Context, alias, target string) error {
+	keys := []string{pageAliasesKey, pageNamesKey, key("visits", alias), key("visits", target)}
+	result, err := setAliasScript.Run(ctx, r.client, keys, alias, target).Int()
+	if err != nil {
+		return err
+	}
+	switch result {
+	case -1:
+		return errAliasCycle
+	case -2:
+		return errAliasChain
+	case -3:
+		return errAliasIsPage
+	case -4:
+		return errAliasTarget
+	}
+	return nil
+}
+
+// DeleteAlias removes an alias
+func (r *RedisClient) DeleteAlias(ctx context.Context, alias string) error {
+	removed, err := r.client.HDel(ctx, pageAliasesKey, alias).Result()
+	if err != nil {
+		return err
+	}
+	if removed == 0 {
+		return errAliasNotFound
+	}
+	return nil
+}
+
+// AliasStore keeps a local copy of the page aliases, so resolving one costs
+// no round trip. Like the groups, it is refreshed with the flags on their
+// pub/sub notifications and poll.
+type AliasStore struct {
+	redis   *RedisClient
+	current atomic.Pointer[map[string]string]
+}
+
+// NewAliasStore creates an alias store with no aliases
+func NewAliasStore(redisClient *RedisClient) *AliasStore {
+	a := &AliasStore{redis: redisClient}
+	a.current.Store(&map[string]string{})
+	return a
+}
+
+// Resolve returns the page an alias stands for, ok false when page is not
+// an alias
+func (a *AliasStore) Resolve(page string) (string, bool) {
+	target, ok := (*a.current.Load())[page]
+	return target, ok
+}
+
+// Refresh reloads the aliases from Redis
+func (a *AliasStore) Refresh(ctx context.Context) error {
+	aliases, err := a.redis.client.HGetAll(ctx, pageAliasesKey).Result()
+	if err != nil {
+		return err
+	}
+	a.current.Store(&aliases)
+	return nil
+}
+
+// publishAliases reloads the local aliases and notifies the other replicas
+// on the flags channel
+func (s *Server) publishAliases(ctx context.Context) {
+	if err := s.redis.client.Publish(ctx, flagsChannel, "").Err(); err != nil {
+		log.Printf("Failed to publish alias update: %v", err)
+	}
+	if err := s.aliases.Refresh(ctx); err != nil {
+		log.Printf("Failed to refresh aliases: %v", err)
+	}
+}
+
+// ListAliases returns every alias sorted by name, marking those whose
+// target is neither indexed nor counted
+func (r *RedisClient) ListAliases(ctx context.Context) ([]PageAlias, error) {
+	all, err := r.client.HGetAll(ctx, pageAliasesKey).Result()
+	if err != nil {
+		return nil, err
+	}
+	aliases := make([]PageAlias, 0, len(all))
+	if len(all) == 0 {
+		return aliases, nil
+	}
+
+	pipe := r.client.Pipeline()
+	names := make(map[string]*redis.FloatCmd, len(all))
+	counters := make(map[string]*redis.IntCmd, len(all))
+	for alias, target := range all {
+		aliases = append(aliases, PageAlias{Alias: alias, Target: target})
+		if _, ok := names[target]; !ok {
+			names[target] = pipe.ZScore(ctx, pageNamesKey, target)
+			counters[target] = pipe.Exists(ctx, key("visits", target))
+		}
+	}
+	if _, err := pipe.Exec(ctx); ignoreMissing(err) != nil {
+		return nil, err
+	}
+	for i := range aliases {
+		target := aliases[i].Target
+		aliases[i].Dangling = isMissing(names[target].Err()) && counters[target].Val() == 0
+	}
+	sort.Slice(aliases, func(i, j int) bool { return aliases[i].Alias < aliases[j].Alias })
+	return aliases, nil
+}
+
+// aliasesOf returns the sorted aliases of each of pages that has any
+func (r *RedisClient) aliasesOf(ctx context.Context, pages []string) (map[string][]string, error) {
+	all, err := r.client.HGetAll(ctx, pageAliasesKey).Result()
+	if err != nil {
+		return nil, err
+	}
+	wanted := make(map[string]bool, len(pages))
+	for _, page := range pages {
+		wanted[page] = true
+	}
+	byTarget := make(map[string][]string)
+	for alias, target := range all {
+		if wanted[target] {
+			byTarget[target] = append(byTarget[target], alias)
+		}
+	}
+	for _, aliases := range byTarget {
+		sort.Strings(aliases)
+	}
+	return byTarget, nil
+}
+
+// resolveAlias replaces an aliased :page with the page it stands for, so
+// every handler after it sees the target, and records the alias for the
+// response's resolved_from. Aliases are read from the local copy.
+func (s *Server) resolveAlias(c *gin.Context) {
+	for i, param := range c.Params {
+		if param.Key != "page" {
+			continue
+		}
+		if target, ok := s.aliases.Resolve(param.Value); ok {
+			c.Params[i].Value = target
+			c.Set(resolvedFromKey, param.Value)
+		}
+		break
+	}
+	c.Next()
+}
+
+// handleListAliases lists the page aliases
+func (s *Server) handleListAliases(c *gin.Context) {
+	aliases, err := s.redis.ListAliases(c.Request.Context())
+	if err != nil {
+		log.Printf("Error listing page aliases: %v", err)
+		respondStoreError(c, err, "Failed to list aliases")
+		return
+	}
+	respondJSON(c, http.StatusOK, AliasListResponse{Aliases: aliases, Total: len(aliases)})
+}
+
+// handlePutAlias points an alias at a page
+func (s *Server) handlePutAlias(c *gin.Context) {
+	var req AliasRequest
+	if err := c.ShouldBindJSON(&req); err != nil || req.Target == "" {
+		respondError(c, http.StatusBadRequest, "invalid_request", "Body must be an object with a target")
+		return
+	}
+	alias := c.Param("alias")
+	err := s.redis.SetAlias(c.Request.Context(), alias, req.Target)
+	switch {
+	case errors.Is(err, errAliasCycle):
+		respondError(c, http.StatusConflict, "alias_cycle", "The alias would form a cycle")
+		return
+	case errors.Is(err, errAliasChain):
+		respondError(c, http.StatusConflict, "alias_chain", "Aliases may only point at pages, not other aliases")
+		return
+	case errors.Is(err, errAliasIsPage):
+		respondError(c, http.StatusConflict, "page_exists", "The alias is the name of an existing page")
+		return
+	case errors.Is(err, errAliasTarget):
+		respondError(c, http.StatusNotFound, "not_found", "Target page not found")
+		return
+	case err != nil:
+		log.Printf("Error setting page alias: %v", err)
+		respondStoreError(c, err, "Failed to set alias")
+		return
+	}
+	s.publishAliases(c.Request.Context())
+	c.JSON(http.StatusOK, PageAlias{Alias: alias, Target: req.Target})
+}
+
+// handleDeleteAlias removes an alias
+func (s *Server) handleDeleteAlias(c *gin.Context) {
+	err := s.redis.DeleteAlias(c.Request.Context(), c.Param("alias"))
+	if errors.Is(err, errAliasNotFound) {
+		respondError(c, http.StatusNotFound, "not_found", "Alias not found")
+		return
+	}
+	if err != nil {
+		log.Printf("Error deleting page alias: %v", err)
+		respondStoreError(c, err, "Failed to delete alias")
+		return
+	}
+	s.publishAliases(c.Request.Context())
+	c.Status(http.StatusNoContent)
+}
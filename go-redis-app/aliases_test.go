@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAliasResolution(t *testing.T) {
+	_, redisClient := newTestRedis(t)
+	router := newTestServer(t, testConfig(), redisClient).Router()
+	doRequest(router, "GET", "/visit/pricing", "", nil)
+
+	if w := doRequest(router, "PUT", "/admin/aliases/plans", `{"target":"pricing"}`, nil); w.Code != http.StatusOK {
+		t.Fatalf("Set alias: %d %s", w.Code, w.Body.String())
+	}
+
+	// Visits through the alias count for the target
+	w := doRequest(router, "GET", "/visit/plans", "", nil)
+	var resp VisitResponse
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if w.Code != http.StatusOK || resp.Page != "pricing" || resp.ResolvedFrom != "plans" || resp.Visits != 2 {
+		t.Fatalf("Expected the visit counted for pricing, got %d: %s", w.Code, w.Body.String())
+	}
+	w = doRequest(router, "GET", "/visits/plans", "", nil)
+	resp = VisitResponse{}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if resp.Page != "pricing" || resp.ResolvedFrom != "plans" || resp.Visits != 2 {
+		t.Errorf("Expected the read resolved, got %s", w.Body.String())
+	}
+	if w := doRequest(router, "GET", "/visits/plans/range?from=2024-01-01&to=2024-01-02", "", nil); w.Code != http.StatusOK {
+		t.Errorf("Expected the sub-resources resolved too, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// Requests by the page's own name are unchanged
+	w = doRequest(router, "GET", "/visits/pricing", "", nil)
+	resp = VisitResponse{}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if resp.ResolvedFrom != "" || resp.Visits != 2 {
+		t.Errorf("Expected no resolved_from, got %s", w.Body.String())
+	}
+	if got, _ := redisClient.GetVisitCount(context.Background(), "plans"); got != 0 {
+		t.Errorf("Expected no counter for the alias, got %d", got)
+	}
+
+	if w := doRequest(router, "DELETE", "/admin/aliases/plans", "", nil); w.Code != http.StatusNoContent {
+		t.Fatalf("Delete alias: %d %s", w.Code, w.Body.String())
+	}
+	if w := doRequest(router, "DELETE", "/admin/aliases/plans", "", nil); w.Code != http.StatusNotFound {
+		t.Errorf("Expected a missing alias reported, got %d", w.Code)
+	}
+	if w := doRequest(router, "GET", "/visit/plans", "", nil); !strings.Contains(w.Body.String(), `"page":"plans"`) {
+		t.Errorf("Expected plans counted on its own once unaliased, got %s", w.Body.String())
+	}
+}
+
+func TestAliasEditsRefreshOtherReplicas(t *testing.T) {
+	mr, _ := newTestRedis(t)
+	serverA := newTestServer(t, testConfig(), newTestRedisClient(t, mr))
+	serverB := newTestServer(t, testConfig(), newTestRedisClient(t, mr))
+	routerA, routerB := serverA.Router(), serverB.Router()
+	doRequest(routerA, "GET", "/visit/pricing", "", nil)
+
+	// The poll interval is an hour, so only pub/sub can refresh server B
+	doRequest(routerA, "PUT", "/admin/aliases/plans", `{"target":"pricing"}`, nil)
+	waitFor(t, 2*time.Second, func() bool { _, ok := serverB.aliases.Resolve("plans"); return ok })
+	if w := doRequest(routerB, "GET", "/visit/plans", "", nil); !strings.Contains(w.Body.String(), `"resolved_from":"plans"`) {
+		t.Errorf("Expected server B to resolve the alias, got %s", w.Body.String())
+	}
+
+	doRequest(routerA, "DELETE", "/admin/aliases/plans", "", nil)
+	waitFor(t, 2*time.Second, func() bool { _, ok := serverB.aliases.Resolve("plans"); return !ok })
+}
+
+func TestAliasRejectsCyclesAndChains(t *testing.T) {
+	_, redisClient := newTestRedis(t)
+	router := newTestServer(t, testConfig(), redisClient).Router()
+	for _, page := range []string{"pricing", "about"} {
+		doRequest(router, "GET", "/visit/"+page, "", nil)
+	}
+	if w := doRequest(router, "PUT", "/admin/aliases/plans", `{"target":"pricing"}`, nil); w.Code != http.StatusOK {
+		t.Fatalf("Set alias: %d %s", w.Code, w.Body.String())
+	}
+
+	for _, tt := range []struct {
+		alias, target string
+		status        int
+		code          string
+	}{
+		{"pricing", "pricing", http.StatusConflict, "alias_cycle"},
+		{"fees", "plans", http.StatusConflict, "alias_chain"},
+		{"pricing", "about", http.StatusConflict, "alias_chain"},
+		{"about", "pricing", http.StatusConflict, "page_exists"},
+		{"team", "nowhere", http.StatusNotFound, "not_found"},
+	} {
+		w := doRequest(router, "PUT", "/admin/aliases/"+tt.alias, `{"target":"`+tt.target+`"}`, nil)
+		var resp ErrorResponse
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		if w.Code != tt.status || resp.Code != tt.code {
+			t.Errorf("Expected %s -> %s rejected with %d %s, got %d: %s", tt.alias, tt.target, tt.status, tt.code, w.Code, w.Body.String())
+		}
+	}
+
+	// A cycle through an existing alias is caught before it is a chain
+	if err := redisClient.client.HSet(context.Background(), pageAliasesKey, "pricing-old", "plans").Err(); err != nil {
+		t.Fatal(err)
+	}
+	w := doRequest(router, "PUT", "/admin/aliases/plans", `{"target":"pricing-old"}`, nil)
+	if !strings.Contains(w.Body.String(), `"code":"alias_cycle"`) {
+		t.Errorf("Expected a two-alias cycle rejected, got %d: %s", w.Code, w.Body.String())
+	}
+	redisClient.client.HDel(context.Background(), pageAliasesKey, "pricing-old")
+
+	// Re-pointing an alias is allowed
+	if w := doRequest(router, "PUT", "/admin/aliases/plans", `{"target":"about"}`, nil); w.Code != http.StatusOK {
+		t.Errorf("Expected the alias re-pointed, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := doRequest(router, "PUT", "/admin/aliases/plans", `{}`, nil); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected a missing target rejected, got %d", w.Code)
+	}
+}
+
+func TestAliasDanglingAfterDelete(t *testing.T) {
+	_, redisClient := newTestRedis(t)
+	router := newTestServer(t, testConfig(), redisClient).Router()
+	for _, page := range []string{"pricing", "about"} {
+		doRequest(router, "GET", "/visit/"+page, "", nil)
+	}
+	for alias, target := range map[string]string{"plans": "pricing", "fees": "pricing", "team": "about"} {
+		if w := doRequest(router, "PUT", "/admin/aliases/"+alias, `{"target":"`+target+`"}`, nil); w.Code != http.StatusOK {
+			t.Fatalf("Set alias %s: %d %s", alias, w.Code, w.Body.String())
+		}
+	}
+
+	w := doRequest(router, "POST", "/admin/pages/batch", `{"operation":"delete","pages":["pricing"]}`, nil)
+	var batch BatchResponse
+	json.Unmarshal(w.Body.Bytes(), &batch)
+	if w.Code != http.StatusOK || len(batch.Results) != 1 {
+		t.Fatalf("Batch delete: %d %s", w.Code, w.Body.String())
+	}
+	if got := batch.Results[0].DanglingAliases; len(got) != 2 || got[0] != "fees" || got[1] != "plans" {
+		t.Errorf("Expected fees and plans reported dangling, got %v", got)
+	}
+
+	w = doRequest(router, "GET", "/admin/aliases", "", nil)
+	var list AliasListResponse
+	json.Unmarshal(w.Body.Bytes(), &list)
+	want := []PageAlias{
+		{Alias: "fees", Target: "pricing", Dangling: true},
+		{Alias: "plans", Target: "pricing", Dangling: true},
+		{Alias: "team", Target: "about"},
+	}
+	if w.Code != http.StatusOK || list.Total != 3 || len(list.Aliases) != 3 {
+		t.Fatalf("Expected 3 aliases, got %d: %s", w.Code, w.Body.String())
+	}
+	for i := range want {
+		if list.Aliases[i] != want[i] {
+			t.Errorf("Expected %+v, got %+v", want[i], list.Aliases[i])
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// CIDRMatcher checks client IPs against a set of allowed networks
+type CIDRMatcher struct {
+	networks []*net.IPNet
+	allowAll bool
+}
+
+// ParseCIDRMatcher parses a comma-separated list of IPv4/IPv6 CIDRs. An empty
+// list, 0.0.0.0/0, or ::/0 allows every address.
+func ParseCIDRMatcher(value string) (*CIDRMatcher, error) {
+	m := &CIDRMatcher{}
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q: %w", entry, err)
+		}
+		if ones, _ := network.Mask.Size(); ones == 0 {
+			m.allowAll = true
+		}
+		m.networks = append(m.networks, network)
+	}
+	if len(m.networks) == 0 {
+		m.allowAll = true
+	}
+	return m, nil
+}
+
+// Allows reports whether ip falls within one of the allowed networks
+func (m *CIDRMatcher) Allows(ip net.IP) bool {
+	if m == nil || m.allowAll {
+		return true
+	}
+	if ip == nil {
+		return false
+	}
+	for _, network := range m.networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// requireAllowedIP rejects admin requests from outside ADMIN_ALLOWED_CIDRS,
+// using the client IP resolved through the trusted proxies
+func (s *Server) requireAllowedIP(c *gin.Context) {
+	if !s.cfg.AdminAllowedCIDRs.Allows(net.ParseIP(c.ClientIP())) {
+		respondError(c, http.StatusForbidden, "ip_not_allowed", "Admin access is not allowed from this address")
+		return
+	}
+	c.Next()
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCIDRMatcher(t *testing.T) {
+	tests := []struct {
+		cidrs string
+		ip    string
+		want  bool
+	}{
+		{"10.8.0.0/16", "10.8.0.0", true},
+		{"10.8.0.0/16", "10.8.255.255", true},
+		{"10.8.0.0/16", "10.9.0.0", false},
+		{"10.8.0.0/16", "10.7.255.255", false},
+		{"10.8.0.0/16,192.168.1.10/32", "192.168.1.10", true},
+		{"10.8.0.0/16,192.168.1.10/32", "192.168.1.11", false},
+		{"2001:db8::/32", "2001:db8:ffff::1", true},
+		{"2001:db8::/32", "2001:db9::1", false},
+		{"2001:db8::/32", "10.8.0.1", false},
+		{"10.8.0.0/16", "::ffff:10.8.1.1", true},
+		{"0.0.0.0/0", "203.0.113.9", true},
+		{"0.0.0.0/0", "2001:db8::1", true},
+		{"", "203.0.113.9", true},
+		{"10.8.0.0/16", "", false},
+	}
+
+	for _, tt := range tests {
+		m, err := ParseCIDRMatcher(tt.cidrs)
+		if err != nil {
+			t.Fatalf("ParseCIDRMatcher(%q): %v", tt.cidrs, err)
+		}
+		if got := m.Allows(net.ParseIP(tt.ip)); got != tt.want {
+			t.Errorf("Allows(%q) with %q = %t, want %t", tt.ip, tt.cidrs, got, tt.want)
+		}
+	}
+}
+
+func TestParseCIDRMatcherRejectsInvalid(t *testing.T) {
+	for _, value := range []string{"10.8.0.0", "10.8.0.0/33", "office"} {
+		if _, err := ParseCIDRMatcher(value); err == nil {
+			t.Errorf("Expected error for %q", value)
+		}
+	}
+}
+
+func TestAdminAllowlistWithProxies(t *testing.T) {
+	_, redisClient := newTestRedis(t)
+	cfg := testConfig()
+	cfg.AdminAllowedCIDRs, _ = ParseCIDRMatcher("10.8.0.0/16,2001:db8::/32")
+	cfg.TrustedProxies = []string{"172.16.0.0/12"}
+	router := newTestServer(t, cfg, redisClient).Router()
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		forwarded  string
+		status     int
+	}{
+		{"direct allowed", "10.8.1.2:5000", "", http.StatusOK},
+		{"direct denied", "192.0.2.1:5000", "", http.StatusForbidden},
+		{"direct IPv6 allowed", "[2001:db8::5]:5000", "", http.StatusOK},
+		{"direct IPv6 denied", "[2001:db9::5]:5000", "", http.StatusForbidden},
+		{"trusted proxy forwards allowed", "172.16.0.1:5000", "10.8.3.4", http.StatusOK},
+		{"trusted proxy forwards denied", "172.16.0.1:5000", "192.0.2.1", http.StatusForbidden},
+		{"untrusted proxy header ignored", "192.0.2.1:5000", "10.8.3.4", http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/admin/flags", nil)
+			req.RemoteAddr = tt.remoteAddr
+			if tt.forwarded != "" {
+				req.Header.Set("X-Forwarded-For", tt.forwarded)
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			if w.Code != tt.status {
+				t.Errorf("Expected %d, got %d", tt.status, w.Code)
+			}
+		})
+	}
+
+	// Public routes are unaffected
+	req := httptest.NewRequest("GET", "/health", nil)
+	req.RemoteAddr = "192.0.2.1:5000"
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected public route to allow any IP, got %d", w.Code)
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// annotationsMaxPerPage caps the annotations kept per page; adding one
+	// past the cap drops the oldest
+	annotationsMaxPerPage = 1000
+
+	// annotationMaxLabel bounds the label length
+	annotationMaxLabel = 200
+
+	// annotationMaxFuture is how far ahead an annotation may be placed, for
+	// markers of planned launches
+	annotationMaxFuture = 24 * time.Hour
+
+	// defaultAnnotationKind is the kind of annotations posted without one
+	defaultAnnotationKind = "note"
+)
+
+// annotationKindPattern restricts kinds to short identifiers such as
+// deploy, content or incident
+var annotationKindPattern = regexp.MustCompile(`^[a-z0-9_-]{1,32}$`)
+
+// annotationsKey is the sorted set of a page's annotations, scored by
+// their time in Unix milliseconds
+func annotationsKey(page string) string {
+	return key("visits", "annotations", page)
+}
+
+// annotation is a marker on a page's timeline. Its ID keeps identical
+// markers apart in the sorted set.
+type annotation struct {
+	ID    string    `json:"id"`
+	Label string    `json:"label"`
+	Kind  string    `json:"kind"`
+	Time  time.Time `json:"-"`
+}
+
+// AddAnnotation stores an annotation, dropping the page's oldest ones past
+// annotationsMaxPerPage
+func (r *RedisClient) AddAnnotation(ctx context.Context, page string, a annotation) error {
+	member, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+	_, err = r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.ZAdd(ctx, annotationsKey(page), redis.Z{Score: float64(a.Time.UnixMilli()), Member: member})
+		pipe.ZRemRangeByRank(ctx, annotationsKey(page), 0, -annotationsMaxPerPage-1)
+		return nil
+	})
+	return err
+}
+
+// Annotations returns the page's annotations from from to to (inclusive),
+// oldest first; a zero bound is open
+func (r *RedisClient) Annotations(ctx context.Context, page string, from, to time.Time) ([]annotation, error) {
+	by := &redis.ZRangeBy{Min: "-inf", Max: "+inf"}
+	if !from.IsZero() {
+		by.Min = strconv.FormatInt(from.UnixMilli(), 10)
+	}
+	if !to.IsZero() {
+		by.Max = strconv.FormatInt(to.UnixMilli(), 10)
+	}
+	entries, err := r.client.ZRangeByScoreWithScores(ctx, annotationsKey(page), by).Result()
+	if err != nil {
+		return nil, err
+	}
+	return decodeAnnotations(page, entries), nil
+}
+
+// decodeAnnotations decodes annotation set entries, dropping malformed ones
+func decodeAnnotations(page string, entries []redis.Z) []annotation {
+	annotations := make([]annotation, 0, len(entries))
+	for _, e := range entries {
+		member, _ := e.Member.(string)
+		var a annotation
+		if err := json.Unmarshal([]byte(member), &a); err != nil {
+			log.Printf("Dropping malformed annotation of %s: %v", page, err)
+			continue
+		}
+		a.Time = time.UnixMilli(int64(e.Score)).UTC()
+		annotations = append(annotations, a)
+	}
+	return annotations
+}
+
+// AnnotationRequest adds an annotation at Timestamp. Kind defaults to
+// "note".
+type AnnotationRequest struct {
+	Timestamp *Timestamp `json:"timestamp"`
+	Label     string     `json:"label"`
+	Kind      string     `json:"kind"`
+}
+
+// Annotation is an annotation in API responses
+type Annotation struct {
+	ID        string    `json:"id"`
+	Timestamp Timestamp `json:"timestamp"`
+	Label     string    `json:"label"`
+	Kind      string    `json:"kind"`
+}
+
+// AnnotationsResponse represents the annotations API response
+type AnnotationsResponse struct {
+	Page        string       `json:"page"`
+	Annotations []Annotation `json:"annotations"`
+}
+
+// annotationResponses converts stored annotations for a response
+func annotationResponses(c *gin.Context, annotations []annotation) []Annotation {
+	out := make([]Annotation, len(annotations))
+	for i, a := range annotations {
+		out[i] = Annotation{ID: a.ID, Timestamp: stamp(c, a.Time), Label: a.Label, Kind: a.Kind}
+	}
+	return out
+}
+
+// parseTimeBound reads an annotation range bound, a YYYY-MM-DD date or an
+// RFC3339 time. A date as the upper bound covers the whole day.
+func parseTimeBound(value string, upper bool) (time.Time, bool) {
+	if value == "" {
+		return time.Time{}, true
+	}
+	if day, err := time.Parse(dayLayout, value); err == nil {
+		if upper {
+			return day.Add(24*time.Hour - time.Millisecond), true
+		}
+		return day, true
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	return t, err == nil
+}
+
+// handleAddAnnotation adds an annotation to a page's timeline
+func (s *Server) handleAddAnnotation(c *gin.Context) {
+	page := c.Param("page")
+	var req AnnotationRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondError(c, http.StatusBadRequest, "invalid_request", "Body must be an annotation object")
+		return
+	}
+	if req.Timestamp == nil || req.Timestamp.Time.IsZero() {
+		respondError(c, http.StatusBadRequest, "invalid_request", "timestamp is required")
+		return
+	}
+	at := req.Timestamp.Time.UTC()
+	if at.Before(time.Unix(0, 0)) || at.After(s.clock.Now().Add(annotationMaxFuture)) {
+		respondError(c, http.StatusBadRequest, "invalid_request",
+			fmt.Sprintf("timestamp must be after 1970 and at most %s ahead", annotationMaxFuture))
+		return
+	}
+	if req.Label == "" || len(req.Label) > annotationMaxLabel {
+		respondError(c, http.StatusBadRequest, "invalid_request", fmt.Sprintf("label must be 1 to %d bytes", annotationMaxLabel))
+		return
+	}
+	if req.Kind == "" {
+		req.Kind = defaultAnnotationKind
+	}
+	if !annotationKindPattern.MatchString(req.Kind) {
+		respondError(c, http.StatusBadRequest, "invalid_request", "kind must be up to 32 lowercase letters, digits, '_' or '-'")
+		return
+	}
+
+	id, err := newVisitorID()
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, "internal_error", "Failed to add annotation")
+		return
+	}
+	a := annotation{ID: id, Label: req.Label, Kind: req.Kind, Time: at.Truncate(time.Millisecond)}
+	if err := s.redis.AddAnnotation(c.Request.Context(), page, a); err != nil {
+		log.Printf("Error adding annotation: %v", err)
+		respondStoreError(c, err, "Failed to add annotation")
+		return
+	}
+	respondJSON(c, http.StatusCreated, annotationResponses(c, []annotation{a})[0])
+}
+
+// handleGetAnnotations lists a page's annotations between the optional from
+// and to bounds
+func (s *Server) handleGetAnnotations(c *gin.Context) {
+	page := c.Param("page")
+	from, okFrom := parseTimeBound(c.Query("from"), false)
+	to, okTo := parseTimeBound(c.Query("to"), true)
+	if !okFrom || !okTo || (!from.IsZero() && !to.IsZero() && to.Before(from)) {
+		respondError(c, http.StatusBadRequest, "invalid_request", "from and to must be YYYY-MM-DD dates or RFC3339 times with from <= to")
+		return
+	}
+
+	hidden, err := s.pageHidden(c, page)
+	if err != nil {
+		log.Printf("Error getting page metadata: %v", err)
+		respondStoreError(c, err, "Failed to get annotations")
+		return
+	}
+	if hidden {
+		respondError(c, http.StatusNotFound, "not_found", "Page not found")
+		return
+	}
+
+	annotations, err := s.redis.Annotations(c.Request.Context(), page, from, to)
+	if err != nil {
+		log.Printf("Error getting annotations: %v", err)
+		respondStoreError(c, err, "Failed to get annotations")
+		return
+	}
+	respondJSON(c, http.StatusOK, AnnotationsResponse{Page: page, Annotations: annotationResponses(c, annotations)})
+}
+
+// rangeAnnotations returns the annotations within the days of a range
+// response, so dashboards can overlay them on the points
+func (s *Server) rangeAnnotations(c *gin.Context, page string, from, to time.Time) ([]Annotation, error) {
+	annotations, err := s.redis.Annotations(c.Request.Context(), page, from, to.Add(24*time.Hour-time.Millisecond))
+	if err != nil {
+		return nil, err
+	}
+	return annotationResponses(c, annotations), nil
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"go-redis-app/internal/clocktest"
+)
+
+// getAnnotations lists a page's annotations with query
+func getAnnotations(t *testing.T, router http.Handler, page, query string) []Annotation {
+	t.Helper()
+	w := doRequest(router, "GET", "/pages/"+page+"/annotations"+query, "", nil)
+	var resp AnnotationsResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("Expected the annotations, got %d: %s", w.Code, w.Body.String())
+	}
+	return resp.Annotations
+}
+
+func TestAnnotationsRange(t *testing.T) {
+	_, redisClient := newTestRedis(t)
+	clock := clocktest.New(time.Date(2024, 3, 10, 12, 0, 0, 0, time.UTC))
+	router := newTestServerWithClock(t, testConfig(), redisClient, clock).Router()
+
+	for _, body := range []string{
+		`{"timestamp": "2024-03-02T14:02:00Z", "label": "Shipped the launch post", "kind": "content"}`,
+		`{"timestamp": "2024-03-01T09:00:00Z", "label": "v1.4.0", "kind": "deploy"}`,
+		`{"timestamp": 1709596800, "label": "Unix seconds"}`,
+	} {
+		if w := doRequest(router, "POST", "/admin/pages/blog/annotations", body, nil); w.Code != http.StatusCreated {
+			t.Fatalf("Expected the annotation added, got %d: %s", w.Code, w.Body.String())
+		}
+	}
+
+	all := getAnnotations(t, router, "blog", "")
+	if len(all) != 3 || all[0].Label != "v1.4.0" || all[1].Kind != "content" || all[2].Kind != defaultAnnotationKind || all[0].ID == "" {
+		t.Fatalf("Expected every annotation oldest first, got %+v", all)
+	}
+	if !all[1].Timestamp.Time.Equal(time.Date(2024, 3, 2, 14, 2, 0, 0, time.UTC)) {
+		t.Errorf("Expected the posted time, got %s", all[1].Timestamp.Time)
+	}
+	for query, want := range map[string]int{
+		"?from=2024-03-02":                         2,
+		"?to=2024-03-02":                           2, // the whole of the last day
+		"?from=2024-03-02T15:00:00Z&to=2024-03-05": 1,
+		"?from=2024-03-06":                         0,
+		"?from=2024-03-01T09:00:00Z&to=2024-03-01": 1,
+	} {
+		if got := getAnnotations(t, router, "blog", query); len(got) != want {
+			t.Errorf("Expected %d annotations for %s, got %+v", want, query, got)
+		}
+	}
+	if got := getAnnotations(t, router, "home", ""); len(got) != 0 {
+		t.Errorf("Expected no annotations on another page, got %+v", got)
+	}
+
+	for _, body := range []string{
+		`{"label": "no time"}`,
+		`{"timestamp": "2024-03-12T12:00:00Z", "label": "too far ahead"}`,
+		`{"timestamp": "yesterday", "label": "unparsable"}`,
+		`{"timestamp": "2024-03-01T00:00:00Z", "label": ""}`,
+		`{"timestamp": "2024-03-01T00:00:00Z", "label": "x", "kind": "Deploy!"}`,
+	} {
+		if w := doRequest(router, "POST", "/admin/pages/blog/annotations", body, nil); w.Code != http.StatusBadRequest {
+			t.Errorf("Expected 400 for %s, got %d", body, w.Code)
+		}
+	}
+	if w := doRequest(router, "GET", "/pages/blog/annotations?from=2024-03-05&to=2024-03-01", "", nil); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an inverted range, got %d", w.Code)
+	}
+}
+
+func TestAnnotationsAdminOnly(t *testing.T) {
+	_, redisClient := newTestRedis(t)
+	cfg := testConfig()
+	cfg.AdminAPIKeys = map[string]string{"secret": "ops"}
+	router := newTestServer(t, cfg, redisClient).Router()
+	body := `{"timestamp": "2024-03-02T14:02:00Z", "label": "Launch"}`
+
+	if w := doRequest(router, "POST", "/pages/blog/annotations", body, nil); w.Code != http.StatusNotFound {
+		t.Errorf("Expected no public annotation route, got %d", w.Code)
+	}
+	if w := doRequest(router, "POST", "/admin/pages/blog/annotations", body, nil); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected an admin key required, got %d", w.Code)
+	}
+	if w := doRequest(router, "POST", "/admin/pages/blog/annotations", body, map[string]string{"X-API-Key": "secret"}); w.Code != http.StatusCreated {
+		t.Errorf("Expected the annotation added with the key, got %d: %s", w.Code, w.Body.String())
+	}
+	if got := getAnnotations(t, router, "blog", ""); len(got) != 1 || got[0].Label != "Launch" {
+		t.Errorf("Expected the annotation readable, got %+v", got)
+	}
+}
+
+func TestAnnotationsCap(t *testing.T) {
+	_, redisClient := newTestRedis(t)
+	ctx := context.Background()
+	start := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < annotationsMaxPerPage+5; i++ {
+		a := annotation{ID: fmt.Sprint(i), Label: "deploy", Kind: "deploy", Time: start.Add(time.Duration(i) * time.Minute)}
+		if err := redisClient.AddAnnotation(ctx, "home", a); err != nil {
+			t.Fatalf("Failed to add annotation: %v", err)
+		}
+	}
+	annotations, err := redisClient.Annotations(ctx, "home", time.Time{}, time.Time{})
+	if err != nil || len(annotations) != annotationsMaxPerPage || annotations[0].ID != "5" {
+		t.Errorf("Expected the oldest 5 dropped, got %d starting at %+v, %v", len(annotations), annotations[0], err)
+	}
+}
+
+func TestRangeIncludesAnnotations(t *testing.T) {
+	_, redisClient := newTestRedis(t)
+	redisClient.client.Set(context.Background(), dailyKey("blog", parseDay("2024-03-02")), 40, 0)
+	router := newTestServer(t, testConfig(), redisClient).Router()
+	doRequest(router, "POST", "/admin/pages/blog/annotations", `{"timestamp": "2024-03-02T14:02:00Z", "label": "Launch post", "kind": "content"}`, nil)
+	doRequest(router, "POST", "/admin/pages/blog/annotations", `{"timestamp": "2024-03-04T00:00:00Z", "label": "Later"}`, nil)
+
+	w := doRequest(router, "GET", "/visits/blog/range?from=2024-03-01&to=2024-03-03", "", nil)
+	var resp RangeResponse
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if w.Code != http.StatusOK || resp.Total != 40 || len(resp.Annotations) != 1 || resp.Annotations[0].Label != "Launch post" {
+		t.Errorf("Expected the range with its one annotation, got %d: %s", w.Code, w.Body.String())
+	}
+	w = doRequest(router, "GET", "/visits/home/range?from=2024-03-01&to=2024-03-03", "", nil)
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if resp.Annotations == nil || len(resp.Annotations) != 0 {
+		t.Errorf("Expected an empty annotations list, got %s", w.Body.String())
+	}
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// minuteBucketTTL keeps minute buckets past the longest ANOMALY_WINDOW
+	minuteBucketTTL = 2 * time.Hour
+
+	// anomalyBaselinesKey maps pages to their JSON AnomalyBaseline
+	anomalyBaselinesKey = "anomaly:baselines"
+
+	// anomalyFlaggedKey maps flagged pages to when, in Unix ms, their
+	// anomaly began
+	anomalyFlaggedKey = "anomaly:flagged"
+
+	// anomalyLockKey keeps replicas from analyzing the same interval
+	anomalyLockKey = "anomaly:lock"
+
+	// anomalyBatchSize is how many pages are analyzed per round trip
+	anomalyBatchSize = 200
+
+	// anomalyAlpha is the weight of each new rate in the EWMA baseline
+	anomalyAlpha = 0.2
+
+	// anomalyWarmup is the number of rates a baseline needs before its page
+	// can be flagged
+	anomalyWarmup = 3
+)
+
+// minuteKey holds one hour of a page's visits, with UTC minute fields
+func minuteKey(page string, t time.Time) string {
+	return key("visits", page, "minutes", t.UTC().Format("2006-01-02T15"))
+}
+
+// queueMinute adds a visit's minute bucket update to the pipeline
+func queueMinute(ctx context.Context, pipe redis.Pipeliner, page string, now time.Time, weight int64) {
+	pipe.HIncrBy(ctx, minuteKey(page, now), strconv.Itoa(now.UTC().Minute()), weight)
+	pipe.Expire(ctx, minuteKey(page, now), minuteBucketTTL)
+}
+
+// queueMinuteRate adds the reads of a page's minute buckets for the window
+// minutes before now's minute to the pipeline, for minuteRate
+func queueMinuteRate(ctx context.Context, pipe redis.Pipeliner, page string, now time.Time, window int) []*redis.StringCmd {
+	buckets := make([]*redis.StringCmd, window)
+	current := now.UTC().Truncate(time.Minute)
+	for m := range buckets {
+		minute := current.Add(-time.Duration(m+1) * time.Minute)
+		buckets[m] = pipe.HGet(ctx, minuteKey(page, minute), strconv.Itoa(minute.Minute()))
+	}
+	return buckets
+}
+
+// minuteRate returns the visits a minute of the read minute buckets
+func minuteRate(buckets []*redis.StringCmd) float64 {
+	var visits int64
+	for _, bucket := range buckets {
+		n, _ := bucket.Int64()
+		visits += n
+	}
+	return float64(visits) / float64(len(buckets))
+}
+
+// AnomalyBaseline is a page's rolling visit rate, in visits a minute
+type AnomalyBaseline struct {
+	Rate    float64 `json:"rate"`
+	Samples int64   `json:"samples"`
+}
+
+// AnomalyModel compares a page's recent visit rate with its baseline, an
+// exponentially weighted moving average of the rates before it
+type AnomalyModel struct {
+	Alpha     float64
+	Threshold float64
+	MinRate   float64
+	Warmup    int64
+}
+
+// Observe reports whether rate is anomalous for baseline, Threshold times
+// it or more and at least MinRate, and returns the baseline to keep. A
+// baseline with fewer than Warmup samples never flags. Anomalous rates are
+// left out of the baseline, so a spike doesn't raise it and a page stays
+// flagged until its traffic drops back under the threshold.
+func (m AnomalyModel) Observe(baseline AnomalyBaseline, rate float64) (AnomalyBaseline, bool) {
+	if baseline.Samples >= m.Warmup && rate >= m.MinRate && rate >= m.Threshold*baseline.Rate {
+		return baseline, true
+	}
+	if baseline.Samples == 0 {
+		baseline.Rate = rate
+	} else {
+		baseline.Rate = m.Alpha*rate + (1-m.Alpha)*baseline.Rate
+	}
+	baseline.Samples++
+	return baseline, false
+}
+
+// AnomalyAlert is the payload posted to ALERT_WEBHOOK_URL when a page is
+// flagged or its traffic goes back to normal
+type AnomalyAlert struct {
+	Event     string    `json:"event"`
+	Env       string    `json:"env,omitempty"`
+	Page      string    `json:"page"`
+	Rate      float64   `json:"rate"`
+	Baseline  float64   `json:"baseline"`
+	Threshold float64   `json:"threshold"`
+	Since     time.Time `json:"since"`
+}
+
+// AnomalyReport summarizes one analysis
+type AnomalyReport struct {
+	Analyzed int
+	Flagged  int
+	Cleared  int
+}
+
+// AnomalyDetector flags pages whose visit rate spikes over their baseline
+type AnomalyDetector struct {
+	model  AnomalyModel
+	window int
+	env    string
+	alert  *Webhook
+
+	flagged  atomic.Int64
+	detected atomic.Int64
+}
+
+// newAnomalyDetector creates the detector from cfg, alerting to alert, or
+// returns nil when ANOMALY_INTERVAL is 0
+func newAnomalyDetector(cfg Config, alert *Webhook) *AnomalyDetector {
+	if cfg.AnomalyInterval <= 0 {
+		return nil
+	}
+	return &AnomalyDetector{
+		model:  AnomalyModel{Alpha: anomalyAlpha, Threshold: cfg.AnomalyThreshold, MinRate: cfg.AnomalyMinRate, Warmup: anomalyWarmup},
+		window: int(cfg.AnomalyWindow / time.Minute),
+		env:    cfg.EnvName,
+		alert:  alert,
+	}
+}
+
+// anomalyState is what a batch of pages needs to be analyzed
+type anomalyState struct {
+	rates     []float64
+	baselines []AnomalyBaseline
+}
+
+// AnomalyPages returns the pages to analyze: those visited since since and
+// those flagged, which are rechecked until they clear, with when each
+// flagged page's anomaly began
+func (r *RedisClient) AnomalyPages(ctx context.Context, since time.Time) ([]string, map[string]time.Time, error) {
+	pipe := r.client.Pipeline()
+	active := pipe.ZRangeByScore(ctx, lastVisitKey, &redis.ZRangeBy{Min: strconv.FormatInt(since.UnixMilli(), 10), Max: "+inf"})
+	flaggedCmd := pipe.HGetAll(ctx, anomalyFlaggedKey)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, nil, err
+	}
+	pages := active.Val()
+	flagged := make(map[string]time.Time, len(flaggedCmd.Val()))
+	seen := make(map[string]bool, len(pages))
+	for _, page := range pages {
+		seen[page] = true
+	}
+	for page, ms := range flaggedCmd.Val() {
+		at, _ := strconv.ParseInt(ms, 10, 64)
+		flagged[page] = time.UnixMilli(at).UTC()
+		if !seen[page] {
+			pages = append(pages, page)
+		}
+	}
+	return pages, flagged, nil
+}
+
+// AnomalyState reads the visit rate of each page over the window minutes
+// before now's minute, and its baseline
+func (r *RedisClient) AnomalyState(ctx context.Context, pages []string, now time.Time, window int) (anomalyState, error) {
+	pipe := r.client.Pipeline()
+	baselines := pipe.HMGet(ctx, anomalyBaselinesKey, pages...)
+	buckets := make([][]*redis.StringCmd, len(pages))
+	for i, page := range pages {
+		buckets[i] = queueMinuteRate(ctx, pipe, page, now, window)
+	}
+	if _, err := pipe.Exec(ctx); ignoreMissing(err) != nil {
+		return anomalyState{}, err
+	}
+
+	state := anomalyState{rates: make([]float64, len(pages)), baselines: make([]AnomalyBaseline, len(pages))}
+	for i := range pages {
+		state.rates[i] = minuteRate(buckets[i])
+		if raw, ok := baselines.Val()[i].(string); ok {
+			json.Unmarshal([]byte(raw), &state.baselines[i])
+		}
+	}
+	return state, nil
+}
+
+// SaveAnomalies stores baselines and sets or clears flags
+func (r *RedisClient) SaveAnomalies(ctx context.Context, baselines map[string]AnomalyBaseline, flag map[string]time.Time, clear []string) error {
+	pipe := r.client.Pipeline()
+	if len(baselines) > 0 {
+		values := make([]interface{}, 0, 2*len(baselines))
+		for page, baseline := range baselines {
+			b, err := json.Marshal(baseline)
+			if err != nil {
+				return err
+			}
+			values = append(values, page, string(b))
+		}
+		pipe.HSet(ctx, anomalyBaselinesKey, values...)
+	}
+	for page, since := range flag {
+		pipe.HSet(ctx, anomalyFlaggedKey, page, since.UnixMilli())
+	}
+	if len(clear) > 0 {
+		pipe.HDel(ctx, anomalyFlaggedKey, clear...)
+	}
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// analyzeAnomalies compares the recent visit rate of every page visited
+// since the last analysis, or still flagged, with its baseline. Pages
+// crossing the threshold are flagged, so their metadata is served with
+// traffic_anomaly, and alerted on, and lose the flag once their rate drops
+// back. Approximate pages have
+// no last visit, so they are not analyzed.
+func (s *Server) analyzeAnomalies(ctx context.Context, now time.Time) (AnomalyReport, error) {
+	d := s.anomalies
+	since := now.Add(-max(s.cfg.AnomalyInterval, s.cfg.AnomalyWindow))
+	pages, flagged, err := s.redis.AnomalyPages(ctx, since)
+	if err != nil {
+		return AnomalyReport{}, err
+	}
+
+	report := AnomalyReport{Analyzed: len(pages)}
+	for start := 0; start < len(pages); start += anomalyBatchSize {
+		batch := pages[start:min(start+anomalyBatchSize, len(pages))]
+		state, err := s.redis.AnomalyState(ctx, batch, now, d.window)
+		if err != nil {
+			return report, err
+		}
+		baselines := make(map[string]AnomalyBaseline, len(batch))
+		flag := make(map[string]time.Time)
+		var clear []int
+		for i, page := range batch {
+			baseline, anomalous := d.model.Observe(state.baselines[i], state.rates[i])
+			baselines[page] = baseline
+			_, wasFlagged := flagged[page]
+			switch {
+			case anomalous && !wasFlagged:
+				flag[page] = now
+			case !anomalous && wasFlagged:
+				clear = append(clear, i)
+			}
+		}
+		cleared := make([]string, len(clear))
+		for n, i := range clear {
+			cleared[n] = batch[i]
+		}
+		if err := s.redis.SaveAnomalies(ctx, baselines, flag, cleared); err != nil {
+			return report, err
+		}
+
+		for i, page := range batch {
+			if _, ok := flag[page]; !ok {
+				continue
+			}
+			report.Flagged++
+			d.detected.Add(1)
+			log.Printf("Flagged %s for a traffic anomaly: %.1f visits a minute against a baseline of %.1f", page, state.rates[i], state.baselines[i].Rate)
+			d.alert.Alert("Traffic anomaly", d.anomalyAlert("page.traffic_anomaly", page, state.rates[i], state.baselines[i].Rate, now))
+		}
+		for _, i := range clear {
+			page := batch[i]
+			report.Cleared++
+			log.Printf("Cleared the traffic anomaly flag of %s: %.1f visits a minute", page, state.rates[i])
+			d.alert.Alert("Traffic anomaly", d.anomalyAlert("page.traffic_normalized", page, state.rates[i], baselines[page].Rate, flagged[page]))
+		}
+	}
+	d.flagged.Store(int64(len(flagged) + report.Flagged - report.Cleared))
+	return report, nil
+}
+
+// anomalyAlert returns the alert for event on page, whose anomaly began at
+// since
+func (d *AnomalyDetector) anomalyAlert(event, page string, rate, baseline float64, since time.Time) AnomalyAlert {
+	return AnomalyAlert{Event: event, Env: d.env, Page: page, Rate: rate, Baseline: baseline, Threshold: d.model.Threshold, Since: since}
+}
+
+// anomalyWorker is the periodic anomaly analysis. The lock is left to
+// expire just before the next run, so only one replica analyzes each
+// interval and every baseline moves once per interval.
+func (s *Server) anomalyWorker(ctx context.Context) error {
+	_, ok, err := s.redis.acquireLock(ctx, anomalyLockKey, s.cfg.AnomalyInterval*9/10)
+	if err != nil || !ok {
+		return err
+	}
+	_, err = s.analyzeAnomalies(ctx, s.clock.Now())
+	return err
+}
+
+// write writes the traffic_anomaly_pages and traffic_anomalies_total series
+func (d *AnomalyDetector) write(b *strings.Builder, env string) {
+	labels := ""
+	if env != "" {
+		labels = "{env=" + strconv.Quote(env) + "}"
+	}
+	b.WriteString("# HELP traffic_anomaly_pages Pages flagged for a traffic anomaly as of this replica's last analysis.\n")
+	b.WriteString("# TYPE traffic_anomaly_pages gauge\n")
+	fmt.Fprintf(b, "traffic_anomaly_pages%s %d\n", labels, d.flagged.Load())
+	b.WriteString("# HELP traffic_anomalies_total Pages flagged for a traffic anomaly by this replica.\n")
+	b.WriteString("# TYPE traffic_anomalies_total counter\n")
+	fmt.Fprintf(b, "traffic_anomalies_total%s %d\n", labels, d.detected.Load())
+}
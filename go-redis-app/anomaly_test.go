@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go-redis-app/internal/clocktest"
+)
+
+func TestAnomalyModelObserve(t *testing.T) {
+	model := AnomalyModel{Alpha: 0.5, Threshold: 10, MinRate: 1, Warmup: 3}
+	tests := []struct {
+		name      string
+		baseline  AnomalyBaseline
+		rate      float64
+		want      AnomalyBaseline
+		anomalous bool
+	}{
+		{"first rate sets the baseline", AnomalyBaseline{}, 4, AnomalyBaseline{Rate: 4, Samples: 1}, false},
+		{"later rates are averaged", AnomalyBaseline{Rate: 4, Samples: 1}, 8, AnomalyBaseline{Rate: 6, Samples: 2}, false},
+		{"spike while warming up", AnomalyBaseline{Rate: 2, Samples: 2}, 100, AnomalyBaseline{Rate: 51, Samples: 3}, false},
+		{"spike", AnomalyBaseline{Rate: 2, Samples: 3}, 20, AnomalyBaseline{Rate: 2, Samples: 3}, true},
+		{"just under the threshold", AnomalyBaseline{Rate: 2, Samples: 3}, 19.9, AnomalyBaseline{Rate: 10.95, Samples: 4}, false},
+		{"spike under the minimum rate", AnomalyBaseline{Rate: 0.05, Samples: 3}, 0.75, AnomalyBaseline{Rate: 0.4, Samples: 4}, false},
+		{"traffic on a silent page", AnomalyBaseline{Rate: 0, Samples: 5}, 1, AnomalyBaseline{Rate: 0, Samples: 5}, true},
+		{"silence", AnomalyBaseline{Rate: 0, Samples: 5}, 0, AnomalyBaseline{Rate: 0, Samples: 6}, false},
+	}
+	for _, tt := range tests {
+		got, anomalous := model.Observe(tt.baseline, tt.rate)
+		if got != tt.want || anomalous != tt.anomalous {
+			t.Errorf("%s: Observe(%+v, %v) = %+v, %v, want %+v, %v", tt.name, tt.baseline, tt.rate, got, anomalous, tt.want, tt.anomalous)
+		}
+	}
+}
+
+func TestAnomalyDetection(t *testing.T) {
+	var mu sync.Mutex
+	var alerts []AnomalyAlert
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var alert AnomalyAlert
+		json.NewDecoder(r.Body).Decode(&alert)
+		mu.Lock()
+		alerts = append(alerts, alert)
+		mu.Unlock()
+	}))
+	defer hook.Close()
+	received := func() []AnomalyAlert {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]AnomalyAlert(nil), alerts...)
+	}
+
+	mr, redisClient := newTestRedis(t)
+	clock := clocktest.New(time.Date(2024, 5, 1, 12, 0, 30, 0, time.UTC))
+	cfg := testConfig()
+	cfg.AnomalyInterval, cfg.AnomalyWindow, cfg.AnomalyThreshold, cfg.AnomalyMinRate = time.Hour, 5*time.Minute, 10, 1
+	cfg.AlertWebhookURL = hook.URL
+	server := newTestServerWithClock(t, cfg, redisClient, clock)
+	router := server.Router()
+	ctx := context.Background()
+
+	// Visits count in their minute's bucket
+	doRequest(router, "GET", "/visit/home", "", nil)
+	if got := mr.HGet(minuteKey("home", clock.Now()), "0"); got != "1" {
+		t.Fatalf("Expected the visit in the 12:00 bucket, got %q", got)
+	}
+
+	// traffic fills the window before the current minute with perMinute
+	// visits to home in each minute
+	traffic := func(perMinute int) {
+		t.Helper()
+		now := clock.Now().UTC().Truncate(time.Minute)
+		for m := 1; m <= 5; m++ {
+			minute := now.Add(-time.Duration(m) * time.Minute)
+			mr.HSet(minuteKey("home", minute), strconv.Itoa(minute.Minute()), strconv.Itoa(perMinute))
+		}
+		mr.ZAdd(lastVisitKey, float64(clock.Now().UnixMilli()), "home")
+	}
+	analyze := func(perMinute int) AnomalyReport {
+		t.Helper()
+		clock.Advance(5 * time.Minute)
+		traffic(perMinute)
+		report, err := server.analyzeAnomalies(ctx, clock.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return report
+	}
+	flagged := func() bool {
+		t.Helper()
+		var meta PageMeta
+		w := doRequest(router, "GET", "/pages/home/meta", "", nil)
+		if err := json.Unmarshal(w.Body.Bytes(), &meta); err != nil || w.Code != http.StatusOK {
+			t.Fatalf("Expected the metadata, got %d: %s", w.Code, w.Body.String())
+		}
+		return meta.TrafficAnomaly
+	}
+
+	// The baseline warms up at 2 visits a minute
+	for i := 0; i < anomalyWarmup; i++ {
+		if report := analyze(2); report.Analyzed != 1 || report.Flagged != 0 {
+			t.Fatalf("Expected home analyzed and not flagged, got %+v", report)
+		}
+	}
+
+	// 30 a minute is 15 times the baseline
+	if report := analyze(30); report.Flagged != 1 {
+		t.Fatalf("Expected home flagged, got %+v", report)
+	}
+	if !flagged() {
+		t.Error("Expected traffic_anomaly in the metadata")
+	}
+	doRequest(router, "PUT", "/admin/pages/home/meta", `{"title": "Home", "traffic_anomaly": false}`, nil)
+	if !flagged() {
+		t.Error("Expected traffic_anomaly kept across a metadata write")
+	}
+	waitFor(t, time.Second, func() bool { return len(received()) == 1 })
+	if got := received()[0]; got.Event != "page.traffic_anomaly" || got.Page != "home" || got.Rate != 30 || got.Baseline != 2 {
+		t.Errorf("Expected an anomaly alert for home, got %+v", got)
+	}
+	w := doRequest(router, "GET", "/metrics", "", nil)
+	if !strings.Contains(w.Body.String(), "traffic_anomaly_pages 1") || !strings.Contains(w.Body.String(), "traffic_anomalies_total 1") {
+		t.Errorf("Expected the anomaly counted in metrics, got:\n%s", w.Body.String())
+	}
+
+	// A sustained spike is one anomaly, and doesn't raise the baseline
+	if report := analyze(30); report.Flagged != 0 || report.Cleared != 0 {
+		t.Errorf("Expected no change while the spike lasts, got %+v", report)
+	}
+	state, err := redisClient.AnomalyState(ctx, []string{"home"}, clock.Now(), 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.baselines[0].Rate != 2 {
+		t.Errorf("Expected the baseline held at 2, got %+v", state.baselines[0])
+	}
+
+	// Flagged pages are rechecked even once their visits stop
+	clock.Advance(2 * time.Hour)
+	report, err := server.analyzeAnomalies(ctx, clock.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Analyzed != 1 || report.Cleared != 1 {
+		t.Fatalf("Expected home cleared, got %+v", report)
+	}
+	if flagged() {
+		t.Error("Expected traffic_anomaly cleared from the metadata")
+	}
+	waitFor(t, time.Second, func() bool { return len(received()) == 2 })
+	if got := received()[1]; got.Event != "page.traffic_normalized" || got.Page != "home" || got.Rate != 0 {
+		t.Errorf("Expected a normalized alert for home, got %+v", got)
+	}
+	w = doRequest(router, "GET", "/metrics", "", nil)
+	if !strings.Contains(w.Body.String(), "traffic_anomaly_pages 0") {
+		t.Errorf("Expected no flagged pages in metrics, got:\n%s", w.Body.String())
+	}
+}
+
+func TestAnomalyWorkerLock(t *testing.T) {
+	mr, redisClient := newTestRedis(t)
+	cfg := testConfig()
+	cfg.AnomalyInterval, cfg.AnomalyWindow, cfg.AnomalyThreshold, cfg.AnomalyMinRate = time.Hour, 5*time.Minute, 10, 1
+	server := newTestServer(t, cfg, redisClient)
+	doRequest(server.Router(), "GET", "/visit/home", "", nil)
+
+	if err := server.anomalyWorker(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if !mr.Exists(anomalyLockKey) || mr.HGet(anomalyBaselinesKey, "home") == "" {
+		t.Fatal("Expected the analysis run under the lock")
+	}
+	// Another replica in the same interval skips it
+	mr.HDel(anomalyBaselinesKey, "home")
+	if err := server.anomalyWorker(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if mr.HGet(anomalyBaselinesKey, "home") != "" {
+		t.Error("Expected the locked interval skipped")
+	}
+}
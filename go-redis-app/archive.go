@@ -0,0 +1,395 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// archivedPagesKey maps archived page names to their ArchivedPage record
+	archivedPagesKey = "visits:archived"
+
+	// archivePrefix is prepended to the keys of archived pages
+	archivePrefix = "archive:"
+)
+
+var (
+	errPageNotFound    = newKindError(ErrNotFound, "page not found")
+	errAlreadyArchived = newKindError(ErrConflict, "page is already archived")
+	errNotArchived     = newKindError(ErrNotFound, "page is not archived")
+)
+
+// ArchivedPage records an archived page and what is needed to restore it
+type ArchivedPage struct {
+	Page       string     `json:"page"`
+	Visits     int64      `json:"visits"`
+	ArchivedAt time.Time  `json:"archived_at"`
+	LastVisit  *time.Time `json:"last_visit,omitempty"`
+	Keys       []string   `json:"keys"`
+}
+
+// ArchiveListResponse represents the GET /admin/archive API response
+type ArchiveListResponse struct {
+	Pages     []ArchivedPage `json:"pages"`
+	Total     int            `json:"total"`
+	NextToken string         `json:"next_token,omitempty"`
+}
+
+// pageKeyFamilies mark the per-page keys with a variable suffix: daily,
+// monthly and hourly buckets and variant counters
+var pageKeyFamilies = []string{":daily:", ":monthly:", ":hourly:", ":variant:"}
+
+// pageFixedKeys returns the per-page keys with fixed names: the counter,
+// heatmap, pre-history, session count, weighted total, countries,
+// inter-arrival histogram and unique visitors
+func pageFixedKeys(page string) []string {
+	return []string{key("visits", page), heatmapKey(page), preHistoryKey(page), sessionsKey(page), weightedKey(page), geoKey(page), interarrivalKey(page), uniqueKey(page)}
+}
+
+// keyOwner returns the page a family key belongs to
+func keyOwner(key string) (string, bool) {
+	rest, ok := strings.CutPrefix(key, "visits:")
+	if !ok {
+		return "", false
+	}
+	if inner, ok := strings.CutPrefix(rest, "sessions:"); ok {
+		if i := strings.LastIndex(inner, ":daily:"); i > 0 {
+			return inner[:i], true
+		}
+	}
+	for _, family := range pageKeyFamilies {
+		if i := strings.LastIndex(rest, family); i > 0 {
+			return rest[:i], true
+		}
+	}
+	return "", false
+}
+
+// pageKeys returns the existing counter and auxiliary keys of each page:
+// buckets, heatmap, variants, pre-history and sessions. The family keys are
+// found in a single SCAN however many pages are asked for.
+func (r *RedisClient) pageKeys(ctx context.Context, pages []string) (map[string][]string, error) {
+	keys := make(map[string][]string, len(pages))
+	wanted := make(map[string]bool, len(pages))
+	pipe := r.client.Pipeline()
+	exists := make(map[string]*redis.IntCmd)
+	for _, page := range pages {
+		wanted[page] = true
+		for _, key := range pageFixedKeys(page) {
+			exists[key] = pipe.Exists(ctx, key)
+		}
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, err
+	}
+	for _, page := range pages {
+		for _, key := range pageFixedKeys(page) {
+			if exists[key].Val() > 0 {
+				keys[page] = append(keys[page], key)
+			}
+		}
+	}
+
+	err := r.scanKeys(ctx, "visits:*:*", func(batch []string) error {
+		for _, key := range batch {
+			if page, ok := keyOwner(key); ok && wanted[page] {
+				keys[page] = append(keys[page], key)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, page := range pages {
+		sort.Strings(keys[page])
+	}
+	return keys, nil
+}
+
+// ArchivePage renames the page's keys under archivePrefix in one transaction
+// and removes the page from the leaderboard, trending, last-visit and name
+// indexes. The archived record keeps the visit count and last visit so
+// UnarchivePage can restore them.
+func (r *RedisClient) ArchivePage(ctx context.Context, page string, now time.Time) (ArchivedPage, error) {
+	return r.archiveWithKeys(ctx, page, nil, now)
+}
+
+// archiveWithKeys archives a page whose keys may already be known. The
+// record, the counter and the keys are WATCHed, so a visit that creates a
+// bucket between listing the keys and renaming them retries the archive
+// with the keys listed again instead of leaving the bucket behind. Without
+// known keys, or on a retry, they are listed after the WATCH.
+func (r *RedisClient) archiveWithKeys(ctx context.Context, page string, keys []string, now time.Time) (ArchivedPage, error) {
+	var record ArchivedPage
+	err := r.watch(ctx, func(tx *redis.Tx) error {
+		if archived, err := tx.HExists(ctx, archivedPagesKey, page).Result(); err != nil {
+			return err
+		} else if archived {
+			return errAlreadyArchived
+		}
+		if keys == nil {
+			listed, err := r.pageKeys(ctx, []string{page})
+			if err != nil {
+				return err
+			}
+			keys = listed[page]
+		}
+		// The counter is already watched; on servers that renew a repeated
+		// WATCH, watching it again would forget a visit during the listing
+		var listed []string
+		for _, k := range keys {
+			if k != key("visits", page) {
+				listed = append(listed, k)
+			}
+		}
+		if len(listed) > 0 {
+			if err := tx.Watch(ctx, listed...).Err(); err != nil {
+				return err
+			}
+		}
+
+		visits, err := tx.Get(ctx, key("visits", page)).Int64()
+		if ignoreMissing(err) != nil {
+			return err
+		}
+		record = ArchivedPage{Page: page, Visits: visits, ArchivedAt: now.UTC(), Keys: keys}
+		if ms, err := tx.ZScore(ctx, lastVisitKey, page).Result(); err == nil {
+			lastVisit := time.UnixMilli(int64(ms)).UTC()
+			record.LastVisit = &lastVisit
+		} else if !isMissing(err) {
+			return err
+		}
+		// The keys are listed again if the transaction is retried
+		keys = nil
+		if len(record.Keys) == 0 && record.LastVisit == nil {
+			return errPageNotFound
+		}
+
+		encoded, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			for _, key := range record.Keys {
+				pipe.Rename(ctx, key, archivePrefix+key)
+			}
+			pipe.ZRem(ctx, leaderboardKey, page)
+			pipe.ZRem(ctx, trendingKey, page)
+			pipe.ZRem(ctx, lastVisitKey, page)
+			pipe.ZRem(ctx, pageNamesKey, page)
+			pipe.Del(ctx, searchDocPrefix+page)
+			pipe.HSet(ctx, archivedPagesKey, page, encoded)
+			return nil
+		})
+		return err
+	}, archivedPagesKey, key("visits", page))
+	if err != nil {
+		return ArchivedPage{}, err
+	}
+	return record, nil
+}
+
+// UnarchivePage renames the archived keys back and restores the page to the
+// leaderboard and indexes. Archived keys keep their TTL, so some may have
+// expired since: the record and the keys are WATCHed and only the keys still
+// there are renamed, as a failed RENAME would not stop the record's HDEL.
+func (r *RedisClient) UnarchivePage(ctx context.Context, page string) (ArchivedPage, error) {
+	var record ArchivedPage
+	var err error
+	for attempt := 0; attempt < strictWatchAttempts; attempt++ {
+		err = r.client.Watch(ctx, func(tx *redis.Tx) error {
+			var err error
+			if record, err = archivedPage(ctx, tx, page); err != nil {
+				return err
+			}
+			if record.Keys, err = watchArchivedKeys(ctx, tx, record.Keys); err != nil {
+				return err
+			}
+			_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				for _, key := range record.Keys {
+					pipe.Rename(ctx, archivePrefix+key, key)
+				}
+				if record.Visits > 0 {
+					pipe.ZAdd(ctx, leaderboardKey, redis.Z{Member: page, Score: float64(record.Visits)})
+				}
+				if record.LastVisit != nil {
+					pipe.ZAdd(ctx, lastVisitKey, redis.Z{Member: page, Score: float64(record.LastVisit.UnixMilli())})
+				}
+				r.queueIndexPage(ctx, pipe, page)
+				pipe.HDel(ctx, archivedPagesKey, page)
+				return nil
+			})
+			return err
+		}, archivedPagesKey)
+		if !errors.Is(err, redis.TxFailedErr) {
+			return record, err
+		}
+	}
+	return ArchivedPage{}, err
+}
+
+// watchArchivedKeys WATCHes the archived copies of keys and returns the
+// keys whose copy still exists
+func watchArchivedKeys(ctx context.Context, tx *redis.Tx, keys []string) ([]string, error) {
+	if len(keys) == 0 {
+		return keys, nil
+	}
+	archived := make([]string, len(keys))
+	for i, key := range keys {
+		archived[i] = archivePrefix + key
+	}
+	if err := tx.Watch(ctx, archived...).Err(); err != nil {
+		return nil, err
+	}
+	exists := make([]*redis.IntCmd, len(archived))
+	if _, err := tx.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, key := range archived {
+			exists[i] = pipe.Exists(ctx, key)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	present := make([]string, 0, len(keys))
+	for i, key := range keys {
+		if exists[i].Val() > 0 {
+			present = append(present, key)
+		}
+	}
+	return present, nil
+}
+
+// archivedPage returns the archive record of a page, or errNotArchived
+func archivedPage(ctx context.Context, client redis.Cmdable, page string) (ArchivedPage, error) {
+	raw, err := client.HGet(ctx, archivedPagesKey, page).Result()
+	if isMissing(err) {
+		return ArchivedPage{}, errNotArchived
+	}
+	if err != nil {
+		return ArchivedPage{}, err
+	}
+	var record ArchivedPage
+	if err := json.Unmarshal([]byte(raw), &record); err != nil {
+		return ArchivedPage{}, fmt.Errorf("decoding archive record for %q: %w", page, err)
+	}
+	return record, nil
+}
+
+// ArchivedPages lists archived pages, most recently archived first
+func (r *RedisClient) ArchivedPages(ctx context.Context) ([]ArchivedPage, error) {
+	values, err := r.client.HGetAll(ctx, archivedPagesKey).Result()
+	if err != nil {
+		return nil, err
+	}
+	pages := make([]ArchivedPage, 0, len(values))
+	for page, raw := range values {
+		var record ArchivedPage
+		if err := json.Unmarshal([]byte(raw), &record); err != nil {
+			log.Printf("Skipping malformed archive record for %q: %v", page, err)
+			continue
+		}
+		pages = append(pages, record)
+	}
+	sort.Slice(pages, func(i, j int) bool {
+		if !pages[i].ArchivedAt.Equal(pages[j].ArchivedAt) {
+			return pages[i].ArchivedAt.After(pages[j].ArchivedAt)
+		}
+		return pages[i].Page < pages[j].Page
+	})
+	return pages, nil
+}
+
+// rejectArchived answers 410 Gone for archived pages, so they are neither
+// read nor recreated by new visits
+func (s *Server) rejectArchived(c *gin.Context) {
+	page := c.Param("page")
+	archived, err := s.redis.client.HExists(c.Request.Context(), archivedPagesKey, page).Result()
+	if err != nil {
+		log.Printf("Error checking archived pages: %v", err)
+		respondStoreError(c, err, "Failed to check page")
+		return
+	}
+	if archived {
+		respondError(c, http.StatusGone, "archived",
+			fmt.Sprintf("Page %q is archived; restore it with POST /admin/pages/%s/unarchive", page, page))
+		return
+	}
+	c.Next()
+}
+
+// handleArchivePage archives a page
+func (s *Server) handleArchivePage(c *gin.Context) {
+	page := c.Param("page")
+	record, err := s.redis.ArchivePage(c.Request.Context(), page, s.clock.Now())
+	switch {
+	case errors.Is(err, errPageNotFound):
+		respondError(c, http.StatusNotFound, "not_found", "Page not found")
+		return
+	case errors.Is(err, errAlreadyArchived):
+		respondError(c, http.StatusConflict, "conflict", "Page is already archived")
+		return
+	case err != nil:
+		log.Printf("Error archiving page: %v", err)
+		respondStoreError(c, err, "Failed to archive page")
+		return
+	}
+	s.invalidateAggregates(c.Request.Context())
+	c.JSON(http.StatusOK, record)
+}
+
+// handleUnarchivePage restores an archived page
+func (s *Server) handleUnarchivePage(c *gin.Context) {
+	page := c.Param("page")
+	record, err := s.redis.UnarchivePage(c.Request.Context(), page)
+	switch {
+	case errors.Is(err, errNotArchived):
+		respondError(c, http.StatusNotFound, "not_found", "Page is not archived")
+		return
+	case err != nil:
+		log.Printf("Error restoring page: %v", err)
+		respondStoreError(c, err, "Failed to restore page")
+		return
+	}
+	s.invalidateAggregates(c.Request.Context())
+	c.JSON(http.StatusOK, record)
+}
+
+// handleListArchive lists archived pages, ?limit= at a time, resuming from
+// the page_token of next_token
+func (s *Server) handleListArchive(c *gin.Context) {
+	limit, ok := queryInt(c, "limit", 100, 1, 1000)
+	if !ok {
+		respondError(c, http.StatusBadRequest, "invalid_request", "limit must be between 1 and 1000")
+		return
+	}
+	offset, ok := s.offsetCursor(c, listingArchive, "")
+	if !ok {
+		return
+	}
+
+	pages, err := s.redis.ArchivedPages(c.Request.Context())
+	if err != nil {
+		log.Printf("Error listing archived pages: %v", err)
+		respondStoreError(c, err, "Failed to list archived pages")
+		return
+	}
+	response := ArchiveListResponse{Total: len(pages)}
+	end := min(offset+limit, int64(len(pages)))
+	response.Pages = pages[min(offset, end):end]
+	if end < int64(len(pages)) {
+		response.NextToken = s.pageTokens.Issue(listingArchive, "", strconv.FormatInt(end, 10))
+	}
+	respondJSON(c, http.StatusOK, response)
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+func TestArchiveRoundTrip(t *testing.T) {
+	_, redisClient := newTestRedis(t)
+	router := newTestServer(t, testConfig(), redisClient).Router()
+	ctx := context.Background()
+	if w := doRequest(router, "PUT", "/admin/flags", `{"rollups": true}`, nil); w.Code != http.StatusOK {
+		t.Fatalf("Failed to enable rollups: %d", w.Code)
+	}
+	for i := 0; i < 3; i++ {
+		doRequest(router, "GET", "/visit/old-launch", "", nil)
+	}
+	doRequest(router, "GET", "/visit/home", "", nil)
+
+	w := doRequest(router, "POST", "/admin/pages/old-launch/archive", "", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200 archiving, got %d: %s", w.Code, w.Body.String())
+	}
+	var record ArchivedPage
+	json.Unmarshal(w.Body.Bytes(), &record)
+	if record.Visits != 3 || record.LastVisit == nil || !containsString(record.Keys, "visits:old-launch") {
+		t.Errorf("Unexpected archive record: %+v", record)
+	}
+	for _, key := range record.Keys {
+		if n, _ := redisClient.client.Exists(ctx, key).Result(); n != 0 {
+			t.Errorf("Expected %s to be moved", key)
+		}
+		if n, _ := redisClient.client.Exists(ctx, archivePrefix+key).Result(); n != 1 {
+			t.Errorf("Expected %s under the archive prefix", key)
+		}
+	}
+
+	for _, path := range []string{"/visits/old-launch", "/visits/old-launch/range", "/pages/old-launch/meta", "/visit/old-launch"} {
+		w := doRequest(router, "GET", path, "", nil)
+		var resp ErrorResponse
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		if w.Code != http.StatusGone || resp.Code != "archived" {
+			t.Errorf("%s: expected 410 archived, got %d %s", path, w.Code, w.Body.String())
+		}
+	}
+	if got := pageNames(decodePages(t, doRequest(router, "GET", "/pages", "", nil).Body.Bytes()).Pages); len(got) != 1 || got[0] != "home" {
+		t.Errorf("Expected the archived page to leave the listing, got %v", got)
+	}
+	if got := pageNames(decodePages(t, doRequest(router, "GET", "/pages/top", "", nil).Body.Bytes()).Pages); len(got) != 1 {
+		t.Errorf("Expected the archived page to leave the leaderboard, got %v", got)
+	}
+
+	var list ArchiveListResponse
+	json.Unmarshal(doRequest(router, "GET", "/admin/archive", "", nil).Body.Bytes(), &list)
+	if list.Total != 1 || list.Pages[0].Page != "old-launch" {
+		t.Errorf("Unexpected archive listing: %+v", list)
+	}
+	if w := doRequest(router, "POST", "/admin/pages/old-launch/archive", "", nil); w.Code != http.StatusConflict {
+		t.Errorf("Expected 409 archiving twice, got %d", w.Code)
+	}
+
+	if w := doRequest(router, "POST", "/admin/pages/old-launch/unarchive", "", nil); w.Code != http.StatusOK {
+		t.Fatalf("Expected 200 restoring, got %d: %s", w.Code, w.Body.String())
+	}
+	if resp := decodeVisit(t, doRequest(router, "GET", "/visits/old-launch", "", nil).Body.Bytes()); resp.Visits != 3 {
+		t.Errorf("Expected the count to be restored, got %d", resp.Visits)
+	}
+	listing := decodePages(t, doRequest(router, "GET", "/pages?sort=visits", "", nil).Body.Bytes())
+	if listing.Total != 2 || listing.Pages[0].Page != "old-launch" || listing.Pages[0].LastVisit == nil {
+		t.Errorf("Expected the page back in the listing with its last visit, got %+v", listing)
+	}
+	if resp := decodeVisit(t, doRequest(router, "GET", "/visit/old-launch", "", nil).Body.Bytes()); resp.Visits != 4 || resp.FirstVisit {
+		t.Errorf("Expected visits to resume on the restored counter, got %+v", resp)
+	}
+	json.Unmarshal(doRequest(router, "GET", "/admin/archive", "", nil).Body.Bytes(), &list)
+	if list.Total != 0 {
+		t.Errorf("Expected an empty archive, got %+v", list)
+	}
+}
+
+func TestArchiveUnknownPages(t *testing.T) {
+	_, redisClient := newTestRedis(t)
+	router := newTestServer(t, testConfig(), redisClient).Router()
+
+	if w := doRequest(router, "POST", "/admin/pages/missing/archive", "", nil); w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 archiving an unknown page, got %d", w.Code)
+	}
+	if w := doRequest(router, "POST", "/admin/pages/missing/unarchive", "", nil); w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 restoring a page that is not archived, got %d", w.Code)
+	}
+}
+
+func TestUnarchiveAfterArchivedKeyExpired(t *testing.T) {
+	mr, redisClient := newTestRedis(t)
+	router := newTestServer(t, testConfig(), redisClient).Router()
+	doRequest(router, "PUT", "/admin/flags", `{"rollups": true}`, nil)
+	doRequest(router, "GET", "/visit/old-launch", "", nil)
+	var record ArchivedPage
+	json.Unmarshal(doRequest(router, "POST", "/admin/pages/old-launch/archive", "", nil).Body.Bytes(), &record)
+
+	// Archived keys keep their TTL, and the daily bucket's runs out
+	var daily string
+	for _, key := range record.Keys {
+		if _, ok := keyOwner(key); ok && strings.Contains(key, ":daily:") {
+			daily = key
+		}
+	}
+	if daily == "" {
+		t.Fatalf("Expected a daily bucket archived, got %v", record.Keys)
+	}
+	mr.SetTTL(archivePrefix+daily, time.Second)
+	mr.FastForward(2 * time.Second)
+
+	w := doRequest(router, "POST", "/admin/pages/old-launch/unarchive", "", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200 restoring, got %d: %s", w.Code, w.Body.String())
+	}
+	json.Unmarshal(w.Body.Bytes(), &record)
+	if containsString(record.Keys, daily) || !containsString(record.Keys, "visits:old-launch") {
+		t.Errorf("Expected the expired bucket left out of the restored keys, got %v", record.Keys)
+	}
+	if resp := decodeVisit(t, doRequest(router, "GET", "/visits/old-launch", "", nil).Body.Bytes()); resp.Visits != 1 {
+		t.Errorf("Expected the count restored, got %d", resp.Visits)
+	}
+	if mr.Exists(archivedPagesKey) {
+		t.Error("Expected the archive record removed")
+	}
+}
+
+// visitAfterScanHook counts a visit to page through other, creating a
+// daily bucket, once the first SCAN after arming returns
+type visitAfterScanHook struct {
+	armed atomic.Bool
+	other *RedisClient
+	page  string
+	day   time.Time
+}
+
+func (h *visitAfterScanHook) DialHook(next redis.DialHook) redis.DialHook { return next }
+func (h *visitAfterScanHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return next
+}
+
+func (h *visitAfterScanHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		err := next(ctx, cmd)
+		if cmd.Name() == "scan" && h.armed.CompareAndSwap(true, false) {
+			h.other.client.Incr(ctx, key("visits", h.page))
+			h.other.client.Incr(ctx, dailyKey(h.page, h.day))
+		}
+		return err
+	}
+}
+
+func TestArchiveRetriesOnConcurrentVisit(t *testing.T) {
+	mr, redisClient := newTestRedis(t)
+	hook := &visitAfterScanHook{other: newTestRedisClient(t, mr), page: "launch", day: time.Date(2024, 3, 2, 0, 0, 0, 0, time.UTC)}
+	redisClient.client.AddHook(hook)
+	ctx := context.Background()
+	redisClient.client.Set(ctx, key("visits", "launch"), 1, 0)
+	redisClient.client.Set(ctx, dailyKey("launch", hook.day.AddDate(0, 0, -1)), 1, 0)
+
+	// A visit lands between listing the keys and renaming them
+	hook.armed.Store(true)
+	record, err := redisClient.ArchivePage(ctx, "launch", time.Now())
+	if err != nil {
+		t.Fatalf("Failed to archive: %v", err)
+	}
+	if record.Visits != 2 || !containsString(record.Keys, dailyKey("launch", hook.day)) {
+		t.Errorf("Expected the concurrent visit archived with its bucket, got %+v", record)
+	}
+	if mr.Exists(dailyKey("launch", hook.day)) || mr.Exists(key("visits", "launch")) {
+		t.Error("Expected no key of the page left behind")
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	auditStreamKey      = "admin:audit"
+	auditBodySummaryMax = 256
+
+	// auditPagesKey is the context key a handler sets to record every page
+	// an operation touched, which the truncated body may not show
+	auditPagesKey = "audit_pages"
+
+	// auditNoteKey is the context key a handler sets to explain an operation
+	// in its audit entry. Requests rejected with a note are recorded too.
+	auditNoteKey = "audit_note"
+
+	// auditBodyKey is the context key a handler sets to record a summary in
+	// place of a body carrying personal data
+	auditBodyKey = "audit_body"
+)
+
+// AuditEntry represents one recorded admin operation
+type AuditEntry struct {
+	ID        string    `json:"id"`
+	Actor     string    `json:"actor"`
+	Action    string    `json:"action"`
+	Target    string    `json:"target"`
+	Body      string    `json:"body,omitempty"`
+	Pages     []string  `json:"pages,omitempty"`
+	Note      string    `json:"note,omitempty"`
+	Timestamp Timestamp `json:"timestamp"`
+	RequestID string    `json:"request_id"`
+}
+
+// AuditResponse represents a page of audit entries
+type AuditResponse struct {
+	Entries   []AuditEntry `json:"entries"`
+	NextToken string       `json:"next_token,omitempty"`
+
+	// NextBefore is the raw ID for clients still paging with ?before=.
+	//
+	// Deprecated: use NextToken.
+	NextBefore string `json:"next_before,omitempty"`
+}
+
+// isMutating reports whether the HTTP method changes state
+func isMutating(method string) bool {
+	switch method {
+	case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// auditAdmin records successful mutating admin requests to the audit
+// stream, and rejected ones the handler left a note on
+func (s *Server) auditAdmin(c *gin.Context) {
+	if !isMutating(c.Request.Method) {
+		c.Next()
+		return
+	}
+
+	var body []byte
+	if c.Request.Body != nil {
+		body, _ = io.ReadAll(c.Request.Body)
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+	}
+
+	c.Next()
+
+	if c.Writer.Status() >= http.StatusBadRequest && c.GetString(auditNoteKey) == "" {
+		return
+	}
+
+	target := c.Param("page")
+	if target == "" {
+		target = c.Request.URL.Path
+	}
+	summary := string(body)
+	if redacted := c.GetString(auditBodyKey); redacted != "" {
+		summary = redacted
+	}
+	if len(summary) > auditBodySummaryMax {
+		summary = summary[:auditBodySummaryMax] + "..."
+	}
+
+	entry := AuditEntry{
+		Actor:     c.GetString(actorKey),
+		Action:    c.Request.Method + " " + c.FullPath(),
+		Target:    target,
+		Body:      summary,
+		Pages:     c.GetStringSlice(auditPagesKey),
+		Note:      c.GetString(auditNoteKey),
+		Timestamp: Timestamp{Time: s.clock.Now()},
+		RequestID: c.GetString(requestIDKey),
+	}
+	if err := s.redis.AppendAudit(c.Request.Context(), entry, s.cfg.AuditMaxLen); err != nil {
+		log.Printf("Failed to write audit entry for %s: %v", entry.Action, err)
+	}
+}
+
+// AppendAudit adds an entry to the capped audit stream
+func (r *RedisClient) AppendAudit(ctx context.Context, entry AuditEntry, maxLen int64) error {
+	return r.client.XAdd(ctx, &redis.XAddArgs{
+		Stream: auditStreamKey,
+		MaxLen: maxLen,
+		Approx: true,
+		Values: map[string]interface{}{
+			"actor":      entry.Actor,
+			"action":     entry.Action,
+			"target":     entry.Target,
+			"body":       entry.Body,
+			"pages":      strings.Join(entry.Pages, ","),
+			"note":       entry.Note,
+			"timestamp":  entry.Timestamp.Time.Format(time.RFC3339),
+			"request_id": entry.RequestID,
+		},
+	}).Err()
+}
+
+// ReadAudit returns up to count entries, newest first, older than before
+// (or from the newest entry when before is empty)
+func (r *RedisClient) ReadAudit(ctx context.Context, count int64, before string) ([]AuditEntry, error) {
+	start := "+"
+	fetch := count
+	if before != "" {
+		// The range is inclusive, so fetch one extra to drop the cursor entry
+		start = before
+		fetch++
+	}
+
+	messages, err := r.client.XRevRangeN(ctx, auditStreamKey, start, "-", fetch).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]AuditEntry, 0, len(messages))
+	for _, msg := range messages {
+		if msg.ID == before {
+			continue
+		}
+		if int64(len(entries)) == count {
+			break
+		}
+		str := func(field string) string {
+			v, _ := msg.Values[field].(string)
+			return v
+		}
+		timestamp, _ := time.Parse(time.RFC3339, str("timestamp"))
+		var pages []string
+		if joined := str("pages"); joined != "" {
+			pages = strings.Split(joined, ",")
+		}
+		entries = append(entries, AuditEntry{
+			ID:        msg.ID,
+			Actor:     str("actor"),
+			Action:    str("action"),
+			Target:    str("target"),
+			Body:      str("body"),
+			Pages:     pages,
+			Note:      str("note"),
+			Timestamp: Timestamp{Time: timestamp},
+			RequestID: str("request_id"),
+		})
+	}
+	return entries, nil
+}
+
+// handleGetAudit returns audit entries, paginated with the page_token of
+// next_token; a raw ?before=<id> is still accepted
+func (s *Server) handleGetAudit(c *gin.Context) {
+	count, err := strconv.ParseInt(c.DefaultQuery("count", "100"), 10, 64)
+	if err != nil || count < 1 || count > 1000 {
+		respondError(c, http.StatusBadRequest, "invalid_request", "count must be between 1 and 1000")
+		return
+	}
+	before, ok := s.pageCursor(c, listingAudit, "")
+	if !ok {
+		return
+	}
+	if before == "" {
+		before = c.Query("before")
+	} else if c.Query("before") != "" {
+		respondError(c, http.StatusBadRequest, "invalid_request", "page_token cannot be combined with before")
+		return
+	}
+
+	entries, err := s.redis.ReadAudit(c.Request.Context(), count, before)
+	if err != nil {
+		log.Printf("Error reading audit log: %v", err)
+		respondStoreError(c, err, "Failed to read audit log")
+		return
+	}
+
+	for i := range entries {
+		entries[i].Timestamp = stamp(c, entries[i].Timestamp.Time)
+	}
+	response := AuditResponse{Entries: entries}
+	if int64(len(entries)) == count {
+		last := entries[len(entries)-1].ID
+		response.NextToken = s.pageTokens.Issue(listingAudit, "", last)
+		response.NextBefore = last
+	}
+	c.JSON(http.StatusOK, response)
+}
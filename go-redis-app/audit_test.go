@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func readAudit(t *testing.T, h http.Handler, query string) AuditResponse {
+	t.Helper()
+	w := doRequest(h, "GET", "/admin/audit"+query, "", map[string]string{"X-API-Key": "secret"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var resp AuditResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("Failed to decode audit response: %v", err)
+	}
+	return resp
+}
+
+func TestAuditRecordsFlagChanges(t *testing.T) {
+	_, redisClient := newTestRedis(t)
+	cfg := testConfig()
+	cfg.AdminAPIKeys = map[string]string{"secret": "ops"}
+	router := newTestServer(t, cfg, redisClient).Router()
+	headers := map[string]string{"X-API-Key": "secret", "X-Request-ID": "req-1"}
+
+	doRequest(router, "PUT", "/admin/flags", `{"dedupe": true}`, headers)
+	// Rejected requests and reads are not audited
+	doRequest(router, "PUT", "/admin/flags", `{"bogus": true}`, headers)
+	doRequest(router, "GET", "/admin/flags", "", headers)
+
+	resp := readAudit(t, router, "")
+	if len(resp.Entries) != 1 {
+		t.Fatalf("Expected 1 audit entry, got %d", len(resp.Entries))
+	}
+	entry := resp.Entries[0]
+	if entry.Actor != "ops" || entry.Action != "PUT /admin/flags" || entry.Target != "/admin/flags" {
+		t.Errorf("Unexpected audit entry: %+v", entry)
+	}
+	if entry.Body != `{"dedupe": true}` || entry.RequestID != "req-1" {
+		t.Errorf("Unexpected body or request ID: %+v", entry)
+	}
+}
+
+func TestAuditPagination(t *testing.T) {
+	_, redisClient := newTestRedis(t)
+	cfg := testConfig()
+	cfg.AdminAPIKeys = map[string]string{"secret": "ops"}
+	router := newTestServer(t, cfg, redisClient).Router()
+
+	for i := 0; i < 5; i++ {
+		body := fmt.Sprintf(`{"rollups": %t}`, i%2 == 0)
+		doRequest(router, "PUT", "/admin/flags", body, map[string]string{"X-API-Key": "secret"})
+	}
+
+	first := readAudit(t, router, "?count=2")
+	if len(first.Entries) != 2 || first.NextToken == "" {
+		t.Fatalf("Expected 2 entries with a cursor, got %+v", first)
+	}
+	// Clients still paging with before get the raw ID alongside the token
+	if first.NextBefore != first.Entries[1].ID {
+		t.Errorf("Expected next_before %s, got %q", first.Entries[1].ID, first.NextBefore)
+	}
+	if legacy := readAudit(t, router, "?count=2&before="+first.NextBefore); len(legacy.Entries) != 2 || legacy.Entries[0].ID == first.Entries[1].ID {
+		t.Errorf("Expected the next page through before, got %+v", legacy)
+	}
+	if first.Entries[0].Body != `{"rollups": true}` {
+		t.Errorf("Expected newest entry first, got %+v", first.Entries[0])
+	}
+
+	seen := map[string]bool{}
+	for _, e := range first.Entries {
+		seen[e.ID] = true
+	}
+	cursor := first.NextToken
+	for cursor != "" {
+		page := readAudit(t, router, "?count=2&page_token="+cursor)
+		for _, e := range page.Entries {
+			if seen[e.ID] {
+				t.Fatalf("Entry %s returned twice", e.ID)
+			}
+			seen[e.ID] = true
+		}
+		cursor = page.NextToken
+	}
+	if len(seen) != 5 {
+		t.Errorf("Expected to page through 5 entries, got %d", len(seen))
+	}
+
+	if w := doRequest(router, "GET", "/admin/audit?count=0", "", map[string]string{"X-API-Key": "secret"}); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for count=0, got %d", w.Code)
+	}
+}
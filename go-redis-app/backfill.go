@@ -0,0 +1,328 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	backfillModeSet  = "set"
+	backfillModeIncr = "incr"
+
+	// backfillBatchSize bounds the commands sent per pipeline
+	backfillBatchSize = 500
+
+	// maxBackfillEntries bounds a single backfill request
+	maxBackfillEntries = 10000
+)
+
+// recomputeTotalScript sums a page's buckets and pre-history and stores the
+// sum as its counter and leaderboard score, in one step so that no visit
+// lands between the sum and the write. ARGV[2], when not empty, replaces
+// the stored pre-history. A negative sum is returned without being stored.
+//
+// KEYS[1] counter, KEYS[2] pre-history, KEYS[3] leaderboard, KEYS[4] page
+// names, KEYS[5..] buckets; ARGV[1] page, ARGV[2] pre-history
+var recomputeTotalScript = redis.NewScript(`
+local total = tonumber(ARGV[2]) or tonumber(redis.call('GET', KEYS[2]) or '0')
+for i = 5, #KEYS do
+	total = total + tonumber(redis.call('GET', KEYS[i]) or '0')
+end
+if total < 0 then
+	return total
+end
+if ARGV[2] ~= '' then
+	redis.call('SET', KEYS[2], ARGV[2])
+end
+total = string.format('%d', total)
+redis.call('SET', KEYS[1], total)
+redis.call('ZADD', KEYS[3], total, ARGV[1])
+redis.call('ZADD', KEYS[4], 'NX', 0, ARGV[1])
+return total
+`)
+
+// BackfillEntry is one day of historical visits
+type BackfillEntry struct {
+	Date  string `json:"date"`
+	Count int64  `json:"count"`
+}
+
+// BackfillRequest loads historical daily counts for a page
+type BackfillRequest struct {
+	Mode       string          `json:"mode"`
+	PreHistory *int64          `json:"pre_history"`
+	Entries    []BackfillEntry `json:"entries"`
+}
+
+// SkippedRow explains why a backfill entry was not written
+type SkippedRow struct {
+	Index  int    `json:"index"`
+	Date   string `json:"date"`
+	Reason string `json:"reason"`
+}
+
+// BackfillResponse summarizes a backfill
+type BackfillResponse struct {
+	Page        string       `json:"page"`
+	Mode        string       `json:"mode"`
+	Written     int          `json:"written"`
+	Skipped     int          `json:"skipped"`
+	SkippedRows []SkippedRow `json:"skipped_rows,omitempty"`
+	Total       int64        `json:"total"`
+}
+
+// backfillRow is a validated backfill entry
+type backfillRow struct {
+	Day   time.Time
+	Count int64
+}
+
+// preHistoryKey holds the visits counted before the earliest bucket,
+// including buckets removed by retention
+func preHistoryKey(page string) string {
+	return key("visits", page, "pre_history")
+}
+
+// validateBackfill splits entries into rows to write and skipped rows,
+// rejecting malformed dates, negative counts, and days after today (UTC)
+func validateBackfill(entries []BackfillEntry, now time.Time) ([]backfillRow, []SkippedRow) {
+	today := now.UTC().Format("2006-01-02")
+	var rows []backfillRow
+	var skipped []SkippedRow
+	for i, e := range entries {
+		day, err := time.Parse("2006-01-02", e.Date)
+		countErr := checkNonNegative("count", e.Count)
+		switch {
+		case err != nil:
+			skipped = append(skipped, SkippedRow{Index: i, Date: e.Date, Reason: "date must be YYYY-MM-DD"})
+		case e.Date > today:
+			skipped = append(skipped, SkippedRow{Index: i, Date: e.Date, Reason: "date is in the future"})
+		case countErr != nil:
+			skipped = append(skipped, SkippedRow{Index: i, Date: e.Date, Reason: countErr.Error()})
+		default:
+			rows = append(rows, backfillRow{Day: day, Count: e.Count})
+		}
+	}
+	return rows, skipped
+}
+
+// WriteDailyBuckets sets or increments the daily bucket for each row in
+// pipelined batches
+func (r *RedisClient) WriteDailyBuckets(ctx context.Context, page, mode string, rows []backfillRow) error {
+	for start := 0; start < len(rows); start += backfillBatchSize {
+		end := min(start+backfillBatchSize, len(rows))
+		_, err := r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			queueDailyBuckets(ctx, pipe, page, mode, rows[start:end])
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// queueDailyBuckets queues setting or incrementing the daily bucket of each
+// row
+func queueDailyBuckets(ctx context.Context, pipe redis.Pipeliner, page, mode string, rows []backfillRow) {
+	for _, row := range rows {
+		if mode == backfillModeIncr {
+			pipe.IncrBy(ctx, dailyKey(page, row.Day), row.Count)
+		} else {
+			pipe.Set(ctx, dailyKey(page, row.Day), row.Count, 0)
+		}
+	}
+}
+
+// Backfill writes the rows' daily buckets and recomputes the page's total,
+// returning it. now is the time of the request, whose daily bucket is
+// summed even before it exists. In strict mode both happen in one transaction, WATCHing the
+// counter so that a visit in between retries it; otherwise the buckets are
+// written in batches first, and a failure partway leaves the total to
+// recompute by running the backfill again.
+func (r *RedisClient) Backfill(ctx context.Context, page, mode string, rows []backfillRow, preHistory *int64, now time.Time) (int64, error) {
+	if !r.strict {
+		if err := r.WriteDailyBuckets(ctx, page, mode, rows); err != nil {
+			return 0, err
+		}
+		return r.RecomputeTotal(ctx, page, preHistory, now)
+	}
+	var total int64
+	err := r.watched(ctx, func(txPipelined txPipelinedFunc) error {
+		var err error
+		if _, total, err = r.ProjectTotal(ctx, page, mode, rows, preHistory); err != nil {
+			return err
+		}
+		if err := checkNonNegative("total", total); err != nil {
+			return fmt.Errorf("recomputing %s: %w", page, err)
+		}
+		_, err = txPipelined(ctx, func(pipe redis.Pipeliner) error {
+			queueDailyBuckets(ctx, pipe, page, mode, rows)
+			queueTotal(ctx, pipe, page, total, preHistory)
+			return nil
+		})
+		return err
+	}, key("visits", page), preHistoryKey(page))
+	return total, err
+}
+
+// RecomputeTotal sets the lifetime count and leaderboard score to the sum of
+// the page's daily and monthly buckets plus its pre-history offset. A
+// non-nil preHistory replaces the stored offset. The buckets are found by a
+// SCAN and then summed and written by one script, so a visit in between is
+// kept; the daily buckets of now and the next day are summed too, in case
+// such a visit creates one.
+func (r *RedisClient) RecomputeTotal(ctx context.Context, page string, preHistory *int64, now time.Time) (int64, error) {
+	buckets, err := r.bucketValues(ctx, page)
+	if err != nil {
+		return 0, err
+	}
+	for _, day := range []time.Time{now, now.AddDate(0, 0, 1)} {
+		buckets[dailyKey(page, day)] = 0
+	}
+	keys := []string{key("visits", page), preHistoryKey(page), leaderboardKey, pageNamesKey}
+	for bucket := range buckets {
+		keys = append(keys, bucket)
+	}
+	var offset string
+	if preHistory != nil {
+		offset = strconv.FormatInt(*preHistory, 10)
+	}
+	total, err := recomputeTotalScript.Run(ctx, r.client, keys, page, offset).Int64()
+	if err != nil {
+		return 0, err
+	}
+	if err := checkNonNegative("total", total); err != nil {
+		return 0, fmt.Errorf("recomputing %s: %w", page, err)
+	}
+	return total, nil
+}
+
+// queueTotal queues storing a page's recomputed total, and its new
+// pre-history offset when non-nil
+func queueTotal(ctx context.Context, pipe redis.Pipeliner, page string, total int64, preHistory *int64) {
+	if preHistory != nil {
+		pipe.Set(ctx, preHistoryKey(page), *preHistory, 0)
+	}
+	pipe.Set(ctx, key("visits", page), total, 0)
+	pipe.ZAdd(ctx, leaderboardKey, redis.Z{Member: page, Score: float64(total)})
+	pipe.ZAddNX(ctx, pageNamesKey, redis.Z{Member: page})
+}
+
+// bucketValues returns the value of each of a page's daily and monthly
+// buckets, by key
+func (r *RedisClient) bucketValues(ctx context.Context, page string) (map[string]int64, error) {
+	values := make(map[string]int64)
+	err := r.scanKeys(ctx, escapeGlob(fmt.Sprintf("visits:%s:", page))+"*", func(keys []string) error {
+		// Skip other keys of the page and keys of pages whose names extend it
+		var buckets []string
+		for _, key := range keys {
+			if bucketPage, _, _, ok := parseBucketKey(key); ok && bucketPage == page {
+				buckets = append(buckets, key)
+			}
+		}
+		if len(buckets) == 0 {
+			return nil
+		}
+		got, err := r.client.MGet(ctx, buckets...).Result()
+		if err != nil {
+			return err
+		}
+		for i, v := range got {
+			if str, ok := v.(string); ok {
+				values[buckets[i]], _ = strconv.ParseInt(str, 10, 64)
+			}
+		}
+		return nil
+	})
+	return values, err
+}
+
+// handleBackfill loads historical daily counts for a page and reconciles its
+// lifetime total
+func (s *Server) handleBackfill(c *gin.Context) {
+	var req BackfillRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondError(c, http.StatusBadRequest, "invalid_request", "Body must be a backfill object")
+		return
+	}
+	if req.Mode == "" {
+		req.Mode = backfillModeSet
+	}
+	if req.Mode != backfillModeSet && req.Mode != backfillModeIncr {
+		respondError(c, http.StatusBadRequest, "invalid_request", `mode must be "set" or "incr"`)
+		return
+	}
+	if len(req.Entries) > maxBackfillEntries {
+		respondError(c, http.StatusBadRequest, "invalid_request",
+			fmt.Sprintf("At most %d entries may be backfilled per request", maxBackfillEntries))
+		return
+	}
+	if req.PreHistory != nil {
+		if err := checkNonNegative("pre_history", *req.PreHistory); err != nil {
+			respondError(c, http.StatusBadRequest, "invalid_request", err.Error())
+			return
+		}
+	}
+
+	page := c.Param("page")
+	ctx := c.Request.Context()
+	rows, skipped := validateBackfill(req.Entries, s.clock.Now())
+	if !s.guardCounterDrop(c, page, req.Mode, rows, req.PreHistory) {
+		return
+	}
+	total, err := s.redis.Backfill(ctx, page, req.Mode, rows, req.PreHistory, s.clock.Now())
+	if err != nil {
+		log.Printf("Error backfilling page: %v", err)
+		respondStoreError(c, err, "Failed to backfill page")
+		return
+	}
+	s.invalidateAggregates(ctx)
+
+	c.JSON(http.StatusOK, BackfillResponse{
+		Page:        page,
+		Mode:        req.Mode,
+		Written:     len(rows),
+		Skipped:     len(skipped),
+		SkippedRows: skipped,
+		Total:       total,
+	})
+}
+
+// guardCounterDrop applies COUNTER_DROP_GUARD_PERCENT to a backfill: one that
+// would lower the page's counter by more than that is rejected with 409
+// unless the request has ?force=true. Rejected and forced drops are logged
+// and noted in the audit log. It reports whether the backfill may go ahead.
+func (s *Server) guardCounterDrop(c *gin.Context, page, mode string, rows []backfillRow, preHistory *int64) bool {
+	if s.cfg.CounterDropGuardPercent <= 0 {
+		return true
+	}
+	current, projected, err := s.redis.ProjectTotal(c.Request.Context(), page, mode, rows, preHistory)
+	if err != nil {
+		log.Printf("Error projecting backfill total: %v", err)
+		respondStoreError(c, err, "Failed to backfill page")
+		return false
+	}
+	if !exceedsDropGuard(current, projected, s.cfg.CounterDropGuardPercent) {
+		return true
+	}
+
+	drop := formatDrop(page, current, projected)
+	if force, _ := strconv.ParseBool(c.Query("force")); force {
+		log.Printf("Backfill %s, more than %g%%, forced by %s", drop, s.cfg.CounterDropGuardPercent, c.GetString(actorKey))
+		c.Set(auditNoteKey, "forced: backfill "+drop)
+		return true
+	}
+	log.Printf("Rejected backfill that %s, more than %g%%, by %s", drop, s.cfg.CounterDropGuardPercent, c.GetString(actorKey))
+	c.Set(auditNoteKey, "rejected: backfill "+drop)
+	respondError(c, http.StatusConflict, "counter_drop",
+		fmt.Sprintf("Backfill %s, more than the %g%% guard; retry with ?force=true to apply it", drop, s.cfg.CounterDropGuardPercent))
+	return false
+}
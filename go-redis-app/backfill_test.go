@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func backfill(t *testing.T, h http.Handler, page, body string) BackfillResponse {
+	t.Helper()
+	w := doRequest(h, "POST", "/admin/backfill/"+page, body, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var resp BackfillResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("Failed to decode backfill response: %v", err)
+	}
+	return resp
+}
+
+func TestValidateBackfill(t *testing.T) {
+	now := time.Date(2024, 3, 10, 23, 0, 0, 0, time.UTC)
+	rows, skipped := validateBackfill([]BackfillEntry{
+		{Date: "2024-03-09", Count: 5},
+		{Date: "2024-03-10", Count: 1},
+		{Date: "2024-03-11", Count: 1},
+		{Date: "03/09/2024", Count: 1},
+		{Date: "2024-02-30", Count: 1},
+		{Date: "2024-03-01", Count: -1},
+	}, now)
+	if len(rows) != 2 || rows[0].Count != 5 || !rows[1].Day.Equal(time.Date(2024, 3, 10, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("Unexpected rows: %+v", rows)
+	}
+	wantSkipped := []int{2, 3, 4, 5}
+	if len(skipped) != len(wantSkipped) {
+		t.Fatalf("Expected %d skipped rows, got %+v", len(wantSkipped), skipped)
+	}
+	for i, row := range skipped {
+		if row.Index != wantSkipped[i] || row.Reason == "" {
+			t.Errorf("Unexpected skipped row %+v", row)
+		}
+	}
+}
+
+func TestBackfillReconcilesTotals(t *testing.T) {
+	_, redisClient := newTestRedis(t)
+	router := newTestServer(t, testConfig(), redisClient).Router()
+
+	resp := backfill(t, router, "home", `{
+		"pre_history": 100,
+		"entries": [
+			{"date": "2023-01-01", "count": 10},
+			{"date": "2023-01-02", "count": 20},
+			{"date": "2999-01-01", "count": 5},
+			{"date": "yesterday", "count": 5}
+		]
+	}`)
+	if resp.Written != 2 || resp.Skipped != 2 || resp.Total != 130 || resp.Mode != "set" {
+		t.Errorf("Unexpected backfill response: %+v", resp)
+	}
+
+	// incr adds to existing buckets and keeps the stored pre-history
+	resp = backfill(t, router, "home", `{"mode": "incr", "entries": [{"date": "2023-01-02", "count": 5}, {"date": "2023-01-03", "count": 1}]}`)
+	if resp.Total != 136 {
+		t.Errorf("Expected total 136 after incr, got %d", resp.Total)
+	}
+
+	// set replaces buckets, so re-running a backfill is idempotent
+	resp = backfill(t, router, "home", `{"entries": [{"date": "2023-01-01", "count": 10}, {"date": "2023-01-02", "count": 20}]}`)
+	if resp.Total != 131 {
+		t.Errorf("Expected total 131 after set, got %d", resp.Total)
+	}
+
+	// A page whose name extends this one's bucket prefix is not summed
+	backfill(t, router, "home:daily:x", `{"entries": [{"date": "2023-01-01", "count": 1000}]}`)
+	if resp = backfill(t, router, "home", `{}`); resp.Total != 131 {
+		t.Errorf("Expected total 131 unaffected by other pages, got %d", resp.Total)
+	}
+
+	got := decodeVisit(t, doRequest(router, "GET", "/visits/home", "", nil).Body.Bytes())
+	if got.Visits != 131 {
+		t.Errorf("Expected /visits/home to report 131, got %d", got.Visits)
+	}
+	top := decodePages(t, doRequest(router, "GET", "/pages/top?limit=1", "", nil).Body.Bytes())
+	if len(top.Pages) != 1 || top.Pages[0].Page != "home:daily:x" || top.Pages[0].Visits != 1000 {
+		t.Errorf("Expected leaderboard to reflect backfilled totals, got %+v", top.Pages)
+	}
+}
+
+func TestBackfillValidation(t *testing.T) {
+	_, redisClient := newTestRedis(t)
+	router := newTestServer(t, testConfig(), redisClient).Router()
+
+	for _, body := range []string{`not json`, `{"mode": "replace"}`, `{"pre_history": -1}`} {
+		if w := doRequest(router, "POST", "/admin/backfill/home", body, nil); w.Code != http.StatusBadRequest {
+			t.Errorf("Expected 400 for %s, got %d", body, w.Code)
+		}
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+// maxBatchPages caps the pages in one batch request
+const maxBatchPages = 500
+
+// Batch operations
+const (
+	batchDelete  = "delete"
+	batchReset   = "reset"
+	batchArchive = "archive"
+)
+
+// BatchRequest is the body of POST /admin/pages/batch
+type BatchRequest struct {
+	Operation string   `json:"operation"`
+	Pages     []string `json:"pages"`
+}
+
+// BatchResult is the outcome of the operation on one page
+type BatchResult struct {
+	Page   string `json:"page"`
+	Status int    `json:"status"`
+	Error  string `json:"error,omitempty"`
+	// DanglingAliases lists the aliases left pointing at a deleted or
+	// archived page
+	DanglingAliases []string `json:"dangling_aliases,omitempty"`
+}
+
+// BatchSummary counts the outcomes of a batch
+type BatchSummary struct {
+	Total     int `json:"total"`
+	Succeeded int `json:"succeeded"`
+	Failed    int `json:"failed"`
+}
+
+// BatchResponse represents the POST /admin/pages/batch API response
+type BatchResponse struct {
+	Operation string        `json:"operation"`
+	Results   []BatchResult `json:"results"`
+	Summary   BatchSummary  `json:"summary"`
+}
+
+// BatchPages applies a delete, reset or archive to each page, returning a
+// result per page in request order. Existence checks, key discovery (one
+// SCAN for the whole batch) and the writes each run as a single pipeline;
+// archives run one transaction per page.
+func (r *RedisClient) BatchPages(ctx context.Context, op string, pages []string, now time.Time) ([]BatchResult, error) {
+	pipe := r.client.Pipeline()
+	archived := make([]*redis.BoolCmd, len(pages))
+	counters := make([]*redis.IntCmd, len(pages))
+	names := make([]*redis.FloatCmd, len(pages))
+	for i, page := range pages {
+		archived[i] = pipe.HExists(ctx, archivedPagesKey, page)
+		counters[i] = pipe.Exists(ctx, key("visits", page))
+		names[i] = pipe.ZScore(ctx, pageNamesKey, page)
+	}
+	if _, err := pipe.Exec(ctx); ignoreMissing(err) != nil {
+		return nil, err
+	}
+
+	results := make([]BatchResult, len(pages))
+	var found []string
+	for i, page := range pages {
+		results[i] = BatchResult{Page: page, Status: http.StatusOK}
+		switch {
+		case archived[i].Val():
+			results[i].Status, results[i].Error = http.StatusConflict, errAlreadyArchived.Error()
+		case counters[i].Val() == 0 && isMissing(names[i].Err()):
+			results[i].Status, results[i].Error = http.StatusNotFound, errPageNotFound.Error()
+		default:
+			found = append(found, page)
+		}
+	}
+	if len(found) == 0 {
+		return results, nil
+	}
+
+	keys, err := r.pageKeys(ctx, found)
+	if err != nil {
+		return nil, err
+	}
+	failures := make(map[string]error)
+	if op == batchArchive {
+		for _, page := range found {
+			if _, err := r.archiveWithKeys(ctx, page, keys[page], now); err != nil {
+				failures[page] = err
+			}
+		}
+	} else {
+		failures, err = r.clearPages(ctx, op, found, keys)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var aliases map[string][]string
+	if op != batchReset {
+		// The pages are gone either way, so failing to read their aliases
+		// only leaves them out
+		if aliases, err = r.aliasesOf(ctx, found); err != nil {
+			log.Printf("Error getting page aliases: %v", err)
+		}
+	}
+	for i := range results {
+		if err, ok := failures[results[i].Page]; ok {
+			results[i].Status, results[i].Error = http.StatusInternalServerError, err.Error()
+		} else {
+			results[i].DanglingAliases = aliases[results[i].Page]
+		}
+	}
+	return results, nil
+}
+
+// clearPages deletes or resets pages in one pipeline, a transaction in
+// strict mode, returning the error of each page whose commands failed. Delete removes the page from every index;
+// reset keeps it listed with zero visits. Metadata is kept either way.
+func (r *RedisClient) clearPages(ctx context.Context, op string, pages []string, keys map[string][]string) (map[string]error, error) {
+	pipe := r.writePipeline()
+	cmds := make(map[string][]redis.Cmder, len(pages))
+	for _, page := range pages {
+		var queued []redis.Cmder
+		if len(keys[page]) > 0 {
+			queued = append(queued, pipe.Del(ctx, keys[page]...))
+		}
+		queued = append(queued,
+			pipe.ZRem(ctx, trendingKey, page),
+			pipe.ZRem(ctx, lastVisitKey, page),
+		)
+		if op == batchReset {
+			queued = append(queued,
+				pipe.Set(ctx, key("visits", page), 0, 0),
+				pipe.ZAdd(ctx, leaderboardKey, redis.Z{Member: page, Score: 0}),
+			)
+		} else {
+			queued = append(queued,
+				pipe.ZRem(ctx, leaderboardKey, page),
+				pipe.ZRem(ctx, pageNamesKey, page),
+				pipe.Del(ctx, searchDocPrefix+page),
+			)
+		}
+		cmds[page] = queued
+	}
+	// Per-command errors are reported per page below
+	if _, err := pipe.Exec(ctx); err != nil && ctx.Err() != nil {
+		return nil, err
+	}
+
+	failures := make(map[string]error)
+	for page, queued := range cmds {
+		for _, cmd := range queued {
+			if err := cmd.Err(); err != nil {
+				failures[page] = err
+				break
+			}
+		}
+	}
+	return failures, nil
+}
+
+// handleBatchPages deletes, resets or archives up to maxBatchPages pages,
+// answering 207 when some of them failed
+func (s *Server) handleBatchPages(c *gin.Context) {
+	var req BatchRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondError(c, http.StatusBadRequest, "invalid_request", "Invalid JSON body: "+err.Error())
+		return
+	}
+	switch req.Operation {
+	case batchDelete, batchReset, batchArchive:
+	default:
+		respondError(c, http.StatusBadRequest, "invalid_request", "operation must be delete, reset or archive")
+		return
+	}
+	if len(req.Pages) == 0 || len(req.Pages) > maxBatchPages {
+		respondError(c, http.StatusBadRequest, "invalid_request", fmt.Sprintf("pages must list 1 to %d pages", maxBatchPages))
+		return
+	}
+
+	// Duplicates are applied once
+	seen := make(map[string]bool, len(req.Pages))
+	pages := make([]string, 0, len(req.Pages))
+	for _, page := range req.Pages {
+		if page == "" {
+			respondError(c, http.StatusBadRequest, "invalid_request", "page names must not be empty")
+			return
+		}
+		if !seen[page] {
+			seen[page] = true
+			pages = append(pages, page)
+		}
+	}
+	c.Set(auditPagesKey, pages)
+
+	results, err := s.redis.BatchPages(c.Request.Context(), req.Operation, pages, s.clock.Now())
+	if err != nil {
+		log.Printf("Error running batch %s: %v", req.Operation, err)
+		respondStoreError(c, err, "Failed to run batch")
+		return
+	}
+
+	response := BatchResponse{Operation: req.Operation, Results: results, Summary: BatchSummary{Total: len(results)}}
+	for _, result := range results {
+		if result.Status == http.StatusOK {
+			response.Summary.Succeeded++
+		} else {
+			response.Summary.Failed++
+		}
+	}
+	if response.Summary.Succeeded > 0 {
+		s.invalidateAggregates(c.Request.Context())
+	}
+
+	status := http.StatusOK
+	if response.Summary.Failed > 0 {
+		status = http.StatusMultiStatus
+	}
+	c.JSON(status, response)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func decodeBatch(t *testing.T, body []byte) BatchResponse {
+	t.Helper()
+	var resp BatchResponse
+	if err := json.Unmarshal(body, &resp); err != nil {
+		t.Fatalf("Failed to decode batch response: %v", err)
+	}
+	return resp
+}
+
+func TestBatchMixedResults(t *testing.T) {
+	_, redisClient := newTestRedis(t)
+	router := newTestServer(t, testConfig(), redisClient).Router()
+	doRequest(router, "PUT", "/admin/flags", `{"rollups": true}`, nil)
+	for _, page := range []string{"a", "b", "c", "old"} {
+		doRequest(router, "GET", "/visit/"+page, "", nil)
+		doRequest(router, "GET", "/visit/"+page, "", nil)
+	}
+	doRequest(router, "POST", "/admin/pages/old/archive", "", nil)
+	ctx := context.Background()
+	if n, _ := redisClient.client.Exists(ctx, dailyKey("a", time.Now())).Result(); n != 1 {
+		t.Fatal("Expected a daily bucket for a")
+	}
+
+	w := doRequest(router, "POST", "/admin/pages/batch", `{"operation": "delete", "pages": ["a", "missing", "old", "b", "a"]}`, nil)
+	if w.Code != http.StatusMultiStatus {
+		t.Fatalf("Expected 207 for a partly failed batch, got %d: %s", w.Code, w.Body.String())
+	}
+	resp := decodeBatch(t, w.Body.Bytes())
+	statuses := make(map[string]int)
+	for _, r := range resp.Results {
+		statuses[r.Page] = r.Status
+		if r.Status != http.StatusOK && r.Error == "" {
+			t.Errorf("Expected an error message for %s", r.Page)
+		}
+	}
+	want := map[string]int{"a": http.StatusOK, "missing": http.StatusNotFound, "old": http.StatusConflict, "b": http.StatusOK}
+	if !reflect.DeepEqual(statuses, want) || resp.Summary != (BatchSummary{Total: 4, Succeeded: 2, Failed: 2}) {
+		t.Errorf("Unexpected results %v, summary %+v", statuses, resp.Summary)
+	}
+
+	if n, _ := redisClient.client.Exists(ctx, "visits:a", dailyKey("a", time.Now())).Result(); n != 0 {
+		t.Errorf("Expected deleted pages to lose their keys, %d remain", n)
+	}
+	if got := pageNames(decodePages(t, doRequest(router, "GET", "/pages", "", nil).Body.Bytes()).Pages); !reflect.DeepEqual(got, []string{"c"}) {
+		t.Errorf("Expected only c to remain listed, got %v", got)
+	}
+}
+
+func TestBatchResetAndArchive(t *testing.T) {
+	_, redisClient := newTestRedis(t)
+	router := newTestServer(t, testConfig(), redisClient).Router()
+	for _, page := range []string{"a", "b"} {
+		doRequest(router, "GET", "/visit/"+page, "", nil)
+	}
+
+	if w := doRequest(router, "POST", "/admin/pages/batch", `{"operation": "reset", "pages": ["a"]}`, nil); w.Code != http.StatusOK {
+		t.Fatalf("Expected 200 for a successful reset, got %d: %s", w.Code, w.Body.String())
+	}
+	listing := decodePages(t, doRequest(router, "GET", "/pages", "", nil).Body.Bytes())
+	if listing.Total != 2 || listing.Pages[0].Page != "a" || listing.Pages[0].Visits != 0 {
+		t.Errorf("Expected a reset page to stay listed with 0 visits, got %+v", listing)
+	}
+
+	if w := doRequest(router, "POST", "/admin/pages/batch", `{"operation": "archive", "pages": ["a", "b"]}`, nil); w.Code != http.StatusOK {
+		t.Fatalf("Expected 200 for a successful archive, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := doRequest(router, "GET", "/visits/b", "", nil); w.Code != http.StatusGone {
+		t.Errorf("Expected archived page to return 410, got %d", w.Code)
+	}
+	if w := doRequest(router, "POST", "/admin/pages/b/unarchive", "", nil); w.Code != http.StatusOK {
+		t.Errorf("Expected batch-archived page to be restorable, got %d", w.Code)
+	}
+	if resp := decodeVisit(t, doRequest(router, "GET", "/visits/b", "", nil).Body.Bytes()); resp.Visits != 1 {
+		t.Errorf("Expected restored count of 1, got %d", resp.Visits)
+	}
+}
+
+func TestBatchValidation(t *testing.T) {
+	_, redisClient := newTestRedis(t)
+	router := newTestServer(t, testConfig(), redisClient).Router()
+
+	tooMany := make([]string, maxBatchPages+1)
+	for i := range tooMany {
+		tooMany[i] = fmt.Sprintf("%q", fmt.Sprintf("p%d", i))
+	}
+	for _, body := range []string{
+		`{"operation": "purge", "pages": ["a"]}`,
+		`{"operation": "delete", "pages": []}`,
+		`{"operation": "delete", "pages": [""]}`,
+		`{"operation": "delete", "pages": [` + strings.Join(tooMany, ",") + `]}`,
+	} {
+		if w := doRequest(router, "POST", "/admin/pages/batch", body, nil); w.Code != http.StatusBadRequest {
+			t.Errorf("Expected 400 for %.60s, got %d", body, w.Code)
+		}
+	}
+}
+
+func TestBatchAuditAndRateLimit(t *testing.T) {
+	_, redisClient := newTestRedis(t)
+	cfg := testConfig()
+	cfg.BatchRateLimit = 2
+	router := newTestServer(t, cfg, redisClient).Router()
+	doRequest(router, "GET", "/visit/a", "", nil)
+
+	body := `{"operation": "delete", "pages": ["a", "b"]}`
+	for i := 0; i < 2; i++ {
+		if w := doRequest(router, "POST", "/admin/pages/batch", body, nil); w.Code == http.StatusTooManyRequests {
+			t.Fatalf("Request %d was rate limited", i)
+		}
+	}
+	w := doRequest(router, "POST", "/admin/pages/batch", body, nil)
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Errorf("Expected 429 with Retry-After, got %d %v", w.Code, w.Header())
+	}
+
+	audit := readAudit(t, router, "")
+	batches := 0
+	for _, entry := range audit.Entries {
+		if entry.Action == "POST /admin/pages/batch" {
+			batches++
+			if !reflect.DeepEqual(entry.Pages, []string{"a", "b"}) {
+				t.Errorf("Expected the page list in the audit entry, got %v", entry.Pages)
+			}
+		}
+	}
+	if batches != 2 {
+		t.Errorf("Expected one audit entry per accepted batch, got %d", batches)
+	}
+}
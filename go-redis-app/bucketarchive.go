@@ -0,0 +1,349 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// archiveIndexName is the file in ARCHIVE_DIR listing the archive files
+	archiveIndexName = "index.json"
+
+	// archiveFileLayout names archive files by when they were written
+	archiveFileLayout = "20060102T150405Z"
+)
+
+// ArchiveFile describes one archive file: gzipped NDJSON of HistoryRow,
+// the daily buckets a retention run removed
+type ArchiveFile struct {
+	Name      string    `json:"name"`
+	CreatedAt Timestamp `json:"created_at"`
+	From      string    `json:"from"`
+	To        string    `json:"to"`
+	Rows      int64     `json:"rows"`
+	Bytes     int64     `json:"bytes"`
+}
+
+// ArchiveFilesResponse lists the archive files
+type ArchiveFilesResponse struct {
+	Files []ArchiveFile `json:"files"`
+	Total int           `json:"total"`
+}
+
+// BucketArchive writes daily buckets to files under a directory before
+// retention removes them, and reads them back for range queries. Files are
+// only ever added: a bucket archived twice, because a retention run failed
+// after archiving it, is read back from the newer file.
+type BucketArchive struct {
+	dir string
+
+	// mu serializes index updates
+	mu sync.Mutex
+}
+
+// newBucketArchive returns the archive under dir, or nil when dir is empty
+func newBucketArchive(dir string) *BucketArchive {
+	if dir == "" {
+		return nil
+	}
+	return &BucketArchive{dir: dir}
+}
+
+// Index returns the archive files, oldest first
+func (a *BucketArchive) Index() ([]ArchiveFile, error) {
+	data, err := os.ReadFile(filepath.Join(a.dir, archiveIndexName))
+	if errors.Is(err, os.ErrNotExist) {
+		return []ArchiveFile{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var files []ArchiveFile
+	if err := json.Unmarshal(data, &files); err != nil {
+		return nil, fmt.Errorf("reading archive index: %w", err)
+	}
+	return files, nil
+}
+
+// writeAtomic writes a file under the archive directory through a
+// temporary file renamed into place, so readers never see a partial file
+func (a *BucketArchive) writeAtomic(name string, write func(io.Writer) error) (int64, error) {
+	if err := os.MkdirAll(a.dir, 0o755); err != nil {
+		return 0, err
+	}
+	f, err := os.CreateTemp(a.dir, ".tmp-"+name+"-*")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(f.Name())
+	if err := write(f); err != nil {
+		f.Close()
+		return 0, err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return 0, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return 0, err
+	}
+	if err := f.Close(); err != nil {
+		return 0, err
+	}
+	return info.Size(), os.Rename(f.Name(), filepath.Join(a.dir, name))
+}
+
+// Archive writes the daily buckets older than before to a new file and adds
+// it to the index, returning it, or nil when there was nothing to archive
+func (a *BucketArchive) Archive(ctx context.Context, r *RedisClient, before, now time.Time) (*ArchiveFile, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	files, err := a.Index()
+	if err != nil {
+		return nil, err
+	}
+	file := ArchiveFile{Name: "daily-" + now.UTC().Format(archiveFileLayout) + ".ndjson.gz", CreatedAt: Timestamp{Time: now.UTC()}}
+	for n := 2; archiveListed(files, file.Name); n++ {
+		file.Name = fmt.Sprintf("daily-%s-%d.ndjson.gz", now.UTC().Format(archiveFileLayout), n)
+	}
+
+	file.Bytes, err = a.writeAtomic(file.Name, func(w io.Writer) error {
+		gz := gzip.NewWriter(w)
+		enc := json.NewEncoder(gz)
+		err := r.DailyBucketsBefore(ctx, before, func(rows []HistoryRow) error {
+			for _, row := range rows {
+				if err := enc.Encode(row); err != nil {
+					return err
+				}
+				if file.From == "" || row.Date < file.From {
+					file.From = row.Date
+				}
+				if row.Date > file.To {
+					file.To = row.Date
+				}
+				file.Rows++
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		return gz.Close()
+	})
+	if err != nil {
+		return nil, fmt.Errorf("writing archive file: %w", err)
+	}
+	if file.Rows == 0 {
+		os.Remove(filepath.Join(a.dir, file.Name))
+		return nil, nil
+	}
+
+	files = append(files, file)
+	_, err = a.writeAtomic(archiveIndexName, func(w io.Writer) error {
+		return json.NewEncoder(w).Encode(files)
+	})
+	if err != nil {
+		os.Remove(filepath.Join(a.dir, file.Name))
+		return nil, fmt.Errorf("writing archive index: %w", err)
+	}
+	return &file, nil
+}
+
+// archiveListed reports whether name is an archive file in files
+func archiveListed(files []ArchiveFile, name string) bool {
+	for _, f := range files {
+		if f.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// ReadDays returns the archived daily counts of page from from to to, by
+// date. Each file overlapping the range is read in full.
+func (a *BucketArchive) ReadDays(page string, from, to time.Time) (map[string]int64, error) {
+	files, err := a.Index()
+	if err != nil {
+		return nil, err
+	}
+	first, last := from.Format(dayLayout), to.Format(dayLayout)
+	days := make(map[string]int64)
+	for _, file := range files {
+		if file.To < first || file.From > last {
+			continue
+		}
+		if err := a.readFile(file.Name, func(row HistoryRow) {
+			if row.Page == page && row.Date >= first && row.Date <= last {
+				days[row.Date] = row.Visits
+			}
+		}); err != nil {
+			return nil, fmt.Errorf("reading archive file %s: %w", file.Name, err)
+		}
+	}
+	return days, nil
+}
+
+// readFile calls fn with each row of an archive file
+func (a *BucketArchive) readFile(name string, fn func(HistoryRow)) error {
+	f, err := os.Open(filepath.Join(a.dir, name))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bufio.NewReader(gz))
+	for {
+		var row HistoryRow
+		if err := dec.Decode(&row); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		fn(row)
+	}
+}
+
+// DailyBucketsBefore calls fn with each batch of daily buckets older than
+// before
+func (r *RedisClient) DailyBucketsBefore(ctx context.Context, before time.Time, fn func([]HistoryRow) error) error {
+	return r.scanKeys(ctx, "visits:*:daily:*", func(keys []string) error {
+		var rows []HistoryRow
+		var old []string
+		for _, key := range keys {
+			if page, resolution, day, ok := parseBucketKey(key); ok && resolution == resolutionDaily && day.Before(before) {
+				rows = append(rows, HistoryRow{Page: page, Date: day.Format(dayLayout)})
+				old = append(old, key)
+			}
+		}
+		if len(old) == 0 {
+			return nil
+		}
+		values, err := r.client.MGet(ctx, old...).Result()
+		if err != nil {
+			return err
+		}
+		kept := rows[:0]
+		for i, v := range values {
+			if s, ok := v.(string); ok {
+				rows[i].Visits, _ = strconv.ParseInt(s, 10, 64)
+				kept = append(kept, rows[i])
+			}
+		}
+		return fn(kept)
+	})
+}
+
+// removedBefore returns the day before which retention removes daily
+// buckets, rolled up or expired, or the zero time when it keeps them all
+func (p RetentionPolicy) removedBefore(now time.Time) time.Time {
+	daily, monthly := p.cutoffs(now)
+	if daily.After(monthly) {
+		return daily
+	}
+	return monthly
+}
+
+// mergeArchived adds archived days missing from points, the result of
+// VisitRange, taking them out of their month's rolled-up point so no visit
+// is counted twice. A month's point is dropped once its archived days
+// account for all of it. archived must cover whole months. It also returns
+// the number of days added.
+func mergeArchived(points []RangePoint, archived map[string]int64, from, to time.Time) ([]RangePoint, int) {
+	present := make(map[string]bool, len(points))
+	for _, p := range points {
+		if p.Resolution == resolutionDaily {
+			present[p.Period] = true
+		}
+	}
+	months := make(map[string]int64)
+	for day, n := range archived {
+		if !present[day] {
+			months[day[:len(monthLayout)]] += n
+		}
+	}
+
+	first, last := from.Format(dayLayout), to.Format(dayLayout)
+	merged := make([]RangePoint, 0, len(points)+len(archived))
+	added := 0
+	for _, p := range points {
+		if p.Resolution == resolutionMonthly {
+			if p.Visits -= months[p.Period]; p.Visits <= 0 {
+				continue
+			}
+		}
+		merged = append(merged, p)
+	}
+	for day, n := range archived {
+		if !present[day] && day >= first && day <= last {
+			merged = append(merged, RangePoint{Period: day, Resolution: resolutionDaily, Visits: n})
+			added++
+		}
+	}
+	// Months sort ahead of their days, as VisitRange orders them
+	sort.SliceStable(merged, func(i, j int) bool { return merged[i].Period < merged[j].Period })
+	return merged, added
+}
+
+// archiveRange is VisitRange's points merged with the page's archived days
+func (s *Server) archiveRange(page string, points []RangePoint, from, to time.Time) ([]RangePoint, int, error) {
+	monthStart := time.Date(from.Year(), from.Month(), 1, 0, 0, 0, 0, time.UTC)
+	monthEnd := time.Date(to.Year(), to.Month()+1, 0, 0, 0, 0, 0, time.UTC)
+	archived, err := s.archive.ReadDays(page, monthStart, monthEnd)
+	if err != nil {
+		return nil, 0, err
+	}
+	merged, added := mergeArchived(points, archived, from, to)
+	return merged, added, nil
+}
+
+// handleListArchiveFiles lists the archive files
+func (s *Server) handleListArchiveFiles(c *gin.Context) {
+	files, err := s.archive.Index()
+	if err != nil {
+		log.Printf("Error reading archive index: %v", err)
+		respondError(c, http.StatusInternalServerError, "internal_error", "Failed to list archive files")
+		return
+	}
+	for i := range files {
+		files[i].CreatedAt = stamp(c, files[i].CreatedAt.Time)
+	}
+	respondJSON(c, http.StatusOK, ArchiveFilesResponse{Files: files, Total: len(files)})
+}
+
+// handleGetArchiveFile downloads an archive file. Only files in the index
+// are served, so the name can't reach outside ARCHIVE_DIR.
+func (s *Server) handleGetArchiveFile(c *gin.Context) {
+	files, err := s.archive.Index()
+	if err != nil {
+		log.Printf("Error reading archive index: %v", err)
+		respondError(c, http.StatusInternalServerError, "internal_error", "Failed to get archive file")
+		return
+	}
+	name := c.Param("name")
+	if !archiveListed(files, name) {
+		respondError(c, http.StatusNotFound, "not_found", "Archive file not found")
+		return
+	}
+	c.Header("Content-Type", "application/gzip")
+	c.FileAttachment(filepath.Join(s.archive.dir, name), name)
+}
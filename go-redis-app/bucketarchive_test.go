@@ -0,0 +1,155 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"go-redis-app/internal/clocktest"
+)
+
+func TestMergeArchived(t *testing.T) {
+	points := []RangePoint{
+		{"2024-02", resolutionMonthly, 12},
+		{"2024-02-29", resolutionDaily, 7},
+		{"2024-03", resolutionMonthly, 4},
+		{"2024-03-01", resolutionDaily, 1},
+	}
+	archived := map[string]int64{
+		"2024-02-01": 2, // outside the range, but in February's point
+		"2024-02-28": 3,
+		"2024-02-29": 9, // archived by a failed run, still in Redis
+		"2024-03-02": 4,
+	}
+	got, added := mergeArchived(points, archived, parseDay("2024-02-28"), parseDay("2024-03-02"))
+	want := []RangePoint{
+		{"2024-02", resolutionMonthly, 7},
+		{"2024-02-28", resolutionDaily, 3},
+		{"2024-02-29", resolutionDaily, 7},
+		{"2024-03-01", resolutionDaily, 1},
+		{"2024-03-02", resolutionDaily, 4},
+	}
+	if !reflect.DeepEqual(got, want) || added != 2 {
+		t.Errorf("mergeArchived = %v, %d, want %v, 2", got, added, want)
+	}
+}
+
+func TestBucketArchiveRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	mr, redisClient := newTestRedis(t)
+	days := map[string]int64{"2024-02-10": 2, "2024-02-28": 3, "2024-03-01": 4, "2024-03-03": 5}
+	for date, count := range days {
+		redisClient.client.Set(ctx, dailyKey("home", parseDay(date)), count, 0)
+	}
+	redisClient.client.Set(ctx, dailyKey("docs", parseDay("2024-02-11")), 6, 0)
+
+	cfg := testConfig()
+	cfg.Retention = RetentionPolicy{DailyDays: 2}
+	cfg.ArchiveDir = filepath.Join(t.TempDir(), "archive")
+	clock := clocktest.New(time.Date(2024, 3, 3, 12, 0, 0, 0, time.UTC))
+	router := newTestServerWithClock(t, cfg, redisClient, clock).Router()
+
+	// A dry run archives nothing
+	if w := doRequest(router, "POST", "/admin/retention?dry_run=true", "", nil); w.Code != http.StatusOK {
+		t.Fatalf("Dry run: %d %s", w.Code, w.Body.String())
+	}
+	if _, err := os.Stat(cfg.ArchiveDir); !os.IsNotExist(err) {
+		t.Errorf("Expected no archive written by a dry run, got %v", err)
+	}
+
+	if w := doRequest(router, "POST", "/admin/retention", "", nil); w.Code != http.StatusOK {
+		t.Fatalf("Retention: %d %s", w.Code, w.Body.String())
+	}
+	if mr.Exists("visits:home:daily:2024-02-28") {
+		t.Fatal("Expected the old buckets rolled up")
+	}
+
+	w := doRequest(router, "GET", "/admin/archive/files", "", nil)
+	var list ArchiveFilesResponse
+	json.Unmarshal(w.Body.Bytes(), &list)
+	if w.Code != http.StatusOK || list.Total != 1 {
+		t.Fatalf("Expected one archive file, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := doRequest(router, "GET", "/admin/archive/files?ts=unix", "", nil); !strings.Contains(w.Body.String(), `"created_at":1709467200`) {
+		t.Errorf("Expected created_at in the requested format, got %s", w.Body.String())
+	}
+	file := list.Files[0]
+	if file.Name != "daily-20240303T120000Z.ndjson.gz" || file.From != "2024-02-10" || file.To != "2024-02-28" || file.Rows != 3 || file.Bytes == 0 {
+		t.Errorf("Unexpected archive file %+v", file)
+	}
+
+	w = doRequest(router, "GET", "/admin/archive/files/"+file.Name, "", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Download: %d %s", w.Code, w.Body.String())
+	}
+	gz, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows := map[HistoryRow]bool{}
+	for dec := json.NewDecoder(gz); ; {
+		var row HistoryRow
+		if dec.Decode(&row) != nil {
+			break
+		}
+		rows[row] = true
+	}
+	want := map[HistoryRow]bool{{"home", "2024-02-10", 2}: true, {"home", "2024-02-28", 3}: true, {"docs", "2024-02-11", 6}: true}
+	if !reflect.DeepEqual(rows, want) {
+		t.Errorf("Expected the removed buckets archived, got %v", rows)
+	}
+	for _, name := range []string{"index.json", "..%2Findex.json", "daily-nope.ndjson.gz"} {
+		if w := doRequest(router, "GET", "/admin/archive/files/"+name, "", nil); w.Code != http.StatusNotFound {
+			t.Errorf("Expected %s not served, got %d", name, w.Code)
+		}
+	}
+
+	// Out of retention, the range has February as one monthly point, or
+	// read through the archive route just the days in range
+	w = doRequest(router, "GET", "/visits/home/range?from=2024-02-27&to=2024-03-01", "", nil)
+	var plain RangeResponse
+	json.Unmarshal(w.Body.Bytes(), &plain)
+	if len(plain.Points) != 2 || plain.Points[0] != (RangePoint{"2024-02", resolutionMonthly, 5}) {
+		t.Fatalf("Expected February rolled up, got %s", w.Body.String())
+	}
+	w = doRequest(router, "GET", "/admin/archive/pages/home/range?from=2024-02-27&to=2024-03-01", "", nil)
+	var resp RangeResponse
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	wantPoints := []RangePoint{
+		{"2024-02-28", resolutionDaily, 3},
+		{"2024-03-01", resolutionDaily, 4},
+	}
+	if w.Code != http.StatusOK || !reflect.DeepEqual(resp.Points, wantPoints) || resp.Total != 7 || resp.ArchivedDays != 1 {
+		t.Errorf("Expected the archived days read back, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// Nothing left to archive adds no file
+	doRequest(router, "POST", "/admin/retention", "", nil)
+	if files, err := newBucketArchive(cfg.ArchiveDir).Index(); err != nil || len(files) != 1 {
+		t.Errorf("Expected still one archive file, got %v, %v", files, err)
+	}
+	entries, _ := os.ReadDir(cfg.ArchiveDir)
+	if len(entries) != 2 {
+		t.Errorf("Expected the file and index without temporary files, got %v", entries)
+	}
+}
+
+func TestRangeIncludeArchiveWithoutArchive(t *testing.T) {
+	_, redisClient := newTestRedis(t)
+	router := newTestServer(t, testConfig(), redisClient).Router()
+	if w := doRequest(router, "GET", "/visits/home/range?from=2024-03-01&to=2024-03-03&include_archive=true", "", nil); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected include_archive rejected on the public route, got %d", w.Code)
+	}
+	for _, path := range []string{"/admin/archive/files", "/admin/archive/pages/home/range?from=2024-03-01&to=2024-03-03"} {
+		if w := doRequest(router, "GET", path, "", nil); w.Code != http.StatusNotFound {
+			t.Errorf("Expected no archive route %s without ARCHIVE_DIR, got %d", path, w.Code)
+		}
+	}
+}
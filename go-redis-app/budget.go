@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Request phases, as named in Server-Timing
+const (
+	phaseValidate = "validate"
+	phaseRedis    = "redis"
+	phaseEnrich   = "enrich"
+)
+
+// budgetPhase is one step of a request and its share of the time left
+// when it starts, relative to the phases after it. A phase gets at least
+// floor, even if that leaves less for the later ones.
+type budgetPhase struct {
+	name   string
+	weight float64
+	floor  time.Duration
+}
+
+// requestPhases split the deadline of the visit and dashboard handlers:
+// checking the request, its Redis calls and webhook enqueue, then the
+// optional fields read for the response
+var requestPhases = []budgetPhase{
+	{name: phaseValidate, weight: 1, floor: 5 * time.Millisecond},
+	{name: phaseRedis, weight: 6, floor: 50 * time.Millisecond},
+	{name: phaseEnrich, weight: 3, floor: 20 * time.Millisecond},
+}
+
+// phaseTiming is how long a phase was given and took
+type phaseTiming struct {
+	name     string
+	budget   time.Duration // 0 without a deadline
+	duration time.Duration
+	ended    bool
+}
+
+// Budget splits the time left before a request's deadline across its
+// phases in turn, so a step that runs long shrinks the later ones instead
+// of the last always timing out. Deadlines are wall-clock, so it reads
+// time.Now rather than the server's Clock.
+type Budget struct {
+	phases   []budgetPhase
+	deadline time.Time // zero without a deadline
+	now      func() time.Time
+
+	c       *gin.Context
+	request *http.Request // as the handler got it, restored by finish
+	base    *http.Request // with REQUEST_TIMEOUT, the phases' parent
+	writer  gin.ResponseWriter
+	cancel  context.CancelFunc
+
+	current     int // index of the running phase, -1 before the first
+	started     time.Time
+	phaseCancel context.CancelFunc
+	timings     []phaseTiming
+}
+
+// newBudget creates a budget for ctx's deadline, or without limits when it
+// has none
+func newBudget(ctx context.Context, phases []budgetPhase, now func() time.Time) *Budget {
+	deadline, _ := ctx.Deadline()
+	return &Budget{phases: phases, deadline: deadline, now: now, current: -1}
+}
+
+// startBudget gives the request REQUEST_TIMEOUT when set and budgets its
+// phases, adding a Server-Timing header to the response. Call finish when
+// the handler returns.
+func (s *Server) startBudget(c *gin.Context, phases []budgetPhase) *Budget {
+	request := c.Request
+	ctx := request.Context()
+	var cancel context.CancelFunc
+	if s.cfg.RequestTimeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, s.cfg.RequestTimeout)
+		c.Request = request.WithContext(ctx)
+		deadline, _ := ctx.Deadline()
+		c.Set(deadlineKey, deadline)
+	}
+	b := newBudget(ctx, phases, time.Now)
+	b.c, b.request, b.base, b.writer, b.cancel = c, request, c.Request, c.Writer, cancel
+	c.Writer = &serverTimingWriter{ResponseWriter: c.Writer, budget: b}
+	return b
+}
+
+// allot is the time phase i gets when it starts now
+func (b *Budget) allot(i int, now time.Time) time.Duration {
+	if b.deadline.IsZero() {
+		return 0
+	}
+	var weights float64
+	for _, p := range b.phases[i:] {
+		weights += p.weight
+	}
+	share := time.Duration(float64(b.deadline.Sub(now)) * b.phases[i].weight / weights)
+	return max(share, b.phases[i].floor)
+}
+
+// enter ends the running phase and starts the named one, giving the
+// request its slice of the deadline until the next phase starts. Phases
+// are entered in order; skipping one hands its share to the rest.
+func (b *Budget) enter(name string) {
+	now := b.now()
+	b.end(now)
+	b.release()
+	for i := b.current + 1; i < len(b.phases); i++ {
+		if b.phases[i].name != name {
+			continue
+		}
+		b.current, b.started = i, now
+		budget := b.allot(i, now)
+		b.timings = append(b.timings, phaseTiming{name: name, budget: budget})
+		if b.c == nil {
+			return
+		}
+		b.c.Request = b.base
+		if budget > 0 {
+			ctx, cancel := context.WithTimeout(b.base.Context(), budget)
+			b.c.Request, b.phaseCancel = b.base.WithContext(ctx), cancel
+		}
+		return
+	}
+	panic(fmt.Sprintf("budget phase %q is unknown or out of order", name))
+}
+
+// end records the running phase's duration up to now, once
+func (b *Budget) end(now time.Time) {
+	if n := len(b.timings); n > 0 && !b.timings[n-1].ended {
+		b.timings[n-1].duration, b.timings[n-1].ended = now.Sub(b.started), true
+	}
+}
+
+// release cancels the running phase's context
+func (b *Budget) release() {
+	if b.phaseCancel != nil {
+		b.phaseCancel()
+		b.phaseCancel = nil
+	}
+}
+
+// finish ends the running phase and restores the request and writer
+func (b *Budget) finish() {
+	b.end(b.now())
+	b.release()
+	if b.cancel != nil {
+		b.cancel()
+	}
+	b.c.Request, b.c.Writer = b.request, b.writer
+}
+
+// serverTiming formats the phases so far as a Server-Timing header value,
+// durations in milliseconds with the budget as the description
+func (b *Budget) serverTiming() string {
+	b.end(b.now())
+	parts := make([]string, len(b.timings))
+	for i, t := range b.timings {
+		parts[i] = t.name + ";dur=" + strconv.FormatFloat(durationMs(t.duration), 'f', 2, 64)
+		if t.budget > 0 {
+			parts[i] += `;desc="budget ` + t.budget.Round(time.Millisecond).String() + `"`
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+// serverTimingWriter sets the budget's Server-Timing header just before the
+// response's headers are sent, the running phase ending there
+type serverTimingWriter struct {
+	gin.ResponseWriter
+	budget *Budget
+	set    bool
+}
+
+func (w *serverTimingWriter) setHeader() {
+	if !w.set && !w.Written() {
+		w.set = true
+		w.Header().Set("Server-Timing", w.budget.serverTiming())
+	}
+}
+
+func (w *serverTimingWriter) WriteHeaderNow() {
+	w.setHeader()
+	w.ResponseWriter.WriteHeaderNow()
+}
+
+func (w *serverTimingWriter) Write(b []byte) (int, error) {
+	w.setHeader()
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *serverTimingWriter) WriteString(s string) (int, error) {
+	w.setHeader()
+	return w.ResponseWriter.WriteString(s)
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"go-redis-app/internal/clocktest"
+)
+
+// runBudget enters every request phase of a budget with 5s left, the
+// phases taking the given times, and returns its Server-Timing
+func runBudget(validate, redis, enrich time.Duration) (*Budget, string) {
+	clock := clocktest.New(time.Now())
+	ctx, cancel := context.WithDeadline(context.Background(), clock.Now().Add(5*time.Second))
+	defer cancel()
+	b := newBudget(ctx, requestPhases, clock.Now)
+	b.enter(phaseValidate)
+	clock.Advance(validate)
+	b.enter(phaseRedis)
+	clock.Advance(redis)
+	b.enter(phaseEnrich)
+	clock.Advance(enrich)
+	return b, b.serverTiming()
+}
+
+func TestBudgetSplitsDeadline(t *testing.T) {
+	_, timing := runBudget(100*time.Millisecond, 200*time.Millisecond, 50*time.Millisecond)
+	// 5s split 1:6:3, then what is left after each phase
+	want := `validate;dur=100.00;desc="budget 500ms", redis;dur=200.00;desc="budget 3.267s", enrich;dur=50.00;desc="budget 4.7s"`
+	if timing != want {
+		t.Errorf("Expected %s, got %s", want, timing)
+	}
+
+	// A slow validation leaves less for Redis and the rest
+	slow, _ := runBudget(3*time.Second, 200*time.Millisecond, 0)
+	if got := slow.timings[1].budget; got != 2*time.Second*6/9 {
+		t.Errorf("Expected the Redis budget shrunk to 1.333s, got %s", got)
+	}
+	if got := slow.timings[2].budget; got != 1800*time.Millisecond {
+		t.Errorf("Expected the enrich budget shrunk to 1.8s, got %s", got)
+	}
+
+	// Past the deadline every phase still gets its floor
+	late, _ := runBudget(6*time.Second, 0, 0)
+	if late.timings[1].budget != 50*time.Millisecond || late.timings[2].budget != 20*time.Millisecond {
+		t.Errorf("Expected the floors, got %+v", late.timings)
+	}
+
+	// Without a deadline only the durations are reported
+	b := newBudget(context.Background(), requestPhases, time.Now)
+	b.enter(phaseValidate)
+	b.enter(phaseEnrich)
+	if timing := b.serverTiming(); strings.Contains(timing, "desc") || !strings.HasPrefix(timing, "validate;dur=") || !strings.Contains(timing, ", enrich;dur=") {
+		t.Errorf("Expected the skipped phase left out and no budgets, got %s", timing)
+	}
+}
+
+func TestBudgetPhaseDeadlines(t *testing.T) {
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	request := httptest.NewRequest("GET", "/visit/home", nil)
+	c.Request = request
+	server := &Server{cfg: Config{RequestTimeout: 5 * time.Second}}
+
+	b := server.startBudget(c, requestPhases)
+	b.enter(phaseValidate)
+	validate := c.Request.Context()
+	deadline, ok := validate.Deadline()
+	if left := time.Until(deadline); !ok || left > 500*time.Millisecond || left < 400*time.Millisecond {
+		t.Errorf("Expected about 500ms for validation, got %s", left)
+	}
+	b.enter(phaseRedis)
+	if validate.Err() == nil {
+		t.Error("Expected the validation context cancelled once it ended")
+	}
+	deadline, _ = c.Request.Context().Deadline()
+	if left := time.Until(deadline); left < 3*time.Second {
+		t.Errorf("Expected the Redis phase not bound by validation's deadline, got %s", left)
+	}
+
+	c.JSON(http.StatusOK, gin.H{})
+	b.finish()
+	if c.Request != request {
+		t.Error("Expected the request restored")
+	}
+	if timing := w.Header().Get("Server-Timing"); !strings.HasPrefix(timing, "validate;dur=") || !strings.Contains(timing, ", redis;dur=") {
+		t.Errorf("Expected both phases in Server-Timing, got %q", timing)
+	}
+}
+
+func TestServerTimingHeader(t *testing.T) {
+	_, redisClient := newTestRedis(t)
+	cfg := testConfig()
+	cfg.RequestTimeout = 5 * time.Second
+	router := newTestServer(t, cfg, redisClient).Router()
+
+	for _, path := range []string{"/visit/home?include=rank", "/visits/home/range?from=2024-03-01&to=2024-03-03"} {
+		w := doRequest(router, "GET", path, "", nil)
+		timing := w.Header().Get("Server-Timing")
+		phases := strings.Split(timing, ", ")
+		if w.Code != http.StatusOK || len(phases) != 3 {
+			t.Fatalf("Expected three phases for %s, got %d: %q", path, w.Code, timing)
+		}
+		for i, name := range []string{phaseValidate, phaseRedis, phaseEnrich} {
+			if !strings.HasPrefix(phases[i], name+";dur=") || !strings.Contains(phases[i], `;desc="budget `) {
+				t.Errorf("Expected %s with its budget, got %q", name, phases[i])
+			}
+		}
+	}
+
+	// A rejected request reports the phases it reached
+	w := doRequest(router, "GET", "/visit/home?weight=-1", "", nil)
+	if timing := w.Header().Get("Server-Timing"); w.Code != http.StatusBadRequest || !strings.HasPrefix(timing, "validate;") || strings.Contains(timing, "redis") {
+		t.Errorf("Expected only validation timed, got %d: %q", w.Code, timing)
+	}
+}
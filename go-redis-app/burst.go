@@ -0,0 +1,123 @@
+package main
+
+import (
+	"container/list"
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+const (
+	// burstShards splits the burst dedup table so concurrent visits rarely
+	// wait on the same lock
+	burstShards = 64
+
+	// burstShardCapacity bounds the requests remembered per shard; past it
+	// the oldest are forgotten early
+	burstShardCapacity = 4096
+
+	// maxBurstDedupWindow bounds BURST_DEDUP_WINDOW: retries come within
+	// milliseconds, and a longer window starts dropping real repeat visits
+	maxBurstDedupWindow = 10 * time.Second
+)
+
+// burstEntry is the first request of a burst and when it was seen
+type burstEntry struct {
+	key uint64
+	at  time.Time
+}
+
+// burstShard holds the recent first requests in the order they were seen,
+// oldest at the back, so expired ones are dropped from the back
+type burstShard struct {
+	mu      sync.Mutex
+	entries map[uint64]*list.Element
+	order   *list.List
+}
+
+// BurstDedup drops exact repeats of a request within a short window, such
+// as browsers retrying the same visit several times within milliseconds. It
+// lives in process memory, so the check costs no Redis round trip; a burst
+// spread over replicas by the load balancer is only caught per replica.
+type BurstDedup struct {
+	window time.Duration
+	shards []burstShard
+}
+
+// newBurstDedup creates a BurstDedup over n shards, or nil when the window
+// is 0, disabling it
+func newBurstDedup(window time.Duration, n int) *BurstDedup {
+	if window <= 0 {
+		return nil
+	}
+	d := &BurstDedup{window: window, shards: make([]burstShard, n)}
+	for i := range d.shards {
+		d.shards[i] = burstShard{entries: make(map[uint64]*list.Element), order: list.New()}
+	}
+	return d
+}
+
+// burstKey hashes what identifies a repeated request: the client IP, the
+// page and the user agent
+func burstKey(ip, page, userAgent string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(ip))
+	h.Write([]byte{0})
+	h.Write([]byte(page))
+	h.Write([]byte{0})
+	h.Write([]byte(userAgent))
+	return h.Sum64()
+}
+
+// first reports whether a request is the first of its burst at now, that
+// is, no request with the same key was first within the window before it.
+// Repeats do not extend the window, so steady traffic is still counted.
+func (d *BurstDedup) first(key uint64, now time.Time) bool {
+	s := &d.shards[key%uint64(len(d.shards))]
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Forget what has expired, keeping the shard small between bursts
+	for back := s.order.Back(); back != nil; back = s.order.Back() {
+		e := back.Value.(*burstEntry)
+		if now.Sub(e.at) < d.window {
+			break
+		}
+		delete(s.entries, e.key)
+		s.order.Remove(back)
+	}
+
+	if _, ok := s.entries[key]; ok {
+		// Still within the window, as expired entries are gone
+		return false
+	}
+	if s.order.Len() >= burstShardCapacity {
+		oldest := s.order.Back()
+		delete(s.entries, oldest.Value.(*burstEntry).key)
+		s.order.Remove(oldest)
+	}
+	s.entries[key] = s.order.PushFront(&burstEntry{key: key, at: now})
+	return true
+}
+
+// release forgets the request remembered as first at at, unless a later
+// request has taken its place
+func (d *BurstDedup) release(key uint64, at time.Time) {
+	s := &d.shards[key%uint64(len(d.shards))]
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e, ok := s.entries[key]; ok && e.Value.(*burstEntry).at.Equal(at) {
+		delete(s.entries, key)
+		s.order.Remove(e)
+	}
+}
+
+// seen reports whether a request at now would be dropped as a repeat,
+// without remembering it as first
+func (d *BurstDedup) seen(key uint64, now time.Time) bool {
+	s := &d.shards[key%uint64(len(d.shards))]
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.entries[key]
+	return ok && now.Sub(e.Value.(*burstEntry).at) < d.window
+}
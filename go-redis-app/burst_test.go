@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go-redis-app/internal/clocktest"
+)
+
+func TestBurstDedupWindow(t *testing.T) {
+	d := newBurstDedup(100*time.Millisecond, 4)
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	home := burstKey("203.0.113.7", "home", "Mozilla/5.0")
+
+	for _, tt := range []struct {
+		key   uint64
+		at    time.Duration
+		first bool
+	}{
+		{home, 0, true},
+		{home, 20 * time.Millisecond, false},
+		{home, 90 * time.Millisecond, false},
+		{burstKey("203.0.113.7", "home", "curl/8.0"), 30 * time.Millisecond, true},
+		{burstKey("203.0.113.8", "home", "Mozilla/5.0"), 30 * time.Millisecond, true},
+		{burstKey("203.0.113.7", "blog", "Mozilla/5.0"), 30 * time.Millisecond, true},
+		// Repeats did not extend the window
+		{home, 100 * time.Millisecond, true},
+		{home, 150 * time.Millisecond, false},
+	} {
+		if got := d.first(tt.key, start.Add(tt.at)); got != tt.first {
+			t.Errorf("At +%s: expected first=%t", tt.at, tt.first)
+		}
+	}
+
+	if newBurstDedup(0, burstShards) != nil {
+		t.Error("Expected burst dedup disabled without a window")
+	}
+}
+
+func TestBurstDedupCapacity(t *testing.T) {
+	d := newBurstDedup(time.Minute, 1)
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	for i := uint64(0); i <= burstShardCapacity; i++ {
+		d.first(i, now)
+	}
+	if n := d.shards[0].order.Len(); n != burstShardCapacity {
+		t.Errorf("Expected the shard capped at %d, got %d", burstShardCapacity, n)
+	}
+	if !d.first(0, now) {
+		t.Error("Expected the oldest request forgotten past the cap")
+	}
+
+	// Expired requests are dropped on the next check
+	d.first(1, now.Add(2*time.Minute))
+	if n := d.shards[0].order.Len(); n != 1 {
+		t.Errorf("Expected only the new request left, got %d", n)
+	}
+}
+
+// TestBurstDedupConcurrent is meant to be run with -race: of every burst of
+// identical requests arriving at once, exactly one is first
+func TestBurstDedupConcurrent(t *testing.T) {
+	d := newBurstDedup(time.Minute, burstShards)
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	const clients, repeats = 200, 8
+	var firsts [clients]atomic.Int64
+	var wg sync.WaitGroup
+	for r := 0; r < repeats; r++ {
+		for i := 0; i < clients; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				if d.first(burstKey(fmt.Sprintf("10.0.0.%d", i), "home", "Mozilla/5.0"), now) {
+					firsts[i].Add(1)
+				}
+			}(i)
+		}
+	}
+	wg.Wait()
+	for i := range firsts {
+		if n := firsts[i].Load(); n != 1 {
+			t.Errorf("Client %d: expected one first request, got %d", i, n)
+		}
+	}
+}
+
+func TestBurstDedupVisits(t *testing.T) {
+	_, redisClient := newTestRedis(t)
+	cfg := testConfig()
+	cfg.BurstDedupWindow = 100 * time.Millisecond
+	clock := clocktest.New(time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC))
+	router := newTestServerWithClock(t, cfg, redisClient, clock).Router()
+	firefox := map[string]string{"User-Agent": "Mozilla/5.0 Firefox"}
+
+	visit := func(headers map[string]string) VisitResponse {
+		t.Helper()
+		return decodeVisit(t, doRequest(router, "GET", "/visit/home", "", headers).Body.Bytes())
+	}
+	if v := visit(firefox); !*v.Counted || v.Visits != 1 {
+		t.Errorf("Expected the first request counted, got %+v", v)
+	}
+	for i := 0; i < 3; i++ {
+		if v := visit(firefox); *v.Counted || v.Visits != 1 {
+			t.Errorf("Expected the retry not counted, got %+v", v)
+		}
+	}
+	if v := visit(map[string]string{"User-Agent": "curl/8.0"}); !*v.Counted || v.Visits != 2 {
+		t.Errorf("Expected another user agent counted, got %+v", v)
+	}
+	clock.Advance(100 * time.Millisecond)
+	if v := visit(firefox); !*v.Counted || v.Visits != 3 {
+		t.Errorf("Expected a request after the window counted, got %+v", v)
+	}
+}
+
+func TestBurstDedupFailedVisit(t *testing.T) {
+	mr, redisClient := newTestRedis(t)
+	cfg := testConfig()
+	cfg.BurstDedupWindow = 100 * time.Millisecond
+	clock := clocktest.New(time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC))
+	router := newTestServerWithClock(t, cfg, redisClient, clock).Router()
+
+	// The counter can't be incremented, so the visit fails
+	mr.Lpush(key("visits", "home"), "x")
+	if w := doRequest(router, "GET", "/visit/home", "", nil); w.Code < 500 {
+		t.Fatalf("Expected the visit to fail, got %d: %s", w.Code, w.Body.String())
+	}
+	mr.Del(key("visits", "home"))
+	// Its retry, within the window, is not a repeat of a counted visit
+	if v := decodeVisit(t, doRequest(router, "GET", "/visit/home", "", nil).Body.Bytes()); !*v.Counted || v.Visits != 1 {
+		t.Errorf("Expected the retry of a failed visit counted, got %+v", v)
+	}
+}
+
+// BenchmarkBurstDedup compares one locked map with the sharded one under
+// parallel visits from many clients
+func BenchmarkBurstDedup(b *testing.B) {
+	keys := make([]uint64, 1<<14)
+	for i := range keys {
+		keys[i] = burstKey(fmt.Sprintf("10.0.%d.%d", i/256, i%256), "home", "Mozilla/5.0")
+	}
+	for _, shards := range []int{1, burstShards} {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			d := newBurstDedup(100*time.Millisecond, shards)
+			var next atomic.Int64
+			b.RunParallel(func(pb *testing.PB) {
+				i := int(next.Add(1)) * 7919
+				for pb.Next() {
+					d.first(keys[i%len(keys)], time.Now())
+					i++
+				}
+			})
+		})
+	}
+}
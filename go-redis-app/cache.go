@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Cache-Status header values
+const (
+	cacheHit   = "hit"
+	cacheMiss  = "miss"
+	cacheStale = "stale"
+)
+
+// cacheRefreshTimeout bounds a recomputation, which runs detached from the
+// request that triggered it
+const cacheRefreshTimeout = 10 * time.Second
+
+// aggregateCache is a TTL cache for expensive aggregations. Concurrent misses
+// on a key share one recomputation, and for one more TTL after expiry the old
+// value is served as stale while a single background refresh runs.
+type aggregateCache struct {
+	ttl   time.Duration
+	clock Clock
+
+	mu         sync.Mutex
+	entries    map[string]cacheEntry
+	calls      map[string]*cacheCall
+	generation uint64
+}
+
+type cacheEntry struct {
+	value   any
+	expires time.Time
+}
+
+// cacheCall is a recomputation in flight, waited on by every caller of its key
+type cacheCall struct {
+	done  chan struct{}
+	value any
+	err   error
+}
+
+// newAggregateCache creates a cache; a non-positive ttl disables it
+func newAggregateCache(ttl time.Duration, clock Clock) *aggregateCache {
+	return &aggregateCache{
+		ttl:     ttl,
+		clock:   clock,
+		entries: make(map[string]cacheEntry),
+		calls:   make(map[string]*cacheCall),
+	}
+}
+
+// Get returns the cached value for key, calling load on a miss, along with
+// the Cache-Status to report ("" when caching is disabled)
+func (c *aggregateCache) Get(ctx context.Context, key string, load func(context.Context) (any, error)) (any, string, error) {
+	if c.ttl <= 0 {
+		v, err := load(ctx)
+		return v, "", err
+	}
+
+	now := c.clock.Now()
+	c.mu.Lock()
+	entry, ok := c.entries[key]
+	c.mu.Unlock()
+	switch {
+	case ok && now.Before(entry.expires):
+		return entry.value, cacheHit, nil
+	case ok && now.Before(entry.expires.Add(c.ttl)):
+		go c.do(context.WithoutCancel(ctx), key, load)
+		return entry.value, cacheStale, nil
+	}
+	v, err := c.do(context.WithoutCancel(ctx), key, load)
+	return v, cacheMiss, err
+}
+
+// do runs load for key unless a call is already in flight, in which case it
+// waits for that call's result
+func (c *aggregateCache) do(ctx context.Context, key string, load func(context.Context) (any, error)) (any, error) {
+	c.mu.Lock()
+	if call, ok := c.calls[key]; ok {
+		c.mu.Unlock()
+		<-call.done
+		return call.value, call.err
+	}
+	call := &cacheCall{done: make(chan struct{})}
+	c.calls[key] = call
+	generation := c.generation
+	c.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(ctx, cacheRefreshTimeout)
+	defer cancel()
+	call.value, call.err = load(ctx)
+
+	c.mu.Lock()
+	// A result computed before an invalidation must not be cached
+	if call.err == nil && generation == c.generation {
+		c.entries[key] = cacheEntry{value: call.value, expires: c.clock.Now().Add(c.ttl)}
+	}
+	if c.calls[key] == call {
+		delete(c.calls, key)
+	}
+	c.mu.Unlock()
+	close(call.done)
+	return call.value, call.err
+}
+
+// Invalidate drops every cached value, so the next request recomputes
+// rather than joining a recomputation that started before the change
+func (c *aggregateCache) Invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = make(map[string]cacheEntry)
+	c.calls = make(map[string]*cacheCall)
+	c.generation++
+}
+
+// setCacheStatus sets the Cache-Status header when caching is enabled
+func setCacheStatus(c *gin.Context, status string) {
+	if status != "" {
+		c.Header("Cache-Status", status)
+	}
+}
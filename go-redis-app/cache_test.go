@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestAggregateCacheSingleflight(t *testing.T) {
+	cache := newAggregateCache(time.Minute, systemClock{})
+	var loads atomic.Int64
+	release := make(chan struct{})
+	load := func(context.Context) (any, error) {
+		loads.Add(1)
+		<-release
+		return "value", nil
+	}
+
+	var wg sync.WaitGroup
+	statuses := make(chan string, 20)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			v, status, err := cache.Get(context.Background(), "key", load)
+			if err != nil || v != "value" {
+				t.Errorf("Get = %v, %v", v, err)
+			}
+			statuses <- status
+		}()
+	}
+	// Let every caller reach the in-flight call before it completes
+	waitFor(t, time.Second, func() bool {
+		cache.mu.Lock()
+		defer cache.mu.Unlock()
+		return cache.calls["key"] != nil
+	})
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	close(statuses)
+
+	if n := loads.Load(); n != 1 {
+		t.Errorf("Expected concurrent misses to share 1 load, got %d", n)
+	}
+	for status := range statuses {
+		if status != cacheMiss {
+			t.Errorf("Expected %q for the first requests, got %q", cacheMiss, status)
+		}
+	}
+	if _, status, _ := cache.Get(context.Background(), "key", load); status != cacheHit || loads.Load() != 1 {
+		t.Errorf("Expected a hit without reloading, got %q after %d loads", status, loads.Load())
+	}
+}
+
+func TestAggregateCacheStale(t *testing.T) {
+	cache := newAggregateCache(50*time.Millisecond, systemClock{})
+	var loads atomic.Int64
+	load := func(context.Context) (any, error) {
+		return loads.Add(1), nil
+	}
+
+	cache.Get(context.Background(), "key", load)
+	time.Sleep(60 * time.Millisecond)
+	if v, status, _ := cache.Get(context.Background(), "key", load); status != cacheStale || v != int64(1) {
+		t.Errorf("Expected the old value as stale, got %v %q", v, status)
+	}
+	waitFor(t, time.Second, func() bool {
+		v, status, _ := cache.Get(context.Background(), "key", load)
+		return status == cacheHit && v.(int64) > 1
+	})
+
+	time.Sleep(110 * time.Millisecond)
+	if _, status, _ := cache.Get(context.Background(), "key", load); status != cacheMiss {
+		t.Errorf("Expected a miss past the stale window, got %q", status)
+	}
+}
+
+func TestAggregateCacheDisabled(t *testing.T) {
+	cache := newAggregateCache(0, systemClock{})
+	var loads atomic.Int64
+	load := func(context.Context) (any, error) { return loads.Add(1), nil }
+	cache.Get(context.Background(), "key", load)
+	if _, status, _ := cache.Get(context.Background(), "key", load); status != "" || loads.Load() != 2 {
+		t.Errorf("Expected every call to load with no status, got %q after %d loads", status, loads.Load())
+	}
+}
+
+func TestTopPagesCacheInvalidatedByMutation(t *testing.T) {
+	_, redisClient := newTestRedis(t)
+	cfg := testConfig()
+	cfg.CacheTTL = time.Minute
+	server := newTestServer(t, cfg, redisClient)
+	public, internal := server.PublicRouter(), server.InternalRouter()
+
+	doRequest(public, "GET", "/visit/home", "", nil)
+	if w := doRequest(public, "GET", "/pages/top", "", nil); w.Header().Get("Cache-Status") != cacheMiss {
+		t.Errorf("Expected a miss, got %q", w.Header().Get("Cache-Status"))
+	}
+
+	// Visits within the TTL are not reflected until it expires
+	doRequest(public, "GET", "/visit/about", "", nil)
+	w := doRequest(public, "GET", "/pages/top", "", nil)
+	var resp PagesResponse
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if w.Header().Get("Cache-Status") != cacheHit || resp.Total != 1 {
+		t.Errorf("Expected a cached hit with 1 page, got %q with %d", w.Header().Get("Cache-Status"), resp.Total)
+	}
+
+	if w := doRequest(internal, "PUT", "/admin/pages/home/meta", `{"visibility":"private"}`, nil); w.Code != http.StatusOK {
+		t.Fatalf("Set meta: %d %s", w.Code, w.Body.String())
+	}
+	w = doRequest(public, "GET", "/pages/top", "", nil)
+	resp = PagesResponse{}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if w.Header().Get("Cache-Status") != cacheMiss || resp.Total != 1 || resp.Pages[0].Page != "about" {
+		t.Errorf("Expected a recomputed list without the private page, got %q %+v", w.Header().Get("Cache-Status"), resp)
+	}
+
+	if w := doRequest(internal, "POST", "/admin/backfill/home", `{"entries":[]}`, nil); w.Code != http.StatusOK {
+		t.Fatalf("Backfill: %d %s", w.Code, w.Body.String())
+	}
+	if w := doRequest(public, "GET", "/pages/top", "", nil); w.Header().Get("Cache-Status") != cacheMiss {
+		t.Errorf("Expected backfill to invalidate the cache, got %q", w.Header().Get("Cache-Status"))
+	}
+}
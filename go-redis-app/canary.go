@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// canaryTimeout bounds each call to the canary store
+	canaryTimeout = time.Second
+
+	// canaryMaxInFlight is the number of canary calls running at once;
+	// calls past it are skipped rather than queued
+	canaryMaxInFlight = 64
+
+	// canaryExamples is the number of recent mismatches kept for
+	// /debug/canary
+	canaryExamples = 20
+)
+
+// Canary store formats, chosen by METADATA_CANARY_FORMAT
+const (
+	canaryFormatHash = "hash"
+	canaryFormatJSON = "json"
+)
+
+// newCanaryStore connects to the Redis at addr and returns its metadata
+// store in format
+func newCanaryStore(addr, format string) MetadataStore {
+	redisClient := newRedisClient(redis.NewClient(&redis.Options{Addr: addr}))
+	if format == canaryFormatJSON {
+		return NewJSONMetadataStore(redisClient)
+	}
+	return NewRedisMetadataStore(redisClient)
+}
+
+// CanaryMismatch is one call the two stores answered differently
+type CanaryMismatch struct {
+	Op      string    `json:"op"`
+	Key     string    `json:"key"`
+	Primary string    `json:"primary"`
+	Canary  string    `json:"canary"`
+	At      time.Time `json:"at"`
+}
+
+// canaryStats counts the canary's comparisons per operation
+type canaryStats struct {
+	mu          sync.Mutex
+	comparisons map[string]int64
+	mismatches  map[string]int64
+	errors      map[string]int64
+	skipped     int64
+
+	// recent holds the last canaryExamples mismatches, oldest first
+	recent []CanaryMismatch
+}
+
+// CanaryMetadataStore serves metadata from a primary store while issuing
+// the same calls to a canary store in the background, to compare a backend
+// under real traffic before switching to it. Reads are compared; writes are
+// mirrored once the primary has applied them. The canary never affects a
+// response: its failures and mismatches are only counted and logged.
+type CanaryMetadataStore struct {
+	primary MetadataStore
+	canary  MetadataStore
+	clock   Clock
+
+	inFlight chan struct{}
+	wg       sync.WaitGroup
+	stats    canaryStats
+}
+
+// NewCanaryMetadataStore compares canary against primary
+func NewCanaryMetadataStore(primary, canary MetadataStore, clock Clock) *CanaryMetadataStore {
+	return &CanaryMetadataStore{
+		primary:  primary,
+		canary:   canary,
+		clock:    clock,
+		inFlight: make(chan struct{}, canaryMaxInFlight),
+		stats: canaryStats{
+			comparisons: make(map[string]int64),
+			mismatches:  make(map[string]int64),
+			errors:      make(map[string]int64),
+		},
+	}
+}
+
+// GetMeta returns the primary's metadata, comparing the canary's
+func (s *CanaryMetadataStore) GetMeta(ctx context.Context, page string) (PageMeta, error) {
+	meta, err := s.primary.GetMeta(ctx, page)
+	if err == nil {
+		s.background(ctx, "get", page, func(ctx context.Context) (any, error) {
+			return s.canary.GetMeta(ctx, page)
+		}, meta)
+	}
+	return meta, err
+}
+
+// GetMetas returns the primary's metadata. Batch reads are not compared,
+// so a large batch doesn't crowd single reads out of the canary.
+func (s *CanaryMetadataStore) GetMetas(ctx context.Context, pages []string) ([]PageMeta, error) {
+	return s.primary.GetMetas(ctx, pages)
+}
+
+// SetMeta writes the primary, then mirrors the write to the canary
+func (s *CanaryMetadataStore) SetMeta(ctx context.Context, page string, meta PageMeta) error {
+	if err := s.primary.SetMeta(ctx, page, meta); err != nil {
+		return err
+	}
+	s.background(ctx, "set", page, func(ctx context.Context) (any, error) {
+		return nil, s.canary.SetMeta(ctx, page, meta)
+	}, nil)
+	return nil
+}
+
+// PrivatePages returns the primary's private pages, comparing the canary's
+func (s *CanaryMetadataStore) PrivatePages(ctx context.Context) (map[string]bool, error) {
+	private, err := s.primary.PrivatePages(ctx)
+	if err == nil {
+		s.background(ctx, "private", privatePagesKey, func(ctx context.Context) (any, error) {
+			return s.canary.PrivatePages(ctx)
+		}, private)
+	}
+	return private, err
+}
+
+// background runs call against the canary, comparing its result with want
+// unless want is nil. It is skipped when canaryMaxInFlight calls are
+// already running, so a slow canary can't pile up goroutines.
+func (s *CanaryMetadataStore) background(ctx context.Context, op, key string, call func(context.Context) (any, error), want any) {
+	select {
+	case s.inFlight <- struct{}{}:
+	default:
+		s.stats.mu.Lock()
+		s.stats.skipped++
+		s.stats.mu.Unlock()
+		return
+	}
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		defer func() { <-s.inFlight }()
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), canaryTimeout)
+		defer cancel()
+		got, err := call(ctx)
+		s.record(op, key, want, got, err)
+	}()
+}
+
+// record counts one canary call and keeps it as an example on a mismatch
+func (s *CanaryMetadataStore) record(op, key string, want, got any, err error) {
+	st := &s.stats
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.comparisons[op]++
+	if err != nil {
+		st.errors[op]++
+		log.Printf("Canary %s %s failed: %v", op, key, err)
+		return
+	}
+	if want == nil || reflect.DeepEqual(want, got) {
+		return
+	}
+	st.mismatches[op]++
+	primary, _ := json.Marshal(want)
+	canary, _ := json.Marshal(got)
+	log.Printf("Canary %s %s mismatch: primary %s, canary %s", op, key, primary, canary)
+	st.recent = append(st.recent, CanaryMismatch{Op: op, Key: key, Primary: string(primary), Canary: string(canary), At: s.clock.Now()})
+	if len(st.recent) > canaryExamples {
+		st.recent = st.recent[len(st.recent)-canaryExamples:]
+	}
+}
+
+// wait blocks until the canary calls in flight have finished
+func (s *CanaryMetadataStore) wait() {
+	s.wg.Wait()
+}
+
+// sortedOps returns the operations with at least one comparison, sorted
+func (st *canaryStats) sortedOps() []string {
+	ops := make([]string, 0, len(st.comparisons))
+	for op := range st.comparisons {
+		ops = append(ops, op)
+	}
+	sort.Strings(ops)
+	return ops
+}
+
+// write writes the canary_* series
+func (s *CanaryMetadataStore) write(b *strings.Builder, env string) {
+	st := &s.stats
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	labels := func(op string) string {
+		l := "op=" + strconv.Quote(op)
+		if env != "" {
+			l = "env=" + strconv.Quote(env) + "," + l
+		}
+		return l
+	}
+	ops := st.sortedOps()
+	for _, counter := range []struct {
+		name, help string
+		values     map[string]int64
+	}{
+		{"canary_comparisons_total", "Metadata calls issued to the canary store", st.comparisons},
+		{"canary_mismatches_total", "Canary reads that differed from the primary store", st.mismatches},
+		{"canary_errors_total", "Canary calls that failed", st.errors},
+	} {
+		fmt.Fprintf(b, "# HELP %s %s.\n", counter.name, counter.help)
+		fmt.Fprintf(b, "# TYPE %s counter\n", counter.name)
+		for _, op := range ops {
+			fmt.Fprintf(b, "%s{%s} %d\n", counter.name, labels(op), counter.values[op])
+		}
+	}
+	b.WriteString("# HELP canary_skipped_total Canary calls skipped because too many were in flight.\n")
+	b.WriteString("# TYPE canary_skipped_total counter\n")
+	if env != "" {
+		fmt.Fprintf(b, "canary_skipped_total{env=%s} %d\n", strconv.Quote(env), st.skipped)
+	} else {
+		fmt.Fprintf(b, "canary_skipped_total %d\n", st.skipped)
+	}
+}
+
+// CanaryOpStats are the counts of one operation in /debug/canary
+type CanaryOpStats struct {
+	Comparisons  int64   `json:"comparisons"`
+	Mismatches   int64   `json:"mismatches"`
+	Errors       int64   `json:"errors"`
+	MismatchRate float64 `json:"mismatch_rate"`
+}
+
+// CanaryResponse represents the /debug/canary API response
+type CanaryResponse struct {
+	Enabled bool                     `json:"enabled"`
+	Ops     map[string]CanaryOpStats `json:"ops,omitempty"`
+	Skipped int64                    `json:"skipped"`
+	Recent  []CanaryMismatch         `json:"recent"`
+}
+
+// handleCanary reports the canary's mismatch rates and recent mismatches,
+// newest first
+func (s *Server) handleCanary(c *gin.Context) {
+	if s.canary == nil {
+		respondJSON(c, http.StatusOK, CanaryResponse{Recent: []CanaryMismatch{}})
+		return
+	}
+	st := &s.canary.stats
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	resp := CanaryResponse{Enabled: true, Ops: make(map[string]CanaryOpStats), Skipped: st.skipped, Recent: make([]CanaryMismatch, 0, len(st.recent))}
+	for _, op := range st.sortedOps() {
+		ops := CanaryOpStats{Comparisons: st.comparisons[op], Mismatches: st.mismatches[op], Errors: st.errors[op]}
+		if ok := ops.Comparisons - ops.Errors; ok > 0 {
+			ops.MismatchRate = float64(ops.Mismatches) / float64(ok)
+		}
+		resp.Ops[op] = ops
+	}
+	for i := len(st.recent) - 1; i >= 0; i-- {
+		resp.Recent = append(resp.Recent, st.recent[i])
+	}
+	respondJSON(c, http.StatusOK, resp)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+// newCanaryTestStore compares a hash store on a second miniredis against one
+// on the first
+func newCanaryTestStore(t *testing.T) (*CanaryMetadataStore, *miniredis.Miniredis) {
+	t.Helper()
+	_, primary := newTestRedis(t)
+	canaryMR, canary := newTestRedis(t)
+	return NewCanaryMetadataStore(NewRedisMetadataStore(primary), NewRedisMetadataStore(canary), systemClock{}), canaryMR
+}
+
+func TestCanaryMetadataStore(t *testing.T) {
+	store, canaryMR := newCanaryTestStore(t)
+	ctx := context.Background()
+
+	// Writes are mirrored, so untouched pages agree
+	meta := PageMeta{Title: "Home", Visibility: visibilityPrivate, Tags: []string{"a"}}
+	if err := store.SetMeta(ctx, "home", meta); err != nil {
+		t.Fatal(err)
+	}
+	store.wait()
+	if got, _ := NewRedisMetadataStore(newTestRedisClient(t, canaryMR)).GetMeta(ctx, "home"); got.Title != "Home" {
+		t.Fatalf("Expected the write mirrored to the canary, got %+v", got)
+	}
+	store.GetMeta(ctx, "home")
+	store.PrivatePages(ctx)
+	store.wait()
+	if st := &store.stats; st.mismatches["get"] != 0 || st.mismatches["private"] != 0 || st.comparisons["get"] != 1 {
+		t.Fatalf("Expected the stores to agree, got %+v", st)
+	}
+
+	// The canary diverges
+	canaryMR.HSet(metaKey("home"), "title", "Stale")
+	canaryMR.SRem(privatePagesKey, "home")
+	got, err := store.GetMeta(ctx, "home")
+	if err != nil || got.Title != "Home" {
+		t.Fatalf("Expected the primary's metadata returned, got %+v, %v", got, err)
+	}
+	store.PrivatePages(ctx)
+	store.wait()
+	st := &store.stats
+	if st.mismatches["get"] != 1 || st.mismatches["private"] != 1 || len(st.recent) != 2 {
+		t.Fatalf("Expected both divergences detected, got %+v", st)
+	}
+	if m := st.recent[0]; m.Op != "get" || m.Key != "home" || !strings.Contains(m.Primary, `"title":"Home"`) || !strings.Contains(m.Canary, `"title":"Stale"`) {
+		t.Errorf("Expected the example to carry both values, got %+v", m)
+	}
+
+	// A failing canary is counted, never returned
+	canaryMR.Close()
+	if _, err := store.GetMeta(ctx, "home"); err != nil {
+		t.Errorf("Expected the canary failure hidden, got %v", err)
+	}
+	if err := store.SetMeta(ctx, "home", meta); err != nil {
+		t.Errorf("Expected the canary write failure hidden, got %v", err)
+	}
+	store.wait()
+	if st.errors["get"] != 1 || st.errors["set"] != 1 {
+		t.Errorf("Expected the failures counted, got %+v", st.errors)
+	}
+}
+
+func TestDebugCanary(t *testing.T) {
+	_, redisClient := newTestRedis(t)
+	canaryMR := miniredis.RunT(t)
+	cfg := testConfig()
+	cfg.MetadataCanaryAddr = canaryMR.Addr()
+	cfg.MetadataCanaryFormat = canaryFormatHash
+	server := newTestServer(t, cfg, redisClient)
+	router := server.Router()
+
+	doRequest(router, "PUT", "/admin/pages/home/meta", `{"title": "Home"}`, nil)
+	server.canary.wait()
+	canaryMR.HSet(metaKey("home"), "title", "Stale")
+	for i := 0; i < 3; i++ {
+		if w := doRequest(router, "GET", "/pages/home/meta", "", nil); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"title":"Home"`) {
+			t.Fatalf("Expected the primary's metadata, got %d: %s", w.Code, w.Body.String())
+		}
+	}
+	server.canary.wait()
+
+	var resp CanaryResponse
+	w := doRequest(router, "GET", "/debug/canary", "", nil)
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("Expected the canary report, got %s", w.Body.String())
+	}
+	// Only the PUT's read of the page's webhook, before the canary went
+	// stale, matched
+	if get := resp.Ops["get"]; !resp.Enabled || get.Mismatches != 6 || get.Comparisons != 7 || len(resp.Recent) == 0 || resp.Recent[0].Key != "home" {
+		t.Errorf("Expected the divergent reads reported, got %+v", resp)
+	}
+	metrics := doRequest(router, "GET", "/metrics", "", nil).Body.String()
+	if !strings.Contains(metrics, `canary_mismatches_total{op="get"} `) || !strings.Contains(metrics, `canary_comparisons_total{op="set"} 1`) {
+		t.Errorf("Expected the canary series in the metrics:\n%s", metrics)
+	}
+
+	_, plain := newTestRedis(t)
+	json.Unmarshal(doRequest(newTestServer(t, testConfig(), plain).Router(), "GET", "/debug/canary", "", nil).Body.Bytes(), &resp)
+	if resp.Enabled {
+		t.Errorf("Expected the canary off by default, got %+v", resp)
+	}
+}
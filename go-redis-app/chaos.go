@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+// Chaos faults, injected with POST /debug/chaos/<fault>
+const (
+	chaosRedisErrors = "redis-errors"
+	chaosLatency     = "latency"
+	chaosDrop        = "drop"
+)
+
+const (
+	// chaosMaxDuration bounds how long a fault may be injected for, so a
+	// forgotten one always expires
+	chaosMaxDuration = time.Hour
+
+	// chaosMaxLatency bounds the latency added to a Redis call
+	chaosMaxLatency = 10 * time.Second
+
+	// chaosPrefix is the path of the chaos endpoints, never dropped so that
+	// faults can always be cleared
+	chaosPrefix = "/debug/chaos"
+)
+
+// chaosFault is one injected fault, active until it expires
+type chaosFault struct {
+	until   time.Time
+	percent float64
+	latency time.Duration
+}
+
+// Chaos holds the faults injected with CHAOS_ENABLED: failing or slowing
+// down Redis calls, through a client hook, and dropping HTTP requests,
+// through a middleware. Faults live in this replica's memory only.
+type Chaos struct {
+	clock Clock
+
+	mu     sync.Mutex
+	faults map[string]chaosFault
+}
+
+// newChaos creates a Chaos with no faults injected
+func newChaos(clock Clock) *Chaos {
+	return &Chaos{clock: clock, faults: make(map[string]chaosFault)}
+}
+
+// active returns a fault if it is injected and has not expired
+func (c *Chaos) active(name string) (chaosFault, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	f, ok := c.faults[name]
+	if ok && !c.clock.Now().Before(f.until) {
+		delete(c.faults, name)
+		return chaosFault{}, false
+	}
+	return f, ok
+}
+
+// hits reports whether a call is hit by a fault, for a percent share of calls
+func (c *Chaos) hits(name string) (chaosFault, bool) {
+	f, ok := c.active(name)
+	if !ok || rand.Float64()*100 >= f.percent {
+		return chaosFault{}, false
+	}
+	return f, true
+}
+
+// inject injects a fault, replacing any of the same name
+func (c *Chaos) inject(name string, f chaosFault) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.faults[name] = f
+}
+
+// clear removes every fault
+func (c *Chaos) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.faults = make(map[string]chaosFault)
+}
+
+// errChaos is the failure of a Redis call hit by redis-errors,
+// of the kind a Redis that is down returns
+var errChaos = newKindError(ErrUnavailable, "chaos: injected Redis failure")
+
+// disrupt applies the Redis faults to a call: it fails when hit by
+// redis-errors, and waits the added latency first when hit by latency
+func (c *Chaos) disrupt(ctx context.Context) error {
+	if _, ok := c.hits(chaosRedisErrors); ok {
+		return errChaos
+	}
+	if f, ok := c.hits(chaosLatency); ok {
+		timer := time.NewTimer(f.latency)
+		defer timer.Stop()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+	return nil
+}
+
+// chaosHook applies the injected Redis faults to every command and pipeline
+type chaosHook struct {
+	chaos *Chaos
+}
+
+func (h chaosHook) DialHook(next redis.DialHook) redis.DialHook { return next }
+
+func (h chaosHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		if err := h.chaos.disrupt(ctx); err != nil {
+			cmd.SetErr(err)
+			return err
+		}
+		return next(ctx, cmd)
+	}
+}
+
+func (h chaosHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		if err := h.chaos.disrupt(ctx); err != nil {
+			for _, cmd := range cmds {
+				cmd.SetErr(err)
+			}
+			return err
+		}
+		return next(ctx, cmds)
+	}
+}
+
+// dropRequests is the middleware answering a share of requests with 503
+// while drop is injected
+func (c *Chaos) dropRequests(ctx *gin.Context) {
+	if strings.HasPrefix(ctx.Request.URL.Path, chaosPrefix) {
+		ctx.Next()
+		return
+	}
+	if _, ok := c.hits(chaosDrop); ok {
+		respondError(ctx, http.StatusServiceUnavailable, "chaos", "Request dropped by chaos testing")
+		return
+	}
+	ctx.Next()
+}
+
+// ChaosRequest injects a fault for Seconds. Percent is the share of calls
+// or requests hit, 100 when omitted; LatencyMs is the latency to add.
+type ChaosRequest struct {
+	Seconds   int64   `json:"seconds"`
+	Percent   float64 `json:"percent"`
+	LatencyMs int64   `json:"latency_ms"`
+}
+
+// ChaosFault is an injected fault in the /debug/chaos response
+type ChaosFault struct {
+	Fault            string    `json:"fault"`
+	Percent          float64   `json:"percent"`
+	LatencyMs        int64     `json:"latency_ms,omitempty"`
+	ExpiresAt        Timestamp `json:"expires_at"`
+	RemainingSeconds float64   `json:"remaining_seconds"`
+}
+
+// ChaosResponse represents the /debug/chaos API response
+type ChaosResponse struct {
+	Faults []ChaosFault `json:"faults"`
+}
+
+// handleGetChaos lists the faults currently injected
+func (s *Server) handleGetChaos(c *gin.Context) {
+	response := ChaosResponse{Faults: []ChaosFault{}}
+	now := s.clock.Now()
+	for _, name := range []string{chaosRedisErrors, chaosLatency, chaosDrop} {
+		f, ok := s.chaos.active(name)
+		if !ok {
+			continue
+		}
+		response.Faults = append(response.Faults, ChaosFault{
+			Fault:            name,
+			Percent:          f.percent,
+			LatencyMs:        f.latency.Milliseconds(),
+			ExpiresAt:        stamp(c, f.until),
+			RemainingSeconds: f.until.Sub(now).Seconds(),
+		})
+	}
+	respondJSON(c, http.StatusOK, response)
+}
+
+// handleInjectChaos injects the fault named in the path
+func (s *Server) handleInjectChaos(c *gin.Context) {
+	name := c.Param("fault")
+	if name != chaosRedisErrors && name != chaosLatency && name != chaosDrop {
+		respondError(c, http.StatusNotFound, "not_found",
+			fmt.Sprintf("Unknown fault %q, valid: %s, %s, %s", name, chaosRedisErrors, chaosLatency, chaosDrop))
+		return
+	}
+	var req ChaosRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondError(c, http.StatusBadRequest, "invalid_request", "Body must be a chaos object")
+		return
+	}
+	duration := time.Duration(req.Seconds) * time.Second
+	if duration <= 0 || duration > chaosMaxDuration {
+		respondError(c, http.StatusBadRequest, "invalid_request", fmt.Sprintf("seconds must be from 1 to %d", int(chaosMaxDuration.Seconds())))
+		return
+	}
+	if req.Percent == 0 {
+		req.Percent = 100
+	}
+	if req.Percent < 0 || req.Percent > 100 {
+		respondError(c, http.StatusBadRequest, "invalid_request", "percent must be from 0 to 100")
+		return
+	}
+	latency := time.Duration(req.LatencyMs) * time.Millisecond
+	if name == chaosLatency && (latency <= 0 || latency > chaosMaxLatency) {
+		respondError(c, http.StatusBadRequest, "invalid_request", fmt.Sprintf("latency_ms must be from 1 to %d", chaosMaxLatency.Milliseconds()))
+		return
+	}
+	s.chaos.inject(name, chaosFault{until: s.clock.Now().Add(duration), percent: req.Percent, latency: latency})
+	s.handleGetChaos(c)
+}
+
+// handleClearChaos removes every injected fault
+func (s *Server) handleClearChaos(c *gin.Context) {
+	s.chaos.clear()
+	s.handleGetChaos(c)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"go-redis-app/internal/clocktest"
+)
+
+// getChaos reads /debug/chaos
+func getChaos(t *testing.T, router http.Handler) ChaosResponse {
+	t.Helper()
+	var resp ChaosResponse
+	w := doRequest(router, "GET", "/debug/chaos", "", nil)
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("Expected the chaos settings, got %d: %s", w.Code, w.Body.String())
+	}
+	return resp
+}
+
+func TestChaosFaultsExpire(t *testing.T) {
+	_, redisClient := newTestRedis(t)
+	cfg := testConfig()
+	cfg.ChaosEnabled = true
+	clock := clocktest.New(time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC))
+	router := newTestServerWithClock(t, cfg, redisClient, clock).Router()
+
+	if w := doRequest(router, "POST", "/debug/chaos/redis-errors", `{"seconds": 10}`, nil); w.Code != http.StatusOK {
+		t.Fatalf("Expected the fault injected, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := doRequest(router, "GET", "/visits/home", "", nil); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected Redis unavailable, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := doRequest(router, "GET", "/health", "", nil); !strings.Contains(w.Body.String(), `"redis":"unhealthy"`) {
+		t.Errorf("Expected Redis unhealthy, got %s", w.Body.String())
+	}
+	clock.Advance(4 * time.Second)
+	if resp := getChaos(t, router); len(resp.Faults) != 1 || resp.Faults[0].Fault != chaosRedisErrors || resp.Faults[0].Percent != 100 || resp.Faults[0].RemainingSeconds != 6 {
+		t.Errorf("Expected redis-errors with 6s left, got %+v", resp)
+	}
+	clock.Advance(6 * time.Second)
+	if resp := getChaos(t, router); len(resp.Faults) != 0 {
+		t.Errorf("Expected the fault expired, got %+v", resp)
+	}
+	if w := doRequest(router, "GET", "/visits/home", "", nil); w.Code != http.StatusOK {
+		t.Errorf("Expected Redis back, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// Dropped requests, but never the chaos endpoints themselves
+	doRequest(router, "POST", "/debug/chaos/drop", `{"seconds": 60, "percent": 100}`, nil)
+	if w := doRequest(router, "GET", "/visit/home", "", nil); w.Code != http.StatusServiceUnavailable || !strings.Contains(w.Body.String(), `"code":"chaos"`) {
+		t.Errorf("Expected the visit dropped, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := doRequest(router, "DELETE", "/debug/chaos", "", nil); w.Code != http.StatusOK {
+		t.Fatalf("Expected the faults cleared, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := doRequest(router, "GET", "/visit/home", "", nil); w.Code != http.StatusOK {
+		t.Errorf("Expected the visit counted, got %d: %s", w.Code, w.Body.String())
+	}
+
+	for path, body := range map[string]string{
+		"/debug/chaos/latency":      `{"seconds": 10}`,
+		"/debug/chaos/drop":         `{"seconds": 0}`,
+		"/debug/chaos/redis-errors": `{"seconds": 10, "percent": 120}`,
+	} {
+		if w := doRequest(router, "POST", path, body, nil); w.Code != http.StatusBadRequest {
+			t.Errorf("Expected 400 for %s %s, got %d", path, body, w.Code)
+		}
+	}
+	if w := doRequest(router, "POST", "/debug/chaos/fire", `{"seconds": 10}`, nil); w.Code != http.StatusNotFound {
+		t.Errorf("Expected an unknown fault rejected, got %d", w.Code)
+	}
+}
+
+func TestChaosDisabled(t *testing.T) {
+	_, redisClient := newTestRedis(t)
+	router := newTestServer(t, testConfig(), redisClient).Router()
+	if w := doRequest(router, "POST", "/debug/chaos/redis-errors", `{"seconds": 10}`, nil); w.Code != http.StatusNotFound {
+		t.Errorf("Expected no chaos endpoints, got %d", w.Code)
+	}
+}
+
+func TestChaosLatencyShedsVisits(t *testing.T) {
+	mr, _ := newTestRedis(t)
+	cfg := testConfig()
+	cfg.ChaosEnabled = true
+	cfg.RedisHost, cfg.RedisPort, _ = net.SplitHostPort(mr.Addr())
+	cfg.RedisAdaptiveTimeouts = true
+	cfg.RedisTimeoutFloor, cfg.RedisTimeoutCeiling = 50*time.Millisecond, 2*time.Second
+	cfg.RedisTimeoutMultiplier, cfg.RedisTimeoutHysteresis = 3, 0.2
+	cfg.LoadShedLatency, cfg.LoadShedFullLatency, cfg.LoadShedMaxFraction = time.Millisecond, 2*time.Millisecond, 0.5
+	redisClient := NewRedisClientFromConfig(cfg)
+	t.Cleanup(func() { redisClient.client.Close() })
+	router := newTestServer(t, cfg, redisClient).Router()
+
+	doRequest(router, "POST", "/debug/chaos/latency", `{"seconds": 60, "latency_ms": 3}`, nil)
+	start := time.Now()
+	if w := doRequest(router, "GET", "/visits/home", "", nil); w.Code != http.StatusOK || time.Since(start) < 3*time.Millisecond {
+		t.Errorf("Expected a read slowed by at least 3ms, got %d after %s", w.Code, time.Since(start))
+	}
+
+	// Enough visits for the write path's p99 to adapt: shedding kicks in
+	shed := 0
+	for i := 0; i < 150; i++ {
+		if w := doRequest(router, "GET", "/visit/home", "", nil); w.Code == http.StatusServiceUnavailable {
+			shed++
+		}
+	}
+	var resp LoadShedResponse
+	json.Unmarshal(doRequest(router, "GET", "/debug/loadshed", "", nil).Body.Bytes(), &resp)
+	if resp.Rate != 0.5 || resp.P99Ms < 3 || shed == 0 {
+		t.Errorf("Expected the maximum shed rate at a p99 of 3ms or more, got %+v and %d shed", resp, shed)
+	}
+}
@@ -0,0 +1,338 @@
+// Package client is a typed client for the visit counter API, for Go
+// services that would otherwise hand-roll its HTTP calls. Its types mirror
+// the server's responses; the server's tests run it against the real router
+// so the two stay in step.
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultRetries is how many times a request answered 429 or 503 is
+	// retried unless WithRetries says otherwise. Visit retries fewer
+	// answers; see Visit.
+	DefaultRetries = 3
+
+	// DefaultMaxRetryWait caps the wait before a retry; a longer Retry-After
+	// returns the error instead
+	DefaultMaxRetryWait = 30 * time.Second
+
+	// retryBackoff is the first wait before a retry without Retry-After,
+	// doubled each attempt
+	retryBackoff = 100 * time.Millisecond
+
+	// maxErrorBody caps how much of an error response is read
+	maxErrorBody = 64 << 10
+)
+
+// Client calls the visit counter API. It is safe for concurrent use.
+type Client struct {
+	baseURL      string
+	http         *http.Client
+	apiKey       string
+	token        string
+	retries      int
+	maxRetryWait time.Duration
+}
+
+// Option configures a Client
+type Option func(*Client)
+
+// WithHTTPClient sends requests with h instead of http.DefaultClient
+func WithHTTPClient(h *http.Client) Option {
+	return func(c *Client) { c.http = h }
+}
+
+// WithAPIKey sends key as X-API-Key, which the admin endpoints require
+func WithAPIKey(key string) Option {
+	return func(c *Client) { c.apiKey = key }
+}
+
+// WithToken sends token, a JWT, as the Authorization bearer token
+func WithToken(token string) Option {
+	return func(c *Client) { c.token = token }
+}
+
+// WithRetries retries requests answered 429 or 503 up to n times; 0 turns
+// retries off
+func WithRetries(n int) Option {
+	return func(c *Client) { c.retries = max(n, 0) }
+}
+
+// WithMaxRetryWait caps the wait before a retry
+func WithMaxRetryWait(d time.Duration) Option {
+	return func(c *Client) { c.maxRetryWait = d }
+}
+
+// New creates a client for the API at baseURL, such as
+// "http://visits.internal:8080"
+func New(baseURL string, opts ...Option) *Client {
+	c := &Client{
+		baseURL:      strings.TrimRight(baseURL, "/"),
+		http:         http.DefaultClient,
+		retries:      DefaultRetries,
+		maxRetryWait: DefaultMaxRetryWait,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// Visit is the count of a page, as returned by Visit and GetVisits
+type Visit struct {
+	Page           string   `json:"page"`
+	Visits         int64    `json:"visits"`
+	Sessions       int64    `json:"sessions,omitempty"`
+	WeightedVisits *float64 `json:"weighted_visits,omitempty"`
+	Variant        string   `json:"variant,omitempty"`
+	Approximate    bool     `json:"approximate,omitempty"`
+	Counted        *bool    `json:"counted,omitempty"`
+	Reason         string   `json:"reason,omitempty"`
+	Sampled        bool     `json:"sampled,omitempty"`
+	SampleRate     float64  `json:"sample_rate,omitempty"`
+	FirstVisit     bool     `json:"first_visit,omitempty"`
+	ResolvedFrom   string   `json:"resolved_from,omitempty"`
+
+	// Replicated is set when the server waits for replicas: false means the
+	// visit is counted but replicas had not confirmed it in time
+	Replicated *bool `json:"replicated,omitempty"`
+
+	// Rank, Unique and Expanded are only set when asked for with
+	// GetVisitsOptions
+	Rank      *int64      `json:"rank,omitempty"`
+	Unique    *int64      `json:"unique,omitempty"`
+	Expanded  *Expansions `json:"expanded,omitempty"`
+	Timestamp time.Time   `json:"timestamp"`
+}
+
+// Expansions is the related data of a page asked for with
+// GetVisitsOptions.Expand. An expansion the server has disabled is nil.
+type Expansions struct {
+	Unique *int64 `json:"unique,omitempty"`
+	// Meta is the page metadata object, as /pages/:page/meta returns it
+	Meta        json.RawMessage `json:"meta,omitempty"`
+	Rate        *Rate           `json:"rate,omitempty"`
+	Annotations *Annotations    `json:"annotations,omitempty"`
+}
+
+// Rate is a page's recent visits a minute
+type Rate struct {
+	PerMinute     float64 `json:"per_minute"`
+	WindowMinutes int     `json:"window_minutes"`
+}
+
+// Annotations is a page's number of annotations and its newest ones
+type Annotations struct {
+	Total  int64        `json:"total"`
+	Recent []Annotation `json:"recent"`
+}
+
+// Annotation is a marker on a page's timeline
+type Annotation struct {
+	ID        string    `json:"id"`
+	Timestamp time.Time `json:"timestamp"`
+	Label     string    `json:"label"`
+	Kind      string    `json:"kind"`
+}
+
+// PageCount is a page with its visit count
+type PageCount struct {
+	Page      string     `json:"page"`
+	Visits    int64      `json:"visits"`
+	LastVisit *time.Time `json:"last_visit,omitempty"`
+}
+
+// Pages is a list of pages, as returned by TopPages
+type Pages struct {
+	Pages       []PageCount `json:"pages"`
+	Total       int         `json:"total"`
+	Approximate bool        `json:"approximate,omitempty"`
+	Next        string      `json:"next,omitempty"`
+	Prev        string      `json:"prev,omitempty"`
+}
+
+// Health is the service and Redis health
+type Health struct {
+	Status      string       `json:"status"`
+	Redis       string       `json:"redis"`
+	ClockSkew   *float64     `json:"clock_skew_seconds,omitempty"`
+	ReadOnly    bool         `json:"read_only,omitempty"`
+	OutOfMemory *OutOfMemory `json:"redis_out_of_memory,omitempty"`
+	Timestamp   time.Time    `json:"timestamp"`
+}
+
+// OutOfMemory is set in Health while Redis is out of memory and visits are
+// journaled by the server
+type OutOfMemory struct {
+	Since           time.Time `json:"since"`
+	JournaledVisits int64     `json:"journaled_visits"`
+}
+
+// VisitOptions are the optional parameters of a visit
+type VisitOptions struct {
+	// Variant counts the visit for an A/B variant of the page
+	Variant string
+
+	// Weight is the visit's value, 0 for an unweighted visit
+	Weight float64
+}
+
+// GetVisitsOptions are the optional parameters of GetVisits
+type GetVisitsOptions struct {
+	// Rank and Unique add the page's leaderboard rank and unique visitors
+	Rank   bool
+	Unique bool
+
+	// Snapshot adds rank, unique visitors and sessions, read together with
+	// the count in one atomic step
+	Snapshot bool
+
+	// Expand names related data to add: "unique", "meta", "rate" and
+	// "annotations"
+	Expand []string
+}
+
+// Visit counts a visit to page and returns its new count. Only answers
+// that say the visit was not counted, 429 and a 503 overloaded, are
+// retried: after another 503 it may have been, and a retry would count
+// it twice.
+func (c *Client) Visit(ctx context.Context, page string, opts *VisitOptions) (Visit, error) {
+	query := url.Values{}
+	if opts != nil {
+		if opts.Variant != "" {
+			query.Set("variant", opts.Variant)
+		}
+		if opts.Weight != 0 {
+			query.Set("weight", strconv.FormatFloat(opts.Weight, 'g', -1, 64))
+		}
+	}
+	var visit Visit
+	err := c.do(ctx, "/visit/"+url.PathEscape(page), query, &visit, notCounted)
+	return visit, err
+}
+
+// GetVisits returns the count of page without counting a visit
+func (c *Client) GetVisits(ctx context.Context, page string, opts *GetVisitsOptions) (Visit, error) {
+	query := url.Values{}
+	if opts != nil {
+		var include []string
+		if opts.Snapshot {
+			include = append(include, "all")
+		}
+		if opts.Rank {
+			include = append(include, "rank")
+		}
+		if opts.Unique {
+			include = append(include, "unique")
+		}
+		if len(include) > 0 {
+			query.Set("include", strings.Join(include, ","))
+		}
+		if len(opts.Expand) > 0 {
+			query.Set("expand", strings.Join(opts.Expand, ","))
+		}
+	}
+	var visit Visit
+	err := c.get(ctx, "/visits/"+url.PathEscape(page), query, &visit)
+	return visit, err
+}
+
+// TopPages returns up to limit pages by visit count; 0 is the server's
+// default of 10
+func (c *Client) TopPages(ctx context.Context, limit int) (Pages, error) {
+	query := url.Values{}
+	if limit > 0 {
+		query.Set("limit", strconv.Itoa(limit))
+	}
+	var pages Pages
+	err := c.get(ctx, "/pages/top", query, &pages)
+	return pages, err
+}
+
+// Health returns the service health. A degraded service answers 200, an
+// unhealthy one 503, which is returned as an *Error without retrying.
+func (c *Client) Health(ctx context.Context) (Health, error) {
+	var health Health
+	err := c.do(ctx, "/health", url.Values{}, &health, nil)
+	return health, err
+}
+
+// get sends a GET request and decodes the response into out, retrying 429
+// and 503 answers
+func (c *Client) get(ctx context.Context, path string, query url.Values, out any) error {
+	return c.do(ctx, path, query, out, (*Error).Temporary)
+}
+
+// notCounted reports whether a visit answered with e was certainly not
+// counted: it was rate limited, or shed before reaching Redis
+func notCounted(e *Error) bool {
+	return e.StatusCode == http.StatusTooManyRequests || e.StatusCode == http.StatusServiceUnavailable && e.Code == ErrOverloaded.Code
+}
+
+// do sends a GET request and decodes the response into out, retrying the
+// answers retry accepts; a nil retry never retries
+func (c *Client) do(ctx context.Context, path string, query url.Values, out any, retry func(*Error) bool) error {
+	// Timestamps are always asked for as RFC 3339, which time.Time decodes,
+	// whatever the server's TIMESTAMP_FORMAT
+	query.Set("ts", "rfc3339")
+	target := c.baseURL + path + "?" + query.Encode()
+	for attempt := 0; ; attempt++ {
+		err := c.send(ctx, target, out)
+		apiErr, ok := err.(*Error)
+		if !ok || retry == nil || !retry(apiErr) || attempt >= c.retries {
+			return err
+		}
+		wait := apiErr.RetryAfter
+		if wait == 0 {
+			wait = retryBackoff << attempt
+			wait = wait/2 + time.Duration(rand.Int63n(int64(wait/2)+1))
+		}
+		if wait > c.maxRetryWait {
+			return err
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// send makes one request, returning an *Error for an error response
+func (c *Client) send(ctx context.Context, target string, out any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if c.apiKey != "" {
+		req.Header.Set("X-API-Key", c.apiKey)
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return newError(resp)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("decoding %s response: %w", req.URL.Path, err)
+	}
+	return nil
+}
@@ -0,0 +1,179 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRetriesHonorRetryAfter(t *testing.T) {
+	var calls atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch calls.Add(1) {
+		case 1:
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+			w.Write([]byte(`{"error":"Rate limit exceeded","code":"rate_limited"}`))
+		case 2:
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte(`{"error":"Redis is slow","code":"overloaded"}`))
+		default:
+			w.Write([]byte(`{"page":"home","visits":3,"timestamp":"2024-03-10T12:00:00Z"}`))
+		}
+	}))
+	defer srv.Close()
+
+	visit, err := New(srv.URL).Visit(context.Background(), "home", nil)
+	if err != nil || visit.Visits != 3 || calls.Load() != 3 {
+		t.Fatalf("Expected the visit after 2 retries, got %+v %v after %d calls", visit, err, calls.Load())
+	}
+
+	// Out of retries, the last error is returned
+	calls.Store(0)
+	_, err = New(srv.URL, WithRetries(1)).Visit(context.Background(), "home", nil)
+	if !errors.Is(err, ErrOverloaded) || calls.Load() != 2 {
+		t.Errorf("Expected overloaded after 1 retry, got %v after %d calls", err, calls.Load())
+	}
+}
+
+func TestVisitRetriesOnlyUncounted(t *testing.T) {
+	var calls atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) == 1 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte(`{"error":"Redis is unavailable","code":"unavailable"}`))
+			return
+		}
+		w.Write([]byte(`{"page":"home","visits":3,"timestamp":"2024-03-10T12:00:00Z"}`))
+	}))
+	defer srv.Close()
+
+	// The visit may have been counted, so it isn't sent again
+	if _, err := New(srv.URL).Visit(context.Background(), "home", nil); !errors.Is(err, ErrUnavailable) || calls.Load() != 1 {
+		t.Fatalf("Expected unavailable without a retry, got %v after %d calls", err, calls.Load())
+	}
+
+	// A read is
+	calls.Store(0)
+	if visit, err := New(srv.URL).GetVisits(context.Background(), "home", nil); err != nil || visit.Visits != 3 || calls.Load() != 2 {
+		t.Errorf("Expected the read after 1 retry, got %+v %v after %d calls", visit, err, calls.Load())
+	}
+}
+
+func TestRetryAfterBeyondMaxWait(t *testing.T) {
+	var calls atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.Header().Set("Retry-After", "60")
+		w.WriteHeader(http.StatusTooManyRequests)
+		w.Write([]byte(`{"error":"Daily visit quota exceeded","code":"quota_visits"}`))
+	}))
+	defer srv.Close()
+
+	start := time.Now()
+	_, err := New(srv.URL, WithMaxRetryWait(time.Second)).GetVisits(context.Background(), "home", nil)
+	var apiErr *Error
+	if !errors.As(err, &apiErr) || !errors.Is(err, ErrQuotaVisits) || apiErr.RetryAfter != time.Minute {
+		t.Fatalf("Expected the quota error with its Retry-After, got %v", err)
+	}
+	if calls.Load() != 1 || time.Since(start) > time.Second {
+		t.Errorf("Expected no retry past the max wait, got %d calls", calls.Load())
+	}
+
+	// A context ending during the wait ends the retries
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := New(srv.URL, WithMaxRetryWait(time.Hour)).GetVisits(ctx, "home", nil); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected the deadline, got %v", err)
+	}
+}
+
+func TestErrorsAreNotRetried(t *testing.T) {
+	var calls atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		if r.URL.Path == "/visits/bad" {
+			w.WriteHeader(http.StatusBadGateway)
+			w.Write([]byte("<html>bad gateway</html>"))
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"error":"Page not found","code":"not_found"}`))
+	}))
+	defer srv.Close()
+	c := New(srv.URL)
+
+	_, err := c.GetVisits(context.Background(), "nowhere", nil)
+	if !errors.Is(err, ErrNotFound) || errors.Is(err, ErrConflict) || calls.Load() != 1 {
+		t.Errorf("Expected one not found, got %v after %d calls", err, calls.Load())
+	}
+	_, err = c.GetVisits(context.Background(), "bad", nil)
+	var apiErr *Error
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusBadGateway || apiErr.Code != "" || apiErr.Message != "Bad Gateway" {
+		t.Errorf("Expected a non-JSON error kept as its status, got %v", err)
+	}
+}
+
+func TestRequests(t *testing.T) {
+	var got *http.Request
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+		w.Write([]byte(`{}`))
+	}))
+	defer srv.Close()
+	c := New(srv.URL+"/", WithAPIKey("secret"), WithToken("jwt"))
+	ctx := context.Background()
+
+	for _, tt := range []struct {
+		call func() error
+		want string
+	}{
+		{func() error {
+			_, err := c.Visit(ctx, "docs/intro", &VisitOptions{Variant: "b", Weight: 2.5})
+			return err
+		},
+			"/visit/docs%2Fintro?ts=rfc3339&variant=b&weight=2.5"},
+		{func() error {
+			_, err := c.GetVisits(ctx, "home", &GetVisitsOptions{Rank: true, Unique: true})
+			return err
+		},
+			"/visits/home?include=rank%2Cunique&ts=rfc3339"},
+		{func() error {
+			_, err := c.GetVisits(ctx, "home", &GetVisitsOptions{Snapshot: true})
+			return err
+		},
+			"/visits/home?include=all&ts=rfc3339"},
+		{func() error { _, err := c.TopPages(ctx, 5); return err }, "/pages/top?limit=5&ts=rfc3339"},
+		{func() error { _, err := c.Health(ctx); return err }, "/health?ts=rfc3339"},
+	} {
+		if err := tt.call(); err != nil {
+			t.Fatal(err)
+		}
+		if uri := got.URL.RequestURI(); uri != tt.want {
+			t.Errorf("Expected %s, got %s", tt.want, uri)
+		}
+		if got.Header.Get("X-API-Key") != "secret" || got.Header.Get("Authorization") != "Bearer jwt" {
+			t.Errorf("Expected the credentials sent, got %v", got.Header)
+		}
+	}
+}
+
+func TestRetryAfterFromRateLimitBody(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "21")
+		w.WriteHeader(http.StatusTooManyRequests)
+		w.Write([]byte(`{"error":"At most 2 batch requests per 1m0s","code":"rate_limited","retry_after_ms":20000.5}`))
+	}))
+	defer srv.Close()
+
+	_, err := New(srv.URL, WithMaxRetryWait(time.Second)).GetVisits(context.Background(), "home", nil)
+	var apiErr *Error
+	if !errors.As(err, &apiErr) || !errors.Is(err, ErrRateLimited) || apiErr.RetryAfter != 20000500*time.Microsecond {
+		t.Fatalf("Expected the exact wait from the body, got %v", err)
+	}
+}
@@ -0,0 +1,103 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Error is an error response from the API. Compare it with the sentinels
+// below using errors.Is, which matches on Code.
+type Error struct {
+	StatusCode int
+	Code       string
+	Message    string
+
+	// RetryAfter is the response's Retry-After, or the exact wait a rate
+	// limited response carries; 0 when it has neither
+	RetryAfter time.Duration
+}
+
+func (e *Error) Error() string {
+	if e.StatusCode == 0 {
+		return "visits api: " + e.Code
+	}
+	return fmt.Sprintf("visits api: %d %s: %s", e.StatusCode, e.Code, e.Message)
+}
+
+// Is reports whether target is an *Error with the same code
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	return ok && t.Code != "" && t.Code == e.Code
+}
+
+// Temporary reports whether the request may succeed if retried: the server
+// was rate limiting or unavailable
+func (e *Error) Temporary() bool {
+	return e.StatusCode == http.StatusTooManyRequests || e.StatusCode == http.StatusServiceUnavailable
+}
+
+// The error codes the API answers with, for errors.Is
+var (
+	ErrInvalidRequest   = &Error{Code: "invalid_request"}
+	ErrUnauthorized     = &Error{Code: "unauthorized"}
+	ErrInvalidToken     = &Error{Code: "invalid_token"}
+	ErrInvalidSignature = &Error{Code: "invalid_signature"}
+	ErrForbidden        = &Error{Code: "forbidden"}
+	ErrIPNotAllowed     = &Error{Code: "ip_not_allowed"}
+	ErrNotFound         = &Error{Code: "not_found"}
+	ErrArchived         = &Error{Code: "archived"}
+	ErrConflict         = &Error{Code: "conflict"}
+	ErrUnknownVariant   = &Error{Code: "unknown_variant"}
+	ErrRateLimited      = &Error{Code: "rate_limited"}
+	ErrQuotaVisits      = &Error{Code: "quota_visits"}
+	ErrQuotaRate        = &Error{Code: "quota_rate"}
+	ErrQuotaPages       = &Error{Code: "quota_pages"}
+	ErrReadOnly         = &Error{Code: "read_only"}
+	ErrOverloaded       = &Error{Code: "overloaded"}
+	ErrUnavailable      = &Error{Code: "unavailable"}
+	ErrOutOfMemory      = &Error{Code: "out_of_memory"}
+	ErrTimeout          = &Error{Code: "timeout"}
+	ErrInternal         = &Error{Code: "internal_error"}
+)
+
+// errorBody is the JSON body of an error response
+type errorBody struct {
+	Error        string  `json:"error"`
+	Code         string  `json:"code"`
+	RetryAfterMs float64 `json:"retry_after_ms"`
+}
+
+// newError reads an error response. Bodies that aren't the API's JSON,
+// such as a proxy's, keep the status text as the message.
+func newError(resp *http.Response) *Error {
+	e := &Error{StatusCode: resp.StatusCode, Message: http.StatusText(resp.StatusCode), RetryAfter: retryAfter(resp.Header.Get("Retry-After"))}
+	var body errorBody
+	if b, err := io.ReadAll(io.LimitReader(resp.Body, maxErrorBody)); err == nil && json.Unmarshal(b, &body) == nil {
+		e.Code = body.Code
+		if body.Error != "" {
+			e.Message = body.Error
+		}
+		if body.RetryAfterMs > 0 {
+			e.RetryAfter = time.Duration(body.RetryAfterMs * float64(time.Millisecond))
+		}
+	}
+	return e
+}
+
+// retryAfter parses a Retry-After of seconds or an HTTP date, 0 for none
+func retryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(max(seconds, 0)) * time.Second
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		return max(time.Until(at), 0)
+	}
+	return 0
+}
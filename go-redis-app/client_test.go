@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"go-redis-app/client"
+)
+
+// jsonFields returns the JSON names of a struct type's exported fields
+func jsonFields(typ reflect.Type) []string {
+	var names []string
+	for i := 0; i < typ.NumField(); i++ {
+		if f := typ.Field(i); f.IsExported() {
+			names = append(names, f.Tag.Get("json"))
+		}
+	}
+	return names
+}
+
+func TestClientTypesMatchServer(t *testing.T) {
+	for _, tt := range []struct{ server, client any }{
+		{VisitResponse{}, client.Visit{}},
+		{PageCount{}, client.PageCount{}},
+		{PagesResponse{}, client.Pages{}},
+		{HealthResponse{}, client.Health{}},
+		{OutOfMemoryStatus{}, client.OutOfMemory{}},
+		{Expansions{}, client.Expansions{}},
+		{VisitRate{}, client.Rate{}},
+		{ExpandedAnnotations{}, client.Annotations{}},
+		{Annotation{}, client.Annotation{}},
+	} {
+		server, got := reflect.TypeOf(tt.server), reflect.TypeOf(tt.client)
+		if want, fields := jsonFields(server), jsonFields(got); !reflect.DeepEqual(fields, want) {
+			t.Errorf("Expected client.%s to have the fields of %s %v, got %v", got.Name(), server.Name(), want, fields)
+		}
+	}
+}
+
+func TestClientAgainstRouter(t *testing.T) {
+	_, redisClient := newTestRedis(t)
+	cfg := testConfig()
+	// The client asks for RFC 3339 whatever the server's default
+	cfg.TimestampFormat = TimestampUnix
+	srv := httptest.NewServer(newTestServer(t, cfg, redisClient).Router())
+	defer srv.Close()
+	c := client.New(srv.URL)
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		if _, err := c.Visit(ctx, "home", nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	visit, err := c.Visit(ctx, "docs", nil)
+	if err != nil || visit.Page != "docs" || visit.Visits != 1 || !visit.FirstVisit || time.Since(visit.Timestamp) > time.Minute {
+		t.Fatalf("Unexpected visit %+v %v", visit, err)
+	}
+
+	got, err := c.GetVisits(ctx, "home", &client.GetVisitsOptions{Rank: true})
+	if err != nil || got.Visits != 2 || got.Rank == nil || *got.Rank != 1 {
+		t.Errorf("Unexpected count %+v %v", got, err)
+	}
+	top, err := c.TopPages(ctx, 10)
+	if err != nil || top.Total != 2 || top.Pages[0] != (client.PageCount{Page: "home", Visits: 2}) {
+		t.Errorf("Unexpected top pages %+v %v", top, err)
+	}
+	health, err := c.Health(ctx)
+	if err != nil || health.Status != "healthy" || health.Redis != "healthy" || health.Timestamp.IsZero() {
+		t.Errorf("Unexpected health %+v %v", health, err)
+	}
+
+	if w := doRequest(srv.Config.Handler, "POST", "/admin/pages/docs/archive", "", nil); w.Code != 200 {
+		t.Fatalf("Archive: %d %s", w.Code, w.Body.String())
+	}
+	if _, err := c.GetVisits(ctx, "docs", nil); !errors.Is(err, client.ErrArchived) {
+		t.Errorf("Expected an archived error, got %v", err)
+	}
+	if _, err := c.Visit(ctx, "home", &client.VisitOptions{Weight: -1}); !errors.Is(err, client.ErrInvalidRequest) {
+		t.Errorf("Expected an invalid request, got %v", err)
+	}
+}
+
+func TestClientAuth(t *testing.T) {
+	_, redisClient := newTestRedis(t)
+	cfg := jwtTestConfig()
+	srv := httptest.NewServer(newTestServer(t, cfg, redisClient).Router())
+	defer srv.Close()
+	ctx := context.Background()
+
+	if _, err := client.New(srv.URL).Visit(ctx, "home", nil); !errors.Is(err, client.ErrUnauthorized) {
+		t.Errorf("Expected anonymous visits refused, got %v", err)
+	}
+	if _, err := client.New(srv.URL, client.WithToken("not-a-jwt")).Visit(ctx, "home", nil); !errors.Is(err, client.ErrInvalidToken) {
+		t.Errorf("Expected a bad token refused, got %v", err)
+	}
+	token := mintHS256(t, cfg.JWTSecret, testClaims("write", time.Hour))
+	if visit, err := client.New(srv.URL, client.WithToken(token)).Visit(ctx, "home", nil); err != nil || visit.Visits != 1 {
+		t.Errorf("Expected the visit counted with a token, got %+v %v", visit, err)
+	}
+}
+
+func TestClientReadOnly(t *testing.T) {
+	_, redisClient := newTestRedis(t)
+	cfg := testConfig()
+	cfg.ReadOnly = true
+	srv := httptest.NewServer(newTestServer(t, cfg, redisClient).Router())
+	defer srv.Close()
+
+	if _, err := client.New(srv.URL).Visit(context.Background(), "home", nil); !errors.Is(err, client.ErrReadOnly) {
+		t.Errorf("Expected a read-only error, got %v", err)
+	}
+	if health, err := client.New(srv.URL).Health(context.Background()); err != nil || !health.ReadOnly {
+		t.Errorf("Expected read-only health, got %+v %v", health, err)
+	}
+}
@@ -0,0 +1,15 @@
+package main
+
+import "time"
+
+// Clock is the source of the current time for the server, its caches and
+// middleware. Store methods take the time as a parameter instead, so callers
+// decide which instant a write belongs to.
+type Clock interface {
+	Now() time.Time
+}
+
+// systemClock is the Clock backed by time.Now
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// Coalesced lookups, the label of their metric series
+const (
+	lookupCounts   = "counts"
+	lookupVariants = "variants"
+	lookupSnapshot = "snapshot"
+)
+
+// coalescedLookups lists the lookups in metric order
+var coalescedLookups = []string{lookupCounts, lookupVariants, lookupSnapshot}
+
+// readCoalescer shares one Redis call between identical concurrent reads,
+// so a page polled by many dashboards at once costs a single lookup. Only
+// read endpoints use it; a visit always does its own round trip.
+type readCoalescer struct {
+	group singleflight.Group
+
+	// requests counts the reads asked for, calls those that reached Redis
+	requests map[string]*atomic.Int64
+	calls    map[string]*atomic.Int64
+}
+
+func newReadCoalescer() *readCoalescer {
+	rc := &readCoalescer{requests: make(map[string]*atomic.Int64), calls: make(map[string]*atomic.Int64)}
+	for _, lookup := range coalescedLookups {
+		rc.requests[lookup] = new(atomic.Int64)
+		rc.calls[lookup] = new(atomic.Int64)
+	}
+	return rc
+}
+
+// do runs fn for the lookup and key, or waits for the identical call already
+// in flight. fn keeps running when the caller that started it goes away,
+// since other callers may be waiting on it.
+func (rc *readCoalescer) do(ctx context.Context, lookup, key string, fn func(context.Context) (interface{}, error)) (interface{}, error) {
+	rc.requests[lookup].Add(1)
+	v, err, _ := rc.group.Do(lookup+"\x00"+key, func() (interface{}, error) {
+		rc.calls[lookup].Add(1)
+		return fn(context.WithoutCancel(ctx))
+	})
+	return v, err
+}
+
+// coalesced returns how many reads of the lookup shared another's call
+func (rc *readCoalescer) coalesced(lookup string) int64 {
+	return rc.requests[lookup].Load() - rc.calls[lookup].Load()
+}
+
+// write writes the coalesced_reads_total series
+func (rc *readCoalescer) write(b *strings.Builder, env string) {
+	b.WriteString("# HELP coalesced_reads_total Reads served by another identical read's Redis call, by lookup.\n")
+	b.WriteString("# TYPE coalesced_reads_total counter\n")
+	for _, lookup := range coalescedLookups {
+		labels := "lookup=" + strconv.Quote(lookup)
+		if env != "" {
+			labels = "env=" + strconv.Quote(env) + "," + labels
+		}
+		fmt.Fprintf(b, "coalesced_reads_total{%s} %d\n", labels, rc.coalesced(lookup))
+	}
+}
+
+// readPageCounts is pageCounts for read endpoints, coalescing concurrent
+// reads of the same page
+func (s *Server) readPageCounts(ctx context.Context, page string) (visitResult, error) {
+	v, err := s.coalescer.do(ctx, lookupCounts, page, func(ctx context.Context) (interface{}, error) {
+		return s.pageCounts(ctx, page)
+	})
+	counts, _ := v.(visitResult)
+	return counts, err
+}
+
+// readPageSnapshot is PageSnapshot for read endpoints, coalescing
+// concurrent reads of the same page
+func (s *Server) readPageSnapshot(ctx context.Context, page string) (PageSnapshot, error) {
+	v, err := s.coalescer.do(ctx, lookupSnapshot, page, func(ctx context.Context) (interface{}, error) {
+		return s.redis.PageSnapshot(ctx, page)
+	})
+	snapshot, _ := v.(PageSnapshot)
+	return snapshot, err
+}
+
+// readVariantCounts is VariantCounts for read endpoints, coalescing
+// concurrent reads of the same page and variants
+func (s *Server) readVariantCounts(ctx context.Context, page string, variants []string) ([]int64, error) {
+	v, err := s.coalescer.do(ctx, lookupVariants, page+"\x00"+strings.Join(variants, ","), func(ctx context.Context) (interface{}, error) {
+		return s.redis.VariantCounts(ctx, page, variants)
+	})
+	counts, _ := v.([]int64)
+	return counts, err
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// countingStore counts the MGETs of a page's counts, holding each until
+// released so that concurrent reads overlap
+type countingStore struct {
+	page    string
+	calls   atomic.Int64
+	release chan struct{}
+}
+
+func (s *countingStore) DialHook(next redis.DialHook) redis.DialHook { return next }
+
+func (s *countingStore) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		if args := cmd.Args(); cmd.Name() == "mget" && len(args) > 1 && args[1] == key("visits", s.page) {
+			s.calls.Add(1)
+			<-s.release
+		}
+		return next(ctx, cmd)
+	}
+}
+
+func (s *countingStore) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return next
+}
+
+func TestConcurrentReadsCoalesce(t *testing.T) {
+	mr, redisClient := newTestRedis(t)
+	store := &countingStore{page: "home", release: make(chan struct{})}
+	redisClient.client.AddHook(store)
+	server := newTestServer(t, testConfig(), redisClient)
+	router := server.Router()
+	mr.Set(key("visits", "home"), "7")
+
+	const n = 20
+	var wg sync.WaitGroup
+	codes := make([]int, n)
+	bodies := make([][]byte, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			w := doRequest(router, "GET", "/visits/home", "", nil)
+			codes[i], bodies[i] = w.Code, w.Body.Bytes()
+		}(i)
+	}
+	waitFor(t, 2*time.Second, func() bool { return server.coalescer.requests[lookupCounts].Load() == n })
+	// Let the last reads reach the in-flight call before it returns
+	time.Sleep(50 * time.Millisecond)
+	close(store.release)
+	wg.Wait()
+
+	if got := store.calls.Load(); got != 1 {
+		t.Errorf("Expected %d concurrent reads to share one MGET, got %d", n, got)
+	}
+	for i := range codes {
+		if codes[i] != http.StatusOK || decodeVisit(t, bodies[i]).Visits != 7 {
+			t.Fatalf("Expected every read to get the shared count, got %d: %s", codes[i], bodies[i])
+		}
+	}
+	metrics := doRequest(router, "GET", "/metrics", "", nil).Body.String()
+	if want := `coalesced_reads_total{lookup="counts"} 19`; !strings.Contains(metrics, want) {
+		t.Errorf("Expected %s in the metrics", want)
+	}
+
+	// Once the call has returned, the next read goes to Redis again
+	doRequest(router, "GET", "/visits/home", "", nil)
+	if got := store.calls.Load(); got != 2 {
+		t.Errorf("Expected a later read to make its own call, got %d calls", got)
+	}
+}
+
+func TestVisitsAreNotCoalesced(t *testing.T) {
+	mr, redisClient := newTestRedis(t)
+	server := newTestServer(t, testConfig(), redisClient)
+	router := server.Router()
+
+	const n = 20
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			doRequest(router, "GET", "/visit/home", "", nil)
+		}()
+	}
+	wg.Wait()
+
+	if got, _ := mr.Get(key("visits", "home")); got != "20" {
+		t.Errorf("Expected every visit counted, got %q", got)
+	}
+	if got := server.coalescer.requests[lookupCounts].Load(); got != 0 {
+		t.Errorf("Expected visits to bypass the coalescer, got %d coalesced lookups", got)
+	}
+}
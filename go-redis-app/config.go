@@ -0,0 +1,752 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config holds the service settings read from the environment
+type Config struct {
+	EnvName            string
+	AllowProdLocalhost bool
+	RedisHost          string
+	RedisPort          string
+	RedisDB            int
+
+	// ServiceDiscovery "compose" defaults the dependencies' addresses to
+	// their compose service names, each checked to resolve at startup
+	ServiceDiscovery string
+
+	// StrictConsistency runs each multi-key update, such as the counter,
+	// leaderboard and buckets of a visit, as one MULTI/EXEC transaction
+	StrictConsistency bool
+
+	// WriteConsistency replicated ends each visit's pipeline with a WAIT for
+	// WriteWaitReplicas replicas, up to WriteWaitTimeout; WriteWaitStrict
+	// answers 202 rather than 200 when they don't confirm it
+	WriteConsistency  string
+	WriteWaitReplicas int64
+	WriteWaitTimeout  time.Duration
+	WriteWaitStrict   bool
+
+	// Adaptive Redis deadlines: max(floor, multiplier·p99) up to ceiling
+	RedisAdaptiveTimeouts  bool
+	RedisTimeoutFloor      time.Duration
+	RedisTimeoutCeiling    time.Duration
+	RedisTimeoutMultiplier float64
+	RedisTimeoutHysteresis float64
+
+	// KeyPrefix is prepended to every key. While KeyPrefixMigrating, set by
+	// KEY_PREFIX_OLD even when empty, writes also go to KeyPrefixOld and
+	// reads fall back to it.
+	KeyPrefix          string
+	KeyPrefixOld       string
+	KeyPrefixMigrating bool
+
+	// Failed Redis calls are retried up to RedisMaxRetries times when safe,
+	// after a random wait up to RedisRetryBackoff doubled each attempt and
+	// capped at RedisRetryBackoffMax
+	RedisMaxRetries      int64
+	RedisRetryBackoff    time.Duration
+	RedisRetryBackoffMax time.Duration
+
+	// While Redis is out of memory, up to OOMJournalMaxEntries pages and
+	// days of visits are held in memory, replayed every
+	// OOMJournalReplayInterval until Redis accepts them; 0 entries disables
+	// the journal
+	OOMJournalMaxEntries     int64
+	OOMJournalReplayInterval time.Duration
+
+	// Visit shedding: from 0 at a Redis p99 of LoadShedLatency up to
+	// LoadShedMaxFraction at LoadShedFullLatency; 0 disables it
+	LoadShedLatency     time.Duration
+	LoadShedFullLatency time.Duration
+	LoadShedMaxFraction float64
+
+	// A route with more than InFlightSoftLimit requests in flight for longer
+	// than InFlightSaturationAfter is logged and alerted to AlertWebhookURL;
+	// 0 disables the check
+	InFlightSoftLimit       int64
+	InFlightSaturationAfter time.Duration
+	AlertWebhookURL         string
+
+	// Every AnomalyInterval, pages whose visit rate over the last
+	// AnomalyWindow is AnomalyThreshold times their baseline, and at least
+	// AnomalyMinRate visits a minute, are flagged; 0 disables it
+	AnomalyInterval  time.Duration
+	AnomalyWindow    time.Duration
+	AnomalyThreshold float64
+	AnomalyMinRate   float64
+
+	Port              string
+	InternalPort      string
+	SinglePort        bool
+	Listen            []string
+	ListenSocketMode  os.FileMode
+	TLSCertFile       string
+	TLSKeyFile        string
+	ShutdownTimeout   time.Duration
+	FlushTimeout      time.Duration
+	InstanceName      string
+	AdminAPIKeys      map[string]string // API key -> key name
+	AdminHMACSecret   string
+	PageTokenSecret   string
+	FlagsPollInterval time.Duration
+	DedupeWindow      time.Duration
+	AuditMaxLen       int64
+	BatchRateLimit    int64
+	VisitorCookie     bool
+	IPHashSalt        string
+	IPHashRotation    string
+	SessionWindow     time.Duration
+	SessionRefresh    bool
+	StrictVariants    bool
+
+	TrendingHalfLife      time.Duration
+	TrendingDecayInterval time.Duration
+
+	CacheTTL                time.Duration
+	CacheShared             bool
+	NewPageWebhookURL       string
+	WebhookPollInterval     time.Duration
+	WebhookRetryBase        time.Duration
+	WebhookMaxAttempts      int64
+	WebhookConcurrency      int
+	PageWebhookRate         int64
+	ApproximatePagePrefixes []string
+	ResolveStripParams      []string
+	GeoIPHeaders            bool
+	GeoIPDBPath             string
+	EventsBackend           string
+	EventsStreamMaxLen      int64
+	EventsClaimIdle         time.Duration
+	WaitMaxWaiters          int64
+	Retention               RetentionPolicy
+	RetentionInterval       time.Duration
+	RetentionDryRun         bool
+	ArchiveDir              string
+	PageMetricsTop          int64
+	PageMetricsCacheTTL     time.Duration
+	ReconcileInterval       time.Duration
+	CounterSampleInterval   time.Duration
+	CounterDropGuardPercent float64
+	QuotaCacheTTL           time.Duration
+	QuotaMetricCallers      []string
+	InterarrivalBotMedian   time.Duration
+	CounterSampleMaxKeys    int64
+	ReconcileDryRun         bool
+	AdminAllowedCIDRs       *CIDRMatcher
+	TrustedProxies          []string
+
+	// The clock skew watchdog compares our clock with Redis TIME every
+	// ClockSkewInterval, 0 disables it. BucketTimeSource "redis" records
+	// visits at our time corrected by the measured skew.
+	ClockSkewInterval  time.Duration
+	ClockSkewThreshold time.Duration
+	BucketTimeSource   string
+
+	// ChaosEnabled serves the /debug/chaos failure injection endpoints
+	ChaosEnabled bool
+
+	// DebugEcho serves POST /debug/echo-visit, explaining how a visit would
+	// be counted without counting it
+	DebugEcho bool
+
+	// MigrateOnStart applies the pending schema migrations at startup
+	MigrateOnStart bool
+
+	// ReadOnly serves reads only, with every Redis write blocked and the
+	// background writers off, e.g. against a replica in a recovery drill
+	ReadOnly bool
+
+	// BurstDedupWindow drops exact repeats of a visit from one client within
+	// it, in process memory; 0 disables it
+	BurstDedupWindow time.Duration
+
+	// NegativeCacheTTL is how long GET /visits/:page trusts, in process
+	// memory, that a page had no visits, for up to NegativeCacheSize names;
+	// 0 disables it
+	NegativeCacheTTL  time.Duration
+	NegativeCacheSize int64
+
+	// Counters of pages under CounterExpiringPrefixes are meant to expire,
+	// given CounterTTL when the TTL audit fixes them; every other counter
+	// persists. The audit lists those expiring within TTLAuditSoon.
+	CounterExpiringPrefixes []string
+	CounterTTL              time.Duration
+	TTLAuditSoon            time.Duration
+
+	// RequestTimeout is the deadline of visit and dashboard requests, split
+	// across their phases; 0 leaves them without one. A deadline the gateway
+	// sets in X-Request-Deadline or grpc-timeout applies to every request,
+	// the earlier one winning. Without X-Request-Start to measure it on the
+	// gateway's clock, a deadline further in the past than
+	// RequestDeadlineSkew means our clocks disagree, and RequestTimeout
+	// applies to the request instead.
+	RequestTimeout      time.Duration
+	RequestDeadlineSkew time.Duration
+
+	// RedisCommandBudget is how many Redis commands a request may send,
+	// pipelined ones included, before a warning is logged with its route;
+	// 0 disables the check. DebugHeaders reports each request's commands in
+	// X-Redis-Ops.
+	RedisCommandBudget int64
+	DebugHeaders       bool
+
+	// EventSinks lists the sinks every counted visit is published to in the
+	// background. At most EventSinkBuffer events wait for them; past that
+	// EventSinkOverflow "drop" drops events and "block" holds the visit.
+	EventSinks        []string
+	EventSinkBuffer   int64
+	EventSinkOverflow string
+
+	// The kafka sink produces to KafkaTopic on KafkaBrokers in batches of
+	// KafkaBatchSize, sending partial batches every KafkaBatchTimeout
+	KafkaBrokers      []string
+	KafkaTopic        string
+	KafkaBatchSize    int64
+	KafkaBatchTimeout time.Duration
+
+	// MetadataCanaryAddr is a second Redis whose metadata store, in
+	// MetadataCanaryFormat, is compared against the primary; empty disables it
+	MetadataCanaryAddr   string
+	MetadataCanaryFormat string
+
+	JWTSecret           string
+	JWTJWKSURL          string
+	JWTIssuer           string
+	JWTAudience         string
+	AnonymousPermission Permission
+
+	TimestampFormat TimestampFormat
+
+	LogSkipPaths     []string
+	LogSampleRate    float64
+	LogSlowThreshold time.Duration
+
+	// SelfCheckSoft names the startup self-checks whose failures only warn
+	SelfCheckSoft []string
+
+	// The runtime watchdog samples goroutines and the heap every
+	// RuntimeSampleInterval, 0 disables it, and captures goroutine and heap
+	// profiles into ProfileCaptureDir, keeping ProfileCaptureMax, once
+	// goroutines pass GoroutineThreshold or have grown for
+	// GoroutineGrowthSamples samples in a row; 0 disables either trigger
+	RuntimeSampleInterval  time.Duration
+	GoroutineThreshold     int64
+	GoroutineGrowthSamples int64
+	ProfileCaptureDir      string
+	ProfileCaptureMax      int64
+}
+
+// LoadConfig reads the service configuration from environment variables
+func LoadConfig() (Config, error) {
+	cfg := Config{
+		EnvName:            getEnv("ENV_NAME", ""),
+		AllowProdLocalhost: getEnvBool("ALLOW_PROD_LOCALHOST", false),
+		RedisHost:          getEnv("REDIS_HOST", "localhost"),
+		RedisPort:          getEnv("REDIS_PORT", "6379"),
+		ServiceDiscovery:   getEnv("SERVICE_DISCOVERY", discoveryNone),
+		StrictConsistency:  getEnvBool("STRICT_CONSISTENCY", false),
+		WriteWaitReplicas:  getEnvInt("WRITE_WAIT_REPLICAS", 1),
+		WriteWaitTimeout:   getEnvDuration("WRITE_WAIT_TIMEOUT", 50*time.Millisecond),
+		WriteWaitStrict:    getEnvBool("WRITE_WAIT_STRICT", false),
+
+		RedisAdaptiveTimeouts: getEnvBool("REDIS_ADAPTIVE_TIMEOUTS", true),
+		RedisTimeoutFloor:     getEnvDuration("REDIS_TIMEOUT_FLOOR", 50*time.Millisecond),
+		RedisTimeoutCeiling:   getEnvDuration("REDIS_TIMEOUT_CEILING", 2*time.Second),
+		RedisMaxRetries:       getEnvInt("REDIS_MAX_RETRIES", 2),
+		RedisRetryBackoff:     getEnvDuration("REDIS_RETRY_BACKOFF", 10*time.Millisecond),
+		RedisRetryBackoffMax:  getEnvDuration("REDIS_RETRY_BACKOFF_MAX", 200*time.Millisecond),
+
+		OOMJournalMaxEntries:     getEnvInt("OOM_JOURNAL_MAX_ENTRIES", 10000),
+		OOMJournalReplayInterval: getEnvDuration("OOM_JOURNAL_REPLAY_INTERVAL", time.Second),
+
+		LoadShedLatency:     getEnvDuration("LOAD_SHED_LATENCY", 0),
+		LoadShedFullLatency: getEnvDuration("LOAD_SHED_FULL_LATENCY", 0),
+
+		InFlightSoftLimit:       getEnvInt("INFLIGHT_SOFT_LIMIT", 0),
+		InFlightSaturationAfter: getEnvDuration("INFLIGHT_SATURATION_AFTER", 10*time.Second),
+		AlertWebhookURL:         getEnv("ALERT_WEBHOOK_URL", ""),
+
+		AnomalyInterval: getEnvDuration("ANOMALY_INTERVAL", 0),
+		AnomalyWindow:   getEnvDuration("ANOMALY_WINDOW", 5*time.Minute),
+
+		Port:              getEnv("PORT", "8080"),
+		InternalPort:      getEnv("INTERNAL_PORT", "9090"),
+		SinglePort:        getEnvBool("SINGLE_PORT", false),
+		Listen:            getEnvList("LISTEN"),
+		TLSCertFile:       getEnv("TLS_CERT_FILE", ""),
+		TLSKeyFile:        getEnv("TLS_KEY_FILE", ""),
+		ShutdownTimeout:   getEnvDuration("SHUTDOWN_TIMEOUT", 10*time.Second),
+		FlushTimeout:      getEnvDuration("FLUSH_TIMEOUT", 5*time.Second),
+		InstanceName:      getEnv("INSTANCE_NAME", hostname()),
+		AdminAPIKeys:      parseAPIKeys(getEnv("ADMIN_API_KEYS", "")),
+		AdminHMACSecret:   getEnv("ADMIN_HMAC_SECRET", ""),
+		PageTokenSecret:   getEnv("PAGE_TOKEN_SECRET", ""),
+		FlagsPollInterval: getEnvDuration("FLAGS_POLL_INTERVAL", 30*time.Second),
+		DedupeWindow:      getEnvDuration("DEDUPE_WINDOW", 30*time.Second),
+		AuditMaxLen:       getEnvInt("AUDIT_MAXLEN", 10000),
+		BatchRateLimit:    getEnvInt("BATCH_RATE_LIMIT", 10),
+		VisitorCookie:     getEnvBool("VISITOR_COOKIE", false),
+		IPHashSalt:        getEnv("IP_HASH_SALT", ""),
+		IPHashRotation:    getEnv("IP_HASH_ROTATION", rotationNone),
+		SessionWindow:     getEnvDuration("SESSION_WINDOW", 30*time.Minute),
+		SessionRefresh:    getEnvBool("SESSION_REFRESH", true),
+		TrustedProxies:    getEnvList("TRUSTED_PROXIES"),
+		JWTSecret:         getEnv("JWT_SECRET", ""),
+		JWTJWKSURL:        getEnv("JWT_JWKS_URL", ""),
+		JWTIssuer:         getEnv("JWT_ISSUER", ""),
+		JWTAudience:       getEnv("JWT_AUDIENCE", ""),
+
+		TrendingHalfLife:      getEnvDuration("TRENDING_HALF_LIFE", time.Hour),
+		TrendingDecayInterval: getEnvDuration("TRENDING_DECAY_INTERVAL", time.Minute),
+
+		CacheTTL:                getEnvDuration("CACHE_TTL", 5*time.Second),
+		CacheShared:             getEnvBool("CACHE_SHARED", false),
+		NewPageWebhookURL:       getEnv("NEW_PAGE_WEBHOOK_URL", ""),
+		WebhookPollInterval:     getEnvDuration("WEBHOOK_POLL_INTERVAL", time.Second),
+		WebhookRetryBase:        getEnvDuration("WEBHOOK_RETRY_BASE", time.Second),
+		WebhookMaxAttempts:      getEnvInt("WEBHOOK_MAX_ATTEMPTS", 8),
+		WebhookConcurrency:      int(getEnvInt("WEBHOOK_CONCURRENCY", 8)),
+		PageWebhookRate:         getEnvInt("PAGE_WEBHOOK_RATE", 60),
+		ApproximatePagePrefixes: getEnvList("APPROXIMATE_PAGE_PREFIXES"),
+		ResolveStripParams:      getEnvList("RESOLVE_STRIP_PARAMS"),
+		GeoIPHeaders:            getEnvBool("GEOIP_HEADERS", false),
+		GeoIPDBPath:             getEnv("GEOIP_DB_PATH", ""),
+		EventsStreamMaxLen:      getEnvInt("EVENTS_STREAM_MAXLEN", 10000),
+		WaitMaxWaiters:          getEnvInt("WAIT_MAX_WAITERS", 10000),
+		EventsClaimIdle:         getEnvDuration("EVENTS_CLAIM_IDLE", 30*time.Second),
+		RetentionInterval:       getEnvDuration("RETENTION_INTERVAL", time.Hour),
+		RetentionDryRun:         getEnvBool("RETENTION_DRY_RUN", false),
+		ArchiveDir:              getEnv("ARCHIVE_DIR", ""),
+		PageMetricsTop:          getEnvInt("PAGE_METRICS_TOP", 500),
+		PageMetricsCacheTTL:     getEnvDuration("PAGE_METRICS_CACHE_TTL", 30*time.Second),
+		ReconcileInterval:       getEnvDuration("RECONCILE_INTERVAL", 0),
+		CounterSampleInterval:   getEnvDuration("COUNTER_SAMPLE_INTERVAL", time.Minute),
+		CounterSampleMaxKeys:    getEnvInt("COUNTER_SAMPLE_MAX_KEYS", 1000),
+		QuotaCacheTTL:           getEnvDuration("QUOTA_CACHE_TTL", 30*time.Second),
+		QuotaMetricCallers:      getEnvList("QUOTA_METRIC_CALLERS"),
+		InterarrivalBotMedian:   getEnvDuration("INTERARRIVAL_BOT_MEDIAN", time.Second),
+		MetadataCanaryAddr:      getEnv("METADATA_CANARY_ADDR", ""),
+		MetadataCanaryFormat:    getEnv("METADATA_CANARY_FORMAT", canaryFormatHash),
+		ReconcileDryRun:         getEnvBool("RECONCILE_DRY_RUN", false),
+		ClockSkewInterval:       getEnvDuration("CLOCK_SKEW_INTERVAL", time.Minute),
+		ClockSkewThreshold:      getEnvDuration("CLOCK_SKEW_THRESHOLD", 2*time.Second),
+		BucketTimeSource:        getEnv("BUCKET_TIME_SOURCE", bucketTimeLocal),
+		RequestTimeout:          getEnvDuration("REQUEST_TIMEOUT", 0),
+		RequestDeadlineSkew:     getEnvDuration("REQUEST_DEADLINE_SKEW", 5*time.Second),
+		RedisCommandBudget:      getEnvInt("REDIS_COMMAND_BUDGET", 0),
+		DebugHeaders:            getEnvBool("DEBUG_HEADERS", false),
+		EventSinkBuffer:         getEnvInt("EVENT_SINK_BUFFER", 1024),
+		EventSinkOverflow:       getEnv("EVENT_SINK_OVERFLOW", overflowDrop),
+		KafkaBrokers:            getEnvList("KAFKA_BROKERS"),
+		KafkaTopic:              getEnv("KAFKA_TOPIC", "visits"),
+		KafkaBatchSize:          getEnvInt("KAFKA_BATCH_SIZE", 100),
+		KafkaBatchTimeout:       getEnvDuration("KAFKA_BATCH_TIMEOUT", time.Second),
+		ChaosEnabled:            getEnvBool("CHAOS_ENABLED", false),
+		DebugEcho:               getEnvBool("DEBUG_ECHO_ENABLED", false),
+		MigrateOnStart:          getEnvBool("MIGRATE_ON_START", true),
+		ReadOnly:                getEnvBool("READ_ONLY", false),
+		BurstDedupWindow:        getEnvDuration("BURST_DEDUP_WINDOW", 0),
+		NegativeCacheTTL:        getEnvDuration("NEGATIVE_CACHE_TTL", 0),
+		NegativeCacheSize:       getEnvInt("NEGATIVE_CACHE_SIZE", 10000),
+		CounterExpiringPrefixes: getEnvList("COUNTER_EXPIRING_PREFIXES"),
+		CounterTTL:              getEnvDuration("COUNTER_TTL", 30*24*time.Hour),
+		TTLAuditSoon:            getEnvDuration("TTL_AUDIT_SOON", 24*time.Hour),
+		RuntimeSampleInterval:   getEnvDuration("RUNTIME_SAMPLE_INTERVAL", 15*time.Second),
+		GoroutineThreshold:      getEnvInt("GOROUTINE_THRESHOLD", 10000),
+		GoroutineGrowthSamples:  getEnvInt("GOROUTINE_GROWTH_SAMPLES", 20),
+		ProfileCaptureDir:       getEnv("PROFILE_CAPTURE_DIR", ""),
+		ProfileCaptureMax:       getEnvInt("PROFILE_CAPTURE_MAX", 10),
+
+		LogSkipPaths:     getEnvList("LOG_SKIP_PATHS"),
+		LogSlowThreshold: getEnvDuration("LOG_SLOW_THRESHOLD", time.Second),
+	}
+
+	var err error
+	if cfg.RedisDB, err = parseRedisDB(getEnv("REDIS_DB", "0")); err != nil {
+		return Config{}, fmt.Errorf("REDIS_DB: %w", err)
+	}
+	switch cfg.ServiceDiscovery {
+	case discoveryNone:
+	case discoveryCompose:
+		applyComposeDefaults(&cfg)
+	default:
+		return Config{}, fmt.Errorf("SERVICE_DISCOVERY: must be %s or %s, got %q", discoveryNone, discoveryCompose, cfg.ServiceDiscovery)
+	}
+	cfg.KeyPrefix = os.Getenv("KEY_PREFIX")
+	cfg.KeyPrefixOld, cfg.KeyPrefixMigrating = os.LookupEnv("KEY_PREFIX_OLD")
+	if err := validKeyPrefix(cfg.KeyPrefix); err != nil {
+		return Config{}, fmt.Errorf("KEY_PREFIX: %w", err)
+	}
+	if err := validKeyPrefix(cfg.KeyPrefixOld); err != nil {
+		return Config{}, fmt.Errorf("KEY_PREFIX_OLD: %w", err)
+	}
+	if cfg.KeyPrefixMigrating && cfg.KeyPrefix == cfg.KeyPrefixOld {
+		return Config{}, fmt.Errorf("KEY_PREFIX_OLD: must differ from KEY_PREFIX, both are %q", cfg.KeyPrefix)
+	}
+	if cfg.KeyPrefixMigrating && cfg.KeyPrefix != "" && cfg.KeyPrefixOld != "" &&
+		(strings.HasPrefix(cfg.KeyPrefix, cfg.KeyPrefixOld) || strings.HasPrefix(cfg.KeyPrefixOld, cfg.KeyPrefix)) {
+		return Config{}, fmt.Errorf("KEY_PREFIX_OLD: must not overlap KEY_PREFIX %q, got %q", cfg.KeyPrefix, cfg.KeyPrefixOld)
+	}
+	if cfg.EnvName == prodEnv && isLocalHost(cfg.RedisHost) && !cfg.AllowProdLocalhost {
+		return Config{}, fmt.Errorf("ENV_NAME=%s with REDIS_HOST=%s: refusing to run production against a local Redis; set ALLOW_PROD_LOCALHOST=true to override", prodEnv, cfg.RedisHost)
+	}
+
+	if cfg.IPHashRotation != rotationNone && cfg.IPHashRotation != rotationDaily {
+		return Config{}, fmt.Errorf("IP_HASH_ROTATION: must be %s or %s, got %q", rotationNone, rotationDaily, cfg.IPHashRotation)
+	}
+
+	if cfg.AdminAllowedCIDRs, err = ParseCIDRMatcher(getEnv("ADMIN_ALLOWED_CIDRS", "")); err != nil {
+		return Config{}, fmt.Errorf("ADMIN_ALLOWED_CIDRS: %w", err)
+	}
+
+	if cfg.AnonymousPermission, err = ParsePermission(getEnv("JWT_ANONYMOUS_ROLE", "write")); err != nil {
+		return Config{}, fmt.Errorf("JWT_ANONYMOUS_ROLE: %w", err)
+	}
+
+	mode, err := strconv.ParseUint(getEnv("LISTEN_SOCKET_MODE", "0660"), 8, 32)
+	if err != nil || mode > 0o777 {
+		return Config{}, fmt.Errorf("LISTEN_SOCKET_MODE: must be an octal file mode such as 0660")
+	}
+	cfg.ListenSocketMode = os.FileMode(mode)
+
+	if cfg.LogSampleRate, err = strconv.ParseFloat(getEnv("LOG_SAMPLE_RATE", "1"), 64); err != nil || cfg.LogSampleRate < 0 || cfg.LogSampleRate > 1 {
+		return Config{}, fmt.Errorf("LOG_SAMPLE_RATE: must be a fraction from 0 to 1")
+	}
+
+	if cfg.RedisTimeoutMultiplier, err = strconv.ParseFloat(getEnv("REDIS_TIMEOUT_MULTIPLIER", "3"), 64); err != nil || cfg.RedisTimeoutMultiplier < 1 {
+		return Config{}, fmt.Errorf("REDIS_TIMEOUT_MULTIPLIER: must be a number of at least 1")
+	}
+	if cfg.RedisTimeoutHysteresis, err = strconv.ParseFloat(getEnv("REDIS_TIMEOUT_HYSTERESIS", "0.2"), 64); err != nil || cfg.RedisTimeoutHysteresis < 0 || cfg.RedisTimeoutHysteresis >= 1 {
+		return Config{}, fmt.Errorf("REDIS_TIMEOUT_HYSTERESIS: must be a fraction from 0 to below 1")
+	}
+	if cfg.RedisMaxRetries < 0 {
+		return Config{}, fmt.Errorf("REDIS_MAX_RETRIES: must not be negative, got %d", cfg.RedisMaxRetries)
+	}
+	if cfg.RedisRetryBackoff <= 0 || cfg.RedisRetryBackoffMax < cfg.RedisRetryBackoff {
+		return Config{}, fmt.Errorf("REDIS_RETRY_BACKOFF and REDIS_RETRY_BACKOFF_MAX: need 0 < backoff <= max, got %s and %s", cfg.RedisRetryBackoff, cfg.RedisRetryBackoffMax)
+	}
+	if cfg.TrendingHalfLife <= 0 {
+		return Config{}, fmt.Errorf("TRENDING_HALF_LIFE: must be positive, got %s", cfg.TrendingHalfLife)
+	}
+	if cfg.OOMJournalMaxEntries < 0 {
+		return Config{}, fmt.Errorf("OOM_JOURNAL_MAX_ENTRIES: must not be negative, got %d", cfg.OOMJournalMaxEntries)
+	}
+	if cfg.OOMJournalMaxEntries > 0 && cfg.OOMJournalReplayInterval <= 0 {
+		return Config{}, fmt.Errorf("OOM_JOURNAL_REPLAY_INTERVAL: must be positive, got %s", cfg.OOMJournalReplayInterval)
+	}
+	if cfg.InFlightSoftLimit < 0 {
+		return Config{}, fmt.Errorf("INFLIGHT_SOFT_LIMIT: must not be negative, got %d", cfg.InFlightSoftLimit)
+	}
+	if cfg.InFlightSoftLimit > 0 && cfg.InFlightSaturationAfter <= 0 {
+		return Config{}, fmt.Errorf("INFLIGHT_SATURATION_AFTER: must be positive, got %s", cfg.InFlightSaturationAfter)
+	}
+	if cfg.WriteConsistency, err = parseWriteConsistency(getEnv("WRITE_CONSISTENCY", writeConsistencyLocal)); err != nil {
+		return Config{}, fmt.Errorf("WRITE_CONSISTENCY: %w", err)
+	}
+	if cfg.WriteConsistency == writeConsistencyReplicated {
+		if cfg.StrictConsistency {
+			return Config{}, fmt.Errorf("WRITE_CONSISTENCY: %w", errWaitInTransaction)
+		}
+		if cfg.WriteWaitReplicas < 1 {
+			return Config{}, fmt.Errorf("WRITE_WAIT_REPLICAS: must be at least 1, got %d", cfg.WriteWaitReplicas)
+		}
+		if cfg.WriteWaitTimeout <= 0 || cfg.WriteWaitTimeout > maxWriteWaitTimeout {
+			return Config{}, fmt.Errorf("WRITE_WAIT_TIMEOUT: must be positive and at most %s, got %s", maxWriteWaitTimeout, cfg.WriteWaitTimeout)
+		}
+	}
+	if cfg.PageMetricsTop < 1 || cfg.PageMetricsTop > maxPageMetricsTop {
+		return Config{}, fmt.Errorf("PAGE_METRICS_TOP: must be between 1 and %d, got %d", maxPageMetricsTop, cfg.PageMetricsTop)
+	}
+	if cfg.AnomalyThreshold, err = strconv.ParseFloat(getEnv("ANOMALY_THRESHOLD", "10"), 64); err != nil || cfg.AnomalyThreshold <= 1 {
+		return Config{}, fmt.Errorf("ANOMALY_THRESHOLD: must be a multiplier above 1")
+	}
+	if cfg.AnomalyMinRate, err = strconv.ParseFloat(getEnv("ANOMALY_MIN_RATE", "1"), 64); err != nil || cfg.AnomalyMinRate < 0 {
+		return Config{}, fmt.Errorf("ANOMALY_MIN_RATE: must be a non-negative number of visits a minute")
+	}
+	if cfg.AnomalyInterval < 0 {
+		return Config{}, fmt.Errorf("ANOMALY_INTERVAL: must not be negative, got %s", cfg.AnomalyInterval)
+	}
+	if cfg.AnomalyInterval > 0 && (cfg.AnomalyWindow < time.Minute || cfg.AnomalyWindow > time.Hour || cfg.AnomalyWindow%time.Minute != 0) {
+		return Config{}, fmt.Errorf("ANOMALY_WINDOW: must be whole minutes from 1m to 1h, got %s", cfg.AnomalyWindow)
+	}
+	if cfg.RedisTimeoutFloor <= 0 || cfg.RedisTimeoutCeiling < cfg.RedisTimeoutFloor {
+		return Config{}, fmt.Errorf("REDIS_TIMEOUT_FLOOR and REDIS_TIMEOUT_CEILING: need 0 < floor <= ceiling, got %s and %s", cfg.RedisTimeoutFloor, cfg.RedisTimeoutCeiling)
+	}
+
+	// A fraction below 1 keeps some visits reaching Redis, so the p99 the
+	// shed rate follows keeps being measured and can recover
+	if cfg.LoadShedMaxFraction, err = strconv.ParseFloat(getEnv("LOAD_SHED_MAX_FRACTION", "0.5"), 64); err != nil || cfg.LoadShedMaxFraction <= 0 || cfg.LoadShedMaxFraction >= 1 {
+		return Config{}, fmt.Errorf("LOAD_SHED_MAX_FRACTION: must be a fraction above 0 and below 1")
+	}
+	if cfg.LoadShedFullLatency == 0 {
+		cfg.LoadShedFullLatency = 4 * cfg.LoadShedLatency
+	}
+	if cfg.LoadShedLatency < 0 || cfg.LoadShedFullLatency < cfg.LoadShedLatency || (cfg.LoadShedLatency > 0 && cfg.LoadShedFullLatency == cfg.LoadShedLatency) {
+		return Config{}, fmt.Errorf("LOAD_SHED_LATENCY and LOAD_SHED_FULL_LATENCY: need 0 < latency < full latency, got %s and %s", cfg.LoadShedLatency, cfg.LoadShedFullLatency)
+	}
+
+	if cfg.TimestampFormat, err = ParseTimestampFormat(getEnv("TIMESTAMP_FORMAT", "rfc3339")); err != nil {
+		return Config{}, fmt.Errorf("TIMESTAMP_FORMAT: %w", err)
+	}
+
+	if cfg.Retention.DailyDays, err = parsePeriod(getEnv("RETENTION_DAILY", ""), "d"); err != nil {
+		return Config{}, fmt.Errorf("RETENTION_DAILY: %w", err)
+	}
+	if cfg.Retention.MonthlyMonths, err = parsePeriod(getEnv("RETENTION_MONTHLY", ""), "m"); err != nil {
+		return Config{}, fmt.Errorf("RETENTION_MONTHLY: %w", err)
+	}
+	// Monthly buckets are rolled up from days past RETENTION_DAILY, so a
+	// shorter monthly window would delete them as soon as they are written.
+	// Months count as 31 days, so 3m keeps 90d.
+	if days, months := cfg.Retention.DailyDays, cfg.Retention.MonthlyMonths; days > 0 && months > 0 && months*31 < days {
+		return Config{}, fmt.Errorf("RETENTION_MONTHLY: must be at least RETENTION_DAILY, got %dm and %dd", months, days)
+	}
+
+	switch {
+	case len(cfg.ResolveStripParams) == 0:
+		cfg.ResolveStripParams = defaultStripParams
+	case len(cfg.ResolveStripParams) == 1 && cfg.ResolveStripParams[0] == "none":
+		cfg.ResolveStripParams = nil
+	}
+
+	if cfg.WebhookMaxAttempts < 1 || cfg.WebhookRetryBase <= 0 {
+		return Config{}, fmt.Errorf("WEBHOOK_MAX_ATTEMPTS and WEBHOOK_RETRY_BASE: need at least 1 attempt and a positive base, got %d and %s", cfg.WebhookMaxAttempts, cfg.WebhookRetryBase)
+	}
+	if cfg.WebhookConcurrency < 1 {
+		return Config{}, fmt.Errorf("WEBHOOK_CONCURRENCY: need at least 1 delivery at a time, got %d", cfg.WebhookConcurrency)
+	}
+	if cfg.WaitMaxWaiters < 1 {
+		return Config{}, fmt.Errorf("WAIT_MAX_WAITERS: need room for at least 1 long-poll, got %d", cfg.WaitMaxWaiters)
+	}
+	if cfg.PageWebhookRate < 0 {
+		return Config{}, fmt.Errorf("PAGE_WEBHOOK_RATE: must be 0 (off) or more deliveries per minute, got %d", cfg.PageWebhookRate)
+	}
+
+	if cfg.CounterDropGuardPercent, err = strconv.ParseFloat(getEnv("COUNTER_DROP_GUARD_PERCENT", "0"), 64); err != nil || cfg.CounterDropGuardPercent < 0 || cfg.CounterDropGuardPercent > 100 {
+		return Config{}, fmt.Errorf("COUNTER_DROP_GUARD_PERCENT: must be a percentage from 0 (off) to 100")
+	}
+
+	if cfg.MetadataCanaryFormat != canaryFormatHash && cfg.MetadataCanaryFormat != canaryFormatJSON {
+		return Config{}, fmt.Errorf("METADATA_CANARY_FORMAT: must be hash or json, got %q", cfg.MetadataCanaryFormat)
+	}
+
+	if cfg.CounterSampleMaxKeys < 1 {
+		return Config{}, fmt.Errorf("COUNTER_SAMPLE_MAX_KEYS: must be at least 1, got %d", cfg.CounterSampleMaxKeys)
+	}
+
+	// Gin reads GIN_MODE itself; release is how deployments run it
+	if cfg.ChaosEnabled && (cfg.EnvName == prodEnv || os.Getenv("GIN_MODE") == "release") {
+		return Config{}, fmt.Errorf("CHAOS_ENABLED: failure injection is for development, not ENV_NAME=%s or GIN_MODE=release", prodEnv)
+	}
+
+	if cfg.ClockSkewThreshold <= 0 {
+		return Config{}, fmt.Errorf("CLOCK_SKEW_THRESHOLD: must be positive, got %s", cfg.ClockSkewThreshold)
+	}
+	switch {
+	case cfg.BucketTimeSource != bucketTimeLocal && cfg.BucketTimeSource != bucketTimeRedis:
+		return Config{}, fmt.Errorf("BUCKET_TIME_SOURCE: must be %s or %s, got %q", bucketTimeLocal, bucketTimeRedis, cfg.BucketTimeSource)
+	case cfg.BucketTimeSource == bucketTimeRedis && cfg.ClockSkewInterval <= 0:
+		return Config{}, fmt.Errorf("BUCKET_TIME_SOURCE: redis needs the skew watchdog, but CLOCK_SKEW_INTERVAL is %s", cfg.ClockSkewInterval)
+	}
+
+	if cfg.CounterTTL <= 0 {
+		return Config{}, fmt.Errorf("COUNTER_TTL: must be positive, got %s", cfg.CounterTTL)
+	}
+	if cfg.TTLAuditSoon < 0 {
+		return Config{}, fmt.Errorf("TTL_AUDIT_SOON: must not be negative, got %s", cfg.TTLAuditSoon)
+	}
+	if cfg.BurstDedupWindow < 0 || cfg.BurstDedupWindow > maxBurstDedupWindow {
+		return Config{}, fmt.Errorf("BURST_DEDUP_WINDOW: must be from 0 (off) to %s, got %s", maxBurstDedupWindow, cfg.BurstDedupWindow)
+	}
+	if cfg.NegativeCacheTTL < 0 {
+		return Config{}, fmt.Errorf("NEGATIVE_CACHE_TTL: must not be negative, got %s", cfg.NegativeCacheTTL)
+	}
+	if cfg.NegativeCacheSize < 1 {
+		return Config{}, fmt.Errorf("NEGATIVE_CACHE_SIZE: must be at least 1, got %d", cfg.NegativeCacheSize)
+	}
+
+	if cfg.RequestTimeout < 0 {
+		return Config{}, fmt.Errorf("REQUEST_TIMEOUT: must not be negative, got %s", cfg.RequestTimeout)
+	}
+	if cfg.RequestDeadlineSkew <= 0 {
+		return Config{}, fmt.Errorf("REQUEST_DEADLINE_SKEW: must be positive, got %s", cfg.RequestDeadlineSkew)
+	}
+	if cfg.RedisCommandBudget < 0 {
+		return Config{}, fmt.Errorf("REDIS_COMMAND_BUDGET: must not be negative, got %d", cfg.RedisCommandBudget)
+	}
+
+	if cfg.EventsBackend, err = parseEventsBackend(getEnv("EVENTS_BACKEND", "")); err != nil {
+		return Config{}, fmt.Errorf("EVENTS_BACKEND: %w", err)
+	}
+
+	if cfg.EventSinks, err = parseEventSinks(getEnvList("EVENT_SINKS")); err != nil {
+		return Config{}, fmt.Errorf("EVENT_SINKS: %w", err)
+	}
+	if cfg.EventSinkBuffer <= 0 {
+		return Config{}, fmt.Errorf("EVENT_SINK_BUFFER: must be positive, got %d", cfg.EventSinkBuffer)
+	}
+	if cfg.EventSinkOverflow != overflowDrop && cfg.EventSinkOverflow != overflowBlock {
+		return Config{}, fmt.Errorf("EVENT_SINK_OVERFLOW: must be %s or %s, got %q", overflowDrop, overflowBlock, cfg.EventSinkOverflow)
+	}
+	if containsString(cfg.EventSinks, sinkKafka) {
+		switch {
+		case len(cfg.KafkaBrokers) == 0:
+			return Config{}, fmt.Errorf("KAFKA_BROKERS: the kafka sink needs at least one broker")
+		case cfg.KafkaTopic == "":
+			return Config{}, fmt.Errorf("KAFKA_TOPIC: the kafka sink needs a topic")
+		case cfg.KafkaBatchSize <= 0:
+			return Config{}, fmt.Errorf("KAFKA_BATCH_SIZE: must be positive, got %d", cfg.KafkaBatchSize)
+		case cfg.KafkaBatchTimeout <= 0:
+			return Config{}, fmt.Errorf("KAFKA_BATCH_TIMEOUT: must be positive, got %s", cfg.KafkaBatchTimeout)
+		}
+	}
+
+	switch {
+	case cfg.RuntimeSampleInterval < 0:
+		return Config{}, fmt.Errorf("RUNTIME_SAMPLE_INTERVAL: must not be negative, got %s", cfg.RuntimeSampleInterval)
+	case cfg.GoroutineThreshold < 0:
+		return Config{}, fmt.Errorf("GOROUTINE_THRESHOLD: must not be negative, got %d", cfg.GoroutineThreshold)
+	case cfg.GoroutineGrowthSamples < 0:
+		return Config{}, fmt.Errorf("GOROUTINE_GROWTH_SAMPLES: must not be negative, got %d", cfg.GoroutineGrowthSamples)
+	case cfg.ProfileCaptureMax < 1:
+		return Config{}, fmt.Errorf("PROFILE_CAPTURE_MAX: must be positive, got %d", cfg.ProfileCaptureMax)
+	case cfg.ProfileCaptureDir != "" && cfg.RuntimeSampleInterval == 0:
+		return Config{}, fmt.Errorf("PROFILE_CAPTURE_DIR: captures need the runtime watchdog, set RUNTIME_SAMPLE_INTERVAL")
+	}
+
+	if cfg.SelfCheckSoft, err = parseSelfCheckSoft(os.Getenv("SELFCHECK_SOFT")); err != nil {
+		return Config{}, fmt.Errorf("SELFCHECK_SOFT: %w", err)
+	}
+
+	switch mode := getEnv("VARIANT_MODE", variantModeStrict); mode {
+	case variantModeStrict:
+		cfg.StrictVariants = true
+	case variantModeLenient:
+	default:
+		return Config{}, fmt.Errorf("VARIANT_MODE: must be %s or %s, got %q", variantModeStrict, variantModeLenient, mode)
+	}
+
+	return cfg, nil
+}
+
+// prodEnv is the ENV_NAME of production deployments
+const prodEnv = "prod"
+
+// maxRedisDB is the highest logical database of a default Redis server
+const maxRedisDB = 15
+
+// parseRedisDB parses a logical database number
+func parseRedisDB(value string) (int, error) {
+	db, err := strconv.Atoi(value)
+	if err != nil || db < 0 || db > maxRedisDB {
+		return 0, fmt.Errorf("must be a database number from 0 to %d, got %q", maxRedisDB, value)
+	}
+	return db, nil
+}
+
+// isLocalHost reports whether host names this machine
+func isLocalHost(host string) bool {
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+	ip := net.ParseIP(strings.Trim(host, "[]"))
+	return ip != nil && (ip.IsLoopback() || ip.IsUnspecified())
+}
+
+// parsePeriod parses a count with a unit suffix such as "90d", returning 0
+// for an empty value
+func parsePeriod(value, unit string) (int, error) {
+	if value == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(strings.TrimSuffix(value, unit))
+	if err != nil || !strings.HasSuffix(value, unit) || n < 0 {
+		return 0, fmt.Errorf("must look like 12%s, got %q", unit, value)
+	}
+	return n, nil
+}
+
+// getEnvList gets a comma-separated environment variable as a list
+func getEnvList(key string) []string {
+	var values []string
+	for _, v := range strings.Split(getEnv(key, ""), ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+// parseAPIKeys parses "name:key,name:key" into a key -> name map
+func parseAPIKeys(value string) map[string]string {
+	keys := make(map[string]string)
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, key, ok := strings.Cut(entry, ":")
+		if !ok || name == "" || key == "" {
+			log.Printf("Ignoring malformed ADMIN_API_KEYS entry %q", entry)
+			continue
+		}
+		keys[key] = name
+	}
+	return keys
+}
+
+// hostname returns the machine's host name, or "" when it is unavailable
+func hostname() string {
+	name, _ := os.Hostname()
+	return name
+}
+
+// getEnvInt gets an integer environment variable with a fallback value
+func getEnvInt(key string, fallback int64) int64 {
+	value := getEnv(key, "")
+	if value == "" {
+		return fallback
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		log.Printf("Invalid %s %q, using %d", key, value, fallback)
+		return fallback
+	}
+	return n
+}
+
+// getEnvDuration gets a duration environment variable with a fallback value
+func getEnvDuration(key string, fallback time.Duration) time.Duration {
+	value := getEnv(key, "")
+	if value == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		log.Printf("Invalid %s %q, using %s", key, value, fallback)
+		return fallback
+	}
+	return d
+}
+
+// getEnvBool gets a boolean environment variable with a fallback value
+func getEnvBool(key string, fallback bool) bool {
+	value := getEnv(key, "")
+	if value == "" {
+		return fallback
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Printf("Invalid %s %q, using %t", key, value, fallback)
+		return fallback
+	}
+	return b
+}
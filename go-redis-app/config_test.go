@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestParseRedisDB(t *testing.T) {
+	tests := []struct {
+		value string
+		db    int
+		ok    bool
+	}{
+		{"0", 0, true},
+		{"7", 7, true},
+		{"15", 15, true},
+		{"16", 0, false},
+		{"-1", 0, false},
+		{"one", 0, false},
+	}
+	for _, tt := range tests {
+		db, err := parseRedisDB(tt.value)
+		if (err == nil) != tt.ok || db != tt.db {
+			t.Errorf("parseRedisDB(%q) = %d, %v", tt.value, db, err)
+		}
+	}
+}
+
+func TestLoadConfigEnvironment(t *testing.T) {
+	tests := []struct {
+		name string
+		env  map[string]string
+		ok   bool
+		db   int
+	}{
+		{"defaults", map[string]string{}, true, 0},
+		{"staging db", map[string]string{"ENV_NAME": "staging", "REDIS_DB": "2"}, true, 2},
+		{"db out of range", map[string]string{"REDIS_DB": "16"}, false, 0},
+		{"db not a number", map[string]string{"REDIS_DB": "prod"}, false, 0},
+		{"prod on remote redis", map[string]string{"ENV_NAME": "prod", "REDIS_HOST": "redis.internal"}, true, 0},
+		{"prod on default host", map[string]string{"ENV_NAME": "prod"}, false, 0},
+		{"prod on loopback", map[string]string{"ENV_NAME": "prod", "REDIS_HOST": "127.0.0.1"}, false, 0},
+		{"prod on ipv6 loopback", map[string]string{"ENV_NAME": "prod", "REDIS_HOST": "::1"}, false, 0},
+		{"prod on localhost allowed", map[string]string{"ENV_NAME": "prod", "REDIS_HOST": "localhost", "ALLOW_PROD_LOCALHOST": "true"}, true, 0},
+		{"dev on localhost", map[string]string{"ENV_NAME": "dev", "REDIS_HOST": "localhost"}, true, 0},
+		{"chaos in dev", map[string]string{"ENV_NAME": "dev", "CHAOS_ENABLED": "true"}, true, 0},
+		{"chaos in prod", map[string]string{"ENV_NAME": "prod", "REDIS_HOST": "redis.internal", "CHAOS_ENABLED": "true"}, false, 0},
+		{"chaos in release mode", map[string]string{"GIN_MODE": "release", "CHAOS_ENABLED": "true"}, false, 0},
+		{"burst dedup", map[string]string{"BURST_DEDUP_WINDOW": "100ms"}, true, 0},
+		{"burst dedup too long", map[string]string{"BURST_DEDUP_WINDOW": "1m"}, false, 0},
+		{"burst dedup negative", map[string]string{"BURST_DEDUP_WINDOW": "-100ms"}, false, 0},
+		{"request timeout", map[string]string{"REQUEST_TIMEOUT": "5s"}, true, 0},
+		{"negative request timeout", map[string]string{"REQUEST_TIMEOUT": "-1s"}, false, 0},
+		{"zero request deadline skew", map[string]string{"REQUEST_DEADLINE_SKEW": "0s"}, false, 0},
+		{"event sinks", map[string]string{"EVENT_SINKS": "stream,log", "EVENT_SINK_OVERFLOW": "block"}, true, 0},
+		{"unknown event sink", map[string]string{"EVENT_SINKS": "stream,s3"}, false, 0},
+		{"unknown overflow policy", map[string]string{"EVENT_SINKS": "log", "EVENT_SINK_OVERFLOW": "spill"}, false, 0},
+		{"kafka sink", map[string]string{"EVENT_SINKS": "kafka", "KAFKA_BROKERS": "kafka-1:9092,kafka-2:9092"}, true, 0},
+		{"kafka sink without brokers", map[string]string{"EVENT_SINKS": "kafka"}, false, 0},
+		{"kafka sink with compose brokers", map[string]string{"EVENT_SINKS": "kafka", "SERVICE_DISCOVERY": "compose"}, true, 0},
+		{"unknown service discovery", map[string]string{"SERVICE_DISCOVERY": "consul"}, false, 0},
+		{"profile captures", map[string]string{"PROFILE_CAPTURE_DIR": "/tmp/captures", "PROFILE_CAPTURE_MAX": "3"}, true, 0},
+		{"profile captures without the watchdog", map[string]string{"PROFILE_CAPTURE_DIR": "/tmp/captures", "RUNTIME_SAMPLE_INTERVAL": "0s"}, false, 0},
+		{"zero profile captures kept", map[string]string{"PROFILE_CAPTURE_MAX": "0"}, false, 0},
+		{"negative goroutine threshold", map[string]string{"GOROUTINE_THRESHOLD": "-1"}, false, 0},
+		{"redis retries", map[string]string{"REDIS_MAX_RETRIES": "0"}, true, 0},
+		{"negative redis retries", map[string]string{"REDIS_MAX_RETRIES": "-1"}, false, 0},
+		{"redis retry backoff above max", map[string]string{"REDIS_RETRY_BACKOFF": "1s", "REDIS_RETRY_BACKOFF_MAX": "100ms"}, false, 0},
+		{"counter ttl", map[string]string{"COUNTER_EXPIRING_PREFIXES": "tmp/", "COUNTER_TTL": "72h"}, true, 0},
+		{"zero counter ttl", map[string]string{"COUNTER_TTL": "0s"}, false, 0},
+		{"negative ttl audit threshold", map[string]string{"TTL_AUDIT_SOON": "-1h"}, false, 0},
+		{"negative oom journal size", map[string]string{"OOM_JOURNAL_MAX_ENTRIES": "-1"}, false, 0},
+		{"trending without a half-life", map[string]string{"TRENDING_HALF_LIFE": "0s"}, false, 0},
+		{"oom journal without replays", map[string]string{"OOM_JOURNAL_REPLAY_INTERVAL": "0s"}, false, 0},
+		{"oom journal off", map[string]string{"OOM_JOURNAL_MAX_ENTRIES": "0", "OOM_JOURNAL_REPLAY_INTERVAL": "0s"}, true, 0},
+		{"negative in-flight soft limit", map[string]string{"INFLIGHT_SOFT_LIMIT": "-1"}, false, 0},
+		{"in-flight soft limit without a period", map[string]string{"INFLIGHT_SOFT_LIMIT": "100", "INFLIGHT_SATURATION_AFTER": "0s"}, false, 0},
+		{"in-flight check off", map[string]string{"INFLIGHT_SATURATION_AFTER": "0s"}, true, 0},
+		{"anomaly detection", map[string]string{"ANOMALY_INTERVAL": "5m", "ANOMALY_WINDOW": "15m", "ANOMALY_THRESHOLD": "4.5"}, true, 0},
+		{"anomaly threshold of 1", map[string]string{"ANOMALY_THRESHOLD": "1"}, false, 0},
+		{"negative anomaly minimum rate", map[string]string{"ANOMALY_MIN_RATE": "-1"}, false, 0},
+		{"anomaly window in seconds", map[string]string{"ANOMALY_INTERVAL": "5m", "ANOMALY_WINDOW": "90s"}, false, 0},
+		{"anomaly window over an hour", map[string]string{"ANOMALY_INTERVAL": "5m", "ANOMALY_WINDOW": "2h"}, false, 0},
+		{"page metrics top of 0", map[string]string{"PAGE_METRICS_TOP": "0"}, false, 0},
+		{"page metrics top over the maximum", map[string]string{"PAGE_METRICS_TOP": "10001"}, false, 0},
+		{"negative redis command budget", map[string]string{"REDIS_COMMAND_BUDGET": "-1"}, false, 0},
+		{"negative cache", map[string]string{"NEGATIVE_CACHE_TTL": "30s", "NEGATIVE_CACHE_SIZE": "500"}, true, 0},
+		{"negative negative cache ttl", map[string]string{"NEGATIVE_CACHE_TTL": "-1s"}, false, 0},
+		{"zero negative cache size", map[string]string{"NEGATIVE_CACHE_SIZE": "0"}, false, 0},
+		{"unknown write consistency", map[string]string{"WRITE_CONSISTENCY": "quorum"}, false, 0},
+		{"replicated writes", map[string]string{"WRITE_CONSISTENCY": "replicated", "WRITE_WAIT_REPLICAS": "2", "WRITE_WAIT_TIMEOUT": "100ms"}, true, 0},
+		{"replicated writes with strict consistency", map[string]string{"WRITE_CONSISTENCY": "replicated", "STRICT_CONSISTENCY": "true"}, false, 0},
+		{"write wait of 0 replicas", map[string]string{"WRITE_CONSISTENCY": "replicated", "WRITE_WAIT_REPLICAS": "0"}, false, 0},
+		{"write wait timeout over the maximum", map[string]string{"WRITE_CONSISTENCY": "replicated", "WRITE_WAIT_TIMEOUT": "2s"}, false, 0},
+		{"retention", map[string]string{"RETENTION_DAILY": "90d", "RETENTION_MONTHLY": "3m"}, true, 0},
+		{"monthly retention only", map[string]string{"RETENTION_MONTHLY": "1m"}, true, 0},
+		{"monthly retention shorter than daily", map[string]string{"RETENTION_DAILY": "90d", "RETENTION_MONTHLY": "2m"}, false, 0},
+		{"key prefix", map[string]string{"KEY_PREFIX": "blue:"}, true, 0},
+		{"glob in key prefix", map[string]string{"KEY_PREFIX": "blue*"}, false, 0},
+		{"key prefix migration", map[string]string{"KEY_PREFIX": "blue:", "KEY_PREFIX_OLD": ""}, true, 0},
+		{"key prefix migration to the same prefix", map[string]string{"KEY_PREFIX": "blue:", "KEY_PREFIX_OLD": "blue:"}, false, 0},
+		{"overlapping key prefixes", map[string]string{"KEY_PREFIX": "blue:v2:", "KEY_PREFIX_OLD": "blue:"}, false, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, key := range []string{"ENV_NAME", "REDIS_HOST", "REDIS_DB", "ALLOW_PROD_LOCALHOST", "CHAOS_ENABLED", "GIN_MODE", "BURST_DEDUP_WINDOW", "EVENT_SINKS", "EVENT_SINK_OVERFLOW", "KAFKA_BROKERS", "REQUEST_TIMEOUT", "COUNTER_EXPIRING_PREFIXES", "COUNTER_TTL", "TTL_AUDIT_SOON", "REDIS_MAX_RETRIES", "REDIS_RETRY_BACKOFF", "REDIS_RETRY_BACKOFF_MAX", "OOM_JOURNAL_MAX_ENTRIES", "OOM_JOURNAL_REPLAY_INTERVAL", "TRENDING_HALF_LIFE", "KEY_PREFIX", "INFLIGHT_SOFT_LIMIT", "INFLIGHT_SATURATION_AFTER", "ANOMALY_INTERVAL", "ANOMALY_WINDOW", "ANOMALY_THRESHOLD", "ANOMALY_MIN_RATE", "PAGE_METRICS_TOP", "WRITE_CONSISTENCY", "WRITE_WAIT_REPLICAS", "WRITE_WAIT_TIMEOUT", "STRICT_CONSISTENCY", "REDIS_COMMAND_BUDGET", "NEGATIVE_CACHE_TTL", "NEGATIVE_CACHE_SIZE", "REQUEST_DEADLINE_SKEW", "SERVICE_DISCOVERY", "PROFILE_CAPTURE_DIR", "PROFILE_CAPTURE_MAX", "RUNTIME_SAMPLE_INTERVAL", "GOROUTINE_THRESHOLD", "RETENTION_DAILY", "RETENTION_MONTHLY"} {
+				t.Setenv(key, tt.env[key])
+			}
+			// KEY_PREFIX_OLD switches the mode on even when empty, so it is
+			// only set by the cases using it
+			if old, ok := tt.env["KEY_PREFIX_OLD"]; ok {
+				t.Setenv("KEY_PREFIX_OLD", old)
+			}
+			cfg, err := LoadConfig()
+			if (err == nil) != tt.ok {
+				t.Fatalf("Expected ok=%t, got %v", tt.ok, err)
+			}
+			if err == nil && (cfg.RedisDB != tt.db || cfg.EnvName != tt.env["ENV_NAME"]) {
+				t.Errorf("Expected DB %d in %q, got DB %d in %q", tt.db, tt.env["ENV_NAME"], cfg.RedisDB, cfg.EnvName)
+			}
+		})
+	}
+}
+
+func TestEnvironmentTag(t *testing.T) {
+	_, redisClient := newTestRedis(t)
+	cfg := testConfig()
+	cfg.EnvName = "staging"
+	server := newTestServer(t, cfg, redisClient)
+
+	w := doRequest(server.Router(), "GET", "/", "", nil)
+	var root map[string]any
+	json.Unmarshal(w.Body.Bytes(), &root)
+	if root["environment"] != "staging" {
+		t.Errorf("Expected environment staging on the root endpoint, got %v", root["environment"])
+	}
+
+	doRequest(server.Router(), "GET", "/visit/home", "", nil)
+	body := doRequest(server.Router(), "GET", "/metrics", "", nil).Body.String()
+	if want := `http_requests_total{env="staging",method="GET",route="/visit/:page",status="200"} 1`; !strings.Contains(body, want) {
+		t.Errorf("Expected /metrics to contain %q, got:\n%s", want, body)
+	}
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected 200 from the root endpoint, got %d", w.Code)
+	}
+}
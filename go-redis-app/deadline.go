@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Deadline headers set by the API gateway: the absolute deadline in Unix
+// milliseconds, the gRPC timeout relative to when the request arrived, and
+// when the gateway received the request, in Unix milliseconds by its clock
+const (
+	requestDeadlineHeader = "X-Request-Deadline"
+	grpcTimeoutHeader     = "Grpc-Timeout"
+	requestStartHeader    = "X-Request-Start"
+)
+
+// deadlineRemainingHeader carries the milliseconds left before the
+// request's deadline with DEBUG_HEADERS=true
+const deadlineRemainingHeader = "X-Deadline-Remaining"
+
+// deadlineKey is the context key of the request's effective deadline, the
+// earliest of the gateway's and REQUEST_TIMEOUT
+const deadlineKey = "deadline"
+
+// skewWarnEvery limits the clock skew warnings to one per interval
+const skewWarnEvery = time.Minute
+
+// grpcTimeoutUnits are the units of a grpc-timeout value
+var grpcTimeoutUnits = map[byte]time.Duration{
+	'H': time.Hour,
+	'M': time.Minute,
+	'S': time.Second,
+	'm': time.Millisecond,
+	'u': time.Microsecond,
+	'n': time.Nanosecond,
+}
+
+// parseGRPCTimeout parses a grpc-timeout value: up to 8 digits and a unit
+func parseGRPCTimeout(value string) (time.Duration, bool) {
+	if len(value) < 2 || len(value) > 9 {
+		return 0, false
+	}
+	unit, ok := grpcTimeoutUnits[value[len(value)-1]]
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.ParseUint(value[:len(value)-1], 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return time.Duration(n) * unit, true
+}
+
+// gatewayDeadline returns the earliest deadline the request's headers set.
+// With X-Request-Start the time X-Request-Deadline leaves is measured on the
+// gateway's clock and counted from now, so skew between the clocks moves
+// neither an expired nor a future deadline; skew is how far the gateway's
+// clock is behind ours. Without it, a deadline further in the past than
+// tolerance can't be told apart from skew and is ignored, as the gateway
+// would not have forwarded it. Malformed values are ignored.
+func gatewayDeadline(header http.Header, now time.Time, tolerance time.Duration) (deadline time.Time, skew time.Duration, ignored bool) {
+	if at, ok := parseUnixMillis(header.Get(requestDeadlineHeader)); ok {
+		if start, ok := parseUnixMillis(header.Get(requestStartHeader)); ok {
+			skew = now.Sub(start)
+			deadline = now.Add(at.Sub(start))
+		} else if now.Sub(at) > tolerance {
+			ignored = true
+		} else {
+			deadline = at
+		}
+	}
+	if timeout, ok := parseGRPCTimeout(header.Get(grpcTimeoutHeader)); ok {
+		if at := now.Add(timeout); deadline.IsZero() || at.Before(deadline) {
+			deadline = at
+		}
+	}
+	return deadline, skew, ignored
+}
+
+// parseUnixMillis parses a time in Unix milliseconds
+func parseUnixMillis(value string) (time.Time, bool) {
+	ms, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.UnixMilli(ms), true
+}
+
+// deadlineWarnings throttles the warnings about the gateway's clock
+type deadlineWarnings struct {
+	last    atomic.Int64 // Unix nanoseconds of the last warning
+	skipped atomic.Int64 // warnings skipped since then
+}
+
+// warn logs a warning about the gateway's clock, at most once per
+// skewWarnEvery
+func (w *deadlineWarnings) warn(now time.Time, format string, args ...any) {
+	last := w.last.Load()
+	if now.UnixNano()-last < int64(skewWarnEvery) || !w.last.CompareAndSwap(last, now.UnixNano()) {
+		w.skipped.Add(1)
+		return
+	}
+	log.Printf(format+" (%d more since the last warning)", append(args, w.skipped.Swap(0))...)
+}
+
+// applyDeadline gives the request the deadline the gateway set, answering
+// 504 at once when it has already passed so no work is done for a client
+// that is gone. Handlers with REQUEST_TIMEOUT keep whichever is earlier; a
+// deadline that had to be ignored falls back to REQUEST_TIMEOUT on every
+// route. Deadlines are wall-clock, so it reads time.Now rather than the
+// server's Clock.
+func (s *Server) applyDeadline(c *gin.Context) {
+	now := time.Now()
+	tolerance := s.cfg.RequestDeadlineSkew
+	deadline, skew, ignored := gatewayDeadline(c.Request.Header, now, tolerance)
+	switch {
+	case ignored:
+		s.deadlineWarnings.warn(now, "Ignoring %s %s, more than REQUEST_DEADLINE_SKEW in the past; check the gateway's clock or have it send %s",
+			requestDeadlineHeader, c.GetHeader(requestDeadlineHeader), requestStartHeader)
+		if deadline.IsZero() && s.cfg.RequestTimeout > 0 {
+			deadline = now.Add(s.cfg.RequestTimeout)
+		}
+	case skew > tolerance || skew < -tolerance:
+		s.deadlineWarnings.warn(now, "The gateway's clock is %s behind ours going by %s; its deadlines are measured on its own clock",
+			skew.Round(time.Second), requestStartHeader)
+	}
+	if !deadline.IsZero() {
+		if !deadline.After(now) {
+			respondError(c, http.StatusGatewayTimeout, "deadline_exceeded", "The request deadline has already passed")
+			return
+		}
+		ctx, cancel := context.WithDeadline(c.Request.Context(), deadline)
+		defer cancel()
+		c.Request = c.Request.WithContext(ctx)
+		c.Set(deadlineKey, deadline)
+	}
+	if s.cfg.DebugHeaders {
+		writer := c.Writer
+		c.Writer = &deadlineWriter{ResponseWriter: writer, c: c}
+		defer func() { c.Writer = writer }()
+	}
+	c.Next()
+}
+
+// deadlineWriter sets X-Deadline-Remaining just before the response's
+// headers are sent, when the request has a deadline
+type deadlineWriter struct {
+	gin.ResponseWriter
+	c   *gin.Context
+	set bool
+}
+
+func (w *deadlineWriter) setHeader() {
+	if w.set || w.Written() {
+		return
+	}
+	w.set = true
+	if deadline, ok := w.c.Get(deadlineKey); ok {
+		remaining := time.Until(deadline.(time.Time))
+		w.Header().Set(deadlineRemainingHeader, strconv.FormatFloat(durationMs(remaining), 'f', 2, 64))
+	}
+}
+
+func (w *deadlineWriter) WriteHeaderNow() {
+	w.setHeader()
+	w.ResponseWriter.WriteHeaderNow()
+}
+
+func (w *deadlineWriter) Write(b []byte) (int, error) {
+	w.setHeader()
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *deadlineWriter) WriteString(s string) (int, error) {
+	w.setHeader()
+	return w.ResponseWriter.WriteString(s)
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseGRPCTimeout(t *testing.T) {
+	for value, want := range map[string]time.Duration{
+		"1H":        time.Hour,
+		"250m":      250 * time.Millisecond,
+		"30S":       30 * time.Second,
+		"99999999n": 99999999 * time.Nanosecond,
+	} {
+		if got, ok := parseGRPCTimeout(value); !ok || got != want {
+			t.Errorf("parseGRPCTimeout(%q) = %s, %t; want %s", value, got, ok, want)
+		}
+	}
+	for _, value := range []string{"", "m", "5", "5x", "-5m", "123456789m"} {
+		if _, ok := parseGRPCTimeout(value); ok {
+			t.Errorf("Expected %q rejected", value)
+		}
+	}
+}
+
+func TestGatewayDeadline(t *testing.T) {
+	now := time.UnixMilli(1_700_000_000_000)
+	millis := func(d time.Duration) string { return strconv.FormatInt(now.Add(d).UnixMilli(), 10) }
+
+	for _, tt := range []struct {
+		name    string
+		headers map[string]string
+		want    time.Duration // from now, -1 for none
+		skew    time.Duration
+		ignored bool
+	}{
+		{"absent", nil, -1, 0, false},
+		{"deadline", map[string]string{requestDeadlineHeader: millis(2 * time.Second)}, 2 * time.Second, 0, false},
+		{"grpc timeout", map[string]string{grpcTimeoutHeader: "300m"}, 300 * time.Millisecond, 0, false},
+		{"earliest wins", map[string]string{requestDeadlineHeader: millis(2 * time.Second), grpcTimeoutHeader: "1S"}, time.Second, 0, false},
+		{"just passed", map[string]string{requestDeadlineHeader: millis(-time.Second)}, -time.Second, 0, false},
+		{"skewed", map[string]string{requestDeadlineHeader: millis(-time.Hour)}, -1, 0, true},
+		{"skewed with grpc timeout", map[string]string{requestDeadlineHeader: millis(-time.Hour), grpcTimeoutHeader: "1S"}, time.Second, 0, true},
+		{"malformed", map[string]string{requestDeadlineHeader: "soon", grpcTimeoutHeader: "1 second"}, -1, 0, false},
+		// X-Request-Start measures the time left on the gateway's clock
+		{"gateway behind", map[string]string{requestStartHeader: millis(-time.Hour), requestDeadlineHeader: millis(-time.Hour + 2*time.Second)}, 2 * time.Second, time.Hour, false},
+		{"gateway ahead", map[string]string{requestStartHeader: millis(time.Hour), requestDeadlineHeader: millis(time.Hour + 2*time.Second)}, 2 * time.Second, -time.Hour, false},
+		{"expired at the gateway", map[string]string{requestStartHeader: millis(-time.Hour), requestDeadlineHeader: millis(-time.Hour - time.Second)}, -time.Second, time.Hour, false},
+		{"malformed start", map[string]string{requestStartHeader: "earlier", requestDeadlineHeader: millis(-time.Hour)}, -1, 0, true},
+	} {
+		header := http.Header{}
+		for k, v := range tt.headers {
+			header.Set(k, v)
+		}
+		deadline, skew, ignored := gatewayDeadline(header, now, 5*time.Second)
+		if skew != tt.skew || ignored != tt.ignored {
+			t.Errorf("%s: expected skew %s and ignored %t, got %s and %t", tt.name, tt.skew, tt.ignored, skew, ignored)
+		}
+		if tt.want == -1 {
+			if !deadline.IsZero() {
+				t.Errorf("%s: expected no deadline, got %s", tt.name, deadline)
+			}
+		} else if got := deadline.Sub(now); got != tt.want {
+			t.Errorf("%s: expected the deadline in %s, got %s", tt.name, tt.want, got)
+		}
+	}
+}
+
+func TestRequestDeadline(t *testing.T) {
+	_, redisClient := newTestRedis(t)
+	cfg := testConfig()
+	cfg.DebugHeaders = true
+	cfg.RequestDeadlineSkew = 5 * time.Second
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	router := newTestServer(t, cfg, redisClient).Router()
+	deadline := func(d time.Duration) map[string]string {
+		return map[string]string{requestDeadlineHeader: strconv.FormatInt(time.Now().Add(d).UnixMilli(), 10)}
+	}
+	remaining := func(t *testing.T, headers http.Header) float64 {
+		t.Helper()
+		ms, err := strconv.ParseFloat(headers.Get(deadlineRemainingHeader), 64)
+		if err != nil {
+			t.Fatalf("Expected %s, got %q", deadlineRemainingHeader, headers.Get(deadlineRemainingHeader))
+		}
+		return ms
+	}
+
+	t.Run("expired", func(t *testing.T) {
+		w := doRequest(router, "GET", "/visit/expired", "", deadline(-time.Second))
+		if w.Code != http.StatusGatewayTimeout || !strings.Contains(w.Body.String(), "deadline_exceeded") {
+			t.Fatalf("Expected 504 deadline_exceeded, got %d %s", w.Code, w.Body.String())
+		}
+		if w := doRequest(router, "GET", "/visits/expired", "", nil); decodeVisit(t, w.Body.Bytes()).Visits != 0 {
+			t.Errorf("Expected the expired visit not counted")
+		}
+		if w := doRequest(router, "GET", "/health", "", map[string]string{grpcTimeoutHeader: "0m"}); w.Code != http.StatusGatewayTimeout {
+			t.Errorf("Expected a zero grpc-timeout rejected, got %d", w.Code)
+		}
+	})
+
+	t.Run("near", func(t *testing.T) {
+		w := doRequest(router, "GET", "/visit/near", "", deadline(500*time.Millisecond))
+		if ms := remaining(t, w.Header()); w.Code != http.StatusOK || ms <= 0 || ms > 500 {
+			t.Errorf("Expected the visit within its 500ms, got %d with %.2fms left", w.Code, ms)
+		}
+	})
+
+	t.Run("absent", func(t *testing.T) {
+		w := doRequest(router, "GET", "/visits/home", "", nil)
+		if w.Code != http.StatusOK || w.Header().Get(deadlineRemainingHeader) != "" {
+			t.Errorf("Expected no deadline, got %d %q", w.Code, w.Header().Get(deadlineRemainingHeader))
+		}
+	})
+
+	t.Run("skewed", func(t *testing.T) {
+		logs.Reset()
+		for i := 0; i < 3; i++ {
+			if w := doRequest(router, "GET", "/visits/home", "", deadline(-time.Hour)); w.Code != http.StatusOK || w.Header().Get(deadlineRemainingHeader) != "" {
+				t.Errorf("Expected the skewed deadline ignored, got %d", w.Code)
+			}
+		}
+		if n := strings.Count(logs.String(), "Ignoring X-Request-Deadline"); n != 1 {
+			t.Errorf("Expected one throttled warning, got %d: %q", n, logs.String())
+		}
+	})
+
+	t.Run("gateway clock behind", func(t *testing.T) {
+		// A new server, as the skewed warning above throttles this one's
+		router := newTestServer(t, cfg, redisClient).Router()
+		logs.Reset()
+		start := time.Now().Add(-time.Hour)
+		headers := map[string]string{
+			requestStartHeader:    strconv.FormatInt(start.UnixMilli(), 10),
+			requestDeadlineHeader: strconv.FormatInt(start.Add(500*time.Millisecond).UnixMilli(), 10),
+		}
+		w := doRequest(router, "GET", "/visit/behind", "", headers)
+		if ms := remaining(t, w.Header()); w.Code != http.StatusOK || ms <= 0 || ms > 500 {
+			t.Errorf("Expected the 500ms the gateway gave, got %d with %.2fms left", w.Code, ms)
+		}
+		if !strings.Contains(logs.String(), "The gateway's clock is 1h0m0s behind ours") {
+			t.Errorf("Expected the skew logged, got %q", logs.String())
+		}
+
+		// Expired by the gateway's clock, however far its clock is off
+		headers[requestDeadlineHeader] = strconv.FormatInt(start.Add(-time.Second).UnixMilli(), 10)
+		if w := doRequest(router, "GET", "/visit/behind", "", headers); w.Code != http.StatusGatewayTimeout {
+			t.Errorf("Expected 504 for a deadline passed at the gateway, got %d", w.Code)
+		}
+	})
+
+	t.Run("request timeout earlier", func(t *testing.T) {
+		cfg := cfg
+		cfg.RequestTimeout = 200 * time.Millisecond
+		router := newTestServer(t, cfg, redisClient).Router()
+		w := doRequest(router, "GET", "/visit/home", "", deadline(10*time.Second))
+		if ms := remaining(t, w.Header()); ms > 200 {
+			t.Errorf("Expected REQUEST_TIMEOUT to bound the deadline, got %.2fms left", ms)
+		}
+
+		// An ignored deadline falls back to REQUEST_TIMEOUT on every route
+		w = doRequest(router, "GET", "/health", "", deadline(-time.Hour))
+		if ms := remaining(t, w.Header()); w.Code != http.StatusOK || ms <= 0 || ms > 200 {
+			t.Errorf("Expected REQUEST_TIMEOUT in place of the skewed deadline, got %d with %.2fms left", w.Code, ms)
+		}
+	})
+}
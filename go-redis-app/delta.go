@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	resolutionHour = "hour"
+	resolutionDay  = "day"
+)
+
+// DeltaResponse reports the visits accumulated since a time
+type DeltaResponse struct {
+	Page  string    `json:"page"`
+	Since Timestamp `json:"since"`
+	// From and To are the window actually counted, since rounded down to
+	// the start of its bucket
+	From       Timestamp `json:"from"`
+	To         Timestamp `json:"to"`
+	Visits     int64     `json:"visits"`
+	Resolution string    `json:"resolution"`
+}
+
+// deltaFromDays sums the visits from since to now given the days from
+// since's UTC day through today, in any order. The first day is counted from
+// since's hour when its hour histogram is available (or it has no visits)
+// and whole otherwise;
+// later days use their daily bucket. It returns the window start and the
+// coarsest resolution used.
+func deltaFromDays(days []HeatmapDay, since time.Time) (int64, time.Time, string) {
+	since = since.UTC()
+	first := since.Truncate(24 * time.Hour)
+
+	var visits int64
+	from, resolution := first, resolutionDay
+	for _, day := range days {
+		switch {
+		case day.Date.After(first):
+			visits += day.Total
+			resolution = resolutionDay
+		case day.Date.Equal(first) && !since.Equal(first) && (len(day.Hours) > 0 || day.Total == 0):
+			for hour, count := range day.Hours {
+				if hour >= since.Hour() {
+					visits += count
+				}
+			}
+			from = since.Truncate(time.Hour)
+			if len(days) == 1 {
+				resolution = resolutionHour
+			}
+		case day.Date.Equal(first):
+			visits += day.Total
+		}
+	}
+	return visits, from, resolution
+}
+
+// earliestDelta returns the earliest since the delta endpoint accepts
+func (s *Server) earliestDelta(now time.Time) time.Time {
+	earliest := now.UTC().Truncate(24*time.Hour).AddDate(0, 0, -maxRangeDays)
+	if dailyCutoff, _ := s.cfg.Retention.cutoffs(now); dailyCutoff.After(earliest) {
+		earliest = dailyCutoff
+	}
+	return earliest
+}
+
+// handleGetDelta returns the visits accumulated since ?since=
+func (s *Server) handleGetDelta(c *gin.Context) {
+	page := c.Param("page")
+	now := s.clock.Now().UTC()
+	since, err := time.Parse(time.RFC3339, c.Query("since"))
+	if err != nil || since.After(now) {
+		respondError(c, http.StatusBadRequest, "invalid_request", "since must be an RFC3339 time that is not in the future")
+		return
+	}
+	if earliest := s.earliestDelta(now); since.Before(earliest) {
+		respondError(c, http.StatusBadRequest, "out_of_retention",
+			fmt.Sprintf("since is before the earliest available data at %s", earliest.Format(time.RFC3339)))
+		return
+	}
+
+	hidden, err := s.pageHidden(c, page)
+	if err != nil {
+		log.Printf("Error getting page metadata: %v", err)
+		respondStoreError(c, err, "Failed to get visit delta")
+		return
+	}
+	if hidden {
+		respondError(c, http.StatusNotFound, "not_found", "Page not found")
+		return
+	}
+
+	n := int(now.Truncate(24*time.Hour).Sub(since.UTC().Truncate(24*time.Hour))/(24*time.Hour)) + 1
+	days, err := s.redis.HeatmapDays(c.Request.Context(), page, now, n)
+	if err != nil {
+		log.Printf("Error getting visit delta: %v", err)
+		respondStoreError(c, err, "Failed to get visit delta")
+		return
+	}
+	visits, from, resolution := deltaFromDays(days, since)
+
+	respondJSON(c, http.StatusOK, DeltaResponse{
+		Page:       page,
+		Since:      stamp(c, since),
+		From:       stamp(c, from),
+		To:         stamp(c, now),
+		Visits:     visits,
+		Resolution: resolution,
+	})
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"go-redis-app/internal/clocktest"
+)
+
+func TestDeltaFromDays(t *testing.T) {
+	d1 := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	d2 := d1.AddDate(0, 0, 1)
+	d3 := d1.AddDate(0, 0, 2)
+	first := HeatmapDay{Date: d1, Hours: map[int]int64{9: 1, 10: 2, 11: 3}, Total: 6}
+
+	// Same day: only hours from since's hour on
+	visits, from, resolution := deltaFromDays([]HeatmapDay{first}, d1.Add(10*time.Hour+30*time.Minute))
+	if visits != 5 || !from.Equal(d1.Add(10*time.Hour)) || resolution != resolutionHour {
+		t.Errorf("Same day: got %d, %s, %s", visits, from, resolution)
+	}
+
+	// Multi-day: partial first day plus daily buckets
+	days := []HeatmapDay{{Date: d3, Total: 7}, {Date: d2, Total: 4}, first}
+	visits, from, resolution = deltaFromDays(days, d1.Add(11*time.Hour))
+	if visits != 14 || !from.Equal(d1.Add(11*time.Hour)) || resolution != resolutionDay {
+		t.Errorf("Multi-day: got %d, %s, %s", visits, from, resolution)
+	}
+
+	// Midnight uses the whole daily bucket
+	visits, from, _ = deltaFromDays(days, d1)
+	if visits != 17 || !from.Equal(d1) {
+		t.Errorf("Midnight: got %d, %s", visits, from)
+	}
+
+	// Without an hour histogram the first day is counted whole
+	noHours := []HeatmapDay{{Date: d1, Hours: map[int]int64{}, Total: 6}}
+	visits, from, resolution = deltaFromDays(noHours, d1.Add(20*time.Hour))
+	if visits != 6 || !from.Equal(d1) || resolution != resolutionDay {
+		t.Errorf("No hours: got %d, %s, %s", visits, from, resolution)
+	}
+}
+
+func getDelta(t *testing.T, h http.Handler, page string, since time.Time) (int, DeltaResponse, string) {
+	t.Helper()
+	w := doRequest(h, "GET", "/visits/"+page+"/delta?since="+url.QueryEscape(since.Format(time.RFC3339)), "", nil)
+	var resp DeltaResponse
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	return w.Code, resp, w.Body.String()
+}
+
+func TestDeltaEndpoint(t *testing.T) {
+	ctx := context.Background()
+	_, redisClient := newTestRedis(t)
+	cfg := testConfig()
+	cfg.Retention = RetentionPolicy{DailyDays: 30}
+	now := time.Date(2024, 5, 1, 9, 15, 0, 0, time.UTC)
+	server := newTestServerWithClock(t, cfg, redisClient, clocktest.New(now))
+	server.flags.Set(ctx, map[string]bool{"rollups": true})
+	router := server.Router()
+
+	today := now.Truncate(24 * time.Hour)
+	yesterday := today.AddDate(0, 0, -1)
+	redisClient.client.Set(ctx, dailyKey("home", yesterday), 10, 0)
+	redisClient.client.HSet(ctx, hourlyKey("home", yesterday), "6", 4, "18", 6)
+
+	doRequest(router, "GET", "/visit/home", "", nil)
+	doRequest(router, "GET", "/visit/home", "", nil)
+
+	// Same day
+	code, resp, body := getDelta(t, router, "home", now.Truncate(time.Hour))
+	if code != http.StatusOK || resp.Visits != 2 || resp.Resolution != resolutionHour {
+		t.Errorf("Same day: unexpected response %d: %s", code, body)
+	}
+
+	// Multi-day: yesterday's 18:00 hour plus today's bucket
+	code, resp, body = getDelta(t, router, "home", yesterday.Add(12*time.Hour))
+	if code != http.StatusOK || resp.Visits != 8 || resp.Resolution != resolutionDay ||
+		!resp.From.Time.Equal(yesterday.Add(12*time.Hour)) {
+		t.Errorf("Multi-day: unexpected response %d: %s", code, body)
+	}
+
+	// Out of retention
+	code, _, body = getDelta(t, router, "home", today.AddDate(0, 0, -60))
+	earliest := today.AddDate(0, 0, -30).Format(time.RFC3339)
+	if code != http.StatusBadRequest || !strings.Contains(body, "out_of_retention") || !strings.Contains(body, earliest) {
+		t.Errorf("Out of retention: expected 400 naming %s, got %d: %s", earliest, code, body)
+	}
+
+	for _, query := range []string{"", "?since=yesterday", "?since=" + url.QueryEscape(now.Add(time.Hour).Format(time.RFC3339))} {
+		if w := doRequest(router, "GET", "/visits/home/delta"+query, "", nil); w.Code != http.StatusBadRequest {
+			t.Errorf("Expected 400 for %q, got %d", query, w.Code)
+		}
+	}
+}
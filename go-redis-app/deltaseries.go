@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// historyEncodingDelta is the ?encoding= sending daily history as a
+// DeltaSeries instead of one point or row per day
+const historyEncodingDelta = "delta"
+
+// DeltaSeries is a run of consecutive daily counts as the value of its
+// first day and the day-over-day deltas after it. A run of days with
+// unchanged counts is a 0 followed by the number of days in the run, so a
+// page with one spike in a year of zeros takes a handful of numbers.
+type DeltaSeries struct {
+	Page       string  `json:"page,omitempty"`
+	Start      string  `json:"start"`
+	StartValue int64   `json:"start_value"`
+	Deltas     []int64 `json:"deltas"`
+}
+
+// NewDeltaSeries encodes the daily counts of a page from start, which has
+// values[0]
+func NewDeltaSeries(page string, start time.Time, values []int64) DeltaSeries {
+	series := DeltaSeries{Page: page, Start: start.Format(dayLayout), Deltas: []int64{}}
+	if len(values) == 0 {
+		return series
+	}
+	series.StartValue = values[0]
+	var zeros int64
+	for i := 1; i < len(values); i++ {
+		delta := values[i] - values[i-1]
+		if delta == 0 {
+			zeros++
+			continue
+		}
+		if zeros > 0 {
+			series.Deltas = append(series.Deltas, 0, zeros)
+			zeros = 0
+		}
+		series.Deltas = append(series.Deltas, delta)
+	}
+	if zeros > 0 {
+		series.Deltas = append(series.Deltas, 0, zeros)
+	}
+	return series
+}
+
+// DecodeDeltas is the reference decoder of DeltaSeries.Deltas: it returns
+// the daily counts from startValue, the first day's, onwards. Clients
+// decode the same way: keep a running value, append it for the first day,
+// then for each delta d append value += d, except that a 0 is followed by a
+// count n and appends the value n times.
+func DecodeDeltas(startValue int64, deltas []int64) ([]int64, error) {
+	values := []int64{startValue}
+	value := startValue
+	for i := 0; i < len(deltas); i++ {
+		if deltas[i] != 0 {
+			value += deltas[i]
+			values = append(values, value)
+			continue
+		}
+		if i++; i == len(deltas) || deltas[i] < 1 || deltas[i] > maxRangeDays {
+			return nil, fmt.Errorf("a 0 delta must be followed by a run length from 1 to %d", maxRangeDays)
+		}
+		for n := deltas[i]; n > 0; n-- {
+			values = append(values, value)
+		}
+	}
+	return values, nil
+}
+
+// denseDays returns the counts of each day from from to to in rows, one
+// page's rows in date order, zero for days without a row
+func denseDays(rows []HistoryRow, from, to time.Time) []int64 {
+	values := make([]int64, int(to.Sub(from)/(24*time.Hour))+1)
+	for _, row := range rows {
+		if d, err := time.Parse(dayLayout, row.Date); err == nil {
+			if i := int(d.Sub(from) / (24 * time.Hour)); i >= 0 && i < len(values) {
+				values[i] = row.Visits
+			}
+		}
+	}
+	return values
+}
+
+// historyEncoding reads ?encoding=, responding 400 unless it is empty or
+// delta; delta reports whether the delta encoding was asked for
+func historyEncoding(c *gin.Context) (delta, ok bool) {
+	switch encoding := c.Query("encoding"); encoding {
+	case "":
+		return false, true
+	case historyEncodingDelta:
+		return true, true
+	default:
+		respondError(c, http.StatusBadRequest, "invalid_request", fmt.Sprintf("encoding must be %q, got %q", historyEncodingDelta, encoding))
+		return false, false
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDeltaSeriesGolden(t *testing.T) {
+	spike := make([]int64, 365)
+	spike[200] = 40
+	tests := []struct {
+		name   string
+		values []int64
+		start  int64
+		deltas []int64
+	}{
+		{"single day", []int64{7}, 7, []int64{}},
+		{"all zero", make([]int64, 365), 0, []int64{0, 364}},
+		{"single spike", spike, 0, []int64{0, 199, 40, -40, 0, 163}},
+		{"spike on the first day", []int64{9, 0, 0, 0}, 9, []int64{-9, 0, 2}},
+		{"spike on the last day", []int64{0, 0, 0, 5}, 0, []int64{0, 2, 5}},
+		{"steady traffic", []int64{3, 3, 3, 3}, 3, []int64{0, 3}},
+		{"every day changing", []int64{1, 4, 2, 8}, 1, []int64{3, -2, 6}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			series := NewDeltaSeries("home", time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), tt.values)
+			if series.Start != "2024-01-01" || series.StartValue != tt.start || !reflect.DeepEqual(series.Deltas, tt.deltas) {
+				t.Errorf("Expected %d %v, got %+v", tt.start, tt.deltas, series)
+			}
+			decoded, err := DecodeDeltas(series.StartValue, series.Deltas)
+			if err != nil || !reflect.DeepEqual(decoded, tt.values) {
+				t.Errorf("Expected the series decoded back, got %v, %v", decoded, err)
+			}
+		})
+	}
+}
+
+func TestDecodeDeltasRejectsBadRuns(t *testing.T) {
+	for _, deltas := range [][]int64{{0}, {3, 0}, {0, 0}, {0, -2}, {0, maxRangeDays + 1}} {
+		if _, err := DecodeDeltas(1, deltas); err == nil {
+			t.Errorf("Expected %v rejected", deltas)
+		}
+	}
+}
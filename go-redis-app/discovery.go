@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+)
+
+// Service discovery modes, as set by SERVICE_DISCOVERY
+const (
+	discoveryNone    = "none"
+	discoveryCompose = "compose"
+)
+
+// serviceLookupTimeout bounds the startup DNS lookups of the dependencies
+const serviceLookupTimeout = 5 * time.Second
+
+// composeService is a dependency under its conventional compose service
+// name, which is also its host name on the compose network
+type composeService struct {
+	Name string
+	Port string
+}
+
+// Addr returns the service's default address
+func (s composeService) Addr() string {
+	return net.JoinHostPort(s.Name, s.Port)
+}
+
+var (
+	composeRedis = composeService{Name: "redis", Port: "6379"}
+	composeKafka = composeService{Name: "kafka", Port: "9092"}
+)
+
+// applyComposeDefaults points the dependencies not configured explicitly at
+// their compose services. Set variables always win, even when they name
+// another host.
+func applyComposeDefaults(cfg *Config) {
+	if os.Getenv("REDIS_HOST") == "" {
+		cfg.RedisHost = composeRedis.Name
+	}
+	if os.Getenv("REDIS_PORT") == "" {
+		cfg.RedisPort = composeRedis.Port
+	}
+	if len(cfg.KafkaBrokers) == 0 {
+		cfg.KafkaBrokers = []string{composeKafka.Addr()}
+	}
+}
+
+// hostResolver looks up host names; *net.Resolver implements it
+type hostResolver interface {
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+// serviceHost is an enabled dependency's host and the variable setting it
+type serviceHost struct {
+	Service string
+	Env     string
+	Host    string
+}
+
+// serviceHosts lists the hosts of the enabled dependencies: Redis, and the
+// Kafka brokers with the kafka sink
+func serviceHosts(cfg Config) []serviceHost {
+	hosts := []serviceHost{{Service: composeRedis.Name, Env: "REDIS_HOST", Host: cfg.RedisHost}}
+	if containsString(cfg.EventSinks, sinkKafka) {
+		for _, broker := range cfg.KafkaBrokers {
+			host, _, err := net.SplitHostPort(broker)
+			if err != nil {
+				host = broker
+			}
+			hosts = append(hosts, serviceHost{Service: composeKafka.Name, Env: "KAFKA_BROKERS", Host: host})
+		}
+	}
+	return hosts
+}
+
+// verifyServices checks that every enabled dependency resolves with
+// SERVICE_DISCOVERY=compose, so a stopped compose service is reported by
+// name at startup rather than as connection errors later. Every failure is
+// reported, not just the first.
+func verifyServices(ctx context.Context, cfg Config, resolver hostResolver) error {
+	if cfg.ServiceDiscovery != discoveryCompose {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, serviceLookupTimeout)
+	defer cancel()
+
+	var errs []error
+	for _, dep := range serviceHosts(cfg) {
+		if net.ParseIP(dep.Host) != nil {
+			continue
+		}
+		if _, err := resolver.LookupHost(ctx, dep.Host); err != nil {
+			errs = append(errs, fmt.Errorf("service '%s' not resolvable — is the compose service running? (%s=%s: %w)", dep.Service, dep.Env, dep.Host, err))
+		}
+	}
+	return errors.Join(errs...)
+}
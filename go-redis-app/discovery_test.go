@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// stubResolver resolves the host names it holds and no others
+type stubResolver map[string]string
+
+func (r stubResolver) LookupHost(_ context.Context, host string) ([]string, error) {
+	if addr, ok := r[host]; ok {
+		return []string{addr}, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+func TestComposeDefaults(t *testing.T) {
+	for _, key := range []string{"REDIS_HOST", "REDIS_PORT", "KAFKA_BROKERS", "EVENT_SINKS", "ENV_NAME"} {
+		t.Setenv(key, "")
+	}
+	t.Setenv("SERVICE_DISCOVERY", discoveryCompose)
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+	if cfg.RedisHost != "redis" || cfg.RedisPort != "6379" || !reflect.DeepEqual(cfg.KafkaBrokers, []string{"kafka:9092"}) {
+		t.Errorf("Expected the compose addresses, got %s:%s and %v", cfg.RedisHost, cfg.RedisPort, cfg.KafkaBrokers)
+	}
+
+	// Explicit variables win
+	t.Setenv("REDIS_HOST", "cache.internal")
+	t.Setenv("REDIS_PORT", "6380")
+	t.Setenv("KAFKA_BROKERS", "broker-1:9093")
+	if cfg, _ = LoadConfig(); cfg.RedisHost != "cache.internal" || cfg.RedisPort != "6380" || !reflect.DeepEqual(cfg.KafkaBrokers, []string{"broker-1:9093"}) {
+		t.Errorf("Expected the set addresses kept, got %s:%s and %v", cfg.RedisHost, cfg.RedisPort, cfg.KafkaBrokers)
+	}
+
+	// Without discovery the local defaults apply
+	t.Setenv("SERVICE_DISCOVERY", "")
+	t.Setenv("REDIS_HOST", "")
+	t.Setenv("KAFKA_BROKERS", "")
+	if cfg, _ = LoadConfig(); cfg.RedisHost != "localhost" || len(cfg.KafkaBrokers) != 0 {
+		t.Errorf("Expected no compose defaults, got %s and %v", cfg.RedisHost, cfg.KafkaBrokers)
+	}
+}
+
+func TestVerifyServices(t *testing.T) {
+	compose := Config{
+		ServiceDiscovery: discoveryCompose,
+		RedisHost:        "redis",
+		KafkaBrokers:     []string{"kafka:9092"},
+		EventSinks:       []string{sinkKafka},
+	}
+	all := stubResolver{"redis": "172.18.0.2", "kafka": "172.18.0.3"}
+
+	for _, tt := range []struct {
+		name     string
+		cfg      func(Config) Config
+		resolver stubResolver
+		missing  []string // services expected in the error
+	}{
+		{"all resolve", nil, all, nil},
+		{"redis missing", nil, stubResolver{"kafka": "172.18.0.3"}, []string{"'redis'"}},
+		{"kafka missing", nil, stubResolver{"redis": "172.18.0.2"}, []string{"'kafka'"}},
+		{"both missing", nil, stubResolver{}, []string{"'redis'", "'kafka'"}},
+		{"kafka sink off", func(c Config) Config { c.EventSinks = nil; return c }, stubResolver{"redis": "172.18.0.2"}, nil},
+		{"override missing", func(c Config) Config { c.RedisHost = "cache.internal"; return c }, all, []string{"REDIS_HOST=cache.internal"}},
+		{"ip address", func(c Config) Config { c.RedisHost = "10.0.0.5"; return c }, stubResolver{"kafka": "172.18.0.3"}, nil},
+		{"discovery off", func(c Config) Config { c.ServiceDiscovery = discoveryNone; return c }, stubResolver{}, nil},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := compose
+			if tt.cfg != nil {
+				cfg = tt.cfg(cfg)
+			}
+			err := verifyServices(context.Background(), cfg, tt.resolver)
+			if len(tt.missing) == 0 {
+				if err != nil {
+					t.Fatalf("Expected no error, got %v", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("Expected %v reported", tt.missing)
+			}
+			for _, want := range tt.missing {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("Expected %s in %q", want, err)
+				}
+			}
+			if !strings.Contains(err.Error(), "is the compose service running?") {
+				t.Errorf("Expected a remediation hint, got %q", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// counterBuckets are the upper bounds of the counter value histogram, one
+// per order of magnitude
+var counterBuckets = []int64{10, 100, 1_000, 10_000, 100_000, 1_000_000, 10_000_000, 100_000_000, 1_000_000_000}
+
+// counterBucket returns the index of the histogram bucket a counter value
+// falls in, len(counterBuckets) for values above the last bound
+func counterBucket(value int64) int {
+	for i, le := range counterBuckets {
+		if value <= le {
+			return i
+		}
+	}
+	return len(counterBuckets)
+}
+
+// CounterSample is one sampling run over the page counters
+type CounterSample struct {
+	// Values are the counters found
+	Values []int64
+
+	// Scanned is the run's SCAN budget spent: each SCAN is charged its
+	// COUNT, or the keys it returned when more
+	Scanned int
+
+	// Cursor and Skip are where the next run resumes: the SCAN cursor and
+	// how many of the keys it returns were already sampled
+	Cursor uint64
+	Skip   int
+
+	// Wrapped is set when the run reached the end of the keyspace
+	Wrapped bool
+}
+
+// SampleCounters reads the page counters of the next stretch of the
+// keyspace, resuming at cursor and spending at most maxKeys of SCAN budget.
+// The keyspace is walked in SCAN's hash order, so a run's counters are a
+// sample of pages unrelated to their names; a run stops at the end of the
+// keyspace, so each one sees a counter at most once.
+func (r *RedisClient) SampleCounters(ctx context.Context, cursor uint64, skip, maxKeys int) (CounterSample, error) {
+	sample := CounterSample{Cursor: cursor, Skip: skip}
+	var counters []string
+	for sample.Scanned < maxKeys {
+		count := min(backfillBatchSize, maxKeys-sample.Scanned)
+		keys, next, err := r.client.ScanType(ctx, sample.Cursor, "visits:*", int64(count), "string").Result()
+		if err != nil {
+			return CounterSample{}, err
+		}
+		keys = keys[min(sample.Skip, len(keys)):]
+		if room := maxKeys - sample.Scanned; len(keys) > room {
+			// Finish this batch in the next run
+			sample.Scanned = maxKeys
+			sample.Skip += room
+			keys = keys[:room]
+		} else {
+			sample.Scanned += max(count, len(keys))
+			sample.Cursor, sample.Skip = next, 0
+		}
+		for _, k := range keys {
+			if _, ok := counterPage(k); ok {
+				counters = append(counters, k)
+			}
+		}
+		if sample.Cursor == 0 && sample.Skip == 0 {
+			sample.Wrapped = true
+			break
+		}
+	}
+	if len(counters) == 0 {
+		return sample, nil
+	}
+
+	cmds := make([]*redis.StringCmd, len(counters))
+	_, err := r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, k := range counters {
+			cmds[i] = pipe.Get(ctx, k)
+		}
+		return nil
+	})
+	if ignoreMissing(err) != nil {
+		return CounterSample{}, err
+	}
+	for _, cmd := range cmds {
+		// Not a number, or deleted since the SCAN
+		if v, err := cmd.Int64(); err == nil {
+			sample.Values = append(sample.Values, v)
+		}
+	}
+	return sample, nil
+}
+
+// counterSampler walks the page counters a bounded stretch at a time,
+// keeping the histogram of the last run and the totals of the last complete
+// pass over the keyspace
+type counterSampler struct {
+	maxKeys int
+
+	mu     sync.Mutex
+	cursor uint64
+	skip   int
+
+	// buckets counts the last run's values per bucket, not cumulatively,
+	// with the values above the last bound at the end
+	buckets []int64
+	sum     int64
+	count   int64
+
+	// passPages and passVisits accumulate over the pass in progress
+	passPages  int64
+	passVisits int64
+
+	// pages and visits are the last complete pass's totals; passes counts
+	// the complete passes
+	pages  int64
+	visits int64
+	passes int64
+}
+
+func newCounterSampler(maxKeys int) *counterSampler {
+	return &counterSampler{maxKeys: maxKeys, buckets: make([]int64, len(counterBuckets)+1)}
+}
+
+// run samples the next stretch of counters
+func (cs *counterSampler) run(ctx context.Context, r *RedisClient) error {
+	cs.mu.Lock()
+	cursor, skip := cs.cursor, cs.skip
+	cs.mu.Unlock()
+
+	sample, err := r.SampleCounters(ctx, cursor, skip, cs.maxKeys)
+	if err != nil {
+		return err
+	}
+	cs.record(sample)
+	return nil
+}
+
+// record replaces the histogram with a run's sample and adds it to the pass
+func (cs *counterSampler) record(sample CounterSample) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.cursor, cs.skip = sample.Cursor, sample.Skip
+	cs.buckets = make([]int64, len(counterBuckets)+1)
+	cs.sum, cs.count = 0, int64(len(sample.Values))
+	for _, v := range sample.Values {
+		cs.buckets[counterBucket(v)]++
+		cs.sum += v
+	}
+	cs.passPages += cs.count
+	cs.passVisits += cs.sum
+	if sample.Wrapped {
+		cs.pages, cs.visits = cs.passPages, cs.passVisits
+		cs.passPages, cs.passVisits = 0, 0
+		cs.passes++
+	}
+}
+
+// write writes the page_counter_visits histogram and, once a pass has
+// completed, the counted_pages and counted_visits gauges
+func (cs *counterSampler) write(b *strings.Builder, env string) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	// series formats a series name with the environment and labels
+	series := func(name, labels string) string {
+		if env != "" {
+			labels = strings.TrimSuffix("env="+strconv.Quote(env)+","+labels, ",")
+		}
+		if labels == "" {
+			return name
+		}
+		return name + "{" + labels + "}"
+	}
+
+	b.WriteString("# HELP page_counter_visits Visit counts of the page counters sampled by the last run.\n")
+	b.WriteString("# TYPE page_counter_visits histogram\n")
+	var cumulative int64
+	for i, le := range counterBuckets {
+		cumulative += cs.buckets[i]
+		fmt.Fprintf(b, "%s %d\n", series("page_counter_visits_bucket", "le="+strconv.Quote(strconv.FormatInt(le, 10))), cumulative)
+	}
+	fmt.Fprintf(b, "%s %d\n", series("page_counter_visits_bucket", `le="+Inf"`), cs.count)
+	fmt.Fprintf(b, "%s %d\n", series("page_counter_visits_sum", ""), cs.sum)
+	fmt.Fprintf(b, "%s %d\n", series("page_counter_visits_count", ""), cs.count)
+
+	if cs.passes == 0 {
+		return
+	}
+	for _, gauge := range []struct {
+		name, help string
+		value      int64
+	}{
+		{"counted_pages", "Page counters found by the last complete sampling pass", cs.pages},
+		{"counted_visits", "Visits on the page counters of the last complete sampling pass", cs.visits},
+	} {
+		fmt.Fprintf(b, "# HELP %s %s.\n", gauge.name, gauge.help)
+		fmt.Fprintf(b, "# TYPE %s gauge\n", gauge.name)
+		fmt.Fprintf(b, "%s %d\n", series(gauge.name, ""), gauge.value)
+	}
+}
+
+// sampleCounters is the counter sampling worker
+func (s *Server) sampleCounters(ctx context.Context) error {
+	return s.sampler.run(ctx, s.redis)
+}
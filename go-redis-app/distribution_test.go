@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// scanCounter adds up the COUNT of every SCAN
+type scanCounter struct {
+	mu     sync.Mutex
+	counts int64
+}
+
+func (s *scanCounter) DialHook(next redis.DialHook) redis.DialHook { return next }
+
+func (s *scanCounter) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		if args := cmd.Args(); cmd.Name() == "scan" {
+			for i := range args[:len(args)-1] {
+				if args[i] == "count" {
+					s.mu.Lock()
+					s.counts += args[i+1].(int64)
+					s.mu.Unlock()
+				}
+			}
+		}
+		return next(ctx, cmd)
+	}
+}
+
+func (s *scanCounter) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return next
+}
+
+// take returns the COUNTs added up since the last call
+func (s *scanCounter) take() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	counts := s.counts
+	s.counts = 0
+	return counts
+}
+
+func TestCounterBucket(t *testing.T) {
+	tests := map[int64]int{0: 0, 1: 0, 10: 0, 11: 1, 100: 1, 101: 2, 999_999: 5, 1_000_000: 5, 1_000_000_000: 8, 1_000_000_001: 9}
+	for value, want := range tests {
+		if got := counterBucket(value); got != want {
+			t.Errorf("counterBucket(%d) = %d, want %d", value, got, want)
+		}
+	}
+}
+
+func TestCounterHistogram(t *testing.T) {
+	sampler := newCounterSampler(100)
+	sampler.record(CounterSample{Values: []int64{1, 5, 10, 50, 5_000, 2_000_000_000}, Wrapped: true})
+	var b strings.Builder
+	sampler.write(&b, "prod")
+	metrics := b.String()
+	for _, series := range []string{
+		`page_counter_visits_bucket{env="prod",le="10"} 3`,
+		`page_counter_visits_bucket{env="prod",le="100"} 4`,
+		`page_counter_visits_bucket{env="prod",le="1000"} 4`,
+		`page_counter_visits_bucket{env="prod",le="10000"} 5`,
+		`page_counter_visits_bucket{env="prod",le="1000000000"} 5`,
+		`page_counter_visits_bucket{env="prod",le="+Inf"} 6`,
+		`page_counter_visits_sum{env="prod"} 2000005066`,
+		`page_counter_visits_count{env="prod"} 6`,
+		`counted_pages{env="prod"} 6`,
+		`counted_visits{env="prod"} 2000005066`,
+	} {
+		if !strings.Contains(metrics, series+"\n") {
+			t.Errorf("Expected %s in:\n%s", series, metrics)
+		}
+	}
+}
+
+func TestSampleCountersCap(t *testing.T) {
+	mr, redisClient := newTestRedis(t)
+	scans := &scanCounter{}
+	redisClient.client.AddHook(scans)
+	for i := 0; i < 250; i++ {
+		mr.Set(key("visits", fmt.Sprintf("page-%03d", i)), fmt.Sprint(i+1))
+	}
+	// Not counters: a session count, another type, a daily bucket
+	mr.Set(sessionsKey("page-000"), "1")
+	mr.HSet(geoKey("page-000"), "US", "1")
+	mr.Set(dailyKey("page-000", time.Date(2024, 1, 15, 0, 0, 0, 0, time.UTC)), "1")
+
+	const maxKeys = 40
+	sampler := newCounterSampler(maxKeys)
+	seen := 0
+	for run := 1; ; run++ {
+		if run > 20 {
+			t.Fatal("Expected the pass to finish within 20 runs")
+		}
+		if err := sampler.run(context.Background(), redisClient); err != nil {
+			t.Fatal(err)
+		}
+		if counts := scans.take(); counts == 0 || counts > maxKeys {
+			t.Fatalf("Run %d: expected SCANs of at most %d keys in all, got %d", run, maxKeys, counts)
+		}
+		sampler.mu.Lock()
+		count, passes := sampler.count, sampler.passes
+		sampler.mu.Unlock()
+		if count > maxKeys {
+			t.Fatalf("Run %d: expected at most %d counters sampled, got %d", run, maxKeys, count)
+		}
+		seen += int(count)
+		if passes == 1 {
+			break
+		}
+	}
+
+	sampler.mu.Lock()
+	defer sampler.mu.Unlock()
+	if seen != 250 || sampler.pages != 250 || sampler.visits != 250*251/2 {
+		t.Errorf("Expected one pass over the 250 counters, saw %d; totals %d pages, %d visits", seen, sampler.pages, sampler.visits)
+	}
+}
@@ -0,0 +1,399 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+// Outcomes of an EchoDecision
+const (
+	echoPass       = "pass"
+	echoOff        = "off"
+	echoResolved   = "resolved"
+	echoReject     = "reject"
+	echoDrop       = "drop"
+	echoShadowDrop = "shadow_drop"
+	echoJournal    = "journal"
+)
+
+// EchoVisitRequest is the body of POST /debug/echo-visit: the visit to
+// explain, as the URL it would be sent to, its headers and the client IP,
+// which defaults to the caller's
+type EchoVisitRequest struct {
+	URL      string            `json:"url"`
+	Headers  map[string]string `json:"headers"`
+	ClientIP string            `json:"client_ip"`
+}
+
+// EchoDecision is one step of processing a visit: what it decided, and in
+// which mode for the features that have one
+type EchoDecision struct {
+	Step    string      `json:"step"`
+	Mode    FeatureMode `json:"mode,omitempty"`
+	Outcome string      `json:"outcome"`
+	Detail  string      `json:"detail,omitempty"`
+}
+
+// EchoCommand is a write the visit would have sent and the keys it names
+type EchoCommand struct {
+	Command string   `json:"command"`
+	Keys    []string `json:"keys,omitempty"`
+}
+
+// EchoVisitResponse represents the POST /debug/echo-visit API response.
+// Status is what GET /visit would answer; DroppedBy names the step that
+// left the visit uncounted. Keys are the sorted keys of Commands, before
+// KEY_PREFIX.
+type EchoVisitResponse struct {
+	Status       int            `json:"status"`
+	Page         string         `json:"page,omitempty"`
+	ResolvedFrom string         `json:"resolved_from,omitempty"`
+	Counted      bool           `json:"counted"`
+	DroppedBy    string         `json:"dropped_by,omitempty"`
+	Visitor      string         `json:"visitor,omitempty"`
+	Country      string         `json:"country,omitempty"`
+	Variant      string         `json:"variant,omitempty"`
+	Weight       int64          `json:"weight,omitempty"`
+	Decisions    []EchoDecision `json:"decisions"`
+	Keys         []string       `json:"keys"`
+	Commands     []EchoCommand  `json:"commands"`
+}
+
+// decide records a step's outcome
+func (e *EchoVisitResponse) decide(step string, mode FeatureMode, outcome, detail string) {
+	e.Decisions = append(e.Decisions, EchoDecision{Step: step, Mode: mode, Outcome: outcome, Detail: detail})
+}
+
+// reject records the step the visit would be answered status at
+func (e *EchoVisitResponse) reject(step string, status int, detail string) EchoVisitResponse {
+	e.Status = status
+	e.decide(step, "", echoReject, detail)
+	return *e
+}
+
+// drop records the step that would leave the visit uncounted
+func (e *EchoVisitResponse) drop(step string, mode FeatureMode, detail string) EchoVisitResponse {
+	e.DroppedBy = step
+	e.decide(step, mode, echoDrop, detail)
+	return *e
+}
+
+// handleEchoVisit explains how the described visit would be processed
+func (s *Server) handleEchoVisit(c *gin.Context) {
+	var req EchoVisitRequest
+	if err := c.ShouldBindJSON(&req); err != nil || req.URL == "" {
+		respondError(c, http.StatusBadRequest, "invalid_request", "Body must be an object with the url of a visit, such as /visit/home")
+		return
+	}
+	visit, err := http.NewRequestWithContext(c.Request.Context(), http.MethodGet, req.URL, nil)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, "invalid_request", fmt.Sprintf("Invalid url: %v", err))
+		return
+	}
+	for name, value := range req.Headers {
+		visit.Header.Set(name, value)
+	}
+	ip := req.ClientIP
+	if ip == "" {
+		ip = c.ClientIP()
+	} else if net.ParseIP(ip) == nil {
+		respondError(c, http.StatusBadRequest, "invalid_request", fmt.Sprintf("Invalid client_ip %q", ip))
+		return
+	}
+	echo, err := s.explainVisit(visit, ip)
+	if err != nil {
+		log.Printf("Error explaining visit: %v", err)
+		respondStoreError(c, err, "Failed to explain visit")
+		return
+	}
+	respondJSON(c, http.StatusOK, echo)
+}
+
+// explainVisit runs the checks GET /visit applies to r, in the order
+// recordVisit does, reading what they need but writing nothing. The writes
+// of a counted visit are sent to a dry-run client, which records them.
+// Load shedding and quotas depend on the moment and are not evaluated.
+func (s *Server) explainVisit(r *http.Request, ip string) (EchoVisitResponse, error) {
+	ctx := r.Context()
+	e := EchoVisitResponse{Status: http.StatusOK, Decisions: []EchoDecision{}, Keys: []string{}, Commands: []EchoCommand{}}
+
+	page, ok := strings.CutPrefix(r.URL.Path, "/visit/")
+	if !ok || strings.Contains(page, "/") {
+		return e.reject("route", http.StatusNotFound, fmt.Sprintf("%s is not GET /visit/:page", r.URL.Path)), nil
+	}
+	if page == "" {
+		page = "home"
+	}
+	e.Page = page
+	e.decide("route", "", echoPass, "GET /visit/:page")
+
+	if target, aliased := s.aliases.Resolve(page); aliased {
+		e.Page, e.ResolvedFrom, page = target, page, target
+		e.decide("alias", "", echoResolved, fmt.Sprintf("%s is an alias of %s", e.ResolvedFrom, target))
+	} else {
+		e.decide("alias", "", echoPass, "not an alias")
+	}
+
+	archived, err := s.redis.client.HExists(ctx, archivedPagesKey, page).Result()
+	if err != nil {
+		return e, err
+	}
+	if archived {
+		return e.reject("archived", http.StatusGone, fmt.Sprintf("page %q is archived", page)), nil
+	}
+	e.decide("archived", "", echoPass, "")
+
+	query := r.URL.Query()
+	value, err := parseVisitWeight(query.Get("weight"))
+	if err != nil {
+		return e.reject("weight", http.StatusBadRequest, err.Error()), nil
+	}
+	if value > 0 && s.isApproximatePage(page) {
+		return e.reject("weight", http.StatusBadRequest, "weight is not supported on approximate pages"), nil
+	}
+	e.decide("weight", "", echoPass, "")
+
+	if variant := query.Get("variant"); variant != "" {
+		meta, err := s.meta.GetMeta(ctx, page)
+		if err != nil {
+			return e, err
+		}
+		switch {
+		case registeredVariant(meta, variant):
+			e.Variant = variant
+			e.decide("variant", "", echoPass, "registered")
+		case s.cfg.StrictVariants:
+			return e.reject("variant", http.StatusBadRequest, fmt.Sprintf("variant %q is not registered, valid variants: %v", variant, meta.Variants)), nil
+		default:
+			e.Variant = otherVariant
+			e.decide("variant", "", echoResolved, fmt.Sprintf("variant %q is not registered, counted as %s", variant, otherVariant))
+		}
+	}
+
+	optedOut, err := s.optedOut(ctx, ip, s.visitorCookie(r))
+	if err != nil {
+		return e, err
+	}
+	if optedOut {
+		return e.drop(reasonOptOut, "", "the visitor opted out"), nil
+	}
+	e.decide(reasonOptOut, "", echoPass, "")
+
+	flags := s.flags.Flags()
+	userAgent := r.UserAgent()
+	if s.burst == nil {
+		e.decide("burst_dedup", "", echoOff, "")
+	} else if s.burst.seen(burstKey(ip, page, userAgent), s.clock.Now()) {
+		return e.drop("burst_dedup", "", "a request from the same IP and user agent was seen within BURST_DEDUP_WINDOW"), nil
+	} else {
+		e.decide("burst_dedup", "", echoPass, "")
+	}
+
+	visitor, err := s.echoVisitor(ctx, r, ip, &e)
+	if err != nil {
+		return e, err
+	}
+	now := s.bucketNow()
+
+	policy, err := s.pagePolicy(ctx, page, flags)
+	if err != nil {
+		return e, err
+	}
+	if policy.Group == "" {
+		e.decide("group", "", echoOff, "the global counting policy applies")
+	} else {
+		e.decide("group", "", echoResolved, fmt.Sprintf("the counting policy of group %q applies", policy.Group))
+	}
+
+	bot := isBotUserAgent(userAgent)
+	botDetail := fmt.Sprintf("user agent %q is not a bot", userAgent)
+	if bot {
+		botDetail = fmt.Sprintf("user agent %q looks like a bot", userAgent)
+	}
+	switch mode := policy.BotFiltering; {
+	case mode == ModeOff:
+		e.decide(featureBotFiltering, mode, echoOff, botDetail)
+	case !bot:
+		e.decide(featureBotFiltering, mode, echoPass, botDetail)
+	case mode == ModeEnforce:
+		return e.drop(featureBotFiltering, mode, botDetail), nil
+	default:
+		e.decide(featureBotFiltering, mode, echoShadowDrop, botDetail)
+	}
+
+	weight := int64(1)
+	switch mode := flags.Modes.Sampling; mode {
+	case ModeOff:
+		e.decide(featureSampling, mode, echoOff, "")
+	default:
+		sampleW := sampleWeight(policy.SampleRate)
+		in := sampledIn(sampleDraw(), sampleW)
+		switch {
+		case sampleW == 1:
+			e.decide(featureSampling, mode, echoPass, "the page is not sampled")
+		case mode == ModeEnforce && !in:
+			return e.drop(featureSampling, mode, fmt.Sprintf("the request drew sampled out at 1 in %d", sampleW)), nil
+		case mode == ModeEnforce:
+			weight = sampleW
+			e.decide(featureSampling, mode, echoPass, fmt.Sprintf("the request drew sampled in, counting for %d visits", sampleW))
+		case in:
+			e.decide(featureSampling, mode, echoPass, fmt.Sprintf("the request would be sampled in at 1 in %d", sampleW))
+		default:
+			e.decide(featureSampling, mode, echoShadowDrop, fmt.Sprintf("the request would be sampled out at 1 in %d", sampleW))
+		}
+	}
+	e.Weight = weight
+
+	if s.journaling() {
+		e.Counted = true
+		e.decide("out_of_memory", "", echoJournal, "Redis is out of memory, the visit would be journaled in memory")
+		return e, nil
+	}
+
+	switch mode := flags.Modes.Dedupe; mode {
+	case ModeOff:
+		e.decide(featureDedupe, mode, echoOff, "")
+	default:
+		seen, err := s.redis.client.Exists(ctx, dedupeKey(page, visitor)).Result()
+		if err != nil {
+			return e, err
+		}
+		switch {
+		case seen == 0:
+			e.decide(featureDedupe, mode, echoPass, "first visit within the dedupe window of "+policy.DedupeWindow.String())
+		case mode == ModeEnforce:
+			return e.drop(featureDedupe, mode, "the visitor was already counted within the dedupe window of "+policy.DedupeWindow.String()), nil
+		default:
+			e.decide(featureDedupe, mode, echoShadowDrop, "the visitor was already counted within the dedupe window of "+policy.DedupeWindow.String())
+		}
+	}
+
+	e.Country = s.requestCountry(r, ip)
+	if e.Country == "" {
+		e.decide("geo", "", echoOff, "")
+	} else {
+		e.decide("geo", "", echoPass, "counted in "+e.Country)
+	}
+
+	outbox, err := s.newPageOutboxEntry(page, now)
+	if err != nil {
+		return e, err
+	}
+	e.Counted = true
+	e.Commands = s.redis.dryRun(func(dry *RedisClient) {
+		// Replies are empty, so only the commands sent matter
+		if flags.Modes.Dedupe != ModeOff {
+			dry.MarkVisitor(ctx, page, visitor, policy.DedupeWindow, now)
+		}
+		dry.RecordVisit(ctx, VisitWrite{
+			Page:        page,
+			Visitor:     visitor,
+			Now:         now,
+			Rollup:      flags.Rollups,
+			Variant:     e.Variant,
+			Approximate: s.isApproximatePage(page),
+			Weight:      weight,
+			Value:       value,
+			Country:     e.Country,
+			Outbox:      outbox,
+			Journey:     s.cfg.VisitorCookie,
+			Minutes:     s.anomalies != nil,
+			Goals:       s.goals.ForPage(page),
+		})
+		if s.cfg.SessionWindow > 0 {
+			dry.TrackSession(ctx, page, visitor, s.cfg.SessionWindow, s.cfg.SessionRefresh, flags.Rollups, now)
+		}
+	})
+	seen := make(map[string]bool)
+	for _, command := range e.Commands {
+		for _, key := range command.Keys {
+			if !seen[key] {
+				seen[key] = true
+				e.Keys = append(e.Keys, key)
+			}
+		}
+	}
+	sort.Strings(e.Keys)
+	return e, nil
+}
+
+// echoVisitor returns the stored visitor ID of r as visitorID would, without
+// issuing a cookie or creating the day's salt. Before the first visit of a
+// day under daily rotation there is no hash yet, and a placeholder stands
+// in for it.
+func (s *Server) echoVisitor(ctx context.Context, r *http.Request, ip string, e *EchoVisitResponse) (string, error) {
+	kind, value, source := "ip", ip, "client IP "+ip
+	if cookie := s.visitorCookie(r); cookie != "" {
+		kind, value, source = "c", cookie, visitorCookieName+" cookie"
+	}
+	hash, ok, err := s.hasher.peek(ctx, kind+":"+value, s.clock.Now())
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		e.decide("visitor", "", echoPass, "identified by the "+source+"; today's salt does not exist yet")
+		return kind + ":<hash>", nil
+	}
+	e.Visitor = kind + ":" + hash
+	e.decide("visitor", "", echoPass, "identified by the "+source)
+	return e.Visitor, nil
+}
+
+// dryRunHook records the commands a client sends instead of sending them,
+// leaving every reply empty
+type dryRunHook struct {
+	commands []EchoCommand
+}
+
+func (h *dryRunHook) record(cmd redis.Cmder) {
+	name := cmd.Name()
+	if name == "multi" || name == "exec" {
+		return
+	}
+	args := cmd.Args()
+	command := EchoCommand{Command: name}
+	for _, i := range commandKeys(name, args) {
+		command.Keys = append(command.Keys, argString(args[i]))
+	}
+	h.commands = append(h.commands, command)
+}
+
+func (h *dryRunHook) DialHook(next redis.DialHook) redis.DialHook { return next }
+
+func (h *dryRunHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		h.record(cmd)
+		return nil
+	}
+}
+
+func (h *dryRunHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		for _, cmd := range cmds {
+			h.record(cmd)
+		}
+		return nil
+	}
+}
+
+// dryRun calls fn with a copy of the client that records its commands
+// instead of sending them, returning what it would have sent. The copy
+// never connects.
+func (r *RedisClient) dryRun(fn func(dry *RedisClient)) []EchoCommand {
+	hook := &dryRunHook{commands: []EchoCommand{}}
+	rdb := redis.NewClient(&redis.Options{})
+	defer rdb.Close()
+	rdb.AddHook(hook)
+	dry := *r
+	dry.client = rdb
+	fn(&dry)
+	return hook.commands
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// echoVisit explains req through POST /debug/echo-visit
+func echoVisit(t *testing.T, router http.Handler, req string) EchoVisitResponse {
+	t.Helper()
+	w := doRequest(router, "POST", "/debug/echo-visit", req, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Echo visit: %d %s", w.Code, w.Body.String())
+	}
+	var echo EchoVisitResponse
+	json.Unmarshal(w.Body.Bytes(), &echo)
+	return echo
+}
+
+// decision returns the outcome of step, "" when it was not reached
+func (e EchoVisitResponse) decision(step string) string {
+	for _, d := range e.Decisions {
+		if d.Step == step {
+			return d.Outcome
+		}
+	}
+	return ""
+}
+
+func TestEchoVisitAliasedPage(t *testing.T) {
+	mr, redisClient := newTestRedis(t)
+	cfg := testConfig()
+	cfg.DebugEcho = true
+	router := newTestServer(t, cfg, redisClient).Router()
+	doRequest(router, "GET", "/visit/pricing", "", nil)
+	if w := doRequest(router, "PUT", "/admin/aliases/plans", `{"target":"pricing"}`, nil); w.Code != http.StatusOK {
+		t.Fatalf("Set alias: %d %s", w.Code, w.Body.String())
+	}
+	before := mr.Keys()
+
+	echo := echoVisit(t, router, `{"url":"/visit/plans?weight=2","headers":{"User-Agent":"Mozilla/5.0"}}`)
+	if echo.Status != http.StatusOK || !echo.Counted || echo.Page != "pricing" || echo.ResolvedFrom != "plans" || echo.Weight != 1 {
+		t.Fatalf("Expected the visit counted for pricing, got %+v", echo)
+	}
+	if got := echo.decision("alias"); got != echoResolved {
+		t.Errorf("Expected the alias resolved, got %q", got)
+	}
+	keys := make(map[string]bool)
+	for _, key := range echo.Keys {
+		keys[key] = true
+	}
+	for _, want := range []string{"visits:pricing", leaderboardKey, lastVisitKey, uniqueKey("pricing"), weightedKey("pricing")} {
+		if !keys[want] {
+			t.Errorf("Expected %s among the keys, got %v", want, echo.Keys)
+		}
+	}
+	if keys["visits:plans"] || !sort.StringsAreSorted(echo.Keys) {
+		t.Errorf("Expected the target's keys, sorted, got %v", echo.Keys)
+	}
+	if len(echo.Commands) == 0 || echo.Commands[0].Command == "" {
+		t.Errorf("Expected the commands listed, got %+v", echo.Commands)
+	}
+
+	// Nothing was written
+	if after := mr.Keys(); !reflect.DeepEqual(after, before) {
+		t.Errorf("Expected no keys written, had %v, got %v", before, after)
+	}
+	if got, _ := mr.Get("visits:pricing"); got != "1" {
+		t.Errorf("Expected the counter unchanged, got %q", got)
+	}
+}
+
+func TestEchoVisitBotUserAgent(t *testing.T) {
+	_, redisClient := newTestRedis(t)
+	cfg := testConfig()
+	cfg.DebugEcho = true
+	router := newTestServer(t, cfg, redisClient).Router()
+	bot := `{"url":"/visit/home","headers":{"User-Agent":"Googlebot/2.1"}}`
+
+	if got := echoVisit(t, router, bot); got.decision(featureBotFiltering) != echoOff || !got.Counted {
+		t.Errorf("Expected bots counted with bot filtering off, got %+v", got)
+	}
+
+	doRequest(router, "PUT", "/admin/flags", `{"bot_filtering": "shadow"}`, nil)
+	if got := echoVisit(t, router, bot); got.decision(featureBotFiltering) != echoShadowDrop || !got.Counted {
+		t.Errorf("Expected a shadow drop, still counted, got %+v", got)
+	}
+
+	doRequest(router, "PUT", "/admin/flags", `{"bot_filtering": "enforce"}`, nil)
+	got := echoVisit(t, router, bot)
+	if got.Counted || got.DroppedBy != featureBotFiltering || len(got.Keys) != 0 || len(got.Commands) != 0 {
+		t.Errorf("Expected the bot dropped before any write, got %+v", got)
+	}
+	if got.decision(featureSampling) != "" {
+		t.Errorf("Expected processing to stop at the drop, got %+v", got.Decisions)
+	}
+	human := echoVisit(t, router, `{"url":"/visit/home","headers":{"User-Agent":"Mozilla/5.0"}}`)
+	if !human.Counted || human.decision(featureBotFiltering) != echoPass {
+		t.Errorf("Expected a browser counted, got %+v", human)
+	}
+}
+
+func TestEchoVisitDedupedVisitor(t *testing.T) {
+	_, redisClient := newTestRedis(t)
+	cfg := testConfig()
+	cfg.DebugEcho = true
+	router := newTestServer(t, cfg, redisClient).Router()
+	doRequest(router, "PUT", "/admin/flags", `{"dedupe": "enforce"}`, nil)
+
+	// httptest requests come from 192.0.2.1
+	doRequest(router, "GET", "/visit/home", "", nil)
+	got := echoVisit(t, router, `{"url":"/visit/home","client_ip":"192.0.2.1"}`)
+	if got.Counted || got.DroppedBy != featureDedupe || got.Visitor == "" {
+		t.Errorf("Expected the repeat visitor deduped, got %+v", got)
+	}
+
+	other := echoVisit(t, router, `{"url":"/visit/home","client_ip":"198.51.100.7"}`)
+	if !other.Counted || other.decision(featureDedupe) != echoPass || other.Visitor == got.Visitor {
+		t.Fatalf("Expected a new visitor counted, got %+v", other)
+	}
+	found := false
+	for _, key := range other.Keys {
+		found = found || key == dedupeKey("home", other.Visitor)
+	}
+	if !found {
+		t.Errorf("Expected the dedupe marker among the keys, got %v", other.Keys)
+	}
+	// Explaining the visit did not mark the visitor
+	if again := echoVisit(t, router, `{"url":"/visit/home","client_ip":"198.51.100.7"}`); !again.Counted {
+		t.Errorf("Expected the visitor still new, got %+v", again)
+	}
+}
+
+func TestEchoVisitRejections(t *testing.T) {
+	_, redisClient := newTestRedis(t)
+	cfg := testConfig()
+	cfg.DebugEcho = true
+	router := newTestServer(t, cfg, redisClient).Router()
+	doRequest(router, "GET", "/visit/old", "", nil)
+	doRequest(router, "POST", "/admin/pages/old/archive", "", nil)
+
+	for _, tt := range []struct {
+		req    string
+		status int
+		step   string
+	}{
+		{`{"url":"/visits/home"}`, http.StatusNotFound, "route"},
+		{`{"url":"/visit/home?weight=-1"}`, http.StatusBadRequest, "weight"},
+		{`{"url":"/visit/home?variant=b"}`, http.StatusBadRequest, "variant"},
+		{`{"url":"/visit/old"}`, http.StatusGone, "archived"},
+	} {
+		got := echoVisit(t, router, tt.req)
+		if got.Status != tt.status || got.Counted || got.decision(tt.step) != echoReject {
+			t.Errorf("Expected %s rejected at %s with %d, got %+v", tt.req, tt.step, tt.status, got)
+		}
+	}
+	for _, req := range []string{`{}`, `{"url":"/visit/home","client_ip":"nowhere"}`} {
+		if w := doRequest(router, "POST", "/debug/echo-visit", req, nil); w.Code != http.StatusBadRequest {
+			t.Errorf("Expected %s rejected, got %d", req, w.Code)
+		}
+	}
+
+	// Off unless enabled
+	disabled := newTestServer(t, testConfig(), redisClient).Router()
+	if w := doRequest(disabled, "POST", "/debug/echo-visit", `{"url":"/visit/home"}`, nil); w.Code != http.StatusNotFound {
+		t.Errorf("Expected no echo endpoint by default, got %d", w.Code)
+	}
+}
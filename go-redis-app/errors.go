@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+// Store error kinds. Errors returned by the RedisClient wrap one of these
+// around the underlying go-redis error, so callers can test the kind with
+// errors.Is and still reach the cause with errors.Is or errors.As.
+var (
+	ErrNotFound    = errors.New("not found")
+	ErrUnavailable = errors.New("redis unavailable")
+	ErrTimeout     = errors.New("redis timeout")
+	ErrConflict    = errors.New("conflict")
+	ErrReadOnly    = errors.New("read-only mode")
+	ErrOutOfMemory = errors.New("redis out of memory")
+)
+
+// kindError is a store error of a kind with its own message, such as a page
+// that is not found
+type kindError struct {
+	kind error
+	msg  string
+}
+
+// newKindError creates an error of kind reported as msg
+func newKindError(kind error, msg string) error {
+	return &kindError{kind: kind, msg: msg}
+}
+
+func (e *kindError) Error() string { return e.msg }
+
+func (e *kindError) Is(target error) bool { return target == e.kind }
+
+// unavailablePrefixes are the server errors of a Redis that is up but
+// cannot serve the command yet
+var unavailablePrefixes = []string{"LOADING", "READONLY", "MASTERDOWN", "CLUSTERDOWN", "TRYAGAIN", "BUSY "}
+
+// oomPrefix starts the error Redis returns for writes past maxmemory under
+// the noeviction policy
+const oomPrefix = "OOM "
+
+// classifyError returns the kind of a go-redis error, or nil if it is
+// another kind of failure (a script error, a wrong type, ...)
+func classifyError(err error) error {
+	var netErr net.Error
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, redis.Nil):
+		return ErrNotFound
+	case errors.Is(err, redis.TxFailedErr):
+		return ErrConflict
+	case errors.Is(err, context.DeadlineExceeded),
+		errors.As(err, &netErr) && netErr.Timeout(),
+		err.Error() == "redis: connection pool timeout":
+		return ErrTimeout
+	case errors.Is(err, redis.ErrClosed), errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF),
+		errors.As(err, new(*net.OpError)):
+		return ErrUnavailable
+	}
+	if strings.HasPrefix(err.Error(), oomPrefix) {
+		return ErrOutOfMemory
+	}
+	for _, prefix := range unavailablePrefixes {
+		if strings.HasPrefix(err.Error(), prefix) {
+			return ErrUnavailable
+		}
+	}
+	return nil
+}
+
+// wrapError wraps err in its kind, leaving unclassified and already wrapped
+// errors as they are
+func wrapError(err error) error {
+	kind := classifyError(err)
+	if kind == nil || errors.Is(err, kind) {
+		return err
+	}
+	return fmt.Errorf("%w: %w", kind, err)
+}
+
+// isMissing reports whether err is a missing key or value, from a command or
+// a store method
+func isMissing(err error) bool {
+	return errors.Is(err, ErrNotFound) || errors.Is(err, redis.Nil)
+}
+
+// ignoreMissing returns nil for missing keys, which many reads treat as
+// empty, and err otherwise
+func ignoreMissing(err error) error {
+	if isMissing(err) {
+		return nil
+	}
+	return err
+}
+
+// pipelineError returns the first error of a pipeline's cmds other than
+// skip's. Exec only returns the first one, so a nil reply there would hide
+// a later command's failure; nil replies are only ignored for the commands
+// in nilable, which read keys that may be missing. The error is wrapped in
+// its kind, as the hook wraps Exec's.
+func pipelineError(cmds []redis.Cmder, skip redis.Cmder, nilable ...redis.Cmder) error {
+	for _, cmd := range cmds {
+		err := cmd.Err()
+		if err == nil || cmd == skip || (isMissing(err) && slices.Contains(nilable, cmd)) {
+			continue
+		}
+		return wrapError(err)
+	}
+	return nil
+}
+
+// errorHook wraps the errors of every command and pipeline in their kind
+type errorHook struct{}
+
+func (errorHook) DialHook(next redis.DialHook) redis.DialHook {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := next(ctx, network, addr)
+		return conn, wrapError(err)
+	}
+}
+
+func (errorHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		return wrapError(next(ctx, cmd))
+	}
+}
+
+func (errorHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		return wrapError(next(ctx, cmds))
+	}
+}
+
+// newRedisClient wraps a go-redis client, installing the error hook and the
+// per-request command accounting
+func newRedisClient(rdb *redis.Client) *RedisClient {
+	rdb.AddHook(errorHook{})
+	rdb.AddHook(redisOpsHook{})
+	return &RedisClient{client: rdb}
+}
+
+// respondStoreError answers a failed store call: 404, 409, 503 or 504 for
+// the store error kinds, and 500 with message for anything else
+func respondStoreError(c *gin.Context, err error, message string) {
+	for _, m := range []struct {
+		kind   error
+		status int
+		code   string
+	}{
+		{ErrNotFound, http.StatusNotFound, "not_found"},
+		{ErrConflict, http.StatusConflict, "conflict"},
+		{ErrUnavailable, http.StatusServiceUnavailable, "unavailable"},
+		{ErrTimeout, http.StatusGatewayTimeout, "timeout"},
+		{ErrReadOnly, http.StatusForbidden, "read_only"},
+		{ErrOutOfMemory, http.StatusServiceUnavailable, "out_of_memory"},
+	} {
+		if errors.Is(err, m.kind) {
+			respondError(c, m.status, m.code, message+": "+m.kind.Error())
+			return
+		}
+	}
+	respondError(c, http.StatusInternalServerError, "internal_error", message)
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// failingStore fails every command and pipeline with its error once set,
+// standing in for a Redis that is down, slow or refusing writes
+type failingStore struct {
+	mu  sync.Mutex
+	err error
+}
+
+func (f *failingStore) fail(err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.err = err
+}
+
+func (f *failingStore) current() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.err
+}
+
+func (f *failingStore) DialHook(next redis.DialHook) redis.DialHook { return next }
+
+func (f *failingStore) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		if err := f.current(); err != nil {
+			return err
+		}
+		return next(ctx, cmd)
+	}
+}
+
+func (f *failingStore) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		if err := f.current(); err != nil {
+			for _, cmd := range cmds {
+				cmd.SetErr(err)
+			}
+			return err
+		}
+		return next(ctx, cmds)
+	}
+}
+
+// newFailingRedis returns a client whose commands fail once the returned
+// store is told to; the error hook wraps the injected errors as for a real
+// Redis
+func newFailingRedis(t *testing.T) (*RedisClient, *failingStore) {
+	t.Helper()
+	_, redisClient := newTestRedis(t)
+	store := &failingStore{}
+	redisClient.client.AddHook(store)
+	return redisClient, store
+}
+
+func TestClassifyError(t *testing.T) {
+	opErr := &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+	tests := []struct {
+		err  error
+		kind error
+	}{
+		{redis.Nil, ErrNotFound},
+		{redis.TxFailedErr, ErrConflict},
+		{context.DeadlineExceeded, ErrTimeout},
+		{&net.OpError{Op: "read", Net: "tcp", Err: timeoutError{}}, ErrTimeout},
+		{errors.New("redis: connection pool timeout"), ErrTimeout},
+		{opErr, ErrUnavailable},
+		{io.EOF, ErrUnavailable},
+		{redis.ErrClosed, ErrUnavailable},
+		{errors.New("LOADING Redis is loading the dataset in memory"), ErrUnavailable},
+		{errors.New("READONLY You can't write against a read only replica."), ErrUnavailable},
+		{errors.New("OOM command not allowed when used memory > 'maxmemory'."), ErrOutOfMemory},
+		{errors.New("WRONGTYPE Operation against a key holding the wrong kind of value"), nil},
+		{errors.New("ERR unknown command"), nil},
+	}
+	for _, tt := range tests {
+		if kind := classifyError(tt.err); kind != tt.kind {
+			t.Errorf("classifyError(%v) = %v, want %v", tt.err, kind, tt.kind)
+		}
+		wrapped := wrapError(tt.err)
+		if !errors.Is(wrapped, tt.err) {
+			t.Errorf("Expected %v to still match its cause", wrapped)
+		}
+		if tt.kind != nil && !errors.Is(wrapped, tt.kind) {
+			t.Errorf("Expected %v to match %v", wrapped, tt.kind)
+		}
+		if again := wrapError(wrapped); again != wrapped {
+			t.Errorf("Expected wrapping to be idempotent, got %v", again)
+		}
+	}
+
+	var target *net.OpError
+	if !errors.As(wrapError(opErr), &target) || target != opErr {
+		t.Error("Expected errors.As to reach the underlying net.OpError")
+	}
+	if !errors.Is(errPageNotFound, ErrNotFound) || !errors.Is(errGoalExists, ErrConflict) || errors.Is(errPageNotFound, ErrConflict) {
+		t.Error("Expected domain errors to match their kind only")
+	}
+}
+
+// timeoutError is a net.Error that timed out
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestStoreErrorsWrapRedisErrors(t *testing.T) {
+	redisClient, store := newFailingRedis(t)
+	ctx := context.Background()
+
+	if count, err := redisClient.GetVisitCount(ctx, "never-visited"); err != nil || count != 0 {
+		t.Errorf("Expected a missing page to count 0, got %d, %v", count, err)
+	}
+	if _, err := redisClient.client.Get(ctx, "missing").Result(); !errors.Is(err, ErrNotFound) || !errors.Is(err, redis.Nil) {
+		t.Errorf("Expected a missing key to be ErrNotFound wrapping redis.Nil, got %v", err)
+	}
+
+	store.fail(errors.New("LOADING Redis is loading the dataset in memory"))
+	if _, err := redisClient.GetVisitCount(ctx, "home"); !errors.Is(err, ErrUnavailable) {
+		t.Errorf("Expected ErrUnavailable, got %v", err)
+	}
+	if _, err := redisClient.GetGoalStats(ctx, "signup"); !errors.Is(err, ErrUnavailable) {
+		t.Errorf("Expected pipelined reads to return ErrUnavailable, got %v", err)
+	}
+}
+
+func TestHandlersMapStoreErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		err    error
+		status int
+		code   string
+	}{
+		{"missing", redis.Nil, http.StatusNotFound, "not_found"},
+		{"transaction aborted", redis.TxFailedErr, http.StatusConflict, "conflict"},
+		{"connection refused", &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}, http.StatusServiceUnavailable, "unavailable"},
+		{"loading", errors.New("LOADING Redis is loading the dataset in memory"), http.StatusServiceUnavailable, "unavailable"},
+		{"deadline", context.DeadlineExceeded, http.StatusGatewayTimeout, "timeout"},
+		{"read timeout", &net.OpError{Op: "read", Net: "tcp", Err: timeoutError{}}, http.StatusGatewayTimeout, "timeout"},
+		{"script error", errors.New("ERR Error running script"), http.StatusInternalServerError, "internal_error"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			redisClient, store := newFailingRedis(t)
+			router := newTestServer(t, testConfig(), redisClient).Router()
+			store.fail(tt.err)
+
+			for _, path := range []string{"/visit/home", "/visits/home", "/pages/top", "/trending"} {
+				w := doRequest(router, "GET", path, "", nil)
+				var body ErrorResponse
+				if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || body.Error == "" {
+					t.Fatalf("%s: expected an error envelope, got %q", path, w.Body.String())
+				}
+				if w.Code != tt.status || body.Code != tt.code {
+					t.Errorf("%s: expected %d %s, got %d %s", path, tt.status, tt.code, w.Code, body.Code)
+				}
+			}
+		})
+	}
+}
+
+func TestRespondStoreErrorKeepsDomainErrors(t *testing.T) {
+	redisClient, _ := newFailingRedis(t)
+	router := newTestServer(t, testConfig(), redisClient).Router()
+
+	// Errors that already have a handler-specific answer keep it
+	if w := doRequest(router, "GET", "/goals/missing", "", nil); w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for an undefined goal, got %d", w.Code)
+	}
+	body := `{"name": "signup", "source_page": "home", "target_page": "done"}`
+	doRequest(router, "POST", "/goals", body, nil)
+	if w := doRequest(router, "POST", "/goals", body, nil); w.Code != http.StatusConflict {
+		t.Errorf("Expected 409 for a duplicate goal, got %d", w.Code)
+	}
+	if w := doRequest(router, "POST", "/admin/pages/home/unarchive", "", nil); w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 restoring a page that is not archived, got %d", w.Code)
+	}
+}
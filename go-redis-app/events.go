@@ -0,0 +1,513 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+// EVENTS_BACKEND values
+const (
+	eventsBackendNone   = ""
+	eventsBackendPubSub = "pubsub"
+	eventsBackendStream = "stream"
+)
+
+const (
+	// eventsChannel carries live events with the pubsub backend
+	eventsChannel = "events"
+
+	// eventsStreamKey holds live events with the stream backend
+	eventsStreamKey = "events:stream"
+
+	// eventsReadBlock is how long a stream read waits for new events
+	eventsReadBlock = time.Second
+
+	// eventsReadCount bounds the entries fetched per stream read
+	eventsReadCount = 100
+
+	// eventsHeartbeat is how often an idle SSE stream sends a comment, so
+	// proxies don't close it
+	eventsHeartbeat = 15 * time.Second
+
+	// webhookGroup is the consumer group delivering page.created events to
+	// NEW_PAGE_WEBHOOK_URL with the stream backend
+	webhookGroup = "webhook"
+)
+
+// Live event types
+const (
+	eventVisit       = "visit"
+	eventPageCreated = "page.created"
+)
+
+// streamIDPattern matches Redis stream IDs, as sent back in Last-Event-ID
+var streamIDPattern = regexp.MustCompile(`^[0-9]+-[0-9]+$`)
+
+// Event is a live event. ID is the stream entry ID with the stream backend
+// and empty with pubsub.
+type Event struct {
+	ID     string    `json:"-"`
+	Type   string    `json:"type"`
+	Page   string    `json:"page"`
+	Visits int64     `json:"visits,omitempty"`
+	Time   time.Time `json:"time"`
+}
+
+// EventBus publishes live events and delivers them to subscribers
+type EventBus interface {
+	Publish(ctx context.Context, event Event) error
+
+	// Subscribe delivers the events published after the call, or with a
+	// resumable bus those after the event ID in after. The channel is
+	// closed when ctx is done or the subscription fails; subscribers
+	// reconnect with the last ID they saw.
+	Subscribe(ctx context.Context, after string) (<-chan Event, error)
+
+	// Resumable reports whether Subscribe honours after
+	Resumable() bool
+}
+
+// newEventBus returns the bus for EVENTS_BACKEND, or nil when live events
+// are disabled
+func newEventBus(cfg Config, redisClient *RedisClient) EventBus {
+	switch cfg.EventsBackend {
+	case eventsBackendPubSub:
+		return &pubSubBus{redis: redisClient}
+	case eventsBackendStream:
+		return &streamBus{redis: redisClient, maxLen: cfg.EventsStreamMaxLen}
+	}
+	return nil
+}
+
+// pubSubBus sends events through Redis Pub/Sub. Events published while a
+// subscriber reconnects are lost.
+type pubSubBus struct {
+	redis *RedisClient
+}
+
+// Publish implements EventBus
+func (b *pubSubBus) Publish(ctx context.Context, event Event) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	return b.redis.client.Publish(ctx, eventsChannel, data).Err()
+}
+
+// Subscribe implements EventBus; after is ignored
+func (b *pubSubBus) Subscribe(ctx context.Context, _ string) (<-chan Event, error) {
+	pubsub := b.redis.client.Subscribe(ctx, eventsChannel)
+	if _, err := pubsub.Receive(ctx); err != nil {
+		pubsub.Close()
+		return nil, err
+	}
+	events := make(chan Event)
+	go func() {
+		defer close(events)
+		defer pubsub.Close()
+		messages := pubsub.Channel()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case msg, ok := <-messages:
+				if !ok {
+					return
+				}
+				var event Event
+				if err := json.Unmarshal([]byte(msg.Payload), &event); err != nil {
+					log.Printf("Dropping malformed event: %v", err)
+					continue
+				}
+				select {
+				case events <- event:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return events, nil
+}
+
+// Resumable implements EventBus
+func (b *pubSubBus) Resumable() bool { return false }
+
+// streamBus keeps events in a Redis Stream capped at about maxLen entries,
+// so subscribers can resume from the last ID they saw
+type streamBus struct {
+	redis  *RedisClient
+	maxLen int64
+}
+
+// Publish implements EventBus
+func (b *streamBus) Publish(ctx context.Context, event Event) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	return b.redis.client.XAdd(ctx, &redis.XAddArgs{
+		Stream: eventsStreamKey,
+		MaxLen: b.maxLen,
+		Approx: true,
+		Values: []interface{}{"data", data},
+	}).Err()
+}
+
+// Subscribe implements EventBus. Without after it starts from the stream's
+// last entry, not "$", so nothing is missed between reads.
+func (b *streamBus) Subscribe(ctx context.Context, after string) (<-chan Event, error) {
+	if after == "" {
+		last, err := b.redis.client.XRevRangeN(ctx, eventsStreamKey, "+", "-", 1).Result()
+		if err != nil {
+			return nil, err
+		}
+		after = "0-0"
+		if len(last) > 0 {
+			after = last[0].ID
+		}
+	}
+
+	events := make(chan Event)
+	go func() {
+		defer close(events)
+		for ctx.Err() == nil {
+			streams, err := b.redis.client.XRead(ctx, &redis.XReadArgs{
+				Streams: []string{eventsStreamKey, after},
+				Count:   eventsReadCount,
+				Block:   eventsReadBlock,
+			}).Result()
+			if isMissing(err) {
+				continue
+			}
+			if err != nil {
+				if ctx.Err() == nil {
+					log.Printf("Event stream read failed: %v", err)
+				}
+				return
+			}
+			for _, stream := range streams {
+				for _, msg := range stream.Messages {
+					after = msg.ID
+					event, err := decodeStreamEvent(msg)
+					if err != nil {
+						log.Printf("Dropping malformed event %s: %v", msg.ID, err)
+						continue
+					}
+					select {
+					case events <- event:
+					case <-ctx.Done():
+						return
+					}
+				}
+			}
+		}
+	}()
+	return events, nil
+}
+
+// Resumable implements EventBus
+func (b *streamBus) Resumable() bool { return true }
+
+// decodeStreamEvent decodes an event stream entry
+func decodeStreamEvent(msg redis.XMessage) (Event, error) {
+	data, _ := msg.Values["data"].(string)
+	var event Event
+	if err := json.Unmarshal([]byte(data), &event); err != nil {
+		return Event{}, err
+	}
+	event.ID = msg.ID
+	return event, nil
+}
+
+// EventConsumer processes the event stream as one consumer of a consumer
+// group, acknowledging each event its handler accepts. Events a crashed or
+// failing consumer left pending for minIdle are claimed with XAUTOCLAIM, so
+// every event is handled at least once.
+type EventConsumer struct {
+	redis   *RedisClient
+	group   string
+	name    string
+	minIdle time.Duration
+	handle  func(context.Context, Event) error
+}
+
+// NewEventConsumer creates a consumer of group named after the host and
+// process
+func NewEventConsumer(redisClient *RedisClient, group string, minIdle time.Duration, handle func(context.Context, Event) error) *EventConsumer {
+	host, _ := os.Hostname()
+	return &EventConsumer{
+		redis:   redisClient,
+		group:   group,
+		name:    fmt.Sprintf("%s-%d", host, os.Getpid()),
+		minIdle: minIdle,
+		handle:  handle,
+	}
+}
+
+// Run consumes events until ctx is done. The group is created at the end of
+// the stream if it does not exist.
+func (c *EventConsumer) Run(ctx context.Context) error {
+	err := c.redis.client.XGroupCreateMkStream(ctx, eventsStreamKey, c.group, "$").Err()
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return err
+	}
+
+	lastClaim := time.Time{}
+	for ctx.Err() == nil {
+		if time.Since(lastClaim) >= c.minIdle {
+			if err := c.claim(ctx); err != nil {
+				return err
+			}
+			lastClaim = time.Now()
+		}
+
+		streams, err := c.redis.client.XReadGroup(ctx, &redis.XReadGroupArgs{
+			Group:    c.group,
+			Consumer: c.name,
+			Streams:  []string{eventsStreamKey, ">"},
+			Count:    eventsReadCount,
+			Block:    eventsReadBlock,
+		}).Result()
+		if isMissing(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		for _, stream := range streams {
+			for _, msg := range stream.Messages {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				c.process(ctx, msg)
+			}
+		}
+	}
+	return ctx.Err()
+}
+
+// claim takes over and processes the events pending for at least minIdle
+func (c *EventConsumer) claim(ctx context.Context) error {
+	start := "0-0"
+	for {
+		msgs, next, err := c.redis.client.XAutoClaim(ctx, &redis.XAutoClaimArgs{
+			Stream:   eventsStreamKey,
+			Group:    c.group,
+			Consumer: c.name,
+			MinIdle:  c.minIdle,
+			Start:    start,
+			Count:    eventsReadCount,
+		}).Result()
+		if err != nil {
+			return err
+		}
+		for _, msg := range msgs {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			c.process(ctx, msg)
+		}
+		if next == "0-0" || next == "" {
+			return nil
+		}
+		start = next
+	}
+}
+
+// process handles one event, acknowledging it unless the handler failed.
+// Malformed entries are acknowledged so they aren't claimed forever.
+func (c *EventConsumer) process(ctx context.Context, msg redis.XMessage) {
+	event, err := decodeStreamEvent(msg)
+	if err == nil {
+		if err = c.handle(ctx, event); err != nil {
+			if ctx.Err() == nil {
+				log.Printf("Consumer group %s: event %s failed, will retry: %v", c.group, msg.ID, err)
+			}
+			return
+		}
+	} else {
+		log.Printf("Consumer group %s: dropping malformed event %s: %v", c.group, msg.ID, err)
+	}
+	if err := c.redis.client.XAck(ctx, eventsStreamKey, c.group, msg.ID).Err(); err != nil && ctx.Err() == nil {
+		log.Printf("Consumer group %s: failed to acknowledge %s: %v", c.group, msg.ID, err)
+	}
+}
+
+// EventGroupLag is a consumer group's backlog
+type EventGroupLag struct {
+	Group string
+	// Lag is the number of entries not yet delivered to the group
+	Lag int64
+	// Pending is the number delivered but not acknowledged
+	Pending int64
+}
+
+// EventGroupLags reports the backlog of every consumer group on the event
+// stream, none when the stream does not exist
+func (r *RedisClient) EventGroupLags(ctx context.Context) ([]EventGroupLag, error) {
+	groups, err := r.client.XInfoGroups(ctx, eventsStreamKey).Result()
+	if err != nil {
+		if strings.Contains(err.Error(), "no such key") {
+			return nil, nil
+		}
+		return nil, err
+	}
+	lags := make([]EventGroupLag, len(groups))
+	for i, g := range groups {
+		lags[i] = EventGroupLag{Group: g.Name, Lag: g.Lag, Pending: g.Pending}
+	}
+	return lags, nil
+}
+
+// publishVisit publishes the live events for a counted visit. New page
+// webhooks go through the visit's outbox entry or, with the stream backend,
+// the webhook consumer group.
+func (s *Server) publishVisit(ctx context.Context, page string, visits int64, first bool, now time.Time) {
+	if s.events == nil {
+		return
+	}
+	if err := s.events.Publish(ctx, Event{Type: eventVisit, Page: page, Visits: visits, Time: now.UTC()}); err != nil {
+		log.Printf("Failed to publish visit event: %v", err)
+	}
+	if first {
+		if err := s.events.Publish(ctx, Event{Type: eventPageCreated, Page: page, Time: now.UTC()}); err != nil {
+			log.Printf("Failed to publish page event: %v", err)
+		}
+	}
+}
+
+// startEventConsumers starts the consumer groups reading the event stream
+func (s *Server) startEventConsumers(ctx context.Context) {
+	if s.cfg.EventsBackend != eventsBackendStream || s.pageWebhook == nil {
+		return
+	}
+	consumer := NewEventConsumer(s.redis, webhookGroup, s.cfg.EventsClaimIdle, func(ctx context.Context, event Event) error {
+		if event.Type != eventPageCreated {
+			return nil
+		}
+		return s.pageWebhook.Deliver(event.Page, event.Time)
+	})
+	go func() {
+		for ctx.Err() == nil {
+			if err := consumer.Run(ctx); err != nil && ctx.Err() == nil {
+				log.Printf("Consumer group %s stopped, restarting: %v", webhookGroup, err)
+				select {
+				case <-ctx.Done():
+				case <-time.After(time.Second):
+				}
+			}
+		}
+	}()
+}
+
+// handleEvents streams live events as server-sent events. With the stream
+// backend a reconnecting client's Last-Event-ID header (or ?last_event_id=)
+// resumes after that event; ?page= limits the stream to one page.
+func (s *Server) handleEvents(c *gin.Context) {
+	if s.events == nil {
+		respondError(c, http.StatusNotFound, "not_found", "Live events are disabled; set EVENTS_BACKEND")
+		return
+	}
+	after := c.GetHeader("Last-Event-ID")
+	if after == "" {
+		after = c.Query("last_event_id")
+	}
+	if after != "" && !streamIDPattern.MatchString(after) {
+		respondError(c, http.StatusBadRequest, "invalid_request", "Last-Event-ID must be an event ID sent by this stream")
+		return
+	}
+	page := c.Query("page")
+	hidden, err := s.hiddenPages(c)
+	if err != nil {
+		log.Printf("Error loading private pages: %v", err)
+		respondStoreError(c, err, "Failed to subscribe to events")
+		return
+	}
+
+	ctx, cancel := context.WithCancel(c.Request.Context())
+	defer cancel()
+	if s.lifetime != nil {
+		// End the stream at shutdown rather than holding the drain open
+		stop := context.AfterFunc(s.lifetime, cancel)
+		defer stop()
+	}
+	events, err := s.events.Subscribe(ctx, after)
+	if err != nil {
+		log.Printf("Error subscribing to events: %v", err)
+		respondStoreError(c, err, "Failed to subscribe to events")
+		return
+	}
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+	c.Writer.Flush()
+
+	heartbeat := time.NewTicker(eventsHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-heartbeat.C:
+			if _, err := c.Writer.WriteString(": ping\n\n"); err != nil {
+				return
+			}
+			c.Writer.Flush()
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			if (page != "" && event.Page != page) || hidden[event.Page] {
+				continue
+			}
+			if err := writeSSE(c.Writer, event); err != nil {
+				return
+			}
+			c.Writer.Flush()
+		}
+	}
+}
+
+// writeSSE writes one event in the text/event-stream format
+func writeSSE(w gin.ResponseWriter, event Event) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	var b strings.Builder
+	if event.ID != "" {
+		b.WriteString("id: " + event.ID + "\n")
+	}
+	b.WriteString("event: " + event.Type + "\n")
+	b.WriteString("data: ")
+	b.Write(data)
+	b.WriteString("\n\n")
+	_, err = w.WriteString(b.String())
+	return err
+}
+
+// errUnknownEventsBackend is returned by parseEventsBackend
+var errUnknownEventsBackend = errors.New("must be pubsub or stream")
+
+// parseEventsBackend validates EVENTS_BACKEND; empty disables live events
+func parseEventsBackend(value string) (string, error) {
+	switch value {
+	case eventsBackendNone, eventsBackendPubSub, eventsBackendStream:
+		return value, nil
+	}
+	return "", errUnknownEventsBackend
+}
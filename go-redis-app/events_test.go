@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// sseEvent is a frame read from an /events stream
+type sseEvent struct {
+	ID    string
+	Event Event
+}
+
+// openEvents connects to /events, resuming after lastID when set
+func openEvents(t *testing.T, ctx context.Context, url, lastID string) (*bufio.Scanner, func()) {
+	t.Helper()
+	req, _ := http.NewRequestWithContext(ctx, "GET", url+"/events", nil)
+	if lastID != "" {
+		req.Header.Set("Last-Event-ID", lastID)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("Expected an event stream, got %d %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	return bufio.NewScanner(resp.Body), func() { resp.Body.Close() }
+}
+
+// readEvents reads n frames from an event stream
+func readEvents(t *testing.T, scanner *bufio.Scanner, n int) []sseEvent {
+	t.Helper()
+	var events []sseEvent
+	var frame sseEvent
+	for len(events) < n && scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "id: "):
+			frame.ID = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "data: "):
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &frame.Event); err != nil {
+				t.Fatalf("Invalid event data %q: %v", line, err)
+			}
+		case line == "" && frame.Event.Type != "":
+			events = append(events, frame)
+			frame = sseEvent{}
+		}
+	}
+	if len(events) < n {
+		t.Fatalf("Expected %d events, got %d: %v", n, len(events), scanner.Err())
+	}
+	return events
+}
+
+func TestParseEventsBackend(t *testing.T) {
+	for _, value := range []string{"", "pubsub", "stream"} {
+		if got, err := parseEventsBackend(value); err != nil || got != value {
+			t.Errorf("parseEventsBackend(%q) = %q, %v", value, got, err)
+		}
+	}
+	if _, err := parseEventsBackend("kafka"); err == nil {
+		t.Error("Expected an error for an unknown backend")
+	}
+}
+
+func TestEventsDisabled(t *testing.T) {
+	_, redisClient := newTestRedis(t)
+	router := newTestServer(t, testConfig(), redisClient).Router()
+	if w := doRequest(router, "GET", "/events", "", nil); w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 without EVENTS_BACKEND, got %d", w.Code)
+	}
+}
+
+func TestEventsPubSub(t *testing.T) {
+	_, redisClient := newTestRedis(t)
+	cfg := testConfig()
+	cfg.EventsBackend = eventsBackendPubSub
+	router := newTestServer(t, cfg, redisClient).Router()
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	scanner, closeStream := openEvents(t, ctx, ts.URL, "")
+	defer closeStream()
+
+	doRequest(router, "GET", "/visit/launch", "", nil)
+	events := readEvents(t, scanner, 2)
+	if events[0].Event.Type != eventVisit || events[0].Event.Page != "launch" || events[0].Event.Visits != 1 || events[0].ID != "" {
+		t.Errorf("Expected the visit without an ID, got %+v", events[0])
+	}
+	if events[1].Event.Type != eventPageCreated {
+		t.Errorf("Expected page.created for the first visit, got %+v", events[1])
+	}
+}
+
+func TestEventsStreamResume(t *testing.T) {
+	_, redisClient := newTestRedis(t)
+	cfg := testConfig()
+	cfg.EventsBackend = eventsBackendStream
+	router := newTestServer(t, cfg, redisClient).Router()
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	scanner, closeStream := openEvents(t, ctx, ts.URL, "")
+	doRequest(router, "GET", "/visit/home", "", nil)
+	doRequest(router, "GET", "/visit/home", "", nil)
+	first := readEvents(t, scanner, 3)
+	closeStream()
+	if first[0].ID == "" || first[2].Event.Visits != 2 {
+		t.Fatalf("Expected stream IDs and both visits, got %+v", first)
+	}
+
+	// Visits while the client is away are replayed on reconnect
+	for i := 0; i < 5; i++ {
+		doRequest(router, "GET", "/visit/home", "", nil)
+	}
+	scanner, closeStream = openEvents(t, ctx, ts.URL, first[2].ID)
+	defer closeStream()
+	missed := readEvents(t, scanner, 5)
+	for i, e := range missed {
+		if e.Event.Visits != int64(i+3) {
+			t.Errorf("Expected visit %d after resuming, got %+v", i+3, e.Event)
+		}
+	}
+
+	if w := doRequest(router, "GET", "/events", "", map[string]string{"Last-Event-ID": "yesterday"}); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a malformed Last-Event-ID, got %d", w.Code)
+	}
+}
+
+func TestEventsHidePrivatePages(t *testing.T) {
+	_, redisClient := newTestRedis(t)
+	cfg := testConfig()
+	cfg.EventsBackend = eventsBackendStream
+	router := newTestServer(t, cfg, redisClient).Router()
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+	doRequest(router, "PUT", "/admin/pages/secret/meta", `{"visibility": "private"}`, nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	scanner, closeStream := openEvents(t, ctx, ts.URL, "")
+	defer closeStream()
+	doRequest(router, "GET", "/visit/secret", "", nil)
+	doRequest(router, "GET", "/visit/home", "", nil)
+	if e := readEvents(t, scanner, 1)[0]; e.Event.Page != "home" {
+		t.Errorf("Expected private pages left out, got %+v", e.Event)
+	}
+}
+
+func TestEventConsumerRecoversCrashedConsumer(t *testing.T) {
+	_, redisClient := newTestRedis(t)
+	bus := &streamBus{redis: redisClient, maxLen: 1000}
+	ctx := context.Background()
+
+	var mu sync.Mutex
+	handled := make(map[string]string)
+	handler := func(name string, crashAfter int, cancel func()) func(context.Context, Event) error {
+		return func(_ context.Context, e Event) error {
+			mu.Lock()
+			defer mu.Unlock()
+			if crashAfter >= 0 && len(handled) == crashAfter {
+				// The consumer dies mid-batch, before acknowledging
+				cancel()
+				return errors.New("killed")
+			}
+			handled[e.Page] = name
+			return nil
+		}
+	}
+
+	// Publish a backlog so the consumer dies with part of a batch unacknowledged
+	if err := redisClient.client.XGroupCreateMkStream(ctx, eventsStreamKey, "audit", "$").Err(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if err := bus.Publish(ctx, Event{Type: eventVisit, Page: fmt.Sprintf("page-%d", i), Visits: 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	crashCtx, crash := context.WithCancel(ctx)
+	defer crash()
+	crashed := &EventConsumer{redis: redisClient, group: "audit", name: "crashed", minIdle: time.Hour}
+	crashed.handle = handler("crashed", 4, crash)
+	done := make(chan error, 1)
+	go func() { done <- crashed.Run(crashCtx) }()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the consumer to stop")
+	}
+	lags, _ := redisClient.EventGroupLags(ctx)
+	if len(handled) != 4 || lags[0].Pending != 6 {
+		t.Fatalf("Expected 4 events handled and 6 pending after the crash, got %d handled, %+v", len(handled), lags)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	resumeCtx, stop := context.WithCancel(ctx)
+	defer stop()
+	recovered := &EventConsumer{redis: redisClient, group: "audit", name: "recovered", minIdle: 10 * time.Millisecond}
+	recovered.handle = handler("recovered", -1, stop)
+	go recovered.Run(resumeCtx)
+	waitFor(t, 5*time.Second, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(handled) == 10
+	})
+	for i := 0; i < 10; i++ {
+		page := fmt.Sprintf("page-%d", i)
+		want := "crashed"
+		if i >= 4 {
+			want = "recovered"
+		}
+		if handled[page] != want {
+			t.Errorf("Expected %s handled by %s, got %q", page, want, handled[page])
+		}
+	}
+	waitFor(t, time.Second, func() bool {
+		lags, _ := redisClient.EventGroupLags(ctx)
+		return lags[0].Pending == 0
+	})
+}
+
+func TestEventsWebhookConsumerGroup(t *testing.T) {
+	var mu sync.Mutex
+	var pages []string
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event NewPageEvent
+		json.NewDecoder(r.Body).Decode(&event)
+		mu.Lock()
+		pages = append(pages, event.Page)
+		mu.Unlock()
+	}))
+	defer hook.Close()
+
+	_, redisClient := newTestRedis(t)
+	cfg := testConfig()
+	cfg.EventsBackend = eventsBackendStream
+	cfg.EventsClaimIdle = time.Second
+	cfg.NewPageWebhookURL = hook.URL
+	cfg.EnvName = "test"
+	router := newTestServer(t, cfg, redisClient).Router()
+	waitFor(t, time.Second, func() bool {
+		lags, _ := redisClient.EventGroupLags(context.Background())
+		return len(lags) == 1
+	})
+
+	doRequest(router, "GET", "/visit/launch", "", nil)
+	doRequest(router, "GET", "/visit/launch", "", nil)
+	waitFor(t, 5*time.Second, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(pages) > 0
+	})
+	mu.Lock()
+	if len(pages) != 1 || pages[0] != "launch" {
+		t.Errorf("Expected one webhook for launch, got %v", pages)
+	}
+	mu.Unlock()
+
+	body := doRequest(router, "GET", "/metrics", "", nil).Body.String()
+	for _, series := range []string{`events_consumer_group_lag{env="test",group="webhook"} `, `events_consumer_group_pending{env="test",group="webhook"} 0`} {
+		if !strings.Contains(body, series) {
+			t.Errorf("Expected %s in the metrics, got:\n%s", series, body)
+		}
+	}
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/sync/errgroup"
+)
+
+// Related data of a page, requested with ?expand=
+const (
+	expandUnique      = "unique"
+	expandMeta        = "meta"
+	expandRate        = "rate"
+	expandAnnotations = "annotations"
+
+	// expandAnnotationsLimit is how many of a page's newest annotations are
+	// expanded
+	expandAnnotationsLimit = 10
+)
+
+// visitExpansions lists the ?expand= names
+var visitExpansions = []string{expandUnique, expandMeta, expandRate, expandAnnotations}
+
+// expansions is the related data a read asked for with ?expand=
+type expansions struct {
+	unique      bool
+	meta        bool
+	rate        bool
+	annotations bool
+}
+
+// any reports whether any expansion is set
+func (e expansions) any() bool {
+	return e.unique || e.meta || e.rate || e.annotations
+}
+
+// parseExpansions reads ?expand=, responding 400 for unknown names.
+// Expansions are verbose fields, so they can't be combined with
+// view=compact.
+func parseExpansions(c *gin.Context) (expansions, bool) {
+	var e expansions
+	expand := c.Query("expand")
+	if expand == "" {
+		return e, true
+	}
+	if c.Query("view") == viewCompact {
+		respondError(c, http.StatusBadRequest, "invalid_request", "expand cannot be combined with view=compact")
+		return e, false
+	}
+	for _, name := range strings.Split(expand, ",") {
+		switch name {
+		case expandUnique:
+			e.unique = true
+		case expandMeta:
+			e.meta = true
+		case expandRate:
+			e.rate = true
+		case expandAnnotations:
+			e.annotations = true
+		default:
+			respondError(c, http.StatusBadRequest, "invalid_request",
+				fmt.Sprintf("unknown expand %q, valid: %s", name, strings.Join(visitExpansions, ",")))
+			return e, false
+		}
+	}
+	return e, true
+}
+
+// enabledExpansions drops the expansions whose expand_ flag is off. The
+// rate is read from the minute buckets, which are only recorded with
+// ANOMALY_INTERVAL set, so it is dropped without them too.
+func (s *Server) enabledExpansions(e expansions) expansions {
+	flags := s.flags.Flags()
+	return expansions{
+		unique:      e.unique && flags.ExpandUnique,
+		meta:        e.meta && flags.ExpandMeta,
+		rate:        e.rate && flags.ExpandRate && s.anomalies != nil,
+		annotations: e.annotations && flags.ExpandAnnotations,
+	}
+}
+
+// Expansions is the related data of a page added with ?expand=. Each is
+// left out unless asked for and enabled by its flag.
+type Expansions struct {
+	Unique      *int64               `json:"unique,omitempty"`
+	Meta        *PageMeta            `json:"meta,omitempty"`
+	Rate        *VisitRate           `json:"rate,omitempty"`
+	Annotations *ExpandedAnnotations `json:"annotations,omitempty"`
+}
+
+// VisitRate is a page's visits a minute over the ANOMALY_WINDOW minutes
+// before the current one
+type VisitRate struct {
+	PerMinute     float64 `json:"per_minute"`
+	WindowMinutes int     `json:"window_minutes"`
+}
+
+// ExpandedAnnotations is a page's number of annotations and its newest
+// ones, newest first
+type ExpandedAnnotations struct {
+	Total  int64        `json:"total"`
+	Recent []Annotation `json:"recent"`
+}
+
+// pageExpansion is the part of a page's expansions kept in the counter
+// keys: everything but the metadata
+type pageExpansion struct {
+	unique      *int64
+	rate        *float64
+	total       int64
+	annotations []annotation
+}
+
+// ExpandPages reads the expansions of pages other than their metadata in
+// one pipeline: the unique visitors, the minute buckets of the rate over
+// window minutes before now's and the newest annotations
+func (r *RedisClient) ExpandPages(ctx context.Context, pages []string, e expansions, now time.Time, window int) ([]pageExpansion, error) {
+	pipe := r.client.Pipeline()
+	uniques := make([]*redis.IntCmd, len(pages))
+	buckets := make([][]*redis.StringCmd, len(pages))
+	totals := make([]*redis.IntCmd, len(pages))
+	recent := make([]*redis.ZSliceCmd, len(pages))
+	for i, page := range pages {
+		if e.unique {
+			uniques[i] = pipe.PFCount(ctx, uniqueKey(page))
+		}
+		if e.rate {
+			buckets[i] = queueMinuteRate(ctx, pipe, page, now, window)
+		}
+		if e.annotations {
+			totals[i] = pipe.ZCard(ctx, annotationsKey(page))
+			recent[i] = pipe.ZRevRangeWithScores(ctx, annotationsKey(page), 0, expandAnnotationsLimit-1)
+		}
+	}
+	if cmds, err := pipe.Exec(ctx); err != nil {
+		// Only the minute buckets are missing for minutes without visits
+		var nilable []redis.Cmder
+		for _, page := range buckets {
+			for _, bucket := range page {
+				nilable = append(nilable, bucket)
+			}
+		}
+		if err := pipelineError(cmds, nil, nilable...); err != nil {
+			return nil, err
+		}
+	}
+
+	expanded := make([]pageExpansion, len(pages))
+	for i, page := range pages {
+		if e.unique {
+			n := uniques[i].Val()
+			expanded[i].unique = &n
+		}
+		if e.rate {
+			rate := minuteRate(buckets[i])
+			expanded[i].rate = &rate
+		}
+		if e.annotations {
+			expanded[i].total = totals[i].Val()
+			expanded[i].annotations = decodeAnnotations(page, recent[i].Val())
+		}
+	}
+	return expanded, nil
+}
+
+// expandPages reads the enabled expansions of pages, in order. The counter
+// keys are read in one pipeline and the metadata in one batch of its store,
+// concurrently, so a page costs a single round trip group however many it
+// expands.
+func (s *Server) expandPages(c *gin.Context, pages []string, e expansions) ([]*Expansions, error) {
+	var expanded []pageExpansion
+	var metas []PageMeta
+	g, ctx := errgroup.WithContext(c.Request.Context())
+	if e.unique || e.rate || e.annotations {
+		g.Go(func() error {
+			window := 0
+			if s.anomalies != nil {
+				window = s.anomalies.window
+			}
+			var err error
+			expanded, err = s.redis.ExpandPages(ctx, pages, e, s.clock.Now(), window)
+			return err
+		})
+	}
+	if e.meta {
+		g.Go(func() error {
+			var err error
+			metas, err = s.meta.GetMetas(ctx, pages)
+			return err
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+
+	out := make([]*Expansions, len(pages))
+	for i := range pages {
+		out[i] = &Expansions{}
+		if expanded != nil {
+			out[i].Unique = expanded[i].unique
+			if e.rate {
+				out[i].Rate = &VisitRate{PerMinute: *expanded[i].rate, WindowMinutes: s.anomalies.window}
+			}
+			if e.annotations {
+				out[i].Annotations = &ExpandedAnnotations{Total: expanded[i].total, Recent: annotationResponses(c, expanded[i].annotations)}
+			}
+		}
+		if metas != nil {
+			meta := metas[i]
+			// As on /pages/:page/meta, webhook URLs often carry a token
+			meta.WebhookURL = ""
+			out[i].Meta = &meta
+		}
+	}
+	return out, nil
+}
+
+// pendingExpansion is a page's expansions being read in the background
+type pendingExpansion struct {
+	done     chan struct{}
+	expanded *Expansions
+	err      error
+}
+
+// startExpansion starts reading a page's enabled expansions while the
+// caller reads its counts, so the two overlap instead of adding their round
+// trips. It returns nil when no expansion is enabled.
+func (s *Server) startExpansion(c *gin.Context, page string, e expansions) *pendingExpansion {
+	if !e.any() {
+		return nil
+	}
+	pending := &pendingExpansion{done: make(chan struct{})}
+	// The handler keeps using c, so the goroutine reads a copy
+	copied := c.Copy()
+	go func() {
+		defer close(pending.done)
+		expanded, err := s.expandPages(copied, []string{page}, e)
+		if err != nil {
+			pending.err = err
+			return
+		}
+		pending.expanded = expanded[0]
+	}()
+	return pending
+}
+
+// wait returns the expansions once read
+func (p *pendingExpansion) wait() (*Expansions, error) {
+	<-p.done
+	return p.expanded, p.err
+}
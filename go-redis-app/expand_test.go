@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"go-redis-app/internal/clocktest"
+)
+
+// allExpandFlags enables every expansion
+var allExpandFlags = map[string]bool{"expand_unique": true, "expand_meta": true, "expand_rate": true, "expand_annotations": true}
+
+// newExpandServer starts a server recording minute buckets and seeds home
+// with 6 visits from 3 visitors, metadata and 12 annotations, a minute
+// before the clock
+func newExpandServer(t *testing.T, cfg Config) (*Server, http.Handler) {
+	t.Helper()
+	_, redisClient := newTestRedis(t)
+	clock := clocktest.New(time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC))
+	server := newTestServerWithClock(t, cfg, redisClient, clock)
+	router := server.Router()
+	for i := 0; i < 6; i++ {
+		visitFrom(router, "home", fmt.Sprintf("10.0.0.%d", i%3))
+	}
+	visitFrom(router, "about", "10.0.0.9")
+	meta := `{"title": "Home", "tags": ["landing"], "webhook_url": "https://hooks.example/secret"}`
+	if w := doRequest(router, "PUT", "/admin/pages/home/meta", meta, nil); w.Code != http.StatusOK {
+		t.Fatalf("Failed to set metadata: %d %s", w.Code, w.Body.String())
+	}
+	for i := 0; i < 12; i++ {
+		body := fmt.Sprintf(`{"timestamp": "2024-04-%02dT09:00:00Z", "label": "release %d"}`, i+1, i+1)
+		if w := doRequest(router, "POST", "/admin/pages/home/annotations", body, nil); w.Code != http.StatusCreated {
+			t.Fatalf("Failed to add an annotation: %d %s", w.Code, w.Body.String())
+		}
+	}
+	clock.Advance(time.Minute)
+	return server, router
+}
+
+// expandConfig records the minute buckets the rate is read from
+func expandConfig() Config {
+	cfg := testConfig()
+	cfg.AnomalyInterval, cfg.AnomalyWindow, cfg.AnomalyThreshold, cfg.AnomalyMinRate = time.Hour, 5*time.Minute, 10, 1
+	return cfg
+}
+
+// expandedKeys returns the keys of a response's expanded object, nil
+// without one
+func expandedKeys(t *testing.T, body []byte) []string {
+	t.Helper()
+	var raw struct {
+		Expanded map[string]json.RawMessage `json:"expanded"`
+	}
+	if err := json.Unmarshal(body, &raw); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if raw.Expanded == nil {
+		return nil
+	}
+	var keys []string
+	for _, name := range visitExpansions {
+		if _, ok := raw.Expanded[name]; ok {
+			keys = append(keys, name)
+		}
+	}
+	return keys
+}
+
+func TestExpandVisit(t *testing.T) {
+	server, router := newExpandServer(t, expandConfig())
+	server.flags.Set(context.Background(), allExpandFlags)
+
+	for _, expand := range []string{"unique", "meta", "rate", "annotations", "unique,rate", "meta,annotations", "unique,meta,rate,annotations"} {
+		t.Run(expand, func(t *testing.T) {
+			w := doRequest(router, "GET", "/visits/home?expand="+expand, "", nil)
+			if w.Code != http.StatusOK {
+				t.Fatalf("Expected 200, got %d %s", w.Code, w.Body.String())
+			}
+			if got := strings.Join(expandedKeys(t, w.Body.Bytes()), ","); got != expand {
+				t.Fatalf("Expected exactly %s expanded, got %s", expand, got)
+			}
+			resp := decodeVisit(t, w.Body.Bytes())
+			e := resp.Expanded
+			if resp.Visits != 6 {
+				t.Errorf("Expected the count alongside, got %d", resp.Visits)
+			}
+			if strings.Contains(expand, expandUnique) && *e.Unique != 3 {
+				t.Errorf("Expected 3 unique visitors, got %d", *e.Unique)
+			}
+			if strings.Contains(expand, expandMeta) && (e.Meta.Title != "Home" || e.Meta.Tags[0] != "landing" || e.Meta.WebhookURL != "") {
+				t.Errorf("Expected the metadata without its webhook, got %+v", *e.Meta)
+			}
+			if strings.Contains(expand, expandRate) && *e.Rate != (VisitRate{PerMinute: 1.2, WindowMinutes: 5}) {
+				t.Errorf("Expected 6 visits over 5 minutes, got %+v", *e.Rate)
+			}
+			if strings.Contains(expand, expandAnnotations) {
+				if a := e.Annotations; a.Total != 12 || len(a.Recent) != expandAnnotationsLimit || a.Recent[0].Label != "release 12" {
+					t.Errorf("Expected the 10 newest of 12 annotations, got %+v", *a)
+				}
+			}
+		})
+	}
+
+	// Expansions combine with ?include=, including the snapshot read
+	w := doRequest(router, "GET", "/visits/home?include=all&expand=rate", "", nil)
+	if resp := decodeVisit(t, w.Body.Bytes()); resp.Rank == nil || resp.Expanded == nil || resp.Expanded.Rate == nil {
+		t.Errorf("Expected the snapshot expanded, got %s", w.Body.String())
+	}
+}
+
+func TestExpandFlags(t *testing.T) {
+	server, router := newExpandServer(t, expandConfig())
+	ctx := context.Background()
+
+	// Every flag is off by default, so nothing is expanded
+	w := doRequest(router, "GET", "/visits/home?expand=unique,meta,rate,annotations", "", nil)
+	if w.Code != http.StatusOK || strings.Contains(w.Body.String(), "expanded") {
+		t.Fatalf("Expected no expansions without their flags, got %d %s", w.Code, w.Body.String())
+	}
+
+	server.flags.Set(ctx, map[string]bool{"expand_meta": true, "expand_annotations": true})
+	w = doRequest(router, "GET", "/visits/home?expand=unique,meta,rate,annotations", "", nil)
+	if got := strings.Join(expandedKeys(t, w.Body.Bytes()), ","); got != "meta,annotations" {
+		t.Errorf("Expected only the enabled expansions, got %s", w.Body.String())
+	}
+	if strings.Contains(w.Body.String(), "null") {
+		t.Errorf("Expected disabled expansions omitted, not null: %s", w.Body.String())
+	}
+
+	// Without ANOMALY_INTERVAL there are no minute buckets to read a rate from
+	server, router = newExpandServer(t, testConfig())
+	server.flags.Set(ctx, allExpandFlags)
+	w = doRequest(router, "GET", "/visits/home?expand=unique,rate", "", nil)
+	if got := strings.Join(expandedKeys(t, w.Body.Bytes()), ","); got != "unique" {
+		t.Errorf("Expected the rate left out, got %s", w.Body.String())
+	}
+}
+
+func TestExpandReadErrors(t *testing.T) {
+	server, router := newExpandServer(t, expandConfig())
+	server.flags.Set(context.Background(), allExpandFlags)
+
+	// Missing minute buckets read as 0, but a failed read queued after them
+	// still fails the request
+	server.redis.client.Set(context.Background(), annotationsKey("home"), "not a sorted set", 0)
+	if w := doRequest(router, "GET", "/visits/home?expand=rate,annotations", "", nil); w.Code < http.StatusInternalServerError {
+		t.Errorf("Expected a failed annotations read to fail the request, got %d %s", w.Code, w.Body.String())
+	}
+	if w := doRequest(router, "GET", "/visits/about?expand=rate,annotations", "", nil); w.Code != http.StatusOK {
+		t.Errorf("Expected missing minute buckets served, got %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestExpandValidation(t *testing.T) {
+	_, redisClient := newTestRedis(t)
+	router := newTestServer(t, testConfig(), redisClient).Router()
+
+	for _, tt := range []struct {
+		method, path, body string
+	}{
+		{"GET", "/visits/home?expand=unique,owner", ""},
+		{"GET", "/visits/home?expand=", ""},
+		{"GET", "/visits/home?expand=unique&view=compact", ""},
+		{"POST", "/visits/query?expand=history", `{"pages": ["home"]}`},
+	} {
+		w := doRequest(router, tt.method, tt.path, tt.body, nil)
+		if tt.path == "/visits/home?expand=" {
+			if w.Code != http.StatusOK {
+				t.Errorf("Expected an empty expand ignored, got %d", w.Code)
+			}
+			continue
+		}
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Expected 400 for %s %s, got %d", tt.method, tt.path, w.Code)
+			continue
+		}
+		if !strings.Contains(tt.path, "compact") && !strings.Contains(w.Body.String(), "valid: unique,meta,rate,annotations") {
+			t.Errorf("Expected the valid expansions listed, got %s", w.Body.String())
+		}
+	}
+}
+
+func TestQueryExpand(t *testing.T) {
+	server, router := newExpandServer(t, expandConfig())
+	server.flags.Set(context.Background(), allExpandFlags)
+
+	results := queryLines(t, router, []string{"home", "about", "nowhere"}, "?expand=unique,meta,annotations")
+	if len(results) != 3 {
+		t.Fatalf("Expected a line per page, got %+v", results)
+	}
+	home, about, nowhere := results[0].Expanded, results[1].Expanded, results[2].Expanded
+	if home == nil || *home.Unique != 3 || home.Meta.Title != "Home" || home.Annotations.Total != 12 || home.Rate != nil {
+		t.Errorf("Unexpected home expansions %+v", home)
+	}
+	if about == nil || *about.Unique != 1 || about.Meta.Visibility != visibilityPublic || about.Annotations.Total != 0 || len(about.Annotations.Recent) != 0 {
+		t.Errorf("Unexpected about expansions %+v", about)
+	}
+	if results[2].Status != http.StatusNotFound || nowhere != nil {
+		t.Errorf("Expected the missing page unexpanded, got %+v", results[2])
+	}
+
+	// Without expand the lines are unchanged
+	for _, result := range queryLines(t, router, []string{"home"}, "") {
+		if result.Expanded != nil {
+			t.Errorf("Expected no expansions, got %+v", result)
+		}
+	}
+}
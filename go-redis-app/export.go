@@ -0,0 +1,280 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+// Export formats, chosen by ?format=
+const (
+	exportFormatCSV   = "csv"
+	exportFormatJSONL = "jsonl"
+)
+
+const (
+	// exportChunkKeys is the number of daily buckets read per pipeline. A
+	// chunk holds at least one page, so a single page's range may exceed it.
+	exportChunkKeys = 1000
+
+	// exportMaxPages caps the pages listed with ?page=
+	exportMaxPages = 500
+)
+
+// HistoryRow is one row of a history export: a page's daily bucket. It is
+// also the JSONL schema: "page" (string), "date" (string, YYYY-MM-DD, UTC)
+// and "visits" (integer).
+type HistoryRow struct {
+	Page   string `json:"page"`
+	Date   string `json:"date"`
+	Visits int64  `json:"visits"`
+}
+
+// historyColumns is the CSV header, in HistoryRow order
+var historyColumns = []string{"page", "date", "visits"}
+
+// History reads the daily buckets of pages from from to to (inclusive days)
+// in one pipeline, in page then date order. Days without a bucket have no
+// row.
+func (r *RedisClient) History(ctx context.Context, pages []string, from, to time.Time) ([]HistoryRow, error) {
+	pipe := r.client.Pipeline()
+	var rows []HistoryRow
+	var cmds []*redis.StringCmd
+	for _, page := range pages {
+		for d := from; !d.After(to); d = d.AddDate(0, 0, 1) {
+			rows = append(rows, HistoryRow{Page: page, Date: d.Format(dayLayout)})
+			cmds = append(cmds, pipe.Get(ctx, dailyKey(page, d)))
+		}
+	}
+	if _, err := pipe.Exec(ctx); ignoreMissing(err) != nil {
+		return nil, err
+	}
+	found := rows[:0]
+	for i, cmd := range cmds {
+		n, err := cmd.Int64()
+		if isMissing(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		rows[i].Visits = n
+		found = append(found, rows[i])
+	}
+	return found, nil
+}
+
+// ScanHistory calls emit with the daily buckets from from to to of the
+// given pages, or of every page the leaderboard lists starting with prefix
+// when pages is empty. Pages are read a chunk of exportChunkKeys buckets at
+// a time, so memory stays bounded however many pages there are.
+func (r *RedisClient) ScanHistory(ctx context.Context, pages []string, prefix string, from, to time.Time, emit func([]HistoryRow) error) error {
+	days := int(to.Sub(from)/(24*time.Hour)) + 1
+	perChunk := max(1, exportChunkKeys/days)
+	read := func(pages []string) error {
+		for len(pages) > 0 {
+			n := min(perChunk, len(pages))
+			rows, err := r.History(ctx, pages[:n], from, to)
+			if err != nil {
+				return err
+			}
+			if len(rows) > 0 {
+				if err := emit(rows); err != nil {
+					return err
+				}
+			}
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			pages = pages[n:]
+		}
+		return nil
+	}
+	if len(pages) > 0 {
+		return read(pages)
+	}
+	return r.scanLeaderboard(ctx, prefix, read)
+}
+
+// acceptsGzip reports whether an Accept-Encoding header accepts gzip
+func acceptsGzip(header string) bool {
+	for _, part := range strings.Split(header, ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		if coding != "gzip" && coding != "*" {
+			continue
+		}
+		if value, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if q, err := strconv.ParseFloat(value, 64); err != nil || q <= 0 {
+				continue
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// historyWriter writes history rows in an export format
+type historyWriter interface {
+	write(HistoryRow) error
+	flush() error
+}
+
+type csvHistoryWriter struct{ w *csv.Writer }
+
+func (h csvHistoryWriter) write(row HistoryRow) error {
+	return h.w.Write([]string{row.Page, row.Date, strconv.FormatInt(row.Visits, 10)})
+}
+
+func (h csvHistoryWriter) flush() error {
+	h.w.Flush()
+	return h.w.Error()
+}
+
+type jsonlHistoryWriter struct{ enc *json.Encoder }
+
+func (h jsonlHistoryWriter) write(row HistoryRow) error { return h.enc.Encode(row) }
+func (h jsonlHistoryWriter) flush() error               { return nil }
+
+// handleExportHistory streams the daily buckets of every page, or of the
+// ?page= pages or those starting with ?prefix=, between the from and to
+// dates as CSV or JSONL rows, or with encoding=delta one DeltaSeries line
+// per page, gzipped when the client accepts it. Rows are written while
+// scanning, so large exports never buffer in memory.
+func (s *Server) handleExportHistory(c *gin.Context) {
+	delta, ok := historyEncoding(c)
+	if !ok {
+		return
+	}
+	format := c.DefaultQuery("format", exportFormatCSV)
+	if delta {
+		// One series per page only fits JSONL
+		format = c.DefaultQuery("format", exportFormatJSONL)
+	}
+	if format != exportFormatCSV && format != exportFormatJSONL {
+		respondError(c, http.StatusBadRequest, "invalid_request", fmt.Sprintf("format must be %q or %q", exportFormatCSV, exportFormatJSONL))
+		return
+	}
+	if delta && format != exportFormatJSONL {
+		respondError(c, http.StatusBadRequest, "invalid_request", fmt.Sprintf("encoding=%s needs format=%s", historyEncodingDelta, exportFormatJSONL))
+		return
+	}
+	from, to, ok := parseDayRange(c)
+	if !ok {
+		return
+	}
+	pages := c.QueryArray("page")
+	if len(pages) > exportMaxPages {
+		respondError(c, http.StatusBadRequest, "invalid_request", fmt.Sprintf("At most %d pages may be listed", exportMaxPages))
+		return
+	}
+	hidden, err := s.hiddenPages(c)
+	if err != nil {
+		log.Printf("Error loading private pages: %v", err)
+		respondStoreError(c, err, "Failed to export history")
+		return
+	}
+
+	ctx := c.Request.Context()
+	name := fmt.Sprintf("history-%s-%s.%s", from.Format(dayLayout), to.Format(dayLayout), format)
+	c.Header("Content-Disposition", `attachment; filename="`+name+`"`)
+	c.Writer.Header().Add("Vary", "Accept-Encoding")
+	if format == exportFormatCSV {
+		c.Header("Content-Type", "text/csv; charset=utf-8")
+	} else {
+		c.Header("Content-Type", "application/x-ndjson")
+	}
+	var out io.Writer = c.Writer
+	var gz *gzip.Writer
+	if acceptsGzip(c.GetHeader("Accept-Encoding")) {
+		c.Header("Content-Encoding", "gzip")
+		gz = gzip.NewWriter(c.Writer)
+		defer gz.Close()
+		out = gz
+	}
+	c.Status(http.StatusOK)
+
+	enc := json.NewEncoder(out)
+	var rows historyWriter = jsonlHistoryWriter{enc}
+	if format == exportFormatCSV {
+		w := csv.NewWriter(out)
+		w.Write(historyColumns)
+		rows = csvHistoryWriter{w}
+	}
+	// flush pushes the rows written so far to the client
+	flush := func() error {
+		if err := rows.flush(); err != nil {
+			return err
+		}
+		if gz != nil {
+			if err := gz.Flush(); err != nil {
+				return err
+			}
+		}
+		c.Writer.Flush()
+		// Stop scanning as soon as the client goes away
+		return ctx.Err()
+	}
+
+	unflushed := 0
+	written := func() error {
+		if unflushed++; unflushed == streamFlushEvery {
+			unflushed = 0
+			return flush()
+		}
+		return nil
+	}
+	err = s.redis.ScanHistory(ctx, pages, c.Query("prefix"), from, to, func(batch []HistoryRow) error {
+		if delta {
+			// A batch holds every row of its pages, in page order
+			for len(batch) > 0 {
+				n := 1
+				for n < len(batch) && batch[n].Page == batch[0].Page {
+					n++
+				}
+				page := batch[0].Page
+				if !hidden[page] {
+					if err := enc.Encode(NewDeltaSeries(page, from, denseDays(batch[:n], from, to))); err != nil {
+						return err
+					}
+					if err := written(); err != nil {
+						return err
+					}
+				}
+				batch = batch[n:]
+			}
+			return nil
+		}
+		for _, row := range batch {
+			if hidden[row.Page] {
+				continue
+			}
+			if err := rows.write(row); err != nil {
+				return err
+			}
+			if err := written(); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		if ctx.Err() == nil {
+			log.Printf("Error exporting history: %v", err)
+		}
+		// Headers are already sent, so the export simply ends early
+		return
+	}
+	flush()
+}
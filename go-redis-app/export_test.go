@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// seedHistory lists n pages named prefix000... on the leaderboard, each
+// with daily buckets for every day of January 2024 counting its day of the
+// month
+func seedHistory(t *testing.T, redisClient *RedisClient, prefix string, n int) {
+	t.Helper()
+	ctx := context.Background()
+	pipe := redisClient.client.Pipeline()
+	for i := 0; i < n; i++ {
+		page := fmt.Sprintf("%s%03d", prefix, i)
+		pipe.ZAdd(ctx, leaderboardKey, redis.Z{Member: page, Score: 31})
+		for day := 1; day <= 31; day++ {
+			pipe.Set(ctx, dailyKey(page, time.Date(2024, 1, day, 0, 0, 0, 0, time.UTC)), day, 0)
+		}
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAcceptsGzip(t *testing.T) {
+	tests := map[string]bool{
+		"":                     false,
+		"gzip":                 true,
+		"deflate, GZIP;q=0.5":  true,
+		"gzip;q=0":             false,
+		"br, *":                true,
+		"identity, gzip;q=bad": false,
+	}
+	for header, want := range tests {
+		if got := acceptsGzip(header); got != want {
+			t.Errorf("acceptsGzip(%q) = %v, want %v", header, got, want)
+		}
+	}
+}
+
+func TestExportHistoryCSV(t *testing.T) {
+	_, redisClient := newTestRedis(t)
+	// Enough pages and days to span several scan batches and pipelines
+	seedHistory(t, redisClient, "blog-", 450)
+	seedHistory(t, redisClient, "docs-", 3)
+	router := newTestServer(t, testConfig(), redisClient).Router()
+
+	// export reads a CSV export into its rows, header first
+	export := func(query string, headers map[string]string) ([][]string, *httptest.ResponseRecorder) {
+		t.Helper()
+		w := doRequest(router, "GET", "/export/history?"+query, "", headers)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected the export, got %d: %s", w.Code, w.Body.String())
+		}
+		records, err := csv.NewReader(w.Body).ReadAll()
+		if err != nil {
+			t.Fatalf("Expected CSV, got %v", err)
+		}
+		return records, w
+	}
+
+	records, w := export("format=csv&from=2024-01-10&to=2024-01-12", nil)
+	if ct := w.Header().Get("Content-Type"); ct != "text/csv; charset=utf-8" {
+		t.Errorf("Expected text/csv, got %q", ct)
+	}
+	if len(records) != 1+453*3 || strings.Join(records[0], ",") != "page,date,visits" {
+		t.Fatalf("Expected a header and 3 days of 453 pages, got %d rows starting %v", len(records), records[0])
+	}
+	days := make(map[string]int)
+	for _, r := range records[1:] {
+		days[r[1]]++
+		if day, _ := time.Parse(dayLayout, r[1]); r[2] != strconv.Itoa(day.Day()) {
+			t.Fatalf("Expected the day's count, got %v", r)
+		}
+	}
+	if days["2024-01-10"] != 453 || days["2024-01-12"] != 453 || len(days) != 3 {
+		t.Errorf("Expected both edges of the window included, got %v", days)
+	}
+
+	// The window may extend past the data: only existing buckets are rows
+	records, _ = export("from=2023-12-30&to=2024-01-01&prefix=docs-", nil)
+	if len(records) != 1+3 || records[1][0] != "docs-000" || records[1][1] != "2024-01-01" {
+		t.Errorf("Expected only January 1st of the docs pages, got %v", records)
+	}
+	records, _ = export("from=2024-01-31&to=2024-02-02&page=docs-001&page=blog-449", nil)
+	if len(records) != 1+2 || records[1][0] != "docs-001" || records[2][0] != "blog-449" || records[2][2] != "31" {
+		t.Errorf("Expected the last day of the listed pages, got %v", records)
+	}
+
+	// Gzip when accepted
+	w = doRequest(router, "GET", "/export/history?from=2024-01-01&to=2024-01-31&prefix=docs-", "", map[string]string{"Accept-Encoding": "gzip"})
+	if w.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("Expected a gzipped export, got headers %v", w.Header())
+	}
+	gz, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if records, err := csv.NewReader(gz).ReadAll(); err != nil || len(records) != 1+3*31 {
+		t.Errorf("Expected 93 gzipped rows, got %d, %v", len(records), err)
+	}
+}
+
+func TestExportHistoryJSONL(t *testing.T) {
+	_, redisClient := newTestRedis(t)
+	seedHistory(t, redisClient, "docs-", 2)
+	router := newTestServer(t, testConfig(), redisClient).Router()
+	doRequest(router, "PUT", "/admin/pages/docs-001/meta", `{"visibility": "private"}`, nil)
+
+	w := doRequest(router, "GET", "/export/history?format=jsonl&from=2024-01-30&to=2024-01-31", "", nil)
+	if ct := w.Header().Get("Content-Type"); ct != "application/x-ndjson" {
+		t.Errorf("Expected application/x-ndjson, got %q", ct)
+	}
+	var rows []map[string]interface{}
+	scanner := bufio.NewScanner(w.Body)
+	for scanner.Scan() {
+		var row map[string]interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &row); err != nil {
+			t.Fatalf("Invalid line %q: %v", scanner.Text(), err)
+		}
+		rows = append(rows, row)
+	}
+	// The private page is hidden, and rows have exactly the schema's fields
+	want := []map[string]interface{}{
+		{"page": "docs-000", "date": "2024-01-30", "visits": float64(30)},
+		{"page": "docs-000", "date": "2024-01-31", "visits": float64(31)},
+	}
+	if fmt.Sprint(rows) != fmt.Sprint(want) {
+		t.Errorf("Expected %v, got %v", want, rows)
+	}
+}
+
+func TestExportHistoryDelta(t *testing.T) {
+	_, redisClient := newTestRedis(t)
+	seedHistory(t, redisClient, "docs-", 2)
+	redisClient.client.ZAdd(context.Background(), leaderboardKey, redis.Z{Member: "quiet", Score: 0})
+	redisClient.client.Set(context.Background(), dailyKey("quiet", parseDay("2024-01-03")), 4, 0)
+	router := newTestServer(t, testConfig(), redisClient).Router()
+	doRequest(router, "PUT", "/admin/pages/docs-001/meta", `{"visibility": "private"}`, nil)
+
+	w := doRequest(router, "GET", "/export/history?encoding=delta&from=2024-01-01&to=2024-01-05", "", nil)
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/x-ndjson" {
+		t.Fatalf("Expected JSONL, got %d %q", w.Code, w.Header().Get("Content-Type"))
+	}
+	var series []DeltaSeries
+	scanner := bufio.NewScanner(w.Body)
+	for scanner.Scan() {
+		var s DeltaSeries
+		if err := json.Unmarshal(scanner.Bytes(), &s); err != nil {
+			t.Fatalf("Invalid line %q: %v", scanner.Text(), err)
+		}
+		series = append(series, s)
+	}
+	want := []DeltaSeries{
+		// Days without a bucket count 0
+		{Page: "quiet", Start: "2024-01-01", StartValue: 0, Deltas: []int64{0, 1, 4, -4, 0, 1}},
+		{Page: "docs-000", Start: "2024-01-01", StartValue: 1, Deltas: []int64{1, 1, 1, 1}},
+	}
+	if fmt.Sprint(series) != fmt.Sprint(want) {
+		t.Errorf("Expected %v, got %v", want, series)
+	}
+
+	if w := doRequest(router, "GET", "/export/history?encoding=delta&format=csv&from=2024-01-01&to=2024-01-05", "", nil); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected CSV rejected with delta, got %d", w.Code)
+	}
+}
+
+func TestExportHistoryValidation(t *testing.T) {
+	_, redisClient := newTestRedis(t)
+	router := newTestServer(t, testConfig(), redisClient).Router()
+	for _, query := range []string{
+		"from=2024-01-02&to=2024-01-01",
+		"from=2024-01-01",
+		"from=2024-01-01&to=2024-01-02&format=parquet",
+		"from=2024-01-01&to=2024-01-02&encoding=rle",
+		"from=2010-01-01&to=2024-01-01",
+		"from=2024-01-01&to=2024-01-02" + strings.Repeat("&page=x", exportMaxPages+1),
+	} {
+		if w := doRequest(router, "GET", "/export/history?"+query, "", nil); w.Code != http.StatusBadRequest {
+			t.Errorf("Expected 400 for %s, got %d", query[:min(len(query), 60)], w.Code)
+		}
+	}
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	flagsKey     = "flags"
+	flagsChannel = "flags-updated"
+)
+
+// FeatureMode is how a counting feature is applied. In shadow mode it
+// records what it would have done without affecting the counts.
+type FeatureMode string
+
+const (
+	ModeOff     FeatureMode = "off"
+	ModeShadow  FeatureMode = "shadow"
+	ModeEnforce FeatureMode = "enforce"
+)
+
+// parseFeatureMode parses a mode, accepting booleans for off and enforce
+func parseFeatureMode(value string) (FeatureMode, error) {
+	switch mode := FeatureMode(value); mode {
+	case ModeOff, ModeShadow, ModeEnforce:
+		return mode, nil
+	}
+	if enabled, err := strconv.ParseBool(value); err == nil {
+		if enabled {
+			return ModeEnforce, nil
+		}
+		return ModeOff, nil
+	}
+	return "", fmt.Errorf("must be %s, %s or %s", ModeOff, ModeShadow, ModeEnforce)
+}
+
+// FeatureModes holds the modes of the features that can run in shadow mode
+type FeatureModes struct {
+	BotFiltering FeatureMode `json:"bot_filtering"`
+	Dedupe       FeatureMode `json:"dedupe"`
+	Sampling     FeatureMode `json:"sampling"`
+}
+
+// defaultModes leaves bot filtering and dedupe off and applies per-page
+// sample rates, as before modes existed
+var defaultModes = FeatureModes{BotFiltering: ModeOff, Dedupe: ModeOff, Sampling: ModeEnforce}
+
+// Flags is an immutable snapshot of the runtime feature flags. BotFiltering
+// and Dedupe are set when their mode is enforce.
+type Flags struct {
+	BotFiltering bool         `json:"bot_filtering"`
+	Dedupe       bool         `json:"dedupe"`
+	Rollups      bool         `json:"rollups"`
+	Modes        FeatureModes `json:"modes"`
+
+	// The expand_ flags enable each ?expand= of the visit reads
+	ExpandUnique      bool `json:"expand_unique"`
+	ExpandMeta        bool `json:"expand_meta"`
+	ExpandRate        bool `json:"expand_rate"`
+	ExpandAnnotations bool `json:"expand_annotations"`
+}
+
+// flagFields maps boolean flag names to their field in a Flags snapshot
+var flagFields = map[string]func(*Flags) *bool{
+	"rollups":            func(f *Flags) *bool { return &f.Rollups },
+	"expand_unique":      func(f *Flags) *bool { return &f.ExpandUnique },
+	"expand_meta":        func(f *Flags) *bool { return &f.ExpandMeta },
+	"expand_rate":        func(f *Flags) *bool { return &f.ExpandRate },
+	"expand_annotations": func(f *Flags) *bool { return &f.ExpandAnnotations },
+}
+
+// modeFields maps the names of flags with a mode to their field
+var modeFields = map[string]func(*FeatureModes) *FeatureMode{
+	featureBotFiltering: func(m *FeatureModes) *FeatureMode { return &m.BotFiltering },
+	featureDedupe:       func(m *FeatureModes) *FeatureMode { return &m.Dedupe },
+	featureSampling:     func(m *FeatureModes) *FeatureMode { return &m.Sampling },
+}
+
+// isKnownFlag reports whether name is a boolean or mode flag
+func isKnownFlag(name string) bool {
+	_, isBool := flagFields[name]
+	_, isMode := modeFields[name]
+	return isBool || isMode
+}
+
+// knownFlagNames returns the sorted list of valid flag names
+func knownFlagNames() []string {
+	names := make([]string, 0, len(flagFields)+len(modeFields))
+	for name := range flagFields {
+		names = append(names, name)
+	}
+	for name := range modeFields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// parseFlagValue validates a stored or requested flag value
+func parseFlagValue(name, value string) error {
+	if _, ok := modeFields[name]; ok {
+		_, err := parseFeatureMode(value)
+		return err
+	}
+	if _, err := strconv.ParseBool(value); err != nil {
+		return fmt.Errorf("must be true or false")
+	}
+	return nil
+}
+
+// FlagStore keeps a local copy of the flags hash, refreshed on pub/sub
+// notifications and by a periodic fallback poll
+type FlagStore struct {
+	redis        *RedisClient
+	pollInterval time.Duration
+	current      atomic.Pointer[Flags]
+
+	// followers are refreshed along with the flags, set before Start
+	followers []func(context.Context) error
+}
+
+// NewFlagStore creates a flag store with the default flags
+func NewFlagStore(redisClient *RedisClient, pollInterval time.Duration) *FlagStore {
+	f := &FlagStore{redis: redisClient, pollInterval: pollInterval}
+	f.current.Store(&Flags{Modes: defaultModes})
+	return f
+}
+
+// Flags returns the current flag snapshot
+func (f *FlagStore) Flags() Flags {
+	return *f.current.Load()
+}
+
+// Refresh reloads the flags from Redis
+func (f *FlagStore) Refresh(ctx context.Context) error {
+	values, err := f.redis.client.HGetAll(ctx, flagsKey).Result()
+	if err != nil {
+		return err
+	}
+
+	flags := Flags{Modes: defaultModes}
+	for name, value := range values {
+		if field, ok := modeFields[name]; ok {
+			mode, err := parseFeatureMode(value)
+			if err != nil {
+				log.Printf("Ignoring invalid value %q for flag %s", value, name)
+				continue
+			}
+			*field(&flags.Modes) = mode
+			continue
+		}
+		field, ok := flagFields[name]
+		if !ok {
+			continue
+		}
+		enabled, err := strconv.ParseBool(value)
+		if err != nil {
+			log.Printf("Ignoring invalid value %q for flag %s", value, name)
+			continue
+		}
+		*field(&flags) = enabled
+	}
+	flags.BotFiltering = flags.Modes.BotFiltering == ModeEnforce
+	flags.Dedupe = flags.Modes.Dedupe == ModeEnforce
+
+	f.current.Store(&flags)
+	return nil
+}
+
+// Set stores boolean flag updates; for flags with a mode, true is enforce
+// and false is off
+func (f *FlagStore) Set(ctx context.Context, updates map[string]bool) (Flags, error) {
+	values := make(map[string]string, len(updates))
+	for name, enabled := range updates {
+		values[name] = strconv.FormatBool(enabled)
+	}
+	return f.SetValues(ctx, values)
+}
+
+// SetValues validates and stores flag updates given as booleans or modes,
+// then notifies the other replicas
+func (f *FlagStore) SetValues(ctx context.Context, updates map[string]string) (Flags, error) {
+	values := make(map[string]interface{}, len(updates))
+	for name, value := range updates {
+		if !isKnownFlag(name) {
+			return Flags{}, fmt.Errorf("unknown flag %q", name)
+		}
+		if err := parseFlagValue(name, value); err != nil {
+			return Flags{}, fmt.Errorf("flag %s: %w", name, err)
+		}
+		values[name] = value
+	}
+
+	if len(values) > 0 {
+		if err := f.redis.client.HSet(ctx, flagsKey, values).Err(); err != nil {
+			return Flags{}, err
+		}
+		if err := f.redis.client.Publish(ctx, flagsChannel, "").Err(); err != nil {
+			log.Printf("Failed to publish flag update: %v", err)
+		}
+	}
+
+	if err := f.Refresh(ctx); err != nil {
+		return Flags{}, err
+	}
+	return f.Flags(), nil
+}
+
+// follow refreshes refresh whenever the flags are, so settings published
+// on the flags channel share its subscription and poll
+func (f *FlagStore) follow(refresh func(context.Context) error) {
+	f.followers = append(f.followers, refresh)
+}
+
+// refreshAll reloads the flags and their followers, logging failures
+func (f *FlagStore) refreshAll(ctx context.Context) {
+	if err := f.Refresh(ctx); err != nil && ctx.Err() == nil {
+		log.Printf("Failed to refresh flags: %v", err)
+	}
+	for _, refresh := range f.followers {
+		if err := refresh(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("Failed to refresh settings with the flags: %v", err)
+		}
+	}
+}
+
+// Start loads the flags and subscribes to updates. The subscription is
+// confirmed before Start returns; refreshing continues until ctx is done.
+func (f *FlagStore) Start(ctx context.Context) error {
+	if err := f.Refresh(ctx); err != nil {
+		log.Printf("Failed to load flags: %v", err)
+	}
+	for _, refresh := range f.followers {
+		if err := refresh(ctx); err != nil {
+			log.Printf("Failed to load settings with the flags: %v", err)
+		}
+	}
+
+	pubsub := f.redis.client.Subscribe(ctx, flagsChannel)
+	if _, err := pubsub.Receive(ctx); err != nil {
+		pubsub.Close()
+		return err
+	}
+
+	go func() {
+		defer pubsub.Close()
+		ticker := time.NewTicker(f.pollInterval)
+		defer ticker.Stop()
+		messages := pubsub.Channel()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-messages:
+			case <-ticker.C:
+			}
+			f.refreshAll(ctx)
+		}
+	}()
+
+	return nil
+}
+
+// handleGetFlags returns the current flag values
+func (s *Server) handleGetFlags(c *gin.Context) {
+	c.JSON(http.StatusOK, s.flags.Flags())
+}
+
+// handlePutFlags updates one or more flags. Values are booleans, or for
+// bot_filtering, dedupe and sampling also "off", "shadow" or "enforce".
+func (s *Server) handlePutFlags(c *gin.Context) {
+	var body map[string]interface{}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		respondError(c, http.StatusBadRequest, "invalid_request", "Body must be a JSON object of flag names to booleans or modes")
+		return
+	}
+	updates := make(map[string]string, len(body))
+	for name, value := range body {
+		if !isKnownFlag(name) {
+			respondError(c, http.StatusBadRequest, "unknown_flag",
+				fmt.Sprintf("Unknown flag %q, valid flags: %v", name, knownFlagNames()))
+			return
+		}
+		switch v := value.(type) {
+		case bool:
+			updates[name] = strconv.FormatBool(v)
+		case string:
+			updates[name] = v
+		default:
+			updates[name] = ""
+		}
+		if err := parseFlagValue(name, updates[name]); err != nil {
+			respondError(c, http.StatusBadRequest, "invalid_request", fmt.Sprintf("Flag %s %v", name, err))
+			return
+		}
+	}
+
+	flags, err := s.flags.SetValues(c.Request.Context(), updates)
+	if err != nil {
+		log.Printf("Error updating flags: %v", err)
+		respondStoreError(c, err, "Failed to update flags")
+		return
+	}
+
+	c.JSON(http.StatusOK, flags)
+}
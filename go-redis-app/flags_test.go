@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func decodeVisit(t *testing.T, body []byte) VisitResponse {
+	t.Helper()
+	var resp VisitResponse
+	if err := json.Unmarshal(body, &resp); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	return resp
+}
+
+func TestFlagsPropagateAcrossRouters(t *testing.T) {
+	mr, _ := newTestRedis(t)
+	serverA := newTestServer(t, testConfig(), newTestRedisClient(t, mr))
+	serverB := newTestServer(t, testConfig(), newTestRedisClient(t, mr))
+	routerA, routerB := serverA.Router(), serverB.Router()
+
+	botUA := map[string]string{"User-Agent": "Googlebot/2.1"}
+
+	// Bot visits are counted while the flag is off
+	w := doRequest(routerB, "GET", "/visit/home", "", botUA)
+	if resp := decodeVisit(t, w.Body.Bytes()); resp.Visits != 1 || !*resp.Counted {
+		t.Fatalf("Expected counted bot visit, got %+v", resp)
+	}
+
+	w = doRequest(routerA, "PUT", "/admin/flags", `{"bot_filtering": true}`, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// The poll interval is an hour, so only pub/sub can refresh router B
+	waitFor(t, 2*time.Second, func() bool { return serverB.flags.Flags().BotFiltering })
+
+	w = doRequest(routerB, "GET", "/visit/home", "", botUA)
+	if resp := decodeVisit(t, w.Body.Bytes()); resp.Visits != 1 || *resp.Counted {
+		t.Errorf("Expected bot visit to be filtered, got %+v", resp)
+	}
+
+	w = doRequest(routerB, "GET", "/visit/home", "", map[string]string{"User-Agent": "Mozilla/5.0"})
+	if resp := decodeVisit(t, w.Body.Bytes()); resp.Visits != 2 || !*resp.Counted {
+		t.Errorf("Expected browser visit to be counted, got %+v", resp)
+	}
+}
+
+func TestPutFlagsRejectsUnknownFlag(t *testing.T) {
+	_, redisClient := newTestRedis(t)
+	router := newTestServer(t, testConfig(), redisClient).Router()
+
+	w := doRequest(router, "PUT", "/admin/flags", `{"dedupe": true, "teleport": true}`, nil)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("Expected 400, got %d", w.Code)
+	}
+
+	w = doRequest(router, "GET", "/admin/flags", "", nil)
+	var flags Flags
+	if err := json.Unmarshal(w.Body.Bytes(), &flags); err != nil {
+		t.Fatalf("Failed to decode flags: %v", err)
+	}
+	if flags.Dedupe {
+		t.Error("Expected rejected update to leave dedupe disabled")
+	}
+}
+
+func TestFlagsPollFallback(t *testing.T) {
+	mr, redisClient := newTestRedis(t)
+	cfg := testConfig()
+	cfg.FlagsPollInterval = 20 * time.Millisecond
+	server := newTestServer(t, cfg, redisClient)
+
+	// Written directly without a pub/sub notification
+	mr.HSet(flagsKey, "rollups", "true")
+	waitFor(t, 2*time.Second, func() bool { return server.flags.Flags().Rollups })
+}
+
+func TestDedupeAndRollupFlags(t *testing.T) {
+	mr, redisClient := newTestRedis(t)
+	router := newTestServer(t, testConfig(), redisClient).Router()
+
+	doRequest(router, "PUT", "/admin/flags", `{"dedupe": true, "rollups": true}`, nil)
+
+	w := doRequest(router, "GET", "/visit/pricing", "", nil)
+	if resp := decodeVisit(t, w.Body.Bytes()); resp.Visits != 1 || !*resp.Counted {
+		t.Fatalf("Expected first visit to count, got %+v", resp)
+	}
+	w = doRequest(router, "GET", "/visit/pricing", "", nil)
+	if resp := decodeVisit(t, w.Body.Bytes()); resp.Visits != 1 || *resp.Counted {
+		t.Errorf("Expected repeat visit to be deduped, got %+v", resp)
+	}
+
+	if got, _ := mr.Get(dailyKey("pricing", time.Now())); got != "1" {
+		t.Errorf("Expected daily bucket of 1, got %q", got)
+	}
+}
+
+func TestAdminRequiresAPIKey(t *testing.T) {
+	_, redisClient := newTestRedis(t)
+	cfg := testConfig()
+	cfg.AdminAPIKeys = map[string]string{"secret": "ops"}
+	router := newTestServer(t, cfg, redisClient).Router()
+
+	if w := doRequest(router, "GET", "/admin/flags", "", nil); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 without key, got %d", w.Code)
+	}
+	if w := doRequest(router, "GET", "/admin/flags", "", map[string]string{"X-API-Key": "secret"}); w.Code != http.StatusOK {
+		t.Errorf("Expected 200 with key, got %d", w.Code)
+	}
+}
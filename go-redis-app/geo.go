@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// unknownCountry is the bucket of visits whose country was not resolved
+const unknownCountry = "unknown"
+
+// countryHeaders are the CDN headers carrying the viewer's country, in the
+// order they are tried: CloudFront, then Cloudflare
+var countryHeaders = []string{"CloudFront-Viewer-Country", "CF-IPCountry"}
+
+// GeoResolver maps a request to the ISO 3166-1 alpha-2 code of the client's
+// country, returning "" when it cannot tell. clientIP is the address after
+// TRUSTED_PROXIES are applied.
+type GeoResolver interface {
+	Country(r *http.Request, clientIP string) string
+}
+
+// HeaderGeoResolver reads the country a CDN put in the request headers. It
+// must only be used behind that CDN, since clients can set the headers too.
+type HeaderGeoResolver struct{}
+
+// Country implements GeoResolver
+func (HeaderGeoResolver) Country(r *http.Request, _ string) string {
+	return countryFromHeaders(r.Header)
+}
+
+// countryFromHeaders returns the first valid country code in the CDN
+// headers. Cloudflare's XX (unknown) and T1 (Tor) are not countries.
+func countryFromHeaders(h http.Header) string {
+	for _, name := range countryHeaders {
+		if code := normalizeCountry(h.Get(name)); code != "" {
+			return code
+		}
+	}
+	return ""
+}
+
+// normalizeCountry uppercases an alpha-2 country code, returning "" for
+// anything else
+func normalizeCountry(code string) string {
+	code = strings.ToUpper(strings.TrimSpace(code))
+	if len(code) != 2 || code[0] < 'A' || code[0] > 'Z' || code[1] < 'A' || code[1] > 'Z' {
+		return ""
+	}
+	if code == "XX" || code == "T1" {
+		return ""
+	}
+	return code
+}
+
+// MaxMindGeoResolver looks the client IP up in a MaxMind GeoIP2 or GeoLite2
+// country (or city) database
+type MaxMindGeoResolver struct {
+	db *maxminddb.Reader
+}
+
+// maxMindRecord is the part of a MaxMind record holding the country
+type maxMindRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+}
+
+// NewMaxMindGeoResolver opens the database at path
+func NewMaxMindGeoResolver(path string) (*MaxMindGeoResolver, error) {
+	db, err := maxminddb.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &MaxMindGeoResolver{db: db}, nil
+}
+
+// Country implements GeoResolver
+func (m *MaxMindGeoResolver) Country(_ *http.Request, clientIP string) string {
+	ip := net.ParseIP(clientIP)
+	if ip == nil {
+		return ""
+	}
+	var record maxMindRecord
+	if err := m.db.Lookup(ip, &record); err != nil {
+		return ""
+	}
+	return normalizeCountry(record.Country.ISOCode)
+}
+
+// Close releases the database
+func (m *MaxMindGeoResolver) Close() error {
+	return m.db.Close()
+}
+
+// GeoChain tries each resolver in turn, returning the first country found
+type GeoChain []GeoResolver
+
+// Country implements GeoResolver
+func (g GeoChain) Country(r *http.Request, clientIP string) string {
+	for _, resolver := range g {
+		if code := resolver.Country(r, clientIP); code != "" {
+			return code
+		}
+	}
+	return ""
+}
+
+// NewGeoResolverFromConfig builds the resolver for GEOIP_HEADERS and
+// GEOIP_DB_PATH, the CDN headers taking precedence over the database. It
+// returns nil, disabling the country breakdown, when neither is set.
+func NewGeoResolverFromConfig(cfg Config) (GeoResolver, error) {
+	var chain GeoChain
+	if cfg.GeoIPHeaders {
+		chain = append(chain, HeaderGeoResolver{})
+	}
+	if cfg.GeoIPDBPath != "" {
+		db, err := NewMaxMindGeoResolver(cfg.GeoIPDBPath)
+		if err != nil {
+			return nil, fmt.Errorf("opening GEOIP_DB_PATH: %w", err)
+		}
+		chain = append(chain, db)
+	}
+	if len(chain) == 0 {
+		return nil, nil
+	}
+	return chain, nil
+}
+
+// visitCountry returns the country bucket to count a visit in, or "" when
+// the country breakdown is disabled
+func (s *Server) visitCountry(c *gin.Context) string {
+	return s.requestCountry(c.Request, c.ClientIP())
+}
+
+// requestCountry is visitCountry for a request from ip
+func (s *Server) requestCountry(r *http.Request, ip string) string {
+	if s.geo == nil {
+		return ""
+	}
+	if code := s.geo.Country(r, ip); code != "" {
+		return code
+	}
+	return unknownCountry
+}
+
+// geoKey returns the hash of a page's visits by country
+func geoKey(page string) string {
+	return key("visits", "geo", page)
+}
+
+// CountryCount is a country's share of a page's visits
+type CountryCount struct {
+	Country string  `json:"country"`
+	Visits  int64   `json:"visits"`
+	Percent float64 `json:"percent"`
+}
+
+// CountriesResponse is a page's visits by country
+type CountriesResponse struct {
+	Page      string         `json:"page"`
+	Total     int64          `json:"total"`
+	Countries []CountryCount `json:"countries"`
+}
+
+// PageCountries returns a page's visits by country, most visited first,
+// with percentages of the counted total rounded to two decimals
+func (r *RedisClient) PageCountries(ctx context.Context, page string) (CountriesResponse, error) {
+	fields, err := r.client.HGetAll(ctx, geoKey(page)).Result()
+	if err != nil {
+		return CountriesResponse{}, err
+	}
+	response := CountriesResponse{Page: page, Countries: make([]CountryCount, 0, len(fields))}
+	for country, value := range fields {
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return CountriesResponse{}, fmt.Errorf("country %s: %w", country, err)
+		}
+		response.Total += n
+		response.Countries = append(response.Countries, CountryCount{Country: country, Visits: n})
+	}
+	for i := range response.Countries {
+		if response.Total > 0 {
+			response.Countries[i].Percent = math.Round(float64(response.Countries[i].Visits)*10000/float64(response.Total)) / 100
+		}
+	}
+	sort.Slice(response.Countries, func(i, j int) bool {
+		a, b := response.Countries[i], response.Countries[j]
+		if a.Visits != b.Visits {
+			return a.Visits > b.Visits
+		}
+		return a.Country < b.Country
+	})
+	return response, nil
+}
+
+// handleGetCountries returns a page's visits by country
+func (s *Server) handleGetCountries(c *gin.Context) {
+	page := c.Param("page")
+	hidden, err := s.pageHidden(c, page)
+	if err != nil {
+		log.Printf("Error getting page metadata: %v", err)
+		respondStoreError(c, err, "Failed to get countries")
+		return
+	}
+	if hidden {
+		respondError(c, http.StatusNotFound, "not_found", "Page not found")
+		return
+	}
+
+	response, err := s.redis.PageCountries(c.Request.Context(), page)
+	if err != nil {
+		log.Printf("Error getting countries: %v", err)
+		respondStoreError(c, err, "Failed to get countries")
+		return
+	}
+	respondJSON(c, http.StatusOK, response)
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"testing"
+)
+
+// fakeGeo resolves countries from a table keyed by client IP, or by the
+// X-Test-Visitor header when set
+type fakeGeo map[string]string
+
+func (f fakeGeo) Country(r *http.Request, clientIP string) string {
+	if visitor := r.Header.Get("X-Test-Visitor"); visitor != "" {
+		return f[visitor]
+	}
+	return f[clientIP]
+}
+
+func TestCountryFromHeaders(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers map[string]string
+		want    string
+	}{
+		{"none", nil, ""},
+		{"cloudfront", map[string]string{"CloudFront-Viewer-Country": "US"}, "US"},
+		{"cloudflare", map[string]string{"CF-IPCountry": "DE"}, "DE"},
+		{"lowercase", map[string]string{"CF-IPCountry": "fr"}, "FR"},
+		{"whitespace", map[string]string{"CloudFront-Viewer-Country": " gb "}, "GB"},
+		{"header name case", map[string]string{"cf-ipcountry": "JP"}, "JP"},
+		{"cloudfront first", map[string]string{"CloudFront-Viewer-Country": "CA", "CF-IPCountry": "MX"}, "CA"},
+		{"invalid cloudfront falls back", map[string]string{"CloudFront-Viewer-Country": "???", "CF-IPCountry": "MX"}, "MX"},
+		{"cloudflare unknown", map[string]string{"CF-IPCountry": "XX"}, ""},
+		{"cloudflare tor", map[string]string{"CF-IPCountry": "T1"}, ""},
+		{"empty", map[string]string{"CF-IPCountry": ""}, ""},
+		{"alpha-3", map[string]string{"CF-IPCountry": "USA"}, ""},
+		{"one letter", map[string]string{"CF-IPCountry": "U"}, ""},
+		{"digits", map[string]string{"CF-IPCountry": "12"}, ""},
+		{"non-ascii", map[string]string{"CF-IPCountry": "ÜS"}, ""},
+		{"injection", map[string]string{"CF-IPCountry": "U:S"}, ""},
+	}
+	for _, tt := range tests {
+		h := http.Header{}
+		for name, value := range tt.headers {
+			h.Set(name, value)
+		}
+		if got := countryFromHeaders(h); got != tt.want {
+			t.Errorf("%s: countryFromHeaders(%v) = %q, want %q", tt.name, tt.headers, got, tt.want)
+		}
+	}
+}
+
+func TestGeoChain(t *testing.T) {
+	chain := GeoChain{HeaderGeoResolver{}, fakeGeo{"203.0.113.7": "NL"}}
+	req, _ := http.NewRequest("GET", "/visit/home", nil)
+	if got := chain.Country(req, "203.0.113.7"); got != "NL" {
+		t.Errorf("Expected the fallback resolver without headers, got %q", got)
+	}
+	req.Header.Set("CF-IPCountry", "BE")
+	if got := chain.Country(req, "203.0.113.7"); got != "BE" {
+		t.Errorf("Expected the headers to take precedence, got %q", got)
+	}
+	if got := chain.Country(&http.Request{Header: http.Header{}}, "198.51.100.1"); got != "" {
+		t.Errorf("Expected no country, got %q", got)
+	}
+}
+
+func TestNewGeoResolverFromConfig(t *testing.T) {
+	if geo, err := NewGeoResolverFromConfig(testConfig()); geo != nil || err != nil {
+		t.Errorf("Expected no resolver by default, got %v, %v", geo, err)
+	}
+	cfg := testConfig()
+	cfg.GeoIPHeaders = true
+	if geo, err := NewGeoResolverFromConfig(cfg); err != nil || geo == nil {
+		t.Errorf("Expected the header resolver, got %v, %v", geo, err)
+	}
+	cfg.GeoIPDBPath = filepath.Join(t.TempDir(), "missing.mmdb")
+	if _, err := NewGeoResolverFromConfig(cfg); err == nil {
+		t.Error("Expected an error for a missing GEOIP_DB_PATH")
+	}
+}
+
+func TestPageCountries(t *testing.T) {
+	mr, redisClient := newTestRedis(t)
+	geo := fakeGeo{"alice": "US", "bob": "DE"}
+	router := newTestServerWithGeo(t, testConfig(), redisClient, geo).Router()
+	for _, visitor := range []string{"alice", "alice", "alice", "bob", "carol"} {
+		doRequest(router, "GET", "/visit/pricing", "", map[string]string{"X-Test-Visitor": visitor})
+	}
+	if got := mr.HGet(geoKey("pricing"), "US"); got != "3" {
+		t.Fatalf("Expected 3 US visits in %s, got %q", geoKey("pricing"), got)
+	}
+
+	w := doRequest(router, "GET", "/visits/pricing/countries", "", nil)
+	var resp CountriesResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("Expected the country breakdown, got %d: %s", w.Code, w.Body.String())
+	}
+	if resp.Total != 5 || len(resp.Countries) != 3 {
+		t.Fatalf("Expected 5 visits over 3 buckets, got %+v", resp)
+	}
+	want := []CountryCount{{"US", 3, 60}, {"DE", 1, 20}, {unknownCountry, 1, 20}}
+	for i, c := range want {
+		if resp.Countries[i] != c {
+			t.Errorf("Expected %+v at %d, got %+v", c, i, resp.Countries[i])
+		}
+	}
+
+	// Pages without geo data have an empty breakdown
+	w = doRequest(router, "GET", "/visits/home/countries", "", nil)
+	if w.Code != http.StatusOK || w.Body.String() != `{"page":"home","total":0,"countries":[]}` {
+		t.Errorf("Expected an empty breakdown, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestPageCountriesPercentRounding(t *testing.T) {
+	mr, redisClient := newTestRedis(t)
+	mr.HSet(geoKey("docs"), "US", "1", "DE", "1", "FR", "1")
+
+	resp, err := redisClient.PageCountries(context.Background(), "docs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range resp.Countries {
+		if c.Percent != 33.33 {
+			t.Errorf("Expected 33.33%% for %s, got %v", c.Country, c.Percent)
+		}
+	}
+	if resp.Countries[0].Country != "DE" {
+		t.Errorf("Expected ties ordered by country code, got %+v", resp.Countries)
+	}
+}
+
+func TestGeoDisabled(t *testing.T) {
+	mr, redisClient := newTestRedis(t)
+	router := newTestServer(t, testConfig(), redisClient).Router()
+	doRequest(router, "GET", "/visit/pricing", "", map[string]string{"CF-IPCountry": "US"})
+	if mr.Exists(geoKey("pricing")) {
+		t.Error("Expected no country tracking without a resolver")
+	}
+}
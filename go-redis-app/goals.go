@@ -0,0 +1,285 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+const defaultGoalWindow = time.Hour
+
+// goalNamePattern restricts goal names to safe key segments
+var goalNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// goalsKey is the set of defined goal names
+const goalsKey = "goals"
+
+// goalScript attributes a visit to the goals whose source or target is the
+// page: target visits convert visitors with a live source marker, and source
+// visits start an attribution window.
+//
+// KEYS[2i-1] the visitor's source marker of goal i, KEYS[2i] its
+// conversions counter for a target page or sources counter for a source
+// page; ARGV[1] current Unix time (stored in source markers), ARGV[i+1] the
+// window in seconds of goal i for a source page, empty for a target page
+var goalScript = redis.NewScript(`
+for i = 1, #KEYS / 2 do
+	local marker, counter, window = KEYS[2 * i - 1], KEYS[2 * i], ARGV[i + 1]
+	if window == '' then
+		if redis.call('DEL', marker) == 1 then
+			redis.call('INCR', counter)
+		end
+	elseif redis.call('SET', marker, ARGV[1], 'NX', 'EX', window) then
+		redis.call('INCR', counter)
+	end
+end
+return 0
+`)
+
+// Goal is a conversion from visiting one page to later visiting another
+type Goal struct {
+	Name       string `json:"name"`
+	SourcePage string `json:"source_page"`
+	TargetPage string `json:"target_page"`
+	Window     string `json:"window,omitempty"`
+}
+
+// GoalStats reports a goal's conversions
+type GoalStats struct {
+	Goal
+	Sources     int64   `json:"sources"`
+	Conversions int64   `json:"conversions"`
+	Rate        float64 `json:"rate"`
+}
+
+// goalKey returns the definition key for a goal
+func goalKey(name string) string {
+	return fmt.Sprintf("goals:%s", name)
+}
+
+// pageGoal is a goal a page takes part in, as its source or its target
+type pageGoal struct {
+	Name   string
+	Source bool
+	Window time.Duration
+}
+
+// queueGoals queues attributing a visit to goals, returning the script, nil
+// when there are none
+func queueGoals(ctx context.Context, pipe redis.Pipeliner, goals []pageGoal, visitor string, now time.Time) *queuedScript {
+	if len(goals) == 0 {
+		return nil
+	}
+	keys := make([]string, 0, 2*len(goals))
+	args := make([]any, 1, len(goals)+1)
+	args[0] = now.Unix()
+	for _, goal := range goals {
+		if goal.Source {
+			keys = append(keys, goalKey(goal.Name)+":src:"+visitor, goalKey(goal.Name)+":sources")
+			args = append(args, int64(goal.Window/time.Second))
+		} else {
+			keys = append(keys, goalKey(goal.Name)+":src:"+visitor, goalKey(goal.Name)+":conversions")
+			args = append(args, "")
+		}
+	}
+	return queueScript(ctx, pipe, goalScript, keys, args...)
+}
+
+// errGoalExists is returned when creating a goal whose name is taken
+var errGoalExists = newKindError(ErrConflict, "goal already exists")
+
+// errGoalNotFound is returned for goals that are not defined
+var errGoalNotFound = newKindError(ErrNotFound, "goal not found")
+
+// CreateGoal stores a goal definition and indexes it by name and by source
+// and target page. The definition is WATCHed, so of two creations of one
+// name only the first succeeds.
+func (r *RedisClient) CreateGoal(ctx context.Context, goal Goal, window time.Duration) error {
+	err := r.client.Watch(ctx, func(tx *redis.Tx) error {
+		exists, err := tx.Exists(ctx, goalKey(goal.Name)).Result()
+		if err != nil {
+			return err
+		}
+		if exists > 0 {
+			return errGoalExists
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.HSet(ctx, goalKey(goal.Name),
+				"source_page", goal.SourcePage,
+				"target_page", goal.TargetPage,
+				"window", int64(window/time.Second),
+			)
+			pipe.SAdd(ctx, goalsKey, goal.Name)
+			pipe.SAdd(ctx, "goals:by-source:"+goal.SourcePage, goal.Name)
+			pipe.SAdd(ctx, "goals:by-target:"+goal.TargetPage, goal.Name)
+			return nil
+		})
+		return err
+	}, goalKey(goal.Name))
+	if errors.Is(err, redis.TxFailedErr) {
+		return errGoalExists
+	}
+	return err
+}
+
+// LoadGoals returns the goals of every page with one, by page
+func (r *RedisClient) LoadGoals(ctx context.Context) (map[string][]pageGoal, error) {
+	names, err := r.client.SMembers(ctx, goalsKey).Result()
+	if err != nil {
+		return nil, err
+	}
+	pipe := r.client.Pipeline()
+	defs := make([]*redis.MapStringStringCmd, len(names))
+	for i, name := range names {
+		defs[i] = pipe.HGetAll(ctx, goalKey(name))
+	}
+	if len(names) > 0 {
+		if _, err := pipe.Exec(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	goals := make(map[string][]pageGoal)
+	for i, name := range names {
+		def := defs[i].Val()
+		if len(def) == 0 {
+			continue
+		}
+		seconds, err := strconv.ParseInt(def["window"], 10, 64)
+		if err != nil {
+			seconds = int64(defaultGoalWindow / time.Second)
+		}
+		window := time.Duration(seconds) * time.Second
+		goals[def["source_page"]] = append(goals[def["source_page"]], pageGoal{Name: name, Source: true, Window: window})
+		goals[def["target_page"]] = append(goals[def["target_page"]], pageGoal{Name: name})
+	}
+	return goals, nil
+}
+
+// GoalStore keeps a local copy of the goals by page, so a visit knows the
+// keys of its goals, refreshed with the flags on their pub/sub
+// notifications and poll
+type GoalStore struct {
+	redis   *RedisClient
+	current atomic.Pointer[map[string][]pageGoal]
+}
+
+// NewGoalStore creates a goal store with no goals
+func NewGoalStore(redisClient *RedisClient) *GoalStore {
+	g := &GoalStore{redis: redisClient}
+	g.current.Store(&map[string][]pageGoal{})
+	return g
+}
+
+// ForPage returns the goals whose source or target is page
+func (g *GoalStore) ForPage(page string) []pageGoal {
+	return (*g.current.Load())[page]
+}
+
+// Refresh reloads the goals from Redis
+func (g *GoalStore) Refresh(ctx context.Context) error {
+	goals, err := g.redis.LoadGoals(ctx)
+	if err != nil {
+		return err
+	}
+	g.current.Store(&goals)
+	return nil
+}
+
+// GetGoalStats returns a goal with its counts, or errGoalNotFound if it is
+// undefined
+func (r *RedisClient) GetGoalStats(ctx context.Context, name string) (GoalStats, error) {
+	pipe := r.client.Pipeline()
+	def := pipe.HGetAll(ctx, goalKey(name))
+	sources := pipe.Get(ctx, goalKey(name)+":sources")
+	conversions := pipe.Get(ctx, goalKey(name)+":conversions")
+	if _, err := pipe.Exec(ctx); ignoreMissing(err) != nil {
+		return GoalStats{}, err
+	}
+	if len(def.Val()) == 0 {
+		return GoalStats{}, errGoalNotFound
+	}
+
+	seconds, _ := strconv.ParseInt(def.Val()["window"], 10, 64)
+	stats := GoalStats{Goal: Goal{
+		Name:       name,
+		SourcePage: def.Val()["source_page"],
+		TargetPage: def.Val()["target_page"],
+		Window:     (time.Duration(seconds) * time.Second).String(),
+	}}
+	stats.Sources, _ = sources.Int64()
+	stats.Conversions, _ = conversions.Int64()
+	if stats.Sources > 0 {
+		stats.Rate = float64(stats.Conversions) / float64(stats.Sources)
+	}
+	return stats, nil
+}
+
+// handleCreateGoal defines a new goal
+func (s *Server) handleCreateGoal(c *gin.Context) {
+	var goal Goal
+	if err := c.ShouldBindJSON(&goal); err != nil {
+		respondError(c, http.StatusBadRequest, "invalid_request", "Body must be a goal object")
+		return
+	}
+	if !goalNamePattern.MatchString(goal.Name) {
+		respondError(c, http.StatusBadRequest, "invalid_request", "name must be 1-64 letters, digits, '_' or '-'")
+		return
+	}
+	if goal.SourcePage == "" || goal.TargetPage == "" || goal.SourcePage == goal.TargetPage {
+		respondError(c, http.StatusBadRequest, "invalid_request", "source_page and target_page must be different pages")
+		return
+	}
+	window := defaultGoalWindow
+	if goal.Window != "" {
+		d, err := time.ParseDuration(goal.Window)
+		if err != nil || d < time.Second {
+			respondError(c, http.StatusBadRequest, "invalid_request", "window must be a duration of at least 1s")
+			return
+		}
+		window = d
+	}
+	goal.Window = window.String()
+
+	err := s.redis.CreateGoal(c.Request.Context(), goal, window)
+	if errors.Is(err, errGoalExists) {
+		respondError(c, http.StatusConflict, "conflict", "A goal with this name already exists")
+		return
+	}
+	if err != nil {
+		log.Printf("Error creating goal: %v", err)
+		respondStoreError(c, err, "Failed to create goal")
+		return
+	}
+	if err := s.redis.client.Publish(c.Request.Context(), flagsChannel, "").Err(); err != nil {
+		log.Printf("Failed to publish goal update: %v", err)
+	}
+	if err := s.goals.Refresh(c.Request.Context()); err != nil {
+		log.Printf("Failed to refresh goals: %v", err)
+	}
+	c.JSON(http.StatusCreated, goal)
+}
+
+// handleGetGoal returns a goal's source count, conversions, and rate
+func (s *Server) handleGetGoal(c *gin.Context) {
+	stats, err := s.redis.GetGoalStats(c.Request.Context(), c.Param("name"))
+	if errors.Is(err, errGoalNotFound) {
+		respondError(c, http.StatusNotFound, "not_found", "Goal not found")
+		return
+	}
+	if err != nil {
+		log.Printf("Error getting goal: %v", err)
+		respondStoreError(c, err, "Failed to get goal")
+		return
+	}
+	respondJSON(c, http.StatusOK, stats)
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func visitAs(h http.Handler, vid, page string) {
+	req := httptest.NewRequest("GET", "/visit/"+page, nil)
+	req.AddCookie(&http.Cookie{Name: visitorCookieName, Value: vid})
+	h.ServeHTTP(httptest.NewRecorder(), req)
+}
+
+func getGoal(t *testing.T, h http.Handler, name string) GoalStats {
+	t.Helper()
+	w := doRequest(h, "GET", "/goals/"+name, "", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var stats GoalStats
+	if err := json.Unmarshal(w.Body.Bytes(), &stats); err != nil {
+		t.Fatalf("Failed to decode goal: %v", err)
+	}
+	return stats
+}
+
+func TestGoalConversions(t *testing.T) {
+	mr, redisClient := newTestRedis(t)
+	router := newTestServer(t, testConfig(), redisClient).Router()
+
+	w := doRequest(router, "POST", "/goals", `{"name": "signup", "source_page": "pricing", "target_page": "signup-complete", "window": "30m"}`, nil)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected 201, got %d: %s", w.Code, w.Body.String())
+	}
+
+	alice, _ := newVisitorID()
+	bob, _ := newVisitorID()
+	carol, _ := newVisitorID()
+	dave, _ := newVisitorID()
+
+	// Alice converts, visiting pricing twice first
+	visitAs(router, alice, "pricing")
+	visitAs(router, alice, "pricing")
+	visitAs(router, alice, "signup-complete")
+	// A second target visit is not a second conversion
+	visitAs(router, alice, "signup-complete")
+
+	// Bob reaches the target without the source
+	visitAs(router, bob, "signup-complete")
+
+	// Carol's attribution window expires before she signs up
+	visitAs(router, carol, "pricing")
+	mr.FastForward(31 * time.Minute)
+	visitAs(router, carol, "signup-complete")
+
+	// Dave only browses
+	visitAs(router, dave, "pricing")
+
+	stats := getGoal(t, router, "signup")
+	if stats.Sources != 3 || stats.Conversions != 1 {
+		t.Errorf("Expected 3 sources and 1 conversion, got %+v", stats)
+	}
+	if stats.Rate < 0.333 || stats.Rate > 0.334 {
+		t.Errorf("Expected rate of 1/3, got %f", stats.Rate)
+	}
+	if stats.Window != "30m0s" {
+		t.Errorf("Expected window of 30m0s, got %q", stats.Window)
+	}
+
+	// Normal counting is unaffected
+	resp := decodeVisit(t, doRequest(router, "GET", "/visits/pricing", "", nil).Body.Bytes())
+	if resp.Visits != 4 {
+		t.Errorf("Expected 4 pricing visits, got %d", resp.Visits)
+	}
+}
+
+func TestGoalValidation(t *testing.T) {
+	_, redisClient := newTestRedis(t)
+	router := newTestServer(t, testConfig(), redisClient).Router()
+
+	tests := []struct {
+		body   string
+		status int
+	}{
+		{`{"name": "g1", "source_page": "a", "target_page": "b"}`, http.StatusCreated},
+		{`{"name": "g1", "source_page": "a", "target_page": "c"}`, http.StatusConflict},
+		{`{"name": "bad name", "source_page": "a", "target_page": "b"}`, http.StatusBadRequest},
+		{`{"name": "g2", "source_page": "a", "target_page": "a"}`, http.StatusBadRequest},
+		{`{"name": "g3", "source_page": "a"}`, http.StatusBadRequest},
+		{`{"name": "g4", "source_page": "a", "target_page": "b", "window": "soon"}`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		if w := doRequest(router, "POST", "/goals", tt.body, nil); w.Code != tt.status {
+			t.Errorf("POST %s: expected %d, got %d", tt.body, tt.status, w.Code)
+		}
+	}
+
+	if w := doRequest(router, "GET", "/goals/missing", "", nil); w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for unknown goal, got %d", w.Code)
+	}
+}
+
+func TestCreateGoalConcurrent(t *testing.T) {
+	mr, redisClient := newTestRedis(t)
+	ctx := context.Background()
+
+	var created atomic.Int64
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			goal := Goal{Name: "signup", SourcePage: "pricing", TargetPage: fmt.Sprintf("welcome-%d", i)}
+			switch err := redisClient.CreateGoal(ctx, goal, time.Hour); {
+			case err == nil:
+				created.Add(1)
+			case !errors.Is(err, errGoalExists):
+				t.Errorf("Expected errGoalExists, got %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if created.Load() != 1 {
+		t.Errorf("Expected one creation to succeed, got %d", created.Load())
+	}
+	target := mr.HGet(goalKey("signup"), "target_page")
+	if members, _ := mr.Members("goals:by-target:" + target); len(members) != 1 {
+		t.Errorf("Expected the winner indexed by its target, got %v", members)
+	}
+	goals, err := redisClient.LoadGoals(ctx)
+	if err != nil || len(goals) != 2 || len(goals["pricing"]) != 1 || !goals["pricing"][0].Source || len(goals[target]) != 1 {
+		t.Errorf("Expected the goal loaded for its two pages, got %+v, %v", goals, err)
+	}
+}
@@ -0,0 +1,467 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+// groupsKey is the set of defined group names
+const groupsKey = "groups"
+
+// policyPagesKey is the set of pages whose metadata overrides
+// dedupe_window, bot_filtering or ttl
+const policyPagesKey = "visits:meta:policies"
+
+// groupNamePattern restricts group names to safe key segments
+var groupNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// Group is a counting policy shared by the pages assigned to it through
+// their metadata. Unset fields fall back to the global settings.
+type Group struct {
+	Name         string      `json:"name"`
+	DedupeWindow string      `json:"dedupe_window,omitempty"`
+	BotFiltering FeatureMode `json:"bot_filtering,omitempty"`
+	// TTL is the counter TTL the TTL audit gives the group's pages
+	TTL        string  `json:"ttl,omitempty"`
+	SampleRate float64 `json:"sample_rate,omitempty"`
+}
+
+// countingPolicy is the counting policy a page resolves to: its own
+// settings, then its group's, then the global ones
+type countingPolicy struct {
+	Group        string
+	DedupeWindow time.Duration
+	BotFiltering FeatureMode
+	SampleRate   float64
+	// TTL is 0 for pages the global COUNTER_EXPIRING_PREFIXES decide
+	TTL time.Duration
+}
+
+// groupKey returns the definition key for a group
+func groupKey(name string) string {
+	return fmt.Sprintf("groups:%s", name)
+}
+
+// groupPagesKey returns the set of pages assigned to a group
+func groupPagesKey(name string) string {
+	return fmt.Sprintf("groups:%s:pages", name)
+}
+
+// errGroupExists is returned when creating a group whose name is taken
+var errGroupExists = newKindError(ErrConflict, "group already exists")
+
+// errGroupNotFound is returned for groups that are not defined
+var errGroupNotFound = newKindError(ErrNotFound, "group not found")
+
+// errGroupInUse is returned when deleting a group pages are assigned to
+var errGroupInUse = newKindError(ErrConflict, "group has pages assigned")
+
+// policy validates the group and returns its settings, zero where unset
+func (g Group) policy() (countingPolicy, error) {
+	if !groupNamePattern.MatchString(g.Name) {
+		return countingPolicy{}, errors.New("name must be 1-64 letters, digits, '_' or '-'")
+	}
+	policy, err := parsePolicy(g.DedupeWindow, g.BotFiltering, g.TTL, g.SampleRate)
+	policy.Group = g.Name
+	return policy, err
+}
+
+// parsePolicy validates the settings a group or a page can override and
+// returns them as a policy, zero where unset
+func parsePolicy(dedupeWindow string, botFiltering FeatureMode, ttl string, sampleRate float64) (countingPolicy, error) {
+	policy := countingPolicy{BotFiltering: botFiltering, SampleRate: sampleRate}
+	if botFiltering != "" {
+		if _, err := parseFeatureMode(string(botFiltering)); err != nil {
+			return countingPolicy{}, fmt.Errorf("bot_filtering %v", err)
+		}
+	}
+	if sampleRate < 0 || sampleRate > 1 {
+		return countingPolicy{}, errors.New("sample_rate must be between 0 and 1")
+	}
+	for _, field := range []struct {
+		name, value string
+		d           *time.Duration
+	}{
+		{"dedupe_window", dedupeWindow, &policy.DedupeWindow},
+		{"ttl", ttl, &policy.TTL},
+	} {
+		if field.value == "" {
+			continue
+		}
+		d, err := time.ParseDuration(field.value)
+		if err != nil || d < time.Second {
+			return countingPolicy{}, fmt.Errorf("%s must be a duration of at least 1s", field.name)
+		}
+		*field.d = d
+	}
+	return policy, nil
+}
+
+// group returns the policy in its API form
+func (p countingPolicy) group() Group {
+	g := Group{Name: p.Group, BotFiltering: p.BotFiltering, SampleRate: p.SampleRate}
+	if p.DedupeWindow > 0 {
+		g.DedupeWindow = p.DedupeWindow.String()
+	}
+	if p.TTL > 0 {
+		g.TTL = p.TTL.String()
+	}
+	return g
+}
+
+// SaveGroup stores a group's policy. Creating fails with errGroupExists if
+// the name is taken, updating with errGroupNotFound if it is not. The group
+// key is WATCHed, so two creates of one name can't both succeed and an
+// update can't recreate a group deleted since its check.
+func (r *RedisClient) SaveGroup(ctx context.Context, policy countingPolicy, create bool) error {
+	return r.watch(ctx, func(tx *redis.Tx) error {
+		exists, err := tx.Exists(ctx, groupKey(policy.Group)).Result()
+		if err != nil {
+			return err
+		}
+		switch {
+		case create && exists > 0:
+			return errGroupExists
+		case !create && exists == 0:
+			return errGroupNotFound
+		}
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.HSet(ctx, groupKey(policy.Group),
+				"dedupe_window", int64(policy.DedupeWindow/time.Second),
+				"bot_filtering", string(policy.BotFiltering),
+				"ttl", int64(policy.TTL/time.Second),
+				"sample_rate", strconv.FormatFloat(policy.SampleRate, 'f', -1, 64),
+			)
+			pipe.SAdd(ctx, groupsKey, policy.Group)
+			return nil
+		})
+		return err
+	}, groupKey(policy.Group))
+}
+
+// DeleteGroup removes a group that no page is assigned to. Its page set is
+// WATCHed, so a page assigned to it concurrently aborts the delete.
+func (r *RedisClient) DeleteGroup(ctx context.Context, name string) error {
+	return r.watch(ctx, func(tx *redis.Tx) error {
+		pipe := tx.Pipeline()
+		exists := pipe.Exists(ctx, groupKey(name))
+		pages := pipe.SCard(ctx, groupPagesKey(name))
+		if _, err := pipe.Exec(ctx); err != nil {
+			return err
+		}
+		switch {
+		case exists.Val() == 0:
+			return errGroupNotFound
+		case pages.Val() > 0:
+			return errGroupInUse
+		}
+		_, err := tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Del(ctx, groupKey(name))
+			pipe.SRem(ctx, groupsKey, name)
+			return nil
+		})
+		return err
+	}, groupKey(name), groupPagesKey(name))
+}
+
+// checkGroup returns errGroupNotFound unless group is empty or defined. It
+// reads within tx, which must WATCH the group key.
+func checkGroup(ctx context.Context, tx *redis.Tx, group string) error {
+	if group == "" {
+		return nil
+	}
+	exists, err := tx.Exists(ctx, groupKey(group)).Result()
+	if err != nil {
+		return err
+	}
+	if exists == 0 {
+		return errGroupNotFound
+	}
+	return nil
+}
+
+// PolicyPages returns the set of pages whose metadata overrides
+// dedupe_window, bot_filtering or ttl
+func (r *RedisClient) PolicyPages(ctx context.Context) (map[string]bool, error) {
+	pages, err := r.client.SMembers(ctx, policyPagesKey).Result()
+	if err != nil {
+		return nil, err
+	}
+	set := make(map[string]bool, len(pages))
+	for _, page := range pages {
+		set[page] = true
+	}
+	return set, nil
+}
+
+// LoadGroups returns the policy of every defined group by name
+func (r *RedisClient) LoadGroups(ctx context.Context) (map[string]countingPolicy, error) {
+	names, err := r.client.SMembers(ctx, groupsKey).Result()
+	if err != nil {
+		return nil, err
+	}
+	pipe := r.client.Pipeline()
+	defs := make([]*redis.MapStringStringCmd, len(names))
+	for i, name := range names {
+		defs[i] = pipe.HGetAll(ctx, groupKey(name))
+	}
+	if len(names) > 0 {
+		if _, err := pipe.Exec(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	groups := make(map[string]countingPolicy, len(names))
+	for i, name := range names {
+		def := defs[i].Val()
+		if len(def) == 0 {
+			// Deleted since the SMEMBERS
+			continue
+		}
+		dedupe, _ := strconv.ParseInt(def["dedupe_window"], 10, 64)
+		ttl, _ := strconv.ParseInt(def["ttl"], 10, 64)
+		rate, _ := strconv.ParseFloat(def["sample_rate"], 64)
+		groups[name] = countingPolicy{
+			Group:        name,
+			DedupeWindow: time.Duration(dedupe) * time.Second,
+			BotFiltering: FeatureMode(def["bot_filtering"]),
+			SampleRate:   rate,
+			TTL:          time.Duration(ttl) * time.Second,
+		}
+	}
+	return groups, nil
+}
+
+// GroupStore keeps a local copy of the group policies and of the pages
+// overriding them, refreshed with the flags on their pub/sub notifications
+// and poll
+type GroupStore struct {
+	redis     *RedisClient
+	current   atomic.Pointer[map[string]countingPolicy]
+	overrides atomic.Pointer[map[string]bool]
+}
+
+// NewGroupStore creates a group store with no groups
+func NewGroupStore(redisClient *RedisClient) *GroupStore {
+	g := &GroupStore{redis: redisClient}
+	g.current.Store(&map[string]countingPolicy{})
+	g.overrides.Store(&map[string]bool{})
+	return g
+}
+
+// Get returns the policy of a group
+func (g *GroupStore) Get(name string) (countingPolicy, bool) {
+	policy, ok := (*g.current.Load())[name]
+	return policy, ok
+}
+
+// Len returns the number of groups
+func (g *GroupStore) Len() int {
+	return len(*g.current.Load())
+}
+
+// Overridden reports whether the page's metadata overrides dedupe_window,
+// bot_filtering or ttl
+func (g *GroupStore) Overridden(page string) bool {
+	return (*g.overrides.Load())[page]
+}
+
+// Refresh reloads the groups and the overriding pages from Redis
+func (g *GroupStore) Refresh(ctx context.Context) error {
+	groups, err := g.redis.LoadGroups(ctx)
+	if err != nil {
+		return err
+	}
+	overrides, err := g.redis.PolicyPages(ctx)
+	if err != nil {
+		return err
+	}
+	g.current.Store(&groups)
+	g.overrides.Store(&overrides)
+	return nil
+}
+
+// pagePolicy resolves the counting policy of a page: its own settings, then
+// its group's, then the global ones. Metadata is only read when a group,
+// sampling or an override of the page's can apply; on an error the global
+// policy is returned with it.
+func (s *Server) pagePolicy(ctx context.Context, page string, flags Flags) (countingPolicy, error) {
+	policy := countingPolicy{DedupeWindow: s.cfg.DedupeWindow, BotFiltering: flags.Modes.BotFiltering}
+	if s.groups.Len() == 0 && flags.Modes.Sampling == ModeOff && !s.groups.Overridden(page) {
+		return policy, nil
+	}
+	meta, err := s.cachedMeta(ctx, page)
+	if err != nil {
+		return policy, err
+	}
+	if group, ok := s.groups.Get(meta.Group); ok {
+		policy = policy.override(group)
+	}
+	// Stored metadata was validated, so its policy parses
+	own, _ := meta.policy()
+	return policy.override(own), nil
+}
+
+// override returns p with the settings set in group, which may also be a
+// page's own settings with no group name
+func (p countingPolicy) override(group countingPolicy) countingPolicy {
+	if group.Group != "" {
+		p.Group = group.Group
+	}
+	if group.DedupeWindow > 0 {
+		p.DedupeWindow = group.DedupeWindow
+	}
+	if group.BotFiltering != "" {
+		p.BotFiltering = group.BotFiltering
+	}
+	if group.SampleRate > 0 {
+		p.SampleRate = group.SampleRate
+	}
+	if group.TTL > 0 {
+		p.TTL = group.TTL
+	}
+	return p
+}
+
+// policyTTLs returns the counter TTL of each page with a ttl of its own or
+// assigned to a group with one, the page's winning
+func (s *Server) policyTTLs(ctx context.Context) (map[string]time.Duration, error) {
+	ttls := make(map[string]time.Duration)
+	for name, policy := range *s.groups.current.Load() {
+		if policy.TTL <= 0 {
+			continue
+		}
+		pages, err := s.redis.client.SMembers(ctx, groupPagesKey(name)).Result()
+		if err != nil {
+			return nil, err
+		}
+		for _, page := range pages {
+			ttls[page] = policy.TTL
+		}
+	}
+
+	pages, err := s.redis.client.SMembers(ctx, policyPagesKey).Result()
+	if err != nil || len(pages) == 0 {
+		return ttls, err
+	}
+	metas, err := s.meta.GetMetas(ctx, pages)
+	if err != nil {
+		return nil, err
+	}
+	for i, meta := range metas {
+		if own, _ := meta.policy(); own.TTL > 0 {
+			ttls[pages[i]] = own.TTL
+		}
+	}
+	return ttls, nil
+}
+
+// publishGroups reloads the local groups and notifies the other replicas
+// on the flags channel
+func (s *Server) publishGroups(ctx context.Context) {
+	if err := s.redis.client.Publish(ctx, flagsChannel, "").Err(); err != nil {
+		log.Printf("Failed to publish group update: %v", err)
+	}
+	if err := s.groups.Refresh(ctx); err != nil {
+		log.Printf("Failed to refresh groups: %v", err)
+	}
+}
+
+// handleListGroups returns every group, sorted by name
+func (s *Server) handleListGroups(c *gin.Context) {
+	groups, err := s.redis.LoadGroups(c.Request.Context())
+	if err != nil {
+		log.Printf("Error listing groups: %v", err)
+		respondStoreError(c, err, "Failed to list groups")
+		return
+	}
+	list := make([]Group, 0, len(groups))
+	for _, policy := range groups {
+		list = append(list, policy.group())
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	c.JSON(http.StatusOK, gin.H{"groups": list})
+}
+
+// handleCreateGroup defines a new group
+func (s *Server) handleCreateGroup(c *gin.Context) {
+	var group Group
+	if err := c.ShouldBindJSON(&group); err != nil {
+		respondError(c, http.StatusBadRequest, "invalid_request", "Body must be a group object")
+		return
+	}
+	s.saveGroup(c, group, true)
+}
+
+// handlePutGroup replaces the policy of an existing group
+func (s *Server) handlePutGroup(c *gin.Context) {
+	var group Group
+	if err := c.ShouldBindJSON(&group); err != nil {
+		respondError(c, http.StatusBadRequest, "invalid_request", "Body must be a group object")
+		return
+	}
+	group.Name = c.Param("group")
+	s.saveGroup(c, group, false)
+}
+
+// saveGroup validates and stores a group for the create and update handlers
+func (s *Server) saveGroup(c *gin.Context, group Group, create bool) {
+	policy, err := group.policy()
+	if err != nil {
+		respondError(c, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+	ctx := c.Request.Context()
+	err = s.redis.SaveGroup(ctx, policy, create)
+	switch {
+	case errors.Is(err, errGroupExists):
+		respondError(c, http.StatusConflict, "conflict", "A group with this name already exists")
+		return
+	case errors.Is(err, errGroupNotFound):
+		respondError(c, http.StatusNotFound, "not_found", "Group not found")
+		return
+	case err != nil:
+		log.Printf("Error saving group: %v", err)
+		respondStoreError(c, err, "Failed to save group")
+		return
+	}
+	s.publishGroups(ctx)
+
+	status := http.StatusOK
+	if create {
+		status = http.StatusCreated
+	}
+	c.JSON(status, policy.group())
+}
+
+// handleDeleteGroup removes a group no page is assigned to
+func (s *Server) handleDeleteGroup(c *gin.Context) {
+	ctx := c.Request.Context()
+	err := s.redis.DeleteGroup(ctx, c.Param("group"))
+	switch {
+	case errors.Is(err, errGroupNotFound):
+		respondError(c, http.StatusNotFound, "not_found", "Group not found")
+		return
+	case errors.Is(err, errGroupInUse):
+		respondError(c, http.StatusConflict, "conflict", "Pages are still assigned to this group")
+		return
+	case err != nil:
+		log.Printf("Error deleting group: %v", err)
+		respondStoreError(c, err, "Failed to delete group")
+		return
+	}
+	s.publishGroups(ctx)
+	c.Status(http.StatusNoContent)
+}
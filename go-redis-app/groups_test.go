@@ -0,0 +1,299 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// putGroupMeta assigns a page to a group, with its own sample_rate if set
+func putGroupMeta(t *testing.T, router http.Handler, page, body string) {
+	t.Helper()
+	if w := doRequest(router, "PUT", "/admin/pages/"+page+"/meta", body, nil); w.Code != http.StatusOK {
+		t.Fatalf("Set %s metadata: %d %s", page, w.Code, w.Body.String())
+	}
+}
+
+func TestGroupCRUD(t *testing.T) {
+	_, redisClient := newTestRedis(t)
+	router := newTestServer(t, testConfig(), redisClient).Router()
+
+	w := doRequest(router, "POST", "/admin/groups", `{"name":"docs","dedupe_window":"1h","bot_filtering":"enforce","ttl":"48h","sample_rate":0.5}`, nil)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Create group: %d %s", w.Code, w.Body.String())
+	}
+	var group Group
+	json.Unmarshal(w.Body.Bytes(), &group)
+	if group != (Group{Name: "docs", DedupeWindow: "1h0m0s", BotFiltering: ModeEnforce, TTL: "48h0m0s", SampleRate: 0.5}) {
+		t.Errorf("Expected the group echoed normalized, got %+v", group)
+	}
+
+	for _, tt := range []struct {
+		method, path, body string
+		status             int
+	}{
+		{"POST", "/admin/groups", `{"name":"docs"}`, http.StatusConflict},
+		{"POST", "/admin/groups", `{"name":"a:b"}`, http.StatusBadRequest},
+		{"POST", "/admin/groups", `{"name":"x","bot_filtering":"sometimes"}`, http.StatusBadRequest},
+		{"POST", "/admin/groups", `{"name":"x","dedupe_window":"10ms"}`, http.StatusBadRequest},
+		{"POST", "/admin/groups", `{"name":"x","sample_rate":2}`, http.StatusBadRequest},
+		{"PUT", "/admin/groups/nowhere", `{"ttl":"1h"}`, http.StatusNotFound},
+		{"PUT", "/admin/pages/home/meta", `{"group":"nowhere"}`, http.StatusBadRequest},
+		{"DELETE", "/admin/groups/nowhere", "", http.StatusNotFound},
+		{"HEAD", "/admin/groups", "", http.StatusOK},
+	} {
+		if w := doRequest(router, tt.method, tt.path, tt.body, nil); w.Code != tt.status {
+			t.Errorf("%s %s %s: expected %d, got %d %s", tt.method, tt.path, tt.body, tt.status, w.Code, w.Body.String())
+		}
+	}
+
+	// Updates replace the whole policy
+	if w := doRequest(router, "PUT", "/admin/groups/docs", `{"dedupe_window":"2h"}`, nil); w.Code != http.StatusOK {
+		t.Fatalf("Update group: %d %s", w.Code, w.Body.String())
+	}
+	w = doRequest(router, "GET", "/admin/groups", "", nil)
+	var list struct{ Groups []Group }
+	json.Unmarshal(w.Body.Bytes(), &list)
+	if len(list.Groups) != 1 || list.Groups[0] != (Group{Name: "docs", DedupeWindow: "2h0m0s"}) {
+		t.Errorf("Expected the updated group listed, got %s", w.Body.String())
+	}
+
+	putGroupMeta(t, router, "guide", `{"group":"docs"}`)
+	if w := doRequest(router, "DELETE", "/admin/groups/docs", "", nil); w.Code != http.StatusConflict {
+		t.Errorf("Expected a group in use kept, got %d", w.Code)
+	}
+	putGroupMeta(t, router, "guide", `{}`)
+	if w := doRequest(router, "DELETE", "/admin/groups/docs", "", nil); w.Code != http.StatusNoContent {
+		t.Errorf("Expected the unused group deleted, got %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestGroupPolicyPrecedence(t *testing.T) {
+	_, redisClient := newTestRedis(t)
+	cfg := testConfig()
+	cfg.DedupeWindow = 30 * time.Second
+	server := newTestServer(t, cfg, redisClient)
+	router := server.Router()
+	doRequest(router, "PUT", "/admin/flags", `{"bot_filtering":"shadow"}`, nil)
+	doRequest(router, "POST", "/admin/groups", `{"name":"docs","dedupe_window":"1h","bot_filtering":"enforce","ttl":"48h","sample_rate":0.5}`, nil)
+	doRequest(router, "POST", "/admin/groups", `{"name":"blog","sample_rate":0.25}`, nil)
+	putGroupMeta(t, router, "guide", `{"group":"docs"}`)
+	putGroupMeta(t, router, "faq", `{"group":"docs","sample_rate":0.1}`)
+	putGroupMeta(t, router, "post", `{"group":"blog"}`)
+	putGroupMeta(t, router, "pricing", `{"sample_rate":0.2}`)
+	putGroupMeta(t, router, "changelog", `{"group":"docs","dedupe_window":"5m","bot_filtering":"off","ttl":"1h"}`)
+
+	for _, tt := range []struct {
+		page string
+		want countingPolicy
+	}{
+		// No group: the global settings, with the page's own rate
+		{"home", countingPolicy{DedupeWindow: 30 * time.Second, BotFiltering: ModeShadow}},
+		{"pricing", countingPolicy{DedupeWindow: 30 * time.Second, BotFiltering: ModeShadow, SampleRate: 0.2}},
+		// The group's settings replace the global ones
+		{"guide", countingPolicy{Group: "docs", DedupeWindow: time.Hour, BotFiltering: ModeEnforce, SampleRate: 0.5, TTL: 48 * time.Hour}},
+		// The page's sample_rate wins over the group's
+		{"faq", countingPolicy{Group: "docs", DedupeWindow: time.Hour, BotFiltering: ModeEnforce, SampleRate: 0.1, TTL: 48 * time.Hour}},
+		// So do the page's other settings
+		{"changelog", countingPolicy{Group: "docs", DedupeWindow: 5 * time.Minute, BotFiltering: ModeOff, SampleRate: 0.5, TTL: time.Hour}},
+		// Settings the group leaves unset stay global
+		{"post", countingPolicy{Group: "blog", DedupeWindow: 30 * time.Second, BotFiltering: ModeShadow, SampleRate: 0.25}},
+	} {
+		got, err := server.pagePolicy(context.Background(), tt.page, server.flags.Flags())
+		if err != nil || got != tt.want {
+			t.Errorf("%s: expected %+v, got %+v (%v)", tt.page, tt.want, got, err)
+		}
+	}
+}
+
+func TestGroupPolicyAppliesToVisits(t *testing.T) {
+	mr, redisClient := newTestRedis(t)
+	cfg := testConfig()
+	cfg.DedupeWindow = 30 * time.Second
+	router := newTestServer(t, cfg, redisClient).Router()
+	doRequest(router, "PUT", "/admin/flags", `{"dedupe":"enforce"}`, nil)
+	doRequest(router, "POST", "/admin/groups", `{"name":"docs","dedupe_window":"1h","bot_filtering":"enforce"}`, nil)
+	putGroupMeta(t, router, "guide", `{"group":"docs"}`)
+	bot := map[string]string{"User-Agent": "Googlebot/2.1"}
+
+	// Bot filtering is off globally but enforced for the group
+	if resp := decodeVisit(t, doRequest(router, "GET", "/visit/guide", "", bot).Body.Bytes()); *resp.Counted {
+		t.Errorf("Expected the group's bot filtering to drop the visit, got %+v", resp)
+	}
+	if resp := decodeVisit(t, doRequest(router, "GET", "/visit/home", "", bot).Body.Bytes()); !*resp.Counted {
+		t.Errorf("Expected bots counted outside the group, got %+v", resp)
+	}
+
+	// The dedupe marker takes the group's window
+	doRequest(router, "GET", "/visit/guide", "", nil)
+	for page, want := range map[string]time.Duration{"guide": time.Hour, "home": 30 * time.Second} {
+		markers := 0
+		for _, k := range mr.Keys() {
+			if strings.HasPrefix(k, dedupeKey(page, "")) {
+				markers++
+				if ttl := mr.TTL(k); ttl != want {
+					t.Errorf("%s: expected a dedupe window of %s, got %s", page, want, ttl)
+				}
+			}
+		}
+		if markers != 1 {
+			t.Errorf("%s: expected one dedupe marker, got %d", page, markers)
+		}
+	}
+}
+
+func TestPageOverridesWithoutGroups(t *testing.T) {
+	mr, _ := newTestRedis(t)
+	serverA := newTestServer(t, testConfig(), newTestRedisClient(t, mr))
+	serverB := newTestServer(t, testConfig(), newTestRedisClient(t, mr))
+	routerA, routerB := serverA.Router(), serverB.Router()
+	bot := map[string]string{"User-Agent": "Googlebot/2.1"}
+
+	// No group is defined and sampling is off, so only the policy index
+	// tells server B to read guide's metadata
+	putGroupMeta(t, routerA, "guide", `{"bot_filtering":"enforce"}`)
+	waitFor(t, 2*time.Second, func() bool { return serverB.groups.Overridden("guide") })
+	if resp := decodeVisit(t, doRequest(routerB, "GET", "/visit/guide", "", bot).Body.Bytes()); *resp.Counted {
+		t.Errorf("Expected the page's bot filtering to drop the visit, got %+v", resp)
+	}
+	if resp := decodeVisit(t, doRequest(routerB, "GET", "/visit/home", "", bot).Body.Bytes()); !*resp.Counted {
+		t.Errorf("Expected bots counted on other pages, got %+v", resp)
+	}
+
+	putGroupMeta(t, routerA, "guide", `{}`)
+	waitFor(t, 2*time.Second, func() bool { return !serverB.groups.Overridden("guide") })
+}
+
+func TestSaveGroupConcurrent(t *testing.T) {
+	_, redisClient := newTestRedis(t)
+	ctx := context.Background()
+
+	var created atomic.Int64
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			policy := countingPolicy{Group: "docs", DedupeWindow: time.Duration(i+1) * time.Minute}
+			switch err := redisClient.SaveGroup(ctx, policy, true); {
+			case err == nil:
+				created.Add(1)
+			case !errors.Is(err, errGroupExists):
+				t.Errorf("Expected errGroupExists, got %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if created.Load() != 1 {
+		t.Errorf("Expected one creation to succeed, got %d", created.Load())
+	}
+}
+
+func TestGroupEditsRefreshOtherReplicas(t *testing.T) {
+	mr, _ := newTestRedis(t)
+	serverA := newTestServer(t, testConfig(), newTestRedisClient(t, mr))
+	serverB := newTestServer(t, testConfig(), newTestRedisClient(t, mr))
+	routerA, routerB := serverA.Router(), serverB.Router()
+	bot := map[string]string{"User-Agent": "Googlebot/2.1"}
+
+	doRequest(routerA, "POST", "/admin/groups", `{"name":"docs"}`, nil)
+	putGroupMeta(t, routerA, "guide", `{"group":"docs"}`)
+	// The poll interval is an hour, so only pub/sub can refresh server B
+	waitFor(t, 2*time.Second, func() bool { _, ok := serverB.groups.Get("docs"); return ok })
+	if resp := decodeVisit(t, doRequest(routerB, "GET", "/visit/guide", "", bot).Body.Bytes()); !*resp.Counted {
+		t.Fatalf("Expected bots counted under the global policy, got %+v", resp)
+	}
+
+	// Server B has cached guide's metadata; the edit reaches it regardless
+	doRequest(routerA, "PUT", "/admin/groups/docs", `{"bot_filtering":"enforce"}`, nil)
+	waitFor(t, 2*time.Second, func() bool {
+		policy, _ := serverB.groups.Get("docs")
+		return policy.BotFiltering == ModeEnforce
+	})
+	if resp := decodeVisit(t, doRequest(routerB, "GET", "/visit/guide", "", bot).Body.Bytes()); *resp.Counted {
+		t.Errorf("Expected the edited policy to drop the bot, got %+v", resp)
+	}
+}
+
+func TestAggregateGroupVisits(t *testing.T) {
+	_, redisClient := newTestRedis(t)
+	router := newTestServer(t, testConfig(), redisClient).Router()
+	doRequest(router, "POST", "/admin/groups", `{"name":"docs"}`, nil)
+	doRequest(router, "POST", "/admin/groups", `{"name":"blog"}`, nil)
+	for page, visits := range map[string]int{"guide": 3, "faq": 2, "internal": 4, "post": 1} {
+		for i := 0; i < visits; i++ {
+			doRequest(router, "GET", "/visit/"+page, "", nil)
+		}
+	}
+	putGroupMeta(t, router, "guide", `{"group":"docs"}`)
+	putGroupMeta(t, router, "faq", `{"group":"docs"}`)
+	putGroupMeta(t, router, "internal", `{"group":"docs","visibility":"private"}`)
+	putGroupMeta(t, router, "post", `{"group":"blog"}`)
+
+	w := doRequest(router, "GET", "/visits/aggregate?group=docs&breakdown=true", "", nil)
+	resp := decodeAggregate(t, w.Body.Bytes())
+	if w.Code != http.StatusOK || resp.Group != "docs" || resp.Visits != 5 || resp.Pages != 2 {
+		t.Fatalf("Expected the public docs pages summed, got %d %s", w.Code, w.Body.String())
+	}
+	if len(resp.Breakdown) != 2 || resp.Breakdown[0] != (PageCount{Page: "faq", Visits: 2}) || resp.Breakdown[1] != (PageCount{Page: "guide", Visits: 3}) {
+		t.Errorf("Expected the breakdown sorted by page, got %+v", resp.Breakdown)
+	}
+
+	// Moving a page moves its visits
+	putGroupMeta(t, router, "faq", `{"group":"blog"}`)
+	if resp := decodeAggregate(t, doRequest(router, "GET", "/visits/aggregate?group=blog", "", nil).Body.Bytes()); resp.Visits != 3 || resp.Pages != 2 {
+		t.Errorf("Expected faq counted in blog, got %+v", resp)
+	}
+	if resp := decodeAggregate(t, doRequest(router, "GET", "/visits/aggregate?group=docs", "", nil).Body.Bytes()); resp.Visits != 3 || resp.Pages != 1 {
+		t.Errorf("Expected faq gone from docs, got %+v", resp)
+	}
+
+	for _, query := range []string{"group=a:b", "group=docs&pattern=g*"} {
+		if w := doRequest(router, "GET", "/visits/aggregate?"+query, "", nil); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", query, w.Code)
+		}
+	}
+}
+
+func TestTTLAuditGroupTTL(t *testing.T) {
+	mr, redisClient := newTestRedis(t)
+	cfg := testConfig()
+	cfg.CounterExpiringPrefixes = []string{"tmp-"}
+	cfg.CounterTTL = 72 * time.Hour
+	router := newTestServer(t, cfg, redisClient).Router()
+	doRequest(router, "POST", "/admin/groups", `{"name":"campaign","ttl":"24h"}`, nil)
+	doRequest(router, "POST", "/admin/groups", `{"name":"docs"}`, nil)
+	putGroupMeta(t, router, "launch", `{"group":"campaign"}`)
+	putGroupMeta(t, router, "tmp-draft", `{"group":"campaign"}`)
+	putGroupMeta(t, router, "tmp-notes", `{"group":"docs"}`)
+	putGroupMeta(t, router, "pinned", `{"group":"campaign","ttl":"6h"}`)
+	for _, page := range []string{"home", "launch", "tmp-draft", "tmp-notes", "pinned"} {
+		mr.Set(key("visits", page), "5")
+	}
+
+	w := doRequest(router, "POST", "/admin/ttl-audit/fix", "", nil)
+	report := decodeTTLAudit(t, w.Body.Bytes())
+	if w.Code != http.StatusOK || report.ShouldExpire.Count != 4 || report.Fixed != 4 {
+		t.Fatalf("Expected launch, tmp-draft, tmp-notes and pinned given TTLs, got %d %s", w.Code, w.Body.String())
+	}
+	for page, want := range map[string]time.Duration{
+		"home":      0,
+		"launch":    24 * time.Hour,
+		"tmp-draft": 24 * time.Hour,
+		// A group without a ttl leaves the prefix rule in place
+		"tmp-notes": 72 * time.Hour,
+		// The page's own ttl wins over its group's
+		"pinned": 6 * time.Hour,
+	} {
+		if ttl := mr.TTL(key("visits", page)); ttl != want {
+			t.Errorf("%s: expected TTL %s, got %s", page, want, ttl)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+)
+
+// checkNonNegative is the validation every count written by an admin
+// operation goes through: counters, buckets and offsets are never negative
+func checkNonNegative(field string, n int64) error {
+	if n < 0 {
+		return fmt.Errorf("%s must not be negative", field)
+	}
+	return nil
+}
+
+// dropPercent is how far next is below current, as a percentage of current;
+// 0 when it is not lower
+func dropPercent(current, next int64) float64 {
+	if current <= 0 || next >= current {
+		return 0
+	}
+	return float64(current-next) * 100 / float64(current)
+}
+
+// exceedsDropGuard reports whether lowering a counter from current to next
+// drops it by more than percent. A percent of 0 disables the guard.
+func exceedsDropGuard(current, next int64, percent float64) bool {
+	if percent <= 0 || current <= 0 || next >= current {
+		return false
+	}
+	// Compared without dividing, so a drop of exactly percent passes
+	return float64(current-next)*100 > percent*float64(current)
+}
+
+// ProjectTotal returns a page's counter and the total a backfill of rows in
+// mode, with preHistory replacing the offset when non-nil, would recompute
+// it to, without writing anything. Visits recorded between the projection
+// and the backfill are not included.
+func (r *RedisClient) ProjectTotal(ctx context.Context, page, mode string, rows []backfillRow, preHistory *int64) (current, projected int64, err error) {
+	current, err = r.client.Get(ctx, key("visits", page)).Int64()
+	if ignoreMissing(err) != nil {
+		return 0, 0, err
+	}
+	if preHistory != nil {
+		projected = *preHistory
+	} else if projected, err = r.client.Get(ctx, preHistoryKey(page)).Int64(); ignoreMissing(err) != nil {
+		return 0, 0, err
+	}
+
+	buckets, err := r.bucketValues(ctx, page)
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, row := range rows {
+		if mode == backfillModeIncr {
+			buckets[dailyKey(page, row.Day)] += row.Count
+		} else {
+			buckets[dailyKey(page, row.Day)] = row.Count
+		}
+	}
+	for _, n := range buckets {
+		projected += n
+	}
+	return current, projected, nil
+}
+
+// formatDrop describes a counter drop for logs, errors and the audit log
+func formatDrop(page string, current, next int64) string {
+	return fmt.Sprintf("lowers %s from %d to %d (%.1f%%)", page, current, next, math.Floor(dropPercent(current, next)*10)/10)
+}
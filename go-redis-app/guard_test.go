@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestCheckNonNegative(t *testing.T) {
+	if err := checkNonNegative("count", 0); err != nil {
+		t.Errorf("Expected 0 to pass, got %v", err)
+	}
+	if err := checkNonNegative("count", -1); err == nil || err.Error() != "count must not be negative" {
+		t.Errorf("Expected a negative count rejected, got %v", err)
+	}
+}
+
+func TestExceedsDropGuard(t *testing.T) {
+	tests := []struct {
+		current, next int64
+		percent       float64
+		want          bool
+	}{
+		{1000, 500, 50, false}, // exactly the threshold
+		{1000, 499, 50, true},  // just past it
+		{1000, 501, 50, false},
+		{1000, 3, 50, true},
+		{1000, 0, 100, false}, // 100% only rejects nothing
+		{1000, 2000, 50, false},
+		{0, 0, 50, false},
+		{1000, 3, 0, false}, // guard off
+		{3, 2, 33.3, true},
+		{3, 2, 33.4, false},
+	}
+	for _, tt := range tests {
+		if got := exceedsDropGuard(tt.current, tt.next, tt.percent); got != tt.want {
+			t.Errorf("exceedsDropGuard(%d, %d, %g) = %v, want %v", tt.current, tt.next, tt.percent, got, tt.want)
+		}
+	}
+}
+
+func TestBackfillDropGuard(t *testing.T) {
+	mr, redisClient := newTestRedis(t)
+	cfg := testConfig()
+	cfg.CounterDropGuardPercent = 50
+	router := newTestServer(t, cfg, redisClient).Router()
+	backfill(t, router, "home", `{"pre_history": 1000}`)
+
+	// Down to 500 is at the threshold, down to 499 past it
+	backfill(t, router, "home", `{"pre_history": 500}`)
+	w := doRequest(router, "POST", "/admin/backfill/home", `{"pre_history": 249}`, nil)
+	if w.Code != http.StatusConflict || !strings.Contains(w.Body.String(), `"code":"counter_drop"`) {
+		t.Fatalf("Expected 409 for a drop past the guard, got %d: %s", w.Code, w.Body.String())
+	}
+	if got, _ := mr.Get(key("visits", "home")); got != "500" {
+		t.Errorf("Expected the rejected backfill to write nothing, got %s", got)
+	}
+
+	// New daily buckets are counted in the projection
+	backfill(t, router, "home", `{"pre_history": 240, "entries": [{"date": "2023-01-01", "count": 10}]}`)
+
+	resp := backfill(t, router, "home?force=true", `{"pre_history": 3, "entries": [{"date": "2023-01-01", "count": 0}]}`)
+	if resp.Total != 3 {
+		t.Errorf("Expected the forced backfill applied, got total %d", resp.Total)
+	}
+
+	var audit AuditResponse
+	json.Unmarshal(doRequest(router, "GET", "/admin/audit", "", nil).Body.Bytes(), &audit)
+	var notes []string
+	for _, e := range audit.Entries {
+		if e.Note != "" {
+			notes = append(notes, e.Note)
+		}
+	}
+	want := []string{
+		"forced: backfill lowers home from 250 to 3 (98.8%)",
+		"rejected: backfill lowers home from 500 to 249 (50.2%)",
+	}
+	if strings.Join(notes, "\n") != strings.Join(want, "\n") {
+		t.Errorf("Expected the rejected and forced drops audited, got %q", notes)
+	}
+}
+
+func TestBackfillDropGuardOff(t *testing.T) {
+	_, redisClient := newTestRedis(t)
+	router := newTestServer(t, testConfig(), redisClient).Router()
+	backfill(t, router, "home", `{"pre_history": 1000}`)
+	if resp := backfill(t, router, "home", `{"pre_history": 3}`); resp.Total != 3 {
+		t.Errorf("Expected no guard by default, got total %d", resp.Total)
+	}
+}
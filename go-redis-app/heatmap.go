@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	// Embedded zone data so ?tz= works in minimal containers
+	_ "time/tzdata"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// hourlyTTL keeps per-day hour histograms long enough for range heatmaps
+	hourlyTTL = 100 * 24 * time.Hour
+
+	// maxHeatmapDays bounds ?range= for heatmaps
+	maxHeatmapDays = 90
+)
+
+// Matrix is a day-of-week (Sunday first) by hour-of-day grid
+type Matrix [7][24]int64
+
+// Heatmap represents visit intensity by weekday and hour
+type Heatmap struct {
+	Page     string `json:"page"`
+	Timezone string `json:"timezone"`
+	Range    string `json:"range,omitempty"`
+	Counts   Matrix `json:"counts"`
+	// Normalized scales counts to [0, 1] by the busiest cell
+	Normalized [7][24]float64 `json:"normalized"`
+	// Unattributed counts visits in the range with no hour data, such as
+	// backfilled days
+	Unattributed int64 `json:"unattributed,omitempty"`
+}
+
+// heatmapKey holds the all-time histogram with "weekday:hour" (UTC) fields
+func heatmapKey(page string) string {
+	return key("visits", page, "heatmap")
+}
+
+// hourlyKey holds one day's histogram with UTC hour fields
+func hourlyKey(page string, t time.Time) string {
+	return key("visits", page, "hourly", t.UTC().Format(dayLayout))
+}
+
+// queueHourly adds the hour histogram updates for a visit to the pipeline
+func queueHourly(ctx context.Context, pipe redis.Pipeliner, page string, now time.Time, weight int64) {
+	now = now.UTC()
+	pipe.HIncrBy(ctx, hourlyKey(page, now), strconv.Itoa(now.Hour()), weight)
+	pipe.Expire(ctx, hourlyKey(page, now), hourlyTTL)
+	pipe.HIncrBy(ctx, heatmapKey(page), fmt.Sprintf("%d:%d", now.Weekday(), now.Hour()), weight)
+}
+
+// HeatmapDay is one day of hour histogram data
+type HeatmapDay struct {
+	Date  time.Time     // UTC midnight
+	Hours map[int]int64 // UTC hour -> visits
+	Total int64         // the daily bucket, which may exceed the hour sum
+}
+
+// histogramMatrix converts an all-time "weekday:hour" UTC histogram to loc,
+// using loc's offset at now (rounded to the hour) for every cell
+func histogramMatrix(hist map[string]int64, loc *time.Location, now time.Time) Matrix {
+	_, offset := now.In(loc).Zone()
+	shift := (offset + 1800*sign(offset)) / 3600
+
+	var m Matrix
+	for field, count := range hist {
+		d, h, ok := strings.Cut(field, ":")
+		weekday, errD := strconv.Atoi(d)
+		hour, errH := strconv.Atoi(h)
+		if !ok || errD != nil || errH != nil || weekday < 0 || weekday > 6 || hour < 0 || hour > 23 {
+			continue
+		}
+		cell := ((weekday*24+hour+shift)%168 + 168) % 168
+		m[cell/24][cell%24] += count
+	}
+	return m
+}
+
+// sign returns -1 for negative n and 1 otherwise
+func sign(n int) int {
+	if n < 0 {
+		return -1
+	}
+	return 1
+}
+
+// dayMatrix aggregates per-day hour histograms into loc's weekdays and
+// hours, converting each hour exactly, and returns the visits of daily
+// buckets not covered by hour data
+func dayMatrix(days []HeatmapDay, loc *time.Location) (Matrix, int64) {
+	var m Matrix
+	var unattributed int64
+	for _, day := range days {
+		var attributed int64
+		for hour, count := range day.Hours {
+			if hour < 0 || hour > 23 {
+				continue
+			}
+			local := day.Date.Add(time.Duration(hour) * time.Hour).In(loc)
+			m[local.Weekday()][local.Hour()] += count
+			attributed += count
+		}
+		if day.Total > attributed {
+			unattributed += day.Total - attributed
+		}
+	}
+	return m, unattributed
+}
+
+// normalize scales a matrix by its largest cell
+func normalize(m Matrix) [7][24]float64 {
+	var max int64
+	for _, row := range m {
+		for _, v := range row {
+			if v > max {
+				max = v
+			}
+		}
+	}
+	var out [7][24]float64
+	if max == 0 {
+		return out
+	}
+	for d, row := range m {
+		for h, v := range row {
+			out[d][h] = float64(v) / float64(max)
+		}
+	}
+	return out
+}
+
+// HeatmapHistogram returns the page's all-time UTC histogram
+func (r *RedisClient) HeatmapHistogram(ctx context.Context, page string) (map[string]int64, error) {
+	values, err := r.client.HGetAll(ctx, heatmapKey(page)).Result()
+	if err != nil {
+		return nil, err
+	}
+	hist := make(map[string]int64, len(values))
+	for field, v := range values {
+		hist[field], _ = strconv.ParseInt(v, 10, 64)
+	}
+	return hist, nil
+}
+
+// HeatmapDays returns the hour histograms and daily buckets for the given
+// number of days ending with the day of now (UTC)
+func (r *RedisClient) HeatmapDays(ctx context.Context, page string, now time.Time, n int) ([]HeatmapDay, error) {
+	today := now.UTC().Truncate(24 * time.Hour)
+	pipe := r.client.Pipeline()
+	hours := make([]*redis.MapStringStringCmd, n)
+	totals := make([]*redis.StringCmd, n)
+	for i := 0; i < n; i++ {
+		date := today.AddDate(0, 0, -i)
+		hours[i] = pipe.HGetAll(ctx, hourlyKey(page, date))
+		totals[i] = pipe.Get(ctx, dailyKey(page, date))
+	}
+	if _, err := pipe.Exec(ctx); ignoreMissing(err) != nil {
+		return nil, err
+	}
+
+	days := make([]HeatmapDay, n)
+	for i := range days {
+		days[i] = HeatmapDay{Date: today.AddDate(0, 0, -i), Hours: make(map[int]int64)}
+		for field, v := range hours[i].Val() {
+			hour, err := strconv.Atoi(field)
+			if err != nil {
+				continue
+			}
+			days[i].Hours[hour], _ = strconv.ParseInt(v, 10, 64)
+		}
+		days[i].Total, _ = totals[i].Int64()
+	}
+	return days, nil
+}
+
+// handleHeatmap returns the weekday by hour visit matrix for a page, all-time
+// or for the last ?range= days, in the ?tz= timezone (default UTC)
+func (s *Server) handleHeatmap(c *gin.Context) {
+	page := c.Param("page")
+	loc, err := time.LoadLocation(c.DefaultQuery("tz", "UTC"))
+	if err != nil {
+		respondError(c, http.StatusBadRequest, "invalid_request", "tz must be an IANA time zone such as Europe/Berlin")
+		return
+	}
+	days := 0
+	if r := c.Query("range"); r != "" {
+		if days, err = parsePeriod(r, "d"); err != nil || days < 1 || days > maxHeatmapDays {
+			respondError(c, http.StatusBadRequest, "invalid_request", fmt.Sprintf("range must be 1d-%dd", maxHeatmapDays))
+			return
+		}
+	}
+
+	hidden, err := s.pageHidden(c, page)
+	if err != nil {
+		log.Printf("Error getting page metadata: %v", err)
+		respondStoreError(c, err, "Failed to get heatmap")
+		return
+	}
+	if hidden {
+		respondError(c, http.StatusNotFound, "not_found", "Page not found")
+		return
+	}
+
+	ctx := c.Request.Context()
+	now := s.clock.Now()
+	response := Heatmap{Page: page, Timezone: loc.String()}
+	if days > 0 {
+		data, err := s.redis.HeatmapDays(ctx, page, now, days)
+		if err != nil {
+			log.Printf("Error getting heatmap: %v", err)
+			respondStoreError(c, err, "Failed to get heatmap")
+			return
+		}
+		response.Range = c.Query("range")
+		response.Counts, response.Unattributed = dayMatrix(data, loc)
+	} else {
+		hist, err := s.redis.HeatmapHistogram(ctx, page)
+		if err != nil {
+			log.Printf("Error getting heatmap: %v", err)
+			respondStoreError(c, err, "Failed to get heatmap")
+			return
+		}
+		response.Counts = histogramMatrix(hist, loc, now)
+	}
+	response.Normalized = normalize(response.Counts)
+
+	respondJSON(c, http.StatusOK, response)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"go-redis-app/internal/clocktest"
+)
+
+func TestHistogramMatrix(t *testing.T) {
+	hist := map[string]int64{"0:3": 5, "6:23": 2, "bogus": 9, "7:0": 1}
+
+	m := histogramMatrix(hist, time.UTC, time.Now())
+	if m[0][3] != 5 || m[6][23] != 2 {
+		t.Errorf("Unexpected UTC matrix cells: %d, %d", m[0][3], m[6][23])
+	}
+
+	// New York is UTC-5 in January: Sunday 03:00 UTC is Saturday 22:00, and
+	// Saturday 23:00 UTC is Saturday 18:00
+	ny, _ := time.LoadLocation("America/New_York")
+	m = histogramMatrix(hist, ny, time.Date(2024, 1, 15, 0, 0, 0, 0, time.UTC))
+	if m[6][22] != 5 || m[6][18] != 2 {
+		t.Errorf("Unexpected shifted cells: %d, %d", m[6][22], m[6][18])
+	}
+
+	// Kolkata's +5:30 rounds to +6 hours; Saturday 23:00 UTC wraps to Sunday
+	kolkata, _ := time.LoadLocation("Asia/Kolkata")
+	if m = histogramMatrix(hist, kolkata, time.Now()); m[0][5] != 2 {
+		t.Errorf("Expected wrap to Sunday 05:00, got %v", m[0])
+	}
+}
+
+func TestDayMatrix(t *testing.T) {
+	ny, _ := time.LoadLocation("America/New_York")
+	days := []HeatmapDay{
+		// Monday 2024-07-01 (UTC-4 in summer)
+		{Date: time.Date(2024, 7, 1, 0, 0, 0, 0, time.UTC), Hours: map[int]int64{2: 3, 14: 4}, Total: 7},
+		// A backfilled day with no hour data
+		{Date: time.Date(2024, 7, 2, 0, 0, 0, 0, time.UTC), Hours: map[int]int64{}, Total: 10},
+		// A day with no data at all
+		{Date: time.Date(2024, 7, 3, 0, 0, 0, 0, time.UTC), Hours: map[int]int64{}},
+	}
+
+	m, unattributed := dayMatrix(days, ny)
+	if m[time.Sunday][22] != 3 || m[time.Monday][10] != 4 {
+		t.Errorf("Expected 02:00 and 14:00 UTC Monday at Sunday 22:00 and Monday 10:00, got %v", m)
+	}
+	if unattributed != 10 {
+		t.Errorf("Expected 10 unattributed visits, got %d", unattributed)
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	var m Matrix
+	if n := normalize(m); n[0][0] != 0 {
+		t.Error("Expected zeros for an empty matrix")
+	}
+	m[1][2], m[3][4] = 4, 2
+	n := normalize(m)
+	if n[1][2] != 1 || n[3][4] != 0.5 || n[0][0] != 0 {
+		t.Errorf("Unexpected normalization: %v, %v", n[1][2], n[3][4])
+	}
+}
+
+func TestHeatmapEndpoint(t *testing.T) {
+	_, redisClient := newTestRedis(t)
+	now := time.Date(2024, 5, 1, 23, 59, 0, 0, time.UTC)
+	clock := clocktest.New(now)
+	server := newTestServerWithClock(t, testConfig(), redisClient, clock)
+	server.flags.Set(context.Background(), map[string]bool{"rollups": true})
+	router := server.Router()
+
+	doRequest(router, "GET", "/visit/home", "", nil)
+	doRequest(router, "GET", "/visit/home", "", nil)
+
+	for _, query := range []string{"", "?range=7d"} {
+		w := doRequest(router, "GET", "/visits/home/heatmap"+query, "", nil)
+		var resp Heatmap
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || w.Code != http.StatusOK {
+			t.Fatalf("Unexpected response %d: %s", w.Code, w.Body.String())
+		}
+		if resp.Timezone != "UTC" || resp.Counts[now.Weekday()][now.Hour()] != 2 || resp.Normalized[now.Weekday()][now.Hour()] != 1 {
+			t.Errorf("Expected 2 visits in the current cell for %q, got %+v", query, resp)
+		}
+	}
+
+	// Pages without data get a zero matrix, not nulls
+	w := doRequest(router, "GET", "/visits/empty/heatmap?tz=Europe/Berlin", "", nil)
+	var raw map[string]json.RawMessage
+	json.Unmarshal(w.Body.Bytes(), &raw)
+	var counts [][]int64
+	if err := json.Unmarshal(raw["counts"], &counts); err != nil || len(counts) != 7 || len(counts[0]) != 24 {
+		t.Errorf("Expected a 7x24 zero matrix, got %s", raw["counts"])
+	}
+
+	for _, query := range []string{"?tz=Mars/Olympus", "?range=0d", "?range=91d", "?range=7"} {
+		if w := doRequest(router, "GET", "/visits/home/heatmap"+query, "", nil); w.Code != http.StatusBadRequest {
+			t.Errorf("Expected 400 for %q, got %d", query, w.Code)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/alicebob/miniredis/v2/server"
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+func TestMain(m *testing.M) {
+	gin.SetMode(gin.TestMode)
+	os.Exit(m.Run())
+}
+
+// newTestRedis starts an in-memory Redis and returns a client connected to it
+func newTestRedis(t *testing.T) (*miniredis.Miniredis, *RedisClient) {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	registerReadOnlyScripts(mr)
+	return mr, newTestRedisClient(t, mr)
+}
+
+// registerReadOnlyScripts serves EVAL_RO and EVALSHA_RO, which miniredis
+// lacks, as their read-write forms
+func registerReadOnlyScripts(mr *miniredis.Miniredis) {
+	for ro, rw := range map[string]string{"EVAL_RO": "EVAL", "EVALSHA_RO": "EVALSHA"} {
+		rw := rw
+		mr.Server().Register(ro, func(c *server.Peer, _ string, args []string) {
+			mr.Server().Dispatch(c, append([]string{rw}, args...))
+		})
+	}
+}
+
+// newTestRedisClient returns a client connected to an existing miniredis
+func newTestRedisClient(t *testing.T, mr *miniredis.Miniredis) *RedisClient {
+	t.Helper()
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { rdb.Close() })
+	return newRedisClient(rdb)
+}
+
+// testConfig returns a configuration suitable for tests
+func testConfig() Config {
+	return Config{
+		Port:              "0",
+		AdminAPIKeys:      map[string]string{},
+		FlagsPollInterval: time.Hour,
+		DedupeWindow:      time.Minute,
+		StrictVariants:    true,
+		AuditMaxLen:       1000,
+		SessionWindow:     30 * time.Minute,
+		SessionRefresh:    true,
+		LogSampleRate:     1,
+		FlushTimeout:      time.Second,
+		InstanceName:      "test",
+		TrendingHalfLife:  time.Hour,
+
+		WebhookPollInterval: 10 * time.Millisecond,
+		WebhookRetryBase:    10 * time.Millisecond,
+		WebhookMaxAttempts:  3,
+		WebhookConcurrency:  4,
+		WaitMaxWaiters:      100,
+
+		AnonymousPermission: PermWrite,
+		ResolveStripParams:  defaultStripParams,
+	}
+}
+
+// newTestServer creates and starts a server, stopping it when the test ends
+func newTestServer(t *testing.T, cfg Config, redisClient *RedisClient) *Server {
+	t.Helper()
+	return newTestServerWithClock(t, cfg, redisClient, systemClock{})
+}
+
+// newTestServerWithClock is newTestServer reading the time from clock, such
+// as a clocktest.Fake
+func newTestServerWithClock(t *testing.T, cfg Config, redisClient *RedisClient, clock Clock) *Server {
+	t.Helper()
+	return startTestServer(t, NewServer(cfg, redisClient, clock, nil))
+}
+
+// newTestServerWithGeo is newTestServer resolving visitor countries with geo
+func newTestServerWithGeo(t *testing.T, cfg Config, redisClient *RedisClient, geo GeoResolver) *Server {
+	t.Helper()
+	return startTestServer(t, NewServer(cfg, redisClient, systemClock{}, geo))
+}
+
+// startTestServer starts the server's workers, stopping them when the test
+// ends
+func startTestServer(t *testing.T, server *Server) *Server {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	if err := server.Start(ctx); err != nil {
+		t.Fatalf("Failed to start server: %v", err)
+	}
+	return server
+}
+
+// doRequest performs a request against the handler and returns the recorder
+func doRequest(h http.Handler, method, path, body string, headers map[string]string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w
+}
+
+// waitFor polls cond until it returns true or the timeout elapses
+func waitFor(t *testing.T, timeout time.Duration, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for condition")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
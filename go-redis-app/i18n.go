@@ -0,0 +1,105 @@
+package main
+
+import (
+	"embed"
+	"encoding/json"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// defaultLanguage is the language messages are written in, used when the
+// request accepts none of the catalogs
+const defaultLanguage = "en"
+
+//go:embed locales/*.json
+var localeFiles embed.FS
+
+// catalogs maps each supported language to its translations, keyed by the
+// English message. English has no catalog: messages are already in it.
+var catalogs = loadCatalogs()
+
+// loadCatalogs reads the embedded catalogs, one locales/<language>.json each
+func loadCatalogs() map[string]map[string]string {
+	catalogs := map[string]map[string]string{defaultLanguage: nil}
+	entries, err := localeFiles.ReadDir("locales")
+	if err != nil {
+		panic(err)
+	}
+	for _, entry := range entries {
+		data, err := localeFiles.ReadFile(path.Join("locales", entry.Name()))
+		if err != nil {
+			panic(err)
+		}
+		var catalog map[string]string
+		if err := json.Unmarshal(data, &catalog); err != nil {
+			panic("locales/" + entry.Name() + ": " + err.Error())
+		}
+		catalogs[strings.TrimSuffix(entry.Name(), ".json")] = catalog
+	}
+	return catalogs
+}
+
+// negotiateLanguage picks the supported language an Accept-Language header
+// prefers: the highest q-value wins, earlier ranges win ties, a region such
+// as de-CH matches its language and * matches the default. Ranges with q=0
+// or an invalid q are skipped.
+func negotiateLanguage(header string) string {
+	type candidate struct {
+		lang string
+		q    float64
+	}
+	var candidates []candidate
+	for _, part := range strings.Split(header, ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		q := 1.0
+		if value, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			var err error
+			if q, err = strconv.ParseFloat(value, 64); err != nil || q < 0 || q > 1 {
+				continue
+			}
+		}
+		lang, _, _ := strings.Cut(strings.ToLower(strings.TrimSpace(tag)), "-")
+		if lang == "*" {
+			lang = defaultLanguage
+		}
+		if _, ok := catalogs[lang]; ok && q > 0 {
+			candidates = append(candidates, candidate{lang, q})
+		}
+	}
+	if len(candidates) == 0 {
+		return defaultLanguage
+	}
+	sort.SliceStable(candidates, func(i, j int) bool { return candidates[i].q > candidates[j].q })
+	return candidates[0].lang
+}
+
+// translate returns message in lang. A message without a translation is
+// split at its first ": ", so a translated prefix such as "Failed to get
+// visit count" still is when followed by an error; anything else is kept.
+func translate(lang, message string) string {
+	catalog := catalogs[lang]
+	if catalog == nil {
+		return message
+	}
+	if translated, ok := catalog[message]; ok {
+		return translated
+	}
+	if head, tail, ok := strings.Cut(message, ": "); ok {
+		return translate(lang, head) + ": " + translate(lang, tail)
+	}
+	return message
+}
+
+// localize translates a human-readable message into the request's language,
+// marking the response as varying by it. Machine-readable codes are never
+// translated.
+func localize(c *gin.Context, message string) string {
+	lang := negotiateLanguage(c.GetHeader("Accept-Language"))
+	c.Writer.Header().Add("Vary", "Accept-Language")
+	c.Header("Content-Language", lang)
+	return translate(lang, message)
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestNegotiateLanguage(t *testing.T) {
+	tests := map[string]string{
+		"":                                   "en",
+		"de":                                 "de",
+		"es-MX":                              "es",
+		"DE-ch":                              "de",
+		"fr":                                 "en", // unsupported
+		"fr, es;q=0.5":                       "es",
+		"de;q=0.3, es;q=0.9":                 "es",
+		"es;q=0.5, de;q=0.5":                 "es", // earlier wins ties
+		"de;q=0, es;q=0.1":                   "es", // q=0 is not acceptable
+		"de;q=0":                             "en",
+		"de;q=abc, es;q=0.2":                 "es", // invalid q skipped
+		"de;q=1.5":                           "en",
+		"*;q=0.8, de;q=0.5":                  "en",
+		"fr-CH, fr;q=0.9, de;q=0.7, *;q=0.5": "de",
+		" es ; q=0.7 , en;q=0.6":             "es",
+	}
+	for header, want := range tests {
+		if got := negotiateLanguage(header); got != want {
+			t.Errorf("negotiateLanguage(%q) = %q, want %q", header, got, want)
+		}
+	}
+}
+
+func TestTranslate(t *testing.T) {
+	tests := []struct {
+		lang, message, want string
+	}{
+		{"de", "Page not found", "Seite nicht gefunden"},
+		{"es", "Page not found", "Página no encontrada"},
+		{"en", "Page not found", "Page not found"},
+		{"de", "Failed to get visit count: redis timeout", "Besuchszahl konnte nicht abgerufen werden: Zeitüberschreitung bei Redis"},
+		{"es", "Invalid bearer token: token is expired", "Token de portador no válido: token is expired"},
+		{"de", "Something new", "Something new"}, // fallback
+	}
+	for _, tt := range tests {
+		if got := translate(tt.lang, tt.message); got != tt.want {
+			t.Errorf("translate(%q, %q) = %q, want %q", tt.lang, tt.message, got, tt.want)
+		}
+	}
+}
+
+func TestCatalogs(t *testing.T) {
+	var source strings.Builder
+	files, _ := filepath.Glob("*.go")
+	for _, name := range files {
+		if !strings.HasSuffix(name, "_test.go") {
+			data, _ := os.ReadFile(name)
+			source.Write(data)
+		}
+	}
+	keys := func(lang string) []string {
+		var keys []string
+		for k := range catalogs[lang] {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		return keys
+	}
+	messages := keys("es")
+	for lang := range catalogs {
+		if lang == defaultLanguage {
+			continue
+		}
+		if got := keys(lang); strings.Join(got, "\n") != strings.Join(messages, "\n") {
+			t.Errorf("Expected the %s catalog to translate the same messages as es", lang)
+		}
+	}
+	// A key no longer in the code is a translation nobody sees
+	for _, k := range messages {
+		if !strings.Contains(source.String(), strconv.Quote(k)[:len(strconv.Quote(k))-1]) {
+			t.Errorf("Catalog message %q is not used by the code", k)
+		}
+	}
+}
+
+func TestLocalizedErrors(t *testing.T) {
+	_, redisClient := newTestRedis(t)
+	cfg := jwtTestConfig()
+	router := newTestServer(t, cfg, redisClient).Router()
+
+	tests := []struct {
+		language, want string
+	}{
+		{"de-DE,de;q=0.9,en;q=0.8", "Ein Bearer-Token ist erforderlich"},
+		{"en;q=0.5, es", "Se requiere un token de portador"},
+		{"ja", "A bearer token is required"},
+		{"", "A bearer token is required"},
+	}
+	for _, tt := range tests {
+		w := doRequest(router, "GET", "/visits/home", "", map[string]string{"Accept-Language": tt.language})
+		var resp ErrorResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || w.Code != http.StatusUnauthorized {
+			t.Fatalf("Expected 401, got %d: %s", w.Code, w.Body.String())
+		}
+		if resp.Error != tt.want || resp.Code != "unauthorized" {
+			t.Errorf("Accept-Language %q: expected %q with the code unchanged, got %+v", tt.language, tt.want, resp)
+		}
+		if w.Header().Get("Vary") != "Accept-Language" {
+			t.Errorf("Expected Vary: Accept-Language, got %v", w.Header())
+		}
+	}
+
+	_, plain := newTestRedis(t)
+	w := doRequest(newTestServer(t, testConfig(), plain).Router(), "GET", "/", "", map[string]string{"Accept-Language": "es"})
+	var root map[string]any
+	json.Unmarshal(w.Body.Bytes(), &root)
+	if root["message"] != "Microservicio Go Redis" || w.Header().Get("Content-Language") != "es" {
+		t.Errorf("Expected the root message in Spanish, got %v %v", w.Header(), root)
+	}
+}
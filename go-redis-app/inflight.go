@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// inFlightCheckInterval is how often routes are checked for saturation
+const inFlightCheckInterval = time.Second
+
+// SaturationAlert is the payload posted to ALERT_WEBHOOK_URL when a route
+// has stayed above INFLIGHT_SOFT_LIMIT for INFLIGHT_SATURATION_AFTER
+type SaturationAlert struct {
+	Event     string    `json:"event"`
+	Env       string    `json:"env,omitempty"`
+	Route     string    `json:"route"`
+	InFlight  int64     `json:"in_flight"`
+	Threshold int64     `json:"threshold"`
+	Since     time.Time `json:"since"`
+}
+
+// routeInFlight is the in-flight gauge of one route template
+type routeInFlight struct {
+	n         atomic.Int64
+	incidents atomic.Int64
+
+	// Guarded by InFlightTracker.mu: when the route went above the soft
+	// limit, zero when it is below, and whether this incident was alerted
+	over    time.Time
+	alerted bool
+}
+
+// InFlightTracker counts the requests being served, in total and per route
+// template, and warns when a route stays above a soft limit, well before a
+// hard limit would start rejecting requests. Tracking is two atomic adds
+// per request; the gauges are only read by the metrics, the debug endpoint
+// and the saturation check.
+type InFlightTracker struct {
+	clock   Clock
+	env     string
+	soft    int64
+	sustain time.Duration
+	alert   *Webhook
+
+	total  atomic.Int64
+	routes sync.Map // route template -> *routeInFlight
+
+	mu sync.Mutex
+}
+
+// newInFlightTracker creates the server's tracker from cfg, alerting to
+// alert; saturation checks are off unless INFLIGHT_SOFT_LIMIT is set
+func newInFlightTracker(cfg Config, clock Clock, alert *Webhook) *InFlightTracker {
+	return &InFlightTracker{
+		clock:   clock,
+		env:     cfg.EnvName,
+		soft:    cfg.InFlightSoftLimit,
+		sustain: cfg.InFlightSaturationAfter,
+		alert:   alert,
+	}
+}
+
+// route returns the gauge of a route template, creating it on first use.
+// Templates are a fixed set, so the map only grows to the number of routes.
+func (t *InFlightTracker) route(route string) *routeInFlight {
+	if route == "" {
+		route = unmatchedRoute
+	}
+	if g, ok := t.routes.Load(route); ok {
+		return g.(*routeInFlight)
+	}
+	g, _ := t.routes.LoadOrStore(route, &routeInFlight{})
+	return g.(*routeInFlight)
+}
+
+// track is the middleware counting a request as in flight until its
+// handlers return. The decrement is deferred, so a handler that panics or
+// returns early because the client went away is still counted out.
+func (t *InFlightTracker) track(c *gin.Context) {
+	g := t.route(c.FullPath())
+	g.n.Add(1)
+	t.total.Add(1)
+	defer func() {
+		g.n.Add(-1)
+		t.total.Add(-1)
+	}()
+	c.Next()
+}
+
+// check looks for routes above the soft limit. A route that has stayed
+// above it for longer than the sustain period is logged and alerted once;
+// the incident ends when the route drops back to the limit.
+func (t *InFlightTracker) check(context.Context) error {
+	if t.soft <= 0 {
+		return nil
+	}
+	now := t.clock.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.routes.Range(func(k, v any) bool {
+		route, g := k.(string), v.(*routeInFlight)
+		n := g.n.Load()
+		switch {
+		case n <= t.soft:
+			if g.alerted {
+				log.Printf("event=saturation_resolved route=%q in_flight=%d threshold=%d duration=%s", route, n, t.soft, now.Sub(g.over))
+			}
+			g.over, g.alerted = time.Time{}, false
+		case g.over.IsZero():
+			g.over = now
+		case !g.alerted && now.Sub(g.over) > t.sustain:
+			g.alerted = true
+			g.incidents.Add(1)
+			log.Printf("event=saturation route=%q in_flight=%d threshold=%d since=%s", route, n, t.soft, g.over.UTC().Format(time.RFC3339))
+			t.alert.Alert("Saturation", SaturationAlert{Event: "route.saturated", Env: t.env, Route: route, InFlight: n, Threshold: t.soft, Since: g.over.UTC()})
+		}
+		return true
+	})
+	return nil
+}
+
+// RouteInFlight is one route of the /debug/inflight response
+type RouteInFlight struct {
+	Route          string     `json:"route"`
+	InFlight       int64      `json:"in_flight"`
+	SaturatedSince *Timestamp `json:"saturated_since,omitempty"`
+	Incidents      int64      `json:"incidents"`
+}
+
+// InFlightResponse represents the /debug/inflight API response
+type InFlightResponse struct {
+	InFlight  int64           `json:"in_flight"`
+	SoftLimit int64           `json:"soft_limit,omitempty"`
+	Routes    []RouteInFlight `json:"routes"`
+}
+
+// snapshot returns the gauge of every route served so far, sorted by route
+func (t *InFlightTracker) snapshot() []RouteInFlight {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	routes := []RouteInFlight{}
+	t.routes.Range(func(k, v any) bool {
+		g := v.(*routeInFlight)
+		route := RouteInFlight{Route: k.(string), InFlight: g.n.Load(), Incidents: g.incidents.Load()}
+		if !g.over.IsZero() {
+			route.SaturatedSince = &Timestamp{Time: g.over}
+		}
+		routes = append(routes, route)
+		return true
+	})
+	sort.Slice(routes, func(i, j int) bool { return routes[i].Route < routes[j].Route })
+	return routes
+}
+
+// handleInFlight lists the requests in flight per route, counting itself
+func (s *Server) handleInFlight(c *gin.Context) {
+	routes := s.inflight.snapshot()
+	for i := range routes {
+		if since := routes[i].SaturatedSince; since != nil {
+			*since = stamp(c, since.Time)
+		}
+	}
+	respondJSON(c, http.StatusOK, InFlightResponse{InFlight: s.inflight.total.Load(), SoftLimit: s.inflight.soft, Routes: routes})
+}
+
+// write writes the http_requests_in_flight, http_route_requests_in_flight
+// and http_route_saturation_incidents_total series
+func (t *InFlightTracker) write(b *strings.Builder, env string) {
+	labels, prefix := "", ""
+	if env != "" {
+		labels = "{env=" + strconv.Quote(env) + "}"
+		prefix = "env=" + strconv.Quote(env) + ","
+	}
+	routes := t.snapshot()
+	b.WriteString("# HELP http_requests_in_flight Requests being served.\n")
+	b.WriteString("# TYPE http_requests_in_flight gauge\n")
+	fmt.Fprintf(b, "http_requests_in_flight%s %d\n", labels, t.total.Load())
+	b.WriteString("# HELP http_route_requests_in_flight Requests being served, by route template.\n")
+	b.WriteString("# TYPE http_route_requests_in_flight gauge\n")
+	for _, route := range routes {
+		fmt.Fprintf(b, "http_route_requests_in_flight{%sroute=%s} %d\n", prefix, strconv.Quote(route.Route), route.InFlight)
+	}
+	b.WriteString("# HELP http_route_saturation_incidents_total Times a route stayed above the in-flight soft limit.\n")
+	b.WriteString("# TYPE http_route_saturation_incidents_total counter\n")
+	for _, route := range routes {
+		fmt.Fprintf(b, "http_route_saturation_incidents_total{%sroute=%s} %d\n", prefix, strconv.Quote(route.Route), route.Incidents)
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go-redis-app/internal/clocktest"
+)
+
+// routeGauge returns the requests in flight on a route
+func routeGauge(s *Server, route string) int64 {
+	return s.inflight.route(route).n.Load()
+}
+
+// serveBlocked serves n more requests to path in the background, returning
+// once all of them are in flight on route
+func serveBlocked(t *testing.T, s *Server, h http.Handler, route, path string, n int) *sync.WaitGroup {
+	t.Helper()
+	want := routeGauge(s, route) + int64(n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+		}()
+	}
+	waitFor(t, time.Second, func() bool { return routeGauge(s, route) == want })
+	return &wg
+}
+
+func TestInFlightGauges(t *testing.T) {
+	_, redisClient := newTestRedis(t)
+	cfg := testConfig()
+	cfg.EventsBackend = eventsBackendPubSub
+	server := newTestServer(t, cfg, redisClient)
+	router := server.Router()
+	release := make(chan struct{})
+	router.GET("/test/block/:n", func(c *gin.Context) { <-release })
+	router.GET("/test/panic", func(c *gin.Context) { panic("boom") })
+
+	wg := serveBlocked(t, server, router, "/test/block/:n", "/test/block/1", 3)
+	if got := server.inflight.total.Load(); got != 3 {
+		t.Errorf("Expected 3 requests in flight, got %d", got)
+	}
+	w := doRequest(router, "GET", "/debug/inflight", "", nil)
+	var resp InFlightResponse
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if w.Code != http.StatusOK || resp.InFlight != 4 {
+		t.Fatalf("Expected the blocked requests and the listing in flight, got %d: %s", w.Code, w.Body.String())
+	}
+	found := false
+	for _, route := range resp.Routes {
+		if route.Route == "/test/block/:n" {
+			found = route.InFlight == 3
+		}
+	}
+	if !found {
+		t.Errorf("Expected 3 in flight on the route template, got %+v", resp.Routes)
+	}
+	if w := doRequest(router, "GET", "/metrics", "", nil); !strings.Contains(w.Body.String(), `http_route_requests_in_flight{route="/test/block/:n"} 3`) {
+		t.Errorf("Expected the route gauge in the metrics, got %s", w.Body.String())
+	}
+	close(release)
+	wg.Wait()
+	if got := routeGauge(server, "/test/block/:n"); got != 0 {
+		t.Errorf("Expected the gauge back to 0, got %d", got)
+	}
+
+	// A panicking handler is still counted out
+	if w := doRequest(router, "GET", "/test/panic", "", nil); w.Code != http.StatusInternalServerError {
+		t.Fatalf("Expected the panic recovered, got %d", w.Code)
+	}
+	if got := routeGauge(server, "/test/panic"); got != 0 {
+		t.Errorf("Expected no request in flight after a panic, got %d", got)
+	}
+
+	// So is a long poll whose client disconnects
+	doRequest(router, "GET", "/visit/home", "", nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		req := httptest.NewRequest("GET", "/visits/home/wait?since=10&timeout=30s", nil).WithContext(ctx)
+		router.ServeHTTP(httptest.NewRecorder(), req)
+	}()
+	waitFor(t, time.Second, func() bool { return routeGauge(server, "/visits/:page/wait") == 1 })
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Expected the long poll to end with its client")
+	}
+	if got := routeGauge(server, "/visits/:page/wait"); got != 0 {
+		t.Errorf("Expected the disconnected request counted out, got %d", got)
+	}
+	if got := server.inflight.total.Load(); got != 0 {
+		t.Errorf("Expected nothing in flight, got %d", got)
+	}
+}
+
+func TestInFlightSaturationAlert(t *testing.T) {
+	var mu sync.Mutex
+	var alerts []SaturationAlert
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var alert SaturationAlert
+		json.NewDecoder(r.Body).Decode(&alert)
+		mu.Lock()
+		alerts = append(alerts, alert)
+		mu.Unlock()
+	}))
+	defer hook.Close()
+	received := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(alerts)
+	}
+
+	_, redisClient := newTestRedis(t)
+	start := time.Date(2024, 3, 10, 12, 0, 0, 0, time.UTC)
+	clock := clocktest.New(start)
+	cfg := testConfig()
+	cfg.InFlightSoftLimit, cfg.InFlightSaturationAfter, cfg.AlertWebhookURL = 2, 10*time.Second, hook.URL
+	server := newTestServerWithClock(t, cfg, redisClient, clock)
+	router := server.Router()
+	release := make(chan struct{})
+	router.GET("/test/block", func(c *gin.Context) { <-release })
+	check := func() {
+		t.Helper()
+		if err := server.inflight.check(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// At the soft limit is not saturated
+	wg := serveBlocked(t, server, router, "/test/block", "/test/block", 2)
+	check()
+	clock.Advance(time.Minute)
+	check()
+	if got := server.inflight.route("/test/block"); !got.over.IsZero() {
+		t.Errorf("Expected no saturation at the limit, since %v", got.over)
+	}
+
+	// Above it, only once it lasts longer than the period
+	more := serveBlocked(t, server, router, "/test/block", "/test/block", 3)
+	check()
+	clock.Advance(10 * time.Second)
+	check()
+	if got := server.inflight.route("/test/block").incidents.Load(); got != 0 {
+		t.Errorf("Expected no incident before the period passed, got %d", got)
+	}
+	clock.Advance(time.Second)
+	check()
+	clock.Advance(time.Minute)
+	check()
+	waitFor(t, time.Second, func() bool { return received() == 1 })
+	mu.Lock()
+	got := alerts[0]
+	mu.Unlock()
+	if got.Event != "route.saturated" || got.Route != "/test/block" || got.InFlight != 5 || got.Threshold != 2 || !got.Since.Equal(start.Add(time.Minute)) {
+		t.Errorf("Unexpected alert %+v", got)
+	}
+	w := doRequest(router, "GET", "/debug/inflight", "", nil)
+	if !strings.Contains(w.Body.String(), `"route":"/test/block","in_flight":5,"saturated_since":"2024-03-10T12:01:00Z","incidents":1`) {
+		t.Errorf("Expected the saturation listed, got %s", w.Body.String())
+	}
+
+	// Dropping back ends the incident, and the next one alerts again
+	close(release)
+	wg.Wait()
+	more.Wait()
+	check()
+	release = make(chan struct{})
+	defer close(release)
+	serveBlocked(t, server, router, "/test/block", "/test/block", 3)
+	for i := 0; i < 3; i++ {
+		check()
+		clock.Advance(6 * time.Second)
+	}
+	waitFor(t, time.Second, func() bool { return received() == 2 })
+	if w := doRequest(router, "GET", "/metrics", "", nil); !strings.Contains(w.Body.String(), `http_route_saturation_incidents_total{route="/test/block"} 2`) {
+		t.Errorf("Expected 2 incidents in the metrics, got %s", w.Body.String())
+	}
+}
+
+func BenchmarkInFlightTracking(b *testing.B) {
+	gin.SetMode(gin.ReleaseMode)
+	tracker := newInFlightTracker(Config{}, systemClock{}, nil)
+	for _, bench := range []struct {
+		name       string
+		middleware []gin.HandlerFunc
+	}{
+		{"untracked", nil},
+		{"tracked", []gin.HandlerFunc{tracker.track}},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			r := gin.New()
+			r.Use(bench.middleware...)
+			r.GET("/visits/:page", func(c *gin.Context) { c.Status(http.StatusNoContent) })
+			b.ReportAllocs()
+			b.RunParallel(func(pb *testing.PB) {
+				req := httptest.NewRequest("GET", "/visits/home", nil)
+				w := httptest.NewRecorder()
+				for pb.Next() {
+					r.ServeHTTP(w, req)
+				}
+			})
+		})
+	}
+}
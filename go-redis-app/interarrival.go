@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+// interarrivalBuckets are the upper bounds of the inter-arrival histogram,
+// roughly one per order of magnitude; slower arrivals go in a last bucket
+var interarrivalBuckets = []time.Duration{time.Second, 10 * time.Second, time.Minute, 10 * time.Minute, time.Hour, 24 * time.Hour}
+
+// interarrivalLabels name the histogram buckets, and are their hash fields
+var interarrivalLabels = []string{"1s", "10s", "1m", "10m", "1h", "1d", "+Inf"}
+
+const (
+	// interarrivalFlagField is the histogram hash field holding whether the
+	// page was last flagged as a suspected bot
+	interarrivalFlagField = "suspected_bot"
+
+	// interarrivalMinSamples is the number of inter-arrival times a page
+	// needs before it can be flagged
+	interarrivalMinSamples = 20
+)
+
+// interarrivalKey is the hash of a page's inter-arrival histogram
+func interarrivalKey(page string) string {
+	return key("visits", "interarrival", page)
+}
+
+// interarrivalBucket returns the index of the bucket an inter-arrival time
+// falls in, len(interarrivalBuckets) for times above the last bound
+func interarrivalBucket(delta time.Duration) int {
+	for i, le := range interarrivalBuckets {
+		if delta <= le {
+			return i
+		}
+	}
+	return len(interarrivalBuckets)
+}
+
+// interarrivalMedian returns the index of the bucket holding the median of
+// a histogram, taking the lower median of an even count, and the number of
+// samples; -1 for an empty histogram
+func interarrivalMedian(counts []int64) (int, int64) {
+	var total int64
+	for _, n := range counts {
+		total += n
+	}
+	if total == 0 {
+		return -1, 0
+	}
+	rank, cumulative := (total+1)/2, int64(0)
+	for i, n := range counts {
+		if cumulative += n; cumulative >= rank {
+			return i, total
+		}
+	}
+	return len(counts) - 1, total
+}
+
+// suspectedBot reports whether a histogram's median is under threshold:
+// the bucket holding it is bounded by threshold or less. Pages with fewer
+// than interarrivalMinSamples samples, and a threshold of 0, never are.
+func suspectedBot(counts []int64, threshold time.Duration) bool {
+	median, total := interarrivalMedian(counts)
+	if threshold <= 0 || total < interarrivalMinSamples || median >= len(interarrivalBuckets) {
+		return false
+	}
+	return interarrivalBuckets[median] <= threshold
+}
+
+// parseInterarrival reads a histogram hash into bucket counts and the flag
+func parseInterarrival(fields map[string]string) ([]int64, bool) {
+	counts := make([]int64, len(interarrivalLabels))
+	for i, label := range interarrivalLabels {
+		counts[i], _ = strconv.ParseInt(fields[label], 10, 64)
+	}
+	return counts, fields[interarrivalFlagField] == "1"
+}
+
+// RecordInterarrival adds an inter-arrival time to a page's histogram and
+// returns the histogram and whether the page is flagged
+func (r *RedisClient) RecordInterarrival(ctx context.Context, page string, delta time.Duration) ([]int64, bool, error) {
+	var fields *redis.MapStringStringCmd
+	_, err := r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HIncrBy(ctx, interarrivalKey(page), interarrivalLabels[interarrivalBucket(delta)], 1)
+		fields = pipe.HGetAll(ctx, interarrivalKey(page))
+		return nil
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	counts, flagged := parseInterarrival(fields.Val())
+	return counts, flagged, nil
+}
+
+// Interarrival returns a page's histogram and whether it is flagged
+func (r *RedisClient) Interarrival(ctx context.Context, page string) ([]int64, bool, error) {
+	fields, err := r.client.HGetAll(ctx, interarrivalKey(page)).Result()
+	if err != nil {
+		return nil, false, err
+	}
+	counts, flagged := parseInterarrival(fields)
+	return counts, flagged, nil
+}
+
+// SetInterarrivalFlag records whether a page is flagged as a suspected bot
+func (r *RedisClient) SetInterarrivalFlag(ctx context.Context, page string, flagged bool) error {
+	return r.client.HSet(ctx, interarrivalKey(page), interarrivalFlagField, boolFlag(flagged)).Err()
+}
+
+// recordInterarrival adds a visit's inter-arrival time to the page's
+// histogram and, when that moves its median across INTERARRIVAL_BOT_MEDIAN,
+// sets or clears its suspected_bot flag. Failures are logged: the histogram
+// never fails a visit.
+func (s *Server) recordInterarrival(ctx context.Context, page string, delta time.Duration) {
+	counts, flagged, err := s.redis.RecordInterarrival(ctx, page, max(delta, 0))
+	if err != nil {
+		log.Printf("Error recording inter-arrival time: %v", err)
+		return
+	}
+	suspected := suspectedBot(counts, s.cfg.InterarrivalBotMedian)
+	if suspected == flagged {
+		return
+	}
+	if err := s.redis.SetInterarrivalFlag(ctx, page, suspected); err != nil {
+		log.Printf("Error flagging suspected bot traffic: %v", err)
+		return
+	}
+	if suspected {
+		log.Printf("Flagged %s as suspected bot traffic: median inter-arrival under %s", page, s.cfg.InterarrivalBotMedian)
+	} else {
+		log.Printf("Cleared the suspected bot flag of %s", page)
+	}
+}
+
+// InterarrivalBucket is one bucket of an inter-arrival histogram
+type InterarrivalBucket struct {
+	LE     string `json:"le"`
+	Visits int64  `json:"visits"`
+}
+
+// InterarrivalResponse represents the /visits/:page/interarrival API response
+type InterarrivalResponse struct {
+	Page    string               `json:"page"`
+	Samples int64                `json:"samples"`
+	Buckets []InterarrivalBucket `json:"buckets"`
+
+	// MedianLE is the upper bound of the bucket holding the median
+	MedianLE     string `json:"median_le,omitempty"`
+	SuspectedBot bool   `json:"suspected_bot"`
+}
+
+// handleGetInterarrival returns a page's inter-arrival histogram
+func (s *Server) handleGetInterarrival(c *gin.Context) {
+	page := c.Param("page")
+	hidden, err := s.pageHidden(c, page)
+	if err != nil {
+		log.Printf("Error getting page metadata: %v", err)
+		respondStoreError(c, err, "Failed to get inter-arrival times")
+		return
+	}
+	if hidden {
+		respondError(c, http.StatusNotFound, "not_found", "Page not found")
+		return
+	}
+
+	counts, flagged, err := s.redis.Interarrival(c.Request.Context(), page)
+	if err != nil {
+		log.Printf("Error getting inter-arrival times: %v", err)
+		respondStoreError(c, err, "Failed to get inter-arrival times")
+		return
+	}
+	response := InterarrivalResponse{Page: page, Buckets: make([]InterarrivalBucket, len(counts)), SuspectedBot: flagged}
+	for i, n := range counts {
+		response.Buckets[i] = InterarrivalBucket{LE: interarrivalLabels[i], Visits: n}
+	}
+	var median int
+	if median, response.Samples = interarrivalMedian(counts); median >= 0 {
+		response.MedianLE = interarrivalLabels[median]
+	}
+	respondJSON(c, http.StatusOK, response)
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"go-redis-app/internal/clocktest"
+)
+
+func TestInterarrivalBucket(t *testing.T) {
+	tests := map[time.Duration]int{
+		0:                          0,
+		300 * time.Millisecond:     0,
+		time.Second:                0,
+		time.Second + 1:            1,
+		10 * time.Second:           1,
+		30 * time.Second:           2,
+		5 * time.Minute:            3,
+		59 * time.Minute:           4,
+		23 * time.Hour:             5,
+		24*time.Hour + time.Second: 6,
+		30 * 24 * time.Hour:        6,
+	}
+	for delta, want := range tests {
+		if got := interarrivalBucket(delta); got != want {
+			t.Errorf("interarrivalBucket(%s) = %d, want %d", delta, got, want)
+		}
+	}
+}
+
+func TestInterarrivalMedian(t *testing.T) {
+	tests := []struct {
+		counts []int64
+		median int
+		total  int64
+	}{
+		{[]int64{0, 0, 0, 0, 0, 0, 0}, -1, 0},
+		{[]int64{1, 0, 0, 0, 0, 0, 0}, 0, 1},
+		{[]int64{2, 1, 0, 0, 0, 0, 0}, 0, 3},
+		{[]int64{1, 1, 0, 0, 0, 0, 0}, 0, 2}, // lower median
+		{[]int64{1, 0, 2, 0, 0, 0, 0}, 2, 3},
+		{[]int64{0, 0, 0, 0, 0, 0, 5}, 6, 5},
+	}
+	for _, tt := range tests {
+		if median, total := interarrivalMedian(tt.counts); median != tt.median || total != tt.total {
+			t.Errorf("interarrivalMedian(%v) = %d, %d, want %d, %d", tt.counts, median, total, tt.median, tt.total)
+		}
+	}
+}
+
+func TestSuspectedBot(t *testing.T) {
+	fast := []int64{15, 5, 0, 0, 0, 0, 0}
+	tests := []struct {
+		name      string
+		counts    []int64
+		threshold time.Duration
+		want      bool
+	}{
+		{"sub-second median", fast, time.Second, true},
+		{"threshold off", fast, 0, false},
+		{"too few samples", []int64{19, 0, 0, 0, 0, 0, 0}, time.Second, false},
+		{"median above threshold", []int64{5, 15, 0, 0, 0, 0, 0}, time.Second, false},
+		{"wider threshold", []int64{5, 15, 0, 0, 0, 0, 0}, 10 * time.Second, true},
+		{"threshold inside a bucket", []int64{5, 15, 0, 0, 0, 0, 0}, 5 * time.Second, false},
+		{"slowest bucket", []int64{0, 0, 0, 0, 0, 0, 20}, 365 * 24 * time.Hour, false},
+	}
+	for _, tt := range tests {
+		if got := suspectedBot(tt.counts, tt.threshold); got != tt.want {
+			t.Errorf("%s: suspectedBot(%v, %s) = %v, want %v", tt.name, tt.counts, tt.threshold, got, tt.want)
+		}
+	}
+}
+
+func TestInterarrivalEndToEnd(t *testing.T) {
+	_, redisClient := newTestRedis(t)
+	cfg := testConfig()
+	cfg.InterarrivalBotMedian = time.Second
+	clock := clocktest.New(time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC))
+	server := newTestServerWithClock(t, cfg, redisClient, clock)
+	router := server.Router()
+
+	// interarrival reads the page's histogram
+	interarrival := func() InterarrivalResponse {
+		t.Helper()
+		var resp InterarrivalResponse
+		w := doRequest(router, "GET", "/visits/feed/interarrival", "", nil)
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || w.Code != http.StatusOK {
+			t.Fatalf("Expected the histogram, got %d: %s", w.Code, w.Body.String())
+		}
+		return resp
+	}
+	// suspected reads the page's suspected_bot metadata
+	suspected := func() bool {
+		t.Helper()
+		var meta PageMeta
+		w := doRequest(router, "GET", "/pages/feed/meta", "", nil)
+		if err := json.Unmarshal(w.Body.Bytes(), &meta); err != nil || w.Code != http.StatusOK {
+			t.Fatalf("Expected the metadata, got %d: %s", w.Code, w.Body.String())
+		}
+		return meta.SuspectedBot
+	}
+
+	doRequest(router, "PUT", "/admin/pages/feed/meta", `{"title": "Feed"}`, nil)
+	doRequest(router, "GET", "/visit/feed", "", nil)
+	if resp := interarrival(); resp.Samples != 0 || resp.MedianLE != "" {
+		t.Errorf("Expected no inter-arrival time for a first visit, got %+v", resp)
+	}
+
+	// A human pace: minutes apart
+	for i := 0; i < 5; i++ {
+		clock.Advance(3 * time.Minute)
+		doRequest(router, "GET", "/visit/feed", "", nil)
+	}
+	// Then a script: one visit every 200ms
+	for i := 0; i < interarrivalMinSamples; i++ {
+		clock.Advance(200 * time.Millisecond)
+		doRequest(router, "GET", "/visit/feed", "", nil)
+	}
+	resp := interarrival()
+	if resp.Samples != 25 || resp.Buckets[0].Visits != 20 || resp.Buckets[3].Visits != 5 || resp.MedianLE != "1s" || !resp.SuspectedBot {
+		t.Fatalf("Expected 20 sub-second and 5 ten-minute arrivals flagged, got %+v", resp)
+	}
+	if !suspected() {
+		t.Error("Expected suspected_bot set in the metadata")
+	}
+	var meta PageMeta
+	json.Unmarshal(doRequest(router, "GET", "/pages/feed/meta", "", nil).Body.Bytes(), &meta)
+	if meta.Title != "Feed" || !meta.SuspectedBot {
+		t.Errorf("Expected the flag added to the existing metadata, got %+v", meta)
+	}
+	// The flag is the service's: a PUT neither drops nor clears it
+	doRequest(router, "PUT", "/admin/pages/feed/meta", `{"title": "Feed v2"}`, nil)
+	doRequest(router, "PUT", "/admin/pages/feed/meta", `{"title": "Feed v2", "suspected_bot": false}`, nil)
+	if !suspected() {
+		t.Error("Expected suspected_bot kept across metadata writes")
+	}
+
+	// The script stops; human traffic pulls the median back up
+	for i := 0; i < 2*interarrivalMinSamples; i++ {
+		clock.Advance(time.Hour)
+		doRequest(router, "GET", "/visit/feed", "", nil)
+	}
+	if resp := interarrival(); resp.SuspectedBot || resp.MedianLE != "1h" {
+		t.Errorf("Expected the flag cleared, got %+v", resp)
+	}
+	if suspected() {
+		t.Error("Expected suspected_bot cleared in the metadata")
+	}
+}
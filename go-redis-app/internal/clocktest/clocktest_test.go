@@ -0,0 +1,21 @@
+package clocktest
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFake(t *testing.T) {
+	start := time.Date(2024, 5, 1, 23, 59, 0, 0, time.UTC)
+	clock := New(start)
+	if !clock.Now().Equal(start) {
+		t.Errorf("Expected %s, got %s", start, clock.Now())
+	}
+	if got := clock.Advance(2 * time.Minute); !got.Equal(start.Add(2*time.Minute)) || !clock.Now().Equal(got) {
+		t.Errorf("Expected Advance to move the clock to %s, got %s", start.Add(2*time.Minute), clock.Now())
+	}
+	clock.Set(start)
+	if !clock.Now().Equal(start) {
+		t.Errorf("Expected Set to move the clock back to %s, got %s", start, clock.Now())
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// journeyMaxPages caps the visits kept per visitor journey
+	journeyMaxPages = 50
+
+	// journeyTTL is how long a journey lasts after the visitor's last visit
+	journeyTTL = 24 * time.Hour
+)
+
+// journeyKey is the list of a visitor's recent visits, most recent first,
+// each "<unix ms>:<page>"
+func journeyKey(visitor string) string {
+	return "journey:" + visitor
+}
+
+// JourneyStep is one visit of a visitor journey
+type JourneyStep struct {
+	Page      string    `json:"page"`
+	Timestamp Timestamp `json:"timestamp"`
+}
+
+// JourneyResponse represents the GET /admin/visitors/:id/journey response
+type JourneyResponse struct {
+	Visitor string        `json:"visitor"`
+	Pages   []JourneyStep `json:"pages"`
+	Total   int           `json:"total"`
+}
+
+// queueJourney adds a visit to the visitor's journey, keeping the latest
+// journeyMaxPages and the journey for journeyTTL past it
+func queueJourney(ctx context.Context, pipe redis.Pipeliner, visitor, page string, now time.Time) {
+	k := journeyKey(visitor)
+	pipe.LPush(ctx, k, strconv.FormatInt(now.UnixMilli(), 10)+":"+page)
+	pipe.LTrim(ctx, k, 0, journeyMaxPages-1)
+	pipe.Expire(ctx, k, journeyTTL)
+}
+
+// Journey returns the visitor's recent visits, most recent first. Entries
+// that don't parse are skipped.
+func (r *RedisClient) Journey(ctx context.Context, visitor string) ([]JourneyStep, error) {
+	entries, err := r.client.LRange(ctx, journeyKey(visitor), 0, journeyMaxPages-1).Result()
+	if err != nil {
+		return nil, err
+	}
+	steps := make([]JourneyStep, 0, len(entries))
+	for _, entry := range entries {
+		ms, page, ok := strings.Cut(entry, ":")
+		at, err := strconv.ParseInt(ms, 10, 64)
+		if !ok || err != nil {
+			continue
+		}
+		steps = append(steps, JourneyStep{Page: page, Timestamp: Timestamp{Time: time.UnixMilli(at).UTC()}})
+	}
+	return steps, nil
+}
+
+// isValidHashedVisitor reports whether id looks like a stored visitor: a
+// "c" (cookie) or "ip" kind and a visitor hash
+func isValidHashedVisitor(id string) bool {
+	kind, hash, ok := strings.Cut(id, ":")
+	return ok && (kind == "c" || kind == "ip") && isValidVisitorID(hash)
+}
+
+// handleGetJourney lists a visitor's recent pages. The visitor is the
+// hashed ID carried by visit events, never a raw IP or cookie.
+func (s *Server) handleGetJourney(c *gin.Context) {
+	visitor := c.Param("id")
+	if !isValidHashedVisitor(visitor) {
+		respondError(c, http.StatusBadRequest, "invalid_request", "id must be a hashed visitor ID such as c:<32 hex digits>")
+		return
+	}
+	steps, err := s.redis.Journey(c.Request.Context(), visitor)
+	if err != nil {
+		log.Printf("Error getting visitor journey: %v", err)
+		respondStoreError(c, err, "Failed to get visitor journey")
+		return
+	}
+	for i := range steps {
+		steps[i].Timestamp = stamp(c, steps[i].Timestamp.Time)
+	}
+	respondJSON(c, http.StatusOK, JourneyResponse{Visitor: visitor, Pages: steps, Total: len(steps)})
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"go-redis-app/internal/clocktest"
+)
+
+func TestVisitorJourney(t *testing.T) {
+	mr, redisClient := newTestRedis(t)
+	start := time.Date(2024, 3, 10, 12, 0, 0, 0, time.UTC)
+	clock := clocktest.New(start)
+	cfg := testConfig()
+	cfg.VisitorCookie = true
+	server := newTestServerWithClock(t, cfg, redisClient, clock)
+	router := server.Router()
+
+	cookie := &http.Cookie{Name: visitorCookieName, Value: strings.Repeat("ab", 16)}
+	for i := 0; i < journeyMaxPages+5; i++ {
+		if w, _ := visitWithHeaders(t, router, fmt.Sprintf("page-%02d", i), nil, cookie); w.Code != http.StatusOK {
+			t.Fatalf("Visit: %d %s", w.Code, w.Body.String())
+		}
+		clock.Advance(time.Second)
+	}
+	visitor, err := server.hashedVisitor(context.Background(), "c", cookie.Value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mr.Exists(journeyKey(cookie.Value)) {
+		t.Error("Expected the journey keyed by the hashed visitor, not the raw ID")
+	}
+	if got := mr.TTL(journeyKey(visitor)); got != journeyTTL {
+		t.Errorf("Expected the journey to expire after %v, got %v", journeyTTL, got)
+	}
+
+	w := doRequest(router, "GET", "/admin/visitors/"+visitor+"/journey", "", nil)
+	var resp JourneyResponse
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if w.Code != http.StatusOK || resp.Visitor != visitor || resp.Total != journeyMaxPages || len(resp.Pages) != journeyMaxPages {
+		t.Fatalf("Expected the journey capped at %d, got %d: %s", journeyMaxPages, w.Code, w.Body.String())
+	}
+	// Most recent first, the 5 oldest visits trimmed
+	for i, step := range resp.Pages {
+		n := journeyMaxPages + 4 - i
+		if want := fmt.Sprintf("page-%02d", n); step.Page != want {
+			t.Errorf("Expected step %d to be %s, got %s", i, want, step.Page)
+		}
+		if want := start.Add(time.Duration(n) * time.Second); !step.Timestamp.Time.Equal(want) {
+			t.Errorf("Expected step %d at %v, got %v", i, want, step.Timestamp.Time)
+		}
+	}
+
+	// Visitors without a journey have an empty one
+	other := "ip:" + strings.Repeat("0", 32)
+	w = doRequest(router, "GET", "/admin/visitors/"+other+"/journey", "", nil)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"pages":[]`) {
+		t.Errorf("Expected an empty journey, got %d: %s", w.Code, w.Body.String())
+	}
+	for _, id := range []string{"203.0.113.7", cookie.Value, "c:" + cookie.Value[:8], "x:" + cookie.Value} {
+		if w := doRequest(router, "GET", "/admin/visitors/"+id+"/journey", "", nil); w.Code != http.StatusBadRequest {
+			t.Errorf("Expected %q rejected as a visitor ID, got %d", id, w.Code)
+		}
+	}
+
+	// Privacy purges of the visitor remove the journey
+	if w := doRequest(router, "POST", "/admin/privacy/purge", `{"identifier":"`+cookie.Value+`"}`, nil); w.Code != http.StatusOK {
+		t.Fatalf("Purge: %d %s", w.Code, w.Body.String())
+	}
+	if mr.Exists(journeyKey(visitor)) {
+		t.Error("Expected the journey purged with the visitor")
+	}
+}
+
+func TestVisitorJourneyDisabled(t *testing.T) {
+	mr, redisClient := newTestRedis(t)
+	router := newTestServer(t, testConfig(), redisClient).Router()
+	ip := "ip:" + strings.Repeat("0", 32)
+
+	doRequest(router, "GET", "/visit/home", "", nil)
+	if keys := journeyKeys(mr); len(keys) != 0 {
+		t.Errorf("Expected no journeys without visitor IDs, got %v", keys)
+	}
+	if w := doRequest(router, "GET", "/admin/visitors/"+ip+"/journey", "", nil); w.Code != http.StatusNotFound {
+		t.Errorf("Expected no journey endpoint, got %d", w.Code)
+	}
+}
+
+func journeyKeys(mr *miniredis.Miniredis) []string {
+	var keys []string
+	for _, key := range mr.Keys() {
+		if strings.HasPrefix(key, "journey:") {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Permission is an access level granted by a token role
+type Permission int
+
+const (
+	PermNone Permission = iota
+	PermRead
+	PermWrite
+	PermAdmin
+)
+
+// permissionKey is the context key holding the caller's Permission
+const permissionKey = "permission"
+
+// authenticatedKey is the context key set when the caller presented a token
+const authenticatedKey = "authenticated"
+
+// ParsePermission maps a role claim to a permission level
+func ParsePermission(role string) (Permission, error) {
+	switch strings.ToLower(role) {
+	case "none":
+		return PermNone, nil
+	case "read":
+		return PermRead, nil
+	case "write":
+		return PermWrite, nil
+	case "admin":
+		return PermAdmin, nil
+	}
+	return PermNone, fmt.Errorf("unknown role %q", role)
+}
+
+// Claims are the JWT claims understood by the service
+type Claims struct {
+	Role string `json:"role"`
+	jwt.RegisteredClaims
+}
+
+// JWTAuth validates bearer tokens signed with a static HS256 secret or keys
+// published at a JWKS URL
+type JWTAuth struct {
+	secret   []byte
+	jwks     *JWKSCache
+	issuer   string
+	audience string
+	clock    Clock
+}
+
+// NewJWTAuth returns nil when neither a secret nor a JWKS URL is configured
+func NewJWTAuth(cfg Config, clock Clock) *JWTAuth {
+	if cfg.JWTSecret == "" && cfg.JWTJWKSURL == "" {
+		return nil
+	}
+	auth := &JWTAuth{issuer: cfg.JWTIssuer, audience: cfg.JWTAudience, clock: clock}
+	if cfg.JWTSecret != "" {
+		auth.secret = []byte(cfg.JWTSecret)
+	}
+	if cfg.JWTJWKSURL != "" {
+		auth.jwks = NewJWKSCache(cfg.JWTJWKSURL, clock)
+	}
+	return auth
+}
+
+// Validate parses the token and checks its signature, issuer, audience, and expiry
+func (a *JWTAuth) Validate(ctx context.Context, token string) (*Claims, error) {
+	var methods []string
+	if a.secret != nil {
+		methods = append(methods, "HS256")
+	}
+	if a.jwks != nil {
+		methods = append(methods, "RS256", "RS384", "RS512")
+	}
+
+	opts := []jwt.ParserOption{jwt.WithValidMethods(methods), jwt.WithExpirationRequired(), jwt.WithTimeFunc(a.clock.Now)}
+	if a.issuer != "" {
+		opts = append(opts, jwt.WithIssuer(a.issuer))
+	}
+	if a.audience != "" {
+		opts = append(opts, jwt.WithAudience(a.audience))
+	}
+
+	claims := &Claims{}
+	_, err := jwt.ParseWithClaims(token, claims, func(t *jwt.Token) (interface{}, error) {
+		if _, ok := t.Method.(*jwt.SigningMethodHMAC); ok {
+			return a.secret, nil
+		}
+		kid, _ := t.Header["kid"].(string)
+		return a.jwks.Key(ctx, kid)
+	}, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// JWKSCache caches RSA keys from a JWKS endpoint, refetching on a key miss
+type JWKSCache struct {
+	url         string
+	client      *http.Client
+	minInterval time.Duration
+	clock       Clock
+
+	mu        sync.Mutex
+	keys      map[string]*rsa.PublicKey
+	lastFetch time.Time
+}
+
+// NewJWKSCache creates a cache for the given JWKS URL
+func NewJWKSCache(url string, clock Clock) *JWKSCache {
+	return &JWKSCache{
+		url:         url,
+		client:      &http.Client{Timeout: 5 * time.Second},
+		minInterval: 10 * time.Second,
+		clock:       clock,
+		keys:        make(map[string]*rsa.PublicKey),
+	}
+}
+
+// Key returns the key with the given ID, refreshing the set when it is
+// unknown (at most once per minInterval)
+func (j *JWKSCache) Key(ctx context.Context, kid string) (*rsa.PublicKey, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if key, ok := j.keys[kid]; ok {
+		return key, nil
+	}
+	if j.clock.Now().Sub(j.lastFetch) < j.minInterval {
+		return nil, fmt.Errorf("unknown key ID %q", kid)
+	}
+	if err := j.fetch(ctx); err != nil {
+		return nil, err
+	}
+	if key, ok := j.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown key ID %q", kid)
+}
+
+// fetch replaces the cached keys with the current JWKS document
+func (j *JWKSCache) fetch(ctx context.Context) error {
+	j.lastFetch = j.clock.Now()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, j.url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := j.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("fetching JWKS: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("fetching JWKS: status %d", resp.StatusCode)
+	}
+
+	var doc struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		return fmt.Errorf("decoding JWKS: %w", err)
+	}
+
+	keys := make(map[string]*rsa.PublicKey, len(doc.Keys))
+	for _, k := range doc.Keys {
+		if k.Kty != "RSA" {
+			continue
+		}
+		n, errN := base64.RawURLEncoding.DecodeString(k.N)
+		e, errE := base64.RawURLEncoding.DecodeString(k.E)
+		if errN != nil || errE != nil {
+			continue
+		}
+		keys[k.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+	j.keys = keys
+	return nil
+}
+
+// authenticate resolves the caller's permission from an optional bearer token.
+// Invalid tokens are rejected with 401; requests without one get the
+// anonymous permission.
+func (s *Server) authenticate(c *gin.Context) {
+	header := c.GetHeader("Authorization")
+	if s.jwt == nil || !strings.HasPrefix(header, "Bearer ") {
+		c.Set(permissionKey, s.cfg.AnonymousPermission)
+		c.Next()
+		return
+	}
+
+	claims, err := s.jwt.Validate(c.Request.Context(), strings.TrimPrefix(header, "Bearer "))
+	if err != nil {
+		respondError(c, http.StatusUnauthorized, "invalid_token", "Invalid bearer token: "+err.Error())
+		return
+	}
+	perm, err := ParsePermission(claims.Role)
+	if err != nil {
+		respondError(c, http.StatusUnauthorized, "invalid_token", "Invalid bearer token: "+err.Error())
+		return
+	}
+
+	c.Set(permissionKey, perm)
+	c.Set(authenticatedKey, true)
+	c.Set(actorKey, claims.Subject)
+	c.Next()
+}
+
+// requirePermission rejects callers below the given permission: 401 when no
+// token was presented, 403 when the token's role is insufficient
+func requirePermission(perm Permission) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if callerPermission(c) >= perm {
+			c.Next()
+			return
+		}
+		if !c.GetBool(authenticatedKey) {
+			respondError(c, http.StatusUnauthorized, "unauthorized", "A bearer token is required")
+			return
+		}
+		respondError(c, http.StatusForbidden, "forbidden", "Token role does not grant access to this route")
+	}
+}
+
+// callerPermission returns the permission resolved by authenticate
+func callerPermission(c *gin.Context) Permission {
+	perm, _ := c.Get(permissionKey)
+	p, _ := perm.(Permission)
+	return p
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func mintHS256(t *testing.T, secret string, claims Claims) string {
+	t.Helper()
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(secret))
+	if err != nil {
+		t.Fatalf("Failed to sign token: %v", err)
+	}
+	return token
+}
+
+func testClaims(role string, expiresIn time.Duration) Claims {
+	return Claims{
+		Role: role,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   "alice",
+			Issuer:    "https://idp.example.com",
+			Audience:  jwt.ClaimStrings{"visits-api"},
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(expiresIn)),
+		},
+	}
+}
+
+func jwtTestConfig() Config {
+	cfg := testConfig()
+	cfg.JWTSecret = "jwt-secret"
+	cfg.JWTIssuer = "https://idp.example.com"
+	cfg.JWTAudience = "visits-api"
+	cfg.AnonymousPermission = PermNone
+	return cfg
+}
+
+func TestJWTRoleEnforcement(t *testing.T) {
+	_, redisClient := newTestRedis(t)
+	cfg := jwtTestConfig()
+	router := newTestServer(t, cfg, redisClient).Router()
+
+	bearer := func(claims Claims) map[string]string {
+		return map[string]string{"Authorization": "Bearer " + mintHS256(t, cfg.JWTSecret, claims)}
+	}
+	wrongAudience := testClaims("admin", time.Hour)
+	wrongAudience.Audience = jwt.ClaimStrings{"other-api"}
+	wrongIssuer := testClaims("admin", time.Hour)
+	wrongIssuer.Issuer = "https://evil.example.com"
+
+	tests := []struct {
+		name    string
+		path    string
+		headers map[string]string
+		status  int
+	}{
+		{"anonymous read", "/visits/home", nil, http.StatusUnauthorized},
+		{"read token reads", "/visits/home", bearer(testClaims("read", time.Hour)), http.StatusOK},
+		{"read token cannot write", "/visit/home", bearer(testClaims("read", time.Hour)), http.StatusForbidden},
+		{"write token writes", "/visit/home", bearer(testClaims("write", time.Hour)), http.StatusOK},
+		{"write token cannot admin", "/admin/flags", bearer(testClaims("write", time.Hour)), http.StatusForbidden},
+		{"admin token admins", "/admin/flags", bearer(testClaims("admin", time.Hour)), http.StatusOK},
+		{"expired token", "/visits/home", bearer(testClaims("admin", -time.Minute)), http.StatusUnauthorized},
+		{"wrong audience", "/visits/home", bearer(wrongAudience), http.StatusUnauthorized},
+		{"wrong issuer", "/visits/home", bearer(wrongIssuer), http.StatusUnauthorized},
+		{"unknown role", "/visits/home", bearer(testClaims("owner", time.Hour)), http.StatusUnauthorized},
+		{"bad signature", "/visits/home", map[string]string{
+			"Authorization": "Bearer " + mintHS256(t, "other-secret", testClaims("admin", time.Hour)),
+		}, http.StatusUnauthorized},
+		{"garbage token", "/visits/home", map[string]string{"Authorization": "Bearer abc.def"}, http.StatusUnauthorized},
+		{"health stays public", "/health", nil, http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if w := doRequest(router, "GET", tt.path, "", tt.headers); w.Code != tt.status {
+				t.Errorf("Expected %d, got %d: %s", tt.status, w.Code, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestJWTAdminActorInAudit(t *testing.T) {
+	_, redisClient := newTestRedis(t)
+	cfg := jwtTestConfig()
+	router := newTestServer(t, cfg, redisClient).Router()
+	headers := map[string]string{"Authorization": "Bearer " + mintHS256(t, cfg.JWTSecret, testClaims("admin", time.Hour))}
+
+	doRequest(router, "PUT", "/admin/flags", `{"dedupe": true}`, headers)
+	w := doRequest(router, "GET", "/admin/audit", "", headers)
+	var resp AuditResponse
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if len(resp.Entries) != 1 || resp.Entries[0].Actor != "alice" {
+		t.Errorf("Expected one entry by alice, got %+v", resp.Entries)
+	}
+}
+
+// jwksServer serves the public keys of the current signing keys
+type jwksServer struct {
+	mu   sync.Mutex
+	keys map[string]*rsa.PrivateKey
+	hits int
+}
+
+func (j *jwksServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.hits++
+	var doc struct {
+		Keys []map[string]string `json:"keys"`
+	}
+	for kid, key := range j.keys {
+		doc.Keys = append(doc.Keys, map[string]string{
+			"kty": "RSA",
+			"kid": kid,
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		})
+	}
+	json.NewEncoder(w).Encode(doc)
+}
+
+func (j *jwksServer) add(t *testing.T, kid string) *rsa.PrivateKey {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	j.mu.Lock()
+	j.keys[kid] = key
+	j.mu.Unlock()
+	return key
+}
+
+func TestJWKSRefreshOnKeyMiss(t *testing.T) {
+	keys := &jwksServer{keys: map[string]*rsa.PrivateKey{}}
+	ts := httptest.NewServer(keys)
+	defer ts.Close()
+
+	auth := NewJWTAuth(Config{JWTJWKSURL: ts.URL}, systemClock{})
+	auth.jwks.minInterval = 0
+	ctx := context.Background()
+
+	sign := func(kid string, key *rsa.PrivateKey) string {
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, testClaims("read", time.Hour))
+		token.Header["kid"] = kid
+		s, err := token.SignedString(key)
+		if err != nil {
+			t.Fatalf("Failed to sign token: %v", err)
+		}
+		return s
+	}
+
+	first := keys.add(t, "k1")
+	if _, err := auth.Validate(ctx, sign("k1", first)); err != nil {
+		t.Fatalf("Expected k1 token to validate: %v", err)
+	}
+	if _, err := auth.Validate(ctx, sign("k1", first)); err != nil {
+		t.Fatalf("Expected cached k1 token to validate: %v", err)
+	}
+	if keys.hits != 1 {
+		t.Errorf("Expected one JWKS fetch, got %d", keys.hits)
+	}
+
+	// A rotated key is picked up on the first miss
+	second := keys.add(t, "k2")
+	if _, err := auth.Validate(ctx, sign("k2", second)); err != nil {
+		t.Fatalf("Expected rotated k2 token to validate: %v", err)
+	}
+	if keys.hits != 2 {
+		t.Errorf("Expected a refresh on key miss, got %d fetches", keys.hits)
+	}
+
+	// HS256 tokens are rejected when only JWKS is configured
+	if _, err := auth.Validate(ctx, mintHS256(t, "x", testClaims("read", time.Hour))); err == nil {
+		t.Error("Expected HS256 token to be rejected")
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// kafkaWriter is the part of kafka.Writer the Kafka sink uses, so tests can
+// stand in for the brokers
+type kafkaWriter interface {
+	WriteMessages(ctx context.Context, msgs ...kafka.Message) error
+	Close() error
+}
+
+// newKafkaWriter creates the producer for KAFKA_BROKERS and KAFKA_TOPIC
+func newKafkaWriter(cfg Config) *kafka.Writer {
+	return &kafka.Writer{
+		Addr:  kafka.TCP(cfg.KafkaBrokers...),
+		Topic: cfg.KafkaTopic,
+		// Messages are keyed by page, keeping each page's events in order on
+		// one partition
+		Balancer:     &kafka.Hash{},
+		BatchSize:    int(cfg.KafkaBatchSize),
+		RequiredAcks: kafka.RequireAll,
+		// The sink hands over whole batches, so the writer need not wait for
+		// more messages
+		BatchTimeout: time.Millisecond,
+	}
+}
+
+// kafkaSink produces visit events to Kafka in batches of up to size
+// messages, sending a partial batch every interval. Failed batches are not
+// retried beyond the writer's own attempts; they are logged and counted.
+type kafkaSink struct {
+	writer   kafkaWriter
+	size     int
+	interval time.Duration
+
+	mu    sync.Mutex
+	batch []kafka.Message
+
+	// sendMu keeps batches in order when a full batch and the interval's
+	// flush race
+	sendMu sync.Mutex
+
+	delivered     int64
+	failed        int64
+	failedBatches int64
+}
+
+// newKafkaSink creates a Kafka sink producing through writer
+func newKafkaSink(writer kafkaWriter, size int, interval time.Duration) *kafkaSink {
+	return &kafkaSink{writer: writer, size: size, interval: interval}
+}
+
+// start sends partial batches every interval until ctx is done
+func (k *kafkaSink) start(ctx context.Context) {
+	runPeriodic(ctx, "Kafka flush", k.interval, func(ctx context.Context) error {
+		// A batch in flight at shutdown is still sent
+		return k.Flush(context.WithoutCancel(ctx))
+	})
+}
+
+// Publish implements EventSink, adding the event to the batch and sending
+// it once full. The Publish that sends a batch returns its error, so the
+// dispatcher counts it as failed; the batch's undelivered events are in
+// kafka_messages_total.
+func (k *kafkaSink) Publish(ctx context.Context, event VisitEvent) error {
+	value, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	k.mu.Lock()
+	k.batch = append(k.batch, kafka.Message{Key: []byte(event.Page), Value: value, Time: event.Timestamp})
+	full := len(k.batch) >= k.size
+	k.mu.Unlock()
+	if full {
+		return k.Flush(ctx)
+	}
+	return nil
+}
+
+// Flush implements Flusher, sending the pending batch
+func (k *kafkaSink) Flush(ctx context.Context) error {
+	k.sendMu.Lock()
+	defer k.sendMu.Unlock()
+	k.mu.Lock()
+	batch := k.batch
+	k.batch = nil
+	k.mu.Unlock()
+	if len(batch) == 0 {
+		return nil
+	}
+
+	err := k.writer.WriteMessages(ctx, batch...)
+	failed := 0
+	if err != nil {
+		var perMessage kafka.WriteErrors
+		if errors.As(err, &perMessage) {
+			failed = perMessage.Count()
+		} else {
+			failed = len(batch)
+		}
+	}
+	k.mu.Lock()
+	k.delivered += int64(len(batch) - failed)
+	k.failed += int64(failed)
+	if failed > 0 {
+		k.failedBatches++
+	}
+	k.mu.Unlock()
+	if err != nil {
+		log.Printf("Kafka sink failed to deliver %d of %d visit events: %v", failed, len(batch), err)
+		return fmt.Errorf("%d of %d events not delivered: %w", failed, len(batch), err)
+	}
+	return nil
+}
+
+// Close releases the writer's connections
+func (k *kafkaSink) Close() error {
+	return k.writer.Close()
+}
+
+// write writes the kafka_* delivery series, formatting their labels with
+// labels
+func (k *kafkaSink) write(b *strings.Builder, labels func(string) string) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	b.WriteString("# HELP kafka_messages_total Visit events produced to Kafka, by result.\n")
+	b.WriteString("# TYPE kafka_messages_total counter\n")
+	for _, result := range []struct {
+		name string
+		n    int64
+	}{{"delivered", k.delivered}, {"failed", k.failed}} {
+		fmt.Fprintf(b, "kafka_messages_total%s %d\n", labels("result="+strconv.Quote(result.name)), result.n)
+	}
+	b.WriteString("# HELP kafka_failed_batches_total Batches with at least one event Kafka did not accept.\n")
+	b.WriteString("# TYPE kafka_failed_batches_total counter\n")
+	fmt.Fprintf(b, "kafka_failed_batches_total%s %d\n", labels(""), k.failedBatches)
+}
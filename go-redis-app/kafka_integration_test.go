@@ -0,0 +1,60 @@
+//go:build integration
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// Run against a Kafka broker with:
+//
+//	KAFKA_TEST_BROKERS=localhost:9092 go test -tags integration -run Kafka
+func TestKafkaSinkWithBroker(t *testing.T) {
+	broker := os.Getenv("KAFKA_TEST_BROKERS")
+	if broker == "" {
+		t.Skip("KAFKA_TEST_BROKERS is not set")
+	}
+	topic := fmt.Sprintf("visits-test-%d", time.Now().UnixNano())
+	conn, err := kafka.Dial("tcp", broker)
+	if err != nil {
+		t.Fatalf("Failed to connect to Kafka: %v", err)
+	}
+	defer conn.Close()
+	if err := conn.CreateTopics(kafka.TopicConfig{Topic: topic, NumPartitions: 1, ReplicationFactor: 1}); err != nil {
+		t.Fatalf("Failed to create topic: %v", err)
+	}
+
+	cfg := testConfig()
+	cfg.KafkaBrokers, cfg.KafkaTopic, cfg.KafkaBatchSize = []string{broker}, topic, 10
+	sink := newKafkaSink(newKafkaWriter(cfg), 10, time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	for i := 1; i <= 3; i++ {
+		sink.Publish(ctx, VisitEvent{Page: "home", Visits: int64(i), Timestamp: time.Now().UTC()})
+	}
+	if err := sink.Flush(ctx); err != nil {
+		t.Fatalf("Failed to produce: %v", err)
+	}
+	sink.Close()
+
+	reader := kafka.NewReader(kafka.ReaderConfig{Brokers: []string{broker}, Topic: topic})
+	defer reader.Close()
+	for i := 1; i <= 3; i++ {
+		msg, err := reader.ReadMessage(ctx)
+		if err != nil {
+			t.Fatalf("Failed to read message %d: %v", i, err)
+		}
+		var event VisitEvent
+		json.Unmarshal(msg.Value, &event)
+		if string(msg.Key) != "home" || event.Visits != int64(i) {
+			t.Errorf("Expected visit %d of home, got %s: %s", i, msg.Key, msg.Value)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// fakeKafka stands in for the brokers, recording each batch written and
+// failing those it is told to
+type fakeKafka struct {
+	mu      sync.Mutex
+	batches [][]kafka.Message
+	err     error
+	closed  bool
+}
+
+func (f *fakeKafka) WriteMessages(_ context.Context, msgs ...kafka.Message) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.batches = append(f.batches, msgs)
+	return f.err
+}
+
+func (f *fakeKafka) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.closed = true
+	return nil
+}
+
+func (f *fakeKafka) written() [][]kafka.Message {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([][]kafka.Message(nil), f.batches...)
+}
+
+func TestKafkaSinkBatches(t *testing.T) {
+	writer := &fakeKafka{}
+	sink := newKafkaSink(writer, 3, time.Hour)
+	ctx := context.Background()
+	at := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	for i, page := range []string{"home", "blog", "home", "about"} {
+		sink.Publish(ctx, VisitEvent{Page: page, Visits: int64(i + 1), Timestamp: at})
+	}
+
+	batches := writer.written()
+	if len(batches) != 1 || len(batches[0]) != 3 {
+		t.Fatalf("Expected one full batch of 3, got %v", batches)
+	}
+	msg := batches[0][1]
+	var event VisitEvent
+	json.Unmarshal(msg.Value, &event)
+	if string(msg.Key) != "blog" || event.Visits != 2 || !msg.Time.Equal(at) {
+		t.Errorf("Expected the message keyed by page, got %s: %s", msg.Key, msg.Value)
+	}
+
+	if err := sink.Flush(ctx); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	if batches = writer.written(); len(batches) != 2 || len(batches[1]) != 1 || string(batches[1][0].Key) != "about" {
+		t.Errorf("Expected the partial batch sent on flush, got %v", batches)
+	}
+	sink.Flush(ctx)
+	if len(writer.written()) != 2 {
+		t.Error("Expected no write without pending events")
+	}
+	sink.Close()
+	if !writer.closed {
+		t.Error("Expected the writer closed")
+	}
+}
+
+func TestKafkaSinkInterval(t *testing.T) {
+	writer := &fakeKafka{}
+	sink := newKafkaSink(writer, 100, 10*time.Millisecond)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sink.start(ctx)
+	sink.Publish(ctx, VisitEvent{Page: "home"})
+	waitFor(t, 2*time.Second, func() bool { return len(writer.written()) == 1 })
+}
+
+func TestKafkaSinkDeliveryFailures(t *testing.T) {
+	writer := &fakeKafka{err: errors.New("kafka: leader not available")}
+	sink := newKafkaSink(writer, 3, time.Hour)
+	ctx := context.Background()
+	sink.Publish(ctx, VisitEvent{Page: "home"})
+	sink.Publish(ctx, VisitEvent{Page: "blog"})
+	if err := sink.Flush(ctx); err == nil {
+		t.Error("Expected the failed flush reported")
+	}
+
+	// Only some messages of a batch can fail
+	writer.err = kafka.WriteErrors{nil, kafka.NotLeaderForPartition, nil}
+	for i := 0; i < 2; i++ {
+		if err := sink.Publish(ctx, VisitEvent{Page: "home"}); err != nil {
+			t.Errorf("Expected events batched without error, got %v", err)
+		}
+	}
+	// The Publish that fills the batch reports its failure
+	if err := sink.Publish(ctx, VisitEvent{Page: "home"}); err == nil {
+		t.Error("Expected the failed batch reported by Publish")
+	}
+
+	var b strings.Builder
+	sink.write(&b, func(labels string) string {
+		if labels == "" {
+			return ""
+		}
+		return "{" + labels + "}"
+	})
+	for _, want := range []string{
+		`kafka_messages_total{result="delivered"} 2`,
+		`kafka_messages_total{result="failed"} 3`,
+		"kafka_failed_batches_total 2",
+	} {
+		if !strings.Contains(b.String(), want+"\n") {
+			t.Errorf("Expected %s in\n%s", want, b.String())
+		}
+	}
+}
+
+func TestKafkaSinkThroughDispatcher(t *testing.T) {
+	writer := &fakeKafka{}
+	sink := newKafkaSink(writer, 10, time.Hour)
+	d := newEventDispatcher([]namedSink{{sinkKafka, sink}}, 10, false)
+	d.start(context.Background())
+	for i := 0; i < 4; i++ {
+		d.enqueue(context.Background(), VisitEvent{Page: "home"})
+	}
+
+	// Shutdown sends the partial batch and closes the producer
+	if err := d.Flush(context.Background()); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	if batches := writer.written(); len(batches) != 1 || len(batches[0]) != 4 || !writer.closed {
+		t.Errorf("Expected the 4 events sent at shutdown, got %v", batches)
+	}
+	var b strings.Builder
+	d.write(&b, "")
+	if !strings.Contains(b.String(), `kafka_messages_total{result="delivered"} 4`) {
+		t.Errorf("Expected the Kafka series with the sink's, got\n%s", b.String())
+	}
+}
@@ -0,0 +1,706 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// keyPrefixScanCount is how many old keys the completion report checks
+	// per round trip
+	keyPrefixScanCount = 500
+
+	// keyPrefixSampleSize caps the old-only keys listed in the report
+	keyPrefixSampleSize = 20
+)
+
+// copyMissingScript copies each old key to its new name unless the new one
+// exists, so a write under the new prefix starts from the old value.
+// KEYS are old and new name pairs.
+const copyMissingScript = `
+for i = 1, #KEYS, 2 do
+	redis.call('COPY', KEYS[i], KEYS[i + 1])
+end
+return 0
+`
+
+// keySpec locates a command's keys among its arguments as COMMAND INFO
+// does: the first and last key positions, the last counting back from the
+// end when negative, and the step between them
+type keySpec struct{ first, last, step int }
+
+// commandKeySpecs are the commands with several keys at fixed places
+var commandKeySpecs = map[string]keySpec{
+	"del": {1, -1, 1}, "unlink": {1, -1, 1}, "exists": {1, -1, 1}, "touch": {1, -1, 1}, "watch": {1, -1, 1},
+	"mget": {1, -1, 1}, "pfcount": {1, -1, 1}, "pfmerge": {1, -1, 1},
+	"sinter": {1, -1, 1}, "sunion": {1, -1, 1}, "sdiff": {1, -1, 1},
+	"sinterstore": {1, -1, 1}, "sunionstore": {1, -1, 1}, "sdiffstore": {1, -1, 1},
+	"mset": {1, -1, 2}, "msetnx": {1, -1, 2},
+	"rename": {1, 2, 1}, "renamenx": {1, 2, 1}, "copy": {1, 2, 1}, "smove": {1, 2, 1},
+	"lmove": {1, 2, 1}, "blmove": {1, 2, 1}, "rpoplpush": {1, 2, 1},
+	"blpop": {1, -2, 1}, "brpop": {1, -2, 1}, "bzpopmin": {1, -2, 1}, "bzpopmax": {1, -2, 1},
+	"json.mget": {1, -2, 1},
+}
+
+// singleKeyCommands take one key, as their first argument
+var singleKeyCommands = map[string]bool{
+	"get": true, "set": true, "setnx": true, "setex": true, "psetex": true, "getset": true, "getdel": true, "getex": true,
+	"incr": true, "incrby": true, "incrbyfloat": true, "decr": true, "decrby": true, "append": true, "strlen": true,
+	"getrange": true, "setrange": true,
+	"expire": true, "expireat": true, "pexpire": true, "pexpireat": true, "persist": true, "ttl": true, "pttl": true,
+	"expiretime": true, "type": true, "dump": true, "restore": true,
+	"hget": true, "hset": true, "hsetnx": true, "hmset": true, "hmget": true, "hdel": true, "hexists": true, "hgetall": true,
+	"hincrby": true, "hincrbyfloat": true, "hkeys": true, "hvals": true, "hlen": true, "hscan": true, "hstrlen": true, "hrandfield": true,
+	"sadd": true, "srem": true, "smembers": true, "sismember": true, "smismember": true, "scard": true, "sscan": true,
+	"spop": true, "srandmember": true,
+	"zadd": true, "zrem": true, "zscore": true, "zmscore": true, "zincrby": true, "zcard": true, "zcount": true, "zlexcount": true,
+	"zrange": true, "zrangebyscore": true, "zrevrangebyscore": true, "zrangebylex": true, "zrevrangebylex": true, "zrevrange": true,
+	"zrank": true, "zrevrank": true, "zremrangebyscore": true, "zremrangebyrank": true, "zremrangebylex": true, "zscan": true,
+	"zrandmember": true, "zpopmin": true, "zpopmax": true,
+	"lpush": true, "rpush": true, "lpushx": true, "rpushx": true, "lpop": true, "rpop": true, "lrange": true, "lrem": true,
+	"ltrim": true, "llen": true, "lindex": true, "lset": true, "linsert": true, "lpos": true,
+	"xadd": true, "xrange": true, "xrevrange": true, "xlen": true, "xack": true, "xautoclaim": true, "xclaim": true,
+	"xpending": true, "xtrim": true, "xdel": true, "xsetid": true,
+	"pfadd": true,
+}
+
+// moduleKeyPrefixes are the module command families whose first argument is
+// a key, or for RediSearch an index name, which is namespaced the same way
+var moduleKeyPrefixes = []string{"bf.", "cms.", "topk.", "json.", "ft."}
+
+// unshadowedCommands only write under the new prefix while migrating:
+// consumer groups and search indexes belong to one prefix, and replaying
+// acks or claims by ID against the old stream would not match its entries
+var unshadowedCommands = map[string]bool{
+	"xreadgroup": true, "xack": true, "xautoclaim": true, "xclaim": true, "xgroup": true,
+}
+
+// commandKeys returns the positions of a command's keys in args
+func commandKeys(name string, args []interface{}) []int {
+	switch name {
+	case "eval", "evalsha", "eval_ro", "evalsha_ro", "fcall", "fcall_ro":
+		return countedKeys(args, 2)
+	case "zunionstore", "zinterstore", "zdiffstore":
+		if len(args) < 2 {
+			return nil
+		}
+		return append([]int{1}, countedKeys(args, 2)...)
+	case "zunion", "zinter", "zdiff", "sintercard", "zintercard":
+		return countedKeys(args, 1)
+	case "xread", "xreadgroup":
+		for i := range args {
+			if strings.EqualFold(argString(args[i]), "streams") {
+				return keyRange(i+1, i+(len(args)-i-1)/2, 1)
+			}
+		}
+		return nil
+	case "xinfo", "xgroup":
+		// XINFO GROUPS key, XGROUP CREATE key group ...
+		if len(args) > 2 {
+			return []int{2}
+		}
+		return nil
+	case "ft.create":
+		// The index and the hash prefixes it covers
+		keys := []int{1}
+		for i := 2; i+1 < len(args); i++ {
+			switch strings.ToLower(argString(args[i])) {
+			case "prefix":
+				n, _ := strconv.Atoi(argString(args[i+1]))
+				return append(keys, keyRange(i+2, min(i+1+n, len(args)-1), 1)...)
+			case "schema":
+				return keys
+			}
+		}
+		return keys
+	}
+	if spec, ok := commandKeySpecs[name]; ok {
+		last := spec.last
+		if last < 0 {
+			last += len(args)
+		}
+		return keyRange(spec.first, min(last, len(args)-1), spec.step)
+	}
+	if len(args) < 2 {
+		return nil
+	}
+	if singleKeyCommands[name] {
+		return []int{1}
+	}
+	for _, prefix := range moduleKeyPrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return []int{1}
+		}
+	}
+	return nil
+}
+
+// countedKeys returns the positions of the keys counted at args[at] and
+// following it, as EVAL and ZUNIONSTORE take them
+func countedKeys(args []interface{}, at int) []int {
+	if at >= len(args) {
+		return nil
+	}
+	n, _ := strconv.Atoi(argString(args[at]))
+	return keyRange(at+1, min(at+n, len(args)-1), 1)
+}
+
+// keyRange returns first to last by step
+func keyRange(first, last, step int) []int {
+	var keys []int
+	for i := first; i <= last; i += step {
+		keys = append(keys, i)
+	}
+	return keys
+}
+
+// scanPattern returns the position of a SCAN's MATCH pattern, -1 if none
+func scanPattern(args []interface{}) int {
+	for i := 2; i+1 < len(args); i++ {
+		if strings.EqualFold(argString(args[i]), "match") {
+			return i + 1
+		}
+	}
+	return -1
+}
+
+// argString returns a command argument as a string
+func argString(arg interface{}) string {
+	switch v := arg.(type) {
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	}
+	return fmt.Sprint(arg)
+}
+
+// prefixArgs prefixes the arguments at positions in place, returning a func
+// putting the originals back, so a retried command is not prefixed twice
+func prefixArgs(args []interface{}, positions []int, prefix string) func() {
+	if prefix == "" || len(positions) == 0 {
+		return func() {}
+	}
+	saved := make([]interface{}, len(positions))
+	for i, pos := range positions {
+		saved[i], args[pos] = args[pos], prefix+argString(args[pos])
+	}
+	return func() {
+		for i, pos := range positions {
+			args[pos] = saved[i]
+		}
+	}
+}
+
+// validKeyPrefix rejects prefixes SCAN would read as a pattern
+func validKeyPrefix(prefix string) error {
+	if strings.ContainsAny(prefix, "*?[]\\") {
+		return fmt.Errorf("must not contain glob characters, got %q", prefix)
+	}
+	return nil
+}
+
+// KeyPrefix namespaces every key the service uses under prefix. While it
+// migrates from old, writes are shadowed to the old prefix, after copying
+// keys not yet under the new one, and reads that find nothing under the new
+// prefix fall back to the old one.
+type KeyPrefix struct {
+	prefix    string
+	old       string
+	migrating bool
+
+	fallbacks    atomic.Int64
+	shadowed     atomic.Int64
+	shadowErrors atomic.Int64
+}
+
+// NewKeyPrefix creates the key namespace, migrating from old when set
+func NewKeyPrefix(prefix, old string, migrating bool) *KeyPrefix {
+	return &KeyPrefix{prefix: prefix, old: old, migrating: migrating}
+}
+
+// scanPrefix is the prefix SCAN runs under: the old one while migrating,
+// since every key is still written there and keys not yet copied are only
+// found there
+func (p *KeyPrefix) scanPrefix() string {
+	if p.migrating {
+		return p.old
+	}
+	return p.prefix
+}
+
+// strip returns the service's name of a key under ns, false for keys
+// outside it: other prefixes, and the new prefix's keys when ns (the empty
+// old prefix) covers them
+func (p *KeyPrefix) strip(key, ns string) (string, bool) {
+	name, ok := strings.CutPrefix(key, ns)
+	if !ok || (ns != p.prefix && p.prefix != "" && strings.HasPrefix(key, p.prefix)) {
+		return "", false
+	}
+	return name, true
+}
+
+// shadows reports whether a command is a write to keys that is repeated
+// under the old prefix; PUBLISH and other writes without keys are not
+func (p *KeyPrefix) shadows(cmd redis.Cmder) bool {
+	name := cmd.Name()
+	return p.migrating && !readOnlyAllowed(name) && !unshadowedCommands[name] && !strings.HasPrefix(name, "ft.") &&
+		len(commandKeys(name, cmd.Args())) > 0
+}
+
+// fallsBack reports whether a read that found nothing is retried under the
+// old prefix. Blocking reads and search indexes stay on the new prefix.
+func (p *KeyPrefix) fallsBack(cmd redis.Cmder) bool {
+	name := cmd.Name()
+	return p.migrating && readOnlyAllowed(name) && !untimedCommands[name] && name != "watch" && name != "scan" &&
+		!strings.HasPrefix(name, "ft.") && emptyReply(cmd)
+}
+
+// emptyReply reports whether a read came back as if its keys were missing
+func emptyReply(cmd redis.Cmder) bool {
+	if err := cmd.Err(); err != nil {
+		return errors.Is(err, redis.Nil)
+	}
+	switch c := cmd.(type) {
+	case *redis.IntCmd:
+		return c.Val() == 0
+	case *redis.BoolCmd:
+		return !c.Val()
+	case *redis.StringSliceCmd:
+		return len(c.Val()) == 0
+	case *redis.ZSliceCmd:
+		return len(c.Val()) == 0
+	case *redis.MapStringStringCmd:
+		return len(c.Val()) == 0
+	case *redis.XMessageSliceCmd:
+		return len(c.Val()) == 0
+	case *redis.SliceCmd:
+		// MGET and HMGET: any key or field missing
+		for _, v := range c.Val() {
+			if v == nil {
+				return true
+			}
+		}
+	case *redis.Cmd:
+		if values, ok := c.Val().([]interface{}); ok {
+			return len(values) == 0
+		}
+		return c.Val() == nil
+	}
+	return false
+}
+
+// stripReply removes ns from the key names in a reply: SCAN's keys, the
+// streams XREAD answers for and FT.SEARCH's document IDs
+func (p *KeyPrefix) stripReply(cmd redis.Cmder, ns string) {
+	switch c := cmd.(type) {
+	case *redis.ScanCmd:
+		if c.Name() != "scan" {
+			return
+		}
+		keys, cursor := c.Val()
+		names := keys[:0]
+		for _, key := range keys {
+			if name, ok := p.strip(key, ns); ok {
+				names = append(names, name)
+			}
+		}
+		c.SetVal(names, cursor)
+	case *redis.XStreamSliceCmd:
+		streams := c.Val()
+		for i := range streams {
+			streams[i].Stream = strings.TrimPrefix(streams[i].Stream, ns)
+		}
+	case *redis.Cmd:
+		if c.Name() == "ft.search" {
+			stripSearchIDs(c.Val(), ns)
+		}
+	}
+}
+
+// stripSearchIDs removes prefix from the document IDs of an FT.SEARCH
+// reply in place, in either of the shapes parseSearchIDs reads
+func stripSearchIDs(reply interface{}, prefix string) {
+	switch r := reply.(type) {
+	case []interface{}:
+		for i := 1; i < len(r); i++ {
+			if id, ok := r[i].(string); ok {
+				r[i] = strings.TrimPrefix(id, prefix)
+			}
+		}
+	case map[interface{}]interface{}:
+		results, _ := r["results"].([]interface{})
+		for _, v := range results {
+			if doc, ok := v.(map[interface{}]interface{}); ok {
+				if id, ok := doc["id"].(string); ok {
+					doc["id"] = strings.TrimPrefix(id, prefix)
+				}
+			}
+		}
+	}
+}
+
+// prepare prefixes a command's keys, or a SCAN's pattern, for the namespace
+// it runs in, returning a func restoring its arguments
+func (p *KeyPrefix) prepare(cmd redis.Cmder) func() {
+	args := cmd.Args()
+	if cmd.Name() == "scan" {
+		if at := scanPattern(args); at > 0 {
+			return prefixArgs(args, []int{at}, p.scanPrefix())
+		}
+		// Without a pattern the reply is filtered instead
+		return func() {}
+	}
+	return prefixArgs(args, commandKeys(cmd.Name(), args), p.prefix)
+}
+
+// finish strips the namespace from the reply of a prepared command
+func (p *KeyPrefix) finish(cmd redis.Cmder) {
+	if cmd.Name() == "scan" {
+		p.stripReply(cmd, p.scanPrefix())
+		return
+	}
+	p.stripReply(cmd, p.prefix)
+}
+
+// copyPairs returns the old and new names of a command's keys
+func (p *KeyPrefix) copyPairs(cmd redis.Cmder) []interface{} {
+	args := cmd.Args()
+	var pairs []interface{}
+	for _, pos := range commandKeys(cmd.Name(), args) {
+		name := argString(args[pos])
+		pairs = append(pairs, p.old+name, p.prefix+name)
+	}
+	return pairs
+}
+
+// copyCmd copies the keys in pairs that are not yet under the new prefix
+func copyCmd(ctx context.Context, pairs []interface{}) redis.Cmder {
+	args := append([]interface{}{"eval", copyMissingScript, len(pairs)}, pairs...)
+	return redis.NewCmd(ctx, args...)
+}
+
+// shadowCmd is cmd with its keys under the old prefix
+func (p *KeyPrefix) shadowCmd(ctx context.Context, cmd redis.Cmder) redis.Cmder {
+	args := append([]interface{}(nil), cmd.Args()...)
+	prefixArgs(args, commandKeys(cmd.Name(), args), p.old)
+	p.shadowed.Add(1)
+	return redis.NewCmd(ctx, args...)
+}
+
+// checkShadow counts and logs a failed shadow write. The old prefix is on
+// its way out, so the write under the new prefix still stands.
+func (p *KeyPrefix) checkShadow(cmd redis.Cmder) {
+	if err := cmd.Err(); err != nil && !errors.Is(err, redis.Nil) {
+		p.shadowErrors.Add(1)
+		log.Printf("Error writing %s under the old key prefix: %v", cmd.Name(), err)
+	}
+}
+
+// readOld reruns the reads among cmds that found nothing under the new
+// prefix against the old one, sent with run. MGET-style replies keep the
+// values found under the new prefix.
+func (p *KeyPrefix) readOld(cmds []redis.Cmder, run func([]redis.Cmder) error) error {
+	var reads []redis.Cmder
+	var restores []func()
+	found := make(map[redis.Cmder][]interface{})
+	for _, cmd := range cmds {
+		if !p.fallsBack(cmd) {
+			continue
+		}
+		args := cmd.Args()
+		keys := commandKeys(cmd.Name(), args)
+		if len(keys) == 0 {
+			continue
+		}
+		if slice, ok := cmd.(*redis.SliceCmd); ok {
+			found[cmd] = append([]interface{}(nil), slice.Val()...)
+		}
+		cmd.SetErr(nil)
+		reads = append(reads, cmd)
+		restores = append(restores, prefixArgs(args, keys, p.old))
+	}
+	if len(reads) == 0 {
+		return nil
+	}
+	p.fallbacks.Add(int64(len(reads)))
+	err := run(reads)
+	for _, restore := range restores {
+		restore()
+	}
+	for _, cmd := range reads {
+		p.stripReply(cmd, p.old)
+		if values, ok := found[cmd]; ok {
+			slice := cmd.(*redis.SliceCmd)
+			merged := slice.Val()
+			for i := range merged {
+				if i < len(values) && values[i] != nil {
+					merged[i] = values[i]
+				}
+			}
+			slice.SetVal(merged)
+		}
+	}
+	return err
+}
+
+// write writes the key_prefix series
+func (p *KeyPrefix) write(b *strings.Builder, env string) {
+	labels := ""
+	if env != "" {
+		labels = "{env=" + strconv.Quote(env) + "}"
+	}
+	b.WriteString("# HELP key_prefix_fallback_reads_total Reads that found nothing under KEY_PREFIX and were retried under KEY_PREFIX_OLD.\n")
+	b.WriteString("# TYPE key_prefix_fallback_reads_total counter\n")
+	fmt.Fprintf(b, "key_prefix_fallback_reads_total%s %d\n", labels, p.fallbacks.Load())
+	b.WriteString("# HELP key_prefix_shadow_writes_total Writes repeated under KEY_PREFIX_OLD.\n")
+	b.WriteString("# TYPE key_prefix_shadow_writes_total counter\n")
+	fmt.Fprintf(b, "key_prefix_shadow_writes_total%s %d\n", labels, p.shadowed.Load())
+	b.WriteString("# HELP key_prefix_shadow_errors_total Writes that failed under KEY_PREFIX_OLD.\n")
+	b.WriteString("# TYPE key_prefix_shadow_errors_total counter\n")
+	fmt.Fprintf(b, "key_prefix_shadow_errors_total%s %d\n", labels, p.shadowErrors.Load())
+}
+
+// prefixHook applies the key prefix to every command and pipeline. It sits
+// inside the retry and timeout hooks, so a retry rewrites the command
+// afresh and the extra round trips of a migration share one deadline.
+type prefixHook struct {
+	prefix *KeyPrefix
+}
+
+func (h prefixHook) DialHook(next redis.DialHook) redis.DialHook { return next }
+
+func (h prefixHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		p := h.prefix
+		shadow := p.shadows(cmd)
+		if shadow {
+			if err := next(ctx, copyCmd(ctx, p.copyPairs(cmd))); err != nil {
+				cmd.SetErr(err)
+				return err
+			}
+		}
+
+		restore := p.prepare(cmd)
+		err := next(ctx, cmd)
+		restore()
+		p.finish(cmd)
+
+		switch {
+		case shadow && (err == nil || errors.Is(err, redis.Nil)):
+			written := p.shadowCmd(ctx, cmd)
+			next(ctx, written)
+			p.checkShadow(written)
+		case p.fallsBack(cmd):
+			p.readOld([]redis.Cmder{cmd}, func(reads []redis.Cmder) error { return next(ctx, reads[0]) })
+			err = cmd.Err()
+		}
+		return err
+	}
+}
+
+// ProcessPipelineHook prefixes a pipeline's commands. While migrating, the
+// copies run first and the shadow writes last in the same round trip,
+// inside the transaction for MULTI/EXEC pipelines; reads that found nothing
+// are then rerun against the old prefix in one more.
+func (h prefixHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		p := h.prefix
+		tx := len(cmds) >= 2 && cmds[0].Name() == "multi" && cmds[len(cmds)-1].Name() == "exec"
+		body := cmds
+		if tx {
+			body = cmds[1 : len(cmds)-1]
+		}
+
+		var pairs []interface{}
+		var shadows []redis.Cmder
+		restores := make([]func(), len(body))
+		for i, cmd := range body {
+			if p.shadows(cmd) {
+				pairs = append(pairs, p.copyPairs(cmd)...)
+				shadows = append(shadows, p.shadowCmd(ctx, cmd))
+			}
+			restores[i] = p.prepare(cmd)
+		}
+
+		sent := body
+		var copied redis.Cmder
+		if len(shadows) > 0 {
+			copied = copyCmd(ctx, pairs)
+			sent = make([]redis.Cmder, 0, len(body)+len(shadows)+1)
+			sent = append(append(append(sent, copied), body...), shadows...)
+		}
+		run := func(sent []redis.Cmder) error {
+			if tx {
+				sent = append(append([]redis.Cmder{cmds[0]}, sent...), cmds[len(cmds)-1])
+			}
+			return next(ctx, sent)
+		}
+		err := run(sent)
+		for i, cmd := range body {
+			restores[i]()
+			p.finish(cmd)
+		}
+		if copied != nil && copied.Err() != nil {
+			p.shadowErrors.Add(1)
+			log.Printf("Error copying keys to the new key prefix: %v", copied.Err())
+		}
+		for _, written := range shadows {
+			p.checkShadow(written)
+		}
+		if err != nil && !errors.Is(err, redis.Nil) && firstErr(body) == nil {
+			// The copies or the transaction failed as a whole
+			return err
+		}
+
+		if p.migrating {
+			if tx {
+				run = func(reads []redis.Cmder) error {
+					wrapped := append(append([]redis.Cmder{redis.NewStatusCmd(ctx, "multi")}, reads...), redis.NewSliceCmd(ctx, "exec"))
+					return next(ctx, wrapped)
+				}
+			}
+			p.readOld(body, run)
+		}
+		if tx {
+			return firstErr(cmds)
+		}
+		return firstErr(body)
+	}
+}
+
+// firstErr returns the first error among cmds, as a pipeline reports it
+func firstErr(cmds []redis.Cmder) error {
+	for _, cmd := range cmds {
+		if err := cmd.Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// KeyPrefixReport is how far a key prefix migration has come: the keys
+// under the old prefix, and those of them not yet under the new one
+type KeyPrefixReport struct {
+	Prefix    string `json:"prefix"`
+	OldPrefix string `json:"old_prefix"`
+	Scanned   int64  `json:"scanned"`
+	OldOnly   int64  `json:"old_only"`
+	// Sample lists up to keyPrefixSampleSize of the old-only keys
+	Sample []string `json:"sample"`
+	Copy   bool     `json:"copy"`
+	Copied int64    `json:"copied"`
+	// Complete is set once every old key is also under the new prefix, when
+	// KEY_PREFIX_OLD can be unset
+	Complete bool `json:"complete"`
+}
+
+// KeyPrefixStatus scans the old prefix for keys that are not yet under the
+// new one, and with copyKeys copies them there server-side, keeping TTLs.
+// Keys already under the new prefix are left alone: the shadow writes keep
+// both in step. It reads the raw keyspace, past the prefix hook.
+func (r *RedisClient) KeyPrefixStatus(ctx context.Context, copyKeys bool) (KeyPrefixReport, error) {
+	p := r.prefix
+	report := KeyPrefixReport{Prefix: p.prefix, OldPrefix: p.old, Sample: []string{}, Copy: copyKeys}
+	if copyKeys && r.readOnly {
+		return report, readOnlyError("copy")
+	}
+	raw := r.withDB(r.client.Options().DB)
+	defer raw.Close()
+
+	var cursor uint64
+	for {
+		keys, next, err := raw.Scan(ctx, cursor, p.old+"*", keyPrefixScanCount).Result()
+		if err != nil {
+			return report, err
+		}
+		var names []string
+		for _, key := range keys {
+			if name, ok := p.strip(key, p.old); ok && !strings.HasPrefix(name, migrateCheckpointPrefix) {
+				names = append(names, name)
+			}
+		}
+		report.Scanned += int64(len(names))
+
+		if len(names) > 0 {
+			pipe := raw.Pipeline()
+			exists := make([]*redis.IntCmd, len(names))
+			for i, name := range names {
+				exists[i] = pipe.Exists(ctx, p.prefix+name)
+			}
+			if _, err := pipe.Exec(ctx); err != nil {
+				return report, err
+			}
+			copies := raw.Pipeline()
+			var copied []*redis.IntCmd
+			for i, name := range names {
+				if exists[i].Val() == 1 {
+					continue
+				}
+				report.OldOnly++
+				if len(report.Sample) < keyPrefixSampleSize {
+					report.Sample = append(report.Sample, name)
+				}
+				if copyKeys {
+					copied = append(copied, copies.Copy(ctx, p.old+name, p.prefix+name, r.client.Options().DB, false))
+				}
+			}
+			if len(copied) > 0 {
+				if _, err := copies.Exec(ctx); err != nil {
+					return report, err
+				}
+				for _, cmd := range copied {
+					// 0: written under the new prefix or expired since
+					report.Copied += cmd.Val()
+				}
+			}
+		}
+		if cursor = next; cursor == 0 {
+			break
+		}
+	}
+	report.Complete = report.OldOnly == report.Copied
+	return report, nil
+}
+
+// handleKeyPrefixStatus reports the keys still only under KEY_PREFIX_OLD,
+// copying them to KEY_PREFIX with copy=true
+func (s *Server) handleKeyPrefixStatus(c *gin.Context) {
+	copyKeys, _ := strconv.ParseBool(c.Query("copy"))
+	ctx := c.Request.Context()
+	if copyKeys {
+		release, ok, err := s.redis.AcquireMaintenanceLock(ctx, time.Hour)
+		if err != nil {
+			log.Printf("Error taking the maintenance lock: %v", err)
+			respondStoreError(c, err, "Failed to check the key prefix migration")
+			return
+		}
+		if !ok {
+			respondError(c, http.StatusConflict, "conflict", "Maintenance is already running on another replica")
+			return
+		}
+		defer release()
+	}
+
+	report, err := s.redis.KeyPrefixStatus(ctx, copyKeys)
+	if err != nil {
+		log.Printf("Error checking the key prefix migration: %v", err)
+		respondStoreError(c, err, "Failed to check the key prefix migration")
+		return
+	}
+	if report.Copied > 0 {
+		log.Printf("Copied %d keys from %q to %q", report.Copied, report.OldPrefix, report.Prefix)
+		s.invalidateAggregates(ctx)
+	}
+	c.JSON(http.StatusOK, report)
+}
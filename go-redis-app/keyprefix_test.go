@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+// newPrefixTestClient returns a client namespaced under prefix, migrating
+// from old when migrating is set
+func newPrefixTestClient(t *testing.T, mr *miniredis.Miniredis, prefix, old string, migrating bool) *RedisClient {
+	t.Helper()
+	r := newTestRedisClient(t, mr)
+	r.prefix = NewKeyPrefix(prefix, old, migrating)
+	r.client.AddHook(prefixHook{prefix: r.prefix})
+	return r
+}
+
+func TestCommandKeys(t *testing.T) {
+	for _, tt := range []struct {
+		args []interface{}
+		want []int
+	}{
+		{[]interface{}{"get", "a"}, []int{1}},
+		{[]interface{}{"ping"}, nil},
+		{[]interface{}{"publish", "channel", "msg"}, nil},
+		{[]interface{}{"mset", "a", "1", "b", "2"}, []int{1, 3}},
+		{[]interface{}{"del", "a", "b", "c"}, []int{1, 2, 3}},
+		{[]interface{}{"blpop", "a", "b", 5}, []int{1, 2}},
+		{[]interface{}{"evalsha", "sha", 2, "a", "b", "arg"}, []int{3, 4}},
+		{[]interface{}{"zunionstore", "dst", 2, "a", "b", "weights", 1, 2}, []int{1, 3, 4}},
+		{[]interface{}{"xread", "count", 10, "streams", "a", "b", "0", "0"}, []int{4, 5}},
+		{[]interface{}{"xgroup", "create", "stream", "group", "$"}, []int{2}},
+		{[]interface{}{"ft.create", "idx", "on", "hash", "prefix", 1, "doc:", "schema", "f", "text"}, []int{1, 6}},
+		{[]interface{}{"bf.add", "filter", "x"}, []int{1}},
+	} {
+		if got := commandKeys(argString(tt.args[0]), tt.args); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("commandKeys(%v) = %v, want %v", tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestKeyPrefixNamespacesKeys(t *testing.T) {
+	mr, _ := newTestRedis(t)
+	redisClient := newPrefixTestClient(t, mr, "blue:", "", false)
+	ctx := context.Background()
+	router := newTestServer(t, testConfig(), redisClient).Router()
+	for i := 0; i < 2; i++ {
+		doRequest(router, "GET", "/visit/home", "", nil)
+	}
+	mr.Set("visits:stray", "7")
+
+	for _, key := range mr.Keys() {
+		if key != "visits:stray" && !strings.HasPrefix(key, "blue:") {
+			t.Errorf("Expected every key under blue:, got %s", key)
+		}
+	}
+	if got, _ := mr.Get("blue:visits:home"); got != "2" {
+		t.Errorf("Expected the counter under the prefix, got %q", got)
+	}
+
+	// Scans only see the service's own keys, by their unprefixed names
+	keys, _, err := redisClient.client.Scan(ctx, 0, "visits:*", 100).Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := strings.Join(keys, ",")
+	if !strings.Contains(found, "visits:home") || strings.Contains(found, "blue:") || strings.Contains(found, "visits:stray") {
+		t.Errorf("Expected the scan stripped and outside keys skipped, got %v", keys)
+	}
+}
+
+func TestKeyPrefixMigration(t *testing.T) {
+	// The service ran unprefixed, and replicas now move it under blue:
+	mr, oldClient := newTestRedis(t)
+	oldRouter := newTestServer(t, testConfig(), oldClient).Router()
+	for page, n := range map[string]int{"home": 3, "about": 2, "docs": 1} {
+		for i := 0; i < n; i++ {
+			doRequest(oldRouter, "GET", "/visit/"+page, "", nil)
+		}
+	}
+	ctx := context.Background()
+
+	redisClient := newPrefixTestClient(t, mr, "blue:", "", true)
+	cfg := testConfig()
+	cfg.KeyPrefix, cfg.KeyPrefixMigrating = "blue:", true
+	router := newTestServer(t, cfg, redisClient).Router()
+
+	// Reads fall back to the old keys
+	w := doRequest(router, "GET", "/visits/about", "", nil)
+	var resp VisitResponse
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if w.Code != http.StatusOK || resp.Visits != 2 {
+		t.Fatalf("Expected the old count read, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// A write continues from the old value and lands under both prefixes
+	w = doRequest(router, "GET", "/visit/home", "", nil)
+	resp = VisitResponse{}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if resp.Visits != 4 {
+		t.Errorf("Expected the old count carried over, got %s", w.Body.String())
+	}
+	for _, key := range []string{"blue:visits:home", "visits:home"} {
+		if got, _ := mr.Get(key); got != "4" {
+			t.Errorf("Expected %s at 4, got %q", key, got)
+		}
+	}
+	// Replicas still on the old prefix see the write
+	if got, _ := oldClient.GetVisitCount(ctx, "home"); got != 4 {
+		t.Errorf("Expected the shadow write seen unprefixed, got %d", got)
+	}
+
+	// Multi-key reads merge what each prefix has
+	values, err := redisClient.client.MGet(ctx, "visits:home", "visits:docs", "visits:nowhere").Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(values, []interface{}{"4", "1", nil}) {
+		t.Errorf("Expected the counts merged across prefixes, got %v", values)
+	}
+
+	report := func(query string) KeyPrefixReport {
+		t.Helper()
+		w := doRequest(router, "GET", "/admin/key-prefix"+query, "", nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Key prefix status: %d %s", w.Code, w.Body.String())
+		}
+		var report KeyPrefixReport
+		json.Unmarshal(w.Body.Bytes(), &report)
+		return report
+	}
+	got := report("")
+	if got.Prefix != "blue:" || got.OldPrefix != "" || got.Complete || got.OldOnly == 0 || got.OldOnly >= got.Scanned {
+		t.Fatalf("Expected old-only keys reported, got %+v", got)
+	}
+	sample := strings.Join(got.Sample, ",")
+	if !strings.Contains(sample, "visits:about") || strings.Contains(sample, "visits:home") || strings.Contains(sample, "blue:") {
+		t.Errorf("Expected about sampled and home, already copied, not, got %v", got.Sample)
+	}
+	if mr.Exists("blue:visits:about") {
+		t.Error("Expected the report alone to copy nothing")
+	}
+
+	copied := report("?copy=true")
+	if copied.Copied != got.OldOnly || !copied.Complete {
+		t.Errorf("Expected every old-only key copied, got %+v", copied)
+	}
+	if got, _ := mr.Get("blue:visits:about"); got != "2" {
+		t.Errorf("Expected about copied, got %q", got)
+	}
+	if after := report(""); after.OldOnly != 0 || !after.Complete {
+		t.Errorf("Expected the migration complete, got %+v", after)
+	}
+}
+
+func TestKeyPrefixMigrationTransactions(t *testing.T) {
+	mr, _ := newTestRedis(t)
+	mr.Set("old:visits:home", "5")
+	redisClient := newPrefixTestClient(t, mr, "new:", "old:", true)
+	ctx := context.Background()
+
+	// In MULTI/EXEC the copy, the write and its shadow commit together
+	pipe := redisClient.client.TxPipeline()
+	incr := pipe.Incr(ctx, "visits:home")
+	pipe.Get(ctx, "visits:docs")
+	if _, err := pipe.Exec(ctx); ignoreMissing(err) != nil {
+		t.Fatal(err)
+	}
+	if incr.Val() != 6 {
+		t.Errorf("Expected the copied count incremented, got %d", incr.Val())
+	}
+	for _, key := range []string{"new:visits:home", "old:visits:home"} {
+		if got, _ := mr.Get(key); got != "6" {
+			t.Errorf("Expected %s at 6, got %q", key, got)
+		}
+	}
+
+	// A read in a transaction falls back in one of its own
+	mr.Set("old:visits:docs", "2")
+	pipe = redisClient.client.TxPipeline()
+	read := pipe.Get(ctx, "visits:docs")
+	if _, err := pipe.Exec(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if read.Val() != "2" {
+		t.Errorf("Expected the old value read, got %q %v", read.Val(), read.Err())
+	}
+}
+
+func TestKeyPrefixRetriedOnce(t *testing.T) {
+	mr, _ := newTestRedis(t)
+	redisClient, failing := newRetryTestClient(t, mr.Addr(), NewRetryPolicy(2, 0, 0))
+	redisClient.prefix = NewKeyPrefix("blue:", "", false)
+	redisClient.client.AddHook(prefixHook{prefix: redisClient.prefix})
+
+	failing.fail(errRefused)
+	if _, err := redisClient.IncrementVisitCount(context.Background(), "home"); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := mr.Get("blue:visits:home"); got != "1" || mr.Exists("blue:blue:visits:home") {
+		t.Errorf("Expected the retry prefixed once, got keys %v", mr.Keys())
+	}
+}
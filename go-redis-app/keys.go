@@ -0,0 +1,22 @@
+package main
+
+import "strings"
+
+// key joins key segments with ':'. It sizes the result up front so building a
+// key costs one allocation, where fmt.Sprintf also boxes every argument; keys
+// are built several times per visit.
+func key(parts ...string) string {
+	n := len(parts) - 1
+	for _, part := range parts {
+		n += len(part)
+	}
+	var b strings.Builder
+	b.Grow(n)
+	for i, part := range parts {
+		if i > 0 {
+			b.WriteByte(':')
+		}
+		b.WriteString(part)
+	}
+	return b.String()
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestKey(t *testing.T) {
+	day := time.Date(2024, 5, 1, 23, 0, 0, 0, time.UTC)
+	tests := []struct {
+		got, want string
+	}{
+		{key("visits", "home"), fmt.Sprintf("visits:%s", "home")},
+		{key("visits", "a:b"), "visits:a:b"},
+		{key("visits", ""), "visits:"},
+		{dailyKey("home", day), "visits:home:daily:2024-05-01"},
+		{hourlyKey("home", day), "visits:home:hourly:2024-05-01"},
+		{monthlyKey("home", day), "visits:home:monthly:2024-05"},
+		{sessionsDailyKey("home", day), "visits:sessions:home:daily:2024-05-01"},
+		{variantKey("home", "b"), "visits:home:variant:b"},
+		{metaKey("home"), "visits:meta:home"},
+	}
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("Expected key %q, got %q", tt.want, tt.got)
+		}
+	}
+}
+
+// BenchmarkKey compares key with the fmt.Sprintf it replaced; run with
+// -benchmem to see the allocations per key
+func BenchmarkKey(b *testing.B) {
+	page := "docs/getting-started"
+	b.Run("sprintf", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			_ = fmt.Sprintf("visits:%s:variant:%s", page, "b")
+		}
+	})
+	b.Run("key", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			_ = key("visits", page, "variant", "b")
+		}
+	})
+}
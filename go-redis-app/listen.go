@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// listenFDsStart is the first file descriptor passed by systemd socket
+// activation (SD_LISTEN_FDS_START)
+const listenFDsStart = 3
+
+// listenSpec is a parsed LISTEN address
+type listenSpec struct {
+	Network string // "tcp" or "unix"
+	Address string
+	TLS     bool
+}
+
+// parseListenAddr parses tcp://host:port, tls://host:port, unix:///path or
+// a bare host:port, which is treated as TCP
+func parseListenAddr(addr string) (listenSpec, error) {
+	scheme, rest, ok := strings.Cut(addr, "://")
+	if !ok {
+		scheme, rest = "tcp", addr
+	}
+	if rest == "" {
+		return listenSpec{}, fmt.Errorf("missing address in %q", addr)
+	}
+	switch scheme {
+	case "tcp":
+		return listenSpec{Network: "tcp", Address: rest}, nil
+	case "tls":
+		return listenSpec{Network: "tcp", Address: rest, TLS: true}, nil
+	case "unix":
+		return listenSpec{Network: "unix", Address: rest}, nil
+	}
+	return listenSpec{}, fmt.Errorf("unsupported scheme %q in %q", scheme, addr)
+}
+
+// openListeners opens the configured LISTEN addresses plus any sockets
+// inherited from systemd. Without LISTEN the TCP port from PORT is used,
+// unless systemd already passed sockets.
+func openListeners(cfg Config) ([]net.Listener, error) {
+	listeners, err := inheritedListeners()
+	if err != nil {
+		return nil, err
+	}
+	addrs := cfg.Listen
+	if len(addrs) == 0 && len(listeners) == 0 {
+		addrs = []string{":" + cfg.Port}
+	}
+	for _, addr := range addrs {
+		l, err := openListener(addr, cfg)
+		if err != nil {
+			closeListeners(listeners)
+			return nil, fmt.Errorf("listen %s: %w", addr, err)
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
+
+// openListener opens a single LISTEN address
+func openListener(addr string, cfg Config) (net.Listener, error) {
+	spec, err := parseListenAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	if spec.Network == "unix" {
+		return listenUnix(spec.Address, cfg.ListenSocketMode)
+	}
+
+	var tlsConfig *tls.Config
+	if spec.TLS {
+		// Load the certificate before binding so a bad path fails cleanly
+		cert, err := tls.LoadX509KeyPair(cfg.TLSCertFile, cfg.TLSKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading TLS_CERT_FILE/TLS_KEY_FILE: %w", err)
+		}
+		tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	}
+	l, err := net.Listen("tcp", spec.Address)
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil {
+		l = tls.NewListener(l, tlsConfig)
+	}
+	return l, nil
+}
+
+// listenUnix listens on a unix socket with the given file mode. A stale
+// socket left by a crashed process is replaced, but one with a live server
+// behind it is not. The socket file is removed when the listener closes.
+func listenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s is in use by another server", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if mode != 0 {
+		if err := os.Chmod(path, mode); err != nil {
+			l.Close()
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+// inheritedListeners returns the sockets passed by systemd socket activation
+// through LISTEN_PID and LISTEN_FDS, clearing the variables so child
+// processes don't inherit them
+func inheritedListeners() ([]net.Listener, error) {
+	n, err := listenFDCount(os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_FDS"), os.Getpid())
+	if err != nil || n == 0 {
+		return nil, err
+	}
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	var listeners []net.Listener
+	for fd := listenFDsStart; fd < listenFDsStart+n; fd++ {
+		f := os.NewFile(uintptr(fd), "LISTEN_FD_"+strconv.Itoa(fd))
+		l, err := net.FileListener(f)
+		// FileListener dups the descriptor, so the original is always closed
+		f.Close()
+		if err != nil {
+			closeListeners(listeners)
+			return nil, fmt.Errorf("inherited fd %d: %w", fd, err)
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
+
+// listenFDCount returns how many sockets systemd passed to this process,
+// ignoring LISTEN_FDS meant for a different PID
+func listenFDCount(pidEnv, fdsEnv string, pid int) (int, error) {
+	if fdsEnv == "" {
+		return 0, nil
+	}
+	if listenPID, err := strconv.Atoi(pidEnv); err != nil || listenPID != pid {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(fdsEnv)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid LISTEN_FDS %q", fdsEnv)
+	}
+	return n, nil
+}
+
+// closeListeners closes every listener, ignoring errors
+func closeListeners(listeners []net.Listener) {
+	for _, l := range listeners {
+		l.Close()
+	}
+}
+
+// Endpoint pairs a handler with the listeners it is served on
+type Endpoint struct {
+	Handler   http.Handler
+	Listeners []net.Listener
+}
+
+// Serve serves every endpoint until ctx is done or one of the listeners
+// fails, then shuts all of them down together, giving in-flight requests up
+// to timeout to finish. Shutdown closes the listeners, removing any unix
+// socket files.
+func Serve(ctx context.Context, timeout time.Duration, endpoints ...Endpoint) error {
+	var servers []*http.Server
+	errs := make(chan error, 1)
+	for _, e := range endpoints {
+		srv := &http.Server{Handler: e.Handler, ReadHeaderTimeout: 10 * time.Second}
+		servers = append(servers, srv)
+		for _, l := range e.Listeners {
+			go func(l net.Listener) {
+				if err := srv.Serve(l); !errors.Is(err, http.ErrServerClosed) {
+					select {
+					case errs <- err:
+					default:
+					}
+				}
+			}(l)
+		}
+	}
+
+	var serveErr error
+	select {
+	case <-ctx.Done():
+	case serveErr = <-errs:
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	for _, srv := range servers {
+		if err := srv.Shutdown(shutdownCtx); err != nil && serveErr == nil {
+			serveErr = err
+		}
+	}
+	return serveErr
+}
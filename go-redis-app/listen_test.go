@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseListenAddr(t *testing.T) {
+	tests := []struct {
+		addr    string
+		want    listenSpec
+		wantErr bool
+	}{
+		{addr: ":8080", want: listenSpec{Network: "tcp", Address: ":8080"}},
+		{addr: "tcp://127.0.0.1:8080", want: listenSpec{Network: "tcp", Address: "127.0.0.1:8080"}},
+		{addr: "tls://:8443", want: listenSpec{Network: "tcp", Address: ":8443", TLS: true}},
+		{addr: "unix:///var/run/visits.sock", want: listenSpec{Network: "unix", Address: "/var/run/visits.sock"}},
+		{addr: "udp://:53", wantErr: true},
+		{addr: "unix://", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseListenAddr(tt.addr)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseListenAddr(%q) error = %v, wantErr %v", tt.addr, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseListenAddr(%q) = %+v, want %+v", tt.addr, got, tt.want)
+		}
+	}
+}
+
+func TestListenFDCount(t *testing.T) {
+	tests := []struct {
+		name    string
+		pid     string
+		fds     string
+		want    int
+		wantErr bool
+	}{
+		{name: "unset", want: 0},
+		{name: "this process", pid: "42", fds: "2", want: 2},
+		{name: "other process", pid: "41", fds: "2", want: 0},
+		{name: "invalid count", pid: "42", fds: "x", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := listenFDCount(tt.pid, tt.fds, 42)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: error = %v, wantErr %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s: got %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+// unixClient returns an HTTP client that dials the unix socket at path
+func unixClient(path string) *http.Client {
+	return &http.Client{
+		Timeout: 5 * time.Second,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", path)
+			},
+		},
+	}
+}
+
+func TestServeOverUnixSocket(t *testing.T) {
+	_, redisClient := newTestRedis(t)
+	server := newTestServer(t, testConfig(), redisClient)
+
+	path := filepath.Join(t.TempDir(), "visits.sock")
+	l, err := listenUnix(path, 0o600)
+	if err != nil {
+		t.Fatalf("listenUnix: %v", err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	if info.Mode()&os.ModeSocket == 0 || info.Mode().Perm() != 0o600 {
+		t.Errorf("Expected a socket with mode 0600, got %s", info.Mode())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- Serve(ctx, time.Second, Endpoint{Handler: server.Router(), Listeners: []net.Listener{l}})
+	}()
+
+	client := unixClient(path)
+	resp, err := client.Get("http://unix/visit/socket")
+	if err != nil {
+		t.Fatalf("GET over unix socket: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", resp.StatusCode)
+	}
+	if visits, _ := redisClient.GetVisitCount(context.Background(), "socket"); visits != 1 {
+		t.Errorf("Expected 1 visit, got %d", visits)
+	}
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Serve returned %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Serve did not shut down")
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("Expected socket file to be removed on shutdown, got %v", err)
+	}
+}
+
+func TestListenUnixReplacesStaleSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "visits.sock")
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	// Simulate a crash that left the socket file behind
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	l, err := listenUnix(path, 0o660)
+	if err != nil {
+		t.Fatalf("Expected stale socket to be replaced, got %v", err)
+	}
+	l.Close()
+}
+
+func TestListenUnixRefusesLiveSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "visits.sock")
+	live, err := listenUnix(path, 0o660)
+	if err != nil {
+		t.Fatalf("listenUnix: %v", err)
+	}
+	defer live.Close()
+
+	if l, err := listenUnix(path, 0o660); err == nil {
+		l.Close()
+		t.Fatal("Expected an error for a socket in use")
+	}
+
+	regular := filepath.Join(t.TempDir(), "file")
+	os.WriteFile(regular, nil, 0o600)
+	if _, err := listenUnix(regular, 0o660); err == nil {
+		t.Fatal("Expected an error for a path that is not a socket")
+	}
+}
+
+func TestOpenListenerTLSRequiresCertificate(t *testing.T) {
+	if _, err := openListener("tls://127.0.0.1:0", testConfig()); err == nil {
+		t.Fatal("Expected an error without TLS_CERT_FILE and TLS_KEY_FILE")
+	}
+}
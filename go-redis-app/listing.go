@@ -0,0 +1,304 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+// lastVisitKey is the sorted set of pages scored by their last visit time in
+// Unix milliseconds
+const lastVisitKey = "visits:pages:last_visit"
+
+// listScanBatch is how many index entries are read per round trip when a
+// listing has to be filtered in the service
+const listScanBatch = 500
+
+// Page listing sort keys
+const (
+	sortName      = "name"
+	sortVisits    = "visits"
+	sortLastVisit = "last_visit"
+)
+
+// PageQuery selects, orders and paginates the pages listing
+type PageQuery struct {
+	Sort      string
+	Desc      bool
+	MinVisits int64
+	Prefix    string
+	Offset    int64
+	Limit     int64
+
+	// ExactNames is set when every page in the name index has a leaderboard
+	// entry (no approximate pages), so name ranges can be counted by the index
+	ExactNames bool
+}
+
+// ListedPage is a page in the listing
+type ListedPage struct {
+	Page      string
+	Visits    int64
+	LastVisit time.Time
+}
+
+// ListPages returns the window of pages matching q, skipping excluded pages,
+// and the total number of matches. Each sort reads its own index: visits the
+// leaderboard by score, name the name index by range, and last_visit the
+// last-visit set. When the index alone can apply every filter the window is
+// read directly; otherwise the index is scanned in batches and filtered here.
+func (r *RedisClient) ListPages(ctx context.Context, q PageQuery, exclude map[string]bool) ([]ListedPage, int64, error) {
+	if len(exclude) == 0 && q.indexFiltered() {
+		batch, err := r.listBatch(ctx, q, q.Offset, q.Limit)
+		if err != nil {
+			return nil, 0, err
+		}
+		pages := batch[:0]
+		for _, p := range batch {
+			if q.matches(p) {
+				pages = append(pages, p)
+			}
+		}
+		total, err := r.countIndex(ctx, q)
+		return pages, total, err
+	}
+
+	var pages []ListedPage
+	var matched int64
+	for offset := int64(0); ; offset += listScanBatch {
+		batch, err := r.listBatch(ctx, q, offset, listScanBatch)
+		if err != nil {
+			return nil, 0, err
+		}
+		for _, p := range batch {
+			if exclude[p.Page] || !q.matches(p) {
+				continue
+			}
+			if matched >= q.Offset && int64(len(pages)) < q.Limit {
+				pages = append(pages, p)
+			}
+			matched++
+		}
+		if int64(len(batch)) < listScanBatch {
+			return pages, matched, nil
+		}
+	}
+}
+
+// indexFiltered reports whether the sort's index applies every filter itself
+func (q PageQuery) indexFiltered() bool {
+	switch q.Sort {
+	case sortVisits:
+		return q.Prefix == ""
+	case sortName:
+		return q.MinVisits == 0 && q.ExactNames
+	}
+	return q.Prefix == "" && q.MinVisits == 0
+}
+
+// matches applies the filters to a page read from an index; MinVisits is
+// never negative, so pages without a leaderboard entry never match
+func (q PageQuery) matches(p ListedPage) bool {
+	return p.Visits >= q.MinVisits && strings.HasPrefix(p.Page, q.Prefix)
+}
+
+// nameRange returns the lexicographic bounds of the prefix filter
+func (q PageQuery) nameRange() (string, string) {
+	if q.Prefix == "" {
+		return "-", "+"
+	}
+	return "[" + q.Prefix, "[" + q.Prefix + "\xff"
+}
+
+// listBatch reads count entries of the sort's index after skipping offset,
+// filling in the visit counts and last visits. Pages without a leaderboard
+// entry have Visits set to -1 so the filters drop them.
+func (r *RedisClient) listBatch(ctx context.Context, q PageQuery, offset, count int64) ([]ListedPage, error) {
+	var entries []redis.Z
+	var err error
+	switch q.Sort {
+	case sortVisits:
+		by := &redis.ZRangeBy{Min: strconv.FormatInt(q.MinVisits, 10), Max: "+inf", Offset: offset, Count: count}
+		if q.Desc {
+			entries, err = r.client.ZRevRangeByScoreWithScores(ctx, leaderboardKey, by).Result()
+		} else {
+			entries, err = r.client.ZRangeByScoreWithScores(ctx, leaderboardKey, by).Result()
+		}
+	case sortName:
+		lo, hi := q.nameRange()
+		by := &redis.ZRangeBy{Min: lo, Max: hi, Offset: offset, Count: count}
+		var names []string
+		if q.Desc {
+			names, err = r.client.ZRevRangeByLex(ctx, pageNamesKey, by).Result()
+		} else {
+			names, err = r.client.ZRangeByLex(ctx, pageNamesKey, by).Result()
+		}
+		for _, name := range names {
+			entries = append(entries, redis.Z{Member: name})
+		}
+	default:
+		if q.Desc {
+			entries, err = r.client.ZRevRangeWithScores(ctx, lastVisitKey, offset, offset+count-1).Result()
+		} else {
+			entries, err = r.client.ZRangeWithScores(ctx, lastVisitKey, offset, offset+count-1).Result()
+		}
+	}
+	if err != nil || len(entries) == 0 {
+		return nil, err
+	}
+
+	pages := make([]ListedPage, len(entries))
+	pipe := r.client.Pipeline()
+	visits := make([]*redis.FloatCmd, len(entries))
+	lastVisits := make([]*redis.FloatCmd, len(entries))
+	for i, z := range entries {
+		pages[i].Page, _ = z.Member.(string)
+		switch q.Sort {
+		case sortVisits:
+			pages[i].Visits = int64(z.Score)
+		case sortLastVisit:
+			pages[i].LastVisit = time.UnixMilli(int64(z.Score)).UTC()
+		}
+		if q.Sort != sortVisits {
+			visits[i] = pipe.ZScore(ctx, leaderboardKey, pages[i].Page)
+		}
+		if q.Sort != sortLastVisit {
+			lastVisits[i] = pipe.ZScore(ctx, lastVisitKey, pages[i].Page)
+		}
+	}
+	if _, err := pipe.Exec(ctx); ignoreMissing(err) != nil {
+		return nil, err
+	}
+	for i := range pages {
+		if visits[i] != nil {
+			pages[i].Visits = -1
+			if score, err := visits[i].Result(); err == nil {
+				pages[i].Visits = int64(score)
+			}
+		}
+		if lastVisits[i] != nil {
+			if ms, err := lastVisits[i].Result(); err == nil {
+				pages[i].LastVisit = time.UnixMilli(int64(ms)).UTC()
+			}
+		}
+	}
+	return pages, nil
+}
+
+// countIndex counts the entries of the sort's index within its filter
+func (r *RedisClient) countIndex(ctx context.Context, q PageQuery) (int64, error) {
+	switch q.Sort {
+	case sortVisits:
+		return r.client.ZCount(ctx, leaderboardKey, strconv.FormatInt(q.MinVisits, 10), "+inf").Result()
+	case sortName:
+		lo, hi := q.nameRange()
+		return r.client.ZLexCount(ctx, pageNamesKey, lo, hi).Result()
+	}
+	return r.client.ZCard(ctx, lastVisitKey).Result()
+}
+
+// parsePageQuery reads the listing parameters from the query string
+func parsePageQuery(c *gin.Context) (PageQuery, bool) {
+	limit, okLimit := queryInt(c, "limit", 100, 1, 1000)
+	offset, okOffset := queryInt(c, "offset", 0, 0, 1<<31)
+	minVisits, okMin := queryInt(c, "min_visits", 0, 0, 1<<62)
+	q := PageQuery{
+		Sort:      c.DefaultQuery("sort", sortName),
+		Prefix:    c.Query("prefix"),
+		Offset:    offset,
+		Limit:     limit,
+		MinVisits: minVisits,
+	}
+	switch q.Sort {
+	case sortName, sortVisits, sortLastVisit:
+	default:
+		return PageQuery{}, false
+	}
+
+	// Names read A-Z by default, counts and recency highest first
+	order := "desc"
+	if q.Sort == sortName {
+		order = "asc"
+	}
+	switch c.DefaultQuery("order", order) {
+	case "asc":
+	case "desc":
+		q.Desc = true
+	default:
+		return PageQuery{}, false
+	}
+	return q, okLimit && okOffset && okMin
+}
+
+// digest identifies the query's filters and sort, which its page tokens are
+// bound to. The limit may change between pages.
+func (q PageQuery) digest() string {
+	return queryDigest(q.Sort, strconv.FormatBool(q.Desc), q.Prefix, strconv.FormatInt(q.MinVisits, 10))
+}
+
+// pageLink returns the request URL resuming the listing at offset, the
+// offset wrapped in a page token
+func (s *Server) pageLink(c *gin.Context, q PageQuery, offset int64) string {
+	query := c.Request.URL.Query()
+	query.Del("offset")
+	query.Set(pageTokenParam, s.pageTokens.Issue(listingPages, q.digest(), strconv.FormatInt(offset, 10)))
+	return c.Request.URL.Path + "?" + query.Encode()
+}
+
+// handleListPages lists pages with sorting, filtering and limit pagination,
+// resuming from the page_token of the next and prev links; a raw offset is
+// still accepted
+func (s *Server) handleListPages(c *gin.Context) {
+	q, ok := parsePageQuery(c)
+	if !ok {
+		respondError(c, http.StatusBadRequest, "invalid_request",
+			"sort must be name, visits or last_visit, order asc or desc, limit 1-1000, and offset and min_visits non-negative")
+		return
+	}
+	q.ExactNames = len(s.cfg.ApproximatePagePrefixes) == 0
+	if c.Query(pageTokenParam) != "" {
+		if c.Query("offset") != "" {
+			respondError(c, http.StatusBadRequest, "invalid_request", "page_token cannot be combined with offset")
+			return
+		}
+		if q.Offset, ok = s.offsetCursor(c, listingPages, q.digest()); !ok {
+			return
+		}
+	}
+
+	hidden, err := s.hiddenPages(c)
+	if err != nil {
+		log.Printf("Error loading private pages: %v", err)
+		respondStoreError(c, err, "Failed to list pages")
+		return
+	}
+	listed, total, err := s.redis.ListPages(c.Request.Context(), q, hidden)
+	if err != nil {
+		log.Printf("Error listing pages: %v", err)
+		respondStoreError(c, err, "Failed to list pages")
+		return
+	}
+
+	response := PagesResponse{Pages: make([]PageCount, 0, len(listed)), Total: int(total)}
+	for _, p := range listed {
+		page := PageCount{Page: p.Page, Visits: p.Visits}
+		if !p.LastVisit.IsZero() {
+			lastVisit := stamp(c, p.LastVisit)
+			page.LastVisit = &lastVisit
+		}
+		response.Pages = append(response.Pages, page)
+	}
+	if q.Offset+q.Limit < total {
+		response.Next = s.pageLink(c, q, q.Offset+q.Limit)
+	}
+	if q.Offset > 0 {
+		response.Prev = s.pageLink(c, q, max(q.Offset-q.Limit, 0))
+	}
+	respondJSON(c, http.StatusOK, response)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"reflect"
+	"testing"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// seedListing records visits for a fixed set of pages and pins their last
+// visit times so the ordering is deterministic
+func seedListing(t *testing.T, router http.Handler, redisClient *RedisClient) {
+	t.Helper()
+	visits := map[string]int{"blog-a": 5, "home": 3, "pricing": 2, "about": 1, "blog-b": 1}
+	for page, n := range visits {
+		for i := 0; i < n; i++ {
+			doRequest(router, "GET", "/visit/"+page, "", nil)
+		}
+	}
+	lastVisits := map[string]float64{"about": 1000, "home": 2000, "pricing": 3000, "blog-a": 4000, "blog-b": 5000}
+	for page, ms := range lastVisits {
+		redisClient.client.ZAdd(context.Background(), lastVisitKey, redis.Z{Member: page, Score: ms})
+	}
+}
+
+func TestListPagesSortAndFilter(t *testing.T) {
+	tests := []struct {
+		query string
+		want  []string
+		total int
+	}{
+		{"", []string{"about", "blog-a", "blog-b", "home", "pricing"}, 5},
+		{"sort=name&order=desc", []string{"pricing", "home", "blog-b", "blog-a", "about"}, 5},
+		{"sort=name&prefix=blog-", []string{"blog-a", "blog-b"}, 2},
+		{"sort=name&min_visits=2", []string{"blog-a", "home", "pricing"}, 3},
+		{"sort=name&prefix=blog-&min_visits=2", []string{"blog-a"}, 1},
+		{"sort=visits", []string{"blog-a", "home", "pricing", "blog-b", "about"}, 5},
+		{"sort=visits&order=asc", []string{"about", "blog-b", "pricing", "home", "blog-a"}, 5},
+		{"sort=visits&min_visits=2", []string{"blog-a", "home", "pricing"}, 3},
+		{"sort=visits&prefix=blog-", []string{"blog-a", "blog-b"}, 2},
+		{"sort=visits&limit=2&offset=1", []string{"home", "pricing"}, 5},
+		{"sort=last_visit", []string{"blog-b", "blog-a", "pricing", "home", "about"}, 5},
+		{"sort=last_visit&order=asc&min_visits=2", []string{"home", "pricing", "blog-a"}, 3},
+		{"sort=last_visit&order=asc&prefix=blog-", []string{"blog-a", "blog-b"}, 2},
+		{"sort=last_visit&prefix=x", []string{}, 0},
+	}
+
+	// Approximate prefixes force name sorts through the filtered scan, so
+	// both paths must agree
+	for _, prefixes := range [][]string{nil, {"zz-"}} {
+		_, redisClient := newTestRedis(t)
+		cfg := testConfig()
+		cfg.ApproximatePagePrefixes = prefixes
+		router := newTestServer(t, cfg, redisClient).Router()
+		seedListing(t, router, redisClient)
+
+		for _, tt := range tests {
+			w := doRequest(router, "GET", "/pages?"+tt.query, "", nil)
+			if w.Code != http.StatusOK {
+				t.Errorf("%q: expected 200, got %d", tt.query, w.Code)
+				continue
+			}
+			resp := decodePages(t, w.Body.Bytes())
+			if got := pageNames(resp.Pages); !reflect.DeepEqual(got, tt.want) || resp.Total != tt.total {
+				t.Errorf("%q (approximate %v): got %v of %d, want %v of %d", tt.query, prefixes, got, resp.Total, tt.want, tt.total)
+			}
+		}
+	}
+}
+
+func TestListPagesLinksAndLastVisit(t *testing.T) {
+	_, redisClient := newTestRedis(t)
+	router := newTestServer(t, testConfig(), redisClient).Router()
+	seedListing(t, router, redisClient)
+
+	resp := decodePages(t, doRequest(router, "GET", "/pages?sort=visits&limit=2&offset=1", "", nil).Body.Bytes())
+	next, _ := url.Parse(resp.Next)
+	if next.Path != "/pages" || next.Query().Get("offset") != "" || next.Query().Get(pageTokenParam) == "" || next.Query().Get("sort") != "visits" || next.Query().Get("limit") != "2" {
+		t.Errorf("Unexpected next link %q", resp.Next)
+	}
+	// The links resume where the raw offsets would
+	for link, offset := range map[string]string{resp.Next: "3", resp.Prev: "0"} {
+		want := decodePages(t, doRequest(router, "GET", "/pages?sort=visits&limit=2&offset="+offset, "", nil).Body.Bytes())
+		got := decodePages(t, doRequest(router, "GET", link, "", nil).Body.Bytes())
+		if !reflect.DeepEqual(got.Pages, want.Pages) {
+			t.Errorf("Expected %s to list offset %s's %+v, got %+v", link, offset, want.Pages, got.Pages)
+		}
+	}
+	if resp.Pages[0].LastVisit == nil || resp.Pages[0].LastVisit.Time.UnixMilli() != 2000 {
+		t.Errorf("Expected home's last visit, got %+v", resp.Pages[0].LastVisit)
+	}
+
+	last := decodePages(t, doRequest(router, "GET", "/pages?offset=4&limit=2", "", nil).Body.Bytes())
+	if last.Next != "" || last.Prev == "" {
+		t.Errorf("Expected only a prev link on the last page, got next %q prev %q", last.Next, last.Prev)
+	}
+
+	doRequest(router, "GET", "/visit/fresh", "", nil)
+	if _, err := redisClient.client.ZScore(context.Background(), lastVisitKey, "fresh").Result(); err != nil {
+		t.Errorf("Expected a visit to record the last visit time: %v", err)
+	}
+}
+
+func TestListPagesExcludesPrivatePages(t *testing.T) {
+	_, redisClient := newTestRedis(t)
+	router := newTestServer(t, testConfig(), redisClient).Router()
+	seedListing(t, router, redisClient)
+	doRequest(router, "PUT", "/admin/pages/pricing/meta", `{"visibility": "private"}`, nil)
+
+	resp := decodePages(t, doRequest(router, "GET", "/pages?sort=visits&limit=2", "", nil).Body.Bytes())
+	if got := pageNames(resp.Pages); !reflect.DeepEqual(got, []string{"blog-a", "home"}) || resp.Total != 4 {
+		t.Errorf("Expected private pages to be excluded from the window and total, got %v of %d", got, resp.Total)
+	}
+}
+
+func TestListPagesInvalidParams(t *testing.T) {
+	_, redisClient := newTestRedis(t)
+	router := newTestServer(t, testConfig(), redisClient).Router()
+
+	for _, query := range []string{"sort=popularity", "order=up", "min_visits=-1", "limit=0"} {
+		if w := doRequest(router, "GET", "/pages?"+query, "", nil); w.Code != http.StatusBadRequest {
+			t.Errorf("%q: expected 400, got %d", query, w.Code)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// loadShedRetryAfter is the Retry-After sent with a shed visit, in seconds
+const loadShedRetryAfter = 1
+
+// P99 returns the highest p99 latency among the classes with enough samples
+// for their timeout to adapt, 0 when none has
+func (a *AdaptiveTimeouts) P99() time.Duration {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var p99 time.Duration
+	for _, w := range a.classes {
+		if len(w.samples) >= latencyMinSamples {
+			p99 = max(p99, w.p99)
+		}
+	}
+	return p99
+}
+
+// LoadShedder rejects a share of visits while Redis is slow, so the counts
+// that do get through stay fast instead of every request timing out. The
+// share ramps linearly from 0 at a p99 of start to maxFraction at full.
+type LoadShedder struct {
+	timeouts    *AdaptiveTimeouts
+	start       time.Duration
+	full        time.Duration
+	maxFraction float64
+
+	shed atomic.Int64
+}
+
+// NewLoadShedder creates a shedder reading latency from timeouts
+func NewLoadShedder(timeouts *AdaptiveTimeouts, start, full time.Duration, maxFraction float64) *LoadShedder {
+	return &LoadShedder{timeouts: timeouts, start: start, full: full, maxFraction: maxFraction}
+}
+
+// newServerShedder creates the server's shedder from cfg. Shedding follows
+// the adaptive timeouts' p99, so it stays off when they are disabled.
+func newServerShedder(cfg Config, redisClient *RedisClient) *LoadShedder {
+	if cfg.LoadShedLatency <= 0 {
+		return nil
+	}
+	if redisClient == nil || redisClient.timeouts == nil {
+		log.Printf("LOAD_SHED_LATENCY is set but REDIS_ADAPTIVE_TIMEOUTS is off, not shedding visits")
+		return nil
+	}
+	return NewLoadShedder(redisClient.timeouts, cfg.LoadShedLatency, cfg.LoadShedFullLatency, cfg.LoadShedMaxFraction)
+}
+
+// Rate returns the share of visits currently shed and the p99 it follows
+func (l *LoadShedder) Rate() (float64, time.Duration) {
+	if l == nil {
+		return 0, 0
+	}
+	p99 := l.timeouts.P99()
+	if p99 <= l.start {
+		return 0, p99
+	}
+	if p99 >= l.full {
+		return l.maxFraction, p99
+	}
+	return l.maxFraction * float64(p99-l.start) / float64(l.full-l.start), p99
+}
+
+// shedLoad is the middleware of the visit route, answering a Rate() share of
+// visits with 503. Reads and probes never pass through it.
+func (s *Server) shedLoad(c *gin.Context) {
+	if rate, _ := s.shedder.Rate(); rate > 0 && rand.Float64() < rate {
+		s.shedder.shed.Add(1)
+		c.Header("Retry-After", strconv.Itoa(loadShedRetryAfter))
+		respondError(c, http.StatusServiceUnavailable, "overloaded", "Redis is slow, visit not counted; try again later")
+		return
+	}
+	c.Next()
+}
+
+// LoadShedResponse represents the /debug/loadshed API response
+type LoadShedResponse struct {
+	Enabled     bool    `json:"enabled"`
+	Rate        float64 `json:"rate"`
+	P99Ms       float64 `json:"p99_ms"`
+	StartMs     float64 `json:"start_ms,omitempty"`
+	FullMs      float64 `json:"full_ms,omitempty"`
+	MaxFraction float64 `json:"max_fraction,omitempty"`
+	Shed        int64   `json:"shed"`
+}
+
+// handleLoadShed reports the current shed rate and what it is derived from
+func (s *Server) handleLoadShed(c *gin.Context) {
+	l := s.shedder
+	if l == nil {
+		respondJSON(c, http.StatusOK, LoadShedResponse{})
+		return
+	}
+	rate, p99 := l.Rate()
+	respondJSON(c, http.StatusOK, LoadShedResponse{
+		Enabled:     true,
+		Rate:        rate,
+		P99Ms:       durationMs(p99),
+		StartMs:     durationMs(l.start),
+		FullMs:      durationMs(l.full),
+		MaxFraction: l.maxFraction,
+		Shed:        l.shed.Load(),
+	})
+}
+
+// write writes the load_shed_rate and load_shed_visits_total series
+func (l *LoadShedder) write(b *strings.Builder, env string) {
+	labels := ""
+	if env != "" {
+		labels = "{env=" + strconv.Quote(env) + "}"
+	}
+	rate, _ := l.Rate()
+	b.WriteString("# HELP load_shed_rate Share of visits currently rejected because Redis is slow.\n")
+	b.WriteString("# TYPE load_shed_rate gauge\n")
+	fmt.Fprintf(b, "load_shed_rate%s %g\n", labels, rate)
+	b.WriteString("# HELP load_shed_visits_total Visits rejected because Redis was slow.\n")
+	b.WriteString("# TYPE load_shed_visits_total counter\n")
+	fmt.Fprintf(b, "load_shed_visits_total%s %d\n", labels, l.shed.Load())
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadShedRate(t *testing.T) {
+	timeouts := NewAdaptiveTimeouts(time.Millisecond, time.Second, 3, 0.2)
+	shedder := NewLoadShedder(timeouts, 10*time.Millisecond, 50*time.Millisecond, 0.5)
+	if rate, _ := shedder.Rate(); rate != 0 {
+		t.Errorf("Expected no shedding without samples, got %g", rate)
+	}
+	tests := []struct {
+		latency time.Duration
+		want    float64
+	}{
+		{5 * time.Millisecond, 0},
+		{20 * time.Millisecond, 0.125},
+		{30 * time.Millisecond, 0.25},
+		{time.Second, 0.5},
+		{time.Millisecond, 0},
+	}
+	for _, tt := range tests {
+		observeN(timeouts, commandWrite, latencyWindowSize, tt.latency)
+		if rate, p99 := shedder.Rate(); rate != tt.want || p99 != tt.latency {
+			t.Errorf("At a p99 of %s: expected a rate of %g, got %g at %s", tt.latency, tt.want, rate, p99)
+		}
+	}
+	var nilShedder *LoadShedder
+	if rate, _ := nilShedder.Rate(); rate != 0 {
+		t.Errorf("Expected a disabled shedder never to shed, got %g", rate)
+	}
+}
+
+func TestLoadShedVisits(t *testing.T) {
+	mr, _ := newTestRedis(t)
+	cfg := testConfig()
+	cfg.RedisHost, cfg.RedisPort, _ = net.SplitHostPort(mr.Addr())
+	cfg.RedisAdaptiveTimeouts = true
+	cfg.RedisTimeoutFloor, cfg.RedisTimeoutCeiling = 50*time.Millisecond, 2*time.Second
+	cfg.RedisTimeoutMultiplier, cfg.RedisTimeoutHysteresis = 3, 0.2
+	cfg.LoadShedLatency, cfg.LoadShedFullLatency, cfg.LoadShedMaxFraction = 10*time.Millisecond, 50*time.Millisecond, 0.5
+	redisClient := NewRedisClientFromConfig(cfg)
+	t.Cleanup(func() { redisClient.client.Close() })
+	router := newTestServer(t, cfg, redisClient).Router()
+
+	// visits counts the 503s among n visits, checking each carries Retry-After
+	visits := func(n int) int {
+		shed := 0
+		for i := 0; i < n; i++ {
+			w := doRequest(router, "GET", "/visit/home", "", nil)
+			switch w.Code {
+			case http.StatusOK:
+			case http.StatusServiceUnavailable:
+				if w.Header().Get("Retry-After") != "1" || !strings.Contains(w.Body.String(), `"code":"overloaded"`) {
+					t.Fatalf("Expected a shed visit to carry Retry-After, got %v: %s", w.Header(), w.Body.String())
+				}
+				shed++
+			default:
+				t.Fatalf("Expected 200 or 503 for a visit, got %d: %s", w.Code, w.Body.String())
+			}
+		}
+		return shed
+	}
+	// loadShed reads /debug/loadshed
+	loadShed := func() LoadShedResponse {
+		var resp LoadShedResponse
+		w := doRequest(router, "GET", "/debug/loadshed", "", nil)
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || w.Code != http.StatusOK {
+			t.Fatalf("Expected the load shed state, got %d: %s", w.Code, w.Body.String())
+		}
+		return resp
+	}
+
+	if shed := visits(100); shed != 0 {
+		t.Errorf("Expected no visits shed while Redis is fast, got %d", shed)
+	}
+
+	// Redis slows down: the rate ramps to the maximum
+	observeN(redisClient.timeouts, commandWrite, latencyWindowSize, 30*time.Millisecond)
+	if resp := loadShed(); !resp.Enabled || resp.Rate != 0.25 || resp.P99Ms != 30 {
+		t.Errorf("Expected a 25%% shed rate at a 30ms p99, got %+v", resp)
+	}
+	observeN(redisClient.timeouts, commandWrite, latencyWindowSize, 200*time.Millisecond)
+	shed := visits(400)
+	if shed < 120 || shed > 280 {
+		t.Errorf("Expected about half of 400 visits shed, got %d", shed)
+	}
+
+	// Reads and health checks are never shed
+	for _, path := range []string{"/visits/home", "/health"} {
+		for i := 0; i < 50; i++ {
+			if w := doRequest(router, "GET", path, "", nil); w.Code != http.StatusOK {
+				t.Fatalf("Expected %s never shed, got %d", path, w.Code)
+			}
+		}
+	}
+
+	resp := loadShed()
+	if resp.Rate != 0.5 || resp.Shed != int64(shed) {
+		t.Errorf("Expected the maximum rate and %d visits shed, got %+v", shed, resp)
+	}
+	metrics := doRequest(router, "GET", "/metrics", "", nil).Body.String()
+	for _, series := range []string{"load_shed_rate 0.5\n", fmt.Sprintf("load_shed_visits_total %d\n", shed)} {
+		if !strings.Contains(metrics, series) {
+			t.Errorf("Expected %q in the metrics", series)
+		}
+	}
+
+	// Redis recovers: so does the rate
+	observeN(redisClient.timeouts, commandWrite, latencyWindowSize, time.Millisecond)
+	if resp := loadShed(); resp.Rate != 0 {
+		t.Errorf("Expected no shedding once the p99 recovered, got %+v", resp)
+	}
+	if shed := visits(100); shed != 0 {
+		t.Errorf("Expected no visits shed after recovering, got %d", shed)
+	}
+}
+
+func TestLoadShedOff(t *testing.T) {
+	_, redisClient := newTestRedis(t)
+	cfg := testConfig()
+	cfg.LoadShedLatency, cfg.LoadShedFullLatency = 10*time.Millisecond, 50*time.Millisecond
+	router := newTestServer(t, cfg, redisClient).Router()
+	var resp LoadShedResponse
+	json.Unmarshal(doRequest(router, "GET", "/debug/loadshed", "", nil).Body.Bytes(), &resp)
+	if resp.Enabled {
+		t.Errorf("Expected no shedding without adaptive timeouts, got %+v", resp)
+	}
+}
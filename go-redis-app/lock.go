@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// maintenanceLockKey serializes background maintenance across replicas
+const maintenanceLockKey = "maintenance:lock"
+
+// releaseScript deletes a lock only if it is still held by the caller's token
+var releaseScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0
+`)
+
+// AcquireMaintenanceLock takes the maintenance lock for up to ttl. It returns
+// ok=false when another replica holds it; call release when done.
+func (r *RedisClient) AcquireMaintenanceLock(ctx context.Context, ttl time.Duration) (release func(), ok bool, err error) {
+	return r.acquireLock(ctx, maintenanceLockKey, ttl)
+}
+
+// acquireLock takes the lock at key for up to ttl, reporting ok=false when
+// someone else holds it
+func (r *RedisClient) acquireLock(ctx context.Context, key string, ttl time.Duration) (release func(), ok bool, err error) {
+	token, err := newVisitorID()
+	if err != nil {
+		return nil, false, err
+	}
+	ok, err = r.client.SetNX(ctx, key, token, ttl).Result()
+	if err != nil || !ok {
+		return nil, false, err
+	}
+	return func() {
+		releaseScript.Run(context.Background(), r.client, []string{key}, token)
+	}, true, nil
+}
@@ -2,49 +2,105 @@ package main
 
 import (
 	"context"
-	"fmt"
 	"log"
-	"net/http"
+	"net"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
-	"github.com/gin-gonic/gin"
 	"github.com/redis/go-redis/v9"
 )
 
 // RedisClient wraps the Redis client
 type RedisClient struct {
 	client *redis.Client
+
+	// sketches is set at startup when RedisBloom Top-K/CMS are in use
+	sketches bool
+
+	// trendingHalfLife is TRENDING_HALF_LIFE, set with sketches, which
+	// decay the trending Top-K windows by it
+	trendingHalfLife time.Duration
+
+	// search is set at startup when the RediSearch page index is in use
+	search bool
+
+	// strict is set from STRICT_CONSISTENCY: updates spanning several keys
+	// are applied atomically or not at all
+	strict bool
+
+	// timeouts holds the adaptive deadlines, nil when they are disabled
+	timeouts *AdaptiveTimeouts
+
+	// retries is the retry policy, nil when REDIS_MAX_RETRIES is 0
+	retries *RetryPolicy
+
+	// readOnly is set from READ_ONLY: every write command fails
+	readOnly bool
+
+	// prefix namespaces the keys under KEY_PREFIX, nil when neither it nor
+	// KEY_PREFIX_OLD is set
+	prefix *KeyPrefix
 }
 
-// NewRedisClient creates a new Redis client
+// NewRedisClient creates a new Redis client from REDIS_HOST, REDIS_PORT and
+// REDIS_DB
 func NewRedisClient() *RedisClient {
-	host := getEnv("REDIS_HOST", "localhost")
-	port := getEnv("REDIS_PORT", "6379")
-	
+	db, err := parseRedisDB(getEnv("REDIS_DB", "0"))
+	if err != nil {
+		log.Printf("Invalid REDIS_DB, using 0: %v", err)
+	}
+	return NewRedisClientFromConfig(Config{
+		RedisHost: getEnv("REDIS_HOST", "localhost"),
+		RedisPort: getEnv("REDIS_PORT", "6379"),
+		RedisDB:   db,
+	})
+}
+
+// NewRedisClientFromConfig creates a Redis client for the configured server
+// and logical database, with adaptive command deadlines when enabled
+func NewRedisClientFromConfig(cfg Config) *RedisClient {
 	rdb := redis.NewClient(&redis.Options{
-		Addr:     fmt.Sprintf("%s:%s", host, port),
+		Addr:     net.JoinHostPort(cfg.RedisHost, cfg.RedisPort),
 		Password: "", // no password
-		DB:       0,  // default DB
+		DB:       cfg.RedisDB,
+
+		ContextTimeoutEnabled: cfg.RedisAdaptiveTimeouts,
+		// Retries follow the RetryPolicy, which knows INCR from GET
+		MaxRetries: -1,
 	})
 
-	return &RedisClient{client: rdb}
+	r := newRedisClient(rdb)
+	r.strict = cfg.StrictConsistency
+	if cfg.RedisMaxRetries > 0 {
+		r.retries = NewRetryPolicy(int(cfg.RedisMaxRetries), cfg.RedisRetryBackoff, cfg.RedisRetryBackoffMax)
+		rdb.AddHook(retryHook{policy: r.retries})
+	}
+	if cfg.RedisAdaptiveTimeouts {
+		r.timeouts = NewAdaptiveTimeouts(cfg.RedisTimeoutFloor, cfg.RedisTimeoutCeiling, cfg.RedisTimeoutMultiplier, cfg.RedisTimeoutHysteresis)
+		rdb.AddHook(timeoutHook{timeouts: r.timeouts})
+	}
+	if cfg.KeyPrefix != "" || cfg.KeyPrefixMigrating {
+		r.prefix = NewKeyPrefix(cfg.KeyPrefix, cfg.KeyPrefixOld, cfg.KeyPrefixMigrating)
+		rdb.AddHook(prefixHook{prefix: r.prefix})
+	}
+	if cfg.ReadOnly {
+		r.enableReadOnly()
+	}
+	return r
 }
 
 // IncrementVisitCount increments the visit count for a given page
 func (r *RedisClient) IncrementVisitCount(ctx context.Context, page string) (int64, error) {
-	key := fmt.Sprintf("visits:%s", page)
-	return r.client.Incr(ctx, key).Result()
+	return r.client.Incr(ctx, key("visits", page)).Result()
 }
 
-// GetVisitCount gets the current visit count for a given page
+// GetVisitCount gets the current visit count for a given page; pages never
+// visited have a count of 0
 func (r *RedisClient) GetVisitCount(ctx context.Context, page string) (int64, error) {
-	key := fmt.Sprintf("visits:%s", page)
-	result := r.client.Get(ctx, key)
-	if result.Err() == redis.Nil {
-		return 0, nil
-	}
-	return result.Int64()
+	count, err := r.client.Get(ctx, key("visits", page)).Int64()
+	return count, ignoreMissing(err)
 }
 
 // Ping tests the Redis connection
@@ -54,137 +110,145 @@ func (r *RedisClient) Ping(ctx context.Context) error {
 
 // VisitResponse represents the API response
 type VisitResponse struct {
-	Page      string `json:"page"`
-	Visits    int64  `json:"visits"`
-	Timestamp string `json:"timestamp"`
+	Page           string   `json:"page"`
+	Visits         int64    `json:"visits"`
+	Sessions       int64    `json:"sessions,omitempty"`
+	WeightedVisits *float64 `json:"weighted_visits,omitempty"`
+	Variant        string   `json:"variant,omitempty"`
+	Approximate    bool     `json:"approximate,omitempty"`
+	Counted        *bool    `json:"counted,omitempty"`
+	Reason         string   `json:"reason,omitempty"`
+	Sampled        bool     `json:"sampled,omitempty"`
+	SampleRate     float64  `json:"sample_rate,omitempty"`
+	FirstVisit     bool     `json:"first_visit,omitempty"`
+	ResolvedFrom   string   `json:"resolved_from,omitempty"`
+
+	// Replicated is set with WRITE_CONSISTENCY=replicated on counted visits
+	Replicated *bool `json:"replicated,omitempty"`
+
+	// Rank and Unique are only set when requested with ?include=
+	Rank   *int64 `json:"rank,omitempty"`
+	Unique *int64 `json:"unique,omitempty"`
+
+	// Expanded is the related data asked for with ?expand=
+	Expanded  *Expansions `json:"expanded,omitempty"`
+	Timestamp Timestamp   `json:"timestamp"`
+
+	// view selects the encoding and the included fields
+	view visitView
 }
 
 // HealthResponse represents the health check response
 type HealthResponse struct {
-	Status    string `json:"status"`
-	Redis     string `json:"redis"`
-	Timestamp string `json:"timestamp"`
+	Status string `json:"status"`
+	Redis  string `json:"redis"`
+
+	// ClockSkew is the Redis clock minus ours, in seconds, set only while it
+	// exceeds CLOCK_SKEW_THRESHOLD
+	ClockSkew *float64 `json:"clock_skew_seconds,omitempty"`
+
+	// ReadOnly is set in READ_ONLY mode
+	ReadOnly bool `json:"read_only,omitempty"`
+
+	// OutOfMemory is set while Redis refuses writes and visits are
+	// journaled in memory, with status "degraded"
+	OutOfMemory *OutOfMemoryStatus `json:"redis_out_of_memory,omitempty"`
+
+	Timestamp Timestamp `json:"timestamp"`
 }
 
-func main() {
-	// Initialize Redis client
-	redisClient := NewRedisClient()
-	ctx := context.Background()
+// OutOfMemoryStatus is the /health warning for a Redis out of memory
+type OutOfMemoryStatus struct {
+	Since           Timestamp `json:"since"`
+	JournaledVisits int64     `json:"journaled_visits"`
+}
 
-	// Test Redis connection
-	if err := redisClient.Ping(ctx); err != nil {
-		log.Printf("Failed to connect to Redis: %v", err)
-		log.Println("Make sure Redis is running and accessible")
-	} else {
-		log.Println("Successfully connected to Redis")
+func main() {
+	cfg, err := LoadConfig()
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	if cfg.EnvName != "" {
+		log.SetPrefix("[" + cfg.EnvName + "] ")
+	}
+	if err := verifyServices(context.Background(), cfg, net.DefaultResolver); err != nil {
+		log.Fatalf("Service discovery failed:\n%v", err)
 	}
 
-	// Set up Gin router
-	r := gin.Default()
-
-	// Add CORS middleware
-	r.Use(func(c *gin.Context) {
-		c.Header("Access-Control-Allow-Origin", "*")
-		c.Header("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
-		c.Header("Access-Control-Allow-Headers", "Content-Type")
-		
-		if c.Request.Method == "OPTIONS" {
-			c.AbortWithStatus(204)
-			return
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := runMigrateCommand(cfg, os.Args[2:], os.Stdout); err != nil {
+			log.Fatalf("Migration failed: %v", err)
 		}
-		
-		c.Next()
-	})
-
-	// Health check endpoint
-	r.GET("/health", func(c *gin.Context) {
-		redisStatus := "healthy"
-		if err := redisClient.Ping(ctx); err != nil {
-			redisStatus = "unhealthy"
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		if err := runReplayCommand(os.Args[2:], os.Stdin, os.Stdout); err != nil {
+			log.Fatalf("Replay failed: %v", err)
 		}
+		return
+	}
 
-		response := HealthResponse{
-			Status:    "healthy",
-			Redis:     redisStatus,
-			Timestamp: time.Now().Format(time.RFC3339),
-		}
+	// Background workers and the HTTP server stop on SIGINT/SIGTERM
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-		c.JSON(http.StatusOK, response)
-	})
+	// Initialize Redis client
+	redisClient := NewRedisClientFromConfig(cfg)
 
-	// Visit counter endpoint
-	r.GET("/visit/:page", func(c *gin.Context) {
-		page := c.Param("page")
-		if page == "" {
-			page = "home"
-		}
+	if cfg.IPHashSalt == "" {
+		log.Println("IP_HASH_SALT is not set; visitor identifiers are hashed without a secret salt")
+	}
+	if cfg.PageTokenSecret == "" {
+		log.Println("PAGE_TOKEN_SECRET is not set; pagination tokens are only accepted by the replica that issued them")
+	}
 
-		// Increment visit count
-		visits, err := redisClient.IncrementVisitCount(ctx, page)
-		if err != nil {
-			log.Printf("Error incrementing visit count: %v", err)
-			c.JSON(http.StatusInternalServerError, gin.H{
-				"error": "Failed to increment visit count",
-			})
-			return
-		}
+	geo, err := NewGeoResolverFromConfig(cfg)
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
 
-		response := VisitResponse{
-			Page:      page,
-			Visits:    visits,
-			Timestamp: time.Now().Format(time.RFC3339),
-		}
+	server := NewServer(cfg, redisClient, systemClock{}, geo)
 
-		c.JSON(http.StatusOK, response)
-	})
+	// Check Redis, the listen ports and the TLS files before starting
+	report := server.SelfCheck(ctx)
+	writeSelfCheck(os.Stdout, report)
+	if !report.Passed {
+		log.Fatal("Self-check failed; fix the FAIL checks above or list them in SELFCHECK_SOFT")
+	}
 
-	// Get visit count without incrementing
-	r.GET("/visits/:page", func(c *gin.Context) {
-		page := c.Param("page")
-		if page == "" {
-			page = "home"
-		}
+	if err := server.Start(ctx); err != nil {
+		log.Printf("Failed to start background workers: %v", err)
+	}
 
-		visits, err := redisClient.GetVisitCount(ctx, page)
+	listeners, err := openListeners(cfg)
+	if err != nil {
+		log.Fatal("Failed to start server: ", err)
+	}
+	var endpoints []Endpoint
+	if cfg.SinglePort {
+		endpoints = []Endpoint{{Handler: server.Router(), Listeners: listeners}}
+	} else {
+		internal, err := net.Listen("tcp", ":"+cfg.InternalPort)
 		if err != nil {
-			log.Printf("Error getting visit count: %v", err)
-			c.JSON(http.StatusInternalServerError, gin.H{
-				"error": "Failed to get visit count",
-			})
-			return
+			closeListeners(listeners)
+			log.Fatal("Failed to start internal server: ", err)
 		}
-
-		response := VisitResponse{
-			Page:      page,
-			Visits:    visits,
-			Timestamp: time.Now().Format(time.RFC3339),
+		endpoints = []Endpoint{
+			{Handler: server.PublicRouter(), Listeners: listeners},
+			{Handler: server.InternalRouter(), Listeners: []net.Listener{internal}},
 		}
-
-		c.JSON(http.StatusOK, response)
-	})
-
-	// Root endpoint with basic info
-	r.GET("/", func(c *gin.Context) {
-		c.JSON(http.StatusOK, gin.H{
-			"message": "Go Redis Microservice",
-			"version": "1.0.0",
-			"endpoints": gin.H{
-				"health": "/health",
-				"visit":  "/visit/:page",
-				"visits": "/visits/:page",
-			},
-		})
-	})
+		log.Printf("Admin and probe routes on internal port %s", cfg.InternalPort)
+	}
 
 	// Start server
-	port := getEnv("PORT", "8080")
-	log.Printf("Starting server on port %s", port)
-	log.Printf("Health check: http://localhost:%s/health", port)
-	log.Printf("Visit counter: http://localhost:%s/visit/home", port)
-	
-	if err := r.Run(":" + port); err != nil {
-		log.Fatal("Failed to start server:", err)
+	for _, l := range listeners {
+		log.Printf("Listening on %s://%s", l.Addr().Network(), l.Addr())
+	}
+
+	if err := server.Serve(ctx, endpoints...); err != nil {
+		log.Fatal("Server error: ", err)
 	}
+	log.Println("Server stopped")
 }
 
 // getEnv gets an environment variable with a fallback value
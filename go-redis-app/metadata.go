@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	visibilityPublic  = "public"
+	visibilityPrivate = "private"
+
+	// privatePagesKey indexes private pages so listings can filter them
+	privatePagesKey = "visits:private"
+)
+
+// PageMeta holds per-page settings
+type PageMeta struct {
+	Title      string   `json:"title,omitempty"`
+	Visibility string   `json:"visibility"`
+	Tags       []string `json:"tags,omitempty"`
+	Variants   []string `json:"variants,omitempty"`
+	// SampleRate below 1 counts only that fraction of visits, each weighted
+	// by its inverse; 0 means every visit is counted
+	SampleRate float64 `json:"sample_rate,omitempty"`
+	// Group names the group whose counting policy the page follows
+	Group string `json:"group,omitempty"`
+	// DedupeWindow, BotFiltering and TTL override the page's group and the
+	// global settings, as SampleRate does
+	DedupeWindow string      `json:"dedupe_window,omitempty"`
+	BotFiltering FeatureMode `json:"bot_filtering,omitempty"`
+	TTL          string      `json:"ttl,omitempty"`
+	// SuspectedBot is set by the service while the page's median visit
+	// inter-arrival time is under INTERARRIVAL_BOT_MEDIAN. It is kept with
+	// the histogram, not stored with the metadata, and added when the
+	// metadata is served; a PUT can't set or clear it.
+	SuspectedBot bool `json:"suspected_bot,omitempty"`
+	// TrafficAnomaly is set by the service while the page's recent visit
+	// rate is ANOMALY_THRESHOLD times its baseline or more. Like
+	// SuspectedBot it is read from the anomaly flags when the metadata is
+	// served, not stored with it.
+	TrafficAnomaly bool `json:"traffic_anomaly,omitempty"`
+	// WebhookURL receives a page.visited event for every counted visit. It
+	// is left out of /pages/:page/meta, since webhook URLs often carry a token.
+	WebhookURL string `json:"webhook_url,omitempty"`
+}
+
+// Validate normalizes defaults and rejects invalid values
+func (m *PageMeta) Validate() error {
+	switch m.Visibility {
+	case "":
+		m.Visibility = visibilityPublic
+	case visibilityPublic, visibilityPrivate:
+	default:
+		return fmt.Errorf("visibility must be %q or %q", visibilityPublic, visibilityPrivate)
+	}
+	policy, err := m.policy()
+	if err != nil {
+		return err
+	}
+	if policy.DedupeWindow > 0 {
+		m.DedupeWindow = policy.DedupeWindow.String()
+	}
+	if policy.TTL > 0 {
+		m.TTL = policy.TTL.String()
+	}
+	if m.Group != "" && !groupNamePattern.MatchString(m.Group) {
+		return fmt.Errorf("invalid group %q", m.Group)
+	}
+	for _, tag := range m.Tags {
+		if tag == "" || strings.Contains(tag, ",") {
+			return fmt.Errorf("invalid tag %q", tag)
+		}
+	}
+	if m.WebhookURL != "" {
+		if u, err := url.Parse(m.WebhookURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("webhook_url must be an http or https URL")
+		}
+	}
+	for _, variant := range m.Variants {
+		if !variantPattern.MatchString(variant) || variant == otherVariant {
+			return fmt.Errorf("invalid variant %q", variant)
+		}
+	}
+	return nil
+}
+
+// policy returns the counting settings the page overrides, zero where unset
+func (m PageMeta) policy() (countingPolicy, error) {
+	return parsePolicy(m.DedupeWindow, m.BotFiltering, m.TTL, m.SampleRate)
+}
+
+// overridesPolicy reports whether the page overrides a setting other than
+// sample_rate, which pagePolicy reads whenever sampling is on
+func (m PageMeta) overridesPolicy() bool {
+	return m.DedupeWindow != "" || m.BotFiltering != "" || m.TTL != ""
+}
+
+// MetadataStore persists page metadata
+type MetadataStore interface {
+	GetMeta(ctx context.Context, page string) (PageMeta, error)
+	// GetMetas returns the metadata of many pages, in order, in one round
+	// trip
+	GetMetas(ctx context.Context, pages []string) ([]PageMeta, error)
+	SetMeta(ctx context.Context, page string, meta PageMeta) error
+	PrivatePages(ctx context.Context) (map[string]bool, error)
+}
+
+// RedisMetadataStore stores metadata as a flat hash per page
+type RedisMetadataStore struct {
+	redis *RedisClient
+}
+
+// NewRedisMetadataStore creates a hash-backed metadata store
+func NewRedisMetadataStore(redisClient *RedisClient) *RedisMetadataStore {
+	return &RedisMetadataStore{redis: redisClient}
+}
+
+// metaKey returns the metadata key for a page
+func metaKey(page string) string {
+	return key("visits", "meta", page)
+}
+
+// GetMeta returns the page metadata, with defaults for unknown pages
+func (s *RedisMetadataStore) GetMeta(ctx context.Context, page string) (PageMeta, error) {
+	values, err := s.redis.client.HGetAll(ctx, metaKey(page)).Result()
+	if err != nil {
+		return PageMeta{}, err
+	}
+	return metaFromHash(values), nil
+}
+
+// GetMetas returns the metadata of pages with one pipelined HGETALL each
+func (s *RedisMetadataStore) GetMetas(ctx context.Context, pages []string) ([]PageMeta, error) {
+	pipe := s.redis.client.Pipeline()
+	cmds := make([]*redis.MapStringStringCmd, len(pages))
+	for i, page := range pages {
+		cmds[i] = pipe.HGetAll(ctx, metaKey(page))
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, err
+	}
+	metas := make([]PageMeta, len(pages))
+	for i, cmd := range cmds {
+		metas[i] = metaFromHash(cmd.Val())
+	}
+	return metas, nil
+}
+
+// metaFromHash decodes a metadata hash, with defaults for missing fields
+func metaFromHash(values map[string]string) PageMeta {
+	meta := PageMeta{
+		Title:        values["title"],
+		Visibility:   values["visibility"],
+		Group:        values["group"],
+		DedupeWindow: values["dedupe_window"],
+		BotFiltering: FeatureMode(values["bot_filtering"]),
+		TTL:          values["ttl"],
+		WebhookURL:   values["webhook_url"],
+	}
+	if tags := values["tags"]; tags != "" {
+		meta.Tags = strings.Split(tags, ",")
+	}
+	if variants := values["variants"]; variants != "" {
+		meta.Variants = strings.Split(variants, ",")
+	}
+	if rate := values["sample_rate"]; rate != "" {
+		meta.SampleRate, _ = strconv.ParseFloat(rate, 64)
+	}
+	if meta.Visibility == "" {
+		meta.Visibility = visibilityPublic
+	}
+	return meta
+}
+
+// SetMeta replaces the page metadata and updates the private page, group
+// and policy indexes. It fails with errGroupNotFound if the page's group is
+// not defined.
+func (s *RedisMetadataStore) SetMeta(ctx context.Context, page string, meta PageMeta) error {
+	return s.redis.watch(ctx, func(tx *redis.Tx) error {
+		previous, err := tx.HGet(ctx, metaKey(page), "group").Result()
+		if ignoreMissing(err) != nil {
+			return err
+		}
+		if err := checkGroup(ctx, tx, meta.Group); err != nil {
+			return err
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Del(ctx, metaKey(page))
+			pipe.HSet(ctx, metaKey(page),
+				"title", meta.Title,
+				"visibility", meta.Visibility,
+				"tags", strings.Join(meta.Tags, ","),
+				"variants", strings.Join(meta.Variants, ","),
+				"sample_rate", strconv.FormatFloat(meta.SampleRate, 'f', -1, 64),
+				"group", meta.Group,
+				"dedupe_window", meta.DedupeWindow,
+				"bot_filtering", string(meta.BotFiltering),
+				"ttl", meta.TTL,
+				"webhook_url", meta.WebhookURL,
+			)
+			indexMeta(ctx, pipe, page, previous, meta)
+			return nil
+		})
+		return err
+	}, metaWatchKeys(page, meta)...)
+}
+
+// metaWatchKeys returns the keys SetMeta WATCHes: the page's metadata, so
+// the previous group it reads is the one it replaces, and the group it
+// assigns, so the group can't be deleted in between
+func metaWatchKeys(page string, meta PageMeta) []string {
+	keys := []string{metaKey(page)}
+	if meta.Group != "" {
+		keys = append(keys, groupKey(meta.Group))
+	}
+	return keys
+}
+
+// indexMeta updates the private page, group and policy indexes for meta,
+// replacing metadata assigned to the previous group
+func indexMeta(ctx context.Context, pipe redis.Pipeliner, page, previous string, meta PageMeta) {
+	if meta.Visibility == visibilityPrivate {
+		pipe.SAdd(ctx, privatePagesKey, page)
+	} else {
+		pipe.SRem(ctx, privatePagesKey, page)
+	}
+	if meta.overridesPolicy() {
+		pipe.SAdd(ctx, policyPagesKey, page)
+	} else {
+		pipe.SRem(ctx, policyPagesKey, page)
+	}
+	indexGroup(ctx, pipe, page, previous, meta.Group)
+}
+
+// indexGroup moves the page from its previous group's page set to its
+// current one's
+func indexGroup(ctx context.Context, pipe redis.Pipeliner, page, previous, group string) {
+	if previous == group {
+		return
+	}
+	if previous != "" {
+		pipe.SRem(ctx, groupPagesKey(previous), page)
+	}
+	if group != "" {
+		pipe.SAdd(ctx, groupPagesKey(group), page)
+	}
+}
+
+// PrivatePages returns the set of pages marked private
+func (s *RedisMetadataStore) PrivatePages(ctx context.Context) (map[string]bool, error) {
+	pages, err := s.redis.client.SMembers(ctx, privatePagesKey).Result()
+	if err != nil {
+		return nil, err
+	}
+	private := make(map[string]bool, len(pages))
+	for _, page := range pages {
+		private[page] = true
+	}
+	return private, nil
+}
+
+// PageFlags reads the flags the service keeps for a page outside its
+// metadata: suspected_bot from its inter-arrival histogram and
+// traffic_anomaly from the anomaly flags
+func (r *RedisClient) PageFlags(ctx context.Context, page string) (suspectedBot, trafficAnomaly bool, err error) {
+	pipe := r.client.Pipeline()
+	bot := pipe.HGet(ctx, interarrivalKey(page), interarrivalFlagField)
+	anomaly := pipe.HExists(ctx, anomalyFlaggedKey, page)
+	if _, err := pipe.Exec(ctx); ignoreMissing(err) != nil {
+		return false, false, err
+	}
+	if err := ignoreMissing(bot.Err()); err != nil {
+		return false, false, wrapError(err)
+	}
+	return bot.Val() == "1", anomaly.Val(), nil
+}
+
+// boolFlag formats a bool as the "1" or "0" stored in hash fields
+func boolFlag(b bool) string {
+	if b {
+		return "1"
+	}
+	return "0"
+}
@@ -0,0 +1,78 @@
+//go:build integration
+
+package main
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// cleanupMeta removes the metadata keys written by a test
+func cleanupMeta(t *testing.T, redisClient *RedisClient, prefix string) {
+	t.Cleanup(func() {
+		ctx := context.Background()
+		keys, _ := redisClient.client.Keys(ctx, metaKey(prefix+"*")).Result()
+		if len(keys) > 0 {
+			redisClient.client.Del(ctx, keys...)
+		}
+		pages, _ := redisClient.client.SMembers(ctx, privatePagesKey).Result()
+		for _, page := range pages {
+			if strings.HasPrefix(page, prefix) {
+				redisClient.client.SRem(ctx, privatePagesKey, page)
+			}
+		}
+	})
+}
+
+func TestJSONMetadataStoreConformance(t *testing.T) {
+	redisClient := newRedisStackClient(t)
+	cleanupMeta(t, redisClient, "conformance-json-")
+	testMetadataStoreConformance(t, redisClient, NewJSONMetadataStore(redisClient), "conformance-json-")
+}
+
+func TestRedisMetadataStoreConformanceOnStack(t *testing.T) {
+	redisClient := newRedisStackClient(t)
+	cleanupMeta(t, redisClient, "conformance-hash-")
+	testMetadataStoreConformance(t, redisClient, NewRedisMetadataStore(redisClient), "conformance-hash-")
+}
+
+func TestJSONMetadataStoreMigratesHashes(t *testing.T) {
+	ctx := context.Background()
+	redisClient := newRedisStackClient(t)
+	cleanupMeta(t, redisClient, "migrate-")
+
+	legacy := PageMeta{Title: "Legacy", Visibility: visibilityPublic, Tags: []string{"old"}}
+	if err := NewRedisMetadataStore(redisClient).SetMeta(ctx, "migrate-page", legacy); err != nil {
+		t.Fatalf("SetMeta failed: %v", err)
+	}
+
+	store := NewJSONMetadataStore(redisClient)
+	got, err := store.GetMeta(ctx, "migrate-page")
+	if err != nil || !reflect.DeepEqual(got, legacy) {
+		t.Fatalf("Expected legacy hash to be readable, got %+v, %v", got, err)
+	}
+	if batch, err := store.GetMetas(ctx, []string{"migrate-missing", "migrate-page"}); err != nil || !reflect.DeepEqual(batch, []PageMeta{{Visibility: visibilityPublic}, legacy}) {
+		t.Fatalf("Expected legacy hashes in batch reads, got %+v, %v", batch, err)
+	}
+
+	updated := PageMeta{Title: "Migrated", Visibility: visibilityPublic, Tags: []string{"new"}}
+	if err := store.SetMeta(ctx, "migrate-page", updated); err != nil {
+		t.Fatalf("SetMeta failed: %v", err)
+	}
+	if keyType, _ := redisClient.client.Type(ctx, metaKey("migrate-page")).Result(); keyType != "ReJSON-RL" {
+		t.Errorf("Expected a JSON document after the first write, got type %q", keyType)
+	}
+	if got, _ = store.GetMeta(ctx, "migrate-page"); !reflect.DeepEqual(got, updated) {
+		t.Errorf("Expected %+v, got %+v", updated, got)
+	}
+
+	// Typed arrays allow path updates without rewriting the document
+	if err := redisClient.client.Do(ctx, "JSON.ARRAPPEND", metaKey("migrate-page"), "$.tags", `"extra"`).Err(); err != nil {
+		t.Fatalf("JSON.ARRAPPEND failed: %v", err)
+	}
+	if got, _ = store.GetMeta(ctx, "migrate-page"); !reflect.DeepEqual(got.Tags, []string{"new", "extra"}) {
+		t.Errorf("Expected appended tag, got %v", got.Tags)
+	}
+}
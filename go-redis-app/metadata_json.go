@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// metaDocument is the RedisJSON representation of PageMeta. Arrays are always
+// present so path updates such as JSON.ARRAPPEND $.tags work on every page.
+type metaDocument struct {
+	Title      string   `json:"title"`
+	Visibility string   `json:"visibility"`
+	Tags       []string `json:"tags"`
+	Variants   []string `json:"variants"`
+	SampleRate float64  `json:"sample_rate"`
+	Group      string   `json:"group"`
+	// The policy overrides are left out while unset, like webhook_url
+	DedupeWindow string      `json:"dedupe_window,omitempty"`
+	BotFiltering FeatureMode `json:"bot_filtering,omitempty"`
+	TTL          string      `json:"ttl,omitempty"`
+	WebhookURL   string      `json:"webhook_url,omitempty"`
+}
+
+// JSONMetadataStore stores metadata as a RedisJSON document per page. Pages
+// still stored as hashes are read through the hash store until their first
+// write, which replaces the hash with a document.
+type JSONMetadataStore struct {
+	redis  *RedisClient
+	hashes *RedisMetadataStore
+}
+
+// NewJSONMetadataStore creates a RedisJSON-backed metadata store
+func NewJSONMetadataStore(redisClient *RedisClient) *JSONMetadataStore {
+	return &JSONMetadataStore{redis: redisClient, hashes: NewRedisMetadataStore(redisClient)}
+}
+
+// GetMeta returns the page metadata, with defaults for unknown pages
+func (s *JSONMetadataStore) GetMeta(ctx context.Context, page string) (PageMeta, error) {
+	raw, err := s.redis.client.Do(ctx, "JSON.GET", metaKey(page)).Text()
+	if isMissing(err) {
+		return PageMeta{Visibility: visibilityPublic}, nil
+	}
+	if isWrongType(err) {
+		return s.hashes.GetMeta(ctx, page)
+	}
+	if err != nil {
+		return PageMeta{}, err
+	}
+	return metaFromDocument(raw)
+}
+
+// GetMetas returns the metadata of pages with one pipelined JSON.GET each.
+// Pages still stored as hashes are read through the hash store after.
+func (s *JSONMetadataStore) GetMetas(ctx context.Context, pages []string) ([]PageMeta, error) {
+	pipe := s.redis.client.Pipeline()
+	cmds := make([]*redis.Cmd, len(pages))
+	for i, page := range pages {
+		cmds[i] = pipe.Do(ctx, "JSON.GET", metaKey(page))
+	}
+	// Errors are per command: missing and legacy pages are not failures
+	pipe.Exec(ctx)
+
+	metas := make([]PageMeta, len(pages))
+	var legacy []string
+	var legacyAt []int
+	for i, cmd := range cmds {
+		raw, err := cmd.Text()
+		switch {
+		case isMissing(err):
+			metas[i] = PageMeta{Visibility: visibilityPublic}
+		case isWrongType(err):
+			legacy, legacyAt = append(legacy, pages[i]), append(legacyAt, i)
+		case err != nil:
+			return nil, err
+		default:
+			if metas[i], err = metaFromDocument(raw); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if len(legacy) > 0 {
+		hashes, err := s.hashes.GetMetas(ctx, legacy)
+		if err != nil {
+			return nil, err
+		}
+		for n, i := range legacyAt {
+			metas[i] = hashes[n]
+		}
+	}
+	return metas, nil
+}
+
+// metaFromDocument decodes a metadata document
+func metaFromDocument(raw string) (PageMeta, error) {
+	var doc metaDocument
+	if err := json.Unmarshal([]byte(raw), &doc); err != nil {
+		return PageMeta{}, err
+	}
+	meta := PageMeta{
+		Title:        doc.Title,
+		Visibility:   doc.Visibility,
+		SampleRate:   doc.SampleRate,
+		Group:        doc.Group,
+		DedupeWindow: doc.DedupeWindow,
+		BotFiltering: doc.BotFiltering,
+		TTL:          doc.TTL,
+		WebhookURL:   doc.WebhookURL,
+	}
+	if len(doc.Tags) > 0 {
+		meta.Tags = doc.Tags
+	}
+	if len(doc.Variants) > 0 {
+		meta.Variants = doc.Variants
+	}
+	if meta.Visibility == "" {
+		meta.Visibility = visibilityPublic
+	}
+	return meta, nil
+}
+
+// SetMeta replaces the page metadata, migrating a legacy hash if present,
+// and updates the private page, group and policy indexes. Like the hash
+// store's, it WATCHes the page and its group and fails with
+// errGroupNotFound if the group is not defined.
+func (s *JSONMetadataStore) SetMeta(ctx context.Context, page string, meta PageMeta) error {
+	doc := metaDocument{
+		Title:        meta.Title,
+		Visibility:   meta.Visibility,
+		Tags:         append([]string{}, meta.Tags...),
+		Variants:     append([]string{}, meta.Variants...),
+		SampleRate:   meta.SampleRate,
+		Group:        meta.Group,
+		DedupeWindow: meta.DedupeWindow,
+		BotFiltering: meta.BotFiltering,
+		TTL:          meta.TTL,
+		WebhookURL:   meta.WebhookURL,
+	}
+	body, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+
+	return s.redis.watch(ctx, func(tx *redis.Tx) error {
+		previous, err := documentGroup(ctx, tx, page)
+		if err != nil {
+			return err
+		}
+		if err := checkGroup(ctx, tx, meta.Group); err != nil {
+			return err
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			// DEL drops a legacy hash so JSON.SET doesn't fail with WRONGTYPE
+			pipe.Del(ctx, metaKey(page))
+			pipe.Do(ctx, "JSON.SET", metaKey(page), "$", string(body))
+			indexMeta(ctx, pipe, page, previous, meta)
+			return nil
+		})
+		return err
+	}, metaWatchKeys(page, meta)...)
+}
+
+// documentGroup reads the group of the page's document, or of its legacy
+// hash, within tx
+func documentGroup(ctx context.Context, tx *redis.Tx, page string) (string, error) {
+	// Tx has no Do, so the command is built and processed directly
+	cmd := redis.NewCmd(ctx, "JSON.GET", metaKey(page), "$.group")
+	tx.Process(ctx, cmd)
+	raw, err := cmd.Text()
+	switch {
+	case isMissing(err):
+		return "", nil
+	case isWrongType(err):
+		group, err := tx.HGet(ctx, metaKey(page), "group").Result()
+		return group, ignoreMissing(err)
+	case err != nil:
+		return "", err
+	}
+	// A JSONPath query answers with an array of the matches
+	var groups []string
+	if err := json.Unmarshal([]byte(raw), &groups); err != nil || len(groups) == 0 {
+		return "", err
+	}
+	return groups[0], nil
+}
+
+// PrivatePages returns the set of pages marked private
+func (s *JSONMetadataStore) PrivatePages(ctx context.Context) (map[string]bool, error) {
+	return s.hashes.PrivatePages(ctx)
+}
+
+// isWrongType reports whether a command failed because the key holds
+// another type
+func isWrongType(err error) bool {
+	return err != nil && strings.HasPrefix(err.Error(), "WRONGTYPE")
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// testMetadataStoreConformance checks the behaviour every MetadataStore
+// implementation must share
+func testMetadataStoreConformance(t *testing.T, redisClient *RedisClient, store MetadataStore, prefix string) {
+	ctx := context.Background()
+	for _, group := range []string{"campaigns", "docs"} {
+		if err := redisClient.SaveGroup(ctx, countingPolicy{Group: group}, true); err != nil && !errors.Is(err, errGroupExists) {
+			t.Fatalf("SaveGroup failed: %v", err)
+		}
+	}
+
+	t.Run("defaults", func(t *testing.T) {
+		meta, err := store.GetMeta(ctx, prefix+"unknown")
+		if err != nil {
+			t.Fatalf("GetMeta failed: %v", err)
+		}
+		if !reflect.DeepEqual(meta, PageMeta{Visibility: visibilityPublic}) {
+			t.Errorf("Expected default metadata, got %+v", meta)
+		}
+	})
+
+	t.Run("round trip", func(t *testing.T) {
+		want := PageMeta{
+			Title:      "Landing",
+			Visibility: visibilityPrivate,
+			Tags:       []string{"marketing", "q3"},
+			Variants:   []string{"a", "b"},
+			SampleRate: 0.25,
+			Group:      "campaigns",
+			// Stored as Validate normalizes them
+			DedupeWindow: "1h0m0s",
+			BotFiltering: ModeEnforce,
+			TTL:          "48h0m0s",
+		}
+		if err := store.SetMeta(ctx, prefix+"landing", want); err != nil {
+			t.Fatalf("SetMeta failed: %v", err)
+		}
+		got, err := store.GetMeta(ctx, prefix+"landing")
+		if err != nil {
+			t.Fatalf("GetMeta failed: %v", err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("Expected %+v, got %+v", want, got)
+		}
+	})
+
+	t.Run("replace", func(t *testing.T) {
+		page := prefix + "replaced"
+		store.SetMeta(ctx, page, PageMeta{Title: "Old", Visibility: visibilityPrivate, Tags: []string{"x"}, SampleRate: 0.5, Group: "docs"})
+		if err := store.SetMeta(ctx, page, PageMeta{Visibility: visibilityPublic}); err != nil {
+			t.Fatalf("SetMeta failed: %v", err)
+		}
+		got, _ := store.GetMeta(ctx, page)
+		if !reflect.DeepEqual(got, PageMeta{Visibility: visibilityPublic}) {
+			t.Errorf("Expected old fields to be cleared, got %+v", got)
+		}
+	})
+
+	t.Run("unknown group", func(t *testing.T) {
+		page := prefix + "ungrouped"
+		if err := store.SetMeta(ctx, page, PageMeta{Visibility: visibilityPublic, Group: "nowhere"}); !errors.Is(err, errGroupNotFound) {
+			t.Fatalf("Expected errGroupNotFound, got %v", err)
+		}
+		if got, _ := store.GetMeta(ctx, page); !reflect.DeepEqual(got, PageMeta{Visibility: visibilityPublic}) {
+			t.Errorf("Expected nothing stored, got %+v", got)
+		}
+	})
+
+	t.Run("policy index", func(t *testing.T) {
+		page := prefix + "overriding"
+		store.SetMeta(ctx, page, PageMeta{Visibility: visibilityPublic, BotFiltering: ModeShadow})
+		if pages, err := redisClient.PolicyPages(ctx); err != nil || !pages[page] {
+			t.Errorf("Expected %s in the policy index, got %v, %v", page, pages, err)
+		}
+		store.SetMeta(ctx, page, PageMeta{Visibility: visibilityPublic, SampleRate: 0.5})
+		if pages, _ := redisClient.PolicyPages(ctx); pages[page] {
+			t.Errorf("Expected %s to leave the policy index", page)
+		}
+	})
+
+	t.Run("batch", func(t *testing.T) {
+		want := PageMeta{Title: "Batched", Visibility: visibilityPublic, Tags: []string{"a"}}
+		store.SetMeta(ctx, prefix+"batched", want)
+		got, err := store.GetMetas(ctx, []string{prefix + "unknown", prefix + "batched"})
+		if err != nil {
+			t.Fatalf("GetMetas failed: %v", err)
+		}
+		if !reflect.DeepEqual(got, []PageMeta{{Visibility: visibilityPublic}, want}) {
+			t.Errorf("Expected the pages' metadata in order, got %+v", got)
+		}
+	})
+
+	t.Run("private index", func(t *testing.T) {
+		page := prefix + "secret"
+		store.SetMeta(ctx, page, PageMeta{Visibility: visibilityPrivate})
+		private, err := store.PrivatePages(ctx)
+		if err != nil {
+			t.Fatalf("PrivatePages failed: %v", err)
+		}
+		if !private[page] {
+			t.Errorf("Expected %s to be private, got %v", page, private)
+		}
+
+		store.SetMeta(ctx, page, PageMeta{Visibility: visibilityPublic})
+		if private, _ = store.PrivatePages(ctx); private[page] {
+			t.Errorf("Expected %s to leave the private index", page)
+		}
+	})
+}
+
+func TestRedisMetadataStoreConformance(t *testing.T) {
+	_, redisClient := newTestRedis(t)
+	testMetadataStoreConformance(t, redisClient, NewRedisMetadataStore(redisClient), "")
+}
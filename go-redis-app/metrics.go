@@ -0,0 +1,325 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// unmatchedRoute labels requests that matched no route, so unknown paths
+// don't each get their own series
+const unmatchedRoute = "unmatched"
+
+// durationBuckets are the upper bounds, in seconds, of the request duration
+// histogram
+var durationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5}
+
+// routeKey identifies a route by method and Gin path template
+type routeKey struct {
+	Method string
+	Route  string
+}
+
+// routeStats are the accumulated measurements for one route
+type routeStats struct {
+	Statuses      map[int]int64
+	Requests      int64
+	DurationSum   float64
+	Buckets       []int64 // cumulative counts per durationBuckets entry
+	RequestBytes  int64
+	ResponseBytes int64
+}
+
+// Metrics accumulates per-route request counts, durations and sizes,
+// labelled by route template rather than raw path
+type Metrics struct {
+	clock Clock
+
+	mu         sync.Mutex
+	routes     map[routeKey]*routeStats
+	registered map[routeKey]*registeredRoute
+}
+
+// NewMetrics creates an empty metrics registry timing requests with clock
+func NewMetrics(clock Clock) *Metrics {
+	return &Metrics{
+		clock:      clock,
+		routes:     make(map[routeKey]*routeStats),
+		registered: make(map[routeKey]*registeredRoute),
+	}
+}
+
+// addRoutes records an engine's routes so /debug/routes lists them, with
+// their handlers, before they are first hit
+func (m *Metrics) addRoutes(routes []*registeredRoute) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, r := range routes {
+		m.registered[routeKey{Method: r.Method, Route: r.Path}] = r
+	}
+}
+
+// registeredRoute returns how a route was registered, or nil
+func (m *Metrics) registeredRoute(key routeKey) *registeredRoute {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.registered[key]
+}
+
+// observe records one request
+func (m *Metrics) observe(key routeKey, status int, duration time.Duration, requestBytes, responseBytes int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stats := m.routes[key]
+	if stats == nil {
+		stats = &routeStats{Statuses: make(map[int]int64), Buckets: make([]int64, len(durationBuckets))}
+		m.routes[key] = stats
+	}
+	seconds := duration.Seconds()
+	stats.Requests++
+	stats.Statuses[status]++
+	stats.DurationSum += seconds
+	for i, le := range durationBuckets {
+		if seconds <= le {
+			stats.Buckets[i]++
+		}
+	}
+	stats.RequestBytes += requestBytes
+	stats.ResponseBytes += responseBytes
+}
+
+// instrument is the middleware recording every request under its route
+// template, or under unmatchedRoute for 404s without a route
+func (m *Metrics) instrument(c *gin.Context) {
+	start := m.clock.Now()
+	c.Next()
+
+	route := c.FullPath()
+	if route == "" {
+		route = unmatchedRoute
+	}
+	method := c.Request.Method
+	if _, known := methodOrder[method]; !known {
+		method = "other"
+	}
+	m.observe(routeKey{Method: method, Route: route}, c.Writer.Status(), m.clock.Now().Sub(start),
+		max(c.Request.ContentLength, 0), int64(max(c.Writer.Size(), 0)))
+}
+
+// snapshot returns a copy of the stats, including registered routes that
+// have not been hit yet, sorted by route then method
+func (m *Metrics) snapshot() ([]routeKey, map[routeKey]routeStats) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stats := make(map[routeKey]routeStats, len(m.routes))
+	for key, s := range m.routes {
+		copied := *s
+		copied.Statuses = make(map[int]int64, len(s.Statuses))
+		for status, n := range s.Statuses {
+			copied.Statuses[status] = n
+		}
+		copied.Buckets = append([]int64(nil), s.Buckets...)
+		stats[key] = copied
+	}
+	for key := range m.registered {
+		if _, ok := stats[key]; !ok {
+			stats[key] = routeStats{Buckets: make([]int64, len(durationBuckets))}
+		}
+	}
+
+	keys := make([]routeKey, 0, len(stats))
+	for key := range stats {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Route != keys[j].Route {
+			return keys[i].Route < keys[j].Route
+		}
+		return methodOrder[keys[i].Method] < methodOrder[keys[j].Method]
+	})
+	return keys, stats
+}
+
+// handleMetrics writes the request metrics in the Prometheus text format
+func (s *Server) handleMetrics(c *gin.Context) {
+	keys, stats := s.metrics.snapshot()
+	var b strings.Builder
+
+	b.WriteString("# HELP http_requests_total Requests handled, by route template and status.\n")
+	b.WriteString("# TYPE http_requests_total counter\n")
+	for _, key := range keys {
+		st := stats[key]
+		statuses := make([]int, 0, len(st.Statuses))
+		for status := range st.Statuses {
+			statuses = append(statuses, status)
+		}
+		sort.Ints(statuses)
+		for _, status := range statuses {
+			fmt.Fprintf(&b, "http_requests_total{%s,status=\"%d\"} %d\n", metricLabels(s.cfg.EnvName, key), status, st.Statuses[status])
+		}
+	}
+
+	b.WriteString("# HELP http_request_duration_seconds Request duration, by route template.\n")
+	b.WriteString("# TYPE http_request_duration_seconds histogram\n")
+	for _, key := range keys {
+		st := stats[key]
+		labels := metricLabels(s.cfg.EnvName, key)
+		for i, le := range durationBuckets {
+			fmt.Fprintf(&b, "http_request_duration_seconds_bucket{%s,le=\"%s\"} %d\n", labels, strconv.FormatFloat(le, 'g', -1, 64), st.Buckets[i])
+		}
+		fmt.Fprintf(&b, "http_request_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", labels, st.Requests)
+		fmt.Fprintf(&b, "http_request_duration_seconds_sum{%s} %g\n", labels, st.DurationSum)
+		fmt.Fprintf(&b, "http_request_duration_seconds_count{%s} %d\n", labels, st.Requests)
+	}
+
+	for _, size := range []struct {
+		name, help string
+		value      func(routeStats) int64
+	}{
+		{"http_request_size_bytes", "Request body size", func(st routeStats) int64 { return st.RequestBytes }},
+		{"http_response_size_bytes", "Response body size", func(st routeStats) int64 { return st.ResponseBytes }},
+	} {
+		fmt.Fprintf(&b, "# HELP %s %s, by route template.\n", size.name, size.help)
+		fmt.Fprintf(&b, "# TYPE %s summary\n", size.name)
+		for _, key := range keys {
+			st := stats[key]
+			fmt.Fprintf(&b, "%s_sum{%s} %d\n", size.name, metricLabels(s.cfg.EnvName, key), size.value(st))
+			fmt.Fprintf(&b, "%s_count{%s} %d\n", size.name, metricLabels(s.cfg.EnvName, key), st.Requests)
+		}
+	}
+
+	s.shadow.write(&b, s.cfg.EnvName)
+	s.coalescer.write(&b, s.cfg.EnvName)
+	s.quotaMetrics.write(&b, s.cfg.EnvName)
+	s.skew.write(&b, s.cfg.EnvName)
+	s.inflight.write(&b, s.cfg.EnvName)
+	s.watchdog.write(&b, s.cfg.EnvName)
+	if s.canary != nil {
+		s.canary.write(&b, s.cfg.EnvName)
+	}
+	if s.shedder != nil {
+		s.shedder.write(&b, s.cfg.EnvName)
+	}
+	if s.cfg.CounterSampleInterval > 0 {
+		s.sampler.write(&b, s.cfg.EnvName)
+	}
+	if s.sinks != nil {
+		s.sinks.write(&b, s.cfg.EnvName)
+	}
+	if s.redis.retries != nil {
+		s.redis.retries.write(&b, s.cfg.EnvName)
+	}
+	if s.redis.prefix != nil {
+		s.redis.prefix.write(&b, s.cfg.EnvName)
+	}
+	if s.absent != nil {
+		s.absent.write(&b, s.cfg.EnvName)
+	}
+	if s.journal != nil {
+		s.journal.write(&b, s.cfg.EnvName)
+	}
+	if s.anomalies != nil {
+		s.anomalies.write(&b, s.cfg.EnvName)
+	}
+	if s.cfg.WriteConsistency == writeConsistencyReplicated {
+		s.replication.write(&b, s.cfg.EnvName)
+	}
+	if s.cfg.EventsBackend == eventsBackendStream {
+		s.writeEventGroupMetrics(c.Request.Context(), &b)
+	}
+
+	c.Data(http.StatusOK, "text/plain; version=0.0.4; charset=utf-8", []byte(b.String()))
+}
+
+// writeEventGroupMetrics writes the backlog of each consumer group on the
+// event stream. A Redis error only drops these series.
+func (s *Server) writeEventGroupMetrics(ctx context.Context, b *strings.Builder) {
+	lags, err := s.redis.EventGroupLags(ctx)
+	if err != nil {
+		log.Printf("Error getting consumer group lag: %v", err)
+		return
+	}
+	for _, series := range []struct {
+		name, help string
+		value      func(EventGroupLag) int64
+	}{
+		{"events_consumer_group_lag", "Events not yet delivered to the consumer group", func(g EventGroupLag) int64 { return g.Lag }},
+		{"events_consumer_group_pending", "Events delivered to the consumer group but not acknowledged", func(g EventGroupLag) int64 { return g.Pending }},
+	} {
+		fmt.Fprintf(b, "# HELP %s %s.\n", series.name, series.help)
+		fmt.Fprintf(b, "# TYPE %s gauge\n", series.name)
+		for _, g := range lags {
+			labels := "group=" + strconv.Quote(g.Group)
+			if s.cfg.EnvName != "" {
+				labels = "env=" + strconv.Quote(s.cfg.EnvName) + "," + labels
+			}
+			fmt.Fprintf(b, "%s{%s} %d\n", series.name, labels, series.value(g))
+		}
+	}
+}
+
+// metricLabels formats the labels of a series: the environment when one is
+// set, then method and route
+func metricLabels(env string, key routeKey) string {
+	labels := fmt.Sprintf("method=%s,route=%s", strconv.Quote(key.Method), strconv.Quote(key.Route))
+	if env != "" {
+		labels = "env=" + strconv.Quote(env) + "," + labels
+	}
+	return labels
+}
+
+// RouteInfo is one entry of the /debug/routes listing
+type RouteInfo struct {
+	Method        string           `json:"method"`
+	Route         string           `json:"route"`
+	Handler       string           `json:"handler,omitempty"`
+	Shadows       []string         `json:"shadows,omitempty"`
+	Requests      int64            `json:"requests"`
+	Statuses      map[string]int64 `json:"statuses"`
+	AvgDurationMs float64          `json:"avg_duration_ms"`
+	RequestBytes  int64            `json:"request_bytes"`
+	ResponseBytes int64            `json:"response_bytes"`
+}
+
+// RoutesResponse represents the /debug/routes API response
+type RoutesResponse struct {
+	Routes []RouteInfo `json:"routes"`
+}
+
+// handleDebugRoutes lists the registered routes with the handler serving
+// each, the parameterized routes a reserved route is matched ahead of, and
+// their accumulated counts, for inspection without Prometheus
+func (s *Server) handleDebugRoutes(c *gin.Context) {
+	keys, stats := s.metrics.snapshot()
+	response := RoutesResponse{Routes: make([]RouteInfo, 0, len(keys))}
+	for _, key := range keys {
+		st := stats[key]
+		info := RouteInfo{
+			Method:        key.Method,
+			Route:         key.Route,
+			Requests:      st.Requests,
+			Statuses:      make(map[string]int64, len(st.Statuses)),
+			RequestBytes:  st.RequestBytes,
+			ResponseBytes: st.ResponseBytes,
+		}
+		for status, n := range st.Statuses {
+			info.Statuses[strconv.Itoa(status)] = n
+		}
+		if route := s.metrics.registeredRoute(key); route != nil {
+			info.Handler, info.Shadows = route.Handler, route.Shadows
+		}
+		if st.Requests > 0 {
+			info.AvgDurationMs = st.DurationSum * 1000 / float64(st.Requests)
+		}
+		response.Routes = append(response.Routes, info)
+	}
+	respondJSON(c, http.StatusOK, response)
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestMetricsUseRouteTemplates(t *testing.T) {
+	_, redisClient := newTestRedis(t)
+	server := newTestServer(t, testConfig(), redisClient)
+	public, internal := server.PublicRouter(), server.InternalRouter()
+
+	doRequest(public, "GET", "/visit/home", "", nil)
+	doRequest(public, "GET", "/visit/about", "", nil)
+	doRequest(public, "GET", "/visits/home", "", nil)
+	doRequest(public, "GET", "/no/such/page", "", nil)
+	doRequest(public, "POST", "/goals", `{"name":"g","steps":["a"]}`, nil)
+
+	w := doRequest(internal, "GET", "/debug/routes", "", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", w.Code)
+	}
+	var resp RoutesResponse
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	byRoute := make(map[routeKey]RouteInfo)
+	for _, r := range resp.Routes {
+		byRoute[routeKey{Method: r.Method, Route: r.Route}] = r
+	}
+
+	if r := byRoute[routeKey{"GET", "/visit/:page"}]; r.Requests != 2 || r.Statuses["200"] != 2 || r.ResponseBytes == 0 {
+		t.Errorf("Expected 2 requests under /visit/:page with response bytes, got %+v", r)
+	}
+	if r := byRoute[routeKey{"GET", unmatchedRoute}]; r.Requests != 1 || r.Statuses["404"] != 1 {
+		t.Errorf("Expected the unknown path under %q, got %+v", unmatchedRoute, r)
+	}
+	if r := byRoute[routeKey{"POST", "/goals"}]; r.RequestBytes == 0 {
+		t.Errorf("Expected request bytes for POST /goals, got %+v", r)
+	}
+	if r, ok := byRoute[routeKey{"PUT", "/admin/flags"}]; !ok || r.Requests != 0 {
+		t.Errorf("Expected unhit registered routes to be listed with no requests, got %+v", r)
+	}
+	for key := range byRoute {
+		if strings.Contains(key.Route, "home") || strings.Contains(key.Route, "about") {
+			t.Errorf("Expected no raw paths as labels, got %q", key.Route)
+		}
+	}
+
+	body := doRequest(internal, "GET", "/metrics", "", nil).Body.String()
+	for _, want := range []string{
+		`http_requests_total{method="GET",route="/visit/:page",status="200"} 2`,
+		`http_requests_total{method="GET",route="unmatched",status="404"} 1`,
+		`http_request_duration_seconds_count{method="GET",route="/visit/:page"} 2`,
+		`http_response_size_bytes_sum{method="GET",route="/visit/:page"}`,
+		`http_request_size_bytes_sum{method="POST",route="/goals"}`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("Expected /metrics to contain %q", want)
+		}
+	}
+	if strings.Contains(body, "/visit/home") {
+		t.Error("Expected no raw paths in /metrics")
+	}
+}
@@ -0,0 +1,425 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// migrateCheckpointPrefix names the per-migration checkpoint hash, kept in
+	// the source database until the migration completes
+	migrateCheckpointPrefix = "migrate:checkpoint:"
+
+	// defaultMigrateBatch is how many keys are copied per round trip
+	defaultMigrateBatch = 500
+
+	// migrateLockTTL bounds how long a migration holds the maintenance lock
+	migrateLockTTL = time.Hour
+)
+
+// Migration phases recorded in the checkpoint
+const (
+	phaseCopy   = "copy"
+	phaseDelete = "delete"
+)
+
+// MigrateOptions selects the keys to migrate and where they go
+type MigrateOptions struct {
+	SourcePrefix string `json:"source_prefix"`
+	SourceDB     int    `json:"source_db"`
+	TargetPrefix string `json:"target_prefix"`
+	TargetDB     int    `json:"target_db"`
+	BatchSize    int64  `json:"batch_size"`
+	DeleteSource bool   `json:"delete_source"`
+	DryRun       bool   `json:"dry_run"`
+}
+
+// Validate rejects migrations that are empty, out of range or would copy
+// keys into the range they are read from
+func (o MigrateOptions) Validate() error {
+	if o.SourcePrefix == "" {
+		return errors.New("source prefix must not be empty")
+	}
+	if strings.HasPrefix(migrateCheckpointPrefix, o.SourcePrefix) || strings.HasPrefix(o.SourcePrefix, migrateCheckpointPrefix) {
+		return fmt.Errorf("source prefix must not cover the %s checkpoints", migrateCheckpointPrefix)
+	}
+	for _, db := range []int{o.SourceDB, o.TargetDB} {
+		if db < 0 || db > maxRedisDB {
+			return fmt.Errorf("databases must be 0 to %d", maxRedisDB)
+		}
+	}
+	if o.BatchSize < 0 || o.BatchSize > 10000 {
+		return errors.New("batch size must be 1 to 10000")
+	}
+	if o.SourceDB == o.TargetDB &&
+		(strings.HasPrefix(o.SourcePrefix, o.TargetPrefix) || strings.HasPrefix(o.TargetPrefix, o.SourcePrefix)) {
+		return errors.New("within one database the source and target prefixes must not overlap")
+	}
+	return nil
+}
+
+// targetKey maps a source key to its name under the target prefix
+func (o MigrateOptions) targetKey(key string) string {
+	return o.TargetPrefix + strings.TrimPrefix(key, o.SourcePrefix)
+}
+
+// checkpointKey names the checkpoint of this migration
+func (o MigrateOptions) checkpointKey() string {
+	return fmt.Sprintf("%s%d:%s:%d:%s", migrateCheckpointPrefix, o.SourceDB, o.SourcePrefix, o.TargetDB, o.TargetPrefix)
+}
+
+// MigrateReport summarizes a migration; counts include the work done by
+// earlier runs that were resumed
+type MigrateReport struct {
+	Scanned int64 `json:"scanned"`
+	Copied  int64 `json:"copied"`
+	Expired int64 `json:"expired"`
+	Deleted int64 `json:"deleted"`
+	Resumed bool  `json:"resumed"`
+	DryRun  bool  `json:"dry_run"`
+}
+
+// migration is one run of MigrateKeys
+type migration struct {
+	opts           MigrateOptions
+	source, target *redis.Client
+	report         MigrateReport
+
+	// copyMode is set once DUMP is found to be unavailable; keys are then
+	// copied server-side with COPY, which also keeps their TTLs
+	copyMode bool
+}
+
+// withDB returns a client for another logical database of the same server;
+// close it when done
+func (r *RedisClient) withDB(db int) *redis.Client {
+	opts := *r.client.Options()
+	opts.DB = db
+	rdb := redis.NewClient(&opts)
+	rdb.AddHook(errorHook{})
+	return rdb
+}
+
+// MigrateKeys copies every key under the source prefix and database to the
+// target prefix and database with DUMP/RESTORE, keeping TTLs. Progress is
+// checkpointed after each batch, so an interrupted migration resumes where it
+// stopped when run again with the same options. With DeleteSource the source
+// keys are deleted only once every key has been copied. A dry run only counts
+// the keys it would copy. Strict mode refuses all but dry runs, as keys are
+// copied between databases a batch at a time.
+func (r *RedisClient) MigrateKeys(ctx context.Context, opts MigrateOptions) (MigrateReport, error) {
+	if err := opts.Validate(); err != nil {
+		return MigrateReport{}, err
+	}
+	if r.strict && !opts.DryRun {
+		return MigrateReport{}, errNotAtomic
+	}
+	if opts.BatchSize == 0 {
+		opts.BatchSize = defaultMigrateBatch
+	}
+	m := &migration{
+		opts:   opts,
+		source: r.withDB(opts.SourceDB),
+		target: r.withDB(opts.TargetDB),
+		report: MigrateReport{DryRun: opts.DryRun},
+	}
+	defer m.source.Close()
+	defer m.target.Close()
+
+	phase, cursor, err := m.loadCheckpoint(ctx)
+	if err != nil {
+		return MigrateReport{}, err
+	}
+	if phase == phaseCopy {
+		if err := m.copyKeys(ctx, cursor); err != nil {
+			return m.report, err
+		}
+	}
+	if opts.DeleteSource && !opts.DryRun {
+		if err := m.saveCheckpoint(ctx, phaseDelete, 0); err != nil {
+			return m.report, err
+		}
+		if err := m.deleteKeys(ctx); err != nil {
+			return m.report, err
+		}
+	}
+	if !opts.DryRun {
+		if err := m.source.Del(ctx, opts.checkpointKey()).Err(); err != nil {
+			return m.report, err
+		}
+	}
+	log.Printf("Migration %s(db %d) -> %s(db %d) done: %d scanned, %d copied, %d expired, %d deleted",
+		opts.SourcePrefix, opts.SourceDB, opts.TargetPrefix, opts.TargetDB,
+		m.report.Scanned, m.report.Copied, m.report.Expired, m.report.Deleted)
+	return m.report, nil
+}
+
+// loadCheckpoint returns the phase and SCAN cursor to resume from, restoring
+// the counts of the earlier runs. Dry runs always start over.
+func (m *migration) loadCheckpoint(ctx context.Context) (string, uint64, error) {
+	if m.opts.DryRun {
+		return phaseCopy, 0, nil
+	}
+	values, err := m.source.HGetAll(ctx, m.opts.checkpointKey()).Result()
+	if err != nil || len(values) == 0 {
+		return phaseCopy, 0, err
+	}
+	cursor, _ := strconv.ParseUint(values["cursor"], 10, 64)
+	m.report.Scanned, _ = strconv.ParseInt(values["scanned"], 10, 64)
+	m.report.Copied, _ = strconv.ParseInt(values["copied"], 10, 64)
+	m.report.Expired, _ = strconv.ParseInt(values["expired"], 10, 64)
+	m.report.Resumed = true
+	log.Printf("Resuming migration from %s cursor %d after %d keys", values["phase"], cursor, m.report.Scanned)
+	if values["phase"] == phaseDelete {
+		return phaseDelete, 0, nil
+	}
+	return phaseCopy, cursor, nil
+}
+
+// saveCheckpoint records the phase, cursor and counts reached so far
+func (m *migration) saveCheckpoint(ctx context.Context, phase string, cursor uint64) error {
+	return m.source.HSet(ctx, m.opts.checkpointKey(),
+		"phase", phase,
+		"cursor", cursor,
+		"scanned", m.report.Scanned,
+		"copied", m.report.Copied,
+		"expired", m.report.Expired,
+	).Err()
+}
+
+// copyKeys scans the source prefix from cursor, copying each batch and
+// checkpointing the cursor after it. Keys copied again after a resume are
+// replaced, so repeating a batch is harmless.
+func (m *migration) copyKeys(ctx context.Context, cursor uint64) error {
+	pattern := escapeGlob(m.opts.SourcePrefix) + "*"
+	for {
+		keys, next, err := m.source.Scan(ctx, cursor, pattern, m.opts.BatchSize).Result()
+		if err != nil {
+			return err
+		}
+		m.report.Scanned += int64(len(keys))
+		if m.opts.DryRun {
+			m.report.Copied += int64(len(keys))
+		} else if len(keys) > 0 {
+			if err := m.copyBatch(ctx, keys); err != nil {
+				return err
+			}
+			if err := m.saveCheckpoint(ctx, phaseCopy, next); err != nil {
+				return err
+			}
+			log.Printf("Migration progress: %d keys scanned, %d copied", m.report.Scanned, m.report.Copied)
+		}
+		if cursor = next; cursor == 0 {
+			return nil
+		}
+	}
+}
+
+// copyBatch copies keys to the target, falling back to COPY when the server
+// refuses DUMP
+func (m *migration) copyBatch(ctx context.Context, keys []string) error {
+	if !m.copyMode {
+		err := m.restoreBatch(ctx, keys)
+		if err == nil || !strings.Contains(strings.ToLower(err.Error()), "unknown command") {
+			return err
+		}
+		log.Printf("DUMP is unavailable, copying keys server-side: %v", err)
+		m.copyMode = true
+	}
+
+	pipe := m.source.Pipeline()
+	copies := make([]*redis.IntCmd, len(keys))
+	for i, key := range keys {
+		copies[i] = pipe.Copy(ctx, key, m.opts.targetKey(key), m.opts.TargetDB, true)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return err
+	}
+	for _, cmd := range copies {
+		if cmd.Val() == 1 {
+			m.report.Copied++
+		} else {
+			m.report.Expired++
+		}
+	}
+	return nil
+}
+
+// restoreBatch dumps keys with their remaining TTLs and restores them under
+// the target prefix, replacing keys copied by an earlier run
+func (m *migration) restoreBatch(ctx context.Context, keys []string) error {
+	pipe := m.source.Pipeline()
+	dumps := make([]*redis.StringCmd, len(keys))
+	ttls := make([]*redis.DurationCmd, len(keys))
+	for i, key := range keys {
+		dumps[i] = pipe.Dump(ctx, key)
+		ttls[i] = pipe.PTTL(ctx, key)
+	}
+	if _, err := pipe.Exec(ctx); ignoreMissing(err) != nil {
+		return err
+	}
+
+	restore := m.target.Pipeline()
+	for i, key := range keys {
+		dump, err := dumps[i].Result()
+		if isMissing(err) {
+			// Expired or deleted since the SCAN
+			m.report.Expired++
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		ttl := ttls[i].Val()
+		if ttl < 0 {
+			ttl = 0
+		}
+		restore.RestoreReplace(ctx, m.opts.targetKey(key), ttl, dump)
+		m.report.Copied++
+	}
+	_, err := restore.Exec(ctx)
+	return err
+}
+
+// deleteKeys deletes the source keys. A SCAN only promises to return keys
+// present for the whole scan, so passes repeat until one finds nothing left.
+func (m *migration) deleteKeys(ctx context.Context) error {
+	pattern := escapeGlob(m.opts.SourcePrefix) + "*"
+	for {
+		var deleted int64
+		var cursor uint64
+		for {
+			keys, next, err := m.source.Scan(ctx, cursor, pattern, m.opts.BatchSize).Result()
+			if err != nil {
+				return err
+			}
+			if len(keys) > 0 {
+				n, err := m.source.Del(ctx, keys...).Result()
+				if err != nil {
+					return err
+				}
+				deleted += n
+				m.report.Deleted += n
+				log.Printf("Migration progress: %d source keys deleted", m.report.Deleted)
+			}
+			if cursor = next; cursor == 0 {
+				break
+			}
+		}
+		if deleted == 0 {
+			return nil
+		}
+	}
+}
+
+// runMigration runs a migration under the maintenance lock, returning ok=false
+// when another replica holds it
+func (s *Server) runMigration(ctx context.Context, opts MigrateOptions) (MigrateReport, bool, error) {
+	release, ok, err := s.redis.AcquireMaintenanceLock(ctx, migrateLockTTL)
+	if err != nil || !ok {
+		return MigrateReport{}, false, err
+	}
+	defer release()
+	report, err := s.redis.MigrateKeys(ctx, opts)
+	return report, true, err
+}
+
+// handleMigrate migrates keys between prefixes or databases
+func (s *Server) handleMigrate(c *gin.Context) {
+	var opts MigrateOptions
+	if err := c.ShouldBindJSON(&opts); err != nil {
+		respondError(c, http.StatusBadRequest, "invalid_request", "Invalid JSON body: "+err.Error())
+		return
+	}
+	if err := opts.Validate(); err != nil {
+		respondError(c, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+
+	report, ok, err := s.runMigration(c.Request.Context(), opts)
+	if respondNotAtomic(c, err) {
+		return
+	}
+	if err != nil {
+		log.Printf("Error migrating keys: %v", err)
+		respondStoreError(c, err, "Failed to migrate keys; run again to resume")
+		return
+	}
+	if !ok {
+		respondError(c, http.StatusConflict, "conflict", "Maintenance is already running on another replica")
+		return
+	}
+	if !opts.DryRun {
+		s.invalidateAggregates(c.Request.Context())
+	}
+	c.JSON(http.StatusOK, report)
+}
+
+// parseMigrateFlags reads the options of the migrate subcommand
+func parseMigrateFlags(args []string, output io.Writer) (MigrateOptions, error) {
+	var opts MigrateOptions
+	fs := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	fs.SetOutput(output)
+	fs.StringVar(&opts.SourcePrefix, "source-prefix", "visits:", "prefix of the keys to migrate")
+	fs.IntVar(&opts.SourceDB, "source-db", 0, "database to migrate from")
+	fs.StringVar(&opts.TargetPrefix, "target-prefix", "", "prefix the keys are migrated to")
+	fs.IntVar(&opts.TargetDB, "target-db", 0, "database to migrate to")
+	fs.Int64Var(&opts.BatchSize, "batch-size", defaultMigrateBatch, "keys copied per round trip")
+	fs.BoolVar(&opts.DeleteSource, "delete-source", false, "delete the source keys once every key is copied")
+	fs.BoolVar(&opts.DryRun, "dry-run", false, "count the keys without copying them")
+	if err := fs.Parse(args); err != nil {
+		return MigrateOptions{}, err
+	}
+	if fs.NArg() > 0 {
+		return MigrateOptions{}, fmt.Errorf("unexpected arguments: %s", strings.Join(fs.Args(), " "))
+	}
+	return opts, opts.Validate()
+}
+
+// runMigrateCommand is the migrate subcommand: it migrates keys on the
+// configured Redis server, or with --status or --to the schema, and exits
+func runMigrateCommand(cfg Config, args []string, output io.Writer) error {
+	if isSchemaCommand(args) {
+		return runSchemaCommand(cfg, args, output)
+	}
+	opts, err := parseMigrateFlags(args, output)
+	if err != nil {
+		return err
+	}
+	redisClient := NewRedisClientFromConfig(cfg)
+	defer redisClient.client.Close()
+
+	// An interrupted migration resumes from its checkpoint on the next run
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	release, ok, err := redisClient.AcquireMaintenanceLock(ctx, migrateLockTTL)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errors.New("maintenance is already running; try again later")
+	}
+	defer release()
+
+	report, err := redisClient.MigrateKeys(ctx, opts)
+	if err != nil {
+		return fmt.Errorf("%w (run again to resume)", err)
+	}
+	fmt.Fprintf(output, "scanned %d, copied %d, expired %d, deleted %d (dry run %t, resumed %t)\n",
+		report.Scanned, report.Copied, report.Expired, report.Deleted, report.DryRun, report.Resumed)
+	return nil
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/alicebob/miniredis/v2/server"
+)
+
+// seedMigration writes n counters under visits: in DB 0, every tenth with a
+// TTL, plus a key outside the prefix
+func seedMigration(t *testing.T, mr *miniredis.Miniredis, n int) {
+	t.Helper()
+	db := mr.DB(0)
+	for i := 0; i < n; i++ {
+		key := fmt.Sprintf("visits:page-%04d", i)
+		db.Set(key, fmt.Sprint(i))
+		if i%10 == 0 {
+			db.SetTTL(key, time.Duration(i+1)*time.Minute)
+		}
+	}
+	db.Set("other:key", "x")
+}
+
+func TestMigrateKeysBetweenDatabases(t *testing.T) {
+	mr, redisClient := newTestRedis(t)
+	seedMigration(t, mr, 3000)
+
+	opts := MigrateOptions{SourcePrefix: "visits:", TargetPrefix: "app:visits:", TargetDB: 1, BatchSize: 250}
+	report, err := redisClient.MigrateKeys(context.Background(), opts)
+	if err != nil {
+		t.Fatalf("Migration failed: %v", err)
+	}
+	if report != (MigrateReport{Scanned: 3000, Copied: 3000}) {
+		t.Errorf("Unexpected report %+v", report)
+	}
+
+	target := mr.DB(1)
+	if got := len(target.Keys()); got != 3000 {
+		t.Errorf("Expected 3000 keys in DB 1, got %d", got)
+	}
+	for _, i := range []int{0, 7, 1230, 2999} {
+		want := fmt.Sprint(i)
+		if got, _ := target.Get(fmt.Sprintf("app:visits:page-%04d", i)); got != want {
+			t.Errorf("Expected page-%04d = %s in DB 1, got %q", i, want, got)
+		}
+	}
+	if got := target.TTL("app:visits:page-1230"); got != 1231*time.Minute {
+		t.Errorf("Expected the TTL to be preserved, got %s", got)
+	}
+	if got := target.TTL("app:visits:page-0007"); got != 0 {
+		t.Errorf("Expected keys without a TTL to stay persistent, got %s", got)
+	}
+	if got := len(mr.DB(0).Keys()); got != 3001 {
+		t.Errorf("Expected the source keys to be kept, got %d keys", got)
+	}
+	if mr.DB(0).Exists(opts.checkpointKey()) {
+		t.Error("Expected the checkpoint to be removed when done")
+	}
+}
+
+func TestMigrateKeysDeleteSourceAndDryRun(t *testing.T) {
+	mr, redisClient := newTestRedis(t)
+	seedMigration(t, mr, 1200)
+	ctx := context.Background()
+
+	dry, err := redisClient.MigrateKeys(ctx, MigrateOptions{SourcePrefix: "visits:", TargetPrefix: "visits:", TargetDB: 2, DeleteSource: true, DryRun: true})
+	if err != nil || dry != (MigrateReport{Scanned: 1200, Copied: 1200, DryRun: true}) {
+		t.Fatalf("Unexpected dry run %+v, %v", dry, err)
+	}
+	if got := len(mr.DB(2).Keys()); got != 0 || len(mr.DB(0).Keys()) != 1201 {
+		t.Fatalf("Expected a dry run to write nothing, got %d target keys", got)
+	}
+
+	report, err := redisClient.MigrateKeys(ctx, MigrateOptions{SourcePrefix: "visits:", TargetPrefix: "visits:", TargetDB: 2, BatchSize: 100, DeleteSource: true})
+	if err != nil {
+		t.Fatalf("Migration failed: %v", err)
+	}
+	if report.Copied != 1200 || report.Deleted != 1200 {
+		t.Errorf("Expected 1200 keys copied and deleted, got %+v", report)
+	}
+	if keys := mr.DB(0).Keys(); len(keys) != 1 || keys[0] != "other:key" {
+		t.Errorf("Expected only keys outside the prefix to remain, got %d keys", len(keys))
+	}
+	if got := len(mr.DB(2).Keys()); got != 1200 {
+		t.Errorf("Expected 1200 keys in DB 2, got %d", got)
+	}
+}
+
+func TestMigrateKeysResumesFromCheckpoint(t *testing.T) {
+	mr, redisClient := newTestRedis(t)
+	seedMigration(t, mr, 2000)
+	opts := MigrateOptions{SourcePrefix: "visits:", TargetPrefix: "v2:", BatchSize: 500}
+
+	// An earlier run copied the first 1000 keys and stopped
+	mr.DB(0).HSet(opts.checkpointKey(), "phase", phaseCopy, "cursor", "1000", "scanned", "1000", "copied", "1000", "expired", "0")
+	report, err := redisClient.MigrateKeys(context.Background(), opts)
+	if err != nil {
+		t.Fatalf("Migration failed: %v", err)
+	}
+	if report != (MigrateReport{Scanned: 2000, Copied: 2000, Resumed: true}) {
+		t.Errorf("Unexpected report %+v", report)
+	}
+	if mr.Exists("v2:page-0999") || !mr.Exists("v2:page-1000") || !mr.Exists("v2:page-1999") {
+		t.Error("Expected only the keys after the checkpoint to be copied")
+	}
+
+	// Running again starts a fresh migration, replacing the copies
+	again, err := redisClient.MigrateKeys(context.Background(), opts)
+	if err != nil || again.Resumed || again.Copied != 2000 {
+		t.Errorf("Expected a rerun to copy everything again, got %+v, %v", again, err)
+	}
+	if got, _ := mr.Get("v2:page-1500"); got != "1500" {
+		t.Errorf("Expected v2:page-1500 = 1500, got %q", got)
+	}
+}
+
+// registerDumpRestore serves DUMP and RESTORE, which miniredis lacks, for
+// string keys: the payload is the value itself. It returns the number of
+// DUMPs served.
+func registerDumpRestore(mr *miniredis.Miniredis) *atomic.Int64 {
+	var dumps atomic.Int64
+	mr.Server().Register("DUMP", func(c *server.Peer, _ string, args []string) {
+		dumps.Add(1)
+		mr.Server().Dispatch(c, []string{"GET", args[0]})
+	})
+	mr.Server().Register("RESTORE", func(c *server.Peer, _ string, args []string) {
+		set := []string{"SET", args[0], args[2]}
+		if args[1] != "0" {
+			set = append(set, "PX", args[1])
+		}
+		mr.Server().Dispatch(c, set)
+	})
+	return &dumps
+}
+
+func TestMigrateKeysWithDumpRestore(t *testing.T) {
+	mr, redisClient := newTestRedis(t)
+	dumps := registerDumpRestore(mr)
+	seedMigration(t, mr, 300)
+	// Glob characters in the prefix match only themselves
+	mr.DB(0).Set("visits*:page-0001", "glob")
+
+	opts := MigrateOptions{SourcePrefix: "visits:", TargetPrefix: "app:", TargetDB: 1, BatchSize: 100}
+	report, err := redisClient.MigrateKeys(context.Background(), opts)
+	if err != nil {
+		t.Fatalf("Migration failed: %v", err)
+	}
+	if report != (MigrateReport{Scanned: 300, Copied: 300}) || dumps.Load() != 300 {
+		t.Errorf("Expected 300 keys copied with DUMP, got %+v after %d DUMPs", report, dumps.Load())
+	}
+	target := mr.DB(1)
+	if got, _ := target.Get("app:page-0123"); got != "123" {
+		t.Errorf("Expected app:page-0123 = 123, got %q", got)
+	}
+	if got := target.TTL("app:page-0120"); got != 121*time.Minute {
+		t.Errorf("Expected the TTL restored, got %s", got)
+	}
+	if got := target.TTL("app:page-0123"); got != 0 {
+		t.Errorf("Expected keys without a TTL restored persistent, got %s", got)
+	}
+
+	globbed, err := redisClient.MigrateKeys(context.Background(), MigrateOptions{SourcePrefix: "visits*:", TargetPrefix: "glob:", TargetDB: 2})
+	if err != nil || globbed.Copied != 1 || !mr.DB(2).Exists("glob:page-0001") {
+		t.Errorf("Expected only the key under the literal prefix copied, got %+v, %v", globbed, err)
+	}
+}
+
+func TestMigrateOptionsValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		opts MigrateOptions
+		ok   bool
+	}{
+		{"prefix rename", MigrateOptions{SourcePrefix: "visits:", TargetPrefix: "app:"}, true},
+		{"same prefix other db", MigrateOptions{SourcePrefix: "visits:", TargetPrefix: "visits:", TargetDB: 3}, true},
+		{"no source prefix", MigrateOptions{TargetPrefix: "app:", TargetDB: 1}, false},
+		{"same prefix and db", MigrateOptions{SourcePrefix: "visits:", TargetPrefix: "visits:"}, false},
+		{"target inside source", MigrateOptions{SourcePrefix: "visits:", TargetPrefix: "visits:v2:"}, false},
+		{"db out of range", MigrateOptions{SourcePrefix: "visits:", TargetPrefix: "visits:", TargetDB: 16}, false},
+		{"checkpoints", MigrateOptions{SourcePrefix: "migrate:", TargetPrefix: "x:"}, false},
+		{"huge batch", MigrateOptions{SourcePrefix: "visits:", TargetPrefix: "app:", BatchSize: 20000}, false},
+	}
+	for _, tt := range tests {
+		if err := tt.opts.Validate(); (err == nil) != tt.ok {
+			t.Errorf("%s: expected ok=%t, got %v", tt.name, tt.ok, err)
+		}
+	}
+}
+
+func TestParseMigrateFlags(t *testing.T) {
+	opts, err := parseMigrateFlags([]string{"--target-prefix", "app:", "--target-db", "1", "--delete-source", "--dry-run"}, io.Discard)
+	if err != nil {
+		t.Fatalf("Failed to parse flags: %v", err)
+	}
+	want := MigrateOptions{SourcePrefix: "visits:", TargetPrefix: "app:", TargetDB: 1, BatchSize: defaultMigrateBatch, DeleteSource: true, DryRun: true}
+	if opts != want {
+		t.Errorf("Expected %+v, got %+v", want, opts)
+	}
+	if _, err := parseMigrateFlags([]string{"--target-db", "1"}, io.Discard); err != nil {
+		t.Errorf("Expected a same-prefix migration to another DB to be valid, got %v", err)
+	}
+	if _, err := parseMigrateFlags([]string{}, io.Discard); err == nil {
+		t.Error("Expected a migration onto itself to be rejected")
+	}
+	if _, err := parseMigrateFlags([]string{"--target-db", "1", "extra"}, io.Discard); err == nil {
+		t.Error("Expected stray arguments to be rejected")
+	}
+}
+
+func TestMigrateEndpoint(t *testing.T) {
+	mr, redisClient := newTestRedis(t)
+	router := newTestServer(t, testConfig(), redisClient).Router()
+	doRequest(router, "GET", "/visit/home", "", nil)
+
+	w := doRequest(router, "POST", "/admin/migrate", `{"source_prefix": "visits:", "target_prefix": "visits:"}`, nil)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a migration onto itself, got %d", w.Code)
+	}
+
+	w = doRequest(router, "POST", "/admin/migrate", `{"source_prefix": "visits:", "target_prefix": "visits:", "target_db": 1}`, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var report MigrateReport
+	json.Unmarshal(w.Body.Bytes(), &report)
+	if report.Copied == 0 || report.Copied != report.Scanned {
+		t.Errorf("Expected every scanned key to be copied, got %+v", report)
+	}
+	if got, _ := mr.DB(1).Get("visits:home"); got != "1" {
+		t.Errorf("Expected visits:home = 1 in DB 1, got %q", got)
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// absentEntry is a page name read without visits and when that was seen
+type absentEntry struct {
+	page string
+	at   time.Time
+}
+
+// AbsentPages is a negative cache of page names recently read with no
+// visits, so GET /visits/:page for names bots probe at random is answered
+// without reading their counts. It is an LRU bounded to capacity names, each
+// trusted for ttl after the read that confirmed it. A visit creating the
+// page forgets it here, and on the other replicas through the page.created
+// event.
+type AbsentPages struct {
+	ttl      time.Duration
+	capacity int
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	// order holds the most recently used names at the front
+	order *list.List
+
+	hits   atomic.Int64
+	misses atomic.Int64
+}
+
+// newAbsentPages creates a negative cache of capacity names, or nil when
+// ttl is 0, disabling it
+func newAbsentPages(ttl time.Duration, capacity int) *AbsentPages {
+	if ttl <= 0 {
+		return nil
+	}
+	return &AbsentPages{ttl: ttl, capacity: capacity, entries: make(map[string]*list.Element), order: list.New()}
+}
+
+// absent reports whether the page was confirmed to have no visits within
+// the TTL before now, counting the lookup as a hit or a miss
+func (a *AbsentPages) absent(page string, now time.Time) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	elem, ok := a.entries[page]
+	if ok && now.Sub(elem.Value.(*absentEntry).at) >= a.ttl {
+		a.remove(elem)
+		ok = false
+	}
+	if !ok {
+		a.misses.Add(1)
+		return false
+	}
+	a.order.MoveToFront(elem)
+	a.hits.Add(1)
+	return true
+}
+
+// add remembers that the page had no visits at now, evicting the least
+// recently used name when full
+func (a *AbsentPages) add(page string, now time.Time) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if elem, ok := a.entries[page]; ok {
+		elem.Value.(*absentEntry).at = now
+		a.order.MoveToFront(elem)
+		return
+	}
+	if a.order.Len() >= a.capacity {
+		a.remove(a.order.Back())
+	}
+	a.entries[page] = a.order.PushFront(&absentEntry{page: page, at: now})
+}
+
+// forget drops the page, once a visit has created it
+func (a *AbsentPages) forget(page string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if elem, ok := a.entries[page]; ok {
+		a.remove(elem)
+	}
+}
+
+// clear drops every name, when pages may have been created without an
+// event reaching us
+func (a *AbsentPages) clear() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.entries = make(map[string]*list.Element)
+	a.order.Init()
+}
+
+// remove drops an entry; the caller holds mu
+func (a *AbsentPages) remove(elem *list.Element) {
+	delete(a.entries, elem.Value.(*absentEntry).page)
+	a.order.Remove(elem)
+}
+
+// len returns the number of names held
+func (a *AbsentPages) len() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.order.Len()
+}
+
+// write writes the negative cache series
+func (a *AbsentPages) write(b *strings.Builder, env string) {
+	prefix, labels := "", ""
+	if env != "" {
+		prefix = "env=" + strconv.Quote(env) + ","
+		labels = "{env=" + strconv.Quote(env) + "}"
+	}
+	b.WriteString("# HELP negative_cache_lookups_total GET /visits/:page lookups in the negative cache, by whether the page was known to have no visits.\n")
+	b.WriteString("# TYPE negative_cache_lookups_total counter\n")
+	fmt.Fprintf(b, "negative_cache_lookups_total{%sresult=\"hit\"} %d\n", prefix, a.hits.Load())
+	fmt.Fprintf(b, "negative_cache_lookups_total{%sresult=\"miss\"} %d\n", prefix, a.misses.Load())
+	b.WriteString("# HELP negative_cache_entries Page names held in the negative cache.\n")
+	b.WriteString("# TYPE negative_cache_entries gauge\n")
+	fmt.Fprintf(b, "negative_cache_entries%s %d\n", labels, a.len())
+}
+
+// rememberAbsent adds the page of a GET /visits/:page response to the
+// negative cache when it has no visits. Approximate pages are counted
+// elsewhere, and a caller who may read private pages skipped the visibility
+// check a cached answer would skip for everyone.
+func (s *Server) rememberAbsent(c *gin.Context, response VisitResponse) {
+	if s.absent == nil || canReadPrivate(c) || s.isApproximatePage(response.Page) {
+		return
+	}
+	if response.Visits != 0 || response.Sessions != 0 || response.WeightedVisits != nil || response.Rank != nil ||
+		(response.Unique != nil && *response.Unique != 0) {
+		return
+	}
+	s.absent.add(response.Page, s.clock.Now())
+}
+
+// respondAbsentPage answers GET /visits/:page for a page in the negative
+// cache, with the counts it was read with
+func (s *Server) respondAbsentPage(c *gin.Context, page string, view visitView) {
+	response := VisitResponse{
+		Page:         page,
+		ResolvedFrom: c.GetString(resolvedFromKey),
+		Timestamp:    stamp(c, s.clock.Now()),
+		view:         view,
+	}
+	if view.unique {
+		var unique int64
+		response.Unique = &unique
+	}
+	respondJSON(c, http.StatusOK, response)
+}
+
+// watchCreatedPages forgets the pages other replicas create, as their
+// page.created events arrive. The first subscription is confirmed before it
+// returns. Whenever the subscription is lost the whole cache is cleared, as
+// a non-resumable bus drops the events published in between.
+func (s *Server) watchCreatedPages(ctx context.Context) error {
+	events, err := s.events.Subscribe(ctx, "")
+	if err != nil {
+		return err
+	}
+	go func() {
+		after := ""
+		for {
+			for event := range events {
+				after = event.ID
+				if event.Type == eventPageCreated {
+					s.absent.forget(event.Page)
+				}
+			}
+			if ctx.Err() != nil {
+				return
+			}
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(time.Second):
+				}
+				var err error
+				if events, err = s.events.Subscribe(ctx, after); err == nil {
+					break
+				}
+				log.Printf("Failed to resubscribe to page events for the negative cache: %v", err)
+			}
+			if !s.events.Resumable() || after == "" {
+				s.absent.clear()
+			}
+		}
+	}()
+	return nil
+}
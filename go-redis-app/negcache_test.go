@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"go-redis-app/internal/clocktest"
+)
+
+func TestAbsentPagesLRU(t *testing.T) {
+	if newAbsentPages(0, 10) != nil {
+		t.Fatal("Expected no negative cache with a TTL of 0")
+	}
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	absent := newAbsentPages(time.Minute, 2)
+	absent.add("a", now)
+	absent.add("b", now)
+	// Reading a makes b the least recently used
+	if !absent.absent("a", now) {
+		t.Fatal("Expected a cached")
+	}
+	absent.add("c", now)
+	if absent.absent("b", now) || !absent.absent("a", now) || !absent.absent("c", now) {
+		t.Errorf("Expected b evicted, a and c kept")
+	}
+	if absent.absent("a", now.Add(time.Minute)) || absent.len() != 1 {
+		t.Errorf("Expected a expired after the TTL, %d left", absent.len())
+	}
+	absent.forget("c")
+	if absent.absent("c", now) || absent.len() != 0 {
+		t.Errorf("Expected c forgotten")
+	}
+	if absent.hits.Load() != 3 || absent.misses.Load() != 3 {
+		t.Errorf("Expected 3 hits and 3 misses, got %d and %d", absent.hits.Load(), absent.misses.Load())
+	}
+}
+
+func TestNegativeCacheSkipsRedis(t *testing.T) {
+	_, redisClient := newTestRedis(t)
+	cfg := testConfig()
+	cfg.DebugHeaders = true
+	cfg.NegativeCacheTTL = time.Minute
+	cfg.NegativeCacheSize = 100
+	clock := clocktest.New(time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC))
+	router := newTestServerWithClock(t, cfg, redisClient, clock).Router()
+
+	first := doRequest(router, "GET", "/visits/wp-login?include=unique", "", nil)
+	hit := doRequest(router, "GET", "/visits/wp-login?include=unique", "", nil)
+	if first.Body.String() != hit.Body.String() {
+		t.Errorf("Expected the cached answer unchanged, got %s then %s", first.Body.String(), hit.Body.String())
+	}
+	// The archived pages and metadata are still read, the counts not
+	if got := hit.Header().Get(redisOpsHeader); !strings.HasPrefix(got, "commands=2;") {
+		t.Errorf("Expected the hit to skip the page's reads, got %q", got)
+	}
+
+	// A local visit forgets the page at once
+	doRequest(router, "GET", "/visit/wp-login", "", nil)
+	if v := decodeVisit(t, doRequest(router, "GET", "/visits/wp-login", "", nil).Body.Bytes()); v.Visits != 1 {
+		t.Errorf("Expected the visit counted, got %d", v.Visits)
+	}
+	body := doRequest(router, "GET", "/metrics", "", nil).Body.String()
+	for _, want := range []string{
+		`negative_cache_lookups_total{result="hit"} 1`,
+		`negative_cache_lookups_total{result="miss"} 2`,
+		"negative_cache_entries 0",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("Expected %q in metrics", want)
+		}
+	}
+
+	// Entries are trusted for the TTL only
+	doRequest(router, "GET", "/visits/xmlrpc", "", nil)
+	if err := redisClient.client.Set(context.Background(), key("visits", "xmlrpc"), 5, 0).Err(); err != nil {
+		t.Fatal(err)
+	}
+	if v := decodeVisit(t, doRequest(router, "GET", "/visits/xmlrpc", "", nil).Body.Bytes()); v.Visits != 0 {
+		t.Errorf("Expected the cached 0 within the TTL, got %d", v.Visits)
+	}
+	clock.Advance(time.Minute)
+	if v := decodeVisit(t, doRequest(router, "GET", "/visits/xmlrpc", "", nil).Body.Bytes()); v.Visits != 5 {
+		t.Errorf("Expected the count read after the TTL, got %d", v.Visits)
+	}
+}
+
+func TestNegativeCachePrivateReaders(t *testing.T) {
+	_, redisClient := newTestRedis(t)
+	cfg := jwtTestConfig()
+	cfg.AnonymousPermission = testConfig().AnonymousPermission
+	cfg.NegativeCacheTTL = time.Minute
+	cfg.NegativeCacheSize = 100
+	server := newTestServer(t, cfg, redisClient)
+	router := server.Router()
+	bearer := func(role string) map[string]string {
+		return map[string]string{"Authorization": "Bearer " + mintHS256(t, cfg.JWTSecret, testClaims(role, time.Hour))}
+	}
+
+	if w := doRequest(router, "PUT", "/admin/pages/draft/meta", `{"visibility":"private"}`, bearer("admin")); w.Code != http.StatusOK {
+		t.Fatalf("Put meta: %d %s", w.Code, w.Body.String())
+	}
+	// A reader sees the private page's zeros, which must not be served to
+	// everyone else
+	if w := doRequest(router, "GET", "/visits/draft", "", bearer("read")); w.Code != http.StatusOK {
+		t.Fatalf("Expected the reader to see the page, got %d", w.Code)
+	}
+	if w := doRequest(router, "GET", "/visits/draft", "", nil); w.Code != http.StatusNotFound {
+		t.Errorf("Expected the private page hidden, got %d", w.Code)
+	}
+	if server.absent.len() != 0 {
+		t.Errorf("Expected nothing cached, got %d", server.absent.len())
+	}
+
+	// A cached page made private is hidden at once
+	doRequest(router, "GET", "/visits/launch", "", nil)
+	if w := doRequest(router, "PUT", "/admin/pages/launch/meta", `{"visibility":"private"}`, bearer("admin")); w.Code != http.StatusOK {
+		t.Fatalf("Put meta: %d %s", w.Code, w.Body.String())
+	}
+	if w := doRequest(router, "GET", "/visits/launch", "", nil); w.Code != http.StatusNotFound {
+		t.Errorf("Expected the cached page hidden once private, got %d", w.Code)
+	}
+}
+
+func TestNegativeCacheAcrossReplicas(t *testing.T) {
+	for _, readOnly := range []bool{false, true} {
+		t.Run(fmt.Sprintf("read_only=%t", readOnly), func(t *testing.T) {
+			mr, redisClient := newTestRedis(t)
+			cfg := testConfig()
+			cfg.EventsBackend = eventsBackendPubSub
+			cfg.NegativeCacheTTL = time.Hour
+			cfg.NegativeCacheSize = 100
+			a := newTestServer(t, cfg, redisClient).Router()
+			cfg.ReadOnly = readOnly
+			b := newTestServer(t, cfg, newTestRedisClient(t, mr))
+			routerB := b.Router()
+
+			doRequest(routerB, "GET", "/visits/launch", "", nil)
+			if b.absent.len() != 1 {
+				t.Fatalf("Expected launch cached on b")
+			}
+			doRequest(a, "GET", "/visit/launch", "", nil)
+			waitFor(t, 2*time.Second, func() bool { return b.absent.len() == 0 })
+			if v := decodeVisit(t, doRequest(routerB, "GET", "/visits/launch", "", nil).Body.Bytes()); v.Visits != 1 {
+				t.Errorf("Expected b to read a's visit, got %d", v.Visits)
+			}
+		})
+	}
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// oomProbeKey is written with each journal replay, so an empty journal
+	// still finds out whether Redis accepts writes again
+	oomProbeKey = "oom:probe"
+
+	// cleanupLockTTL bounds how long the emergency cleanup holds the
+	// maintenance lock
+	cleanupLockTTL = 10 * time.Minute
+)
+
+// errJournalFull is returned for visits arriving while the journal is full
+var errJournalFull = newKindError(ErrOutOfMemory, "redis out of memory and the visit journal is full")
+
+// journalEntry is what a journaled visit is counted under: its page and,
+// for visits with rollups on, the UTC day of its daily bucket
+type journalEntry struct {
+	page        string
+	day         time.Time
+	approximate bool
+}
+
+// VisitJournal counts visits in memory while Redis refuses writes for lack
+// of memory (maxmemory with noeviction), replaying them as increments once
+// it accepts writes again. Journaled visits only reach the counters, the
+// leaderboard, trending and the daily buckets: dedupe, sessions, unique
+// visitors, goals, webhooks and events are skipped for them.
+type VisitJournal struct {
+	redis      *RedisClient
+	clock      Clock
+	maxEntries int
+
+	mu      sync.Mutex
+	since   time.Time // zero while Redis accepts writes
+	pending map[journalEntry]int64
+	visits  int64
+
+	oomErrors atomic.Int64
+	replayed  atomic.Int64
+	dropped   atomic.Int64
+	cleaned   atomic.Int64
+}
+
+// newVisitJournal creates a journal of up to maxEntries pages and days
+// replayed to redisClient, nil when maxEntries is 0 and OOM errors fail
+// visits instead
+func newVisitJournal(redisClient *RedisClient, clock Clock, maxEntries int) *VisitJournal {
+	if maxEntries <= 0 {
+		return nil
+	}
+	return &VisitJournal{redis: redisClient, clock: clock, maxEntries: maxEntries, pending: make(map[journalEntry]int64)}
+}
+
+// degraded reports whether visits are being journaled, and since when
+func (j *VisitJournal) degraded() (time.Time, bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.since, !j.since.IsZero()
+}
+
+// enter records an OOM error, switching to journaling. It reports whether
+// this switched modes, so a single cleanup is started per episode.
+func (j *VisitJournal) enter(err error) bool {
+	j.oomErrors.Add(1)
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if !j.since.IsZero() {
+		return false
+	}
+	j.since = j.clock.Now()
+	log.Printf("WARNING: Redis is out of memory (%v), journaling visits in memory", err)
+	return true
+}
+
+// add journals weight visits, returning the visits pending for the page, ok
+// false when the journal is full
+func (j *VisitJournal) add(entry journalEntry, weight int64) (int64, bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if _, ok := j.pending[entry]; !ok && len(j.pending) >= j.maxEntries {
+		j.dropped.Add(weight)
+		return 0, false
+	}
+	j.pending[entry] += weight
+	j.visits += weight
+	var pending int64
+	for e, n := range j.pending {
+		if e.page == entry.page {
+			pending += n
+		}
+	}
+	return pending, true
+}
+
+// status returns the journal's size: pending visits and entries
+func (j *VisitJournal) status() (int64, int) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.visits, len(j.pending)
+}
+
+// replay writes the journaled visits in one transaction, so Redis applies
+// all of them or, still out of memory, none, and leaves journaling when it
+// succeeds. Visits journaled meanwhile wait for the next replay.
+func (j *VisitJournal) replay(ctx context.Context) (int64, error) {
+	r := j.redis
+	j.mu.Lock()
+	pending, visits := j.pending, j.visits
+	j.pending, j.visits = make(map[journalEntry]int64), 0
+	j.mu.Unlock()
+
+	pipe := r.client.TxPipeline()
+	for entry, n := range pending {
+		if entry.approximate && r.sketches {
+			r.queueSketchVisit(ctx, pipe, entry.page, true, n, j.clock.Now())
+		} else {
+			pipe.IncrBy(ctx, key("visits", entry.page), n)
+			pipe.ZIncrBy(ctx, leaderboardKey, float64(n), entry.page)
+			r.queueIndexPage(ctx, pipe, entry.page)
+		}
+		if !r.sketches {
+			pipe.ZIncrBy(ctx, trendingKey, float64(n), entry.page)
+		}
+		if !entry.day.IsZero() {
+			pipe.IncrBy(ctx, dailyKey(entry.page, entry.day), n)
+		}
+	}
+	pipe.Set(ctx, oomProbeKey, j.clock.Now().Unix(), time.Minute)
+	if _, err := pipe.Exec(ctx); err != nil {
+		// Redis refuses writes past maxmemory as they are queued, so EXEC
+		// discarded them all and the visits go back for the next attempt
+		j.mu.Lock()
+		for entry, n := range pending {
+			j.pending[entry] += n
+		}
+		j.visits += visits
+		j.mu.Unlock()
+		if errors.Is(err, ErrOutOfMemory) {
+			j.oomErrors.Add(1)
+		}
+		return 0, err
+	}
+	j.replayed.Add(visits)
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if len(j.pending) == 0 {
+		j.since = time.Time{}
+	}
+	return visits, nil
+}
+
+// Flush replays the journal at shutdown
+func (j *VisitJournal) Flush(ctx context.Context) error {
+	if visits, _ := j.status(); visits == 0 {
+		return nil
+	}
+	_, err := j.replay(ctx)
+	return err
+}
+
+// write writes the visit_journal series
+func (j *VisitJournal) write(b *strings.Builder, env string) {
+	labels := ""
+	if env != "" {
+		labels = "{env=" + strconv.Quote(env) + "}"
+	}
+	degraded := 0
+	if _, ok := j.degraded(); ok {
+		degraded = 1
+	}
+	visits, entries := j.status()
+	b.WriteString("# HELP redis_oom_errors_total OOM errors visit writes got from Redis.\n")
+	b.WriteString("# TYPE redis_oom_errors_total counter\n")
+	fmt.Fprintf(b, "redis_oom_errors_total%s %d\n", labels, j.oomErrors.Load())
+	b.WriteString("# HELP visit_journal_degraded Whether visits are journaled in memory because Redis is out of memory.\n")
+	b.WriteString("# TYPE visit_journal_degraded gauge\n")
+	fmt.Fprintf(b, "visit_journal_degraded%s %d\n", labels, degraded)
+	b.WriteString("# HELP visit_journal_pending_visits Journaled visits not yet written to Redis.\n")
+	b.WriteString("# TYPE visit_journal_pending_visits gauge\n")
+	fmt.Fprintf(b, "visit_journal_pending_visits%s %d\n", labels, visits)
+	b.WriteString("# HELP visit_journal_pending_entries Pages and days in the visit journal.\n")
+	b.WriteString("# TYPE visit_journal_pending_entries gauge\n")
+	fmt.Fprintf(b, "visit_journal_pending_entries%s %d\n", labels, entries)
+	b.WriteString("# HELP visit_journal_replayed_visits_total Journaled visits written to Redis once it had memory again.\n")
+	b.WriteString("# TYPE visit_journal_replayed_visits_total counter\n")
+	fmt.Fprintf(b, "visit_journal_replayed_visits_total%s %d\n", labels, j.replayed.Load())
+	b.WriteString("# HELP visit_journal_dropped_visits_total Visits refused because the journal was full.\n")
+	b.WriteString("# TYPE visit_journal_dropped_visits_total counter\n")
+	fmt.Fprintf(b, "visit_journal_dropped_visits_total%s %d\n", labels, j.dropped.Load())
+	b.WriteString("# HELP redis_emergency_cleanup_deleted_keys_total Keys deleted by the cleanup run when Redis ran out of memory.\n")
+	b.WriteString("# TYPE redis_emergency_cleanup_deleted_keys_total counter\n")
+	fmt.Fprintf(b, "redis_emergency_cleanup_deleted_keys_total%s %d\n", labels, j.cleaned.Load())
+}
+
+// journalVisit counts a visit in the journal, answering with the stored
+// count plus the page's journaled visits. Reads still work while Redis is
+// out of memory, so a failed one only leaves the stored count out.
+func (s *Server) journalVisit(ctx context.Context, page string, now time.Time, weight int64, rollup bool) (visitResult, error) {
+	entry := journalEntry{page: page, approximate: s.isApproximatePage(page)}
+	if rollup {
+		entry.day = now.UTC().Truncate(24 * time.Hour)
+	}
+	pending, ok := s.journal.add(entry, weight)
+	if !ok {
+		return visitResult{}, errJournalFull
+	}
+	counts, err := s.pageCounts(ctx, page)
+	if err != nil {
+		log.Printf("Error reading counts for a journaled visit: %v", err)
+	}
+	counts.Visits += pending
+	counts.Counted = true
+	return counts, nil
+}
+
+// journaling reports whether visits go to the journal instead of Redis
+func (s *Server) journaling() bool {
+	if s.journal == nil {
+		return false
+	}
+	_, ok := s.journal.degraded()
+	return ok
+}
+
+// outOfMemory reports whether err is an OOM error the journal takes over
+// from, starting the emergency cleanup when it is the first of an episode
+func (s *Server) outOfMemory(err error) bool {
+	if s.journal == nil || !errors.Is(err, ErrOutOfMemory) {
+		return false
+	}
+	if s.journal.enter(err) {
+		ctx := s.lifetime
+		if ctx == nil {
+			ctx = context.Background()
+		}
+		go s.emergencyCleanup(ctx)
+	}
+	return true
+}
+
+// replayJournal is the periodic journal replay, a no-op while Redis
+// accepts writes
+func (s *Server) replayJournal(ctx context.Context) error {
+	since, ok := s.journal.degraded()
+	if !ok {
+		return nil
+	}
+	visits, err := s.journal.replay(ctx)
+	if errors.Is(err, ErrOutOfMemory) {
+		// Still full: try again next tick
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	log.Printf("Redis accepts writes again after %s, replayed %d journaled visits", s.clock.Now().Sub(since).Round(time.Second), visits)
+	// The replayed visits create pages without page.created events
+	if s.absent != nil {
+		s.absent.clear()
+	}
+	return nil
+}
+
+// emergencyCleanup frees memory when Redis first runs out of it, deleting
+// keys whose loss costs no counts: dedupe markers, which only risk counting
+// a returning visitor again within DEDUPE_WINDOW, and hour histograms older
+// than any heatmap range reads. Deletes are allowed past maxmemory, but
+// taking the maintenance lock is a write, so when Redis refuses it the
+// cleanup runs without: it only deletes, and two replicas running it at
+// once just repeat work. It skips while another replica holds the lock.
+func (s *Server) emergencyCleanup(ctx context.Context) {
+	release, ok, err := s.redis.AcquireMaintenanceLock(ctx, cleanupLockTTL)
+	switch {
+	case errors.Is(err, ErrOutOfMemory):
+		log.Println("Redis is out of memory, running the emergency cleanup without the maintenance lock")
+	case err != nil:
+		log.Printf("Emergency cleanup failed to take the maintenance lock: %v", err)
+		return
+	case !ok:
+		log.Println("Skipping the emergency cleanup, another replica holds the maintenance lock")
+		return
+	default:
+		defer release()
+	}
+
+	deleted, err := s.redis.EmergencyCleanup(ctx, s.clock.Now())
+	s.journal.cleaned.Add(deleted)
+	if err != nil {
+		log.Printf("Emergency cleanup failed after deleting %d keys: %v", deleted, err)
+		return
+	}
+	log.Printf("Emergency cleanup deleted %d keys", deleted)
+}
+
+// EmergencyCleanup deletes the dedupe markers and the hour histograms
+// older than maxHeatmapDays, returning how many keys it deleted
+func (r *RedisClient) EmergencyCleanup(ctx context.Context, now time.Time) (int64, error) {
+	var deleted int64
+	unlink := func(keys []string) error {
+		if len(keys) == 0 {
+			return nil
+		}
+		n, err := r.client.Unlink(ctx, keys...).Result()
+		deleted += n
+		return err
+	}
+	if err := r.scanKeys(ctx, "visits:dedupe:*", unlink); err != nil {
+		return deleted, err
+	}
+
+	cutoff := now.UTC().Truncate(24*time.Hour).AddDate(0, 0, -maxHeatmapDays)
+	err := r.scanKeys(ctx, "visits:*:hourly:*", func(keys []string) error {
+		var old []string
+		for _, k := range keys {
+			i := strings.LastIndex(k, ":hourly:")
+			if i < 0 {
+				continue
+			}
+			if day, err := time.Parse(dayLayout, k[i+len(":hourly:"):]); err == nil && day.Before(cutoff) {
+				old = append(old, k)
+			}
+		}
+		return unlink(old)
+	})
+	return deleted, err
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// errOOM is the error Redis returns for writes past maxmemory
+var errOOM = serverError("OOM command not allowed when used memory > 'maxmemory'.")
+
+// oomHook fails writes with errOOM while on, as a Redis at maxmemory with
+// the noeviction policy does; reads and deletes still go through
+type oomHook struct{ on atomic.Bool }
+
+// refused reports whether a Redis out of memory refuses cmd
+func refused(cmd redis.Cmder) bool {
+	switch name := cmd.Name(); name {
+	case "multi", "exec", "del", "unlink":
+		return false
+	default:
+		return !readOnlyAllowed(name)
+	}
+}
+
+func (h *oomHook) DialHook(next redis.DialHook) redis.DialHook { return next }
+
+func (h *oomHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		if h.on.Load() && refused(cmd) {
+			cmd.SetErr(errOOM)
+			return errOOM
+		}
+		return next(ctx, cmd)
+	}
+}
+
+func (h *oomHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		if h.on.Load() {
+			for _, cmd := range cmds {
+				if refused(cmd) {
+					// A refused command fails its whole transaction at EXEC
+					for _, cmd := range cmds {
+						cmd.SetErr(errOOM)
+					}
+					return errOOM
+				}
+			}
+		}
+		return next(ctx, cmds)
+	}
+}
+
+func TestOutOfMemoryJournalsVisits(t *testing.T) {
+	mr, redisClient := newTestRedis(t)
+	oom := &oomHook{}
+	redisClient.client.AddHook(oom)
+	cfg := testConfig()
+	cfg.OOMJournalMaxEntries = 100
+	cfg.OOMJournalReplayInterval = time.Hour
+	server := newTestServer(t, cfg, redisClient)
+	router := server.Router()
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		doRequest(router, "GET", "/visit/home", "", nil)
+	}
+	mr.Set("visits:dedupe:home:abc", "1")
+	mr.HSet("visits:home:hourly:2020-01-01", "10", "3")
+	mr.HSet(hourlyKey("home", time.Now()), "10", "3")
+
+	visit := func(page string) *VisitResponse {
+		t.Helper()
+		w := doRequest(router, "GET", "/visit/"+page, "", nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Visit %s: %d %s", page, w.Code, w.Body.String())
+		}
+		var resp VisitResponse
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		return &resp
+	}
+
+	// Writes switch to the journal, and responses count the journaled visits
+	oom.on.Store(true)
+	if resp := visit("home"); resp.Visits != 3 || resp.Counted == nil || !*resp.Counted {
+		t.Errorf("Expected the journaled visit counted, got %+v", resp)
+	}
+	if resp := visit("home"); resp.Visits != 4 {
+		t.Errorf("Expected the journaled visits added up, got %d", resp.Visits)
+	}
+	visit("about")
+
+	// Reads are served from Redis as usual
+	w := doRequest(router, "GET", "/visits/home", "", nil)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"visits":2`) {
+		t.Errorf("Expected the stored count read, got %d: %s", w.Code, w.Body.String())
+	}
+
+	w = doRequest(router, "GET", "/health", "", nil)
+	var health HealthResponse
+	json.Unmarshal(w.Body.Bytes(), &health)
+	if health.Status != "degraded" || health.OutOfMemory == nil || health.OutOfMemory.JournaledVisits != 3 {
+		t.Errorf("Expected a degraded health with 3 journaled visits, got %s", w.Body.String())
+	}
+	if body := doRequest(router, "GET", "/metrics", "", nil).Body.String(); !strings.Contains(body, "visit_journal_degraded 1") ||
+		!strings.Contains(body, "visit_journal_pending_visits 3") {
+		t.Errorf("Expected the journal in the metrics, got %s", body)
+	}
+
+	// The emergency cleanup frees what it can without losing counts
+	waitFor(t, time.Second, func() bool {
+		return !mr.Exists("visits:dedupe:home:abc") && !mr.Exists("visits:home:hourly:2020-01-01")
+	})
+	if !mr.Exists(hourlyKey("home", time.Now())) {
+		t.Error("Expected recent hour histograms kept")
+	}
+
+	// Replays fail as a whole while Redis is still full
+	if err := server.replayJournal(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := redisClient.GetVisitCount(ctx, "home"); got != 2 {
+		t.Errorf("Expected nothing replayed yet, got %d", got)
+	}
+
+	// Once writes are accepted again the journal is replayed and cleared
+	oom.on.Store(false)
+	if err := server.replayJournal(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for page, want := range map[string]int64{"home": 4, "about": 1} {
+		if got, _ := redisClient.GetVisitCount(ctx, page); got != want {
+			t.Errorf("Expected %s replayed to %d, got %d", page, want, got)
+		}
+		if score, _ := redisClient.client.ZScore(ctx, leaderboardKey, page).Result(); score != float64(want) {
+			t.Errorf("Expected %s's leaderboard score at %d, got %g", page, want, score)
+		}
+	}
+	if resp := visit("home"); resp.Visits != 5 {
+		t.Errorf("Expected visits written to Redis again, got %d", resp.Visits)
+	}
+	w = doRequest(router, "GET", "/health", "", nil)
+	if strings.Contains(w.Body.String(), "degraded") || strings.Contains(w.Body.String(), "redis_out_of_memory") {
+		t.Errorf("Expected a healthy status after recovery, got %s", w.Body.String())
+	}
+	if body := doRequest(router, "GET", "/metrics", "", nil).Body.String(); !strings.Contains(body, "visit_journal_replayed_visits_total 3") {
+		t.Errorf("Expected the replayed visits counted, got %s", body)
+	}
+}
+
+// pfaddOOMHook fails only the PFADDs of a plain pipeline with errOOM, as
+// Redis does when a write that needs memory comes after one that doesn't
+type pfaddOOMHook struct{}
+
+func (pfaddOOMHook) DialHook(next redis.DialHook) redis.DialHook          { return next }
+func (pfaddOOMHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook { return next }
+
+func (pfaddOOMHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		var sent []redis.Cmder
+		for _, cmd := range cmds {
+			if cmd.Name() == "multi" {
+				return next(ctx, cmds)
+			}
+			if cmd.Name() == "pfadd" {
+				cmd.SetErr(errOOM)
+			} else {
+				sent = append(sent, cmd)
+			}
+		}
+		if len(sent) == len(cmds) {
+			return next(ctx, cmds)
+		}
+		next(ctx, sent)
+		return errOOM
+	}
+}
+
+func TestOutOfMemoryAfterCountingSkipsJournal(t *testing.T) {
+	_, redisClient := newTestRedis(t)
+	redisClient.client.AddHook(pfaddOOMHook{})
+	cfg := testConfig()
+	cfg.OOMJournalMaxEntries = 100
+	cfg.OOMJournalReplayInterval = time.Hour
+	server := newTestServer(t, cfg, redisClient)
+	router := server.Router()
+
+	w := doRequest(router, "GET", "/visit/home", "", nil)
+	if resp := decodeVisit(t, w.Body.Bytes()); w.Code != http.StatusOK || resp.Visits != 1 || !*resp.Counted {
+		t.Fatalf("Expected the counted visit returned, got %d %s", w.Code, w.Body.String())
+	}
+	// The counter was written, so journaling the visit would count it twice
+	if got, _ := redisClient.GetVisitCount(context.Background(), "home"); got != 1 {
+		t.Errorf("Expected the counter written once, got %d", got)
+	}
+	if pending, _ := server.journal.status(); pending != 0 {
+		t.Errorf("Expected nothing journaled, got %d visits", pending)
+	}
+	// Redis is out of memory all the same, so the next visits are journaled
+	if !server.journaling() {
+		t.Error("Expected the journal to take over the next visits")
+	}
+}
+
+func TestOutOfMemoryJournalFull(t *testing.T) {
+	_, redisClient := newTestRedis(t)
+	oom := &oomHook{}
+	redisClient.client.AddHook(oom)
+	cfg := testConfig()
+	cfg.OOMJournalMaxEntries = 1
+	cfg.OOMJournalReplayInterval = time.Hour
+	router := newTestServer(t, cfg, redisClient).Router()
+
+	oom.on.Store(true)
+	if w := doRequest(router, "GET", "/visit/home", "", nil); w.Code != http.StatusOK {
+		t.Fatalf("Expected the first page journaled, got %d", w.Code)
+	}
+	w := doRequest(router, "GET", "/visit/about", "", nil)
+	var resp ErrorResponse
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if w.Code != http.StatusServiceUnavailable || resp.Code != "out_of_memory" {
+		t.Errorf("Expected a full journal to refuse new pages, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := doRequest(router, "GET", "/visit/home", "", nil); w.Code != http.StatusOK {
+		t.Errorf("Expected a journaled page still counted, got %d", w.Code)
+	}
+}
+
+func TestOutOfMemoryWithoutJournal(t *testing.T) {
+	_, redisClient := newTestRedis(t)
+	oom := &oomHook{}
+	redisClient.client.AddHook(oom)
+	router := newTestServer(t, testConfig(), redisClient).Router()
+
+	oom.on.Store(true)
+	w := doRequest(router, "GET", "/visit/home", "", nil)
+	var resp ErrorResponse
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if w.Code != http.StatusServiceUnavailable || resp.Code != "out_of_memory" {
+		t.Errorf("Expected 503 out_of_memory, got %d: %s", w.Code, w.Body.String())
+	}
+}
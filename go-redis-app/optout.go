@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"github.com/gin-gonic/gin"
+)
+
+// optOutKey is the set of opted-out visitors, each stored as a hashed
+// visitor ID, "c:" or "ip:" and its hash
+const optOutKey = "visits:optout"
+
+// reasonOptOut is the reason given for visits of opted-out visitors
+const reasonOptOut = "opt_out"
+
+// OptOutRequest is the body of POST and DELETE /admin/optout; exactly one
+// of the fields is set
+type OptOutRequest struct {
+	// Visitor is a hashed visitor ID, as carried by visit events
+	Visitor string `json:"visitor"`
+
+	// Identifier is a client IP or visitor cookie, hashed and then discarded
+	Identifier string `json:"identifier"`
+}
+
+// OptOutResponse represents the POST and DELETE /admin/optout API response
+type OptOutResponse struct {
+	Visitor string `json:"visitor"`
+	Changed bool   `json:"changed"`
+}
+
+// OptOutCountResponse represents the GET /admin/optout API response. The
+// list itself is never returned.
+type OptOutCountResponse struct {
+	Total int64 `json:"total"`
+}
+
+// OptOuts keeps the number of opted-out visitors, refreshed with the flags
+// on their pub/sub notifications and poll, so visits skip the membership
+// check while nobody has opted out
+type OptOuts struct {
+	redis *RedisClient
+	count atomic.Int64
+}
+
+// NewOptOuts creates an empty opt-out count
+func NewOptOuts(redisClient *RedisClient) *OptOuts {
+	return &OptOuts{redis: redisClient}
+}
+
+// Len returns the number of opted-out visitors
+func (o *OptOuts) Len() int64 {
+	return o.count.Load()
+}
+
+// Refresh reloads the count from Redis
+func (o *OptOuts) Refresh(ctx context.Context) error {
+	n, err := o.redis.client.SCard(ctx, optOutKey).Result()
+	if err != nil {
+		return err
+	}
+	o.count.Store(n)
+	return nil
+}
+
+// OptedOut reports whether any of the hashed visitor IDs has opted out, in
+// one round trip
+func (r *RedisClient) OptedOut(ctx context.Context, visitors []string) (bool, error) {
+	members := make([]interface{}, len(visitors))
+	for i, visitor := range visitors {
+		members[i] = visitor
+	}
+	found, err := r.client.SMIsMember(ctx, optOutKey, members...).Result()
+	if err != nil {
+		return false, err
+	}
+	for _, ok := range found {
+		if ok {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// optedOut reports whether the visitor of a request from ip, with the visitor
+// cookie when set, has opted out. Both identifiers are checked under the
+// static hash raw identifiers are stored with, and with daily rotation under
+// the day's hash too, which is what hashed IDs taken from today's events
+// match. Nothing is written, not even the day's salt, though once read it
+// is cached, so it costs a round trip per replica and day.
+func (s *Server) optedOut(ctx context.Context, ip, cookie string) (bool, error) {
+	if s.optOuts.Len() == 0 {
+		return false, nil
+	}
+	identifiers := []string{"ip:" + ip}
+	if isValidVisitorID(cookie) {
+		identifiers = append(identifiers, "c:"+cookie)
+	}
+	var visitors []string
+	for _, identifier := range identifiers {
+		kind, _, _ := strings.Cut(identifier, ":")
+		visitors = append(visitors, kind+":"+saltedHash(s.hasher.salt, identifier))
+		if s.hasher.daily {
+			hash, ok, err := s.hasher.peek(ctx, identifier, s.clock.Now())
+			if err != nil {
+				return false, err
+			}
+			if ok {
+				visitors = append(visitors, kind+":"+hash)
+			}
+		}
+	}
+	return s.redis.OptedOut(ctx, visitors)
+}
+
+// requestOptedOut is optedOut for a visit request
+func (s *Server) requestOptedOut(c *gin.Context) (bool, error) {
+	return s.optedOut(c.Request.Context(), c.ClientIP(), s.visitorCookie(c.Request))
+}
+
+// optOutVisitor reads the hashed visitor ID of an opt-out request,
+// responding 400 when it is invalid. A raw identifier is hashed with the
+// static salt, never the daily one, so the opt-out outlives the rotation.
+func (s *Server) optOutVisitor(c *gin.Context) (string, bool) {
+	var req OptOutRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondError(c, http.StatusBadRequest, "invalid_request", "Invalid JSON body: "+err.Error())
+		return "", false
+	}
+	if (req.Visitor == "") == (req.Identifier == "") {
+		respondError(c, http.StatusBadRequest, "invalid_request", "Set either visitor or identifier")
+		return "", false
+	}
+	if req.Visitor != "" {
+		if !isValidHashedVisitor(req.Visitor) {
+			respondError(c, http.StatusBadRequest, "invalid_request", "visitor must be a hashed visitor ID such as c:<32 hex digits>")
+			return "", false
+		}
+		return req.Visitor, true
+	}
+	kind, value := "c", strings.TrimSpace(req.Identifier)
+	if ip := net.ParseIP(value); ip != nil {
+		kind, value = "ip", ip.String()
+	} else if !isValidVisitorID(value) {
+		respondError(c, http.StatusBadRequest, "invalid_request", "identifier must be an IP address or visitor ID")
+		return "", false
+	}
+	visitor := kind + ":" + saltedHash(s.hasher.salt, kind+":"+value)
+	// The audit log gets the hash in place of the identifier
+	c.Set(auditBodyKey, `{"visitor":"`+visitor+`"}`)
+	return visitor, true
+}
+
+// publishOptOuts tells every replica the opt-out list changed, on the flags
+// channel their followers refresh on
+func (s *Server) publishOptOuts(ctx context.Context) {
+	if err := s.redis.client.Publish(ctx, flagsChannel, "").Err(); err != nil {
+		log.Printf("Failed to publish opt-out update: %v", err)
+	}
+	if err := s.optOuts.Refresh(ctx); err != nil {
+		log.Printf("Failed to refresh opt-outs: %v", err)
+	}
+}
+
+// handleAddOptOut stops counting a visitor
+func (s *Server) handleAddOptOut(c *gin.Context) {
+	visitor, ok := s.optOutVisitor(c)
+	if !ok {
+		return
+	}
+	added, err := s.redis.client.SAdd(c.Request.Context(), optOutKey, visitor).Result()
+	if err != nil {
+		log.Printf("Error adding opt-out: %v", err)
+		respondStoreError(c, err, "Failed to add opt-out")
+		return
+	}
+	s.publishOptOuts(c.Request.Context())
+	respondJSON(c, http.StatusOK, OptOutResponse{Visitor: visitor, Changed: added == 1})
+}
+
+// handleRemoveOptOut counts a visitor again
+func (s *Server) handleRemoveOptOut(c *gin.Context) {
+	visitor, ok := s.optOutVisitor(c)
+	if !ok {
+		return
+	}
+	removed, err := s.redis.client.SRem(c.Request.Context(), optOutKey, visitor).Result()
+	if err != nil {
+		log.Printf("Error removing opt-out: %v", err)
+		respondStoreError(c, err, "Failed to remove opt-out")
+		return
+	}
+	s.publishOptOuts(c.Request.Context())
+	respondJSON(c, http.StatusOK, OptOutResponse{Visitor: visitor, Changed: removed == 1})
+}
+
+// handleCountOptOuts returns how many visitors opted out
+func (s *Server) handleCountOptOuts(c *gin.Context) {
+	n, err := s.redis.client.SCard(c.Request.Context(), optOutKey).Result()
+	if err != nil {
+		log.Printf("Error counting opt-outs: %v", err)
+		respondStoreError(c, err, "Failed to count opt-outs")
+		return
+	}
+	respondJSON(c, http.StatusOK, OptOutCountResponse{Total: n})
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func optOut(t *testing.T, h http.Handler, method, body string) OptOutResponse {
+	t.Helper()
+	w := doRequest(h, method, "/admin/optout", body, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("%s /admin/optout %s: expected 200, got %d: %s", method, body, w.Code, w.Body.String())
+	}
+	var resp OptOutResponse
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	return resp
+}
+
+func optOutTotal(t *testing.T, h http.Handler) int64 {
+	t.Helper()
+	var resp OptOutCountResponse
+	json.Unmarshal(doRequest(h, "GET", "/admin/optout", "", nil).Body.Bytes(), &resp)
+	return resp.Total
+}
+
+func TestOptOutSkipsVisitor(t *testing.T) {
+	for _, rotation := range []string{rotationNone, rotationDaily} {
+		t.Run(rotation, func(t *testing.T) {
+			mr, redisClient := newTestRedis(t)
+			cfg := testConfig()
+			cfg.IPHashSalt = "pepper"
+			cfg.IPHashRotation = rotation
+			cfg.VisitorCookie = true
+			router := newPrivacyServer(t, redisClient, cfg)
+			visitFrom(router, "home", "192.0.2.2")
+
+			if resp := optOut(t, router, "POST", `{"identifier": "192.0.2.1"}`); !resp.Changed || !strings.HasPrefix(resp.Visitor, "ip:") {
+				t.Fatalf("Expected the IP to be added as its hash, got %+v", resp)
+			}
+			if resp := optOut(t, router, "POST", `{"identifier": "192.0.2.1"}`); resp.Changed {
+				t.Error("Expected adding the IP again to change nothing")
+			}
+			if got := optOutTotal(t, router); got != 1 {
+				t.Errorf("Expected 1 opt-out, got %d", got)
+			}
+
+			before := mr.Dump()
+			w := visitFrom(router, "home", "192.0.2.1")
+			resp := decodeVisit(t, w.Body.Bytes())
+			if w.Code != http.StatusOK || *resp.Counted || resp.Reason != reasonOptOut || resp.Visits != 1 {
+				t.Fatalf("Expected an uncounted opt_out visit, got %d %s", w.Code, w.Body.String())
+			}
+			if w.Header().Get("Set-Cookie") != "" {
+				t.Errorf("Expected no visitor cookie issued, got %q", w.Header().Get("Set-Cookie"))
+			}
+			if after := mr.Dump(); after != before {
+				t.Errorf("Expected nothing written for an opted-out visitor:\nbefore %s\nafter %s", before, after)
+			}
+
+			if resp := optOut(t, router, "DELETE", `{"identifier": "192.0.2.1"}`); !resp.Changed {
+				t.Error("Expected the IP to be removed")
+			}
+			if resp := decodeVisit(t, visitFrom(router, "home", "192.0.2.1").Body.Bytes()); !*resp.Counted || resp.Reason != "" {
+				t.Errorf("Expected the visitor counted again, got %+v", resp)
+			}
+			if got := optOutTotal(t, router); got != 0 {
+				t.Errorf("Expected no opt-outs, got %d", got)
+			}
+		})
+	}
+}
+
+func TestOptOutByCookieAndHash(t *testing.T) {
+	mr, redisClient := newTestRedis(t)
+	cfg := testConfig()
+	cfg.IPHashSalt = "pepper"
+	cfg.VisitorCookie = true
+	router := newPrivacyServer(t, redisClient, cfg)
+
+	// A cookie opts the visitor out from any IP
+	vid, _ := newVisitorID()
+	optOut(t, router, "POST", `{"identifier": "`+vid+`"}`)
+	cookie := &http.Cookie{Name: visitorCookieName, Value: vid}
+	if resp := decodeVisit(t, visitFrom(router, "home", "192.0.2.5", cookie).Body.Bytes()); resp.Reason != reasonOptOut {
+		t.Errorf("Expected the cookie's visits skipped, got %+v", resp)
+	}
+
+	// As does the hashed ID found in events
+	optOut(t, router, "POST", `{"visitor": "ip:`+saltedHash("pepper", "ip:192.0.2.6")+`"}`)
+	if resp := decodeVisit(t, visitFrom(router, "home", "192.0.2.6").Body.Bytes()); resp.Reason != reasonOptOut {
+		t.Errorf("Expected the hashed visitor's visits skipped, got %+v", resp)
+	}
+	if keys := visitorKeys(mr); len(keys) != 0 {
+		t.Errorf("Expected no visitor markers, got %v", keys)
+	}
+}
+
+func TestOptOutPollFallback(t *testing.T) {
+	mr, redisClient := newTestRedis(t)
+	cfg := testConfig()
+	cfg.IPHashSalt = "pepper"
+	cfg.IPHashRotation = rotationDaily
+	router := newPrivacyServer(t, redisClient, cfg)
+	visitFrom(router, "home", "192.0.2.2")
+
+	cfg.FlagsPollInterval = 20 * time.Millisecond
+	replica := newTestServer(t, cfg, redisClient)
+	// Written directly, so the replica only learns of it from its poll
+	mr.SAdd(optOutKey, "ip:"+saltedHash("pepper", "ip:192.0.2.1"))
+	waitFor(t, 2*time.Second, func() bool { return replica.optOuts.Len() == 1 })
+
+	if resp := decodeVisit(t, visitFrom(replica.Router(), "home", "192.0.2.1").Body.Bytes()); resp.Reason != reasonOptOut {
+		t.Errorf("Expected the replica to skip the visitor, got %+v", resp)
+	}
+	replica.hasher.mu.Lock()
+	defer replica.hasher.mu.Unlock()
+	if len(replica.hasher.salts) != 1 {
+		t.Errorf("Expected the day's salt cached by the check, got %v", replica.hasher.salts)
+	}
+}
+
+func TestOptOutAuditOmitsIdentifier(t *testing.T) {
+	_, redisClient := newTestRedis(t)
+	cfg := testConfig()
+	cfg.AdminAPIKeys = map[string]string{"secret": "ops"}
+	router := newTestServer(t, cfg, redisClient).Router()
+	w := doRequest(router, "POST", "/admin/optout", `{"identifier": "192.0.2.1"}`, map[string]string{"X-API-Key": "secret"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	resp := readAudit(t, router, "")
+	if len(resp.Entries) != 1 {
+		t.Fatalf("Expected 1 audit entry, got %d", len(resp.Entries))
+	}
+	if body := resp.Entries[0].Body; strings.Contains(body, "192.0.2.1") || !strings.Contains(body, `"visitor":"ip:`) {
+		t.Errorf("Expected the audit entry to carry the hash only, got %q", body)
+	}
+}
+
+func TestOptOutValidation(t *testing.T) {
+	_, redisClient := newTestRedis(t)
+	router := newTestServer(t, testConfig(), redisClient).Router()
+	for _, body := range []string{
+		`{}`,
+		`{"identifier": "192.0.2.1", "visitor": "ip:0123456789abcdef0123456789abcdef"}`,
+		`{"identifier": "not-an-id"}`,
+		`{"visitor": "192.0.2.1"}`,
+		`not json`,
+	} {
+		for _, method := range []string{"POST", "DELETE"} {
+			if w := doRequest(router, method, "/admin/optout", body, nil); w.Code != http.StatusBadRequest {
+				t.Errorf("%s: expected 400 for %s, got %d", method, body, w.Code)
+			}
+		}
+	}
+}
@@ -0,0 +1,500 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+// Webhook outbox keys. Entries are queued on the outbox list, moved to the
+// dispatching instance's processing list while delivered, then dropped,
+// scheduled on the retry set by due time, or moved to the dead letters. The
+// instances set names the instances with a processing list.
+const (
+	outboxKey           = "webhooks:outbox"
+	outboxRetryKey      = "webhooks:retry"
+	outboxDeadLetterKey = "webhooks:deadletter"
+	outboxInstancesKey  = "webhooks:instances"
+)
+
+// outboxMaxBackoff caps the delay between delivery attempts
+const outboxMaxBackoff = time.Hour
+
+// outboxLeaseTTL is how long an instance's processing list outlives its
+// last lease renewal before another instance returns its entries to the
+// outbox. Leases are renewed four times per TTL.
+const outboxLeaseTTL = time.Minute
+
+// outboxProcessingKey is the list of entries an instance is delivering
+func outboxProcessingKey(instance string) string {
+	return key("webhooks", "processing", instance)
+}
+
+// outboxLeaseKey exists while an instance is running its dispatchers
+func outboxLeaseKey(instance string) string {
+	return key("webhooks", "lease", instance)
+}
+
+// OutboxEntry is a webhook delivery waiting in the outbox
+type OutboxEntry struct {
+	ID         string          `json:"id"`
+	Event      string          `json:"event"`
+	Payload    json.RawMessage `json:"payload"`
+	EnqueuedAt time.Time       `json:"enqueued_at"`
+	Attempts   int64           `json:"attempts"`
+	LastError  string          `json:"last_error,omitempty"`
+
+	// FailedAt is when the entry was dead-lettered
+	FailedAt time.Time `json:"failed_at"`
+
+	// Page and URL are set on per-page webhook entries, which are posted to
+	// the page's webhook_url instead of NEW_PAGE_WEBHOOK_URL
+	Page string `json:"page,omitempty"`
+	URL  string `json:"url,omitempty"`
+}
+
+// createdScript increments a page counter and queues an outbox entry when
+// the increment created it. Doing both in one script keeps the entry atomic
+// with the visit that created the page, which only one visit can observe.
+// It returns the new count.
+//
+// KEYS[1] counter, KEYS[2] outbox; ARGV[1] increment, ARGV[2] entry
+var createdScript = redis.NewScript(`
+local visits = redis.call('INCRBY', KEYS[1], ARGV[1])
+if visits == tonumber(ARGV[1]) then
+	redis.call('RPUSH', KEYS[2], ARGV[2])
+end
+return visits
+`)
+
+// indexCreatedScript is createdScript for approximate pages, which have no
+// counter: adding the name to the index creates the page. It returns 1 when
+// the name was added.
+//
+// KEYS[1] page name index, KEYS[2] outbox; ARGV[1] page, ARGV[2] entry
+var indexCreatedScript = redis.NewScript(`
+local added = redis.call('ZADD', KEYS[1], 'NX', 0, ARGV[1])
+if added == 1 then
+	redis.call('RPUSH', KEYS[2], ARGV[2])
+end
+return added
+`)
+
+// promoteScript moves the retries that are due back onto the outbox, at most
+// ARGV[2] of them. It returns how many were moved.
+//
+// KEYS[1] retry set, KEYS[2] outbox; ARGV[1] now in Unix milliseconds,
+// ARGV[2] limit
+var promoteScript = redis.NewScript(`
+local due = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[1], 'LIMIT', 0, ARGV[2])
+for _, entry in ipairs(due) do
+	redis.call('ZREM', KEYS[1], entry)
+	redis.call('RPUSH', KEYS[2], entry)
+end
+return #due
+`)
+
+// moveEntryScript moves an entry from one list to another, replacing it with
+// ARGV[2], only if it is still in the first one. It returns 1 when moved.
+//
+// KEYS[1] source, KEYS[2] destination; ARGV[1] entry, ARGV[2] replacement
+var moveEntryScript = redis.NewScript(`
+if redis.call('LREM', KEYS[1], 1, ARGV[1]) == 1 then
+	redis.call('RPUSH', KEYS[2], ARGV[2])
+	return 1
+end
+return 0
+`)
+
+// reapScript returns the entries of an instance's processing list to the
+// outbox and forgets the instance, unless its lease is still held. It
+// returns how many entries were returned.
+//
+// KEYS[1] lease, KEYS[2] processing list, KEYS[3] outbox, KEYS[4]
+// instances set; ARGV[1] instance
+var reapScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 1 then
+	return 0
+end
+local n = 0
+while redis.call('LMOVE', KEYS[2], KEYS[3], 'RIGHT', 'LEFT') do
+	n = n + 1
+end
+redis.call('SREM', KEYS[4], ARGV[1])
+return n
+`)
+
+// newOutboxEntry encodes an outbox entry for the event payload
+func newOutboxEntry(event string, payload interface{}, now time.Time) (string, error) {
+	return encodeOutboxEntry(OutboxEntry{Event: event}, payload, now)
+}
+
+// encodeOutboxEntry encodes entry with a new ID, the payload and now as its
+// enqueue time
+func encodeOutboxEntry(entry OutboxEntry, payload interface{}, now time.Time) (string, error) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return "", fmt.Errorf("encoding %s payload: %w", entry.Event, err)
+	}
+	if entry.ID, err = newVisitorID(); err != nil {
+		return "", err
+	}
+	entry.Payload, entry.EnqueuedAt = body, now.UTC()
+	raw, err := json.Marshal(entry)
+	return string(raw), err
+}
+
+// ClaimOutbox moves the oldest outbox entry to the processing list and
+// returns it, or redis.Nil when the outbox is empty
+func (r *RedisClient) ClaimOutbox(ctx context.Context, processing string) (string, error) {
+	return r.client.LMove(ctx, outboxKey, processing, "LEFT", "RIGHT").Result()
+}
+
+// RecoverOutbox returns the entries left on a processing list by a previous
+// run to the outbox, reporting how many there were
+func (r *RedisClient) RecoverOutbox(ctx context.Context, processing string) (int, error) {
+	n := 0
+	for {
+		err := r.client.LMove(ctx, processing, outboxKey, "RIGHT", "LEFT").Err()
+		if isMissing(err) {
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+		n++
+	}
+}
+
+// RenewOutboxLease holds instance's lease on its processing list for ttl
+// and records it in the instances set
+func (r *RedisClient) RenewOutboxLease(ctx context.Context, instance string, ttl time.Duration) error {
+	_, err := r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, outboxLeaseKey(instance), 1, ttl)
+		pipe.SAdd(ctx, outboxInstancesKey, instance)
+		return nil
+	})
+	return err
+}
+
+// ReapOutbox returns the processing lists of the other instances whose
+// lease has lapsed to the outbox, reporting how many entries they held
+func (r *RedisClient) ReapOutbox(ctx context.Context, self string) (int64, error) {
+	instances, err := r.client.SMembers(ctx, outboxInstancesKey).Result()
+	if err != nil {
+		return 0, err
+	}
+	var reaped int64
+	for _, instance := range instances {
+		if instance == self {
+			continue
+		}
+		keys := []string{outboxLeaseKey(instance), outboxProcessingKey(instance), outboxKey, outboxInstancesKey}
+		n, err := reapScript.Run(ctx, r.client, keys, instance).Int64()
+		if err != nil {
+			return reaped, err
+		}
+		reaped += n
+	}
+	return reaped, nil
+}
+
+// PromoteOutboxRetries moves the retries due by now back onto the outbox
+func (r *RedisClient) PromoteOutboxRetries(ctx context.Context, now time.Time) error {
+	return promoteScript.Run(ctx, r.client, []string{outboxRetryKey, outboxKey}, now.UnixMilli(), 1000).Err()
+}
+
+// CompleteOutbox drops a delivered entry from the processing list
+func (r *RedisClient) CompleteOutbox(ctx context.Context, processing, raw string) error {
+	return r.client.LRem(ctx, processing, 1, raw).Err()
+}
+
+// RetryOutbox schedules a failed entry, updated as next, for due
+func (r *RedisClient) RetryOutbox(ctx context.Context, processing, raw, next string, due time.Time) error {
+	_, err := r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.LRem(ctx, processing, 1, raw)
+		pipe.ZAdd(ctx, outboxRetryKey, redis.Z{Member: next, Score: float64(due.UnixMilli())})
+		return nil
+	})
+	return err
+}
+
+// DeadLetterOutbox moves an entry that will not be retried, updated as next,
+// to the dead letters
+func (r *RedisClient) DeadLetterOutbox(ctx context.Context, processing, raw, next string) error {
+	return moveEntryScript.Run(ctx, r.client, []string{processing, outboxDeadLetterKey}, raw, next).Err()
+}
+
+// DeadLetters returns the first count dead letters, oldest first, and how
+// many there are. Entries that don't decode are skipped.
+func (r *RedisClient) DeadLetters(ctx context.Context, count int64) ([]OutboxEntry, int64, error) {
+	var lrange *redis.StringSliceCmd
+	var llen *redis.IntCmd
+	_, err := r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		lrange = pipe.LRange(ctx, outboxDeadLetterKey, 0, count-1)
+		llen = pipe.LLen(ctx, outboxDeadLetterKey)
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	entries := make([]OutboxEntry, 0, len(lrange.Val()))
+	for _, raw := range lrange.Val() {
+		var entry OutboxEntry
+		if err := json.Unmarshal([]byte(raw), &entry); err != nil {
+			log.Printf("Skipping undecodable dead letter: %v", err)
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries, llen.Val(), nil
+}
+
+// RequeueDeadLetters moves the dead letters with the given IDs, or all of
+// them when ids is empty, back onto the outbox with their attempts reset.
+// It returns how many were requeued.
+func (r *RedisClient) RequeueDeadLetters(ctx context.Context, ids []string) (int, error) {
+	want := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		want[id] = true
+	}
+	raws, err := r.client.LRange(ctx, outboxDeadLetterKey, 0, -1).Result()
+	if err != nil {
+		return 0, err
+	}
+	requeued := 0
+	for _, raw := range raws {
+		var entry OutboxEntry
+		if err := json.Unmarshal([]byte(raw), &entry); err != nil || (len(want) > 0 && !want[entry.ID]) {
+			continue
+		}
+		entry.Attempts, entry.LastError, entry.FailedAt = 0, "", time.Time{}
+		next, err := json.Marshal(entry)
+		if err != nil {
+			return requeued, err
+		}
+		moved, err := moveEntryScript.Run(ctx, r.client, []string{outboxDeadLetterKey, outboxKey}, raw, string(next)).Int()
+		if err != nil {
+			return requeued, err
+		}
+		requeued += moved
+	}
+	return requeued, nil
+}
+
+// outboxBackoff is the delay before retrying an entry that has failed
+// attempts times: base doubling with each attempt, up to outboxMaxBackoff
+func outboxBackoff(base time.Duration, attempts int64) time.Duration {
+	backoff := base
+	for i := int64(1); i < attempts && backoff < outboxMaxBackoff; i++ {
+		backoff *= 2
+	}
+	return min(backoff, outboxMaxBackoff)
+}
+
+// newPageOutboxEntry returns the outbox entry for the new page webhook,
+// queued by the visit if it creates the page. There is none without a
+// webhook, or with the stream events backend, whose webhook consumer group
+// delivers page.created events instead.
+func (s *Server) newPageOutboxEntry(page string, now time.Time) (string, error) {
+	if s.pageWebhook == nil || s.cfg.EventsBackend == eventsBackendStream {
+		return "", nil
+	}
+	return newOutboxEntry(eventPageCreated, NewPageEvent{Event: eventPageCreated, Page: page, Timestamp: now.UTC()}, now)
+}
+
+// startOutbox returns the entries a previous run was delivering to the
+// outbox and starts the dispatchers and the reaper, unless there are no
+// webhooks to deliver
+func (s *Server) startOutbox(ctx context.Context) {
+	if s.pageWebhook == nil && s.cfg.PageWebhookRate <= 0 {
+		return
+	}
+	processing := outboxProcessingKey(s.cfg.InstanceName)
+	if n, err := s.redis.RecoverOutbox(ctx, processing); err != nil {
+		log.Printf("Failed to recover webhook outbox: %v", err)
+	} else if n > 0 {
+		log.Printf("Recovered %d webhook deliveries interrupted by the last shutdown", n)
+	}
+	if err := s.reapOutbox(ctx); err != nil {
+		log.Printf("Failed to reap webhook outbox: %v", err)
+	}
+	runPeriodic(ctx, "Webhook outbox reaper", outboxLeaseTTL/4, s.reapOutbox)
+	for i := 0; i < s.cfg.WebhookConcurrency; i++ {
+		runPeriodic(ctx, "Webhook outbox", s.cfg.WebhookPollInterval, s.dispatchOutbox)
+	}
+}
+
+// reapOutbox renews this instance's lease on its processing list and
+// returns the entries of instances whose lease has lapsed, which stopped
+// mid-delivery, to the outbox. A live instance that missed its renewals
+// may then deliver an entry twice.
+func (s *Server) reapOutbox(ctx context.Context) error {
+	if err := s.redis.RenewOutboxLease(ctx, s.cfg.InstanceName, outboxLeaseTTL); err != nil {
+		return err
+	}
+	n, err := s.redis.ReapOutbox(ctx, s.cfg.InstanceName)
+	if n > 0 {
+		log.Printf("Returned %d webhook deliveries of stopped instances to the outbox", n)
+	}
+	return err
+}
+
+// dispatchOutbox promotes the retries that are due and delivers every entry
+// on the outbox. WEBHOOK_CONCURRENCY dispatchers run at once, each claiming
+// its own entries, so a slow target only holds up one of them.
+func (s *Server) dispatchOutbox(ctx context.Context) error {
+	if err := s.redis.PromoteOutboxRetries(ctx, s.clock.Now()); err != nil {
+		return err
+	}
+	processing := outboxProcessingKey(s.cfg.InstanceName)
+	for ctx.Err() == nil {
+		raw, err := s.redis.ClaimOutbox(ctx, processing)
+		if isMissing(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := s.deliverOutbox(ctx, processing, raw); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// outboxWebhook returns the webhook an entry is posted to: its page's
+// webhook_url, or NEW_PAGE_WEBHOOK_URL
+func (s *Server) outboxWebhook(entry OutboxEntry) (*Webhook, error) {
+	if entry.URL != "" {
+		return &Webhook{url: entry.URL, client: s.webhookClient}, nil
+	}
+	if s.pageWebhook == nil {
+		return nil, errors.New("NEW_PAGE_WEBHOOK_URL is not set")
+	}
+	return s.pageWebhook, nil
+}
+
+// deliverOutbox posts a claimed entry, then drops it, schedules its retry,
+// or dead-letters it after WEBHOOK_MAX_ATTEMPTS failures. Per-page entries
+// log each outcome in their page's deliveries.
+func (s *Server) deliverOutbox(ctx context.Context, processing, raw string) error {
+	var entry OutboxEntry
+	if err := json.Unmarshal([]byte(raw), &entry); err != nil {
+		log.Printf("Dead-lettering undecodable outbox entry: %v", err)
+		return s.redis.DeadLetterOutbox(ctx, processing, raw, raw)
+	}
+	if entry.Event == eventPageVisitsCoalesced {
+		if err := s.resolveSummary(ctx, &entry); err != nil {
+			return err
+		}
+	}
+	hook, err := s.outboxWebhook(entry)
+	if err == nil {
+		err = hook.post(entry.Payload)
+	}
+	if err == nil {
+		s.logPageDelivery(ctx, entry, deliveryDelivered)
+		return s.redis.CompleteOutbox(ctx, processing, raw)
+	}
+
+	now := s.clock.Now()
+	entry.Attempts++
+	entry.LastError = err.Error()
+	if entry.Attempts >= s.cfg.WebhookMaxAttempts {
+		entry.FailedAt = now.UTC()
+	}
+	next, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if entry.Attempts >= s.cfg.WebhookMaxAttempts {
+		log.Printf("Webhook %s %s failed %d times, dead-lettering: %s", entry.Event, entry.ID, entry.Attempts, entry.LastError)
+		s.logPageDelivery(ctx, entry, deliveryDeadLettered)
+		return s.redis.DeadLetterOutbox(ctx, processing, raw, string(next))
+	}
+	backoff := outboxBackoff(s.cfg.WebhookRetryBase, entry.Attempts)
+	log.Printf("Webhook %s %s failed (attempt %d), retrying in %s: %s", entry.Event, entry.ID, entry.Attempts, backoff, entry.LastError)
+	s.logPageDelivery(ctx, entry, deliveryRetrying)
+	return s.redis.RetryOutbox(ctx, processing, raw, string(next), now.Add(backoff))
+}
+
+// DeadLetterEntry is a dead letter in the /admin/webhooks/deadletter response
+type DeadLetterEntry struct {
+	ID         string          `json:"id"`
+	Event      string          `json:"event"`
+	Payload    json.RawMessage `json:"payload"`
+	Attempts   int64           `json:"attempts"`
+	LastError  string          `json:"last_error"`
+	EnqueuedAt Timestamp       `json:"enqueued_at"`
+	FailedAt   Timestamp       `json:"failed_at"`
+}
+
+// DeadLettersResponse represents the /admin/webhooks/deadletter API response
+type DeadLettersResponse struct {
+	Total   int64             `json:"total"`
+	Entries []DeadLetterEntry `json:"entries"`
+}
+
+// RequeueRequest is the body of POST /admin/webhooks/deadletter/requeue
+type RequeueRequest struct {
+	// IDs selects the dead letters to requeue, all of them when empty
+	IDs []string `json:"ids"`
+}
+
+// handleGetDeadLetters returns the oldest ?count= dead-lettered webhooks
+func (s *Server) handleGetDeadLetters(c *gin.Context) {
+	count, err := strconv.ParseInt(c.DefaultQuery("count", "100"), 10, 64)
+	if err != nil || count < 1 || count > 1000 {
+		respondError(c, http.StatusBadRequest, "invalid_request", "count must be between 1 and 1000")
+		return
+	}
+
+	entries, total, err := s.redis.DeadLetters(c.Request.Context(), count)
+	if err != nil {
+		log.Printf("Error reading webhook dead letters: %v", err)
+		respondStoreError(c, err, "Failed to read webhook dead letters")
+		return
+	}
+
+	response := DeadLettersResponse{Total: total, Entries: make([]DeadLetterEntry, len(entries))}
+	for i, e := range entries {
+		response.Entries[i] = DeadLetterEntry{
+			ID:         e.ID,
+			Event:      e.Event,
+			Payload:    e.Payload,
+			Attempts:   e.Attempts,
+			LastError:  e.LastError,
+			EnqueuedAt: stamp(c, e.EnqueuedAt),
+			FailedAt:   stamp(c, e.FailedAt),
+		}
+	}
+	respondJSON(c, http.StatusOK, response)
+}
+
+// handleRequeueDeadLetters moves dead-lettered webhooks back onto the outbox
+func (s *Server) handleRequeueDeadLetters(c *gin.Context) {
+	var req RequeueRequest
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			respondError(c, http.StatusBadRequest, "invalid_request", "Body must be a requeue object")
+			return
+		}
+	}
+
+	requeued, err := s.redis.RequeueDeadLetters(c.Request.Context(), req.IDs)
+	if err != nil {
+		log.Printf("Error requeueing webhook dead letters: %v", err)
+		respondStoreError(c, err, "Failed to requeue webhook dead letters")
+		return
+	}
+	respondJSON(c, http.StatusOK, gin.H{"requeued": requeued})
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// flakyWebhook is a webhook endpoint answering 503 to the first failures
+// requests, recording the pages it accepted
+type flakyWebhook struct {
+	mu       sync.Mutex
+	failures int
+	requests int
+	accepted []string
+}
+
+func (f *flakyWebhook) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var event NewPageEvent
+	json.NewDecoder(r.Body).Decode(&event)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests++
+	if f.requests <= f.failures {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	f.accepted = append(f.accepted, event.Page)
+}
+
+func (f *flakyWebhook) state() (requests int, accepted []string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.requests, append([]string(nil), f.accepted...)
+}
+
+func (f *flakyWebhook) setFailures(n int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failures = n
+}
+
+// newOutboxServer starts a server delivering new page webhooks to hook
+func newOutboxServer(t *testing.T, hook http.Handler, tune func(*Config)) (*Server, http.Handler) {
+	t.Helper()
+	endpoint := httptest.NewServer(hook)
+	t.Cleanup(endpoint.Close)
+	_, redisClient := newTestRedis(t)
+	cfg := testConfig()
+	cfg.NewPageWebhookURL = endpoint.URL
+	if tune != nil {
+		tune(&cfg)
+	}
+	server := newTestServer(t, cfg, redisClient)
+	return server, server.Router()
+}
+
+func TestOutboxBackoff(t *testing.T) {
+	tests := map[int64]time.Duration{1: time.Second, 2: 2 * time.Second, 4: 8 * time.Second, 20: outboxMaxBackoff}
+	for attempts, want := range tests {
+		if got := outboxBackoff(time.Second, attempts); got != want {
+			t.Errorf("outboxBackoff(1s, %d) = %s, want %s", attempts, got, want)
+		}
+	}
+}
+
+func TestOutboxQueuedByCreatingVisit(t *testing.T) {
+	// No dispatcher, so the entries stay on the outbox
+	server, router := newOutboxServer(t, &flakyWebhook{}, func(cfg *Config) {
+		cfg.WebhookPollInterval = 0
+		cfg.ApproximatePagePrefixes = []string{"blog-"}
+	})
+	for i := 0; i < 3; i++ {
+		doRequest(router, "GET", "/visit/launch", "", nil)
+		doRequest(router, "GET", "/visit/blog-post", "", nil)
+	}
+
+	raws, err := server.redis.client.LRange(context.Background(), outboxKey, 0, -1).Result()
+	if err != nil || len(raws) != 2 {
+		t.Fatalf("Expected one entry per created page, got %v, %v", raws, err)
+	}
+	for i, want := range []string{"launch", "blog-post"} {
+		var entry OutboxEntry
+		var event NewPageEvent
+		if err := json.Unmarshal([]byte(raws[i]), &entry); err != nil || json.Unmarshal(entry.Payload, &event) != nil {
+			t.Fatalf("Expected an outbox entry, got %s", raws[i])
+		}
+		if entry.Event != eventPageCreated || entry.ID == "" || event.Page != want {
+			t.Errorf("Expected a page.created entry for %s, got %+v with %+v", want, entry, event)
+		}
+	}
+}
+
+func TestOutboxRetriesFlakyWebhook(t *testing.T) {
+	hook := &flakyWebhook{failures: 2}
+	server, router := newOutboxServer(t, hook, nil)
+	doRequest(router, "GET", "/visit/launch", "", nil)
+
+	waitFor(t, 2*time.Second, func() bool {
+		_, accepted := hook.state()
+		return len(accepted) > 0
+	})
+	requests, accepted := hook.state()
+	if requests != 3 || len(accepted) != 1 || accepted[0] != "launch" {
+		t.Errorf("Expected launch delivered on the third attempt, got %d requests and %v", requests, accepted)
+	}
+	// The entry is dropped once the webhook has answered
+	ctx := context.Background()
+	waitFor(t, time.Second, func() bool {
+		n, _ := server.redis.client.Exists(ctx, outboxProcessingKey("test")).Result()
+		return n == 0
+	})
+	for _, k := range []string{outboxKey, outboxRetryKey, outboxDeadLetterKey} {
+		if n, _ := server.redis.client.Exists(ctx, k).Result(); n != 0 {
+			t.Errorf("Expected %s empty after delivery", k)
+		}
+	}
+}
+
+func TestOutboxDeadLetters(t *testing.T) {
+	hook := &flakyWebhook{failures: 1000}
+	_, router := newOutboxServer(t, hook, nil)
+	doRequest(router, "GET", "/visit/launch", "", nil)
+
+	var dead DeadLettersResponse
+	waitFor(t, 2*time.Second, func() bool {
+		w := doRequest(router, "GET", "/admin/webhooks/deadletter", "", nil)
+		return json.Unmarshal(w.Body.Bytes(), &dead) == nil && dead.Total == 1
+	})
+	entry := dead.Entries[0]
+	if entry.Attempts != 3 || entry.LastError != "status 503" || entry.Event != eventPageCreated || entry.FailedAt.Time.IsZero() {
+		t.Errorf("Expected the entry dead-lettered after 3 attempts, got %+v", entry)
+	}
+	if requests, _ := hook.state(); requests != 3 {
+		t.Errorf("Expected no attempts after dead-lettering, got %d", requests)
+	}
+
+	hook.setFailures(0)
+	w := doRequest(router, "POST", "/admin/webhooks/deadletter/requeue", `{"ids": ["unknown"]}`, nil)
+	if w.Code != http.StatusOK || w.Body.String() != `{"requeued":0}` {
+		t.Errorf("Expected nothing requeued for an unknown ID, got %d: %s", w.Code, w.Body.String())
+	}
+	w = doRequest(router, "POST", "/admin/webhooks/deadletter/requeue", `{"ids": ["`+entry.ID+`"]}`, nil)
+	if w.Code != http.StatusOK || w.Body.String() != `{"requeued":1}` {
+		t.Fatalf("Expected the entry requeued, got %d: %s", w.Code, w.Body.String())
+	}
+	waitFor(t, 2*time.Second, func() bool {
+		_, accepted := hook.state()
+		return len(accepted) == 1
+	})
+	w = doRequest(router, "GET", "/admin/webhooks/deadletter", "", nil)
+	if err := json.Unmarshal(w.Body.Bytes(), &dead); err != nil || dead.Total != 0 || len(dead.Entries) != 0 {
+		t.Errorf("Expected no dead letters after the requeue, got %s", w.Body.String())
+	}
+
+	if w := doRequest(router, "GET", "/admin/webhooks/deadletter?count=0", "", nil); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for count=0, got %d", w.Code)
+	}
+}
+
+func TestOutboxRecoversInterruptedDeliveries(t *testing.T) {
+	hook := &flakyWebhook{}
+	endpoint := httptest.NewServer(hook)
+	defer endpoint.Close()
+
+	mr, redisClient := newTestRedis(t)
+	raw, err := newOutboxEntry(eventPageCreated, NewPageEvent{Event: eventPageCreated, Page: "launch"}, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Claimed by a run of this instance that died before delivering it
+	mr.RPush(outboxProcessingKey("test"), raw)
+
+	cfg := testConfig()
+	cfg.NewPageWebhookURL = endpoint.URL
+	newTestServer(t, cfg, redisClient)
+	waitFor(t, 2*time.Second, func() bool {
+		_, accepted := hook.state()
+		return len(accepted) == 1 && !mr.Exists(outboxProcessingKey("test"))
+	})
+}
+
+func TestOutboxReapsStoppedInstances(t *testing.T) {
+	hook := &flakyWebhook{}
+	endpoint := httptest.NewServer(hook)
+	defer endpoint.Close()
+
+	mr, redisClient := newTestRedis(t)
+	entry := func(page string) string {
+		raw, err := newOutboxEntry(eventPageCreated, NewPageEvent{Event: eventPageCreated, Page: page}, time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return raw
+	}
+	// One replica died mid-delivery, the other is still delivering
+	mr.RPush(outboxProcessingKey("gone"), entry("launch"))
+	mr.RPush(outboxProcessingKey("busy"), entry("pricing"))
+	mr.SAdd(outboxInstancesKey, "gone", "busy")
+	if err := redisClient.RenewOutboxLease(context.Background(), "busy", outboxLeaseTTL); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := testConfig()
+	cfg.NewPageWebhookURL = endpoint.URL
+	server := newTestServer(t, cfg, redisClient)
+	waitFor(t, 2*time.Second, func() bool {
+		_, accepted := hook.state()
+		return len(accepted) == 1 && accepted[0] == "launch"
+	})
+	if mr.Exists(outboxProcessingKey("gone")) || !mr.Exists(outboxProcessingKey("busy")) {
+		t.Error("Expected only the stopped replica's entries returned")
+	}
+	if ok, _ := mr.SIsMember(outboxInstancesKey, "test"); !ok || !mr.Exists(outboxLeaseKey("test")) {
+		t.Error("Expected this replica to hold a lease")
+	}
+
+	// Once its lease lapses the other replica's entries are returned too
+	mr.FastForward(outboxLeaseTTL)
+	if err := server.reapOutbox(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, 2*time.Second, func() bool {
+		_, accepted := hook.state()
+		return len(accepted) == 2
+	})
+	if members, _ := mr.Members(outboxInstancesKey); len(members) != 1 || members[0] != "test" {
+		t.Errorf("Expected the stopped replicas forgotten, got %v", members)
+	}
+}
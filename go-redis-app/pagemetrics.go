@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// pageMetricsBatch is how many leaderboard entries are read per round
+	// trip when summing the pages outside the top
+	pageMetricsBatch = 1000
+
+	// maxPageMetricsTop bounds PAGE_METRICS_TOP and ?top=
+	maxPageMetricsTop = 10000
+)
+
+// PageMetricsSnapshot is the per-page visit counts exposed at
+// /admin/metrics/pages: the top pages by leaderboard rank and the rest
+// summed
+type PageMetricsSnapshot struct {
+	Top         []PageCount
+	OtherVisits int64
+	OtherPages  int64
+}
+
+// PageMetricsSnapshot reads the top pages of the leaderboard and sums the
+// visits of every page ranked below them
+func (r *RedisClient) PageMetricsSnapshot(ctx context.Context, top int64) (PageMetricsSnapshot, error) {
+	entries, err := r.client.ZRevRangeWithScores(ctx, leaderboardKey, 0, top-1).Result()
+	if err != nil {
+		return PageMetricsSnapshot{}, err
+	}
+	snapshot := PageMetricsSnapshot{Top: appendPageCounts(make([]PageCount, 0, len(entries)), entries, nil, top)}
+	for start := top; ; start += pageMetricsBatch {
+		if entries, err = r.client.ZRevRangeWithScores(ctx, leaderboardKey, start, start+pageMetricsBatch-1).Result(); err != nil {
+			return PageMetricsSnapshot{}, err
+		}
+		for _, z := range entries {
+			snapshot.OtherVisits += int64(z.Score)
+			snapshot.OtherPages++
+		}
+		if len(entries) < pageMetricsBatch {
+			break
+		}
+	}
+	return snapshot, nil
+}
+
+// escapeLabel escapes a Prometheus label value: backslash, double quote and
+// line feed are the only escapes the text format has
+func escapeLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+// writePageMetrics writes the snapshot in the Prometheus text format
+func writePageMetrics(b *strings.Builder, env string, snapshot PageMetricsSnapshot) {
+	labels, prefix := "", ""
+	if env != "" {
+		prefix = "env=\"" + escapeLabel(env) + "\","
+		labels = "{" + strings.TrimSuffix(prefix, ",") + "}"
+	}
+	b.WriteString("# HELP page_visits_total Visits to each of the top pages by leaderboard rank.\n")
+	b.WriteString("# TYPE page_visits_total counter\n")
+	for _, p := range snapshot.Top {
+		fmt.Fprintf(b, "page_visits_total{%spage=\"%s\"} %d\n", prefix, escapeLabel(p.Page), p.Visits)
+	}
+	b.WriteString("# HELP page_visits_other_total Visits to every page ranked below the top pages.\n")
+	b.WriteString("# TYPE page_visits_other_total counter\n")
+	fmt.Fprintf(b, "page_visits_other_total%s %d\n", labels, snapshot.OtherVisits)
+	b.WriteString("# HELP page_visits_other_pages Pages ranked below the top pages.\n")
+	b.WriteString("# TYPE page_visits_other_pages gauge\n")
+	fmt.Fprintf(b, "page_visits_other_pages%s %d\n", labels, snapshot.OtherPages)
+}
+
+// handlePageMetrics serves a one-off Prometheus exposition of per-page
+// visit counts, kept off /metrics so its cardinality is only paid when
+// asked for. The exposition is cached for PAGE_METRICS_CACHE_TTL.
+func (s *Server) handlePageMetrics(c *gin.Context) {
+	top, ok := queryInt(c, "top", s.cfg.PageMetricsTop, 1, maxPageMetricsTop)
+	if !ok {
+		respondError(c, http.StatusBadRequest, "invalid_request", fmt.Sprintf("top must be between 1 and %d", maxPageMetricsTop))
+		return
+	}
+	key := "page-metrics:" + strconv.FormatInt(top, 10)
+	value, status, err := s.pageMetrics.Get(c.Request.Context(), key, func(ctx context.Context) (any, error) {
+		snapshot, err := s.redis.PageMetricsSnapshot(ctx, top)
+		if err != nil {
+			return nil, err
+		}
+		var b strings.Builder
+		writePageMetrics(&b, s.cfg.EnvName, snapshot)
+		return []byte(b.String()), nil
+	})
+	if err != nil {
+		log.Printf("Error getting page metrics: %v", err)
+		respondStoreError(c, err, "Failed to get page metrics")
+		return
+	}
+	setCacheStatus(c, status)
+	c.Data(http.StatusOK, "text/plain; version=0.0.4; charset=utf-8", value.([]byte))
+}
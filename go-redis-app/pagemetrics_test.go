@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// expositionLine is a comment or sample line of the Prometheus text format
+var expositionLine = regexp.MustCompile(`^(# (HELP|TYPE) [a-zA-Z_:][a-zA-Z0-9_:]* .+|[a-zA-Z_:][a-zA-Z0-9_:]*(\{([a-zA-Z_][a-zA-Z0-9_]*="([^"\\\n]|\\[\\"n])*",?)*\})? -?[0-9]+)$`)
+
+func TestWritePageMetrics(t *testing.T) {
+	var b strings.Builder
+	writePageMetrics(&b, "prod", PageMetricsSnapshot{
+		Top:         []PageCount{{Page: "home", Visits: 9}, {Page: `say "hi"\now`, Visits: 3}, {Page: "two\nlines", Visits: 1}},
+		OtherVisits: 4,
+		OtherPages:  2,
+	})
+	want := `# HELP page_visits_total Visits to each of the top pages by leaderboard rank.
+# TYPE page_visits_total counter
+page_visits_total{env="prod",page="home"} 9
+page_visits_total{env="prod",page="say \"hi\"\\now"} 3
+page_visits_total{env="prod",page="two\nlines"} 1
+# HELP page_visits_other_total Visits to every page ranked below the top pages.
+# TYPE page_visits_other_total counter
+page_visits_other_total{env="prod"} 4
+# HELP page_visits_other_pages Pages ranked below the top pages.
+# TYPE page_visits_other_pages gauge
+page_visits_other_pages{env="prod"} 2
+`
+	if b.String() != want {
+		t.Errorf("Expected:\n%s\ngot:\n%s", want, b.String())
+	}
+	for _, line := range strings.Split(strings.TrimSpace(b.String()), "\n") {
+		if !expositionLine.MatchString(line) {
+			t.Errorf("Invalid exposition line %q", line)
+		}
+	}
+}
+
+func TestPageMetricsEndpoint(t *testing.T) {
+	_, redisClient := newTestRedis(t)
+	ctx := context.Background()
+	// 2500 pages with page-n at n visits, past a batch of the remainder
+	members := make([]redis.Z, 2500)
+	var total int64
+	for i := range members {
+		members[i] = redis.Z{Member: fmt.Sprintf("page-%d", i+1), Score: float64(i + 1)}
+		total += int64(i + 1)
+	}
+	if err := redisClient.client.ZAdd(ctx, leaderboardKey, members...).Err(); err != nil {
+		t.Fatal(err)
+	}
+	cfg := testConfig()
+	cfg.AdminAPIKeys = map[string]string{"secret": "ops"}
+	cfg.PageMetricsTop, cfg.PageMetricsCacheTTL = 500, time.Minute
+	router := newTestServer(t, cfg, redisClient).Router()
+	admin := map[string]string{"X-API-Key": "secret"}
+
+	if w := doRequest(router, "GET", "/admin/metrics/pages", "", nil); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected the snapshot behind admin auth, got %d", w.Code)
+	}
+	w := doRequest(router, "GET", "/admin/metrics/pages", "", admin)
+	if w.Code != http.StatusOK || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain; version=0.0.4") {
+		t.Fatalf("Expected an exposition, got %d %v", w.Code, w.Header())
+	}
+	var pages int
+	var topVisits int64
+	for _, line := range strings.Split(strings.TrimSpace(w.Body.String()), "\n") {
+		if !expositionLine.MatchString(line) {
+			t.Fatalf("Invalid exposition line %q", line)
+		}
+		var page string
+		var n int64
+		if _, err := fmt.Sscanf(line, "page_visits_total{page=%q} %d", &page, &n); err == nil {
+			pages++
+			topVisits += n
+		}
+	}
+	// The top 500 are pages 2001 to 2500
+	if pages != 500 || topVisits != (2001+2500)*500/2 {
+		t.Errorf("Expected the top 500 pages, got %d with %d visits", pages, topVisits)
+	}
+	body := w.Body.String()
+	if !strings.Contains(body, `page_visits_total{page="page-2500"} 2500`) || strings.Contains(body, `page="page-2000"`) {
+		t.Errorf("Expected the top pages by rank, got:\n%s", body)
+	}
+	if want := fmt.Sprintf("page_visits_other_total %d\n", total-topVisits); !strings.Contains(body, want) || !strings.Contains(body, "page_visits_other_pages 2000\n") {
+		t.Errorf("Expected the other 2000 pages summed, got:\n%s", body)
+	}
+	if strings.Contains(doRequest(router, "GET", "/metrics", "", nil).Body.String(), "page_visits_total") {
+		t.Error("Expected per-page counts kept off /metrics")
+	}
+
+	// Snapshots are cached
+	redisClient.client.ZIncrBy(ctx, leaderboardKey, 1000, "page-1")
+	w = doRequest(router, "GET", "/admin/metrics/pages", "", admin)
+	if w.Body.String() != body || w.Header().Get("Cache-Status") != cacheHit {
+		t.Errorf("Expected the cached snapshot, got Cache-Status %q", w.Header().Get("Cache-Status"))
+	}
+
+	w = doRequest(router, "GET", "/admin/metrics/pages?top=3000", "", admin)
+	if !strings.Contains(w.Body.String(), "page_visits_other_total 0\n") || !strings.Contains(w.Body.String(), `page="page-1"} 1001`) {
+		t.Errorf("Expected every page in the top with ?top=3000, got a %d byte body", w.Body.Len())
+	}
+	for _, query := range []string{"top=0", "top=10001", "top=x"} {
+		if w := doRequest(router, "GET", "/admin/metrics/pages?"+query, "", admin); w.Code != http.StatusBadRequest {
+			t.Errorf("Expected 400 for %q, got %d", query, w.Code)
+		}
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+// leaderboardKey is the sorted set of pages scored by visit count
+const leaderboardKey = "visits:leaderboard"
+
+// PageCount is a page with its visit count
+type PageCount struct {
+	Page      string     `json:"page"`
+	Visits    int64      `json:"visits"`
+	LastVisit *Timestamp `json:"last_visit,omitempty"`
+}
+
+// PagesResponse represents a list of pages
+type PagesResponse struct {
+	Pages       []PageCount `json:"pages"`
+	Total       int         `json:"total"`
+	Approximate bool        `json:"approximate,omitempty"`
+	Next        string      `json:"next,omitempty"`
+	Prev        string      `json:"prev,omitempty"`
+}
+
+// TopPages returns up to limit pages by visit count, skipping excluded pages.
+// With sketches enabled the counts come from the Top-K and are approximate.
+func (r *RedisClient) TopPages(ctx context.Context, limit int64, exclude map[string]bool) ([]PageCount, bool, error) {
+	if r.sketches {
+		pages, err := r.topKPages(ctx, limit, exclude)
+		return pages, true, err
+	}
+
+	pages := make([]PageCount, 0, limit)
+	batch := limit + int64(len(exclude))
+	for start := int64(0); int64(len(pages)) < limit; start += batch {
+		entries, err := r.client.ZRevRangeWithScores(ctx, leaderboardKey, start, start+batch-1).Result()
+		if err != nil {
+			return nil, false, err
+		}
+		pages = appendPageCounts(pages, entries, exclude, limit)
+		if int64(len(entries)) < batch {
+			break
+		}
+	}
+	return pages, false, nil
+}
+
+// appendPageCounts converts sorted set entries, stopping once limit is reached
+func appendPageCounts(pages []PageCount, entries []redis.Z, exclude map[string]bool, limit int64) []PageCount {
+	for _, z := range entries {
+		if int64(len(pages)) >= limit {
+			break
+		}
+		page, _ := z.Member.(string)
+		if exclude[page] {
+			continue
+		}
+		pages = append(pages, PageCount{Page: page, Visits: int64(z.Score)})
+	}
+	return pages
+}
+
+// canReadPrivate reports whether the caller authenticated with read permission
+func canReadPrivate(c *gin.Context) bool {
+	return c.GetBool(authenticatedKey) && callerPermission(c) >= PermRead
+}
+
+// pageHidden reports whether the page is private and the caller may not read it
+func (s *Server) pageHidden(c *gin.Context, page string) (bool, error) {
+	if canReadPrivate(c) {
+		return false, nil
+	}
+	meta, err := s.meta.GetMeta(c.Request.Context(), page)
+	if err != nil {
+		return false, err
+	}
+	return meta.Visibility == visibilityPrivate, nil
+}
+
+// hiddenPages returns the pages the caller may not see in listings
+func (s *Server) hiddenPages(c *gin.Context) (map[string]bool, error) {
+	if canReadPrivate(c) {
+		return nil, nil
+	}
+	return s.meta.PrivatePages(c.Request.Context())
+}
+
+// queryInt parses an integer query parameter within [min, max]
+func queryInt(c *gin.Context, name string, fallback, min, max int64) (int64, bool) {
+	value := c.Query(name)
+	if value == "" {
+		return fallback, true
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n < min || n > max {
+		return 0, false
+	}
+	return n, true
+}
+
+// handleTopPages returns the most visited pages
+func (s *Server) handleTopPages(c *gin.Context) {
+	limit, ok := queryInt(c, "limit", 10, 1, 1000)
+	if !ok {
+		respondError(c, http.StatusBadRequest, "invalid_request", "limit must be between 1 and 1000")
+		return
+	}
+
+	// Private pages are only excluded for anonymous callers, so they are
+	// cached separately. Stale entries are refreshed after the response, so
+	// the loader keeps the audience, never the pooled context.
+	private := canReadPrivate(c)
+	key := fmt.Sprintf("top:%d:%t", limit, private)
+	load := func(ctx context.Context) (any, error) {
+		return s.topPages(ctx, limit, private)
+	}
+	value, status, err := s.aggregates.Get(c.Request.Context(), key, s.shared.wrap(key, decodePagesResponse, load))
+	if err != nil {
+		log.Printf("Error getting top pages: %v", err)
+		respondStoreError(c, err, "Failed to get top pages")
+		return
+	}
+
+	setCacheStatus(c, status)
+	respondJSON(c, http.StatusOK, value)
+}
+
+// decodePagesResponse decodes a top pages response from the shared cache
+func decodePagesResponse(b []byte) (any, error) {
+	var resp PagesResponse
+	err := json.Unmarshal(b, &resp)
+	return resp, err
+}
+
+// topPages computes the top pages response, excluding private pages unless
+// the caller may read them
+func (s *Server) topPages(ctx context.Context, limit int64, private bool) (PagesResponse, error) {
+	var hidden map[string]bool
+	if !private {
+		var err error
+		if hidden, err = s.meta.PrivatePages(ctx); err != nil {
+			return PagesResponse{}, err
+		}
+	}
+	pages, approximate, err := s.redis.TopPages(ctx, limit, hidden)
+	if err != nil {
+		return PagesResponse{}, err
+	}
+	return PagesResponse{Pages: pages, Total: len(pages), Approximate: approximate}, nil
+}
+
+// handleGetMeta returns the metadata for a page
+func (s *Server) handleGetMeta(c *gin.Context) {
+	page := c.Param("page")
+	hidden, err := s.pageHidden(c, page)
+	if err != nil {
+		log.Printf("Error getting page metadata: %v", err)
+		respondStoreError(c, err, "Failed to get page metadata")
+		return
+	}
+	if hidden {
+		respondError(c, http.StatusNotFound, "not_found", "Page not found")
+		return
+	}
+
+	meta, err := s.meta.GetMeta(c.Request.Context(), page)
+	if err == nil {
+		meta.SuspectedBot, meta.TrafficAnomaly, err = s.redis.PageFlags(c.Request.Context(), page)
+	}
+	if err != nil {
+		log.Printf("Error getting page metadata: %v", err)
+		respondStoreError(c, err, "Failed to get page metadata")
+		return
+	}
+	meta.WebhookURL = ""
+	respondJSON(c, http.StatusOK, meta)
+}
+
+// handlePutMeta replaces the metadata for a page. The page's webhook is
+// kept unless the body sets webhook_url, as PUT /admin/pages/:page/webhook
+// does.
+func (s *Server) handlePutMeta(c *gin.Context) {
+	var body struct {
+		PageMeta
+		WebhookURL *string `json:"webhook_url"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		respondError(c, http.StatusBadRequest, "invalid_request", "Body must be a page metadata object")
+		return
+	}
+	meta := body.PageMeta
+	if body.WebhookURL != nil {
+		meta.WebhookURL = *body.WebhookURL
+	} else {
+		previous, err := s.meta.GetMeta(c.Request.Context(), c.Param("page"))
+		if err != nil {
+			log.Printf("Error getting page metadata: %v", err)
+			respondStoreError(c, err, "Failed to set page metadata")
+			return
+		}
+		meta.WebhookURL = previous.WebhookURL
+	}
+	if err := meta.Validate(); err != nil {
+		respondError(c, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+
+	err := s.meta.SetMeta(c.Request.Context(), c.Param("page"), meta)
+	switch {
+	case errors.Is(err, errGroupNotFound):
+		respondError(c, http.StatusBadRequest, "unknown_group", fmt.Sprintf("Group %q is not defined", meta.Group))
+		return
+	case err != nil:
+		log.Printf("Error setting page metadata: %v", err)
+		respondStoreError(c, err, "Failed to set page metadata")
+		return
+	}
+	s.metaCache.invalidate(c.Param("page"))
+	if meta.overridesPolicy() || s.groups.Overridden(c.Param("page")) {
+		// The replicas only read the metadata of pages they know override
+		s.publishGroups(c.Request.Context())
+	}
+	s.invalidateAggregates(c.Request.Context())
+	c.JSON(http.StatusOK, meta)
+}
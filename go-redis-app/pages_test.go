@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func decodePages(t *testing.T, body []byte) PagesResponse {
+	t.Helper()
+	var resp PagesResponse
+	if err := json.Unmarshal(body, &resp); err != nil {
+		t.Fatalf("Failed to decode pages: %v", err)
+	}
+	return resp
+}
+
+func pageNames(pages []PageCount) []string {
+	names := make([]string, len(pages))
+	for i, p := range pages {
+		names[i] = p.Page
+	}
+	return names
+}
+
+func TestTopPagesAndListing(t *testing.T) {
+	_, redisClient := newTestRedis(t)
+	router := newTestServer(t, testConfig(), redisClient).Router()
+
+	for page, n := range map[string]int{"home": 3, "about": 1, "pricing": 2} {
+		for i := 0; i < n; i++ {
+			doRequest(router, "GET", "/visit/"+page, "", nil)
+		}
+	}
+
+	top := decodePages(t, doRequest(router, "GET", "/pages/top?limit=2", "", nil).Body.Bytes())
+	if got := pageNames(top.Pages); len(got) != 2 || got[0] != "home" || got[1] != "pricing" {
+		t.Errorf("Unexpected top pages: %v", got)
+	}
+
+	list := decodePages(t, doRequest(router, "GET", "/pages?offset=1&limit=1", "", nil).Body.Bytes())
+	if list.Total != 3 || len(list.Pages) != 1 || list.Pages[0].Page != "home" || list.Pages[0].Visits != 3 {
+		t.Errorf("Unexpected listing: %+v", list)
+	}
+}
+
+func TestPrivatePages(t *testing.T) {
+	_, redisClient := newTestRedis(t)
+	cfg := testConfig()
+	cfg.JWTSecret = "jwt-secret"
+	router := newTestServer(t, cfg, redisClient).Router()
+	reader := map[string]string{"Authorization": "Bearer " + mintHS256(t, cfg.JWTSecret, testClaims("read", time.Hour))}
+	admin := map[string]string{"Authorization": "Bearer " + mintHS256(t, cfg.JWTSecret, testClaims("admin", time.Hour))}
+
+	doRequest(router, "GET", "/visit/home", "", nil)
+	w := doRequest(router, "PUT", "/admin/pages/internal/meta", `{"visibility": "private"}`, admin)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200 setting metadata, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := doRequest(router, "PUT", "/admin/pages/internal/meta", `{"visibility": "secret"}`, admin); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for invalid visibility, got %d", w.Code)
+	}
+
+	// Increments still work anonymously
+	for i := 0; i < 5; i++ {
+		if w := doRequest(router, "GET", "/visit/internal", "", nil); w.Code != http.StatusOK {
+			t.Fatalf("Expected private page visit to succeed, got %d", w.Code)
+		}
+	}
+
+	tests := []struct {
+		path    string
+		headers map[string]string
+		status  int
+	}{
+		{"/visits/internal", nil, http.StatusNotFound},
+		{"/visits/internal", reader, http.StatusOK},
+		{"/pages/internal/meta", nil, http.StatusNotFound},
+		{"/pages/internal/meta", reader, http.StatusOK},
+		{"/visits/home", nil, http.StatusOK},
+	}
+	for _, tt := range tests {
+		if w := doRequest(router, "GET", tt.path, "", tt.headers); w.Code != tt.status {
+			t.Errorf("GET %s (auth=%t): expected %d, got %d", tt.path, tt.headers != nil, tt.status, w.Code)
+		}
+	}
+
+	anonTop := decodePages(t, doRequest(router, "GET", "/pages/top", "", nil).Body.Bytes())
+	if got := pageNames(anonTop.Pages); len(got) != 1 || got[0] != "home" {
+		t.Errorf("Expected anonymous top pages to hide internal, got %v", got)
+	}
+	authTop := decodePages(t, doRequest(router, "GET", "/pages/top", "", reader).Body.Bytes())
+	if got := pageNames(authTop.Pages); len(got) != 2 || got[0] != "internal" {
+		t.Errorf("Expected authenticated top pages to include internal, got %v", got)
+	}
+
+	anonList := decodePages(t, doRequest(router, "GET", "/pages", "", nil).Body.Bytes())
+	if anonList.Total != 1 {
+		t.Errorf("Expected anonymous listing to hide internal, got %+v", anonList)
+	}
+	authList := decodePages(t, doRequest(router, "GET", "/pages", "", reader).Body.Bytes())
+	if authList.Total != 2 {
+		t.Errorf("Expected authenticated listing to include internal, got %+v", authList)
+	}
+
+	// Making the page public again restores anonymous reads
+	doRequest(router, "PUT", "/admin/pages/internal/meta", `{"visibility": "public"}`, admin)
+	if w := doRequest(router, "GET", "/visits/internal", "", nil); w.Code != http.StatusOK {
+		t.Errorf("Expected public page to be readable, got %d", w.Code)
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// pageTokenParam is the query parameter carrying a pagination token
+const pageTokenParam = "page_token"
+
+// Listings paginated with page tokens
+const (
+	listingPages   = "pages"
+	listingAudit   = "audit"
+	listingArchive = "archive"
+)
+
+var (
+	errPageTokenInvalid  = errors.New("page_token is invalid")
+	errPageTokenMismatch = errors.New("page_token was issued for a different query")
+)
+
+// pageTokenState is what a page token carries: the listing that issued it, a
+// digest of the query's filters and sort, and where the next page starts in
+// the backend, such as an offset or a stream ID
+type pageTokenState struct {
+	Listing string `json:"l"`
+	Query   string `json:"q"`
+	Cursor  string `json:"c"`
+}
+
+// PageTokens issues and checks the opaque pagination tokens of the listings.
+// A token is its base64 state and the state's HMAC-SHA256, so clients can
+// neither edit the cursor nor replay it against another listing or query.
+type PageTokens struct {
+	key []byte
+}
+
+// newPageTokens signs tokens with secret, or with a random key when it is
+// empty, in which case only this process accepts the tokens it issued
+func newPageTokens(secret string) *PageTokens {
+	key := []byte(secret)
+	if secret == "" {
+		key = make([]byte, 32)
+		rand.Read(key)
+	}
+	return &PageTokens{key: key}
+}
+
+// queryDigest condenses a listing's filters and sort, which its tokens are
+// bound to
+func queryDigest(parts ...string) string {
+	sum := sha256.Sum256([]byte(strings.Join(parts, "\x00")))
+	return base64.RawURLEncoding.EncodeToString(sum[:12])
+}
+
+// sign returns the HMAC of a token's encoded state
+func (p *PageTokens) sign(payload string) []byte {
+	mac := hmac.New(sha256.New, p.key)
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
+
+// Issue returns the token resuming the listing's query at cursor
+func (p *PageTokens) Issue(listing, query, cursor string) string {
+	raw, _ := json.Marshal(pageTokenState{Listing: listing, Query: query, Cursor: cursor})
+	payload := base64.RawURLEncoding.EncodeToString(raw)
+	return payload + "." + base64.RawURLEncoding.EncodeToString(p.sign(payload))
+}
+
+// Parse returns the cursor of a token issued for the listing's query:
+// errPageTokenInvalid when it was not issued by us or was altered, and
+// errPageTokenMismatch when it belongs to another listing or query
+func (p *PageTokens) Parse(token, listing, query string) (string, error) {
+	payload, signature, ok := strings.Cut(token, ".")
+	if !ok {
+		return "", errPageTokenInvalid
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil || !hmac.Equal(mac, p.sign(payload)) {
+		return "", errPageTokenInvalid
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return "", errPageTokenInvalid
+	}
+	var state pageTokenState
+	if err := json.Unmarshal(raw, &state); err != nil {
+		return "", errPageTokenInvalid
+	}
+	if state.Listing != listing || state.Query != query {
+		return "", errPageTokenMismatch
+	}
+	return state.Cursor, nil
+}
+
+// pageCursor reads the ?page_token= of a listing's query, responding 400
+// when it can't be used. ok is false after responding; cursor is empty when
+// no token was sent.
+func (s *Server) pageCursor(c *gin.Context, listing, query string) (cursor string, ok bool) {
+	token := c.Query(pageTokenParam)
+	if token == "" {
+		return "", true
+	}
+	cursor, err := s.pageTokens.Parse(token, listing, query)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, "invalid_page_token", err.Error())
+		return "", false
+	}
+	return cursor, true
+}
+
+// offsetCursor is pageCursor for the listings paginated by offset, 0 when no
+// token was sent
+func (s *Server) offsetCursor(c *gin.Context, listing, query string) (int64, bool) {
+	cursor, ok := s.pageCursor(c, listing, query)
+	if !ok || cursor == "" {
+		return 0, ok
+	}
+	offset, err := strconv.ParseInt(cursor, 10, 64)
+	if err != nil || offset < 0 {
+		respondError(c, http.StatusBadRequest, "invalid_page_token", errPageTokenInvalid.Error())
+		return 0, false
+	}
+	return offset, true
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestPageTokenRoundTrip(t *testing.T) {
+	tokens := newPageTokens("secret")
+	digest := queryDigest("visits", "true", "blog/", "0")
+	token := tokens.Issue(listingPages, digest, "200")
+	if cursor, err := tokens.Parse(token, listingPages, digest); err != nil || cursor != "200" {
+		t.Fatalf("Expected cursor 200, got %q, %v", cursor, err)
+	}
+	if strings.Contains(token, "200") {
+		t.Errorf("Expected an opaque token, got %q", token)
+	}
+
+	// Another replica with the same secret accepts it, one without doesn't
+	if _, err := newPageTokens("secret").Parse(token, listingPages, digest); err != nil {
+		t.Errorf("Expected a shared secret to accept the token: %v", err)
+	}
+	if _, err := newPageTokens("").Parse(token, listingPages, digest); err != errPageTokenInvalid {
+		t.Errorf("Expected another key to reject the token, got %v", err)
+	}
+
+	if _, err := tokens.Parse(token, listingAudit, digest); err != errPageTokenMismatch {
+		t.Errorf("Expected another listing to be rejected, got %v", err)
+	}
+	if _, err := tokens.Parse(token, listingPages, queryDigest("visits", "false", "blog/", "0")); err != errPageTokenMismatch {
+		t.Errorf("Expected another query to be rejected, got %v", err)
+	}
+}
+
+func TestPageTokenTampering(t *testing.T) {
+	tokens := newPageTokens("secret")
+	token := tokens.Issue(listingArchive, "", "100")
+	payload, signature, _ := strings.Cut(token, ".")
+
+	// Rewriting the cursor keeps a well-formed state but breaks the signature
+	raw, _ := base64.RawURLEncoding.DecodeString(payload)
+	var state pageTokenState
+	json.Unmarshal(raw, &state)
+	state.Cursor = "0"
+	raw, _ = json.Marshal(state)
+	forged := base64.RawURLEncoding.EncodeToString(raw) + "." + signature
+
+	for _, bad := range []string{"", "garbage", payload, payload + ".", forged, token + "x", "!!." + signature} {
+		if _, err := tokens.Parse(bad, listingArchive, ""); err != errPageTokenInvalid {
+			t.Errorf("Parse(%q): expected errPageTokenInvalid, got %v", bad, err)
+		}
+	}
+}
+
+func TestPageTokensOnListings(t *testing.T) {
+	_, redisClient := newTestRedis(t)
+	router := newTestServer(t, testConfig(), redisClient).Router()
+	seedListing(t, router, redisClient)
+
+	resp := decodePages(t, doRequest(router, "GET", "/pages?sort=visits&limit=2", "", nil).Body.Bytes())
+	next, _ := url.Parse(resp.Next)
+	token := next.Query().Get(pageTokenParam)
+
+	for _, tt := range []struct {
+		name, query, code string
+	}{
+		{"other sort", "sort=name&limit=2", "invalid_page_token"},
+		{"other filter", "sort=visits&limit=2&min_visits=1", "invalid_page_token"},
+		{"with offset", "sort=visits&limit=2&offset=1", "invalid_request"},
+		{"tampered", "sort=visits&limit=2&" + pageTokenParam + "=x" + token[1:], "invalid_page_token"},
+	} {
+		query := tt.query
+		if !strings.Contains(query, pageTokenParam) {
+			query += "&" + pageTokenParam + "=" + token
+		}
+		w := doRequest(router, "GET", "/pages?"+query, "", nil)
+		if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), tt.code) {
+			t.Errorf("%s: expected 400 %s, got %d %s", tt.name, tt.code, w.Code, w.Body.String())
+		}
+	}
+	// The limit may change from one page to the next
+	if w := doRequest(router, "GET", "/pages?sort=visits&limit=3&"+pageTokenParam+"="+token, "", nil); w.Code != http.StatusOK {
+		t.Errorf("Expected a new limit accepted, got %d %s", w.Code, w.Body.String())
+	}
+
+	// A pages token is no good for the audit log
+	if w := doRequest(router, "GET", "/admin/audit?"+pageTokenParam+"="+token, "", nil); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected another listing's token rejected, got %d", w.Code)
+	}
+}
+
+func TestArchiveListPagination(t *testing.T) {
+	_, redisClient := newTestRedis(t)
+	router := newTestServer(t, testConfig(), redisClient).Router()
+	for _, page := range []string{"a", "b", "c"} {
+		doRequest(router, "GET", "/visit/"+page, "", nil)
+		if w := doRequest(router, "POST", "/admin/pages/"+page+"/archive", "", nil); w.Code != http.StatusOK {
+			t.Fatalf("Archive %s: %d %s", page, w.Code, w.Body.String())
+		}
+	}
+
+	seen := map[string]bool{}
+	path := "/admin/archive?limit=2"
+	for pages := 0; path != ""; pages++ {
+		var list ArchiveListResponse
+		json.Unmarshal(doRequest(router, "GET", path, "", nil).Body.Bytes(), &list)
+		if list.Total != 3 || len(list.Pages) == 0 || pages > 1 {
+			t.Fatalf("Unexpected archive page %+v", list)
+		}
+		for _, p := range list.Pages {
+			seen[p.Page] = true
+		}
+		path = ""
+		if list.NextToken != "" {
+			path = "/admin/archive?limit=2&" + pageTokenParam + "=" + list.NextToken
+		}
+	}
+	if len(seen) != 3 {
+		t.Errorf("Expected to page through 3 archived pages, got %v", seen)
+	}
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+// Per-page webhook event types
+const (
+	eventPageVisited         = "page.visited"
+	eventPageVisitsCoalesced = "page.visits.coalesced"
+)
+
+// Page delivery statuses, as logged after each attempt
+const (
+	deliveryDelivered    = "delivered"
+	deliveryRetrying     = "retrying"
+	deliveryDeadLettered = "dead_lettered"
+)
+
+const (
+	// pageWebhookWindow is the period PAGE_WEBHOOK_RATE counts deliveries in
+	pageWebhookWindow = time.Minute
+
+	// pageWebhookWindowTTL keeps a window's counter long after it closes, so
+	// its summary can still read it when delivered late
+	pageWebhookWindowTTL = time.Hour
+
+	// pageDeliveryLogLen is the number of recent deliveries kept per page
+	pageDeliveryLogLen = 20
+)
+
+// pageWebhookWindowKey counts a page's visits in the window starting at start
+func pageWebhookWindowKey(page string, start time.Time) string {
+	return key("webhooks", "window", strconv.FormatInt(start.Unix(), 10), page)
+}
+
+// pageDeliveriesKey is the list of a page's recent deliveries, newest first
+func pageDeliveriesKey(page string) string {
+	return key("webhooks", "deliveries", page)
+}
+
+// PageVisitEvent is the payload posted to a page's webhook_url for a visit
+type PageVisitEvent struct {
+	Event string `json:"event"`
+	VisitEvent
+}
+
+// PageVisitSummary is posted once a window closes in place of the visits
+// past PAGE_WEBHOOK_RATE in it
+type PageVisitSummary struct {
+	Event       string    `json:"event"`
+	Page        string    `json:"page"`
+	Coalesced   int64     `json:"coalesced"`
+	Limit       int64     `json:"limit"`
+	WindowStart time.Time `json:"window_start"`
+	WindowEnd   time.Time `json:"window_end"`
+}
+
+// PageDelivery is one attempt at delivering a page's webhook
+type PageDelivery struct {
+	ID       string    `json:"id"`
+	Event    string    `json:"event"`
+	Status   string    `json:"status"`
+	Attempts int64     `json:"attempts"`
+	Error    string    `json:"error,omitempty"`
+	At       time.Time `json:"at"`
+}
+
+// pageWebhookScript counts a visit in its page's window and queues its
+// event while the window has had at most ARGV[1]. The first visit past that
+// schedules the window's summary on the retry set for when the window
+// closes; later ones are only counted. It returns the window's count.
+//
+// KEYS[1] window counter, KEYS[2] outbox, KEYS[3] retry set; ARGV[1] limit,
+// ARGV[2] entry, ARGV[3] summary entry, ARGV[4] window end in Unix
+// milliseconds, ARGV[5] counter TTL in milliseconds
+var pageWebhookScript = redis.NewScript(`
+local n = redis.call('INCR', KEYS[1])
+if n == 1 then
+	redis.call('PEXPIRE', KEYS[1], ARGV[5])
+end
+local limit = tonumber(ARGV[1])
+if n <= limit then
+	redis.call('RPUSH', KEYS[2], ARGV[2])
+elseif n == limit + 1 then
+	redis.call('ZADD', KEYS[3], ARGV[4], ARGV[3])
+end
+return n
+`)
+
+// newPageWebhookEntry encodes an outbox entry posting the event payload to
+// a page's webhook
+func newPageWebhookEntry(page, url, event string, payload interface{}, now time.Time) (string, error) {
+	return encodeOutboxEntry(OutboxEntry{Event: event, Page: page, URL: url}, payload, now)
+}
+
+// QueuePageWebhook counts a visit in its page's window starting at start,
+// queueing entry while the window is within limit and scheduling summary
+// for the window's end on the first visit past it. It returns the window's
+// count.
+func (r *RedisClient) QueuePageWebhook(ctx context.Context, page string, start time.Time, limit int64, entry, summary string) (int64, error) {
+	keys := []string{pageWebhookWindowKey(page, start), outboxKey, outboxRetryKey}
+	end := start.Add(pageWebhookWindow).UnixMilli()
+	return pageWebhookScript.Run(ctx, r.client, keys, limit, entry, summary, end, pageWebhookWindowTTL.Milliseconds()).Int64()
+}
+
+// PageWebhookWindow returns a page's visits in the window starting at start
+func (r *RedisClient) PageWebhookWindow(ctx context.Context, page string, start time.Time) (int64, error) {
+	n, err := r.client.Get(ctx, pageWebhookWindowKey(page, start)).Int64()
+	return n, ignoreMissing(err)
+}
+
+// LogPageDelivery records a page's delivery attempt, keeping the last
+// pageDeliveryLogLen
+func (r *RedisClient) LogPageDelivery(ctx context.Context, page string, delivery PageDelivery) error {
+	raw, err := json.Marshal(delivery)
+	if err != nil {
+		return err
+	}
+	_, err = r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.LPush(ctx, pageDeliveriesKey(page), raw)
+		pipe.LTrim(ctx, pageDeliveriesKey(page), 0, pageDeliveryLogLen-1)
+		return nil
+	})
+	return err
+}
+
+// PageDeliveries returns a page's recent delivery attempts, newest first.
+// Entries that don't decode are skipped.
+func (r *RedisClient) PageDeliveries(ctx context.Context, page string) ([]PageDelivery, error) {
+	raws, err := r.client.LRange(ctx, pageDeliveriesKey(page), 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	deliveries := make([]PageDelivery, 0, len(raws))
+	for _, raw := range raws {
+		var delivery PageDelivery
+		if err := json.Unmarshal([]byte(raw), &delivery); err != nil {
+			log.Printf("Skipping undecodable page delivery: %v", err)
+			continue
+		}
+		deliveries = append(deliveries, delivery)
+	}
+	return deliveries, nil
+}
+
+// queuePageWebhook queues a counted visit's event for its page's
+// webhook_url, coalescing the visits past PAGE_WEBHOOK_RATE a minute into
+// one summary. Failures are logged: the webhook never fails a visit.
+func (s *Server) queuePageWebhook(ctx context.Context, event PageVisitEvent) {
+	if s.cfg.PageWebhookRate <= 0 {
+		return
+	}
+	meta, err := s.cachedMeta(ctx, event.Page)
+	if err != nil || meta.WebhookURL == "" {
+		if err != nil {
+			log.Printf("Skipping page webhook: %v", err)
+		}
+		return
+	}
+
+	now := s.clock.Now()
+	start := event.Timestamp.Truncate(pageWebhookWindow)
+	entry, err := newPageWebhookEntry(event.Page, meta.WebhookURL, eventPageVisited, event, now)
+	if err != nil {
+		log.Printf("Skipping page webhook: %v", err)
+		return
+	}
+	summary, err := newPageWebhookEntry(event.Page, meta.WebhookURL, eventPageVisitsCoalesced, PageVisitSummary{
+		Event:       eventPageVisitsCoalesced,
+		Page:        event.Page,
+		Limit:       s.cfg.PageWebhookRate,
+		WindowStart: start.UTC(),
+		WindowEnd:   start.Add(pageWebhookWindow).UTC(),
+	}, now)
+	if err != nil {
+		log.Printf("Skipping page webhook: %v", err)
+		return
+	}
+	if _, err := s.redis.QueuePageWebhook(ctx, event.Page, start, s.cfg.PageWebhookRate, entry, summary); err != nil {
+		log.Printf("Error queueing page webhook: %v", err)
+	}
+}
+
+// resolveSummary fills in a coalesced summary's count from its window's
+// counter. It is only delivered once the window has closed, so the count
+// is final; past the first attempt the entry already carries it.
+func (s *Server) resolveSummary(ctx context.Context, entry *OutboxEntry) error {
+	var summary PageVisitSummary
+	if err := json.Unmarshal(entry.Payload, &summary); err != nil || summary.Coalesced > 0 {
+		return err
+	}
+	visits, err := s.redis.PageWebhookWindow(ctx, entry.Page, summary.WindowStart)
+	if err != nil {
+		return err
+	}
+	// The summary is only scheduled past the limit, so it covers at least
+	// one visit even if the counter has expired
+	summary.Coalesced = max(visits-summary.Limit, 1)
+	entry.Payload, err = json.Marshal(summary)
+	return err
+}
+
+// logPageDelivery records the outcome of a per-page webhook attempt in its
+// page's deliveries, logging failures
+func (s *Server) logPageDelivery(ctx context.Context, entry OutboxEntry, status string) {
+	if entry.Page == "" {
+		return
+	}
+	delivery := PageDelivery{ID: entry.ID, Event: entry.Event, Status: status, Attempts: entry.Attempts, At: s.clock.Now().UTC()}
+	if status != deliveryDelivered {
+		delivery.Error = entry.LastError
+	}
+	if err := s.redis.LogPageDelivery(ctx, entry.Page, delivery); err != nil {
+		log.Printf("Error logging page webhook delivery: %v", err)
+	}
+}
+
+// PageWebhookRequest is the body of PUT /admin/pages/:page/webhook
+type PageWebhookRequest struct {
+	URL string `json:"url"`
+}
+
+// PageDeliveryEntry is a delivery in the /admin/pages/:page/webhook response
+type PageDeliveryEntry struct {
+	ID       string    `json:"id"`
+	Event    string    `json:"event"`
+	Status   string    `json:"status"`
+	Attempts int64     `json:"attempts"`
+	Error    string    `json:"error,omitempty"`
+	At       Timestamp `json:"at"`
+}
+
+// PageWebhookResponse represents the /admin/pages/:page/webhook API response
+type PageWebhookResponse struct {
+	Page          string `json:"page"`
+	URL           string `json:"url,omitempty"`
+	RatePerMinute int64  `json:"rate_per_minute"`
+
+	// WindowVisits counts the visits in the current window, including the
+	// ones coalesced past the rate
+	WindowVisits int64               `json:"window_visits"`
+	Recent       []PageDeliveryEntry `json:"recent"`
+}
+
+// handleGetPageWebhook returns a page's webhook URL and recent deliveries
+func (s *Server) handleGetPageWebhook(c *gin.Context) {
+	ctx := c.Request.Context()
+	page := c.Param("page")
+	meta, err := s.meta.GetMeta(ctx, page)
+	if err != nil {
+		log.Printf("Error getting page metadata: %v", err)
+		respondStoreError(c, err, "Failed to get page webhook")
+		return
+	}
+	window, err := s.redis.PageWebhookWindow(ctx, page, s.clock.Now().Truncate(pageWebhookWindow))
+	if err != nil {
+		log.Printf("Error getting page webhook window: %v", err)
+		respondStoreError(c, err, "Failed to get page webhook")
+		return
+	}
+	deliveries, err := s.redis.PageDeliveries(ctx, page)
+	if err != nil {
+		log.Printf("Error getting page webhook deliveries: %v", err)
+		respondStoreError(c, err, "Failed to get page webhook")
+		return
+	}
+
+	response := PageWebhookResponse{
+		Page:          page,
+		URL:           meta.WebhookURL,
+		RatePerMinute: s.cfg.PageWebhookRate,
+		WindowVisits:  window,
+		Recent:        make([]PageDeliveryEntry, len(deliveries)),
+	}
+	for i, d := range deliveries {
+		response.Recent[i] = PageDeliveryEntry{ID: d.ID, Event: d.Event, Status: d.Status, Attempts: d.Attempts, Error: d.Error, At: stamp(c, d.At)}
+	}
+	respondJSON(c, http.StatusOK, response)
+}
+
+// handlePutPageWebhook sets a page's webhook URL, keeping its other metadata
+func (s *Server) handlePutPageWebhook(c *gin.Context) {
+	var req PageWebhookRequest
+	if err := c.ShouldBindJSON(&req); err != nil || req.URL == "" {
+		respondError(c, http.StatusBadRequest, "invalid_request", "Body must be an object with a url")
+		return
+	}
+	s.setPageWebhook(c, req.URL)
+}
+
+// handleDeletePageWebhook removes a page's webhook URL. Deliveries already
+// queued are still attempted.
+func (s *Server) handleDeletePageWebhook(c *gin.Context) {
+	s.setPageWebhook(c, "")
+}
+
+// setPageWebhook replaces the webhook URL in a page's metadata
+func (s *Server) setPageWebhook(c *gin.Context, url string) {
+	ctx := c.Request.Context()
+	page := c.Param("page")
+	meta, err := s.meta.GetMeta(ctx, page)
+	if err != nil {
+		log.Printf("Error getting page metadata: %v", err)
+		respondStoreError(c, err, "Failed to set page webhook")
+		return
+	}
+	meta.WebhookURL = url
+	if err := meta.Validate(); err != nil {
+		respondError(c, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+	if err := s.meta.SetMeta(ctx, page, meta); err != nil {
+		log.Printf("Error setting page metadata: %v", err)
+		respondStoreError(c, err, "Failed to set page webhook")
+		return
+	}
+	s.metaCache.invalidate(page)
+	respondJSON(c, http.StatusOK, gin.H{"page": page, "url": url})
+}
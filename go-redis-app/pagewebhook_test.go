@@ -0,0 +1,245 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go-redis-app/internal/clocktest"
+)
+
+// pageWebhookSink is a page webhook endpoint answering status, recording
+// the events it was posted
+type pageWebhookSink struct {
+	mu        sync.Mutex
+	status    int
+	requests  int
+	summaries []PageVisitSummary
+	visits    []PageVisitEvent
+}
+
+func (s *pageWebhookSink) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var body json.RawMessage
+	json.NewDecoder(r.Body).Decode(&body)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests++
+	if s.status != 0 {
+		w.WriteHeader(s.status)
+		return
+	}
+	var event PageVisitEvent
+	json.Unmarshal(body, &event)
+	if event.Event == eventPageVisitsCoalesced {
+		var summary PageVisitSummary
+		json.Unmarshal(body, &summary)
+		s.summaries = append(s.summaries, summary)
+		return
+	}
+	s.visits = append(s.visits, event)
+}
+
+func (s *pageWebhookSink) state() (requests int, visits []PageVisitEvent, summaries []PageVisitSummary) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests, append([]PageVisitEvent(nil), s.visits...), append([]PageVisitSummary(nil), s.summaries...)
+}
+
+// newPageWebhookServer starts a server allowing rate deliveries per page a
+// minute, on a fake clock
+func newPageWebhookServer(t *testing.T, rate int64) (*Server, http.Handler, *clocktest.Fake) {
+	t.Helper()
+	_, redisClient := newTestRedis(t)
+	cfg := testConfig()
+	cfg.PageWebhookRate = rate
+	clock := clocktest.New(time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC))
+	server := newTestServerWithClock(t, cfg, redisClient, clock)
+	return server, server.Router(), clock
+}
+
+// setPageWebhook points a page's webhook at a new endpoint serving sink
+func setPageWebhook(t *testing.T, router http.Handler, page string, sink *pageWebhookSink) {
+	t.Helper()
+	endpoint := httptest.NewServer(sink)
+	t.Cleanup(endpoint.Close)
+	if w := doRequest(router, "PUT", "/admin/pages/"+page+"/webhook", `{"url": "`+endpoint.URL+`"}`, nil); w.Code != http.StatusOK {
+		t.Fatalf("Expected the webhook set, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+// getPageWebhook reads a page's webhook status
+func getPageWebhook(t *testing.T, router http.Handler, page string) PageWebhookResponse {
+	t.Helper()
+	var resp PageWebhookResponse
+	w := doRequest(router, "GET", "/admin/pages/"+page+"/webhook", "", nil)
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("Expected the webhook status, got %d: %s", w.Code, w.Body.String())
+	}
+	return resp
+}
+
+func TestPageWebhookCoalescesBurst(t *testing.T) {
+	_, router, clock := newPageWebhookServer(t, 3)
+	sink := &pageWebhookSink{}
+	setPageWebhook(t, router, "feed", sink)
+
+	for i := 0; i < 10; i++ {
+		doRequest(router, "GET", "/visit/feed", "", map[string]string{"X-Request-ID": "burst"})
+	}
+	waitFor(t, 2*time.Second, func() bool {
+		_, visits, _ := sink.state()
+		return len(visits) == 3
+	})
+	// Deliveries run concurrently, so they may arrive in any order
+	_, visits, summaries := sink.state()
+	sort.Slice(visits, func(i, j int) bool { return visits[i].Visits < visits[j].Visits })
+	for i, v := range visits {
+		if v.Event != eventPageVisited || v.Page != "feed" || v.Visits != int64(i+1) || v.Visitor == "" || v.RequestID != "burst" {
+			t.Errorf("Expected visit %d delivered in full, got %+v", i+1, v)
+		}
+	}
+	if len(summaries) != 0 {
+		t.Fatalf("Expected the summary held until the window closes, got %+v", summaries)
+	}
+	if resp := getPageWebhook(t, router, "feed"); resp.WindowVisits != 10 || resp.RatePerMinute != 3 || len(resp.Recent) != 3 || resp.Recent[0].Status != deliveryDelivered {
+		t.Errorf("Expected 10 visits in the window and 3 deliveries, got %+v", resp)
+	}
+
+	// The window closes: the 7 visits past the rate arrive as one summary
+	clock.Advance(time.Minute)
+	waitFor(t, 2*time.Second, func() bool {
+		_, _, summaries := sink.state()
+		return len(summaries) == 1
+	})
+	_, _, summaries = sink.state()
+	want := PageVisitSummary{
+		Event:       eventPageVisitsCoalesced,
+		Page:        "feed",
+		Coalesced:   7,
+		Limit:       3,
+		WindowStart: time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC),
+		WindowEnd:   time.Date(2024, 3, 1, 12, 1, 0, 0, time.UTC),
+	}
+	if summaries[0] != want {
+		t.Errorf("Expected %+v, got %+v", want, summaries[0])
+	}
+
+	// The next window starts afresh
+	doRequest(router, "GET", "/visit/feed", "", nil)
+	waitFor(t, 2*time.Second, func() bool {
+		_, visits, _ := sink.state()
+		return len(visits) == 4
+	})
+	if resp := getPageWebhook(t, router, "feed"); resp.WindowVisits != 1 || len(resp.Recent) != 5 || resp.Recent[1].Event != eventPageVisitsCoalesced {
+		t.Errorf("Expected the new window and the summary logged, got %+v", resp)
+	}
+}
+
+func TestPageWebhookIsolation(t *testing.T) {
+	_, router, clock := newPageWebhookServer(t, 2)
+	failing := &pageWebhookSink{status: http.StatusServiceUnavailable}
+	healthy := &pageWebhookSink{}
+	setPageWebhook(t, router, "a", failing)
+	setPageWebhook(t, router, "b", healthy)
+
+	for i := 0; i < 5; i++ {
+		doRequest(router, "GET", "/visit/a", "", nil)
+	}
+	doRequest(router, "GET", "/visit/b", "", nil)
+	doRequest(router, "GET", "/visit/b", "", nil)
+	doRequest(router, "GET", "/visit/plain", "", nil)
+
+	// a's burst and failures neither use up b's rate nor hold it back
+	waitFor(t, 2*time.Second, func() bool {
+		requests, _, _ := failing.state()
+		_, visits, _ := healthy.state()
+		return requests == 2 && len(visits) == 2
+	})
+	a, b := getPageWebhook(t, router, "a"), getPageWebhook(t, router, "b")
+	if a.WindowVisits != 5 || len(a.Recent) != 2 || a.Recent[0].Status != deliveryRetrying || a.Recent[0].Error != "status 503" {
+		t.Errorf("Expected a's deliveries retrying, got %+v", a)
+	}
+	if b.WindowVisits != 2 || len(b.Recent) != 2 || b.Recent[0].Status != deliveryDelivered || b.Recent[0].Error != "" {
+		t.Errorf("Expected b's deliveries delivered, got %+v", b)
+	}
+	if plain := getPageWebhook(t, router, "plain"); plain.URL != "" || plain.WindowVisits != 0 || len(plain.Recent) != 0 {
+		t.Errorf("Expected nothing queued for a page without a webhook, got %+v", plain)
+	}
+
+	// Only a, which went past its rate, gets a summary
+	clock.Advance(time.Minute)
+	waitFor(t, 2*time.Second, func() bool {
+		requests, _, _ := failing.state()
+		return requests >= 5
+	})
+	if _, visits, summaries := healthy.state(); len(visits) != 2 || len(summaries) != 0 {
+		t.Errorf("Expected b's deliveries unchanged, got %+v and %+v", visits, summaries)
+	}
+}
+
+func TestPageWebhookSlowTarget(t *testing.T) {
+	_, router, _ := newPageWebhookServer(t, 60)
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	t.Cleanup(slow.Close)
+	t.Cleanup(func() { close(release) })
+	doRequest(router, "PUT", "/admin/pages/a/webhook", `{"url": "`+slow.URL+`"}`, nil)
+	healthy := &pageWebhookSink{}
+	setPageWebhook(t, router, "b", healthy)
+
+	// b is delivered while a's delivery hangs
+	doRequest(router, "GET", "/visit/a", "", nil)
+	doRequest(router, "GET", "/visit/b", "", nil)
+	waitFor(t, 2*time.Second, func() bool {
+		_, visits, _ := healthy.state()
+		return len(visits) == 1
+	})
+}
+
+func TestPageWebhookAdmin(t *testing.T) {
+	_, router, _ := newPageWebhookServer(t, 60)
+	doRequest(router, "PUT", "/admin/pages/feed/meta", `{"title": "Feed"}`, nil)
+
+	for _, body := range []string{`{}`, `{"url": "ftp://example.com/hook"}`, `{"url": "/relative"}`} {
+		if w := doRequest(router, "PUT", "/admin/pages/feed/webhook", body, nil); w.Code != http.StatusBadRequest {
+			t.Errorf("Expected 400 for %s, got %d", body, w.Code)
+		}
+	}
+	if w := doRequest(router, "PUT", "/admin/pages/feed/meta", `{"webhook_url": "nope"}`, nil); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected the metadata webhook_url validated, got %d", w.Code)
+	}
+
+	sink := &pageWebhookSink{}
+	setPageWebhook(t, router, "feed", sink)
+	resp := getPageWebhook(t, router, "feed")
+	if !strings.HasPrefix(resp.URL, "http://127.0.0.1") {
+		t.Errorf("Expected the URL reported, got %+v", resp)
+	}
+	// Setting the webhook keeps the metadata, and readers never see the URL
+	w := doRequest(router, "GET", "/pages/feed/meta", "", nil)
+	if !strings.Contains(w.Body.String(), `"title":"Feed"`) || strings.Contains(w.Body.String(), "webhook") {
+		t.Errorf("Expected the title kept and the URL hidden, got %s", w.Body.String())
+	}
+
+	// A metadata write leaving webhook_url out keeps the webhook
+	doRequest(router, "PUT", "/admin/pages/feed/meta", `{"title": "Feed v2"}`, nil)
+	if resp := getPageWebhook(t, router, "feed"); !strings.HasPrefix(resp.URL, "http://127.0.0.1") {
+		t.Errorf("Expected the webhook kept across a metadata write, got %+v", resp)
+	}
+
+	// Once removed, visits queue nothing
+	if w := doRequest(router, "DELETE", "/admin/pages/feed/webhook", "", nil); w.Code != http.StatusOK {
+		t.Fatalf("Expected the webhook removed, got %d: %s", w.Code, w.Body.String())
+	}
+	doRequest(router, "GET", "/visit/feed", "", nil)
+	if resp := getPageWebhook(t, router, "feed"); resp.URL != "" || resp.WindowVisits != 0 {
+		t.Errorf("Expected no webhook, got %+v", resp)
+	}
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"net"
+	"net/http"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// privacySaltPrefix names the random per-day salts of the daily rotation
+	// mode, shared by every replica
+	privacySaltPrefix = "visits:privacy:salt:"
+
+	// dailySaltTTL keeps yesterday's salt while its keys can still be purged
+	dailySaltTTL = 48 * time.Hour
+)
+
+// Identifier hash rotation modes
+const (
+	rotationNone  = "none"
+	rotationDaily = "daily"
+)
+
+// identifierHasher turns visitor identifiers into salted SHA-256 hashes
+// before they reach a key. In daily mode each UTC day's random salt is mixed
+// in as well, so once it expires that day's hashes can no longer be linked to
+// an identifier, even by someone who knows IP_HASH_SALT.
+type identifierHasher struct {
+	redis *RedisClient
+	salt  string
+	daily bool
+
+	mu    sync.Mutex
+	salts map[string]string // day -> that day's random salt
+}
+
+// newIdentifierHasher creates a hasher with the configured salt and rotation
+func newIdentifierHasher(redisClient *RedisClient, salt string, daily bool) *identifierHasher {
+	return &identifierHasher{redis: redisClient, salt: salt, daily: daily, salts: make(map[string]string)}
+}
+
+// saltedHash returns the hex SHA-256 digest of the salted value
+func saltedHash(salt, value string) string {
+	sum := sha256.Sum256([]byte(salt + "\x00" + value))
+	return hex.EncodeToString(sum[:16])
+}
+
+// Hash returns the hash of value under the salt in effect at now
+func (h *identifierHasher) Hash(ctx context.Context, value string, now time.Time) (string, error) {
+	if !h.daily {
+		return saltedHash(h.salt, value), nil
+	}
+	daySalt, err := h.daySalt(ctx, now.UTC().Format(dayLayout))
+	if err != nil {
+		return "", err
+	}
+	return saltedHash(h.salt+daySalt, value), nil
+}
+
+// peek is Hash without creating the day's salt, reporting false when no
+// replica has created it yet. A salt found is cached as daySalt's are.
+func (h *identifierHasher) peek(ctx context.Context, value string, now time.Time) (string, bool, error) {
+	if !h.daily {
+		return saltedHash(h.salt, value), true, nil
+	}
+	day := now.UTC().Format(dayLayout)
+	h.mu.Lock()
+	salt, ok := h.salts[day]
+	h.mu.Unlock()
+	if !ok {
+		var err error
+		salt, err = h.redis.client.Get(ctx, privacySaltPrefix+day).Result()
+		if isMissing(err) {
+			return "", false, nil
+		}
+		if err != nil {
+			return "", false, err
+		}
+		h.mu.Lock()
+		h.salts = map[string]string{day: salt}
+		h.mu.Unlock()
+	}
+	return saltedHash(h.salt+salt, value), true, nil
+}
+
+// daySalt returns the day's random salt, creating it if no replica has yet
+func (h *identifierHasher) daySalt(ctx context.Context, day string) (string, error) {
+	h.mu.Lock()
+	salt, ok := h.salts[day]
+	h.mu.Unlock()
+	if ok {
+		return salt, nil
+	}
+
+	fresh, err := newVisitorID()
+	if err != nil {
+		return "", err
+	}
+	key := privacySaltPrefix + day
+	if err := h.redis.client.SetNX(ctx, key, fresh, dailySaltTTL).Err(); err != nil {
+		return "", err
+	}
+	if salt, err = h.redis.client.Get(ctx, key).Result(); err != nil {
+		return "", err
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	// Only the current day is needed; a new day replaces the cache
+	h.salts = map[string]string{day: salt}
+	return salt, nil
+}
+
+// candidates returns every hash value may have been stored under: the one
+// static hash, or one per daily salt still kept
+func (h *identifierHasher) candidates(ctx context.Context, value string) ([]string, error) {
+	if !h.daily {
+		return []string{saltedHash(h.salt, value)}, nil
+	}
+	var hashes []string
+	err := h.redis.scanKeys(ctx, privacySaltPrefix+"*", func(keys []string) error {
+		salts, err := h.redis.client.MGet(ctx, keys...).Result()
+		if err != nil {
+			return err
+		}
+		for _, salt := range salts {
+			if s, ok := salt.(string); ok {
+				hashes = append(hashes, saltedHash(h.salt+s, value))
+			}
+		}
+		return nil
+	})
+	return hashes, err
+}
+
+// hashedVisitor returns the stored form of an identifier: its kind ("ip" or
+// "c" for a cookie) and its hash
+func (s *Server) hashedVisitor(ctx context.Context, kind, value string) (string, error) {
+	hash, err := s.hasher.Hash(ctx, kind+":"+value, s.clock.Now())
+	if err != nil {
+		return "", err
+	}
+	return kind + ":" + hash, nil
+}
+
+// visitorKeyPatterns match the visitor-derived keys of one stored visitor,
+// or of every visitor for "*": dedupe markers, session markers, goal
+// attribution markers and journeys. Journeys hold no creation time, so
+// purges by age leave them to expire after journeyTTL.
+func visitorKeyPatterns(visitor string) []string {
+	return []string{
+		"visits:dedupe:*:" + visitor,
+		"visits:session:*:" + visitor,
+		"goals:*:src:" + visitor,
+		journeyKey(visitor),
+	}
+}
+
+// PurgeRequest is the body of POST /admin/privacy/purge; exactly one of the
+// fields is set
+type PurgeRequest struct {
+	Identifier    string `json:"identifier"`
+	OlderThanDays int    `json:"older_than_days"`
+}
+
+// PurgeReport represents the POST /admin/privacy/purge API response
+type PurgeReport struct {
+	Scanned int64 `json:"scanned"`
+	Deleted int64 `json:"deleted"`
+}
+
+// PurgeVisitorKeys deletes the keys matching patterns. With a non-zero
+// cutoff only markers created before it are deleted; markers without a
+// creation time predate it and are deleted too.
+func (r *RedisClient) PurgeVisitorKeys(ctx context.Context, patterns []string, cutoff time.Time) (PurgeReport, error) {
+	var report PurgeReport
+	for _, pattern := range patterns {
+		err := r.scanKeys(ctx, pattern, func(keys []string) error {
+			report.Scanned += int64(len(keys))
+			if !cutoff.IsZero() {
+				values, err := r.client.MGet(ctx, keys...).Result()
+				if err != nil {
+					return err
+				}
+				old := keys[:0:0]
+				for i, v := range values {
+					value, ok := v.(string)
+					if !ok {
+						continue // expired since the SCAN
+					}
+					if created, _ := strconv.ParseInt(value, 10, 64); created < cutoff.Unix() {
+						old = append(old, keys[i])
+					}
+				}
+				keys = old
+			}
+			if len(keys) == 0 {
+				return nil
+			}
+			n, err := r.client.Del(ctx, keys...).Result()
+			report.Deleted += n
+			return err
+		})
+		if err != nil {
+			return report, err
+		}
+	}
+	return report, nil
+}
+
+// handlePrivacyPurge deletes the visitor-derived keys of one identifier (a
+// client IP or visitor ID), or of every visitor first seen more than
+// older_than_days ago
+func (s *Server) handlePrivacyPurge(c *gin.Context) {
+	var req PurgeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondError(c, http.StatusBadRequest, "invalid_request", "Invalid JSON body: "+err.Error())
+		return
+	}
+	if (req.Identifier == "") == (req.OlderThanDays == 0) || req.OlderThanDays < 0 {
+		respondError(c, http.StatusBadRequest, "invalid_request", "Set either identifier or a positive older_than_days")
+		return
+	}
+	ctx := c.Request.Context()
+
+	var patterns []string
+	var cutoff time.Time
+	if req.OlderThanDays > 0 {
+		patterns = visitorKeyPatterns("*")
+		cutoff = s.clock.Now().AddDate(0, 0, -req.OlderThanDays)
+		c.Set(auditBodyKey, `{"older_than_days":`+strconv.Itoa(req.OlderThanDays)+`}`)
+	} else {
+		kind, value := "c", strings.TrimSpace(req.Identifier)
+		if ip := net.ParseIP(value); ip != nil {
+			kind, value = "ip", ip.String()
+		} else if !isValidVisitorID(value) {
+			respondError(c, http.StatusBadRequest, "invalid_request", "identifier must be an IP address or visitor ID")
+			return
+		}
+		// The audit log outlives the purge, so it gets the hash in place of
+		// the identifier, as opt-outs do
+		c.Set(auditBodyKey, `{"visitor":"`+kind+":"+saltedHash(s.hasher.salt, kind+":"+value)+`"}`)
+		hashes, err := s.hasher.candidates(ctx, kind+":"+value)
+		if err != nil {
+			log.Printf("Error hashing identifier: %v", err)
+			respondStoreError(c, err, "Failed to purge visitor data")
+			return
+		}
+		for _, hash := range hashes {
+			patterns = append(patterns, visitorKeyPatterns(kind+":"+hash)...)
+		}
+	}
+
+	report, err := s.redis.PurgeVisitorKeys(ctx, patterns, cutoff)
+	if err != nil {
+		log.Printf("Error purging visitor data: %v", err)
+		respondStoreError(c, err, "Failed to purge visitor data")
+		return
+	}
+	c.JSON(http.StatusOK, report)
+}
+
+// recoverPanic logs a handler panic with its stack but not the request dump
+// Gin's default recovery writes, whose forwarding headers carry client IPs
+func recoverPanic(c *gin.Context, err any) {
+	log.Printf("Panic serving %s %s: %v\n%s", c.Request.Method, c.FullPath(), err, debug.Stack())
+	c.AbortWithStatus(http.StatusInternalServerError)
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gin-gonic/gin"
+)
+
+// visitFrom visits a page from the given client IP
+func visitFrom(h http.Handler, page, ip string, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", "/visit/"+page, nil)
+	req.RemoteAddr = ip + ":40000"
+	for _, cookie := range cookies {
+		req.AddCookie(cookie)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w
+}
+
+// visitorKeys returns the dedupe, session and goal marker keys
+func visitorKeys(mr *miniredis.Miniredis) []string {
+	var keys []string
+	for _, key := range mr.Keys() {
+		if strings.HasPrefix(key, "visits:dedupe:") || strings.HasPrefix(key, "visits:session:") || strings.Contains(key, ":src:") {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// newPrivacyServer returns a router with dedupe, sessions and a goal sourced
+// at "home", so a visit writes every kind of visitor marker
+func newPrivacyServer(t *testing.T, redisClient *RedisClient, cfg Config) *gin.Engine {
+	t.Helper()
+	server := newTestServer(t, cfg, redisClient)
+	router := server.Router()
+	server.flags.Set(context.Background(), map[string]bool{"dedupe": true})
+	doRequest(router, "POST", "/goals", `{"name": "signup", "source_page": "home", "target_page": "done"}`, nil)
+	return router
+}
+
+func TestNoRawIPInKeysOrLogs(t *testing.T) {
+	mr, redisClient := newTestRedis(t)
+	cfg := testConfig()
+	cfg.IPHashSalt = "pepper"
+	cfg.BatchRateLimit = 5
+
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	gin.DefaultWriter = &logs
+	t.Cleanup(func() {
+		log.SetOutput(os.Stderr)
+		gin.DefaultWriter = os.Stdout
+	})
+
+	router := newPrivacyServer(t, redisClient, cfg)
+	const ip = "203.0.113.77"
+	visitFrom(router, "home", ip)
+	req := httptest.NewRequest("POST", "/admin/pages/batch", strings.NewReader(`{"operation": "reset", "pages": ["home"]}`))
+	req.RemoteAddr = ip + ":40000"
+	router.ServeHTTP(httptest.NewRecorder(), req)
+
+	if len(visitorKeys(mr)) != 3 {
+		t.Fatalf("Expected dedupe, session and goal markers, got %v", visitorKeys(mr))
+	}
+	for _, key := range mr.Keys() {
+		if strings.Contains(key, ip) {
+			t.Errorf("Expected no raw IP in keys, got %q", key)
+		}
+	}
+	if logs.Len() == 0 {
+		t.Fatal("Expected access log lines")
+	}
+	if strings.Contains(logs.String(), ip) {
+		t.Errorf("Expected no raw IP in logs, got:\n%s", logs.String())
+	}
+}
+
+func TestIdentifierHashSalting(t *testing.T) {
+	_, redisClient := newTestRedis(t)
+	ctx := context.Background()
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	a, _ := newIdentifierHasher(redisClient, "one", false).Hash(ctx, "ip:192.0.2.1", now)
+	again, _ := newIdentifierHasher(redisClient, "one", false).Hash(ctx, "ip:192.0.2.1", now.AddDate(0, 1, 0))
+	other, _ := newIdentifierHasher(redisClient, "two", false).Hash(ctx, "ip:192.0.2.1", now)
+	if a != again {
+		t.Error("Expected a static salt to hash the same identifier the same way")
+	}
+	if a == other || a == saltedHash("", "ip:192.0.2.1") {
+		t.Error("Expected the salt to change the hash")
+	}
+}
+
+func TestDailySaltRotation(t *testing.T) {
+	mr, redisClient := newTestRedis(t)
+	ctx := context.Background()
+	day := time.Date(2024, 5, 1, 9, 0, 0, 0, time.UTC)
+	hasher := newIdentifierHasher(redisClient, "pepper", true)
+
+	morning, err := hasher.Hash(ctx, "ip:192.0.2.1", day)
+	if err != nil {
+		t.Fatalf("Failed to hash: %v", err)
+	}
+	evening, _ := hasher.Hash(ctx, "ip:192.0.2.1", day.Add(12*time.Hour))
+	tomorrow, _ := hasher.Hash(ctx, "ip:192.0.2.1", day.Add(24*time.Hour))
+	if morning != evening {
+		t.Error("Expected the same hash within a day")
+	}
+	if morning == tomorrow {
+		t.Error("Expected the hash to change with the day")
+	}
+
+	// Another replica picks up the same day's salt
+	replica, _ := newIdentifierHasher(redisClient, "pepper", true).Hash(ctx, "ip:192.0.2.1", day)
+	if replica != morning {
+		t.Error("Expected replicas to share the daily salt")
+	}
+	if ttl := mr.TTL(privacySaltPrefix + "2024-05-01"); ttl <= 0 || ttl > dailySaltTTL {
+		t.Errorf("Expected the daily salt to expire, got TTL %s", ttl)
+	}
+	candidates, _ := hasher.candidates(ctx, "ip:192.0.2.1")
+	if len(candidates) != 2 {
+		t.Errorf("Expected a candidate hash per kept salt, got %d", len(candidates))
+	}
+}
+
+func TestPrivacyPurgeByIdentifier(t *testing.T) {
+	for _, rotation := range []string{rotationNone, rotationDaily} {
+		t.Run(rotation, func(t *testing.T) {
+			mr, redisClient := newTestRedis(t)
+			cfg := testConfig()
+			cfg.IPHashSalt = "pepper"
+			cfg.IPHashRotation = rotation
+			cfg.VisitorCookie = true
+			router := newPrivacyServer(t, redisClient, cfg)
+
+			vid, _ := newVisitorID()
+			visitFrom(router, "home", "192.0.2.1")
+			visitFrom(router, "home", "192.0.2.2")
+			visitFrom(router, "home", "192.0.2.3", &http.Cookie{Name: visitorCookieName, Value: vid})
+			if got := len(visitorKeys(mr)); got != 9 {
+				t.Fatalf("Expected 9 visitor markers, got %d", got)
+			}
+
+			w := doRequest(router, "POST", "/admin/privacy/purge", `{"identifier": "192.0.2.1"}`, nil)
+			var report PurgeReport
+			json.Unmarshal(w.Body.Bytes(), &report)
+			// Its 3 markers and, with visitor cookies on, its journey
+			if w.Code != http.StatusOK || report.Deleted != 4 {
+				t.Fatalf("Expected the IP's 3 markers and journey to be purged, got %d: %s", w.Code, w.Body.String())
+			}
+			doRequest(router, "POST", "/admin/privacy/purge", `{"identifier": "`+vid+`"}`, nil)
+			if got := len(visitorKeys(mr)); got != 3 {
+				t.Errorf("Expected only the other IP's markers to remain, got %d", got)
+			}
+
+			// The purged visitor is a new visitor again
+			if resp := decodeVisit(t, visitFrom(router, "home", "192.0.2.1").Body.Bytes()); !*resp.Counted {
+				t.Error("Expected a purged visitor to be counted again")
+			}
+		})
+	}
+}
+
+func TestPrivacyPurgeOlderThan(t *testing.T) {
+	mr, redisClient := newTestRedis(t)
+	router := newPrivacyServer(t, redisClient, testConfig())
+	visitFrom(router, "home", "192.0.2.1")
+
+	old := time.Now().AddDate(0, 0, -10).Unix()
+	mr.Set("visits:dedupe:home:ip:old", "1") // set before markers held a time
+	mr.Set("visits:session:home:ip:old", strconv.FormatInt(old, 10))
+	mr.Set("goals:signup:src:ip:old", strconv.FormatInt(old, 10))
+
+	w := doRequest(router, "POST", "/admin/privacy/purge", `{"older_than_days": 7}`, nil)
+	var report PurgeReport
+	json.Unmarshal(w.Body.Bytes(), &report)
+	if w.Code != http.StatusOK || report.Deleted != 3 || report.Scanned != 6 {
+		t.Fatalf("Expected the 3 old markers purged out of 6, got %d: %s", w.Code, w.Body.String())
+	}
+	for _, key := range visitorKeys(mr) {
+		if strings.HasSuffix(key, ":ip:old") {
+			t.Errorf("Expected %s to be purged", key)
+		}
+	}
+	if got := len(visitorKeys(mr)); got != 3 {
+		t.Errorf("Expected the fresh markers to be kept, got %d", got)
+	}
+}
+
+func TestPrivacyPurgeAuditOmitsIdentifier(t *testing.T) {
+	for _, rotation := range []string{rotationNone, rotationDaily} {
+		t.Run(rotation, func(t *testing.T) {
+			_, redisClient := newTestRedis(t)
+			cfg := testConfig()
+			cfg.IPHashRotation = rotation
+			router := newPrivacyServer(t, redisClient, cfg)
+			visitFrom(router, "home", "203.0.113.7")
+
+			for _, body := range []string{`{"identifier": "203.0.113.7"}`, `{"older_than_days": 7}`} {
+				if w := doRequest(router, "POST", "/admin/privacy/purge", body, nil); w.Code != http.StatusOK {
+					t.Fatalf("Expected 200 for %s, got %d: %s", body, w.Code, w.Body.String())
+				}
+			}
+
+			resp := readAudit(t, router, "")
+			if len(resp.Entries) != 2 {
+				t.Fatalf("Expected 2 audit entries, got %d", len(resp.Entries))
+			}
+			// Newest first
+			if body := resp.Entries[1].Body; strings.Contains(body, "203.0.113.7") || !strings.Contains(body, `"visitor":"ip:`) {
+				t.Errorf("Expected the purge's audit entry to carry the hash only, got %q", body)
+			}
+			if body := resp.Entries[0].Body; body != `{"older_than_days":7}` {
+				t.Errorf("Expected the age purge summarized, got %q", body)
+			}
+		})
+	}
+}
+
+func TestPrivacyPurgeValidation(t *testing.T) {
+	_, redisClient := newTestRedis(t)
+	router := newTestServer(t, testConfig(), redisClient).Router()
+	for _, body := range []string{
+		`{}`,
+		`{"identifier": "192.0.2.1", "older_than_days": 3}`,
+		`{"older_than_days": -1}`,
+		`{"identifier": "not-an-id"}`,
+		`not json`,
+	} {
+		if w := doRequest(router, "POST", "/admin/privacy/purge", body, nil); w.Code != http.StatusBadRequest {
+			t.Errorf("Expected 400 for %s, got %d", body, w.Code)
+		}
+	}
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// queryRoute is the bulk count lookup, a POST that only reads
+	queryRoute = "/visits/query"
+
+	// maxQueryPages caps the pages in one query
+	maxQueryPages = 5000
+
+	// queryChunkSize is how many pages are looked up per pipeline, and
+	// written before the next chunk is read
+	queryChunkSize = 500
+)
+
+// QueryRequest is the body of POST /visits/query
+type QueryRequest struct {
+	Pages []string `json:"pages"`
+}
+
+// QueryResult is the line of a query response for one requested page, in
+// request order: its count when Status is 200, otherwise the error
+type QueryResult struct {
+	Page         string `json:"page"`
+	ResolvedFrom string `json:"resolved_from,omitempty"`
+	Status       int    `json:"status"`
+	Visits       *int64 `json:"visits,omitempty"`
+	Approximate  bool   `json:"approximate,omitempty"`
+	Code         string `json:"code,omitempty"`
+	Error        string `json:"error,omitempty"`
+
+	// Expanded is the related data asked for with ?expand=, on found pages
+	Expanded *Expansions `json:"expanded,omitempty"`
+}
+
+// QuerySummary is the trailing line of a query response with summary=true
+type QuerySummary struct {
+	Summary   bool `json:"summary"`
+	Total     int  `json:"total"`
+	Succeeded int  `json:"succeeded"`
+	Failed    int  `json:"failed"`
+}
+
+// validatePageName reports why a name can't be a page: every page is
+// counted through a /visit/:page path segment
+func validatePageName(page string) error {
+	switch {
+	case page == "":
+		return fmt.Errorf("page name must not be empty")
+	case strings.Contains(page, "/"):
+		return fmt.Errorf("page name must not contain /")
+	case strings.IndexFunc(page, unicode.IsControl) >= 0:
+		return fmt.Errorf("page name must not contain control characters")
+	}
+	return nil
+}
+
+// queryFailed returns the result of a page that can't be looked up
+func queryFailed(page string, status int, code, msg string) QueryResult {
+	return QueryResult{Page: page, Status: status, Code: code, Error: msg}
+}
+
+// QueryPages looks up the counts of one chunk of valid page names, in
+// order, following aliases. Aliases and archived pages are read in one
+// pipeline and the counters and name index entries of the resolved pages
+// in a second. Hidden and missing pages are not found; approximate pages
+// are left with their index entry's zero count for the caller to estimate.
+func (r *RedisClient) QueryPages(ctx context.Context, pages []string, hidden map[string]bool) ([]QueryResult, error) {
+	pipe := r.client.Pipeline()
+	aliases := pipe.HMGet(ctx, pageAliasesKey, pages...)
+	resolved := make([]string, len(pages))
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, err
+	}
+	for i, page := range pages {
+		resolved[i] = page
+		if target, ok := aliases.Val()[i].(string); ok {
+			resolved[i] = target
+		}
+	}
+
+	pipe = r.client.Pipeline()
+	archived := pipe.HMGet(ctx, archivedPagesKey, resolved...)
+	counters := make([]*redis.StringCmd, len(pages))
+	names := make([]*redis.FloatCmd, len(pages))
+	for i, page := range resolved {
+		counters[i] = pipe.Get(ctx, key("visits", page))
+		names[i] = pipe.ZScore(ctx, pageNamesKey, page)
+	}
+	if _, err := pipe.Exec(ctx); ignoreMissing(err) != nil {
+		return nil, err
+	}
+
+	results := make([]QueryResult, len(pages))
+	for i, page := range resolved {
+		switch {
+		case hidden[page]:
+			results[i] = queryFailed(pages[i], http.StatusNotFound, "not_found", "Page not found")
+			continue
+		case archived.Val()[i] != nil:
+			results[i] = queryFailed(page, http.StatusGone, "archived", fmt.Sprintf("Page %q is archived", page))
+		case isMissing(counters[i].Err()) && isMissing(names[i].Err()):
+			results[i] = queryFailed(page, http.StatusNotFound, "not_found", "Page not found")
+		default:
+			visits, _ := counters[i].Int64()
+			results[i] = QueryResult{Page: page, Status: http.StatusOK, Visits: &visits}
+		}
+		if page != pages[i] {
+			results[i].ResolvedFrom = pages[i]
+		}
+	}
+	return results, nil
+}
+
+// queryChunk looks up one chunk of a query, estimating approximate pages
+// and adding the expansions of the pages found
+func (s *Server) queryChunk(c *gin.Context, pages []string, hidden map[string]bool, expand expansions) ([]QueryResult, error) {
+	ctx := c.Request.Context()
+	results, err := s.redis.QueryPages(ctx, pages, hidden)
+	if err != nil {
+		return nil, err
+	}
+	var found []int
+	for i := range results {
+		if results[i].Status != http.StatusOK {
+			continue
+		}
+		found = append(found, i)
+		if !s.isApproximatePage(results[i].Page) {
+			continue
+		}
+		visits, err := s.redis.ApproximateCount(ctx, results[i].Page)
+		if err != nil {
+			return nil, err
+		}
+		results[i].Visits, results[i].Approximate = &visits, true
+	}
+
+	if !expand.any() || len(found) == 0 {
+		return results, nil
+	}
+	names := make([]string, len(found))
+	for n, i := range found {
+		names[n] = results[i].Page
+	}
+	expanded, err := s.expandPages(c, names, expand)
+	if err != nil {
+		return nil, err
+	}
+	for n, i := range found {
+		results[i].Expanded = expanded[n]
+	}
+	return results, nil
+}
+
+// handleQueryVisits looks up the counts of up to maxQueryPages pages,
+// answering one newline-delimited JSON result per requested page in order,
+// with the ?expand= expansions of each page found.
+// Pages are looked up and written a chunk at a time, so the response only
+// ever holds one chunk and the client can read results as they come. A
+// page that is invalid or can't be read is an error line, not a failed
+// request; once lines are written, a Redis error ends the stream early.
+func (s *Server) handleQueryVisits(c *gin.Context) {
+	var req QueryRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondError(c, http.StatusBadRequest, "invalid_request", "Invalid JSON body: "+err.Error())
+		return
+	}
+	if len(req.Pages) == 0 || len(req.Pages) > maxQueryPages {
+		respondError(c, http.StatusBadRequest, "invalid_request", fmt.Sprintf("pages must list 1 to %d pages", maxQueryPages))
+		return
+	}
+	expand, ok := parseExpansions(c)
+	if !ok {
+		return
+	}
+	expand = s.enabledExpansions(expand)
+	summary, _ := strconv.ParseBool(c.Query("summary"))
+	hidden, err := s.hiddenPages(c)
+	if err != nil {
+		log.Printf("Error loading private pages: %v", err)
+		respondStoreError(c, err, "Failed to query visits")
+		return
+	}
+
+	ctx := c.Request.Context()
+	c.Header("Content-Type", "application/x-ndjson")
+	c.Status(http.StatusOK)
+	enc := json.NewEncoder(c.Writer)
+	totals := QuerySummary{Summary: true, Total: len(req.Pages)}
+
+	results := make([]QueryResult, 0, queryChunkSize)
+	valid := make([]string, 0, queryChunkSize)
+	for start := 0; start < len(req.Pages); start += queryChunkSize {
+		chunk := req.Pages[start:min(start+queryChunkSize, len(req.Pages))]
+		valid = valid[:0]
+		for _, page := range chunk {
+			if validatePageName(page) == nil {
+				valid = append(valid, page)
+			}
+		}
+		var found []QueryResult
+		if len(valid) > 0 {
+			var err error
+			if found, err = s.queryChunk(c, valid, hidden, expand); err != nil {
+				if ctx.Err() == nil {
+					log.Printf("Error querying visits: %v", err)
+				}
+				// Headers are already sent, so the stream simply ends early
+				return
+			}
+		}
+
+		results = results[:0]
+		for _, page := range chunk {
+			if err := validatePageName(page); err != nil {
+				results = append(results, queryFailed(page, http.StatusBadRequest, "invalid_page", err.Error()))
+				continue
+			}
+			results, found = append(results, found[0]), found[1:]
+		}
+		for _, result := range results {
+			if result.Status == http.StatusOK {
+				totals.Succeeded++
+			} else {
+				totals.Failed++
+			}
+			if err := enc.Encode(result); err != nil {
+				return
+			}
+		}
+		c.Writer.Flush()
+		// Stop reading as soon as the client goes away
+		if ctx.Err() != nil {
+			return
+		}
+	}
+	if summary {
+		enc.Encode(totals)
+	}
+	c.Writer.Flush()
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// queryLines posts pages to /visits/query and decodes the response lines
+func queryLines(t *testing.T, h http.Handler, pages []string, query string) []QueryResult {
+	t.Helper()
+	body, _ := json.Marshal(QueryRequest{Pages: pages})
+	w := doRequest(h, "POST", "/visits/query"+query, string(body), nil)
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/x-ndjson" {
+		t.Fatalf("Query: %d %s", w.Code, w.Body.String())
+	}
+	var results []QueryResult
+	scanner := bufio.NewScanner(w.Body)
+	for scanner.Scan() {
+		var result QueryResult
+		if err := json.Unmarshal(scanner.Bytes(), &result); err != nil {
+			t.Fatalf("Bad line %q: %v", scanner.Text(), err)
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+func TestQueryVisits(t *testing.T) {
+	mr, redisClient := newTestRedis(t)
+	router := newTestServer(t, testConfig(), redisClient).Router()
+
+	// Every fifth page is missing, every fifth invalid, the rest counted
+	invalid := []string{"", "a/b", "bad\x01name"}
+	pages := make([]string, maxQueryPages)
+	for i := range pages {
+		switch i % 5 {
+		case 3:
+			pages[i] = fmt.Sprintf("missing-%04d", i)
+		case 4:
+			pages[i] = invalid[(i/5)%len(invalid)]
+		default:
+			pages[i] = fmt.Sprintf("page-%04d", i)
+			mr.Set(key("visits", pages[i]), fmt.Sprint(i))
+		}
+	}
+
+	results := queryLines(t, router, pages, "?summary=true")
+	if len(results) != maxQueryPages+1 {
+		t.Fatalf("Expected a line per page and the summary, got %d", len(results))
+	}
+	for i, got := range results[:maxQueryPages] {
+		switch i % 5 {
+		case 3:
+			if got.Page != pages[i] || got.Status != http.StatusNotFound || got.Code != "not_found" || got.Visits != nil {
+				t.Fatalf("Expected %s not found, got %+v", pages[i], got)
+			}
+		case 4:
+			if got.Page != pages[i] || got.Status != http.StatusBadRequest || got.Code != "invalid_page" || got.Error == "" {
+				t.Fatalf("Expected %q invalid, got %+v", pages[i], got)
+			}
+		default:
+			if got.Page != pages[i] || got.Status != http.StatusOK || got.Visits == nil || *got.Visits != int64(i) {
+				t.Fatalf("Expected %s at %d, got %+v", pages[i], i, got)
+			}
+		}
+	}
+	var summary QuerySummary
+	w := doRequest(router, "POST", "/visits/query?summary=true", `{"pages":["page-0000","nowhere"]}`, nil)
+	lines := strings.Split(strings.TrimSpace(w.Body.String()), "\n")
+	json.Unmarshal([]byte(lines[len(lines)-1]), &summary)
+	if !summary.Summary || summary.Total != 2 || summary.Succeeded != 1 || summary.Failed != 1 {
+		t.Errorf("Expected the summary last, got %s", w.Body.String())
+	}
+}
+
+func TestQueryVisitsAliasesAndArchives(t *testing.T) {
+	_, redisClient := newTestRedis(t)
+	router := newTestServer(t, testConfig(), redisClient).Router()
+	for _, page := range []string{"pricing", "pricing", "old"} {
+		doRequest(router, "GET", "/visit/"+page, "", nil)
+	}
+	if w := doRequest(router, "PUT", "/admin/aliases/plans", `{"target":"pricing"}`, nil); w.Code != http.StatusOK {
+		t.Fatalf("Set alias: %d %s", w.Code, w.Body.String())
+	}
+	if w := doRequest(router, "POST", "/admin/pages/old/archive", "", nil); w.Code != http.StatusOK {
+		t.Fatalf("Archive: %d %s", w.Code, w.Body.String())
+	}
+
+	results := queryLines(t, router, []string{"plans", "old", "pricing"}, "")
+	if len(results) != 3 {
+		t.Fatalf("Expected 3 lines, got %+v", results)
+	}
+	if got := results[0]; got.Page != "pricing" || got.ResolvedFrom != "plans" || got.Visits == nil || *got.Visits != 2 {
+		t.Errorf("Expected the alias resolved, got %+v", got)
+	}
+	if got := results[1]; got.Status != http.StatusGone || got.Code != "archived" {
+		t.Errorf("Expected the archived page reported, got %+v", got)
+	}
+	if got := results[2]; got.ResolvedFrom != "" || got.Visits == nil || *got.Visits != 2 {
+		t.Errorf("Expected pricing counted, got %+v", got)
+	}
+}
+
+func TestQueryVisitsRejectsBadRequests(t *testing.T) {
+	_, redisClient := newTestRedis(t)
+	router := newTestServer(t, testConfig(), redisClient).Router()
+	tooMany, _ := json.Marshal(QueryRequest{Pages: make([]string, maxQueryPages+1)})
+	for _, body := range []string{`{"pages":[]}`, `{}`, `not json`, string(tooMany)} {
+		if w := doRequest(router, "POST", "/visits/query", body, nil); w.Code != http.StatusBadRequest {
+			t.Errorf("Expected %.40q rejected, got %d", body, w.Code)
+		}
+	}
+}
+
+func TestQueryVisitsReadOnly(t *testing.T) {
+	mr, redisClient := newTestRedis(t)
+	mr.Set("visits:home", "3")
+	cfg := testConfig()
+	cfg.ReadOnly = true
+	router := newTestServer(t, cfg, redisClient).Router()
+	results := queryLines(t, router, []string{"home"}, "")
+	if len(results) != 1 || results[0].Visits == nil || *results[0].Visits != 3 {
+		t.Errorf("Expected queries served in read-only mode, got %+v", results)
+	}
+}
@@ -0,0 +1,392 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+// quotasKey is the hash of quota definitions, one JSON Quota per caller
+const quotasKey = "quotas"
+
+// quotaContextKey is the context key holding the quota enforceQuota applied
+const quotaContextKey = "quota"
+
+// quotaUsageKey is the hash of a caller's recorded usage
+func quotaUsageKey(caller string) string {
+	return key("quotas", "usage", caller)
+}
+
+// Quota limits what one caller, identified by its token subject, can record.
+// Zero fields are unlimited.
+type Quota struct {
+	// MaxPages is the number of pages the caller's visits may create
+	MaxPages int64 `json:"max_pages,omitempty"`
+
+	// MaxVisits is the number of visits the caller may record; past it
+	// visits carry a warning, or are rejected with RejectOverVisits
+	MaxVisits        int64 `json:"max_visits,omitempty"`
+	RejectOverVisits bool  `json:"reject_over_visits,omitempty"`
+
+	// RatePerMinute is the number of visit requests allowed per minute
+	RatePerMinute int64 `json:"rate_per_minute,omitempty"`
+}
+
+// Validate checks the quota's limits
+func (q Quota) Validate() error {
+	for _, limit := range []struct {
+		field string
+		n     int64
+	}{
+		{"max_pages", q.MaxPages},
+		{"max_visits", q.MaxVisits},
+		{"rate_per_minute", q.RatePerMinute},
+	} {
+		if err := checkNonNegative(limit.field, limit.n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// QuotaUsage is what a caller has recorded against its quota
+type QuotaUsage struct {
+	Pages  int64 `json:"pages"`
+	Visits int64 `json:"visits"`
+}
+
+// GetQuota returns a caller's quota, the zero Quota when none is defined
+func (r *RedisClient) GetQuota(ctx context.Context, caller string) (Quota, error) {
+	raw, err := r.client.HGet(ctx, quotasKey, caller).Result()
+	if isMissing(err) {
+		return Quota{}, nil
+	}
+	if err != nil {
+		return Quota{}, err
+	}
+	var q Quota
+	if err := json.Unmarshal([]byte(raw), &q); err != nil {
+		return Quota{}, fmt.Errorf("quota of %q: %w", caller, err)
+	}
+	return q, nil
+}
+
+// SetQuota stores a caller's quota, removing it when q has no limits
+func (r *RedisClient) SetQuota(ctx context.Context, caller string, q Quota) error {
+	if q == (Quota{}) {
+		return r.client.HDel(ctx, quotasKey, caller).Err()
+	}
+	raw, err := json.Marshal(q)
+	if err != nil {
+		return err
+	}
+	return r.client.HSet(ctx, quotasKey, caller, raw).Err()
+}
+
+// QuotaUsage returns a caller's recorded usage
+func (r *RedisClient) QuotaUsage(ctx context.Context, caller string) (QuotaUsage, error) {
+	vals, err := r.client.HMGet(ctx, quotaUsageKey(caller), "pages", "visits").Result()
+	if err != nil {
+		return QuotaUsage{}, err
+	}
+	var usage QuotaUsage
+	for i, n := range []*int64{&usage.Pages, &usage.Visits} {
+		if s, ok := vals[i].(string); ok {
+			*n, _ = strconv.ParseInt(s, 10, 64)
+		}
+	}
+	return usage, nil
+}
+
+// ChargeQuota adds pages and visits to a caller's usage
+func (r *RedisClient) ChargeQuota(ctx context.Context, caller string, pages, visits int64) error {
+	_, err := r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		if pages > 0 {
+			pipe.HIncrBy(ctx, quotaUsageKey(caller), "pages", pages)
+		}
+		pipe.HIncrBy(ctx, quotaUsageKey(caller), "visits", visits)
+		return nil
+	})
+	return err
+}
+
+// PageExists reports whether a page has been visited, counted or not
+func (r *RedisClient) PageExists(ctx context.Context, page string) (bool, error) {
+	err := r.client.ZScore(ctx, pageNamesKey, page).Err()
+	if isMissing(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// quotaCache caches quota definitions so visits don't read them from Redis
+// every time. Changes made through another replica apply once the entry
+// expires.
+type quotaCache struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	entries map[string]quotaEntry
+}
+
+type quotaEntry struct {
+	quota   Quota
+	expires time.Time
+}
+
+func newQuotaCache(ttl time.Duration) *quotaCache {
+	return &quotaCache{ttl: ttl, entries: make(map[string]quotaEntry)}
+}
+
+func (c *quotaCache) get(caller string, now time.Time) (Quota, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[caller]
+	if !ok || now.After(entry.expires) {
+		return Quota{}, false
+	}
+	return entry.quota, true
+}
+
+func (c *quotaCache) set(caller string, q Quota, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[caller] = quotaEntry{quota: q, expires: now.Add(c.ttl)}
+}
+
+func (c *quotaCache) invalidate(caller string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, caller)
+}
+
+// callerQuota returns a caller's quota through the cache
+func (s *Server) callerQuota(ctx context.Context, caller string) (Quota, error) {
+	now := s.clock.Now()
+	if q, ok := s.quotas.get(caller, now); ok {
+		return q, nil
+	}
+	q, err := s.redis.GetQuota(ctx, caller)
+	if err != nil {
+		return Quota{}, err
+	}
+	s.quotas.set(caller, q, now)
+	return q, nil
+}
+
+// quotaEvent is one quota_exceeded_total series
+type quotaEvent struct {
+	Caller   string
+	Quota    string
+	Rejected bool
+}
+
+// otherCaller labels the quota events of callers not named in the metrics
+const otherCaller = "other"
+
+// quotaMetrics counts the visits that went past a quota. Token subjects are
+// unbounded, so only the known callers get their own caller label.
+type quotaMetrics struct {
+	mu       sync.Mutex
+	known    map[string]bool
+	exceeded map[quotaEvent]int64
+}
+
+// newQuotaMetrics labels the ADMIN_API_KEYS names and QUOTA_METRIC_CALLERS
+// by name
+func newQuotaMetrics(cfg Config) *quotaMetrics {
+	known := make(map[string]bool)
+	for _, name := range cfg.AdminAPIKeys {
+		known[name] = true
+	}
+	for _, caller := range cfg.QuotaMetricCallers {
+		known[caller] = true
+	}
+	return &quotaMetrics{known: known, exceeded: make(map[quotaEvent]int64)}
+}
+
+func (m *quotaMetrics) record(caller, quota string, rejected bool) {
+	if !m.known[caller] {
+		caller = otherCaller
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.exceeded[quotaEvent{caller, quota, rejected}]++
+}
+
+// write writes the quota_exceeded_total series
+func (m *quotaMetrics) write(b *strings.Builder, env string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	events := make([]quotaEvent, 0, len(m.exceeded))
+	for e := range m.exceeded {
+		events = append(events, e)
+	}
+	sort.Slice(events, func(i, j int) bool {
+		if events[i].Caller != events[j].Caller {
+			return events[i].Caller < events[j].Caller
+		}
+		if events[i].Quota != events[j].Quota {
+			return events[i].Quota < events[j].Quota
+		}
+		return !events[i].Rejected
+	})
+	b.WriteString("# HELP quota_exceeded_total Visits past a caller's quota, by whether they were rejected.\n")
+	b.WriteString("# TYPE quota_exceeded_total counter\n")
+	for _, e := range events {
+		labels := fmt.Sprintf("caller=%s,quota=%s,rejected=%s", strconv.Quote(e.Caller), strconv.Quote(e.Quota), strconv.Quote(strconv.FormatBool(e.Rejected)))
+		if env != "" {
+			labels = "env=" + strconv.Quote(env) + "," + labels
+		}
+		fmt.Fprintf(b, "quota_exceeded_total{%s} %d\n", labels, m.exceeded[e])
+	}
+}
+
+// enforceQuota is the middleware of the visit route applying the caller's
+// quota: its request rate, then its visits and the pages it may create.
+// Callers without a token subject have no quota.
+func (s *Server) enforceQuota(c *gin.Context) {
+	caller := c.GetString(actorKey)
+	if caller == "" || c.Request.Method == http.MethodHead {
+		c.Next()
+		return
+	}
+	ctx := c.Request.Context()
+	q, err := s.callerQuota(ctx, caller)
+	if err != nil {
+		log.Printf("Error reading quota: %v", err)
+		respondStoreError(c, err, "Failed to check quota")
+		return
+	}
+	if q == (Quota{}) {
+		c.Next()
+		return
+	}
+
+	if q.RatePerMinute > 0 {
+		d, err := s.redis.TakeToken(ctx, rateBucketKey("quota", caller), q.RatePerMinute, time.Minute, s.bucketNow())
+		if err != nil {
+			log.Printf("Error checking rate limit: %v", err)
+			respondStoreError(c, err, "Failed to check quota")
+			return
+		}
+		setRateLimitHeaders(c, d, time.Minute)
+		if !d.Allowed {
+			s.quotaMetrics.record(caller, "rate", true)
+			respondRateLimited(c, d, "quota_rate",
+				fmt.Sprintf("At most %d visit requests per minute for %s", q.RatePerMinute, caller))
+			return
+		}
+	}
+
+	if q.MaxPages > 0 || q.MaxVisits > 0 {
+		usage, err := s.redis.QuotaUsage(ctx, caller)
+		if err != nil {
+			log.Printf("Error reading quota usage: %v", err)
+			respondStoreError(c, err, "Failed to check quota")
+			return
+		}
+		if q.MaxVisits > 0 && usage.Visits >= q.MaxVisits {
+			s.quotaMetrics.record(caller, "visits", q.RejectOverVisits)
+			if q.RejectOverVisits {
+				respondError(c, http.StatusTooManyRequests, "quota_visits",
+					fmt.Sprintf("%s has recorded its %d visits", caller, q.MaxVisits))
+				return
+			}
+			c.Header("X-Quota-Warning", fmt.Sprintf("visits: %d of %d recorded", usage.Visits, q.MaxVisits))
+		}
+		if q.MaxPages > 0 && usage.Pages >= q.MaxPages {
+			exists, err := s.redis.PageExists(ctx, c.Param("page"))
+			if err != nil {
+				log.Printf("Error checking page: %v", err)
+				respondStoreError(c, err, "Failed to check quota")
+				return
+			}
+			if !exists {
+				s.quotaMetrics.record(caller, "pages", true)
+				respondError(c, http.StatusTooManyRequests, "quota_pages",
+					fmt.Sprintf("%s has created its %d pages", caller, q.MaxPages))
+				return
+			}
+		}
+	}
+	c.Set(quotaContextKey, q)
+	c.Next()
+}
+
+// chargeQuota adds a recorded visit to the usage of the caller whose quota
+// enforceQuota applied. Concurrent visits can each pass the check before
+// either is charged, so a quota may be exceeded by the requests in flight.
+func (s *Server) chargeQuota(c *gin.Context, result visitResult) {
+	if _, ok := c.Get(quotaContextKey); !ok || !result.Counted {
+		return
+	}
+	var pages int64
+	if result.FirstVisit {
+		pages = 1
+	}
+	var visits int64 = 1
+	if result.SampleRate > 0 {
+		visits = sampleWeight(result.SampleRate)
+	}
+	if err := s.redis.ChargeQuota(c.Request.Context(), c.GetString(actorKey), pages, visits); err != nil {
+		log.Printf("Error charging quota: %v", err)
+	}
+}
+
+// QuotaResponse represents the /admin/quotas/:caller API response
+type QuotaResponse struct {
+	Caller string     `json:"caller"`
+	Quota  Quota      `json:"quota"`
+	Usage  QuotaUsage `json:"usage"`
+}
+
+// handleGetQuota returns a caller's quota and usage
+func (s *Server) handleGetQuota(c *gin.Context) {
+	ctx := c.Request.Context()
+	caller := c.Param("caller")
+	q, err := s.redis.GetQuota(ctx, caller)
+	if err != nil {
+		log.Printf("Error reading quota: %v", err)
+		respondStoreError(c, err, "Failed to read quota")
+		return
+	}
+	usage, err := s.redis.QuotaUsage(ctx, caller)
+	if err != nil {
+		log.Printf("Error reading quota usage: %v", err)
+		respondStoreError(c, err, "Failed to read quota")
+		return
+	}
+	respondJSON(c, http.StatusOK, QuotaResponse{Caller: caller, Quota: q, Usage: usage})
+}
+
+// handlePutQuota replaces a caller's quota; an empty object removes it
+func (s *Server) handlePutQuota(c *gin.Context) {
+	var q Quota
+	if err := c.ShouldBindJSON(&q); err != nil {
+		respondError(c, http.StatusBadRequest, "invalid_request", "Body must be a quota object")
+		return
+	}
+	if err := q.Validate(); err != nil {
+		respondError(c, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+	caller := c.Param("caller")
+	if err := s.redis.SetQuota(c.Request.Context(), caller, q); err != nil {
+		log.Printf("Error setting quota: %v", err)
+		respondStoreError(c, err, "Failed to set quota")
+		return
+	}
+	s.quotas.invalidate(caller)
+	respondJSON(c, http.StatusOK, q)
+}
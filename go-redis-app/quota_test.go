@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"go-redis-app/internal/clocktest"
+)
+
+// quotaTestServer returns a router taking anonymous writes and tokens, with
+// a fake clock, and the headers of an admin token for alice
+func quotaTestServer(t *testing.T, cacheTTL time.Duration) (http.Handler, *RedisClient, *clocktest.Fake, map[string]string) {
+	t.Helper()
+	_, redisClient := newTestRedis(t)
+	cfg := jwtTestConfig()
+	cfg.AnonymousPermission = PermWrite
+	cfg.QuotaCacheTTL = cacheTTL
+	cfg.QuotaMetricCallers = []string{"alice"}
+	clock := clocktest.New(time.Now())
+	router := newTestServerWithClock(t, cfg, redisClient, clock).Router()
+	headers := map[string]string{"Authorization": "Bearer " + mintHS256(t, cfg.JWTSecret, testClaims("admin", time.Hour))}
+	return router, redisClient, clock, headers
+}
+
+// putQuota sets alice's quota through the admin API
+func putQuota(t *testing.T, router http.Handler, headers map[string]string, body string) {
+	t.Helper()
+	if w := doRequest(router, "PUT", "/admin/quotas/alice", body, headers); w.Code != http.StatusOK {
+		t.Fatalf("Expected the quota set, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+// expectQuotaError checks a visit is rejected with a quota error code
+func expectQuotaError(t *testing.T, router http.Handler, path string, headers map[string]string, code string) {
+	t.Helper()
+	w := doRequest(router, "GET", path, "", headers)
+	if w.Code != http.StatusTooManyRequests || !strings.Contains(w.Body.String(), `"code":"`+code+`"`) {
+		t.Fatalf("Expected 429 %s for %s, got %d: %s", code, path, w.Code, w.Body.String())
+	}
+}
+
+func TestQuotaPages(t *testing.T) {
+	router, _, _, headers := quotaTestServer(t, time.Minute)
+	putQuota(t, router, headers, `{"max_pages": 2}`)
+
+	for _, path := range []string{"/visit/a", "/visit/b", "/visit/a"} {
+		if w := doRequest(router, "GET", path, "", headers); w.Code != http.StatusOK {
+			t.Fatalf("Expected %s within the quota, got %d", path, w.Code)
+		}
+	}
+	expectQuotaError(t, router, "/visit/c", headers, "quota_pages")
+	// Visits to pages that exist don't create one
+	if w := doRequest(router, "GET", "/visit/b", "", headers); w.Code != http.StatusOK {
+		t.Errorf("Expected an existing page still visited, got %d", w.Code)
+	}
+	// Nor do pages created by someone else
+	doRequest(router, "GET", "/visit/d", "", nil)
+	if w := doRequest(router, "GET", "/visit/d", "", headers); w.Code != http.StatusOK {
+		t.Errorf("Expected another caller's page visited, got %d", w.Code)
+	}
+
+	var resp QuotaResponse
+	json.Unmarshal(doRequest(router, "GET", "/admin/quotas/alice", "", headers).Body.Bytes(), &resp)
+	if resp.Usage.Pages != 2 || resp.Usage.Visits != 5 || resp.Quota.MaxPages != 2 {
+		t.Errorf("Expected 2 pages and 5 visits charged, got %+v", resp)
+	}
+}
+
+func TestQuotaVisits(t *testing.T) {
+	router, _, _, headers := quotaTestServer(t, time.Minute)
+	putQuota(t, router, headers, `{"max_visits": 2}`)
+
+	for i := 0; i < 2; i++ {
+		if w := doRequest(router, "GET", "/visit/home", "", headers); w.Code != http.StatusOK || w.Header().Get("X-Quota-Warning") != "" {
+			t.Fatalf("Expected visit %d within the quota, got %d %v", i+1, w.Code, w.Header())
+		}
+	}
+	// Soft: counted with a warning
+	w := doRequest(router, "GET", "/visit/home", "", headers)
+	if w.Code != http.StatusOK || w.Header().Get("X-Quota-Warning") != "visits: 2 of 2 recorded" {
+		t.Fatalf("Expected a warning past the soft quota, got %d %v", w.Code, w.Header())
+	}
+	if visits := decodeVisit(t, w.Body.Bytes()).Visits; visits != 3 {
+		t.Errorf("Expected the visit counted, got %d", visits)
+	}
+
+	putQuota(t, router, headers, `{"max_visits": 2, "reject_over_visits": true}`)
+	expectQuotaError(t, router, "/visit/home", headers, "quota_visits")
+
+	metrics := doRequest(router, "GET", "/metrics", "", nil).Body.String()
+	for _, series := range []string{
+		`quota_exceeded_total{caller="alice",quota="visits",rejected="false"} 1`,
+		`quota_exceeded_total{caller="alice",quota="visits",rejected="true"} 1`,
+	} {
+		if !strings.Contains(metrics, series+"\n") {
+			t.Errorf("Expected %s in the metrics", series)
+		}
+	}
+}
+
+func TestQuotaMetricsCallerLabel(t *testing.T) {
+	cfg := testConfig()
+	cfg.AdminAPIKeys = map[string]string{"secret": "ops"}
+	cfg.QuotaMetricCallers = []string{"alice"}
+	m := newQuotaMetrics(cfg)
+	for _, caller := range []string{"ops", "alice", "bob", "carol"} {
+		m.record(caller, "visits", true)
+	}
+
+	var b strings.Builder
+	m.write(&b, "")
+	for _, series := range []string{
+		`quota_exceeded_total{caller="alice",quota="visits",rejected="true"} 1`,
+		`quota_exceeded_total{caller="ops",quota="visits",rejected="true"} 1`,
+		`quota_exceeded_total{caller="other",quota="visits",rejected="true"} 2`,
+	} {
+		if !strings.Contains(b.String(), series+"\n") {
+			t.Errorf("Expected %s in the metrics, got:\n%s", series, b.String())
+		}
+	}
+	if strings.Contains(b.String(), "bob") {
+		t.Errorf("Expected unknown callers bucketed as other, got:\n%s", b.String())
+	}
+}
+
+func TestQuotaRate(t *testing.T) {
+	router, _, _, headers := quotaTestServer(t, time.Minute)
+	putQuota(t, router, headers, `{"rate_per_minute": 3}`)
+	for i := 0; i < 3; i++ {
+		if w := doRequest(router, "GET", "/visit/home", "", headers); w.Code != http.StatusOK {
+			t.Fatalf("Expected visit %d within the rate, got %d", i+1, w.Code)
+		}
+	}
+	w := doRequest(router, "GET", "/visit/home", "", headers)
+	if w.Code != http.StatusTooManyRequests || !strings.Contains(w.Body.String(), `"code":"quota_rate"`) || w.Header().Get("Retry-After") == "" {
+		t.Fatalf("Expected 429 quota_rate with Retry-After, got %d %v: %s", w.Code, w.Header(), w.Body.String())
+	}
+	// Reads and anonymous visits are not limited
+	if w := doRequest(router, "GET", "/visits/home", "", headers); w.Code != http.StatusOK {
+		t.Errorf("Expected reads outside the quota, got %d", w.Code)
+	}
+	if w := doRequest(router, "GET", "/visit/home", "", nil); w.Code != http.StatusOK {
+		t.Errorf("Expected anonymous visits outside the quota, got %d", w.Code)
+	}
+}
+
+func TestQuotaCacheRefresh(t *testing.T) {
+	router, redisClient, clock, headers := quotaTestServer(t, time.Minute)
+	doRequest(router, "GET", "/visit/a", "", headers) // caches "no quota"
+
+	// Set by another replica: applies once the cached entry expires
+	if err := redisClient.SetQuota(context.Background(), "alice", Quota{MaxPages: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if w := doRequest(router, "GET", "/visit/b", "", headers); w.Code != http.StatusOK {
+		t.Fatalf("Expected the cached quota used, got %d", w.Code)
+	}
+	clock.Advance(time.Minute + time.Second)
+	if w := doRequest(router, "GET", "/visit/c", "", headers); w.Code != http.StatusOK {
+		t.Fatalf("Expected the first page charged to the new quota, got %d", w.Code)
+	}
+	expectQuotaError(t, router, "/visit/d", headers, "quota_pages")
+
+	// Set through this replica: applies at once
+	putQuota(t, router, headers, `{}`)
+	if w := doRequest(router, "GET", "/visit/d", "", headers); w.Code != http.StatusOK {
+		t.Errorf("Expected the removed quota to apply immediately, got %d", w.Code)
+	}
+	if quota, _ := redisClient.GetQuota(context.Background(), "alice"); quota != (Quota{}) {
+		t.Errorf("Expected the empty quota removed, got %+v", quota)
+	}
+}
+
+func TestPutQuotaValidation(t *testing.T) {
+	router, _, _, headers := quotaTestServer(t, time.Minute)
+	for _, body := range []string{`{"max_pages": -1}`, `{"rate_per_minute": -5}`, `[]`} {
+		if w := doRequest(router, "PUT", "/admin/quotas/alice", body, headers); w.Code != http.StatusBadRequest {
+			t.Errorf("Expected 400 for %s, got %d", body, w.Code)
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+// takeTokenScript takes a token from a bucket, refilling it for the time
+// since the last call first. The bucket is a hash of its credit, the time it
+// was counted at and the burst and window it was counted with; a missing
+// bucket is a full one, so buckets are only stored while they are refilling
+// and expire once they would be full again. Credit is in token-milliseconds,
+// a token being window of them and each millisecond adding burst, so the
+// refill is exact integer arithmetic. A bucket counted with another limit
+// keeps its tokens.
+//
+// KEYS[1] the bucket; ARGV[1] burst size, ARGV[2] milliseconds to refill
+// that many tokens, ARGV[3] current Unix time in milliseconds. Returns
+// whether a token was taken and the credit left.
+var takeTokenScript = redis.NewScript(`
+local burst, window, now = tonumber(ARGV[1]), tonumber(ARGV[2]), tonumber(ARGV[3])
+local full = burst * window
+local state = redis.call('HMGET', KEYS[1], 'credit', 'ts', 'window')
+local credit, ts = tonumber(state[1]), tonumber(state[2])
+if not credit or not ts then
+	credit, ts = full, now
+elseif tonumber(state[3]) ~= window then
+	credit = math.floor(credit * window / tonumber(state[3]))
+end
+-- A replica whose clock is behind never takes tokens back
+now = math.max(now, ts)
+credit = math.min(full, credit + (now - ts) * burst)
+local taken = 0
+if credit >= window then
+	credit = credit - window
+	taken = 1
+end
+redis.call('HSET', KEYS[1], 'credit', credit, 'ts', now, 'burst', burst, 'window', window)
+redis.call('PEXPIRE', KEYS[1], math.ceil((full - credit) / burst))
+return {taken, credit}
+`)
+
+// RateDecision is a token bucket's answer to one call
+type RateDecision struct {
+	Allowed bool
+
+	// Limit is the bucket's burst size and Remaining the whole tokens left
+	Limit     int64
+	Remaining int64
+
+	// Refill is the tokens added per second
+	Refill float64
+
+	// RetryAfter is the wait for the next token and Reset for a full
+	// bucket
+	RetryAfter time.Duration
+	Reset      time.Duration
+}
+
+// TakeToken takes a token from a bucket of limit tokens that refills at
+// limit per window, shared by every replica. The bucket is created full on
+// first use and expires when idle.
+func (r *RedisClient) TakeToken(ctx context.Context, key string, limit int64, window time.Duration, now time.Time) (RateDecision, error) {
+	windowMs := window.Milliseconds()
+	res, err := takeTokenScript.Run(ctx, r.client, []string{key}, limit, windowMs, now.UnixMilli()).Int64Slice()
+	if err != nil {
+		return RateDecision{}, err
+	}
+	credit := res[1]
+	// The wait for the credit to reach goal, at limit per millisecond
+	wait := func(goal int64) time.Duration {
+		return time.Duration(float64(goal-credit) / float64(limit) * float64(time.Millisecond))
+	}
+	d := RateDecision{
+		Allowed:   res[0] == 1,
+		Limit:     limit,
+		Remaining: credit / windowMs,
+		Refill:    float64(limit) / window.Seconds(),
+		Reset:     wait(limit * windowMs),
+	}
+	if !d.Allowed {
+		d.RetryAfter = wait(windowMs)
+	}
+	return d, nil
+}
+
+// rateBucketKey is the token bucket of a caller for the named operation
+func rateBucketKey(name, caller string) string {
+	return fmt.Sprintf("visits:ratelimit:bucket:%s:%s", name, caller)
+}
+
+// RateLimitResponse represents a 429 response of a rate limit, with the
+// exact wait before the next call is allowed
+type RateLimitResponse struct {
+	Error           string  `json:"error"`
+	Code            string  `json:"code"`
+	RetryAfterMs    float64 `json:"retry_after_ms"`
+	Limit           int64   `json:"limit"`
+	Remaining       int64   `json:"remaining"`
+	RefillPerSecond float64 `json:"refill_per_second"`
+}
+
+// ceilSeconds rounds d up to whole seconds, as the rate limit headers carry
+func ceilSeconds(d time.Duration) string {
+	return strconv.FormatInt(int64(math.Ceil(d.Seconds())), 10)
+}
+
+// setRateLimitHeaders describes the caller's bucket with the RateLimit
+// header fields of draft-ietf-httpapi-ratelimit-headers: the burst size,
+// the tokens left, the seconds until the bucket is full and the policy of
+// limit calls per window
+func setRateLimitHeaders(c *gin.Context, d RateDecision, window time.Duration) {
+	c.Header("RateLimit-Limit", strconv.FormatInt(d.Limit, 10))
+	c.Header("RateLimit-Remaining", strconv.FormatInt(d.Remaining, 10))
+	c.Header("RateLimit-Reset", ceilSeconds(d.Reset))
+	c.Header("RateLimit-Policy", fmt.Sprintf("%d;w=%s", d.Limit, ceilSeconds(window)))
+}
+
+// respondRateLimited answers 429 for a call its bucket had no token for,
+// with Retry-After and the wait in the body
+func respondRateLimited(c *gin.Context, d RateDecision, code, message string) {
+	c.Header("Retry-After", ceilSeconds(d.RetryAfter))
+	c.AbortWithStatusJSON(http.StatusTooManyRequests, RateLimitResponse{
+		Error:           localize(c, message),
+		Code:            code,
+		RetryAfterMs:    durationMs(d.RetryAfter),
+		Limit:           d.Limit,
+		Remaining:       d.Remaining,
+		RefillPerSecond: d.Refill,
+	})
+}
+
+// rateLimit allows each actor (or hashed client IP without one) bursts of
+// limit calls of the named operation, refilled at limit per window; a
+// non-positive limit disables it
+func (s *Server) rateLimit(name string, limit int64, window time.Duration) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if limit <= 0 {
+			c.Next()
+			return
+		}
+		caller := c.GetString(actorKey)
+		if caller == "" {
+			var err error
+			if caller, err = s.hashedVisitor(c.Request.Context(), "ip", c.ClientIP()); err != nil {
+				log.Printf("Error hashing client address: %v", err)
+				respondStoreError(c, err, "Failed to check rate limit")
+				return
+			}
+		}
+		d, err := s.redis.TakeToken(c.Request.Context(), rateBucketKey(name, caller), limit, window, s.bucketNow())
+		if err != nil {
+			log.Printf("Error checking rate limit: %v", err)
+			respondStoreError(c, err, "Failed to check rate limit")
+			return
+		}
+		setRateLimitHeaders(c, d, window)
+		if !d.Allowed {
+			respondRateLimited(c, d, "rate_limited",
+				fmt.Sprintf("At most %d %s requests per %s", limit, name, window))
+			return
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go-redis-app/internal/clocktest"
+)
+
+func TestTokenBucket(t *testing.T) {
+	mr, redisClient := newTestRedis(t)
+	ctx := context.Background()
+	now := time.UnixMilli(1_700_000_000_000)
+	take := func(at time.Time) RateDecision {
+		t.Helper()
+		d, err := redisClient.TakeToken(ctx, "bucket", 5, 5*time.Second, at)
+		if err != nil {
+			t.Fatalf("TakeToken: %v", err)
+		}
+		return d
+	}
+
+	// A new bucket is full: the burst is allowed at once
+	for i := int64(4); i >= 0; i-- {
+		if d := take(now); !d.Allowed || d.Remaining != i {
+			t.Fatalf("Expected a token with %d left, got %+v", i, d)
+		}
+	}
+	d := take(now)
+	if d.Allowed || d.RetryAfter != time.Second || d.Reset != 5*time.Second || d.Refill != 1 {
+		t.Fatalf("Expected the empty bucket to wait 1s for a token, got %+v", d)
+	}
+
+	// 2.5s refill 2.5 tokens, of which one is taken
+	if d := take(now.Add(2500 * time.Millisecond)); !d.Allowed || d.Remaining != 1 || d.Reset != 3500*time.Millisecond {
+		t.Errorf("Expected 1.5 tokens left, got %+v", d)
+	}
+	// An earlier time, from a replica whose clock is behind, refills nothing
+	if d := take(now); !d.Allowed || d.Remaining != 0 {
+		t.Errorf("Expected 0.5 tokens left, got %+v", d)
+	}
+	if d := take(now.Add(2600 * time.Millisecond)); d.Allowed || d.RetryAfter != 400*time.Millisecond {
+		t.Errorf("Expected a 400ms wait for the next token, got %+v", d)
+	}
+
+	// The bucket expires once it would be full, and comes back full
+	if ttl := mr.TTL("bucket"); ttl <= 4*time.Second || ttl > 5*time.Second {
+		t.Errorf("Expected the bucket to expire in its refill time, got %s", ttl)
+	}
+	mr.FastForward(5 * time.Second)
+	if mr.Exists("bucket") {
+		t.Fatal("Expected the idle bucket to expire")
+	}
+	if d := take(now.Add(time.Hour)); !d.Allowed || d.Remaining != 4 {
+		t.Errorf("Expected a new full bucket, got %+v", d)
+	}
+}
+
+func TestTokenBucketConcurrent(t *testing.T) {
+	_, redisClient := newTestRedis(t)
+	now := time.Now()
+	var allowed atomic.Int64
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			d, err := redisClient.TakeToken(context.Background(), "bucket", 20, time.Minute, now)
+			if err != nil {
+				t.Errorf("TakeToken: %v", err)
+				return
+			}
+			if d.Allowed {
+				allowed.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	if got := allowed.Load(); got != 20 {
+		t.Errorf("Expected exactly the burst of 20 allowed, got %d", got)
+	}
+}
+
+func TestRateLimitHeaders(t *testing.T) {
+	_, redisClient := newTestRedis(t)
+	cfg := testConfig()
+	cfg.BatchRateLimit = 2
+	clock := clocktest.New(time.Now())
+	router := newTestServerWithClock(t, cfg, redisClient, clock).Router()
+	body := `{"operation": "delete", "pages": ["a"]}`
+
+	for _, remaining := range []string{"1", "0"} {
+		w := doRequest(router, "POST", "/admin/pages/batch", body, nil)
+		if w.Code == http.StatusTooManyRequests {
+			t.Fatalf("Expected the batch allowed, got %d", w.Code)
+		}
+		for header, want := range map[string]string{
+			"RateLimit-Limit":     "2",
+			"RateLimit-Remaining": remaining,
+			"RateLimit-Policy":    "2;w=60",
+		} {
+			if got := w.Header().Get(header); got != want {
+				t.Errorf("Expected %s %q, got %q", header, want, got)
+			}
+		}
+	}
+
+	clock.Advance(10 * time.Second)
+	w := doRequest(router, "POST", "/admin/pages/batch", body, nil)
+	var resp RateLimitResponse
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if w.Code != http.StatusTooManyRequests || resp.Code != "rate_limited" {
+		t.Fatalf("Expected 429 rate_limited, got %d %s", w.Code, w.Body.String())
+	}
+	// A token every 30s, a third of which has passed
+	if resp.RetryAfterMs != 20000 || resp.Limit != 2 || resp.Remaining != 0 || resp.RefillPerSecond != 2.0/60 {
+		t.Errorf("Unexpected rate limit body %+v", resp)
+	}
+	if got := w.Header().Get("Retry-After"); got != "20" {
+		t.Errorf("Expected Retry-After 20, got %q", got)
+	}
+	if got := w.Header().Get("RateLimit-Reset"); got != "50" {
+		t.Errorf("Expected the bucket full in 50s, got %q", got)
+	}
+
+	clock.Advance(20 * time.Second)
+	if w := doRequest(router, "POST", "/admin/pages/batch", body, nil); w.Code == http.StatusTooManyRequests {
+		t.Errorf("Expected a batch allowed after Retry-After, got %d", w.Code)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+// readOnlyCommands are allowed in READ_ONLY mode besides readCommands:
+// other reads, read-only scripts, transactions (whose commands are checked
+// on their own) and connection setup
+var readOnlyCommands = map[string]bool{
+	"time": true, "zcount": true, "zrevrangebyscore": true, "zrangebylex": true, "zrandmember": true,
+	"lrange": true, "llen": true, "lindex": true, "hexists": true, "hkeys": true, "hvals": true, "strlen": true,
+	"srandmember": true, "sinter": true, "sunion": true, "sdiff": true, "xread": true,
+	"topk.info": true, "cms.info": true, "bf.info": true, "json.type": true, "ft.aggregate": true,
+	"eval_ro": true, "evalsha_ro": true,
+	"multi": true, "exec": true, "discard": true, "watch": true, "unwatch": true,
+	"hello": true, "auth": true, "select": true, "client": true, "command": true,
+	"subscribe": true, "unsubscribe": true,
+}
+
+// readOnlyAllowed reports whether a command may run in READ_ONLY mode
+func readOnlyAllowed(name string) bool {
+	return readCommands[name] || readOnlyCommands[name]
+}
+
+// readOnlyHook fails every command that is not known to be a read, so no
+// code path can write to Redis in READ_ONLY mode, whatever the router lets
+// through. Unknown commands count as writes.
+type readOnlyHook struct{}
+
+func (readOnlyHook) DialHook(next redis.DialHook) redis.DialHook { return next }
+
+func (readOnlyHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		if !readOnlyAllowed(cmd.Name()) {
+			err := readOnlyError(cmd.Name())
+			cmd.SetErr(err)
+			return err
+		}
+		return next(ctx, cmd)
+	}
+}
+
+func (readOnlyHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		for _, cmd := range cmds {
+			if !readOnlyAllowed(cmd.Name()) {
+				err := readOnlyError(cmd.Name())
+				for _, c := range cmds {
+					c.SetErr(err)
+				}
+				return err
+			}
+		}
+		return next(ctx, cmds)
+	}
+}
+
+// readOnlyError is the error of a write attempted in READ_ONLY mode
+func readOnlyError(command string) error {
+	return newKindError(ErrReadOnly, "read-only mode: "+command+" is a write")
+}
+
+// enableReadOnly blocks every write through the client. It is idempotent.
+func (r *RedisClient) enableReadOnly() {
+	if r.readOnly {
+		return
+	}
+	r.readOnly = true
+	r.client.AddHook(readOnlyHook{})
+}
+
+// rejectWrites is the middleware answering every request that would write
+// with 403 in READ_ONLY mode: mutating methods and GET /visit/:page. HEAD
+// visits only read the count and pass, as does POST /visits/query.
+func (s *Server) rejectWrites(c *gin.Context) {
+	route := c.FullPath()
+	if (isMutating(c.Request.Method) && route != queryRoute) || (c.Request.Method == http.MethodGet && route == "/visit/:page") {
+		respondError(c, http.StatusForbidden, "read_only", "The service is in read-only mode")
+		return
+	}
+	c.Next()
+}
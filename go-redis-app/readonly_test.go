@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestReadOnlyClientBlocksWrites(t *testing.T) {
+	mr, redisClient := newTestRedis(t)
+	mr.Set(key("visits", "home"), "7")
+	redisClient.enableReadOnly()
+	redisClient.enableReadOnly()
+	ctx := context.Background()
+
+	if _, err := redisClient.IncrementVisitCount(ctx, "home"); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("Expected the increment rejected, got %v", err)
+	}
+	pipe := redisClient.client.Pipeline()
+	get := pipe.Get(ctx, key("visits", "home"))
+	pipe.Incr(ctx, key("visits", "home"))
+	if _, err := pipe.Exec(ctx); !errors.Is(err, ErrReadOnly) || !errors.Is(get.Err(), ErrReadOnly) {
+		t.Errorf("Expected the whole pipeline rejected, got %v", err)
+	}
+	if err := redisClient.client.Eval(ctx, "return redis.call('INCR', KEYS[1])", []string{"n"}).Err(); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("Expected the script rejected, got %v", err)
+	}
+	if got, _ := mr.Get(key("visits", "home")); got != "7" {
+		t.Errorf("Expected the count unchanged, got %s", got)
+	}
+
+	if count, err := redisClient.GetVisitCount(ctx, "home"); err != nil || count != 7 {
+		t.Errorf("Expected reads to work, got %d, %v", count, err)
+	}
+	if _, _, err := redisClient.client.Scan(ctx, 0, "*", 10).Result(); err != nil {
+		t.Errorf("Expected SCAN to work, got %v", err)
+	}
+}
+
+func TestReadOnlyServer(t *testing.T) {
+	mr, redisClient := newTestRedis(t)
+	mr.Set(key("visits", "home"), "3")
+	before := mr.Keys()
+	cfg := testConfig()
+	cfg.ReadOnly = true
+	router := newTestServer(t, cfg, redisClient).Router()
+
+	for _, tc := range []struct{ method, path, body string }{
+		{"GET", "/visit/home", ""},
+		{"POST", "/goals", `{"name":"signup","page":"home"}`},
+		{"PUT", "/admin/flags", `{"dark":true}`},
+		{"DELETE", "/admin/pages/home/webhook", ""},
+	} {
+		w := doRequest(router, tc.method, tc.path, tc.body, nil)
+		var body ErrorResponse
+		json.Unmarshal(w.Body.Bytes(), &body)
+		if w.Code != http.StatusForbidden || body.Code != "read_only" {
+			t.Errorf("Expected %s %s rejected as read_only, got %d: %s", tc.method, tc.path, w.Code, w.Body.String())
+		}
+	}
+
+	if w := doRequest(router, "GET", "/visits/home", "", nil); w.Code != http.StatusOK {
+		t.Errorf("Expected reads served, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := doRequest(router, "HEAD", "/visit/home", "", nil); w.Code != http.StatusOK {
+		t.Errorf("Expected HEAD visits served, got %d", w.Code)
+	}
+	for _, path := range []string{"/health", "/"} {
+		w := doRequest(router, "GET", path, "", nil)
+		var body map[string]any
+		json.Unmarshal(w.Body.Bytes(), &body)
+		if body["read_only"] != true {
+			t.Errorf("Expected %s to report read-only mode, got %s", path, w.Body.String())
+		}
+	}
+
+	if after := mr.Keys(); !reflect.DeepEqual(after, before) {
+		t.Errorf("Expected nothing written, keys went from %v to %v", before, after)
+	}
+	if got, _ := mr.Get(key("visits", "home")); got != "3" {
+		t.Errorf("Expected the count unchanged, got %s", got)
+	}
+}
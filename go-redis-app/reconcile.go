@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+// reconcileMaxEntries caps the discrepancies listed in a report; the counts
+// still cover every page
+const reconcileMaxEntries = 100
+
+// nonCounterPrefixes are the string keys under visits: that are not page
+// counters: session counters and markers, dedupe markers, salts, rate limit
+// windows and unique visitor HyperLogLogs
+var nonCounterPrefixes = []string{"sessions:", "session:", "dedupe:", "privacy:", "ratelimit:", "unique:"}
+
+// repairScoreScript sets a page's leaderboard score to its counter as they
+// are when the repair runs, returning 1 when the score changed.
+//
+// KEYS[1] counter, KEYS[2] leaderboard; ARGV[1] page
+var repairScoreScript = redis.NewScript(`
+local count = redis.call('GET', KEYS[1])
+if not count then
+	return 0
+end
+local score = redis.call('ZSCORE', KEYS[2], ARGV[1])
+if score and tonumber(score) == tonumber(count) then
+	return 0
+end
+redis.call('ZADD', KEYS[2], count, ARGV[1])
+return 1
+`)
+
+// LeaderboardDrift is a page whose leaderboard score differs from its counter
+type LeaderboardDrift struct {
+	Page    string `json:"page"`
+	Counter int64  `json:"counter"`
+	// Score is nil when the page is missing from the leaderboard
+	Score *int64 `json:"score"`
+}
+
+// ReconcileReport summarizes a leaderboard consistency check
+type ReconcileReport struct {
+	Scanned       int                `json:"scanned"`
+	Discrepancies int                `json:"discrepancies"`
+	Fixed         int                `json:"fixed"`
+	DryRun        bool               `json:"dry_run"`
+	Entries       []LeaderboardDrift `json:"entries"`
+	Truncated     bool               `json:"truncated,omitempty"`
+}
+
+// counterPage returns the page of a page counter key
+func counterPage(key string) (string, bool) {
+	page, ok := strings.CutPrefix(key, "visits:")
+	if !ok || page == "" || key == trendingDecayedAtKey || strings.HasSuffix(key, ":pre_history") || strings.HasSuffix(key, ":weighted") {
+		return "", false
+	}
+	if _, owned := keyOwner(key); owned {
+		return "", false
+	}
+	for _, prefix := range nonCounterPrefixes {
+		if strings.HasPrefix(page, prefix) {
+			return "", false
+		}
+	}
+	return page, true
+}
+
+// ReconcileLeaderboard compares every page counter with the page's
+// leaderboard score, one SCAN batch at a time, and unless dryRun sets the
+// drifted scores to the counters. A visit recorded while its page is checked
+// can show up as drift of its weight; the next run settles it. Callers must
+// hold the maintenance lock.
+func (r *RedisClient) ReconcileLeaderboard(ctx context.Context, dryRun bool) (ReconcileReport, error) {
+	report := ReconcileReport{DryRun: dryRun, Entries: []LeaderboardDrift{}}
+	err := r.scanKeysOfType(ctx, "visits:*", "string", func(keys []string) error {
+		var pages, counters []string
+		for _, key := range keys {
+			if page, ok := counterPage(key); ok {
+				pages = append(pages, page)
+				counters = append(counters, key)
+			}
+		}
+		if len(pages) == 0 {
+			return nil
+		}
+
+		pipe := r.client.Pipeline()
+		values := make([]*redis.StringCmd, len(pages))
+		scores := make([]*redis.FloatCmd, len(pages))
+		for i, page := range pages {
+			values[i] = pipe.Get(ctx, counters[i])
+			scores[i] = pipe.ZScore(ctx, leaderboardKey, page)
+		}
+		if _, err := pipe.Exec(ctx); ignoreMissing(err) != nil {
+			return err
+		}
+
+		repair := r.client.Pipeline()
+		var repairs []*redis.Cmd
+		for i, page := range pages {
+			count, err := values[i].Int64()
+			if err != nil {
+				// Deleted since the SCAN, or not a counter after all
+				continue
+			}
+			report.Scanned++
+			drift := LeaderboardDrift{Page: page, Counter: count}
+			if score, err := scores[i].Result(); err == nil {
+				if int64(score) == count {
+					continue
+				}
+				s := int64(score)
+				drift.Score = &s
+			} else if !isMissing(err) {
+				return err
+			}
+
+			report.Discrepancies++
+			if len(report.Entries) < reconcileMaxEntries {
+				report.Entries = append(report.Entries, drift)
+			} else {
+				report.Truncated = true
+			}
+			if !dryRun {
+				repairs = append(repairs, repairScoreScript.Eval(ctx, repair, []string{counters[i], leaderboardKey}, page))
+			}
+		}
+		if len(repairs) == 0 {
+			return nil
+		}
+		if _, err := repair.Exec(ctx); err != nil {
+			return err
+		}
+		for _, cmd := range repairs {
+			if changed, _ := cmd.Int64(); changed == 1 {
+				report.Fixed++
+			}
+		}
+		return nil
+	})
+	return report, err
+}
+
+// runReconcile checks and repairs the leaderboard under the maintenance
+// lock, reporting ok=false when another replica holds it
+func (s *Server) runReconcile(ctx context.Context, dryRun bool) (ReconcileReport, bool, error) {
+	release, ok, err := s.redis.AcquireMaintenanceLock(ctx, 10*time.Minute)
+	if err != nil || !ok {
+		return ReconcileReport{}, false, err
+	}
+	defer release()
+	report, err := s.redis.ReconcileLeaderboard(ctx, dryRun)
+	if err == nil && report.Fixed > 0 {
+		s.invalidateAggregates(ctx)
+	}
+	return report, true, err
+}
+
+// reconcileWorker is the periodic leaderboard reconciliation job
+func (s *Server) reconcileWorker(ctx context.Context) error {
+	report, ok, err := s.runReconcile(ctx, s.cfg.ReconcileDryRun)
+	if err == nil && ok && report.Discrepancies > 0 {
+		log.Printf("Reconcile (dry run %t): %d of %d pages drifted from the leaderboard, fixed %d",
+			report.DryRun, report.Discrepancies, report.Scanned, report.Fixed)
+	}
+	return err
+}
+
+// handleReconcile checks the leaderboard against the counters on demand
+func (s *Server) handleReconcile(c *gin.Context) {
+	dryRun, _ := strconv.ParseBool(c.Query("dry_run"))
+
+	report, ok, err := s.runReconcile(c.Request.Context(), dryRun)
+	if err != nil {
+		log.Printf("Error reconciling leaderboard: %v", err)
+		respondStoreError(c, err, "Failed to reconcile leaderboard")
+		return
+	}
+	if !ok {
+		respondError(c, http.StatusConflict, "conflict", "Maintenance is already running on another replica")
+		return
+	}
+	c.JSON(http.StatusOK, report)
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func decodeReconcile(t *testing.T, body []byte) ReconcileReport {
+	t.Helper()
+	var report ReconcileReport
+	if err := json.Unmarshal(body, &report); err != nil {
+		t.Fatalf("Failed to decode reconcile report: %v", err)
+	}
+	return report
+}
+
+func TestCounterPage(t *testing.T) {
+	tests := map[string]string{
+		"visits:home":                  "home",
+		"visits:docs:intro":            "docs:intro",
+		"visits:home:daily:2024-05-01": "",
+		"visits:home:variant:b":        "",
+		"visits:home:pre_history":      "",
+		"visits:sessions:home":         "",
+		"visits:dedupe:home:ip:abc":    "",
+		"visits:unique:home":           "",
+		"visits:trending:decayed_at":   "",
+		"archive:visits:home":          "",
+	}
+	for key, want := range tests {
+		if page, ok := counterPage(key); page != want || ok != (want != "") {
+			t.Errorf("counterPage(%q) = %q, %t, want %q", key, page, ok, want)
+		}
+	}
+}
+
+func TestReconcileDetectsAndRepairsDrift(t *testing.T) {
+	mr, redisClient := newTestRedis(t)
+	server := newTestServer(t, testConfig(), redisClient)
+	server.flags.Set(context.Background(), map[string]bool{"rollups": true})
+	router := server.Router()
+	for _, page := range []string{"home", "about", "docs:intro", "pricing"} {
+		doRequest(router, "GET", "/visit/"+page, "", nil)
+		doRequest(router, "GET", "/visit/"+page, "", nil)
+	}
+
+	// Simulate crashes between the counter INCR and the ZINCRBY
+	mr.Set("visits:home", "5")
+	mr.ZAdd(leaderboardKey, 1, "about")
+	mr.ZRem(leaderboardKey, "docs:intro")
+
+	w := doRequest(router, "POST", "/admin/reconcile?dry_run=true", "", nil)
+	report := decodeReconcile(t, w.Body.Bytes())
+	if w.Code != http.StatusOK || report.Scanned != 4 || report.Discrepancies != 3 || report.Fixed != 0 || !report.DryRun {
+		t.Fatalf("Expected 3 of 4 pages reported in the dry run, got %d: %s", w.Code, w.Body.String())
+	}
+	drift := make(map[string]LeaderboardDrift)
+	for _, entry := range report.Entries {
+		drift[entry.Page] = entry
+	}
+	if d := drift["home"]; d.Counter != 5 || d.Score == nil || *d.Score != 2 {
+		t.Errorf("Expected home counted 5 but scored 2, got %+v", d)
+	}
+	if d := drift["about"]; d.Counter != 2 || d.Score == nil || *d.Score != 1 {
+		t.Errorf("Expected about counted 2 but scored 1, got %+v", d)
+	}
+	if d, ok := drift["docs:intro"]; !ok || d.Score != nil {
+		t.Errorf("Expected docs:intro missing from the leaderboard, got %+v", d)
+	}
+	if score, _ := mr.ZScore(leaderboardKey, "home"); score != 2 {
+		t.Errorf("Expected the dry run to leave scores alone, got %v", score)
+	}
+
+	w = doRequest(router, "POST", "/admin/reconcile", "", nil)
+	if report = decodeReconcile(t, w.Body.Bytes()); report.Fixed != 3 {
+		t.Fatalf("Expected 3 scores fixed, got %s", w.Body.String())
+	}
+	for page, want := range map[string]float64{"home": 5, "about": 2, "docs:intro": 2, "pricing": 2} {
+		if score, err := mr.ZScore(leaderboardKey, page); err != nil || score != want {
+			t.Errorf("Expected %s scored %v, got %v, %v", page, want, score, err)
+		}
+	}
+	top := doRequest(router, "GET", "/pages/top", "", nil).Body.String()
+	if !strings.HasPrefix(top, `{"pages":[{"page":"home","visits":5`) {
+		t.Errorf("Expected the repaired leaderboard to be served, got %s", top)
+	}
+
+	w = doRequest(router, "POST", "/admin/reconcile", "", nil)
+	if report = decodeReconcile(t, w.Body.Bytes()); report.Discrepancies != 0 || len(report.Entries) != 0 {
+		t.Errorf("Expected a consistent leaderboard after repair, got %s", w.Body.String())
+	}
+}
+
+func TestReconcileLocking(t *testing.T) {
+	_, redisClient := newTestRedis(t)
+	router := newTestServer(t, testConfig(), redisClient).Router()
+	release, ok, err := redisClient.AcquireMaintenanceLock(context.Background(), time.Minute)
+	if err != nil || !ok {
+		t.Fatalf("Failed to take the maintenance lock: %v", err)
+	}
+	if w := doRequest(router, "POST", "/admin/reconcile", "", nil); w.Code != http.StatusConflict {
+		t.Errorf("Expected 409 while maintenance runs elsewhere, got %d", w.Code)
+	}
+	release()
+	if w := doRequest(router, "POST", "/admin/reconcile", "", nil); w.Code != http.StatusOK {
+		t.Errorf("Expected 200 once the lock is free, got %d", w.Code)
+	}
+}
+
+func TestReconcileWorker(t *testing.T) {
+	mr, redisClient := newTestRedis(t)
+	cfg := testConfig()
+	cfg.ReconcileInterval = 10 * time.Millisecond
+	router := newTestServer(t, cfg, redisClient).Router()
+	doRequest(router, "GET", "/visit/home", "", nil)
+	mr.ZAdd(leaderboardKey, 40, "home")
+
+	waitFor(t, time.Second, func() bool {
+		score, _ := mr.ZScore(leaderboardKey, "home")
+		return score == 1
+	})
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+// redisOpsHeader carries a request's Redis accounting with DEBUG_HEADERS=true
+const redisOpsHeader = "X-Redis-Ops"
+
+// RedisOps accounts for the Redis commands sent on behalf of one request:
+// how many, in how many round trips, and the time spent waiting on them.
+// Pipelined commands count individually but share one round trip. Work
+// handed to background goroutines with the request's context is counted
+// too, as long as it runs before the response is sent.
+type RedisOps struct {
+	commands   atomic.Int64
+	roundTrips atomic.Int64
+	nanos      atomic.Int64
+}
+
+// redisOpsKey is the context key of a request's RedisOps
+type redisOpsKey struct{}
+
+// withRedisOps returns ctx accounting its Redis commands in ops
+func withRedisOps(ctx context.Context, ops *RedisOps) context.Context {
+	return context.WithValue(ctx, redisOpsKey{}, ops)
+}
+
+// redisOpsFrom returns the RedisOps of ctx, nil outside a request
+func redisOpsFrom(ctx context.Context) *RedisOps {
+	ops, _ := ctx.Value(redisOpsKey{}).(*RedisOps)
+	return ops
+}
+
+// observe adds one round trip of n commands that took d
+func (o *RedisOps) observe(n int, d time.Duration) {
+	o.commands.Add(int64(n))
+	o.roundTrips.Add(1)
+	o.nanos.Add(int64(d))
+}
+
+// Commands returns the commands counted so far
+func (o *RedisOps) Commands() int64 { return o.commands.Load() }
+
+// RoundTrips returns the round trips counted so far
+func (o *RedisOps) RoundTrips() int64 { return o.roundTrips.Load() }
+
+// Duration returns the time spent in Redis calls so far
+func (o *RedisOps) Duration() time.Duration { return time.Duration(o.nanos.Load()) }
+
+// header formats the accounting as the X-Redis-Ops value, the duration in
+// milliseconds
+func (o *RedisOps) header() string {
+	return fmt.Sprintf("commands=%d;round_trips=%d;dur=%s",
+		o.Commands(), o.RoundTrips(), strconv.FormatFloat(durationMs(o.Duration()), 'f', 2, 64))
+}
+
+// redisOpsHook counts each call in the RedisOps of its context. It is
+// installed first, outside the retry hook, so a retried command counts
+// once, its retries adding to the duration.
+type redisOpsHook struct{}
+
+func (redisOpsHook) DialHook(next redis.DialHook) redis.DialHook { return next }
+
+func (redisOpsHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		ops := redisOpsFrom(ctx)
+		if ops == nil {
+			return next(ctx, cmd)
+		}
+		start := time.Now()
+		err := next(ctx, cmd)
+		ops.observe(1, time.Since(start))
+		return err
+	}
+}
+
+func (redisOpsHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		ops := redisOpsFrom(ctx)
+		if ops == nil {
+			return next(ctx, cmds)
+		}
+		n := 0
+		for _, cmd := range cmds {
+			// A transaction arrives wrapped in MULTI and EXEC
+			if name := cmd.Name(); name != "multi" && name != "exec" {
+				n++
+			}
+		}
+		start := time.Now()
+		err := next(ctx, cmds)
+		ops.observe(n, time.Since(start))
+		return err
+	}
+}
+
+// countRedisOps accounts for the request's Redis commands, warning when
+// they exceed REDIS_COMMAND_BUDGET and, with DEBUG_HEADERS=true, sending
+// them in X-Redis-Ops
+func (s *Server) countRedisOps(c *gin.Context) {
+	ops := &RedisOps{}
+	c.Request = c.Request.WithContext(withRedisOps(c.Request.Context(), ops))
+	if s.cfg.DebugHeaders {
+		writer := c.Writer
+		c.Writer = &redisOpsWriter{ResponseWriter: writer, ops: ops}
+		defer func() { c.Writer = writer }()
+	}
+	c.Next()
+
+	if budget := s.cfg.RedisCommandBudget; budget > 0 && ops.Commands() > budget {
+		log.Printf("Redis command budget exceeded: %s %s sent %d commands in %d round trips (%.2fms), budget %d",
+			c.Request.Method, c.FullPath(), ops.Commands(), ops.RoundTrips(), durationMs(ops.Duration()), budget)
+	}
+}
+
+// redisOpsWriter sets X-Redis-Ops just before the response's headers are
+// sent, counting the commands up to there
+type redisOpsWriter struct {
+	gin.ResponseWriter
+	ops *RedisOps
+	set bool
+}
+
+func (w *redisOpsWriter) setHeader() {
+	if !w.set && !w.Written() {
+		w.set = true
+		w.Header().Set(redisOpsHeader, w.ops.header())
+	}
+}
+
+func (w *redisOpsWriter) WriteHeaderNow() {
+	w.setHeader()
+	w.ResponseWriter.WriteHeaderNow()
+}
+
+func (w *redisOpsWriter) Write(b []byte) (int, error) {
+	w.setHeader()
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *redisOpsWriter) WriteString(s string) (int, error) {
+	w.setHeader()
+	return w.ResponseWriter.WriteString(s)
+}
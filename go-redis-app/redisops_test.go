@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/redis/go-redis/v9"
+)
+
+func TestRedisOpsCountsPipelinedCommands(t *testing.T) {
+	_, redisClient := newTestRedis(t)
+	ops := &RedisOps{}
+	ctx := withRedisOps(context.Background(), ops)
+
+	redisClient.client.Get(ctx, "visits:home")
+	redisClient.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Incr(ctx, "visits:home")
+		pipe.ZIncrBy(ctx, leaderboardKey, 1, "home")
+		pipe.PFAdd(ctx, uniqueKey("home"), "v1")
+		return nil
+	})
+	// MULTI and EXEC are not counted
+	redisClient.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Get(ctx, "visits:home")
+		pipe.Get(ctx, "visits:docs")
+		return nil
+	})
+	if ops.Commands() != 6 || ops.RoundTrips() != 3 || ops.Duration() <= 0 {
+		t.Errorf("Expected 6 commands in 3 round trips, got %s", ops.header())
+	}
+
+	// Calls outside a request are not accounted anywhere
+	redisClient.client.Get(context.Background(), "visits:home")
+	if ops.Commands() != 6 {
+		t.Errorf("Expected the call without RedisOps uncounted, got %d", ops.Commands())
+	}
+}
+
+func TestRedisOpsHeader(t *testing.T) {
+	_, redisClient := newTestRedis(t)
+	cfg := testConfig()
+	cfg.DebugHeaders = true
+	router := newTestServer(t, cfg, redisClient).Router()
+
+	for _, tt := range []struct {
+		path, want string
+	}{
+		{"/health", "commands=1;round_trips=1;"},
+		// The archived pages, the metadata, then the counts; aliases are
+		// resolved locally
+		{"/visits/home", "commands=3;round_trips=3;"},
+		{"/admin/flags", "commands=0;round_trips=0;"},
+	} {
+		if got := doRequest(router, "GET", tt.path, "", nil).Header().Get(redisOpsHeader); !strings.HasPrefix(got, tt.want) {
+			t.Errorf("GET %s: expected %s, got %q", tt.path, tt.want, got)
+		}
+	}
+
+	// A visit pipelines most of its writes into one round trip
+	header := doRequest(router, "GET", "/visit/home", "", nil).Header().Get(redisOpsHeader)
+	ops := parseRedisOpsHeader(t, header)
+	if ops["commands"] < 12 || 2*ops["round_trips"] >= ops["commands"] {
+		t.Errorf("Expected the visit's pipeline counted per command, got %q", header)
+	}
+
+	plain := newTestServer(t, testConfig(), redisClient).Router()
+	if got := doRequest(plain, "GET", "/health", "", nil).Header().Get(redisOpsHeader); got != "" {
+		t.Errorf("Expected no header without DEBUG_HEADERS, got %q", got)
+	}
+}
+
+// parseRedisOpsHeader returns the counts of an X-Redis-Ops value
+func parseRedisOpsHeader(t *testing.T, header string) map[string]int {
+	t.Helper()
+	counts := make(map[string]int)
+	for _, part := range strings.Split(header, ";") {
+		name, value, _ := strings.Cut(part, "=")
+		if name == "dur" {
+			continue
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			t.Fatalf("Invalid %s in %q", name, header)
+		}
+		counts[name] = n
+	}
+	return counts
+}
+
+func TestRedisCommandBudgetWarning(t *testing.T) {
+	_, redisClient := newTestRedis(t)
+	cfg := testConfig()
+	cfg.RedisCommandBudget = 10
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	router := newTestServer(t, cfg, redisClient).Router()
+
+	// A month of daily buckets is read a command per day
+	if w := doRequest(router, "GET", "/visits/home/range?from=2024-01-01&to=2024-01-31", "", nil); w.Code != http.StatusOK {
+		t.Fatalf("Range: %d %s", w.Code, w.Body.String())
+	}
+	if !strings.Contains(logs.String(), "Redis command budget exceeded: GET /visits/:page/range sent ") || !strings.Contains(logs.String(), "budget 10") {
+		t.Errorf("Expected the range warned about, got %q", logs.String())
+	}
+
+	logs.Reset()
+	doRequest(router, "GET", "/visits/home", "", nil)
+	if strings.Contains(logs.String(), "budget exceeded") {
+		t.Errorf("Expected no warning within the budget, got %q", logs.String())
+	}
+	if got := doRequest(router, "GET", "/health", "", nil).Header().Get(redisOpsHeader); got != "" {
+		t.Errorf("Expected the budget alone to send no header, got %q", got)
+	}
+}
@@ -0,0 +1,404 @@
+package main
+
+import (
+	"bufio"
+	"container/heap"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// replayVisit is a visit to replay at an offset from the first visit
+type replayVisit struct {
+	at   time.Duration
+	page string
+}
+
+// replayRecord is a line of an NDJSON export: a visit event from the event
+// stream, with a time, or a history row, with a date and a day's visits
+type replayRecord struct {
+	Type   string    `json:"type"`
+	Page   string    `json:"page"`
+	Time   time.Time `json:"time"`
+	Date   string    `json:"date"`
+	Visits int64     `json:"visits"`
+}
+
+// replayRun is a run of visits to one page spread evenly over length from
+// start: a history row's day, or a single visit event with no length
+type replayRun struct {
+	page   string
+	start  time.Time
+	length time.Duration
+	visits int64
+}
+
+// visitAt returns the time of the run's i-th visit
+func (r replayRun) visitAt(i int64) time.Time {
+	return r.start.Add(time.Duration(float64(r.length) * float64(i) / float64(r.visits)))
+}
+
+// replaySchedule is the visits of an export in time order. It keeps the
+// export's runs rather than its visits, so a history row of a busy day
+// costs one entry, and expands them as the replay goes.
+type replaySchedule struct {
+	runs   []replayRun
+	visits int64
+	// span is the offset of the last visit from the first
+	span time.Duration
+}
+
+// newReplaySchedule orders runs by start, keeping the input order of runs
+// starting together, and drops the empty ones
+func newReplaySchedule(runs []replayRun) (*replaySchedule, error) {
+	s := &replaySchedule{}
+	for _, run := range runs {
+		if run.visits > 0 {
+			s.runs = append(s.runs, run)
+			s.visits += run.visits
+		}
+	}
+	if len(s.runs) == 0 {
+		return nil, errors.New("no visits to replay")
+	}
+	sort.SliceStable(s.runs, func(a, b int) bool { return s.runs[a].start.Before(s.runs[b].start) })
+	first := s.runs[0].start
+	for _, run := range s.runs {
+		s.span = max(s.span, run.visitAt(run.visits-1).Sub(first))
+	}
+	return s, nil
+}
+
+// replayCursor is the next visit of a run being expanded
+type replayCursor struct {
+	at  time.Time
+	run int
+	i   int64
+}
+
+// replayCursors is a min-heap of cursors by visit time, then run order
+type replayCursors []replayCursor
+
+func (h replayCursors) Len() int { return len(h) }
+func (h replayCursors) Less(a, b int) bool {
+	if !h[a].at.Equal(h[b].at) {
+		return h[a].at.Before(h[b].at)
+	}
+	return h[a].run < h[b].run
+}
+func (h replayCursors) Swap(a, b int) { h[a], h[b] = h[b], h[a] }
+func (h *replayCursors) Push(x any)   { *h = append(*h, x.(replayCursor)) }
+func (h *replayCursors) Pop() any {
+	old := *h
+	c := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return c
+}
+
+// each calls fn with every visit in time order until it returns false,
+// reporting whether every visit was seen. Only the runs under way are held
+// expanded at a time.
+func (s *replaySchedule) each(fn func(replayVisit) bool) bool {
+	first := s.runs[0].start
+	cursors := &replayCursors{}
+	next := 0
+	for next < len(s.runs) || cursors.Len() > 0 {
+		// Runs start with their first visit, so a run starting before the
+		// earliest pending visit is due first
+		for next < len(s.runs) && (cursors.Len() == 0 || !s.runs[next].start.After((*cursors)[0].at)) {
+			heap.Push(cursors, replayCursor{at: s.runs[next].start, run: next})
+			next++
+		}
+		c := heap.Pop(cursors).(replayCursor)
+		run := s.runs[c.run]
+		if !fn(replayVisit{at: c.at.Sub(first), page: run.page}) {
+			return false
+		}
+		if c.i+1 < run.visits {
+			heap.Push(cursors, replayCursor{at: run.visitAt(c.i + 1), run: c.run, i: c.i + 1})
+		}
+	}
+	return true
+}
+
+// readReplaySchedule reads the visits to replay from an export, a line or
+// row at a time: visit events as NDJSON or a capture of /events, replayed
+// at their own times, or a history export as CSV or JSONL, with each day's
+// visits spread evenly over the day.
+func readReplaySchedule(r io.Reader) (*replaySchedule, error) {
+	br := bufio.NewReader(r)
+	var runs []replayRun
+	addDay := func(page, date string, visits int64) error {
+		day, err := time.Parse(dayLayout, date)
+		if err != nil {
+			return fmt.Errorf("invalid date %q", date)
+		}
+		runs = append(runs, replayRun{page: page, start: day, length: 24 * time.Hour, visits: visits})
+		return nil
+	}
+
+	if err := skipSpace(br); err != nil {
+		return nil, err
+	}
+	if header, _ := br.Peek(len("page,")); string(header) != "page," {
+		scanner := bufio.NewScanner(br)
+		for line := 1; scanner.Scan(); line++ {
+			text := strings.TrimSpace(scanner.Text())
+			if data, ok := strings.CutPrefix(text, "data:"); ok {
+				// A capture of /events
+				text = strings.TrimSpace(data)
+			}
+			if text == "" || isSSEField(text) {
+				continue
+			}
+			var rec replayRecord
+			if err := json.Unmarshal([]byte(text), &rec); err != nil {
+				return nil, fmt.Errorf("line %d: %w", line, err)
+			}
+			switch {
+			case rec.Page == "":
+				return nil, fmt.Errorf("line %d: missing page", line)
+			case rec.Date != "":
+				if err := addDay(rec.Page, rec.Date, rec.Visits); err != nil {
+					return nil, fmt.Errorf("line %d: %w", line, err)
+				}
+			case rec.Type == eventVisit:
+				runs = append(runs, replayRun{page: rec.Page, start: rec.Time, visits: 1})
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	} else {
+		rows := csv.NewReader(br)
+		header, err := rows.Read()
+		if err != nil {
+			return nil, err
+		}
+		if strings.Join(header, ",") != strings.Join(historyColumns, ",") {
+			return nil, errors.New("expected a history export with a page,date,visits header")
+		}
+		for line := 2; ; line++ {
+			row, err := rows.Read()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			visits, err := strconv.ParseInt(row[2], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("row %d: invalid visits %q", line, row[2])
+			}
+			if err := addDay(row[0], row[1], visits); err != nil {
+				return nil, fmt.Errorf("row %d: %w", line, err)
+			}
+		}
+	}
+	return newReplaySchedule(runs)
+}
+
+// isSSEField reports whether an event stream line is a comment or a field
+// other than data
+func isSSEField(line string) bool {
+	return strings.HasPrefix(line, ":") || strings.HasPrefix(line, "id:") || strings.HasPrefix(line, "event:") || strings.HasPrefix(line, "retry:")
+}
+
+// skipSpace reads past leading whitespace
+func skipSpace(br *bufio.Reader) error {
+	for {
+		b, err := br.Peek(1)
+		if err == io.EOF {
+			return errors.New("no visits to replay")
+		}
+		if err != nil {
+			return err
+		}
+		if !strings.ContainsRune(" \t\r\n", rune(b[0])) {
+			return nil
+		}
+		br.ReadByte()
+	}
+}
+
+// minReplayLoopPeriod is the shortest a looped pass of the schedule takes
+const minReplayLoopPeriod = time.Second
+
+// ReplayOptions configures a replay: Speed divides the gaps between
+// visits, Concurrency bounds the requests in flight
+type ReplayOptions struct {
+	Input       string
+	Target      string
+	Speed       float64
+	Concurrency int
+	Timeout     time.Duration
+	Loop        bool
+}
+
+// ReplayReport summarizes a replay. Errors are failed requests and
+// responses other than 2xx.
+type ReplayReport struct {
+	Sent        int64
+	Errors      int64
+	Elapsed     time.Duration
+	Interrupted bool
+}
+
+// RPS is the request rate achieved
+func (r ReplayReport) RPS() float64 {
+	if r.Elapsed <= 0 {
+		return 0
+	}
+	return float64(r.Sent) / r.Elapsed.Seconds()
+}
+
+// replayTraffic issues a GET /visit/<page> against opts.Target for each
+// visit at its offset divided by opts.Speed, holding a visit back while
+// opts.Concurrency requests are in flight. With opts.Loop the schedule
+// repeats, a pass at most every minReplayLoopPeriod, until ctx is done; otherwise it returns once every visit is
+// answered. Cancelling ctx stops new visits and waits for those in flight.
+func replayTraffic(ctx context.Context, client *http.Client, schedule *replaySchedule, opts ReplayOptions) ReplayReport {
+	target := strings.TrimSuffix(opts.Target, "/")
+	slots := make(chan struct{}, opts.Concurrency)
+	var wg sync.WaitGroup
+	var sent, failed atomic.Int64
+
+	send := func(page string) {
+		defer wg.Done()
+		defer func() { <-slots }()
+		sent.Add(1)
+		resp, err := client.Get(target + "/visit/" + url.PathEscape(page))
+		if err != nil {
+			failed.Add(1)
+			return
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			failed.Add(1)
+		}
+	}
+
+	start := time.Now()
+	// Each pass takes at least minReplayLoopPeriod, so looping an export
+	// whose visits share a time doesn't spin
+	period := max(time.Duration(float64(schedule.span)/opts.Speed), minReplayLoopPeriod)
+	interrupted := false
+	for pass := 0; pass == 0 || opts.Loop; pass++ {
+		passStart := start.Add(time.Duration(pass) * period)
+		done := schedule.each(func(v replayVisit) bool {
+			due := passStart.Add(time.Duration(float64(v.at) / opts.Speed))
+			if wait := time.Until(due); wait > 0 {
+				timer := time.NewTimer(wait)
+				select {
+				case <-ctx.Done():
+					timer.Stop()
+					return false
+				case <-timer.C:
+				}
+			}
+			select {
+			case <-ctx.Done():
+				return false
+			case slots <- struct{}{}:
+			}
+			wg.Add(1)
+			go send(v.page)
+			return true
+		})
+		if !done {
+			interrupted = true
+			break
+		}
+		if opts.Loop {
+			// Wait out the rest of the period before the next pass
+			timer := time.NewTimer(time.Until(passStart.Add(period)))
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				interrupted = true
+			case <-timer.C:
+			}
+			if interrupted {
+				break
+			}
+		}
+	}
+	wg.Wait()
+	return ReplayReport{Sent: sent.Load(), Errors: failed.Load(), Elapsed: time.Since(start), Interrupted: interrupted}
+}
+
+// parseReplayFlags reads the options of the replay subcommand
+func parseReplayFlags(args []string, output io.Writer) (ReplayOptions, error) {
+	var opts ReplayOptions
+	fs := flag.NewFlagSet("replay", flag.ContinueOnError)
+	fs.SetOutput(output)
+	fs.StringVar(&opts.Input, "input", "-", "history or event export to replay, - for stdin")
+	fs.StringVar(&opts.Target, "target", "", "base URL of the service to send the visits to")
+	fs.Float64Var(&opts.Speed, "speed", 1, "multiplier of the recorded pace")
+	fs.IntVar(&opts.Concurrency, "concurrency", 10, "maximum requests in flight")
+	fs.DurationVar(&opts.Timeout, "timeout", 10*time.Second, "timeout of each request")
+	fs.BoolVar(&opts.Loop, "loop", false, "repeat the replay until interrupted")
+	if err := fs.Parse(args); err != nil {
+		return ReplayOptions{}, err
+	}
+	if fs.NArg() > 0 {
+		return ReplayOptions{}, fmt.Errorf("unexpected arguments: %s", strings.Join(fs.Args(), " "))
+	}
+	if u, err := url.Parse(opts.Target); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return ReplayOptions{}, errors.New("--target must be an http or https URL")
+	}
+	if opts.Speed <= 0 {
+		return ReplayOptions{}, errors.New("--speed must be positive")
+	}
+	if opts.Concurrency < 1 {
+		return ReplayOptions{}, errors.New("--concurrency must be at least 1")
+	}
+	return opts, nil
+}
+
+// runReplayCommand is the replay subcommand: it replays an export against
+// a target until done or interrupted, then prints what it achieved
+func runReplayCommand(args []string, input io.Reader, output io.Writer) error {
+	opts, err := parseReplayFlags(args, output)
+	if err != nil {
+		return err
+	}
+	if opts.Input != "-" {
+		f, err := os.Open(opts.Input)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		input = f
+	}
+	schedule, err := readReplaySchedule(input)
+	if err != nil {
+		return fmt.Errorf("reading %s: %w", opts.Input, err)
+	}
+	fmt.Fprintf(output, "replaying %d visits over %s at %gx against %s\n",
+		schedule.visits, schedule.span, opts.Speed, opts.Target)
+
+	// Ctrl-C stops sending and reports once the requests in flight finish
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	report := replayTraffic(ctx, &http.Client{Timeout: opts.Timeout}, schedule, opts)
+	fmt.Fprintf(output, "sent %d, errors %d in %s: %.1f req/s (interrupted %t)\n",
+		report.Sent, report.Errors, report.Elapsed.Round(time.Millisecond), report.RPS(), report.Interrupted)
+	return nil
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// replayFixture is an NDJSON event export: three visits 100ms apart and a
+// page.created event that is not replayed
+const replayFixture = `{"type":"visit","page":"home","visits":41,"time":"2024-03-01T12:00:00.200Z"}
+{"type":"page.created","page":"blog","time":"2024-03-01T12:00:00.100Z"}
+{"type":"visit","page":"blog","visits":1,"time":"2024-03-01T12:00:00.100Z"}
+{"type":"visit","page":"a b","visits":7,"time":"2024-03-01T12:00:00.000Z"}
+`
+
+// replayTarget records the pages visited, answering 503 for "down"
+type replayTarget struct {
+	mu    sync.Mutex
+	pages []string
+}
+
+func (h *replayTarget) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	page := strings.TrimPrefix(r.URL.Path, "/visit/")
+	h.mu.Lock()
+	h.pages = append(h.pages, page)
+	h.mu.Unlock()
+	if page == "down" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+}
+
+func (h *replayTarget) visited() []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]string(nil), h.pages...)
+}
+
+// scheduledVisits expands a schedule for comparison
+func scheduledVisits(s *replaySchedule) []replayVisit {
+	var visits []replayVisit
+	s.each(func(v replayVisit) bool {
+		visits = append(visits, v)
+		return true
+	})
+	return visits
+}
+
+// readReplayVisits reads an export and expands its schedule
+func readReplayVisits(r io.Reader) ([]replayVisit, error) {
+	schedule, err := readReplaySchedule(r)
+	if err != nil {
+		return nil, err
+	}
+	return scheduledVisits(schedule), nil
+}
+
+func TestReadReplayVisits(t *testing.T) {
+	visits, err := readReplayVisits(strings.NewReader(replayFixture))
+	if err != nil {
+		t.Fatalf("Failed to read events: %v", err)
+	}
+	want := []replayVisit{{0, "a b"}, {100 * time.Millisecond, "blog"}, {200 * time.Millisecond, "home"}}
+	if !reflect.DeepEqual(visits, want) {
+		t.Errorf("Expected %v, got %v", want, visits)
+	}
+
+	// History exports spread a day's visits over the day
+	for _, export := range []string{
+		"page,date,visits\nhome,2024-03-01,4\nblog,2024-03-02,1\n",
+		`{"page":"home","date":"2024-03-01","visits":4}` + "\n" + `{"page":"blog","date":"2024-03-02","visits":1}`,
+	} {
+		visits, err := readReplayVisits(strings.NewReader(export))
+		if err != nil {
+			t.Fatalf("Failed to read %q: %v", export, err)
+		}
+		if len(visits) != 5 || visits[1].at != 6*time.Hour || visits[4] != (replayVisit{24 * time.Hour, "blog"}) {
+			t.Errorf("Expected home every 6h then blog, got %v", visits)
+		}
+	}
+
+	// A busy day is kept as one run until replayed
+	schedule, err := readReplaySchedule(strings.NewReader("page,date,visits\nhome,2024-03-01,1000000\n"))
+	if err != nil || len(schedule.runs) != 1 || schedule.visits != 1000000 || schedule.span != 24*time.Hour-86400*time.Microsecond {
+		t.Errorf("Expected one run of a million visits over the day, got %+v, %v", schedule, err)
+	}
+
+	// A capture of /events
+	sse := ": ping\n\nid: 1-0\ndata: " + strings.SplitN(replayFixture, "\n", 2)[0] + "\n\n"
+	if visits, err := readReplayVisits(strings.NewReader(sse)); err != nil || len(visits) != 1 || visits[0].page != "home" {
+		t.Errorf("Expected the visit in the capture, got %v, %v", visits, err)
+	}
+
+	for _, export := range []string{"", "date,visits\n", "page,visits\nhome,1\n", "{\"page\":\"home\",\"date\":\"March\",\"visits\":1}", `{"type":"page.created","page":"home"}`} {
+		if _, err := readReplayVisits(strings.NewReader(export)); err == nil {
+			t.Errorf("Expected %q rejected", export)
+		}
+	}
+}
+
+func TestReplayTraffic(t *testing.T) {
+	target := &replayTarget{}
+	ts := httptest.NewServer(target)
+	defer ts.Close()
+	schedule, _ := readReplaySchedule(strings.NewReader(replayFixture))
+
+	// One at a time at 4x: the 200ms schedule takes about 50ms, in order
+	opts := ReplayOptions{Target: ts.URL, Speed: 4, Concurrency: 1}
+	report := replayTraffic(context.Background(), ts.Client(), schedule, opts)
+	if got := target.visited(); !reflect.DeepEqual(got, []string{"a b", "blog", "home"}) {
+		t.Errorf("Expected the visits in recorded order, got %v", got)
+	}
+	if report.Sent != 3 || report.Errors != 0 || report.Interrupted {
+		t.Errorf("Unexpected report %+v", report)
+	}
+	if report.Elapsed < 50*time.Millisecond || report.Elapsed > time.Second {
+		t.Errorf("Expected the pace kept at 4x, took %s", report.Elapsed)
+	}
+
+	// Looping runs until interrupted; failures are counted
+	start := time.Now()
+	down, _ := newReplaySchedule([]replayRun{{page: "down", start: start, visits: 1}, {page: "home", start: start.Add(10 * time.Millisecond), visits: 1}})
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	report = replayTraffic(ctx, ts.Client(), down, ReplayOptions{Target: ts.URL + "/", Speed: 1, Concurrency: 2, Loop: true})
+	if !report.Interrupted || report.Sent != 2 || report.Errors != 1 {
+		t.Errorf("Expected one pass in the loop period with the down visit failed, got %+v", report)
+	}
+
+	// An export with no span still waits out the loop period between passes
+	instant, _ := newReplaySchedule([]replayRun{{page: "home", start: start, visits: 1}})
+	ctx, cancel = context.WithTimeout(context.Background(), minReplayLoopPeriod+minReplayLoopPeriod/2)
+	defer cancel()
+	report = replayTraffic(ctx, ts.Client(), instant, ReplayOptions{Target: ts.URL, Speed: 1, Concurrency: 1, Loop: true})
+	if !report.Interrupted || report.Sent != 2 {
+		t.Errorf("Expected two passes in one and a half loop periods, got %+v", report)
+	}
+}
+
+func TestReplayCommand(t *testing.T) {
+	target := &replayTarget{}
+	ts := httptest.NewServer(target)
+	defer ts.Close()
+	path := filepath.Join(t.TempDir(), "events.ndjson")
+	os.WriteFile(path, []byte(replayFixture), 0o644)
+
+	var out bytes.Buffer
+	if err := runReplayCommand([]string{"--input", path, "--target", ts.URL, "--speed", "10"}, nil, &out); err != nil {
+		t.Fatalf("replay failed: %v", err)
+	}
+	if !strings.Contains(out.String(), "replaying 3 visits over 200ms at 10x") || !strings.Contains(out.String(), "sent 3, errors 0") {
+		t.Errorf("Unexpected output %q", out.String())
+	}
+	if err := runReplayCommand([]string{"--target", ts.URL}, strings.NewReader(replayFixture), &out); err != nil || len(target.visited()) != 6 {
+		t.Errorf("Expected a replay from stdin, got %v", err)
+	}
+
+	for _, args := range [][]string{{}, {"--target", "localhost:8080"}, {"--target", ts.URL, "--speed", "0"}, {"--target", ts.URL, "--concurrency", "0"}} {
+		if _, err := parseReplayFlags(args, &out); err == nil {
+			t.Errorf("Expected %v rejected", args)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// WRITE_CONSISTENCY values
+const (
+	writeConsistencyLocal      = "local"
+	writeConsistencyReplicated = "replicated"
+)
+
+// maxWriteWaitTimeout bounds WRITE_WAIT_TIMEOUT, which every visit may wait
+// for
+const maxWriteWaitTimeout = time.Second
+
+// parseWriteConsistency validates a WRITE_CONSISTENCY value
+func parseWriteConsistency(value string) (string, error) {
+	switch value {
+	case writeConsistencyLocal, writeConsistencyReplicated:
+		return value, nil
+	}
+	return "", fmt.Errorf("must be %q or %q, got %q", writeConsistencyLocal, writeConsistencyReplicated, value)
+}
+
+// ReplicaWait is the WAIT a visit's pipeline ends with: with replicated
+// write consistency, the visit is acknowledged once Replicas replicas have
+// it, or as unconfirmed after Timeout
+type ReplicaWait struct {
+	Replicas int
+	Timeout  time.Duration
+}
+
+// queueWait adds the WAIT to the end of the pipeline. WAIT covers the
+// writes made on its connection, so it must share the pipeline's rather
+// than follow it; a MULTI/EXEC transaction can't hold it, which is why
+// STRICT_CONSISTENCY rules it out.
+func (w ReplicaWait) queueWait(ctx context.Context, pipe redis.Pipeliner) *redis.IntCmd {
+	cmd := redis.NewIntCmd(ctx, "wait", w.Replicas, w.Timeout.Milliseconds())
+	pipe.Process(ctx, cmd)
+	return cmd
+}
+
+// replicaWait returns the WAIT visits end with, nil unless
+// WRITE_CONSISTENCY is replicated
+func (s *Server) replicaWait() *ReplicaWait {
+	if s.cfg.WriteConsistency != writeConsistencyReplicated {
+		return nil
+	}
+	return &ReplicaWait{Replicas: int(s.cfg.WriteWaitReplicas), Timeout: s.cfg.WriteWaitTimeout}
+}
+
+// confirmed reports whether the WAIT reached enough replicas
+func (w ReplicaWait) confirmed(cmd *redis.IntCmd) bool {
+	return cmd.Err() == nil && cmd.Val() >= int64(w.Replicas)
+}
+
+// replicationAcks counts visits by whether their replication was
+// confirmed
+type replicationAcks struct {
+	confirmed   atomic.Int64
+	unconfirmed atomic.Int64
+}
+
+// observe counts one visit's WAIT
+func (a *replicationAcks) observe(confirmed bool) {
+	if confirmed {
+		a.confirmed.Add(1)
+	} else {
+		a.unconfirmed.Add(1)
+	}
+}
+
+// write writes the visit_replication_total series
+func (a *replicationAcks) write(b *strings.Builder, env string) {
+	prefix := ""
+	if env != "" {
+		prefix = "env=" + strconv.Quote(env) + ","
+	}
+	b.WriteString("# HELP visit_replication_total Visits written with WRITE_CONSISTENCY=replicated, by whether WRITE_WAIT_REPLICAS replicas confirmed them in time.\n")
+	b.WriteString("# TYPE visit_replication_total counter\n")
+	fmt.Fprintf(b, "visit_replication_total{%sconfirmed=\"true\"} %d\n", prefix, a.confirmed.Load())
+	fmt.Fprintf(b, "visit_replication_total{%sconfirmed=\"false\"} %d\n", prefix, a.unconfirmed.Load())
+}
+
+// errWaitInTransaction is returned for WRITE_CONSISTENCY=replicated with
+// STRICT_CONSISTENCY=true
+var errWaitInTransaction = errors.New("WAIT can't run inside the MULTI/EXEC transaction of STRICT_CONSISTENCY=true")
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// waitHook answers the WAIT commands of pipelines, which miniredis lacks,
+// with replicas or err
+type waitHook struct {
+	mu       sync.Mutex
+	replicas int64
+	err      error
+	waits    [][]interface{}
+}
+
+func (h *waitHook) reply(replicas int64, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.replicas, h.err = replicas, err
+}
+
+func (h *waitHook) DialHook(next redis.DialHook) redis.DialHook { return next }
+
+func (h *waitHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook { return next }
+
+func (h *waitHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		var rest []redis.Cmder
+		var waits []*redis.IntCmd
+		for _, cmd := range cmds {
+			if wait, ok := cmd.(*redis.IntCmd); ok && cmd.Name() == "wait" {
+				waits = append(waits, wait)
+				continue
+			}
+			rest = append(rest, cmd)
+		}
+		err := next(ctx, rest)
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		for _, wait := range waits {
+			h.waits = append(h.waits, wait.Args())
+			if h.err != nil {
+				wait.SetErr(h.err)
+				continue
+			}
+			wait.SetVal(h.replicas)
+		}
+		return err
+	}
+}
+
+// newReplicationTestServer returns a router waiting for 2 replicas, whose
+// WAIT replies come from the returned hook
+func newReplicationTestServer(t *testing.T, strict bool) (http.Handler, *waitHook) {
+	t.Helper()
+	_, redisClient := newTestRedis(t)
+	hook := &waitHook{}
+	redisClient.client.AddHook(hook)
+	cfg := testConfig()
+	cfg.WriteConsistency = writeConsistencyReplicated
+	cfg.WriteWaitReplicas, cfg.WriteWaitTimeout, cfg.WriteWaitStrict = 2, 50*time.Millisecond, strict
+	return newTestServer(t, cfg, redisClient).Router(), hook
+}
+
+func TestReplicatedWrites(t *testing.T) {
+	router, hook := newReplicationTestServer(t, false)
+	visit := func() (int, VisitResponse) {
+		t.Helper()
+		w := doRequest(router, "GET", "/visit/home", "", nil)
+		var resp VisitResponse
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		return w.Code, resp
+	}
+
+	hook.reply(2, nil)
+	code, resp := visit()
+	if code != http.StatusOK || resp.Replicated == nil || !*resp.Replicated || resp.Visits != 1 {
+		t.Fatalf("Expected a confirmed visit, got %d %+v", code, resp)
+	}
+	if len(hook.waits) != 1 || hook.waits[0][1] != 2 || hook.waits[0][2] != int64(50) {
+		t.Errorf("Expected WAIT 2 50, got %v", hook.waits)
+	}
+
+	// Too few replicas in time: still counted and successful
+	hook.reply(1, nil)
+	code, resp = visit()
+	if code != http.StatusOK || resp.Replicated == nil || *resp.Replicated || resp.Visits != 2 {
+		t.Errorf("Expected an unconfirmed visit, got %d %+v", code, resp)
+	}
+
+	// A failed WAIT leaves the visit written but unconfirmed
+	hook.reply(0, serverError("ERR WAIT cannot be used with replica instances"))
+	code, resp = visit()
+	if code != http.StatusOK || resp.Replicated == nil || *resp.Replicated || resp.Visits != 3 {
+		t.Errorf("Expected the visit kept despite the WAIT error, got %d %+v", code, resp)
+	}
+
+	metrics := doRequest(router, "GET", "/metrics", "", nil).Body.String()
+	for _, want := range []string{`visit_replication_total{confirmed="true"} 1`, `visit_replication_total{confirmed="false"} 2`} {
+		if !strings.Contains(metrics, want) {
+			t.Errorf("Expected %s in the metrics", want)
+		}
+	}
+}
+
+func TestReplicatedWritesStrict(t *testing.T) {
+	router, hook := newReplicationTestServer(t, true)
+
+	hook.reply(2, nil)
+	if w := doRequest(router, "GET", "/visit/home", "", nil); w.Code != http.StatusOK {
+		t.Errorf("Expected a confirmed visit answered 200, got %d", w.Code)
+	}
+	hook.reply(0, nil)
+	w := doRequest(router, "GET", "/visit/home", "", nil)
+	if w.Code != http.StatusAccepted || !strings.Contains(w.Body.String(), `"replicated":false`) {
+		t.Errorf("Expected an unconfirmed visit answered 202, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestLocalWritesSkipWait(t *testing.T) {
+	_, redisClient := newTestRedis(t)
+	hook := &waitHook{}
+	redisClient.client.AddHook(hook)
+	router := newTestServer(t, testConfig(), redisClient).Router()
+
+	w := doRequest(router, "GET", "/visit/home", "", nil)
+	if w.Code != http.StatusOK || strings.Contains(w.Body.String(), "replicated") || len(hook.waits) != 0 {
+		t.Errorf("Expected no WAIT with local consistency, got %d: %s", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// pageURLsKey maps URL-derived page names to the URL first resolved to them
+const pageURLsKey = "visits:pages:urls"
+
+// urlPagePrefix starts the page names derived from URLs
+const urlPagePrefix = "url-"
+
+// maxResolveURLLen bounds the URLs accepted by /resolve
+const maxResolveURLLen = 2048
+
+// defaultStripParams are the tracking parameters removed when
+// RESOLVE_STRIP_PARAMS is not set. A trailing '*' matches a prefix.
+var defaultStripParams = []string{"utm_*", "gclid", "fbclid", "msclkid", "mc_cid", "mc_eid", "_ga", "_gl"}
+
+// errPageURLNotFound is returned for pages no URL was resolved to
+var errPageURLNotFound = newKindError(ErrNotFound, "page URL not found")
+
+// ResolveRequest is the body of POST /resolve
+type ResolveRequest struct {
+	URL string `json:"url"`
+}
+
+// ResolveResponse is the page name for a URL
+type ResolveResponse struct {
+	Page         string `json:"page"`
+	URL          string `json:"url"`
+	CanonicalURL string `json:"canonical_url,omitempty"`
+}
+
+// canonicalizeURL normalizes an http(s) URL so that the spellings of one
+// page compare equal: the scheme and host are lowercased, a default port,
+// user info and the fragment are dropped, dot segments are resolved, the
+// query parameters matching strip are removed and the rest sorted by name.
+// Parameter values keep their order, and path case is preserved.
+func canonicalizeURL(raw string, strip []string) (string, error) {
+	u, err := url.Parse(strings.TrimSpace(raw))
+	if err != nil {
+		return "", err
+	}
+	u.Scheme = strings.ToLower(u.Scheme)
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return "", fmt.Errorf("scheme must be http or https")
+	}
+	if u.Opaque != "" || u.Hostname() == "" {
+		return "", fmt.Errorf("missing host")
+	}
+
+	host, port := strings.TrimSuffix(strings.ToLower(u.Hostname()), "."), u.Port()
+	if (u.Scheme == "http" && port == "80") || (u.Scheme == "https" && port == "443") {
+		port = ""
+	}
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	if port != "" {
+		host += ":" + port
+	}
+
+	p := u.Path
+	if p == "" {
+		p = "/"
+	}
+	cleaned := path.Clean(p)
+	if strings.HasSuffix(p, "/") && cleaned != "/" {
+		cleaned += "/"
+	}
+
+	query, err := url.ParseQuery(u.RawQuery)
+	if err != nil {
+		return "", fmt.Errorf("invalid query: %w", err)
+	}
+	for name := range query {
+		if stripParam(name, strip) {
+			delete(query, name)
+		}
+	}
+
+	// Encode sorts by name and re-escapes both path and query consistently
+	canonical := url.URL{Scheme: u.Scheme, Host: host, Path: cleaned, RawQuery: query.Encode()}
+	return canonical.String(), nil
+}
+
+// stripParam reports whether a query parameter matches the strip list,
+// ignoring case
+func stripParam(name string, strip []string) bool {
+	name = strings.ToLower(name)
+	for _, pattern := range strip {
+		pattern = strings.ToLower(pattern)
+		if prefix, ok := strings.CutSuffix(pattern, "*"); ok {
+			if strings.HasPrefix(name, prefix) {
+				return true
+			}
+		} else if name == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// urlPage returns the stable page name for a canonical URL
+func urlPage(canonical string) string {
+	sum := sha256.Sum256([]byte(canonical))
+	return urlPagePrefix + hex.EncodeToString(sum[:8])
+}
+
+// withoutUserInfo drops the user info from a URL, so credentials sent to
+// /resolve are neither stored nor served back. URLs that don't parse are
+// returned unchanged.
+func withoutUserInfo(raw string) string {
+	u, err := url.Parse(strings.TrimSpace(raw))
+	if err != nil || u.User == nil {
+		return raw
+	}
+	u.User = nil
+	return u.String()
+}
+
+// ResolvePageURL records rawURL, without its user info, as the URL of page
+// unless one is already recorded, returning the recorded URL
+func (r *RedisClient) ResolvePageURL(ctx context.Context, page, rawURL string) (string, error) {
+	if err := r.client.HSetNX(ctx, pageURLsKey, page, withoutUserInfo(rawURL)).Err(); err != nil {
+		return "", err
+	}
+	u, err := r.client.HGet(ctx, pageURLsKey, page).Result()
+	// URLs recorded before user info was dropped may still carry it
+	return withoutUserInfo(u), err
+}
+
+// PageURL returns the URL first resolved to page, or errPageURLNotFound
+func (r *RedisClient) PageURL(ctx context.Context, page string) (string, error) {
+	u, err := r.client.HGet(ctx, pageURLsKey, page).Result()
+	if isMissing(err) {
+		return "", errPageURLNotFound
+	}
+	return withoutUserInfo(u), err
+}
+
+// handleResolve maps a URL to the page name to count it under
+func (s *Server) handleResolve(c *gin.Context) {
+	var req ResolveRequest
+	if err := c.ShouldBindJSON(&req); err != nil || req.URL == "" {
+		respondError(c, http.StatusBadRequest, "invalid_request", `Body must be {"url": "..."}`)
+		return
+	}
+	if len(req.URL) > maxResolveURLLen {
+		respondError(c, http.StatusBadRequest, "invalid_request", fmt.Sprintf("url must be at most %d bytes", maxResolveURLLen))
+		return
+	}
+	canonical, err := canonicalizeURL(req.URL, s.cfg.ResolveStripParams)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, "invalid_request", "url: "+err.Error())
+		return
+	}
+
+	page := urlPage(canonical)
+	original, err := s.redis.ResolvePageURL(c.Request.Context(), page, req.URL)
+	if err != nil {
+		log.Printf("Error resolving URL: %v", err)
+		respondStoreError(c, err, "Failed to resolve URL")
+		return
+	}
+	respondJSON(c, http.StatusOK, ResolveResponse{Page: page, URL: original, CanonicalURL: canonical})
+}
+
+// handleGetPageURL returns the URL a page was resolved from
+func (s *Server) handleGetPageURL(c *gin.Context) {
+	page := c.Param("page")
+	hidden, err := s.pageHidden(c, page)
+	if err != nil {
+		log.Printf("Error getting page URL: %v", err)
+		respondStoreError(c, err, "Failed to get page URL")
+		return
+	}
+	if hidden {
+		respondError(c, http.StatusNotFound, "not_found", "Page not found")
+		return
+	}
+
+	original, err := s.redis.PageURL(c.Request.Context(), page)
+	if errors.Is(err, errPageURLNotFound) {
+		respondError(c, http.StatusNotFound, "not_found", "No URL was resolved to this page")
+		return
+	}
+	if err != nil {
+		log.Printf("Error getting page URL: %v", err)
+		respondStoreError(c, err, "Failed to get page URL")
+		return
+	}
+	respondJSON(c, http.StatusOK, ResolveResponse{Page: page, URL: original})
+}
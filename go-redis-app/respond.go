@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxPooledBuffer keeps buffers grown by large listings out of the pool
+const maxPooledBuffer = 64 << 10
+
+// jsonBuffer is a reusable response buffer with an encoder writing into it
+type jsonBuffer struct {
+	bytes.Buffer
+	enc *json.Encoder
+}
+
+var jsonBuffers = sync.Pool{New: func() interface{} {
+	b := new(jsonBuffer)
+	b.enc = json.NewEncoder(&b.Buffer)
+	return b
+}}
+
+// getJSONBuffer returns a buffer from the pool; release it once the encoded
+// bytes have been written
+func getJSONBuffer() *jsonBuffer {
+	return jsonBuffers.Get().(*jsonBuffer)
+}
+
+// encode encodes v into the buffer, returning the same bytes as json.Marshal.
+// They are only valid until the buffer is released.
+func (b *jsonBuffer) encode(v interface{}) ([]byte, error) {
+	b.Reset()
+	if err := b.enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(b.Bytes(), []byte("\n")), nil
+}
+
+// release returns the buffer to the pool
+func (b *jsonBuffer) release() {
+	if b.Cap() <= maxPooledBuffer {
+		jsonBuffers.Put(b)
+	}
+}
+
+// jsonAppender is implemented by hot-path responses that encode themselves
+// without reflection, producing the same bytes as json.Marshal
+type jsonAppender interface {
+	appendJSON(b []byte) []byte
+}
+
+// writeJSON writes v as a JSON response like c.JSON, but encodes it into a
+// pooled buffer instead of allocating the body for every request
+func writeJSON(c *gin.Context, status int, v interface{}) {
+	buf := getJSONBuffer()
+	defer buf.release()
+	var body []byte
+	if a, ok := v.(jsonAppender); ok {
+		buf.Reset()
+		body = a.appendJSON(buf.AvailableBuffer())
+		buf.Write(body)
+	} else {
+		var err error
+		if body, err = buf.encode(v); err != nil {
+			respondError(c, http.StatusInternalServerError, "internal_error", "Failed to encode response")
+			return
+		}
+	}
+	c.Data(status, "application/json; charset=utf-8", body)
+}
+
+// appendJSONString appends s as a JSON string. Strings that need escaping
+// are rare in responses (page names are URL segments) and are left to
+// encoding/json, so the output always matches json.Marshal.
+func appendJSONString(b []byte, s string) []byte {
+	for _, r := range s {
+		if r < 0x20 || r == '"' || r == '\\' || r == '<' || r == '>' || r == '&' ||
+			r == utf8.RuneError || r == '\u2028' || r == '\u2029' {
+			quoted, _ := json.Marshal(s)
+			return append(b, quoted...)
+		}
+	}
+	b = append(b, '"')
+	b = append(b, s...)
+	return append(b, '"')
+}
+
+// appendJSONFloat appends f as encoding/json formats it
+func appendJSONFloat(b []byte, f float64) []byte {
+	if abs := math.Abs(f); abs != 0 && (abs < 1e-6 || abs >= 1e21) {
+		encoded, _ := json.Marshal(f)
+		return append(b, encoded...)
+	}
+	return strconv.AppendFloat(b, f, 'f', -1, 64)
+}
+
+// appendJSON encodes the response field by field, honoring omitempty, since
+// it is written for every visit. Sessions included with ?include= are
+// written even when 0, and the compact view has its own encoding.
+func (v VisitResponse) appendJSON(b []byte) []byte {
+	if v.view.compact {
+		return v.appendCompactJSON(b)
+	}
+	b = append(b, `{"page":`...)
+	b = appendJSONString(b, v.Page)
+	b = append(b, `,"visits":`...)
+	b = strconv.AppendInt(b, v.Visits, 10)
+	if v.Sessions != 0 || v.view.sessions {
+		b = append(b, `,"sessions":`...)
+		b = strconv.AppendInt(b, v.Sessions, 10)
+	}
+	if v.WeightedVisits != nil {
+		b = append(b, `,"weighted_visits":`...)
+		b = appendJSONFloat(b, *v.WeightedVisits)
+	}
+	if v.Variant != "" {
+		b = append(b, `,"variant":`...)
+		b = appendJSONString(b, v.Variant)
+	}
+	if v.Approximate {
+		b = append(b, `,"approximate":true`...)
+	}
+	if v.Counted != nil {
+		b = append(b, `,"counted":`...)
+		b = strconv.AppendBool(b, *v.Counted)
+	}
+	if v.Reason != "" {
+		b = append(b, `,"reason":`...)
+		b = appendJSONString(b, v.Reason)
+	}
+	if v.Sampled {
+		b = append(b, `,"sampled":true`...)
+	}
+	if v.SampleRate != 0 {
+		b = append(b, `,"sample_rate":`...)
+		b = appendJSONFloat(b, v.SampleRate)
+	}
+	if v.FirstVisit {
+		b = append(b, `,"first_visit":true`...)
+	}
+	if v.ResolvedFrom != "" {
+		b = append(b, `,"resolved_from":`...)
+		b = appendJSONString(b, v.ResolvedFrom)
+	}
+	if v.Replicated != nil {
+		b = append(b, `,"replicated":`...)
+		b = strconv.AppendBool(b, *v.Replicated)
+	}
+	if v.Rank != nil {
+		b = append(b, `,"rank":`...)
+		b = strconv.AppendInt(b, *v.Rank, 10)
+	}
+	if v.Unique != nil {
+		b = append(b, `,"unique":`...)
+		b = strconv.AppendInt(b, *v.Unique, 10)
+	}
+	if v.Expanded != nil {
+		// Rarely asked for and nested, so left to encoding/json
+		expanded, err := json.Marshal(v.Expanded)
+		if err == nil {
+			b = append(b, `,"expanded":`...)
+			b = append(b, expanded...)
+		}
+	}
+	b = append(b, `,"timestamp":`...)
+	b = v.Timestamp.appendJSON(b)
+	return append(b, '}')
+}
+
+// MarshalJSON encodes the response with appendJSON
+func (v VisitResponse) MarshalJSON() ([]byte, error) {
+	return v.appendJSON(nil), nil
+}
+
+// respondJSON writes a read endpoint's response, trimmed to the top-level
+// ?fields= when given and indented with ?pretty=true. A weak ETag is
+// computed over the trimmed content, so each field selection has its own
+// tag while pretty-printing does not change it, and If-None-Match is
+// answered with 304.
+func respondJSON(c *gin.Context, status int, v interface{}) {
+	encoded := getJSONBuffer()
+	defer encoded.release()
+	body, err := encoded.encode(v)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, "internal_error", "Failed to encode response")
+		return
+	}
+
+	if fields := c.Query("fields"); fields != "" {
+		valid := jsonFieldNames(reflect.TypeOf(v))
+		if body, err = selectFields(body, strings.Split(fields, ","), valid); err != nil {
+			respondError(c, http.StatusBadRequest, "invalid_fields",
+				fmt.Sprintf("%v, valid fields: %s", err, strings.Join(valid, ",")))
+			return
+		}
+	}
+
+	if status == http.StatusOK {
+		sum := sha256.Sum256(body)
+		etag := `W/"` + hex.EncodeToString(sum[:16]) + `"`
+		c.Header("ETag", etag)
+		if etagMatches(c.GetHeader("If-None-Match"), etag) {
+			c.Status(http.StatusNotModified)
+			return
+		}
+	}
+
+	if pretty, _ := strconv.ParseBool(c.Query("pretty")); pretty {
+		var buf bytes.Buffer
+		if err := json.Indent(&buf, body, "", "  "); err == nil {
+			body = append(buf.Bytes(), '\n')
+		}
+	}
+	c.Data(status, "application/json; charset=utf-8", body)
+}
+
+// etagMatches reports whether an If-None-Match header matches the tag,
+// comparing weakly as RFC 9110 requires for If-None-Match
+func etagMatches(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// jsonFieldNames returns the top-level JSON field names of a struct type in
+// declaration order, including fields promoted from embedded structs
+func jsonFieldNames(t reflect.Type) []string {
+	for t != nil && t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if t == nil || t.Kind() != reflect.Struct {
+		return nil
+	}
+	var names []string
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if f.Anonymous && name == "" {
+			names = append(names, jsonFieldNames(f.Type)...)
+			continue
+		}
+		if !f.IsExported() || name == "-" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		names = append(names, name)
+	}
+	return names
+}
+
+// selectFields trims a JSON object to the requested fields, keeping the
+// order of valid. Requested fields absent from the object (omitted when
+// empty) are left out.
+func selectFields(body []byte, requested, valid []string) ([]byte, error) {
+	want := make(map[string]bool, len(requested))
+	for _, name := range requested {
+		name = strings.TrimSpace(name)
+		if !containsString(valid, name) {
+			return nil, fmt.Errorf("unknown field %q", name)
+		}
+		want[name] = true
+	}
+
+	var object map[string]json.RawMessage
+	if err := json.Unmarshal(body, &object); err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for _, name := range valid {
+		value, ok := object[name]
+		if !want[name] || !ok {
+			continue
+		}
+		if buf.Len() > 1 {
+			buf.WriteByte(',')
+		}
+		key, _ := json.Marshal(name)
+		buf.Write(key)
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// containsString reports whether list contains s
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
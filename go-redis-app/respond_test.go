@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestJSONFieldNames(t *testing.T) {
+	if got := jsonFieldNames(reflect.TypeOf(PageCount{})); !reflect.DeepEqual(got, []string{"page", "visits", "last_visit"}) {
+		t.Errorf("Unexpected PageCount fields: %v", got)
+	}
+	// Embedded struct fields are promoted
+	got := jsonFieldNames(reflect.TypeOf(&GoalStats{}))
+	if len(got) < 4 || got[0] != "name" || !containsString(got, "rate") {
+		t.Errorf("Unexpected GoalStats fields: %v", got)
+	}
+}
+
+func TestResponseFieldFiltering(t *testing.T) {
+	_, redisClient := newTestRedis(t)
+	router := newTestServer(t, testConfig(), redisClient).Router()
+	doRequest(router, "GET", "/visit/home", "", nil)
+
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"fields=visits", `{"visits":1}`},
+		{"fields=visits,page", `{"page":"home","visits":1}`},
+		{"fields=page,%20visits", `{"page":"home","visits":1}`},
+		// Valid fields omitted from this response are left out
+		{"fields=page,variant", `{"page":"home"}`},
+	}
+	for _, tt := range tests {
+		w := doRequest(router, "GET", "/visits/home?"+tt.query, "", nil)
+		if w.Code != http.StatusOK || w.Body.String() != tt.want {
+			t.Errorf("%s: expected %s, got %d %s", tt.query, tt.want, w.Code, w.Body.String())
+		}
+	}
+
+	w := doRequest(router, "GET", "/visits/home?fields=visits,bogus", "", nil)
+	var errResp ErrorResponse
+	json.Unmarshal(w.Body.Bytes(), &errResp)
+	if w.Code != http.StatusBadRequest || errResp.Code != "invalid_fields" || !strings.Contains(errResp.Error, "page,visits,sessions") {
+		t.Errorf("Expected 400 listing valid fields, got %d %s", w.Code, w.Body.String())
+	}
+
+	// Other read endpoints share the helper
+	if w := doRequest(router, "GET", "/pages/top?fields=total", "", nil); w.Body.String() != `{"total":1}` {
+		t.Errorf("Unexpected /pages/top response: %s", w.Body.String())
+	}
+}
+
+func TestResponsePrettyPrinting(t *testing.T) {
+	_, redisClient := newTestRedis(t)
+	router := newTestServer(t, testConfig(), redisClient).Router()
+	doRequest(router, "GET", "/visit/home", "", nil)
+
+	w := doRequest(router, "GET", "/visits/home?fields=page,visits&pretty=true", "", nil)
+	if want := "{\n  \"page\": \"home\",\n  \"visits\": 1\n}\n"; w.Body.String() != want {
+		t.Errorf("Expected indented output, got %q", w.Body.String())
+	}
+}
+
+func TestResponseETags(t *testing.T) {
+	_, redisClient := newTestRedis(t)
+	router := newTestServer(t, testConfig(), redisClient).Router()
+	doRequest(router, "GET", "/visit/home", "", nil)
+
+	etag := func(query string) string {
+		return doRequest(router, "GET", "/pages/top"+query, "", nil).Header().Get("ETag")
+	}
+	full, trimmed, pretty := etag(""), etag("?fields=pages"), etag("?fields=pages&pretty=true")
+	if full == "" || full == trimmed {
+		t.Errorf("Expected distinct ETags per field selection, got %q and %q", full, trimmed)
+	}
+	if trimmed != pretty {
+		t.Errorf("Expected pretty-printing to keep the ETag, got %q and %q", trimmed, pretty)
+	}
+
+	w := doRequest(router, "GET", "/pages/top?fields=pages", "", map[string]string{"If-None-Match": trimmed})
+	if w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+		t.Errorf("Expected 304 with no body, got %d %q", w.Code, w.Body.String())
+	}
+	if w := doRequest(router, "GET", "/pages/top", "", map[string]string{"If-None-Match": trimmed}); w.Code != http.StatusOK {
+		t.Errorf("Expected 200 when another selection's ETag is sent, got %d", w.Code)
+	}
+
+	// A new visit changes the content and so the ETag
+	doRequest(router, "GET", "/visit/home", "", nil)
+	if etag("?fields=pages") == trimmed {
+		t.Error("Expected the ETag to change with the content")
+	}
+}
+
+// plainVisit has VisitResponse's fields without its encoder
+type plainVisit VisitResponse
+
+func TestVisitResponseEncoding(t *testing.T) {
+	yes, no := true, false
+	weighted, zero := 12.5, 0.0
+	rank, unique := int64(2), int64(0)
+	ts := Timestamp{Time: time.Date(2024, 5, 1, 12, 30, 0, 0, time.FixedZone("", 2*3600))}
+	for _, v := range []VisitResponse{
+		{Page: "home", Timestamp: ts},
+		{Page: "home", Visits: 42, Sessions: 7, Variant: "b", Approximate: true, Counted: &yes, Sampled: true, SampleRate: 0.25, FirstVisit: true, Timestamp: ts},
+		{Page: "docs/a b", Visits: -1, Counted: &no, Reason: reasonOptOut, SampleRate: 1e-7, Timestamp: Timestamp{Time: ts.Time, Format: TimestampUnixMs}},
+		{Page: "<script>&\"\\\n", Variant: "caf\u00e9\u2028", Timestamp: Timestamp{Time: ts.Time, Format: TimestampUnix}},
+		{Page: "bad\xffutf8", SampleRate: 1e21, Timestamp: ts},
+		{Page: "checkout", Visits: 5, WeightedVisits: &weighted, Timestamp: ts},
+		{Page: "checkout", WeightedVisits: &zero, Timestamp: ts},
+		{Page: "home", Visits: 3, Rank: &rank, Unique: &unique, Timestamp: ts},
+		{Page: "pricing", ResolvedFrom: "plans", Visits: 4, Timestamp: ts},
+		{Page: "home", Visits: 6, Replicated: &no, Timestamp: ts},
+		{Page: "home", Visits: 6, Expanded: &Expansions{Unique: &unique, Meta: &PageMeta{Title: "<Home>", Visibility: visibilityPublic}}, Timestamp: ts},
+	} {
+		want, _ := json.Marshal(plainVisit(v))
+		if got, _ := json.Marshal(v); string(got) != string(want) {
+			t.Errorf("Expected %s, got %s", want, got)
+		}
+
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		writeJSON(c, http.StatusOK, v)
+		if w.Body.String() != string(want) {
+			t.Errorf("Expected writeJSON to write %s, got %s", want, w.Body.String())
+		}
+		if ct := w.Header().Get("Content-Type"); ct != "application/json; charset=utf-8" {
+			t.Errorf("Unexpected Content-Type %q", ct)
+		}
+	}
+
+	// Other values go through the pooled encoder
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	writeJSON(c, http.StatusOK, ErrorResponse{Error: "bad <request>", Code: "invalid_request"})
+	if want, _ := json.Marshal(ErrorResponse{Error: "bad <request>", Code: "invalid_request"}); w.Body.String() != string(want) {
+		t.Errorf("Expected %s, got %s", want, w.Body.String())
+	}
+}
+
+// BenchmarkVisitResponse compares writing a visit response with c.JSON and
+// reflection, as before, and with appendJSON into a pooled buffer; run with
+// -benchmem to see the allocations
+func BenchmarkVisitResponse(b *testing.B) {
+	counted := true
+	response := VisitResponse{Page: "home", Visits: 12345, Sessions: 678, Counted: &counted, Timestamp: Timestamp{Time: time.Now()}}
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	for _, bench := range []struct {
+		name  string
+		write func(c *gin.Context, status int, v interface{})
+	}{
+		{"gin", func(c *gin.Context, status int, v interface{}) { c.JSON(status, plainVisit(v.(VisitResponse))) }},
+		{"pooled", writeJSON},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				w.Body.Reset()
+				bench.write(c, http.StatusOK, response)
+			}
+		})
+	}
+}
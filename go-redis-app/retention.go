@@ -0,0 +1,453 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	dayLayout   = "2006-01-02"
+	monthLayout = "2006-01"
+
+	resolutionDaily   = "daily"
+	resolutionMonthly = "monthly"
+
+	// maxRangeDays bounds a range query
+	maxRangeDays = 5 * 366
+)
+
+// rollupScript moves a bucket's count into a coarser one (a daily bucket into
+// its month, or an expired bucket into the pre-history offset) atomically, so
+// visits are never counted in both or lost between them
+//
+// KEYS[1] source bucket, KEYS[2] destination
+var rollupScript = redis.NewScript(`
+local count = redis.call('GET', KEYS[1])
+if not count then
+	return 0
+end
+redis.call('INCRBY', KEYS[2], count)
+redis.call('DEL', KEYS[1])
+return tonumber(count)
+`)
+
+// RetentionPolicy is how long each resolution is kept. Zero keeps the
+// resolution forever.
+type RetentionPolicy struct {
+	DailyDays     int
+	MonthlyMonths int
+}
+
+// Enabled reports whether the policy removes anything
+func (p RetentionPolicy) Enabled() bool {
+	return p.DailyDays > 0 || p.MonthlyMonths > 0
+}
+
+// cutoffs returns the first daily and monthly periods that are kept; older
+// periods are rolled up or expired. Zero times mean nothing is removed.
+func (p RetentionPolicy) cutoffs(now time.Time) (daily, monthly time.Time) {
+	now = now.UTC()
+	if p.DailyDays > 0 {
+		daily = time.Date(now.Year(), now.Month(), now.Day()-p.DailyDays, 0, 0, 0, 0, time.UTC)
+	}
+	if p.MonthlyMonths > 0 {
+		monthly = time.Date(now.Year(), now.Month()-time.Month(p.MonthlyMonths), 1, 0, 0, 0, 0, time.UTC)
+	}
+	return daily, monthly
+}
+
+// RetentionReport summarizes a retention run
+type RetentionReport struct {
+	DryRun         bool   `json:"dry_run"`
+	DailyCutoff    string `json:"daily_cutoff,omitempty"`
+	MonthlyCutoff  string `json:"monthly_cutoff,omitempty"`
+	RolledUp       int    `json:"rolled_up"`
+	ExpiredDaily   int    `json:"expired_daily"`
+	ExpiredMonthly int    `json:"expired_monthly"`
+}
+
+// monthlyKey returns the monthly bucket key for a page
+func monthlyKey(page string, t time.Time) string {
+	return key("visits", page, "monthly", t.UTC().Format(monthLayout))
+}
+
+// parseBucketKey splits a daily or monthly bucket key into its page,
+// resolution, and period
+func parseBucketKey(key string) (page, resolution string, period time.Time, ok bool) {
+	for _, b := range []struct{ resolution, layout string }{
+		{resolutionDaily, dayLayout},
+		{resolutionMonthly, monthLayout},
+	} {
+		suffix := len(":"+b.resolution+":") + len(b.layout)
+		if len(key) < len("visits:")+suffix {
+			continue
+		}
+		cut := len(key) - suffix
+		if key[cut:cut+len(b.resolution)+2] != ":"+b.resolution+":" {
+			continue
+		}
+		t, err := time.Parse(b.layout, key[len(key)-len(b.layout):])
+		if err != nil {
+			continue
+		}
+		return key[len("visits:"):cut], b.resolution, t, true
+	}
+	return "", "", time.Time{}, false
+}
+
+// scanKeys calls fn with each batch of keys matching pattern
+func (r *RedisClient) scanKeys(ctx context.Context, pattern string, fn func([]string) error) error {
+	return r.scanKeysOfType(ctx, pattern, "", fn)
+}
+
+// scanKeysOfType is scanKeys limited to keys of keyType, or of any type when
+// keyType is empty
+func (r *RedisClient) scanKeysOfType(ctx context.Context, pattern, keyType string, fn func([]string) error) error {
+	var cursor uint64
+	for {
+		var keys []string
+		var next uint64
+		var err error
+		if keyType == "" {
+			keys, next, err = r.client.Scan(ctx, cursor, pattern, backfillBatchSize).Result()
+		} else {
+			keys, next, err = r.client.ScanType(ctx, cursor, pattern, backfillBatchSize, keyType).Result()
+		}
+		if err != nil {
+			return err
+		}
+		if len(keys) > 0 {
+			if err := fn(keys); err != nil {
+				return err
+			}
+		}
+		if cursor = next; cursor == 0 {
+			return nil
+		}
+	}
+}
+
+// ApplyRetention rolls daily buckets older than the daily window into
+// monthly buckets and deletes buckets older than the monthly window, folding
+// their counts into the page's pre-history offset so totals recomputed by a
+// backfill still reconcile. With
+// dryRun set it only counts what would change. Callers must hold the
+// maintenance lock.
+func (r *RedisClient) ApplyRetention(ctx context.Context, now time.Time, policy RetentionPolicy, dryRun bool) (RetentionReport, error) {
+	dailyCutoff, monthlyCutoff := policy.cutoffs(now)
+	report := RetentionReport{DryRun: dryRun}
+	if !dailyCutoff.IsZero() {
+		report.DailyCutoff = dailyCutoff.Format(dayLayout)
+	}
+	if !monthlyCutoff.IsZero() {
+		report.MonthlyCutoff = monthlyCutoff.Format(monthLayout)
+	}
+	expired := func(t time.Time) bool { return !monthlyCutoff.IsZero() && t.Before(monthlyCutoff) }
+
+	err := r.scanKeys(ctx, "visits:*:daily:*", func(keys []string) error {
+		pipe := r.client.Pipeline()
+		for _, key := range keys {
+			page, resolution, day, ok := parseBucketKey(key)
+			switch {
+			case !ok || resolution != resolutionDaily:
+			case expired(day):
+				// Past both windows: the monthly bucket would expire anyway
+				report.ExpiredDaily++
+				if !dryRun {
+					rollupScript.Eval(ctx, pipe, []string{key, preHistoryKey(page)})
+				}
+			case !dailyCutoff.IsZero() && day.Before(dailyCutoff):
+				report.RolledUp++
+				if !dryRun {
+					rollupScript.Eval(ctx, pipe, []string{key, monthlyKey(page, day)})
+				}
+			}
+		}
+		if dryRun || pipe.Len() == 0 {
+			return nil
+		}
+		_, err := pipe.Exec(ctx)
+		return err
+	})
+	if err != nil {
+		return report, err
+	}
+
+	if monthlyCutoff.IsZero() {
+		return report, nil
+	}
+	err = r.scanKeys(ctx, "visits:*:monthly:*", func(keys []string) error {
+		pipe := r.client.Pipeline()
+		for _, key := range keys {
+			page, resolution, month, ok := parseBucketKey(key)
+			if !ok || resolution != resolutionMonthly || !expired(month) {
+				continue
+			}
+			report.ExpiredMonthly++
+			if !dryRun {
+				rollupScript.Eval(ctx, pipe, []string{key, preHistoryKey(page)})
+			}
+		}
+		if dryRun || pipe.Len() == 0 {
+			return nil
+		}
+		_, err := pipe.Exec(ctx)
+		return err
+	})
+	return report, err
+}
+
+// runRetention applies the configured retention policy under the
+// maintenance lock, reporting ok=false when another replica holds it
+func (s *Server) runRetention(ctx context.Context, dryRun bool) (RetentionReport, bool, error) {
+	release, ok, err := s.redis.AcquireMaintenanceLock(ctx, 10*time.Minute)
+	if err != nil || !ok {
+		return RetentionReport{}, false, err
+	}
+	defer release()
+	now := s.clock.Now()
+	if s.archive != nil && !dryRun {
+		// Buckets are only removed once they are safely on disk
+		file, err := s.archive.Archive(ctx, s.redis, s.cfg.Retention.removedBefore(now), now)
+		if err != nil {
+			return RetentionReport{}, true, err
+		}
+		if file != nil {
+			log.Printf("Archived %d daily buckets from %s to %s to %s", file.Rows, file.From, file.To, file.Name)
+		}
+	}
+	report, err := s.redis.ApplyRetention(ctx, now, s.cfg.Retention, dryRun)
+	return report, true, err
+}
+
+// retentionWorker is the periodic retention job
+func (s *Server) retentionWorker(ctx context.Context) error {
+	report, ok, err := s.runRetention(ctx, s.cfg.RetentionDryRun)
+	if err == nil && ok && (report.RolledUp > 0 || report.ExpiredDaily > 0 || report.ExpiredMonthly > 0) {
+		log.Printf("Retention (dry run %t): rolled up %d, expired %d daily and %d monthly buckets",
+			report.DryRun, report.RolledUp, report.ExpiredDaily, report.ExpiredMonthly)
+	}
+	return err
+}
+
+// handleRunRetention runs the retention policy on demand
+func (s *Server) handleRunRetention(c *gin.Context) {
+	if !s.cfg.Retention.Enabled() {
+		respondError(c, http.StatusBadRequest, "invalid_request", "No retention policy is configured")
+		return
+	}
+	dryRun, _ := strconv.ParseBool(c.Query("dry_run"))
+
+	report, ok, err := s.runRetention(c.Request.Context(), dryRun)
+	if err != nil {
+		log.Printf("Error applying retention: %v", err)
+		respondStoreError(c, err, "Failed to apply retention")
+		return
+	}
+	if !ok {
+		respondError(c, http.StatusConflict, "conflict", "Maintenance is already running on another replica")
+		return
+	}
+	c.JSON(http.StatusOK, report)
+}
+
+// RangePoint is one bucket of a range query
+type RangePoint struct {
+	Period     string `json:"period"`
+	Resolution string `json:"resolution"`
+	Visits     int64  `json:"visits"`
+}
+
+// RangeResponse represents a page's visits over a date range
+type RangeResponse struct {
+	Page   string       `json:"page"`
+	From   string       `json:"from"`
+	To     string       `json:"to"`
+	Points []RangePoint `json:"points"`
+	Total  int64        `json:"total"`
+
+	// Annotations are the page's annotations within the range
+	Annotations []Annotation `json:"annotations"`
+
+	// Daily holds the daily points from the daily retention cutoff on as a
+	// DeltaSeries with encoding=delta, Points then only the monthly ones and
+	// days before the cutoff not yet rolled up. It is nil when the whole
+	// range is before the cutoff.
+	Daily *DeltaSeries `json:"daily,omitempty"`
+
+	// ArchivedDays is the number of daily points read from ARCHIVE_DIR by
+	// GET /admin/archive/pages/:page/range
+	ArchivedDays int `json:"archived_days,omitempty"`
+}
+
+// VisitRange returns the page's buckets from from to to (inclusive days),
+// stitching monthly buckets for rolled-up days with the daily buckets. Each
+// month with rolled-up data gets one monthly point ahead of its daily points;
+// days older than dailyCutoff appear only while their bucket still exists.
+func (r *RedisClient) VisitRange(ctx context.Context, page string, from, to, dailyCutoff time.Time) ([]RangePoint, error) {
+	pipe := r.client.Pipeline()
+	months := make(map[string]*redis.StringCmd)
+	days := make(map[string]*redis.StringCmd)
+	for m := time.Date(from.Year(), from.Month(), 1, 0, 0, 0, 0, time.UTC); !m.After(to); m = m.AddDate(0, 1, 0) {
+		months[m.Format(monthLayout)] = pipe.Get(ctx, monthlyKey(page, m))
+	}
+	for d := from; !d.After(to); d = d.AddDate(0, 0, 1) {
+		days[d.Format(dayLayout)] = pipe.Get(ctx, dailyKey(page, d))
+	}
+	if _, err := pipe.Exec(ctx); ignoreMissing(err) != nil {
+		return nil, err
+	}
+
+	count := func(cmd *redis.StringCmd) (int64, bool, error) {
+		n, err := cmd.Int64()
+		if isMissing(err) {
+			return 0, false, nil
+		}
+		return n, err == nil, err
+	}
+
+	var points []RangePoint
+	month := ""
+	for d := from; !d.After(to); d = d.AddDate(0, 0, 1) {
+		if m := d.Format(monthLayout); m != month {
+			month = m
+			n, ok, err := count(months[m])
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				points = append(points, RangePoint{Period: m, Resolution: resolutionMonthly, Visits: n})
+			}
+		}
+		n, ok, err := count(days[d.Format(dayLayout)])
+		if err != nil {
+			return nil, err
+		}
+		if ok || dailyCutoff.IsZero() || !d.Before(dailyCutoff) {
+			points = append(points, RangePoint{Period: d.Format(dayLayout), Resolution: resolutionDaily, Visits: n})
+		}
+	}
+	return points, nil
+}
+
+// parseDayRange reads the ?from= and ?to= dates of a range, responding 400
+// when they are invalid or more than maxRangeDays apart
+func parseDayRange(c *gin.Context) (from, to time.Time, ok bool) {
+	from, errFrom := time.Parse(dayLayout, c.Query("from"))
+	to, errTo := time.Parse(dayLayout, c.Query("to"))
+	if errFrom != nil || errTo != nil || to.Before(from) {
+		respondError(c, http.StatusBadRequest, "invalid_request", "from and to must be YYYY-MM-DD dates with from <= to")
+		return from, to, false
+	}
+	if to.Sub(from) > maxRangeDays*24*time.Hour {
+		respondError(c, http.StatusBadRequest, "invalid_request", fmt.Sprintf("Range may span at most %d days", maxRangeDays))
+		return from, to, false
+	}
+	return from, to, true
+}
+
+// handleGetRange returns a page's visits between the from and to dates
+func (s *Server) handleGetRange(c *gin.Context) {
+	if c.Query("include_archive") != "" {
+		respondError(c, http.StatusBadRequest, "invalid_request", "include_archive is served by GET /admin/archive/pages/:page/range")
+		return
+	}
+	s.serveRange(c, false)
+}
+
+// handleGetArchivedRange is handleGetRange with the page's archived days
+// read back. Each archive file overlapping the range is read in full, so
+// it is an admin route.
+func (s *Server) handleGetArchivedRange(c *gin.Context) {
+	s.serveRange(c, true)
+}
+
+// serveRange responds with a page's visits between the from and to dates,
+// merged with its archived days when includeArchive is set
+func (s *Server) serveRange(c *gin.Context, includeArchive bool) {
+	budget := s.startBudget(c, requestPhases)
+	defer budget.finish()
+
+	budget.enter(phaseValidate)
+	page := c.Param("page")
+	from, to, ok := parseDayRange(c)
+	if !ok {
+		return
+	}
+	delta, ok := historyEncoding(c)
+	if !ok {
+		return
+	}
+	hidden, err := s.pageHidden(c, page)
+	if err != nil {
+		log.Printf("Error getting page metadata: %v", err)
+		respondStoreError(c, err, "Failed to get visit range")
+		return
+	}
+	if hidden {
+		respondError(c, http.StatusNotFound, "not_found", "Page not found")
+		return
+	}
+
+	budget.enter(phaseRedis)
+	dailyCutoff, _ := s.cfg.Retention.cutoffs(s.clock.Now())
+	points, err := s.redis.VisitRange(c.Request.Context(), page, from, to, dailyCutoff)
+	if err != nil {
+		log.Printf("Error getting visit range: %v", err)
+		respondStoreError(c, err, "Failed to get visit range")
+		return
+	}
+	archived := 0
+	if includeArchive {
+		if points, archived, err = s.archiveRange(page, points, from, to); err != nil {
+			log.Printf("Error reading the archive: %v", err)
+			respondError(c, http.StatusInternalServerError, "internal_error", "Failed to get visit range")
+			return
+		}
+	}
+
+	budget.enter(phaseEnrich)
+	annotations, err := s.rangeAnnotations(c, page, from, to)
+	if err != nil {
+		log.Printf("Error getting annotations: %v", err)
+		respondStoreError(c, err, "Failed to get visit range")
+		return
+	}
+
+	response := RangeResponse{Page: page, From: from.Format(dayLayout), To: to.Format(dayLayout), Points: points, Annotations: annotations, ArchivedDays: archived}
+	for _, p := range points {
+		response.Total += p.Visits
+	}
+	if delta {
+		// Days before the cutoff are in their monthly points, so a dense
+		// series from there would read them as days without visits
+		start := from
+		if dailyCutoff.After(start) {
+			start = dailyCutoff
+		}
+		response.Points = nil
+		var days []HistoryRow
+		for _, p := range points {
+			if p.Resolution == resolutionDaily && p.Period >= start.Format(dayLayout) {
+				days = append(days, HistoryRow{Date: p.Period, Visits: p.Visits})
+			} else {
+				response.Points = append(response.Points, p)
+			}
+		}
+		if !start.After(to) {
+			series := NewDeltaSeries("", start, denseDays(days, start, to))
+			response.Daily = &series
+		}
+	}
+	if response.Points == nil {
+		response.Points = []RangePoint{}
+	}
+	respondJSON(c, http.StatusOK, response)
+}
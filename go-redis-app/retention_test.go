@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	"go-redis-app/internal/clocktest"
+)
+
+func parseDay(s string) time.Time {
+	t, err := time.Parse(dayLayout, s)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+func TestParseBucketKey(t *testing.T) {
+	tests := []struct {
+		key, page, resolution, period string
+		ok                            bool
+	}{
+		{"visits:home:daily:2024-03-01", "home", resolutionDaily, "2024-03-01", true},
+		{"visits:home:monthly:2024-03", "home", resolutionMonthly, "2024-03", true},
+		{"visits:a:daily:b:daily:2024-03-01", "a:daily:b", resolutionDaily, "2024-03-01", true},
+		{"visits:home:daily:2024-3-1", "", "", "", false},
+		{"visits:home:variant:a", "", "", "", false},
+		{"visits:home", "", "", "", false},
+	}
+	for _, tt := range tests {
+		page, resolution, period, ok := parseBucketKey(tt.key)
+		if ok != tt.ok || page != tt.page || resolution != tt.resolution {
+			t.Errorf("parseBucketKey(%q) = %q, %q, %t", tt.key, page, resolution, ok)
+			continue
+		}
+		if ok {
+			layout := dayLayout
+			if resolution == resolutionMonthly {
+				layout = monthLayout
+			}
+			if got := period.Format(layout); got != tt.period {
+				t.Errorf("parseBucketKey(%q) period = %s, want %s", tt.key, got, tt.period)
+			}
+		}
+	}
+}
+
+func TestParsePeriod(t *testing.T) {
+	if n, err := parsePeriod("90d", "d"); err != nil || n != 90 {
+		t.Errorf("Expected 90, got %d, %v", n, err)
+	}
+	if n, err := parsePeriod("", "m"); err != nil || n != 0 {
+		t.Errorf("Expected 0 for empty value, got %d, %v", n, err)
+	}
+	for _, value := range []string{"90", "24d", "-1m", "m"} {
+		if _, err := parsePeriod(value, "m"); err == nil {
+			t.Errorf("Expected error for %q", value)
+		}
+	}
+}
+
+func TestApplyRetentionAcrossBoundaries(t *testing.T) {
+	ctx := context.Background()
+	_, redisClient := newTestRedis(t)
+	policy := RetentionPolicy{DailyDays: 2, MonthlyMonths: 1}
+	for date, count := range map[string]int{
+		"2024-01-15": 1, "2024-02-10": 2, "2024-02-28": 3, "2024-03-01": 4, "2024-03-03": 5,
+	} {
+		redisClient.client.Set(ctx, dailyKey("home", parseDay(date)), count, 0)
+	}
+
+	// The lifetime total must stay the same however the buckets are arranged
+	assertTotal := func(step string) {
+		t.Helper()
+		total, err := redisClient.RecomputeTotal(ctx, "home", nil, time.Now())
+		if err != nil || total != 15 {
+			t.Errorf("%s: expected total 15, got %d, %v", step, total, err)
+		}
+	}
+	get := func(key string) int64 {
+		n, _ := redisClient.client.Get(ctx, key).Int64()
+		return n
+	}
+
+	now := time.Date(2024, 3, 3, 12, 0, 0, 0, time.UTC)
+	report, err := redisClient.ApplyRetention(ctx, now, policy, true)
+	if err != nil || report.RolledUp != 2 || report.ExpiredDaily != 1 || report.DailyCutoff != "2024-03-01" || report.MonthlyCutoff != "2024-02" {
+		t.Fatalf("Unexpected dry run report %+v, %v", report, err)
+	}
+	if get(dailyKey("home", parseDay("2024-02-10"))) != 2 || get(monthlyKey("home", parseDay("2024-02-01"))) != 0 {
+		t.Fatal("Expected dry run to leave buckets unchanged")
+	}
+	assertTotal("dry run")
+
+	if _, err := redisClient.ApplyRetention(ctx, now, policy, false); err != nil {
+		t.Fatalf("ApplyRetention failed: %v", err)
+	}
+	if got := get(monthlyKey("home", parseDay("2024-02-01"))); got != 5 {
+		t.Errorf("Expected February rolled up to 5, got %d", got)
+	}
+	if get(dailyKey("home", parseDay("2024-02-28"))) != 0 || get(dailyKey("home", parseDay("2024-03-01"))) != 4 {
+		t.Error("Expected only buckets before the daily cutoff to be rolled up")
+	}
+	if got := get(preHistoryKey("home")); got != 1 {
+		t.Errorf("Expected the expired January bucket in pre-history, got %d", got)
+	}
+	assertTotal("first run")
+
+	// Re-running at the same time changes nothing
+	if report, _ = redisClient.ApplyRetention(ctx, now, policy, false); report.RolledUp != 0 || report.ExpiredMonthly != 0 {
+		t.Errorf("Expected second run to be a no-op, got %+v", report)
+	}
+	assertTotal("second run")
+
+	// A month later March is rolled up and February expires
+	now = time.Date(2024, 4, 2, 0, 0, 0, 0, time.UTC)
+	if report, _ = redisClient.ApplyRetention(ctx, now, policy, false); report.RolledUp != 2 || report.ExpiredMonthly != 1 {
+		t.Errorf("Unexpected report after month boundary: %+v", report)
+	}
+	if get(monthlyKey("home", parseDay("2024-03-01"))) != 9 || get(preHistoryKey("home")) != 6 {
+		t.Error("Expected March rolled up to 9 and February folded into pre-history")
+	}
+	assertTotal("after month boundary")
+}
+
+func TestVisitRangeStitchesResolutions(t *testing.T) {
+	ctx := context.Background()
+	_, redisClient := newTestRedis(t)
+	redisClient.client.Set(ctx, monthlyKey("home", parseDay("2024-02-01")), 5, 0)
+	redisClient.client.Set(ctx, dailyKey("home", parseDay("2024-02-29")), 7, 0)
+	redisClient.client.Set(ctx, dailyKey("home", parseDay("2024-03-01")), 4, 0)
+	redisClient.client.Set(ctx, dailyKey("home", parseDay("2024-03-03")), 5, 0)
+
+	points, err := redisClient.VisitRange(ctx, "home", parseDay("2024-02-27"), parseDay("2024-03-03"), parseDay("2024-03-01"))
+	if err != nil {
+		t.Fatalf("VisitRange failed: %v", err)
+	}
+	want := []RangePoint{
+		{"2024-02", resolutionMonthly, 5},
+		{"2024-02-29", resolutionDaily, 7}, // not yet rolled up
+		{"2024-03-01", resolutionDaily, 4},
+		{"2024-03-02", resolutionDaily, 0},
+		{"2024-03-03", resolutionDaily, 5},
+	}
+	if len(points) != len(want) {
+		t.Fatalf("Expected %v, got %v", want, points)
+	}
+	for i := range want {
+		if points[i] != want[i] {
+			t.Errorf("Point %d: expected %+v, got %+v", i, want[i], points[i])
+		}
+	}
+}
+
+func TestRangeEndpoint(t *testing.T) {
+	_, redisClient := newTestRedis(t)
+	redisClient.client.Set(context.Background(), dailyKey("home", parseDay("2024-03-02")), 3, 0)
+	router := newTestServer(t, testConfig(), redisClient).Router()
+
+	w := doRequest(router, "GET", "/visits/home/range?from=2024-03-01&to=2024-03-03", "", nil)
+	var resp RangeResponse
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if w.Code != http.StatusOK || len(resp.Points) != 3 || resp.Total != 3 || resp.Points[1].Visits != 3 {
+		t.Errorf("Unexpected range response %d: %s", w.Code, w.Body.String())
+	}
+
+	w = doRequest(router, "GET", "/visits/home/range?from=2024-03-01&to=2024-03-03&encoding=delta", "", nil)
+	resp = RangeResponse{}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	want := DeltaSeries{Start: "2024-03-01", StartValue: 0, Deltas: []int64{3, -3}}
+	if w.Code != http.StatusOK || resp.Daily == nil || !reflect.DeepEqual(*resp.Daily, want) || len(resp.Points) != 0 || resp.Total != 3 {
+		t.Errorf("Expected the daily points delta-encoded, got %d: %s", w.Code, w.Body.String())
+	}
+
+	for _, query := range []string{"from=2024-03-03&to=2024-03-01", "from=2024-03-01", "from=2010-01-01&to=2024-01-01", "from=2024-03-01&to=2024-03-03&encoding=zip"} {
+		if w := doRequest(router, "GET", "/visits/home/range?"+query, "", nil); w.Code != http.StatusBadRequest {
+			t.Errorf("Expected 400 for %q, got %d", query, w.Code)
+		}
+	}
+
+	if w := doRequest(router, "POST", "/admin/retention", "", nil); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 without a retention policy, got %d", w.Code)
+	}
+}
+
+func TestRangeDeltaStartsAtDailyCutoff(t *testing.T) {
+	ctx := context.Background()
+	_, redisClient := newTestRedis(t)
+	redisClient.client.Set(ctx, monthlyKey("home", parseDay("2024-02-01")), 40, 0)
+	redisClient.client.Set(ctx, dailyKey("home", parseDay("2024-02-27")), 2, 0) // not yet rolled up
+	redisClient.client.Set(ctx, dailyKey("home", parseDay("2024-03-02")), 3, 0)
+	cfg := testConfig()
+	cfg.Retention = RetentionPolicy{DailyDays: 5}
+	clock := clocktest.New(time.Date(2024, 3, 6, 12, 0, 0, 0, time.UTC))
+	router := newTestServerWithClock(t, cfg, redisClient, clock).Router()
+
+	w := doRequest(router, "GET", "/visits/home/range?from=2024-02-20&to=2024-03-03&encoding=delta", "", nil)
+	var resp RangeResponse
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	want := DeltaSeries{Start: "2024-03-01", StartValue: 0, Deltas: []int64{3, -3}}
+	if w.Code != http.StatusOK || resp.Daily == nil || !reflect.DeepEqual(*resp.Daily, want) || resp.Total != 45 {
+		t.Fatalf("Expected the daily series from the cutoff, got %d: %s", w.Code, w.Body.String())
+	}
+	wantPoints := []RangePoint{{"2024-02", resolutionMonthly, 40}, {"2024-02-27", resolutionDaily, 2}}
+	if !reflect.DeepEqual(resp.Points, wantPoints) {
+		t.Errorf("Expected the points before the cutoff kept, got %+v", resp.Points)
+	}
+
+	// A range entirely before the cutoff has no daily series
+	w = doRequest(router, "GET", "/visits/home/range?from=2024-02-20&to=2024-02-28&encoding=delta", "", nil)
+	resp = RangeResponse{}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if w.Code != http.StatusOK || resp.Daily != nil || len(resp.Points) != 2 {
+		t.Errorf("Expected only the points before the cutoff, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestRunRetentionEndpoint(t *testing.T) {
+	_, redisClient := newTestRedis(t)
+	old := time.Now().UTC().AddDate(0, 0, -10)
+	redisClient.client.Set(context.Background(), dailyKey("home", old), 3, 0)
+	cfg := testConfig()
+	cfg.Retention = RetentionPolicy{DailyDays: 5}
+	router := newTestServer(t, cfg, redisClient).Router()
+
+	w := doRequest(router, "POST", "/admin/retention?dry_run=true", "", nil)
+	var report RetentionReport
+	json.Unmarshal(w.Body.Bytes(), &report)
+	if w.Code != http.StatusOK || !report.DryRun || report.RolledUp != 1 {
+		t.Errorf("Unexpected dry run response %d: %s", w.Code, w.Body.String())
+	}
+	if n, _ := redisClient.client.Get(context.Background(), dailyKey("home", old)).Int64(); n != 3 {
+		t.Error("Expected dry run to keep the daily bucket")
+	}
+
+	// Another replica holding the maintenance lock blocks the run
+	redisClient.client.Set(context.Background(), maintenanceLockKey, "other", time.Minute)
+	if w := doRequest(router, "POST", "/admin/retention", "", nil); w.Code != http.StatusConflict {
+		t.Errorf("Expected 409 while the lock is held, got %d", w.Code)
+	}
+}
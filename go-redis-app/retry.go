@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Retry classes of a failed Redis call
+const (
+	// retryNotSent: the command never reached Redis, e.g. the connection
+	// was refused, so any command may run again
+	retryNotSent = "not_sent"
+	// retryRejected: Redis refused the command without running it, e.g.
+	// LOADING after a restart
+	retryRejected = "rejected"
+	// retryUnknown: the connection broke after the command was written, so
+	// it may have run; only idempotent commands are retried
+	retryUnknown = "unknown"
+	// retryNever: errors a retry would not fix, or that must surface now
+	retryNever = ""
+)
+
+var retryClasses = []string{retryNotSent, retryRejected, retryUnknown}
+
+// rejectedPrefixes are the server errors of commands Redis refused without
+// running them, and may accept shortly
+var rejectedPrefixes = []string{"LOADING ", "TRYAGAIN ", "CLUSTERDOWN ", "MASTERDOWN ", "ERR max number of clients reached"}
+
+// nonIdempotentReads are allowed in READ_ONLY mode but not safe to repeat:
+// transactions and connection state
+var nonIdempotentReads = map[string]bool{
+	"multi": true, "exec": true, "discard": true, "watch": true, "unwatch": true,
+	"hello": true, "auth": true, "select": true, "client": true, "subscribe": true, "unsubscribe": true,
+}
+
+// idempotentCommand reports whether running the command twice has the
+// effect of running it once: the reads, not INCR, XADD or scripts
+func idempotentCommand(name string) bool {
+	return readOnlyAllowed(name) && !nonIdempotentReads[name]
+}
+
+// classifyRetry returns the retry class of a go-redis error. Timeouts are
+// never retried: repeating a command against a slow server adds load and
+// multiplies the caller's wait.
+func classifyRetry(err error) string {
+	var opErr *net.OpError
+	var redisErr redis.Error
+	switch {
+	case err == nil,
+		errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded),
+		errors.Is(err, redis.ErrClosed), errors.Is(err, redis.Nil), errors.Is(err, redis.TxFailedErr):
+		return retryNever
+	case err.Error() == "redis: connection pool timeout":
+		return retryNotSent
+	case errors.As(err, &opErr):
+		if opErr.Timeout() {
+			return retryNever
+		}
+		if opErr.Op == "dial" {
+			return retryNotSent
+		}
+		// Reset or broken while reading or writing
+		return retryUnknown
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return retryUnknown
+	case errors.As(err, &redisErr):
+		for _, prefix := range rejectedPrefixes {
+			if strings.HasPrefix(err.Error(), prefix) {
+				return retryRejected
+			}
+		}
+	}
+	return retryNever
+}
+
+// RetryPolicy retries failed Redis calls up to maxRetries times with full
+// jitter backoff, as far as their class and idempotence allow. The client's
+// own retries are turned off so this is the only policy.
+type RetryPolicy struct {
+	maxRetries int
+	base       time.Duration
+	ceiling    time.Duration
+
+	retries   map[string]*atomic.Int64 // by class
+	skipped   atomic.Int64             // unknown outcome, not idempotent
+	exhausted atomic.Int64
+}
+
+// NewRetryPolicy creates a policy retrying up to maxRetries times, waiting
+// up to base doubled each attempt, capped at ceiling
+func NewRetryPolicy(maxRetries int, base, ceiling time.Duration) *RetryPolicy {
+	p := &RetryPolicy{maxRetries: maxRetries, base: base, ceiling: ceiling, retries: make(map[string]*atomic.Int64)}
+	for _, class := range retryClasses {
+		p.retries[class] = new(atomic.Int64)
+	}
+	return p
+}
+
+// backoff returns the wait before retry attempt (1-based): random up to
+// base*2^(attempt-1), capped at the ceiling
+func (p *RetryPolicy) backoff(attempt int) time.Duration {
+	limit := p.ceiling
+	if shift := attempt - 1; shift < 30 && p.base<<shift < limit {
+		limit = p.base << shift
+	}
+	if limit <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(limit) + 1))
+}
+
+// run calls fn until it succeeds, fails for good or runs out of retries,
+// classify telling which failures to retry. reset clears the commands'
+// results before each retry.
+func (p *RetryPolicy) run(ctx context.Context, idempotent bool, classify func(error) string, reset func(), fn func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		class := classify(err)
+		if class == retryNever {
+			return err
+		}
+		if class == retryUnknown && !idempotent {
+			p.skipped.Add(1)
+			return err
+		}
+		if attempt > p.maxRetries {
+			p.exhausted.Add(1)
+			return err
+		}
+		timer := time.NewTimer(p.backoff(attempt))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+		p.retries[class].Add(1)
+		reset()
+	}
+}
+
+// write writes the redis_retries series
+func (p *RetryPolicy) write(b *strings.Builder, env string) {
+	envLabel := ""
+	if env != "" {
+		envLabel = "env=" + strconv.Quote(env)
+	}
+	labels := func(pairs string) string {
+		switch {
+		case envLabel == "" && pairs == "":
+			return ""
+		case envLabel == "":
+			return "{" + pairs + "}"
+		case pairs == "":
+			return "{" + envLabel + "}"
+		}
+		return "{" + envLabel + "," + pairs + "}"
+	}
+	b.WriteString("# HELP redis_retries_total Redis calls retried, by why the failed attempt is safe to repeat.\n")
+	b.WriteString("# TYPE redis_retries_total counter\n")
+	for _, class := range retryClasses {
+		fmt.Fprintf(b, "redis_retries_total%s %d\n", labels("class="+strconv.Quote(class)), p.retries[class].Load())
+	}
+	b.WriteString("# HELP redis_retries_skipped_total Failed Redis calls not retried because they may have run and are not idempotent.\n")
+	b.WriteString("# TYPE redis_retries_skipped_total counter\n")
+	fmt.Fprintf(b, "redis_retries_skipped_total%s %d\n", labels(""), p.skipped.Load())
+	b.WriteString("# HELP redis_retries_exhausted_total Redis calls that failed after every retry.\n")
+	b.WriteString("# TYPE redis_retries_exhausted_total counter\n")
+	fmt.Fprintf(b, "redis_retries_exhausted_total%s %d\n", labels(""), p.exhausted.Load())
+}
+
+// retryHook applies the retry policy to every command and pipeline. It
+// sits inside the error hook, so it sees go-redis's own errors, and outside
+// the timeout hook, so each attempt gets a fresh deadline.
+type retryHook struct {
+	policy *RetryPolicy
+}
+
+func (h retryHook) DialHook(next redis.DialHook) redis.DialHook { return next }
+
+func (h retryHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		return h.policy.run(ctx, idempotentCommand(cmd.Name()), classifyRetry,
+			func() { cmd.SetErr(nil) },
+			func() error { return next(ctx, cmd) })
+	}
+}
+
+// ProcessPipelineHook retries a pipeline as a whole. A rejection may have
+// come partway through, after earlier commands ran, so it counts as an
+// unknown outcome: only pipelines of idempotent commands are retried then.
+func (h retryHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		idempotent := true
+		for _, cmd := range cmds {
+			idempotent = idempotent && idempotentCommand(cmd.Name())
+		}
+		return h.policy.run(ctx, idempotent, classifyPipelineRetry,
+			func() {
+				for _, cmd := range cmds {
+					cmd.SetErr(nil)
+				}
+			},
+			func() error { return next(ctx, cmds) })
+	}
+}
+
+// classifyPipelineRetry is classifyRetry for a pipeline's error
+func classifyPipelineRetry(err error) string {
+	if class := classifyRetry(err); class != retryRejected {
+		return class
+	}
+	return retryUnknown
+}
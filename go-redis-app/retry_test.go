@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+// serverError is an error as Redis replies it
+type serverError string
+
+func (e serverError) Error() string { return string(e) }
+func (serverError) RedisError()     {}
+
+// failingHook fails the next calls with its queued errors, as a broken
+// connection or restarting server would, before letting calls through
+type failingHook struct {
+	mu    sync.Mutex
+	errs  []error
+	calls int
+}
+
+func (h *failingHook) fail(errs ...error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.errs, h.calls = errs, 0
+}
+
+func (h *failingHook) next() (int, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.calls++
+	if len(h.errs) == 0 {
+		return h.calls, nil
+	}
+	err := h.errs[0]
+	h.errs = h.errs[1:]
+	return h.calls, err
+}
+
+func (h *failingHook) attempts() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.calls
+}
+
+func (h *failingHook) DialHook(next redis.DialHook) redis.DialHook { return next }
+
+func (h *failingHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		if _, err := h.next(); err != nil {
+			cmd.SetErr(err)
+			return err
+		}
+		return next(ctx, cmd)
+	}
+}
+
+func (h *failingHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		if _, err := h.next(); err != nil {
+			for _, cmd := range cmds {
+				cmd.SetErr(err)
+			}
+			return err
+		}
+		return next(ctx, cmds)
+	}
+}
+
+// newRetryTestClient returns a client retrying with policy, with calls
+// failing as the returned hook is told to
+func newRetryTestClient(t *testing.T, addr string, policy *RetryPolicy) (*RedisClient, *failingHook) {
+	t.Helper()
+	rdb := redis.NewClient(&redis.Options{Addr: addr, MaxRetries: -1})
+	t.Cleanup(func() { rdb.Close() })
+	r := newRedisClient(rdb)
+	r.retries = policy
+	rdb.AddHook(retryHook{policy: r.retries})
+	failing := &failingHook{}
+	rdb.AddHook(failing)
+	return r, failing
+}
+
+var (
+	errRefused = &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}
+	errReset   = &net.OpError{Op: "read", Net: "tcp", Err: os.NewSyscallError("read", syscall.ECONNRESET)}
+	errLoading = serverError("LOADING Redis is loading the dataset in memory")
+)
+
+func TestClassifyRetry(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{"connection refused", errRefused, retryNotSent},
+		{"wrapped refusal", fmt.Errorf("dialing: %w", errRefused), retryNotSent},
+		{"pool timeout", errors.New("redis: connection pool timeout"), retryNotSent},
+		{"loading", errLoading, retryRejected},
+		{"tryagain", serverError("TRYAGAIN Multiple keys request during rehashing of slot"), retryRejected},
+		{"too many clients", serverError("ERR max number of clients reached"), retryRejected},
+		{"connection reset", errReset, retryUnknown},
+		{"broken pipe", &net.OpError{Op: "write", Net: "tcp", Err: os.NewSyscallError("write", syscall.EPIPE)}, retryUnknown},
+		{"eof", io.EOF, retryUnknown},
+		{"unexpected eof", io.ErrUnexpectedEOF, retryUnknown},
+		{"read timeout", &net.OpError{Op: "read", Net: "tcp", Err: os.ErrDeadlineExceeded}, retryNever},
+		{"deadline", context.DeadlineExceeded, retryNever},
+		{"canceled", context.Canceled, retryNever},
+		{"closed client", redis.ErrClosed, retryNever},
+		{"missing key", redis.Nil, retryNever},
+		{"transaction failed", redis.TxFailedErr, retryNever},
+		{"wrong type", serverError("WRONGTYPE Operation against a key holding the wrong kind of value"), retryNever},
+		{"loading text from elsewhere", errors.New("LOADING config"), retryNever},
+		{"chaos", errChaos, retryNever},
+		{"read-only mode", readOnlyError("incr"), retryNever},
+		{"nil", nil, retryNever},
+	}
+	for _, tt := range tests {
+		if got := classifyRetry(tt.err); got != tt.want {
+			t.Errorf("%s: classifyRetry(%v) = %q, want %q", tt.name, tt.err, got, tt.want)
+		}
+	}
+
+	for name, want := range map[string]bool{"get": true, "mget": true, "zrange": true, "ping": true, "incr": false, "xadd": false, "evalsha": false, "exec": false} {
+		if got := idempotentCommand(name); got != want {
+			t.Errorf("idempotentCommand(%q) = %t, want %t", name, got, want)
+		}
+	}
+}
+
+func TestRetryPolicyCommands(t *testing.T) {
+	mr := miniredis.RunT(t)
+	r, failing := newRetryTestClient(t, mr.Addr(), NewRetryPolicy(2, time.Millisecond, 2*time.Millisecond))
+	ctx := context.Background()
+	counter := key("visits", "home")
+
+	// Idempotent commands retry whatever the failure
+	failing.fail(errReset)
+	mr.Set(counter, "5")
+	if count, err := r.GetVisitCount(ctx, "home"); err != nil || count != 5 || failing.attempts() != 2 {
+		t.Errorf("Expected GET retried after a reset, got %d, %v after %d attempts", count, err, failing.attempts())
+	}
+
+	// INCR may have run before the reset, so it is not repeated
+	failing.fail(errReset)
+	if _, err := r.IncrementVisitCount(ctx, "home"); !errors.Is(err, ErrUnavailable) || failing.attempts() != 1 {
+		t.Errorf("Expected INCR failed without retry, got %v after %d attempts", err, failing.attempts())
+	}
+
+	// unless it verifiably did not run
+	for _, err := range []error{errRefused, errLoading} {
+		failing.fail(err)
+		if count, err := r.IncrementVisitCount(ctx, "home"); err != nil || failing.attempts() != 2 {
+			t.Errorf("Expected INCR retried, got %d, %v after %d attempts", count, err, failing.attempts())
+		}
+	}
+	if got, _ := mr.Get(counter); got != "7" {
+		t.Errorf("Expected each retried INCR applied once, got %s", got)
+	}
+
+	// At most two retries, then the error surfaces with its kind
+	failing.fail(errLoading, errLoading, errLoading)
+	if _, err := r.GetVisitCount(ctx, "home"); !errors.Is(err, ErrUnavailable) || failing.attempts() != 3 {
+		t.Errorf("Expected the retries exhausted, got %v after %d attempts", err, failing.attempts())
+	}
+
+	// Errors a retry would not fix fail at once
+	failing.fail(serverError("WRONGTYPE Operation against a key holding the wrong kind of value"))
+	if _, err := r.GetVisitCount(ctx, "home"); err == nil || failing.attempts() != 1 {
+		t.Errorf("Expected WRONGTYPE not retried, got %v after %d attempts", err, failing.attempts())
+	}
+
+	var b strings.Builder
+	r.retries.write(&b, "")
+	for _, want := range []string{
+		`redis_retries_total{class="not_sent"} 1`,
+		`redis_retries_total{class="rejected"} 3`,
+		`redis_retries_total{class="unknown"} 1`,
+		"redis_retries_skipped_total 1",
+		"redis_retries_exhausted_total 1",
+	} {
+		if !strings.Contains(b.String(), want+"\n") {
+			t.Errorf("Expected %s in\n%s", want, b.String())
+		}
+	}
+}
+
+func TestRetryPolicyPipelines(t *testing.T) {
+	mr := miniredis.RunT(t)
+	r, failing := newRetryTestClient(t, mr.Addr(), NewRetryPolicy(2, time.Millisecond, 2*time.Millisecond))
+	ctx := context.Background()
+	mr.Set("a", "1")
+
+	// Reads run again as a whole
+	failing.fail(errReset)
+	pipe := r.client.Pipeline()
+	a, b := pipe.Get(ctx, "a"), pipe.Get(ctx, "b")
+	if _, err := pipe.Exec(ctx); !isMissing(err) || a.Val() != "1" || !isMissing(b.Err()) || failing.attempts() != 2 {
+		t.Errorf("Expected the read pipeline retried, got %v after %d attempts", err, failing.attempts())
+	}
+
+	// A rejection may have come after some writes ran
+	failing.fail(errLoading)
+	pipe = r.client.Pipeline()
+	pipe.Incr(ctx, "a")
+	pipe.Get(ctx, "a")
+	if _, err := pipe.Exec(ctx); err == nil || failing.attempts() != 1 {
+		t.Errorf("Expected the write pipeline not retried after a rejection, got %v after %d attempts", err, failing.attempts())
+	}
+
+	// but not when it never reached Redis
+	failing.fail(errRefused)
+	if _, err := r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Incr(ctx, "a")
+		return nil
+	}); err != nil || failing.attempts() != 2 {
+		t.Errorf("Expected the transaction retried after a refusal, got %v after %d attempts", err, failing.attempts())
+	}
+	if got, _ := mr.Get("a"); got != "2" {
+		t.Errorf("Expected the transaction applied once, got %s", got)
+	}
+}
+
+func TestRetryPolicyRefusedConnection(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	r, failing := newRetryTestClient(t, addr, NewRetryPolicy(2, time.Millisecond, 2*time.Millisecond))
+	if _, err := r.IncrementVisitCount(context.Background(), "home"); !errors.Is(err, ErrUnavailable) {
+		t.Errorf("Expected the refusal reported as unavailable, got %v", err)
+	}
+	var b strings.Builder
+	r.retries.write(&b, "staging")
+	if failing.attempts() != 3 || !strings.Contains(b.String(), `redis_retries_total{env="staging",class="not_sent"} 2`) {
+		t.Errorf("Expected INCR retried twice on a refused dial, got %d attempts:\n%s", failing.attempts(), b.String())
+	}
+}
+
+func TestRetryPolicyStopsWithContext(t *testing.T) {
+	mr := miniredis.RunT(t)
+	r, failing := newRetryTestClient(t, mr.Addr(), NewRetryPolicy(5, time.Hour, time.Hour))
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	failing.fail(errLoading, errLoading)
+	start := time.Now()
+	if _, err := r.GetVisitCount(ctx, "home"); err == nil || time.Since(start) > time.Second {
+		t.Errorf("Expected the wait cut short by the deadline, got %v after %s", err, time.Since(start))
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	p := NewRetryPolicy(10, 10*time.Millisecond, 50*time.Millisecond)
+	for attempt, limit := range map[int]time.Duration{1: 10 * time.Millisecond, 2: 20 * time.Millisecond, 3: 40 * time.Millisecond, 4: 50 * time.Millisecond, 40: 50 * time.Millisecond} {
+		for i := 0; i < 100; i++ {
+			if d := p.backoff(attempt); d < 0 || d > limit {
+				t.Fatalf("Expected attempt %d to wait at most %s, got %s", attempt, limit, d)
+			}
+		}
+	}
+}
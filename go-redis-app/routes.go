@@ -0,0 +1,266 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// getHead registers GET routes together with HEAD
+var getHead = []string{http.MethodGet, http.MethodHead}
+
+// methodOrder is the order methods are listed in Allow headers
+var methodOrder = map[string]int{
+	http.MethodGet:     0,
+	http.MethodHead:    1,
+	http.MethodPost:    2,
+	http.MethodPut:     3,
+	http.MethodDelete:  4,
+	http.MethodOptions: 5,
+}
+
+// headWriter discards the body of a HEAD response while counting it, so
+// the headers (including Content-Length) match the GET response
+type headWriter struct {
+	gin.ResponseWriter
+	length int
+}
+
+func (w *headWriter) Write(b []byte) (int, error) {
+	w.length += len(b)
+	return len(b), nil
+}
+
+func (w *headWriter) WriteString(s string) (int, error) {
+	w.length += len(s)
+	return len(s), nil
+}
+
+// Flush is a no-op so streaming handlers don't send headers early
+func (w *headWriter) Flush() {}
+
+// headResponse runs HEAD requests through the GET handler, sending only the
+// headers
+func headResponse(c *gin.Context) {
+	if c.Request.Method != http.MethodHead {
+		c.Next()
+		return
+	}
+	w := &headWriter{ResponseWriter: c.Writer}
+	c.Writer = w
+	c.Next()
+	c.Writer = w.ResponseWriter
+	if c.Writer.Status() != http.StatusNotModified {
+		c.Header("Content-Length", strconv.Itoa(w.length))
+	}
+	c.Writer.WriteHeaderNow()
+}
+
+// registerOptions answers OPTIONS on every registered path with an Allow
+// header listing that path's methods
+func registerOptions(r *gin.Engine) {
+	allowed := make(map[string][]string)
+	var paths []string
+	for _, route := range r.Routes() {
+		if allowed[route.Path] == nil {
+			paths = append(paths, route.Path)
+		}
+		allowed[route.Path] = append(allowed[route.Path], route.Method)
+	}
+
+	for _, path := range paths {
+		methods := append(allowed[path], http.MethodOptions)
+		sort.Slice(methods, func(i, j int) bool { return methodOrder[methods[i]] < methodOrder[methods[j]] })
+		allow := strings.Join(methods, ", ")
+		r.OPTIONS(path, func(c *gin.Context) {
+			c.Header("Allow", allow)
+			c.Header("Access-Control-Allow-Methods", allow)
+			c.Status(http.StatusNoContent)
+		})
+	}
+}
+
+// registeredRoute is one method and path registered through a RouteGroup
+type registeredRoute struct {
+	Method  string
+	Path    string
+	Handler string
+
+	// Reserved is set on static routes registered with Reserve, which may
+	// take precedence over a parameterized route matching the same paths
+	Reserved bool
+
+	// Shadows are the parameterized routes a reserved route is matched
+	// ahead of
+	Shadows []string
+}
+
+// routeTable is the routes registered on one engine
+type routeTable struct {
+	routes []*registeredRoute
+}
+
+// RouteGroup registers routes on a Gin group, checking each against the
+// routes already on its engine. Gin matches a static segment ahead of a
+// parameter, so /visits/aggregate would silently take the page named
+// aggregate from /visits/:page; such a route must be registered with
+// Reserve. Duplicates, parameters named differently at the same position
+// and catch-alls sharing their prefix fail registration outright.
+// Registration panics on a conflict, like Gin's own, so a bad route table
+// fails at startup with a message naming both routes.
+type RouteGroup struct {
+	table *routeTable
+	group *gin.RouterGroup
+}
+
+// newRouteGroup returns the root group of engine
+func newRouteGroup(engine *gin.Engine) *RouteGroup {
+	return &RouteGroup{table: &routeTable{}, group: &engine.RouterGroup}
+}
+
+// Group returns a subgroup under path running handlers before its routes'
+func (g *RouteGroup) Group(path string, handlers ...gin.HandlerFunc) *RouteGroup {
+	return &RouteGroup{table: g.table, group: g.group.Group(path, handlers...)}
+}
+
+// Match registers handlers for path under each of methods
+func (g *RouteGroup) Match(methods []string, path string, handlers ...gin.HandlerFunc) {
+	g.add(methods, path, false, handlers)
+}
+
+// Reserve is Match for a static route meant to be matched ahead of a
+// parameterized route that also matches its path
+func (g *RouteGroup) Reserve(methods []string, path string, handlers ...gin.HandlerFunc) {
+	g.add(methods, path, true, handlers)
+}
+
+// GET registers a GET route
+func (g *RouteGroup) GET(path string, handlers ...gin.HandlerFunc) {
+	g.Match([]string{http.MethodGet}, path, handlers...)
+}
+
+// POST registers a POST route
+func (g *RouteGroup) POST(path string, handlers ...gin.HandlerFunc) {
+	g.Match([]string{http.MethodPost}, path, handlers...)
+}
+
+// PUT registers a PUT route
+func (g *RouteGroup) PUT(path string, handlers ...gin.HandlerFunc) {
+	g.Match([]string{http.MethodPut}, path, handlers...)
+}
+
+// DELETE registers a DELETE route
+func (g *RouteGroup) DELETE(path string, handlers ...gin.HandlerFunc) {
+	g.Match([]string{http.MethodDelete}, path, handlers...)
+}
+
+func (g *RouteGroup) add(methods []string, path string, reserved bool, handlers []gin.HandlerFunc) {
+	full := g.group.BasePath()
+	if full == "/" {
+		full = path
+	} else {
+		full += path
+	}
+	handler := handlerName(handlers[len(handlers)-1])
+	for _, method := range methods {
+		route := &registeredRoute{Method: method, Path: full, Handler: handler, Reserved: reserved}
+		if err := g.table.add(route); err != nil {
+			panic(err)
+		}
+	}
+	g.group.Match(methods, path, handlers...)
+}
+
+// handlerName names a handler for the route table, as (*Server).handleVisit
+// for this package's
+func handlerName(h gin.HandlerFunc) string {
+	name := runtime.FuncForPC(reflect.ValueOf(h).Pointer()).Name()
+	return strings.TrimSuffix(strings.TrimPrefix(name, packagePrefix), "-fm")
+}
+
+// packagePrefix is the import path qualifying this package's function names
+var packagePrefix = reflect.TypeOf(Server{}).PkgPath() + "."
+
+// isParam reports whether a path segment is a parameter or a catch-all
+func isParam(segment string) bool {
+	return strings.HasPrefix(segment, ":") || strings.HasPrefix(segment, "*")
+}
+
+// add adds route to the table unless it conflicts with a route in it,
+// recording what it shadows
+func (t *routeTable) add(route *registeredRoute) error {
+	segments := strings.Split(route.Path, "/")
+	for _, other := range t.routes {
+		if other.Method == route.Method && other.Path == route.Path {
+			return fmt.Errorf("route %s %s is registered twice, by %s and %s", route.Method, route.Path, other.Handler, route.Handler)
+		}
+		if err := t.check(route, segments, other, strings.Split(other.Path, "/")); err != nil {
+			return err
+		}
+	}
+	t.routes = append(t.routes, route)
+	return nil
+}
+
+// check compares two routes segment by segment up to where they diverge
+func (t *routeTable) check(route *registeredRoute, segments []string, other *registeredRoute, others []string) error {
+	for i := 0; i < len(segments) && i < len(others); i++ {
+		a, b := segments[i], others[i]
+		switch {
+		case a == b:
+			continue
+		case strings.HasPrefix(a, "*") || strings.HasPrefix(b, "*"):
+			return fmt.Errorf("route %s %s conflicts with %s %s: a catch-all must be the only route after its prefix", route.Method, route.Path, other.Method, other.Path)
+		case isParam(a) && isParam(b):
+			return fmt.Errorf("route %s %s names the parameter of %s %s %s instead of %s", route.Method, route.Path, other.Method, other.Path, a, b)
+		case !isParam(a) && !isParam(b):
+			return nil
+		}
+
+		// One is static here where the other is a parameter, and Gin tries
+		// the static one first
+		if route.Method != other.Method || !overlaps(segments[i+1:], others[i+1:]) {
+			return nil
+		}
+		winner, loser, param, value := route, other, b, a
+		if isParam(a) {
+			winner, loser, param, value = other, route, a, b
+		}
+		if !winner.Reserved {
+			return fmt.Errorf("route %s %s shadows %s %s for %s=%q; register it with Reserve if it is meant to", winner.Method, winner.Path, loser.Method, loser.Path, param[1:], value)
+		}
+		winner.Shadows = append(winner.Shadows, loser.Path)
+		return nil
+	}
+	return nil
+}
+
+// overlaps reports whether some path matches both segment lists
+func overlaps(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] && !isParam(a[i]) && !isParam(b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// verify reports reserved routes that no longer shadow anything, so a stale
+// Reserve doesn't hide a future conflict
+func (t *routeTable) verify() error {
+	for _, route := range t.routes {
+		if route.Reserved && len(route.Shadows) == 0 {
+			return fmt.Errorf("route %s %s is reserved but matches no parameterized route", route.Method, route.Path)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestHeadVisitDoesNotCount(t *testing.T) {
+	_, redisClient := newTestRedis(t)
+	router := newTestServer(t, testConfig(), redisClient).Router()
+	doRequest(router, "GET", "/visit/home", "", nil)
+
+	w := doRequest(router, "HEAD", "/visit/home", "", nil)
+	if w.Code != http.StatusOK || w.Body.Len() != 0 {
+		t.Errorf("Expected 200 with no body, got %d %q", w.Code, w.Body.String())
+	}
+	if n, _ := strconv.Atoi(w.Header().Get("Content-Length")); n == 0 {
+		t.Error("Expected a Content-Length for the HEAD response")
+	}
+
+	if resp := decodeVisit(t, doRequest(router, "GET", "/visits/home", "", nil).Body.Bytes()); resp.Visits != 1 {
+		t.Errorf("Expected HEAD not to count a visit, got %d", resp.Visits)
+	}
+}
+
+func TestHeadMatchesGetHeaders(t *testing.T) {
+	_, redisClient := newTestRedis(t)
+	router := newTestServer(t, testConfig(), redisClient).Router()
+	doRequest(router, "GET", "/visit/home", "", nil)
+
+	for _, path := range []string{"/pages/top", "/visits/home", "/health", "/stream/counters"} {
+		get := doRequest(router, "GET", path, "", nil)
+		head := doRequest(router, "HEAD", path, "", nil)
+		if head.Code != get.Code || head.Body.Len() != 0 {
+			t.Errorf("%s: expected HEAD status %d with no body, got %d %q", path, get.Code, head.Code, head.Body.String())
+		}
+		if head.Header().Get("ETag") != get.Header().Get("ETag") || head.Header().Get("Content-Type") != get.Header().Get("Content-Type") {
+			t.Errorf("%s: HEAD headers differ from GET: %v vs %v", path, head.Header(), get.Header())
+		}
+		if path != "/health" && head.Header().Get("Content-Length") != strconv.Itoa(get.Body.Len()) {
+			t.Errorf("%s: expected Content-Length %d, got %q", path, get.Body.Len(), head.Header().Get("Content-Length"))
+		}
+	}
+}
+
+func TestOptionsAllowHeader(t *testing.T) {
+	_, redisClient := newTestRedis(t)
+	router := newTestServer(t, testConfig(), redisClient).Router()
+
+	tests := map[string]string{
+		"/visit/home":         "GET, HEAD, OPTIONS",
+		"/goals":              "POST, OPTIONS",
+		"/admin/flags":        "GET, HEAD, PUT, OPTIONS",
+		"/admin/pages/x/meta": "PUT, OPTIONS",
+		"/pages/x/meta":       "GET, HEAD, OPTIONS",
+	}
+	for path, want := range tests {
+		w := doRequest(router, "OPTIONS", path, "", nil)
+		if w.Code != http.StatusNoContent || w.Header().Get("Allow") != want {
+			t.Errorf("%s: expected 204 with Allow %q, got %d %q", path, want, w.Code, w.Header().Get("Allow"))
+		}
+		if w.Header().Get("Access-Control-Allow-Origin") != "*" {
+			t.Errorf("%s: expected CORS headers on preflight", path)
+		}
+	}
+
+	if w := doRequest(router, "OPTIONS", "/nope", "", nil); w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for OPTIONS on an unknown path, got %d", w.Code)
+	}
+}
+
+func TestRoutePlacementPerPort(t *testing.T) {
+	_, redisClient := newTestRedis(t)
+	server := newTestServer(t, testConfig(), redisClient)
+	public, internal, single := server.PublicRouter(), server.InternalRouter(), server.Router()
+
+	tests := []struct {
+		method   string
+		path     string
+		internal bool
+	}{
+		{"GET", "/visit/home", false},
+		{"GET", "/visits/home", false},
+		{"GET", "/pages/top", false},
+		{"GET", "/health", false},
+		{"GET", "/admin/flags", true},
+		{"GET", "/admin/audit", true},
+		{"POST", "/admin/retention", true},
+		{"GET", "/livez", true},
+		{"GET", "/readyz", true},
+		{"GET", "/metrics", true},
+		{"GET", "/debug/routes", true},
+	}
+	for _, tt := range tests {
+		onPort, offPort := public, internal
+		if tt.internal {
+			onPort, offPort = internal, public
+		}
+		if w := doRequest(onPort, tt.method, tt.path, "", nil); w.Code == http.StatusNotFound {
+			t.Errorf("%s %s: expected route on its port, got 404", tt.method, tt.path)
+		}
+		if w := doRequest(offPort, tt.method, tt.path, "", nil); w.Code != http.StatusNotFound {
+			t.Errorf("%s %s: expected 404 on the other port, got %d", tt.method, tt.path, w.Code)
+		}
+		if w := doRequest(offPort, "OPTIONS", tt.path, "", nil); w.Code != http.StatusNotFound {
+			t.Errorf("OPTIONS %s: expected 404 on the other port, got %d", tt.path, w.Code)
+		}
+		if w := doRequest(single, tt.method, tt.path, "", nil); w.Code == http.StatusNotFound {
+			t.Errorf("%s %s: expected route in single-port mode, got 404", tt.method, tt.path)
+		}
+	}
+}
+
+func TestReadyzReportsRedis(t *testing.T) {
+	mr, redisClient := newTestRedis(t)
+	internal := newTestServer(t, testConfig(), redisClient).InternalRouter()
+
+	if w := doRequest(internal, "GET", "/readyz", "", nil); w.Code != http.StatusOK {
+		t.Errorf("Expected 200 while Redis is up, got %d", w.Code)
+	}
+	mr.Close()
+	if w := doRequest(internal, "GET", "/readyz", "", nil); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 while Redis is down, got %d", w.Code)
+	}
+	if w := doRequest(internal, "GET", "/livez", "", nil); w.Code != http.StatusOK {
+		t.Errorf("Expected livez to stay 200 while Redis is down, got %d", w.Code)
+	}
+}
+
+func TestRouteConflicts(t *testing.T) {
+	tests := []struct {
+		name     string
+		existing []registeredRoute
+		route    registeredRoute
+		err      string
+	}{
+		{"duplicate", []registeredRoute{{Method: "GET", Path: "/visits/:page", Handler: "a"}}, registeredRoute{Method: "GET", Path: "/visits/:page", Handler: "b"}, "GET /visits/:page is registered twice, by a and b"},
+		{"static added after its param", []registeredRoute{{Method: "GET", Path: "/visits/:page"}}, registeredRoute{Method: "GET", Path: "/visits/aggregate"}, `GET /visits/aggregate shadows GET /visits/:page for page="aggregate"`},
+		{"param added after a static", []registeredRoute{{Method: "GET", Path: "/visits/aggregate"}}, registeredRoute{Method: "GET", Path: "/visits/:page"}, `GET /visits/aggregate shadows GET /visits/:page for page="aggregate"`},
+		{"shadow deeper in the path", []registeredRoute{{Method: "GET", Path: "/pages/:page/meta"}}, registeredRoute{Method: "GET", Path: "/pages/top/:field"}, `GET /pages/top/:field shadows GET /pages/:page/meta for page="top"`},
+		{"parameters named differently", []registeredRoute{{Method: "GET", Path: "/visits/:page/range"}}, registeredRoute{Method: "PUT", Path: "/visits/:id"}, "names the parameter of GET /visits/:page/range :id instead of :page"},
+		{"catch-all", []registeredRoute{{Method: "GET", Path: "/files/*path"}}, registeredRoute{Method: "GET", Path: "/files/index"}, "a catch-all must be the only route after its prefix"},
+		{"reserved static", []registeredRoute{{Method: "GET", Path: "/visits/:page"}}, registeredRoute{Method: "GET", Path: "/visits/aggregate", Reserved: true}, ""},
+		{"other method", []registeredRoute{{Method: "GET", Path: "/visits/:page"}}, registeredRoute{Method: "POST", Path: "/visits/query"}, ""},
+		{"longer static path", []registeredRoute{{Method: "GET", Path: "/pages/:page/meta"}}, registeredRoute{Method: "GET", Path: "/pages/top"}, ""},
+		{"diverging statics", []registeredRoute{{Method: "GET", Path: "/pages/:page/meta"}}, registeredRoute{Method: "GET", Path: "/pages/:page/url"}, ""},
+	}
+	for _, tt := range tests {
+		table := &routeTable{}
+		for i := range tt.existing {
+			if err := table.add(&tt.existing[i]); err != nil {
+				t.Fatalf("%s: %v", tt.name, err)
+			}
+		}
+		err := table.add(&tt.route)
+		if tt.err == "" && err != nil {
+			t.Errorf("%s: expected the route added, got %v", tt.name, err)
+		}
+		if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+			t.Errorf("%s: expected %q, got %v", tt.name, tt.err, err)
+		}
+	}
+
+	// A reserved route must still shadow something
+	table := &routeTable{}
+	table.add(&registeredRoute{Method: "GET", Path: "/visits/aggregate", Reserved: true})
+	if err := table.verify(); err == nil || !strings.Contains(err.Error(), "matches no parameterized route") {
+		t.Errorf("Expected a stale reserve reported, got %v", err)
+	}
+}
+
+func TestRouteGroupPanicsOnConflict(t *testing.T) {
+	routes := newRouteGroup(gin.New())
+	handler := func(c *gin.Context) {}
+	routes.Group("/visits").GET("/:page", handler)
+	defer func() {
+		err, _ := recover().(error)
+		if err == nil || !strings.Contains(err.Error(), "GET /visits/aggregate shadows GET /visits/:page") {
+			t.Errorf("Expected registration to fail naming both routes, got %v", err)
+		}
+	}()
+	routes.GET("/visits/aggregate", handler)
+}
+
+func TestStaticRouteBeatsParam(t *testing.T) {
+	_, redisClient := newTestRedis(t)
+	router := newTestServer(t, testConfig(), redisClient).Router()
+	doRequest(router, "GET", "/visit/aggregate", "", nil)
+
+	// A page named aggregate is counted, but /visits/aggregate is the
+	// aggregate endpoint, not its count
+	w := doRequest(router, "GET", "/visits/aggregate?pattern=aggregate", "", nil)
+	var resp AggregateResponse
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if w.Code != http.StatusOK || resp.Pattern != "aggregate" || resp.Visits != 1 {
+		t.Errorf("Expected the aggregate endpoint, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := doRequest(router, "GET", "/visits/home", "", nil); !strings.Contains(w.Body.String(), `"page":"home"`) {
+		t.Errorf("Expected other pages served by /visits/:page, got %s", w.Body.String())
+	}
+
+	w = doRequest(router, "GET", "/debug/routes", "", nil)
+	var routes RoutesResponse
+	json.Unmarshal(w.Body.Bytes(), &routes)
+	byRoute := make(map[routeKey]RouteInfo)
+	for _, r := range routes.Routes {
+		byRoute[routeKey{Method: r.Method, Route: r.Route}] = r
+	}
+	if r := byRoute[routeKey{"GET", "/visits/aggregate"}]; r.Handler != "(*Server).handleAggregateVisits" || !reflect.DeepEqual(r.Shadows, []string{"/visits/:page"}) {
+		t.Errorf("Expected the aggregate route listed as shadowing /visits/:page, got %+v", r)
+	}
+	if r := byRoute[routeKey{"HEAD", "/visits/:page"}]; r.Handler != "(*Server).handleGetVisits" || r.Shadows != nil {
+		t.Errorf("Expected /visits/:page owned by handleGetVisits, got %+v", r)
+	}
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/pprof"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Profile capture triggers
+const (
+	triggerThreshold = "threshold" // goroutines went above GOROUTINE_THRESHOLD
+	triggerGrowth    = "growth"    // goroutines grew for GOROUTINE_GROWTH_SAMPLES samples
+)
+
+// captureLayout names captures by when they were taken, sorting oldest first
+const captureLayout = "20060102T150405.000Z"
+
+// captureProfiles are the profiles written for each capture, as
+// <capture>.<profile>.pb.gz
+var captureProfiles = []string{"goroutine", "heap"}
+
+// runtimeSample is one reading of the goroutines and the heap
+type runtimeSample struct {
+	Goroutines  int64
+	HeapAlloc   uint64
+	HeapInuse   uint64
+	HeapObjects uint64
+}
+
+// readRuntimeSample reads the runtime's goroutine count and heap stats.
+// ReadMemStats stops the world briefly, which is fine every few seconds.
+func readRuntimeSample() runtimeSample {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	return runtimeSample{
+		Goroutines:  int64(runtime.NumGoroutine()),
+		HeapAlloc:   m.HeapAlloc,
+		HeapInuse:   m.HeapInuse,
+		HeapObjects: m.HeapObjects,
+	}
+}
+
+// RuntimeWatchdog samples the goroutines and the heap every
+// RUNTIME_SAMPLE_INTERVAL for the metrics, and captures goroutine and heap
+// profiles when the goroutines look like they are leaking: once each time
+// they go above the threshold, and each time they have grown on every one
+// of the last growth samples
+type RuntimeWatchdog struct {
+	clock     Clock
+	threshold int64
+	growth    int
+	captures  *ProfileCaptures
+	sample    func() runtimeSample
+
+	mu      sync.Mutex
+	last    runtimeSample
+	sampled bool
+	streak  int  // consecutive samples with more goroutines than the one before
+	over    bool // above the threshold at the last sample
+
+	thresholdCaptures atomic.Int64
+	growthCaptures    atomic.Int64
+}
+
+// newRuntimeWatchdog creates the server's watchdog from cfg; it captures
+// nothing without PROFILE_CAPTURE_DIR
+func newRuntimeWatchdog(cfg Config, clock Clock) *RuntimeWatchdog {
+	return &RuntimeWatchdog{
+		clock:     clock,
+		threshold: cfg.GoroutineThreshold,
+		growth:    int(cfg.GoroutineGrowthSamples),
+		captures:  newProfileCaptures(cfg.ProfileCaptureDir, int(cfg.ProfileCaptureMax)),
+		sample:    readRuntimeSample,
+	}
+}
+
+// check takes a sample and captures profiles if it trips a trigger
+func (w *RuntimeWatchdog) check(context.Context) error {
+	sample := w.sample()
+	w.mu.Lock()
+	if w.sampled && sample.Goroutines > w.last.Goroutines {
+		w.streak++
+	} else {
+		w.streak = 0
+	}
+	w.last, w.sampled = sample, true
+
+	var trigger string
+	above := w.threshold > 0 && sample.Goroutines > w.threshold
+	switch {
+	case above && !w.over:
+		trigger = triggerThreshold
+	case w.growth > 0 && w.streak >= w.growth:
+		trigger = triggerGrowth
+		// A leak that keeps growing is captured again after as many samples
+		w.streak = 0
+	}
+	w.over = above
+	w.mu.Unlock()
+
+	if trigger == "" {
+		return nil
+	}
+	if trigger == triggerThreshold {
+		w.thresholdCaptures.Add(1)
+	} else {
+		w.growthCaptures.Add(1)
+	}
+	if w.captures == nil {
+		log.Printf("event=goroutine_leak_suspected trigger=%s goroutines=%d heap_alloc_bytes=%d", trigger, sample.Goroutines, sample.HeapAlloc)
+		return nil
+	}
+	name, err := w.captures.Capture(trigger, w.clock.Now())
+	if err != nil {
+		return fmt.Errorf("capturing profiles: %w", err)
+	}
+	log.Printf("event=goroutine_leak_suspected trigger=%s goroutines=%d heap_alloc_bytes=%d capture=%s",
+		trigger, sample.Goroutines, sample.HeapAlloc, filepath.Join(w.captures.dir, name))
+	return nil
+}
+
+// write writes the runtime gauges, once a sample was taken, and the capture
+// counts
+func (w *RuntimeWatchdog) write(b *strings.Builder, env string) {
+	w.mu.Lock()
+	sample, sampled, streak := w.last, w.sampled, w.streak
+	w.mu.Unlock()
+	labels, prefix := "", ""
+	if env != "" {
+		labels = "{env=" + strconv.Quote(env) + "}"
+		prefix = "env=" + strconv.Quote(env) + ","
+	}
+	if sampled {
+		for _, gauge := range []struct {
+			name, help string
+			value      uint64
+		}{
+			{"go_goroutines", "Goroutines at the last runtime sample.", uint64(sample.Goroutines)},
+			{"go_memstats_heap_alloc_bytes", "Heap bytes allocated and in use at the last runtime sample.", sample.HeapAlloc},
+			{"go_memstats_heap_inuse_bytes", "Heap bytes in in-use spans at the last runtime sample.", sample.HeapInuse},
+			{"go_memstats_heap_objects", "Allocated heap objects at the last runtime sample.", sample.HeapObjects},
+			{"go_goroutines_growth_samples", "Consecutive runtime samples with more goroutines than the one before.", uint64(streak)},
+		} {
+			fmt.Fprintf(b, "# HELP %s %s\n", gauge.name, gauge.help)
+			fmt.Fprintf(b, "# TYPE %s gauge\n", gauge.name)
+			fmt.Fprintf(b, "%s%s %d\n", gauge.name, labels, gauge.value)
+		}
+	}
+	b.WriteString("# HELP profile_captures_total Goroutine and heap profile captures, by trigger.\n")
+	b.WriteString("# TYPE profile_captures_total counter\n")
+	fmt.Fprintf(b, "profile_captures_total{%strigger=%q} %d\n", prefix, triggerGrowth, w.growthCaptures.Load())
+	fmt.Fprintf(b, "profile_captures_total{%strigger=%q} %d\n", prefix, triggerThreshold, w.thresholdCaptures.Load())
+}
+
+// ProfileCapture is one capture of the /debug/captures listing
+type ProfileCapture struct {
+	Name      string    `json:"name"`
+	Trigger   string    `json:"trigger"`
+	CreatedAt time.Time `json:"created_at"`
+	Files     []string  `json:"files"`
+}
+
+// ProfileCapturesResponse represents the /debug/captures API response
+type ProfileCapturesResponse struct {
+	Captures []ProfileCapture `json:"captures"`
+	Total    int              `json:"total"`
+}
+
+// ProfileCaptures writes profile captures to a directory, keeping only the
+// newest PROFILE_CAPTURE_MAX. The directory is the index: captures are
+// listed from the file names, so nothing else needs to survive a restart.
+type ProfileCaptures struct {
+	dir  string
+	keep int
+
+	// mu serializes captures and their rotation
+	mu sync.Mutex
+}
+
+// newProfileCaptures returns the captures under dir, or nil when dir is
+// empty
+func newProfileCaptures(dir string, keep int) *ProfileCaptures {
+	if dir == "" {
+		return nil
+	}
+	return &ProfileCaptures{dir: dir, keep: keep}
+}
+
+// Capture writes the goroutine and heap profiles as a new capture, removes
+// the oldest beyond the limit and returns the capture's name. Each file is
+// written under a temporary name first, so listings never see half a
+// profile.
+func (p *ProfileCaptures) Capture(trigger string, now time.Time) (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := os.MkdirAll(p.dir, 0o755); err != nil {
+		return "", err
+	}
+	name := now.UTC().Format(captureLayout) + "-" + trigger
+	for _, profile := range captureProfiles {
+		path := filepath.Join(p.dir, name+"."+profile+".pb.gz")
+		if err := writeProfile(path, profile); err != nil {
+			return "", err
+		}
+	}
+
+	captures, err := p.list()
+	if err != nil {
+		return name, err
+	}
+	for len(captures) > p.keep {
+		for _, file := range captures[0].Files {
+			if err := os.Remove(filepath.Join(p.dir, file)); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return name, err
+			}
+		}
+		captures = captures[1:]
+	}
+	return name, nil
+}
+
+// writeProfile writes the named runtime profile, gzipped protobuf as
+// go tool pprof reads, to path
+func writeProfile(path, profile string) error {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if profile == "heap" {
+		// Up to date with the allocations since the last GC
+		runtime.GC()
+	}
+	err = pprof.Lookup(profile).WriteTo(f, 0)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// List returns the captures, oldest first
+func (p *ProfileCaptures) List() ([]ProfileCapture, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.list()
+}
+
+func (p *ProfileCaptures) list() ([]ProfileCapture, error) {
+	entries, err := os.ReadDir(p.dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return []ProfileCapture{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	byName := map[string]*ProfileCapture{}
+	for _, entry := range entries {
+		name, ok := captureFileName(entry.Name())
+		if !ok || entry.IsDir() {
+			continue
+		}
+		capture, ok := byName[name]
+		if !ok {
+			stamp, trigger, _ := strings.Cut(name, "-")
+			createdAt, _ := time.Parse(captureLayout, stamp)
+			capture = &ProfileCapture{Name: name, Trigger: trigger, CreatedAt: createdAt}
+			byName[name] = capture
+		}
+		capture.Files = append(capture.Files, entry.Name())
+	}
+	captures := make([]ProfileCapture, 0, len(byName))
+	for _, capture := range byName {
+		captures = append(captures, *capture)
+	}
+	sort.Slice(captures, func(i, j int) bool { return captures[i].Name < captures[j].Name })
+	return captures, nil
+}
+
+// captureFileName returns the capture a profile file belongs to, false for
+// any other file in the directory
+func captureFileName(file string) (string, bool) {
+	for _, profile := range captureProfiles {
+		if name, ok := strings.CutSuffix(file, "."+profile+".pb.gz"); ok {
+			stamp, trigger, _ := strings.Cut(name, "-")
+			if _, err := time.Parse(captureLayout, stamp); err != nil || (trigger != triggerThreshold && trigger != triggerGrowth) {
+				return "", false
+			}
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// handleListCaptures lists the profile captures, oldest first
+func (s *Server) handleListCaptures(c *gin.Context) {
+	captures, err := s.watchdog.captures.List()
+	if err != nil {
+		log.Printf("Error listing profile captures: %v", err)
+		respondError(c, http.StatusInternalServerError, "internal_error", "Failed to list profile captures")
+		return
+	}
+	respondJSON(c, http.StatusOK, ProfileCapturesResponse{Captures: captures, Total: len(captures)})
+}
+
+// handleGetCapture downloads a capture's profile file. Only the files of
+// listed captures are served, so the name can't reach outside
+// PROFILE_CAPTURE_DIR.
+func (s *Server) handleGetCapture(c *gin.Context) {
+	file := c.Param("file")
+	if _, ok := captureFileName(file); !ok || strings.ContainsAny(file, `/\`) {
+		respondError(c, http.StatusNotFound, "not_found", "Profile capture not found")
+		return
+	}
+	path := filepath.Join(s.watchdog.captures.dir, file)
+	if _, err := os.Stat(path); err != nil {
+		respondError(c, http.StatusNotFound, "not_found", "Profile capture not found")
+		return
+	}
+	c.Header("Content-Type", "application/octet-stream")
+	c.FileAttachment(path, file)
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go-redis-app/internal/clocktest"
+)
+
+// spawnGoroutines starts n goroutines blocked until the returned release is
+// called, which waits for them to exit
+func spawnGoroutines(n int) (release func()) {
+	block := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-block
+		}()
+	}
+	return func() {
+		close(block)
+		wg.Wait()
+	}
+}
+
+func TestGoroutineThresholdCapture(t *testing.T) {
+	cfg := testConfig()
+	cfg.GoroutineThreshold = int64(runtime.NumGoroutine()) + 50
+	cfg.ProfileCaptureDir = t.TempDir()
+	cfg.ProfileCaptureMax = 2
+	clock := clocktest.New(time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC))
+	w := newRuntimeWatchdog(cfg, clock)
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		release := spawnGoroutines(100)
+		w.check(ctx)
+		// Staying above the threshold is the same incident
+		w.check(ctx)
+		release()
+		waitFor(t, time.Second, func() bool { return int64(runtime.NumGoroutine()) <= cfg.GoroutineThreshold })
+		w.check(ctx)
+		clock.Advance(time.Minute)
+	}
+	if got := w.thresholdCaptures.Load(); got != 3 {
+		t.Errorf("Expected a capture per incident, got %d", got)
+	}
+
+	// The oldest capture was rotated out
+	captures, err := w.captures.List()
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	if len(captures) != 2 || captures[0].Name != "20240501T120100.000Z-threshold" || captures[1].Name != "20240501T120200.000Z-threshold" {
+		t.Fatalf("Expected the 2 newest captures, got %+v", captures)
+	}
+	for _, capture := range captures {
+		if len(capture.Files) != 2 || capture.Trigger != triggerThreshold || capture.CreatedAt.IsZero() {
+			t.Errorf("Unexpected capture %+v", capture)
+		}
+		for _, file := range capture.Files {
+			if info, err := os.Stat(filepath.Join(cfg.ProfileCaptureDir, file)); err != nil || info.Size() == 0 {
+				t.Errorf("Expected %s written, got %v", file, err)
+			}
+		}
+	}
+	if files, _ := os.ReadDir(cfg.ProfileCaptureDir); len(files) != 4 {
+		t.Errorf("Expected only the kept profiles on disk, got %d files", len(files))
+	}
+}
+
+func TestGoroutineGrowthCapture(t *testing.T) {
+	cfg := testConfig()
+	cfg.GoroutineGrowthSamples = 3
+	w := newRuntimeWatchdog(cfg, clocktest.New(time.Now()))
+	counts := []int64{10, 11, 12, 12, 13, 14, 15, 16, 17, 18}
+	w.sample = func() runtimeSample {
+		n := counts[0]
+		counts = counts[1:]
+		return runtimeSample{Goroutines: n, HeapAlloc: 1 << 20}
+	}
+
+	// 12 to 12 breaks the first run; 13 to 15 make 3 rises, and the run
+	// starts over for 16 to 18
+	wants := []int64{0, 0, 0, 0, 0, 0, 1, 1, 1, 2}
+	for i, want := range wants {
+		w.check(context.Background())
+		if got := w.growthCaptures.Load(); got != want {
+			t.Fatalf("After sample %d: expected %d growth captures, got %d", i+1, want, got)
+		}
+	}
+
+	var b strings.Builder
+	w.write(&b, "")
+	for _, series := range []string{
+		"go_goroutines 18\n",
+		"go_memstats_heap_alloc_bytes 1048576\n",
+		"go_goroutines_growth_samples 0\n",
+		`profile_captures_total{trigger="growth"} 2` + "\n",
+		`profile_captures_total{trigger="threshold"} 0` + "\n",
+	} {
+		if !strings.Contains(b.String(), series) {
+			t.Errorf("Expected %q in the metrics:\n%s", series, b.String())
+		}
+	}
+}
+
+func TestCaptureEndpoints(t *testing.T) {
+	_, redisClient := newTestRedis(t)
+	cfg := testConfig()
+	cfg.ProfileCaptureDir = t.TempDir()
+	cfg.ProfileCaptureMax = 5
+	server := newTestServer(t, cfg, redisClient)
+	router := server.Router()
+	name, err := server.watchdog.captures.Capture(triggerGrowth, time.Now())
+	if err != nil {
+		t.Fatalf("Capture: %v", err)
+	}
+	os.WriteFile(filepath.Join(cfg.ProfileCaptureDir, "notes.txt"), []byte("not a capture"), 0o644)
+
+	w := doRequest(router, "GET", "/debug/captures", "", nil)
+	var resp ProfileCapturesResponse
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if w.Code != http.StatusOK || resp.Total != 1 || resp.Captures[0].Name != name {
+		t.Fatalf("Expected the one capture listed, got %d %s", w.Code, w.Body.String())
+	}
+	file := resp.Captures[0].Files[0]
+	if w := doRequest(router, "GET", "/debug/captures/"+file, "", nil); w.Code != http.StatusOK || w.Body.Len() == 0 {
+		t.Errorf("Expected %s downloaded, got %d", file, w.Code)
+	}
+	for _, bad := range []string{"notes.txt", "20240501T120000.000Z-growth.heap.pb.gz", "..%2Fsecret.heap.pb.gz"} {
+		if w := doRequest(router, "GET", "/debug/captures/"+bad, "", nil); w.Code != http.StatusNotFound {
+			t.Errorf("Expected 404 for %s, got %d", bad, w.Code)
+		}
+	}
+}
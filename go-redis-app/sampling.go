@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// metaCacheTTL bounds how long a page's metadata is cached for visits, and
+// so how long other replicas take to pick up a metadata change
+const metaCacheTTL = 5 * time.Second
+
+// metaCache caches the per-page metadata visits read, such as the sample
+// rate and webhook URL, so hot pages don't read it on every visit
+type metaCache struct {
+	mu      sync.Mutex
+	entries map[string]metaCacheEntry
+}
+
+type metaCacheEntry struct {
+	meta    PageMeta
+	expires time.Time
+}
+
+func newMetaCache() *metaCache {
+	return &metaCache{entries: make(map[string]metaCacheEntry)}
+}
+
+func (c *metaCache) get(page string, now time.Time) (PageMeta, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[page]
+	if !ok || now.After(entry.expires) {
+		return PageMeta{}, false
+	}
+	return entry.meta, true
+}
+
+func (c *metaCache) set(page string, meta PageMeta, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[page] = metaCacheEntry{meta: meta, expires: now.Add(metaCacheTTL)}
+}
+
+func (c *metaCache) invalidate(page string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, page)
+}
+
+// cachedMeta returns the page's metadata, read through the visit cache
+func (s *Server) cachedMeta(ctx context.Context, page string) (PageMeta, error) {
+	now := s.clock.Now()
+	if meta, ok := s.metaCache.get(page, now); ok {
+		return meta, nil
+	}
+	meta, err := s.meta.GetMeta(ctx, page)
+	if err != nil {
+		return PageMeta{}, err
+	}
+	s.metaCache.set(page, meta, now)
+	return meta, nil
+}
+
+// sampleWeight returns how many visits each sampled request counts for: the
+// inverse of the rate rounded to a whole number, or 1 when not sampling
+func sampleWeight(rate float64) int64 {
+	if rate <= 0 || rate >= 1 {
+		return 1
+	}
+	return max(1, int64(math.Round(1/rate)))
+}
+
+// sampleDraw returns a request's random sampling draw. Clients can send
+// their own request ID, so it never decides sampling: an ID found to be
+// sampled in could be replayed to count for weight visits every time.
+func sampleDraw() uint64 {
+	return rand.Uint64()
+}
+
+// sampledIn selects one in weight requests by their draw
+func sampledIn(draw uint64, weight int64) bool {
+	return weight <= 1 || draw%uint64(weight) == 0
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestSampleWeight(t *testing.T) {
+	tests := map[float64]int64{0: 1, 1: 1, 0.5: 2, 0.3: 3, 0.25: 4, 0.01: 100}
+	for rate, want := range tests {
+		if got := sampleWeight(rate); got != want {
+			t.Errorf("sampleWeight(%v) = %d, want %d", rate, got, want)
+		}
+	}
+}
+
+func TestSampledIn(t *testing.T) {
+	sampled := 0
+	for i := 0; i < 10000; i++ {
+		if sampledIn(sampleDraw(), 10) {
+			sampled++
+		}
+	}
+	if sampled < 850 || sampled > 1150 {
+		t.Errorf("Expected about 1000 of 10000 requests sampled at 1/10, got %d", sampled)
+	}
+	if !sampledIn(sampleDraw(), 1) {
+		t.Error("Expected every request to be sampled at weight 1")
+	}
+}
+
+func TestSampledPageCounts(t *testing.T) {
+	mr, redisClient := newTestRedis(t)
+	cfg := testConfig()
+	cfg.VisitorCookie = true
+	server := newTestServer(t, cfg, redisClient)
+	server.flags.Set(context.Background(), map[string]bool{"dedupe": true})
+	router := server.Router()
+
+	if w := doRequest(router, "PUT", "/admin/pages/hot/meta", `{"sample_rate": 0.1}`, nil); w.Code != 200 {
+		t.Fatalf("Failed to set sample rate: %d %s", w.Code, w.Body.String())
+	}
+
+	sampled := 0
+	for i := 0; i < 2000; i++ {
+		// Distinct visitors so dedupe doesn't drop sampled requests. The
+		// request ID is the same every time and doesn't decide sampling.
+		headers := map[string]string{"X-Request-ID": "replayed", "Cookie": fmt.Sprintf("%s=%032x", visitorCookieName, i)}
+		resp := decodeVisit(t, doRequest(router, "GET", "/visit/hot", "", headers).Body.Bytes())
+		if !resp.Sampled || resp.SampleRate != 0.1 {
+			t.Fatalf("Expected sampled response with rate 0.1, got %+v", resp)
+		}
+		if *resp.Counted {
+			sampled++
+		}
+	}
+
+	resp := decodeVisit(t, doRequest(router, "GET", "/visits/hot", "", nil).Body.Bytes())
+	if resp.Visits != int64(sampled)*10 {
+		t.Errorf("Expected %d visits (10 per sampled request), got %d", sampled*10, resp.Visits)
+	}
+	if resp.Visits < 1400 || resp.Visits > 2600 {
+		t.Errorf("Expected an estimate near 2000, got %d", resp.Visits)
+	}
+
+	// Only sampled requests touched dedupe
+	dedupeKeys := 0
+	for _, key := range mr.Keys() {
+		if strings.HasPrefix(key, "visits:dedupe:hot:") {
+			dedupeKeys++
+		}
+	}
+	if dedupeKeys != sampled {
+		t.Errorf("Expected %d dedupe markers, got %d", sampled, dedupeKeys)
+	}
+
+	// Unsampled pages are unaffected
+	if resp := decodeVisit(t, doRequest(router, "GET", "/visit/cold", "", nil).Body.Bytes()); resp.Sampled || resp.Visits != 1 {
+		t.Errorf("Expected an exact count for an unsampled page, got %+v", resp)
+	}
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// schemaMigrationsKey is the set of schema migration IDs applied so far
+const schemaMigrationsKey = "schema:migrations"
+
+// schemaMigration upgrades data written in an older layout. Run must be
+// idempotent, as a migration interrupted halfway runs again from the start,
+// and reports how many keys it changed.
+type schemaMigration struct {
+	ID          string
+	Description string
+
+	// Requires names a Redis module the migration needs; without it the
+	// migration stays pending
+	Requires string
+
+	Run func(ctx context.Context, r *RedisClient) (int64, error)
+}
+
+// schemaMigrations are applied in order. Append new layout changes to the
+// end and never renumber or remove an entry once released.
+var schemaMigrations = []schemaMigration{
+	{
+		ID:          "0001-page-indexes",
+		Description: "index counters from before the leaderboard and page name index",
+		Run:         migratePageIndexes,
+	},
+	{
+		ID:          "0002-private-index",
+		Description: "index private pages from metadata hashes",
+		Run:         migratePrivateIndex,
+	},
+	{
+		ID:          "0003-metadata-documents",
+		Description: "convert metadata hashes to RedisJSON documents",
+		Requires:    "rejson",
+		Run:         migrateMetadataDocuments,
+	},
+	{
+		ID:          "0004-goal-index",
+		Description: "index goals by name for the local goal store",
+		Run:         migrateGoalIndex,
+	},
+}
+
+// migratePageIndexes adds every page counter missing from the leaderboard
+// with its count, and its name to the search indexes
+func migratePageIndexes(ctx context.Context, r *RedisClient) (int64, error) {
+	var changed, scanned int64
+	err := r.scanKeysOfType(ctx, "visits:*", "string", func(keys []string) error {
+		var pages, counters []string
+		for _, key := range keys {
+			if page, ok := counterPage(key); ok {
+				pages = append(pages, page)
+				counters = append(counters, key)
+			}
+		}
+		if len(pages) == 0 {
+			return nil
+		}
+		values, err := r.client.MGet(ctx, counters...).Result()
+		if err != nil {
+			return err
+		}
+		pipe := r.client.Pipeline()
+		var added []*redis.IntCmd
+		for i, page := range pages {
+			s, _ := values[i].(string)
+			count, err := strconv.ParseInt(s, 10, 64)
+			if err != nil {
+				// Deleted since the SCAN, or not a counter after all
+				continue
+			}
+			added = append(added, pipe.ZAddNX(ctx, leaderboardKey, redis.Z{Member: page, Score: float64(count)}))
+			r.queueIndexPage(ctx, pipe, page)
+		}
+		if _, err := pipe.Exec(ctx); err != nil {
+			return err
+		}
+		for _, cmd := range added {
+			changed += cmd.Val()
+		}
+		scanned += int64(len(pages))
+		log.Printf("Schema migration progress: %d pages scanned, %d indexed", scanned, changed)
+		return nil
+	})
+	return changed, err
+}
+
+// migratePrivateIndex adds the pages whose metadata hash marks them private
+// to the private page index
+func migratePrivateIndex(ctx context.Context, r *RedisClient) (int64, error) {
+	var changed int64
+	err := r.scanKeysOfType(ctx, metaKey("*"), "hash", func(keys []string) error {
+		pipe := r.client.Pipeline()
+		visibility := make([]*redis.StringCmd, len(keys))
+		for i, key := range keys {
+			visibility[i] = pipe.HGet(ctx, key, "visibility")
+		}
+		if _, err := pipe.Exec(ctx); ignoreMissing(err) != nil {
+			return err
+		}
+		var private []interface{}
+		for i, key := range keys {
+			if visibility[i].Val() == visibilityPrivate {
+				private = append(private, strings.TrimPrefix(key, metaKey("")))
+			}
+		}
+		if len(private) == 0 {
+			return nil
+		}
+		n, err := r.client.SAdd(ctx, privatePagesKey, private...).Result()
+		changed += n
+		return err
+	})
+	return changed, err
+}
+
+// migrateGoalIndex adds the goals defined before the goal name set to it
+func migrateGoalIndex(ctx context.Context, r *RedisClient) (int64, error) {
+	var changed int64
+	err := r.scanKeysOfType(ctx, goalKey("*"), "hash", func(keys []string) error {
+		var names []interface{}
+		for _, key := range keys {
+			if name := strings.TrimPrefix(key, goalKey("")); goalNamePattern.MatchString(name) {
+				names = append(names, name)
+			}
+		}
+		if len(names) == 0 {
+			return nil
+		}
+		n, err := r.client.SAdd(ctx, goalsKey, names...).Result()
+		changed += n
+		return err
+	})
+	return changed, err
+}
+
+// migrateMetadataDocuments rewrites every metadata hash as a RedisJSON
+// document
+func migrateMetadataDocuments(ctx context.Context, r *RedisClient) (int64, error) {
+	hashes, documents := NewRedisMetadataStore(r), NewJSONMetadataStore(r)
+	var changed int64
+	err := r.scanKeysOfType(ctx, metaKey("*"), "hash", func(keys []string) error {
+		for _, key := range keys {
+			page := strings.TrimPrefix(key, metaKey(""))
+			meta, err := hashes.GetMeta(ctx, page)
+			if err != nil {
+				return err
+			}
+			if err := documents.SetMeta(ctx, page, meta); err != nil {
+				return err
+			}
+			changed++
+		}
+		log.Printf("Schema migration progress: %d metadata hashes converted", changed)
+		return nil
+	})
+	return changed, err
+}
+
+// SchemaMigrationStatus is a schema migration and whether it has run
+type SchemaMigrationStatus struct {
+	ID          string `json:"id"`
+	Description string `json:"description"`
+	Applied     bool   `json:"applied"`
+}
+
+// SchemaStatus lists every schema migration in order with whether it has
+// been applied
+func (r *RedisClient) SchemaStatus(ctx context.Context) ([]SchemaMigrationStatus, error) {
+	applied, err := r.appliedMigrations(ctx)
+	if err != nil {
+		return nil, err
+	}
+	status := make([]SchemaMigrationStatus, len(schemaMigrations))
+	for i, m := range schemaMigrations {
+		status[i] = SchemaMigrationStatus{ID: m.ID, Description: m.Description, Applied: applied[m.ID]}
+	}
+	return status, nil
+}
+
+// appliedMigrations returns the set of applied migration IDs
+func (r *RedisClient) appliedMigrations(ctx context.Context) (map[string]bool, error) {
+	ids, err := r.client.SMembers(ctx, schemaMigrationsKey).Result()
+	if err != nil {
+		return nil, err
+	}
+	applied := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		applied[id] = true
+	}
+	return applied, nil
+}
+
+// ApplySchemaMigrations runs the pending migrations in order, up to and
+// including to, or all of them when to is empty, recording each once it
+// completes. Migrations needing a module missing from modules are skipped
+// and stay pending. It returns the IDs applied. Callers must hold the
+// maintenance lock.
+func (r *RedisClient) ApplySchemaMigrations(ctx context.Context, to string, modules map[string]bool) ([]string, error) {
+	last := len(schemaMigrations) - 1
+	if to != "" {
+		last = -1
+		for i, m := range schemaMigrations {
+			if m.ID == to {
+				last = i
+			}
+		}
+		if last < 0 {
+			return nil, fmt.Errorf("unknown schema migration %q", to)
+		}
+	}
+	applied, err := r.appliedMigrations(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var ran []string
+	for _, m := range schemaMigrations[:last+1] {
+		if applied[m.ID] {
+			continue
+		}
+		if m.Requires != "" && !modules[m.Requires] {
+			log.Printf("Skipping schema migration %s: needs the %s module", m.ID, m.Requires)
+			continue
+		}
+		log.Printf("Running schema migration %s: %s", m.ID, m.Description)
+		changed, err := m.Run(ctx, r)
+		if err != nil {
+			return ran, fmt.Errorf("schema migration %s: %w", m.ID, err)
+		}
+		if err := r.client.SAdd(ctx, schemaMigrationsKey, m.ID).Err(); err != nil {
+			return ran, err
+		}
+		log.Printf("Schema migration %s done: %d keys changed", m.ID, changed)
+		ran = append(ran, m.ID)
+	}
+	return ran, nil
+}
+
+// migrateSchema applies the pending schema migrations at startup under the
+// maintenance lock. A replica that finds the lock held leaves them to the
+// next start or to migrate --to; reads of the old layouts still work.
+func (s *Server) migrateSchema(ctx context.Context, modules map[string]bool) {
+	release, ok, err := s.redis.AcquireMaintenanceLock(ctx, migrateLockTTL)
+	if err != nil {
+		log.Printf("Failed to take the maintenance lock for schema migrations: %v", err)
+		return
+	}
+	if !ok {
+		log.Println("Maintenance is running elsewhere, not applying schema migrations")
+		return
+	}
+	defer release()
+	ran, err := s.redis.ApplySchemaMigrations(ctx, "", modules)
+	if err != nil {
+		log.Printf("Schema migrations stopped, they resume on the next start: %v", err)
+	}
+	if len(ran) > 0 {
+		s.invalidateAggregates(ctx)
+	}
+}
+
+// isSchemaCommand reports whether migrate subcommand arguments use the
+// schema flags rather than the key migration ones
+func isSchemaCommand(args []string) bool {
+	for _, arg := range args {
+		name, _, _ := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		if strings.HasPrefix(arg, "-") && (name == "status" || name == "to") {
+			return true
+		}
+	}
+	return false
+}
+
+// runSchemaCommand is migrate --status, listing the schema migrations, and
+// migrate --to <id>, applying them up to id
+func runSchemaCommand(cfg Config, args []string, output io.Writer) error {
+	fs := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	fs.SetOutput(output)
+	status := fs.Bool("status", false, "list the schema migrations and whether each has run")
+	to := fs.String("to", "", "apply the schema migrations up to and including this ID")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return fmt.Errorf("unexpected arguments: %s", strings.Join(fs.Args(), " "))
+	}
+	if *status == (*to != "") {
+		return errors.New("use one of --status or --to")
+	}
+	redisClient := NewRedisClientFromConfig(cfg)
+	defer redisClient.client.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if *status {
+		migrations, err := redisClient.SchemaStatus(ctx)
+		if err != nil {
+			return err
+		}
+		for _, m := range migrations {
+			state := "pending"
+			if m.Applied {
+				state = "applied"
+			}
+			fmt.Fprintf(output, "%-8s %s  %s\n", state, m.ID, m.Description)
+		}
+		return nil
+	}
+
+	release, ok, err := redisClient.AcquireMaintenanceLock(ctx, migrateLockTTL)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errors.New("maintenance is already running; try again later")
+	}
+	defer release()
+	// Servers without MODULE support get the migrations that need none
+	modules, _ := redisClient.Modules(ctx)
+	ran, err := redisClient.ApplySchemaMigrations(ctx, *to, modules)
+	for _, id := range ran {
+		fmt.Fprintf(output, "applied %s\n", id)
+	}
+	if err != nil {
+		return fmt.Errorf("%w (run again to resume)", err)
+	}
+	if len(ran) == 0 {
+		fmt.Fprintln(output, "nothing to apply")
+	}
+	return nil
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+// Fixtures of the historical layouts: counters alone, from before the
+// leaderboard and page name index, and metadata hashes from before the
+// private page index
+func seedCountersOnly(mr *miniredis.Miniredis) {
+	mr.Set("visits:home", "12")
+	mr.Set("visits:blog", "3")
+	mr.Set("visits:home:daily:2024-03-01", "12")
+}
+
+func seedHashMetadata(mr *miniredis.Miniredis) {
+	mr.HSet(metaKey("blog"), "title", "Blog", "visibility", visibilityPrivate)
+	mr.HSet(metaKey("home"), "title", "Home", "visibility", visibilityPublic)
+}
+
+func seedUnindexedGoals(mr *miniredis.Miniredis) {
+	mr.HSet(goalKey("signup"), "source_page", "pricing", "target_page", "welcome", "window", "3600")
+	mr.SAdd("goals:by-source:pricing", "signup")
+	mr.SAdd("goals:by-target:welcome", "signup")
+}
+
+func TestSchemaMigrationsUpgradeLayouts(t *testing.T) {
+	mr, redisClient := newTestRedis(t)
+	seedCountersOnly(mr)
+	seedHashMetadata(mr)
+	seedUnindexedGoals(mr)
+	ctx := context.Background()
+
+	ran, err := redisClient.ApplySchemaMigrations(ctx, "", nil)
+	if err != nil {
+		t.Fatalf("Migrations failed: %v", err)
+	}
+	if want := []string{"0001-page-indexes", "0002-private-index", "0004-goal-index"}; !reflect.DeepEqual(ran, want) {
+		t.Errorf("Expected %v applied without RedisJSON, got %v", want, ran)
+	}
+	if members, _ := mr.ZMembers(leaderboardKey); !reflect.DeepEqual(members, []string{"blog", "home"}) {
+		t.Errorf("Expected both pages on the leaderboard, got %v", members)
+	}
+	if score, _ := mr.ZScore(leaderboardKey, "home"); score != 12 {
+		t.Errorf("Expected home's counter as its score, got %v", score)
+	}
+	if members, _ := mr.ZMembers(pageNamesKey); len(members) != 2 {
+		t.Errorf("Expected both pages in the name index, got %v", members)
+	}
+	if members, _ := mr.Members(privatePagesKey); !reflect.DeepEqual(members, []string{"blog"}) {
+		t.Errorf("Expected blog indexed private, got %v", members)
+	}
+	if members, _ := mr.Members(goalsKey); !reflect.DeepEqual(members, []string{"signup"}) {
+		t.Errorf("Expected the goal indexed by name, got %v", members)
+	}
+
+	// Recorded migrations never run again, even on data they would change
+	mr.Set("visits:about", "1")
+	if ran, err := redisClient.ApplySchemaMigrations(ctx, "", nil); err != nil || len(ran) != 0 {
+		t.Errorf("Expected nothing left to apply, got %v, %v", ran, err)
+	}
+	if members, _ := mr.ZMembers(leaderboardKey); len(members) != 2 {
+		t.Errorf("Expected the applied migration not to run again, got %v", members)
+	}
+
+	status, err := redisClient.SchemaStatus(ctx)
+	if err != nil || len(status) != len(schemaMigrations) || !status[0].Applied || !status[1].Applied || status[2].Applied {
+		t.Errorf("Expected the metadata documents migration pending, got %+v, %v", status, err)
+	}
+}
+
+func TestSchemaMigrationsIdempotent(t *testing.T) {
+	// The current layout, already indexed, is left as it is
+	mr, redisClient := newTestRedis(t)
+	seedCountersOnly(mr)
+	mr.ZAdd(leaderboardKey, 20, "home")
+	seedHashMetadata(mr)
+	mr.SAdd(privatePagesKey, "blog")
+	ctx := context.Background()
+
+	if _, err := redisClient.ApplySchemaMigrations(ctx, "0001-page-indexes", nil); err != nil {
+		t.Fatalf("Migrations failed: %v", err)
+	}
+	if score, _ := mr.ZScore(leaderboardKey, "home"); score != 20 {
+		t.Errorf("Expected an existing score kept, got %v", score)
+	}
+	status, _ := redisClient.SchemaStatus(ctx)
+	if !status[0].Applied || status[1].Applied {
+		t.Errorf("Expected only the first migration applied, got %+v", status)
+	}
+	// An interrupted migration starts over
+	mr.SRem(schemaMigrationsKey, "0001-page-indexes")
+	if ran, err := redisClient.ApplySchemaMigrations(ctx, "", nil); err != nil || len(ran) != 3 {
+		t.Errorf("Expected the chain rerun, got %v, %v", ran, err)
+	}
+	if members, _ := mr.Members(privatePagesKey); !reflect.DeepEqual(members, []string{"blog"}) {
+		t.Errorf("Expected the private index unchanged, got %v", members)
+	}
+
+	if _, err := redisClient.ApplySchemaMigrations(ctx, "9999-future", nil); err == nil {
+		t.Error("Expected an unknown migration rejected")
+	}
+}
+
+func TestSchemaMigrationsOnStart(t *testing.T) {
+	mr, redisClient := newTestRedis(t)
+	seedCountersOnly(mr)
+	cfg := testConfig()
+	cfg.MigrateOnStart = true
+	router := newTestServer(t, cfg, redisClient).Router()
+
+	if w := doRequest(router, "GET", "/pages/top", "", nil); !strings.Contains(w.Body.String(), `"page":"home"`) {
+		t.Errorf("Expected the old counters in the top pages, got %s", w.Body.String())
+	}
+	if ok, _ := mr.SIsMember(schemaMigrationsKey, "0002-private-index"); !ok {
+		t.Error("Expected the migrations recorded")
+	}
+}
+
+func TestSchemaCommand(t *testing.T) {
+	mr, _ := newTestRedis(t)
+	seedCountersOnly(mr)
+	cfg := testConfig()
+	cfg.RedisHost, cfg.RedisPort, _ = net.SplitHostPort(mr.Addr())
+
+	var out bytes.Buffer
+	if err := runMigrateCommand(cfg, []string{"--to", "0001-page-indexes"}, &out); err != nil {
+		t.Fatalf("migrate --to failed: %v", err)
+	}
+	if out.String() != "applied 0001-page-indexes\n" {
+		t.Errorf("Unexpected output %q", out.String())
+	}
+	out.Reset()
+	if err := runMigrateCommand(cfg, []string{"--status"}, &out); err != nil {
+		t.Fatalf("migrate --status failed: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != len(schemaMigrations) || !strings.HasPrefix(lines[0], "applied  0001-page-indexes") || !strings.HasPrefix(lines[1], "pending  0002-private-index") {
+		t.Errorf("Unexpected status %q", out.String())
+	}
+
+	for _, args := range [][]string{{"--status", "--to", "0001-page-indexes"}, {"--status", "--target-db", "1"}, {"--status", "extra"}} {
+		if err := runMigrateCommand(cfg, args, &out); err == nil {
+			t.Errorf("Expected %v rejected", args)
+		}
+	}
+}
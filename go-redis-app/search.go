@@ -0,0 +1,338 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// pageNamesKey indexes page names (all scored 0) for lexicographic search
+	pageNamesKey = "visits:pages:names"
+
+	// searchIndex is the RediSearch index over searchDocPrefix hashes
+	searchIndex     = "visits:pages:idx"
+	searchDocPrefix = "visits:search:"
+
+	// searchScanCount is the batch size of the name index and RediSearch
+	// reads
+	searchScanCount = 500
+
+	// maxSearchOffset caps how far into the matches a search can page, as
+	// every match before the offset is read
+	maxSearchOffset = 10000
+)
+
+// SearchResponse represents a page of search matches
+type SearchResponse struct {
+	Query      string      `json:"query"`
+	Match      string      `json:"match"`
+	Pages      []PageCount `json:"pages"`
+	NextOffset int64       `json:"next_offset,omitempty"`
+}
+
+// EnableSearch creates the RediSearch page index when the module is loaded,
+// reporting whether fuzzy search is in use
+func (r *RedisClient) EnableSearch(ctx context.Context, modules map[string]bool) (bool, error) {
+	if !modules["search"] {
+		return false, nil
+	}
+	if r.readOnly {
+		// Search only if a writable instance created the index
+		if err := r.client.Do(ctx, "FT.INFO", searchIndex).Err(); err != nil {
+			if strings.Contains(strings.ToLower(err.Error()), "unknown index") {
+				return false, nil
+			}
+			return false, fmt.Errorf("checking search index: %w", err)
+		}
+		r.search = true
+		return true, nil
+	}
+	err := r.client.Do(ctx, "FT.CREATE", searchIndex, "ON", "HASH",
+		"PREFIX", 1, searchDocPrefix, "SCHEMA", "name", "TEXT").Err()
+	if err != nil && !strings.Contains(strings.ToLower(err.Error()), "index already exists") {
+		return false, fmt.Errorf("creating search index: %w", err)
+	}
+	r.search = true
+	return true, nil
+}
+
+// queueIndexPage adds the page to the search indexes in the pipeline,
+// returning the name index ZADD, which yields 1 when the name is new
+func (r *RedisClient) queueIndexPage(ctx context.Context, pipe redis.Pipeliner, page string) *redis.IntCmd {
+	added := pipe.ZAddNX(ctx, pageNamesKey, redis.Z{Member: page})
+	if r.search {
+		pipe.HSetNX(ctx, searchDocPrefix+page, "name", page)
+	}
+	return added
+}
+
+// escapeGlob escapes the characters SCAN MATCH treats as pattern syntax
+func escapeGlob(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch r {
+		case '*', '?', '[', ']', '\\':
+			b.WriteRune('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// escapeSearchQuery escapes RediSearch query syntax so the query is a
+// single fuzzy term
+func escapeSearchQuery(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if !(r == '_' || r >= '0' && r <= '9' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r > 127) {
+			b.WriteRune('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// searchWindow collects one page of search matches: the visible matches
+// after skipping offset of them, each once. Hidden pages are dropped before
+// counting, so every page of results is full while more matches exist.
+type searchWindow struct {
+	hidden  map[string]bool
+	offset  int64
+	limit   int64
+	seen    map[string]bool
+	matches []string
+}
+
+// newSearchWindow returns a window of up to limit matches after offset
+func newSearchWindow(hidden map[string]bool, offset, limit int64) *searchWindow {
+	return &searchWindow{hidden: hidden, offset: offset, limit: limit, seen: make(map[string]bool)}
+}
+
+// add adds a match, reporting whether the window is full
+func (w *searchWindow) add(page string) bool {
+	if w.hidden[page] || w.seen[page] {
+		return false
+	}
+	w.seen[page] = true
+	if int64(len(w.seen)) > w.offset {
+		w.matches = append(w.matches, page)
+	}
+	return int64(len(w.matches)) >= w.limit
+}
+
+// SearchPrefix returns up to limit visible page names starting with prefix,
+// after skipping offset of them. The name index is read in batches, each
+// starting after the last name of the one before.
+func (r *RedisClient) SearchPrefix(ctx context.Context, prefix string, hidden map[string]bool, offset, limit int64) ([]string, error) {
+	w := newSearchWindow(hidden, offset, limit)
+	from := "[" + prefix
+	for {
+		names, err := r.client.ZRangeByLex(ctx, pageNamesKey, &redis.ZRangeBy{
+			Min:   from,
+			Max:   "[" + prefix + "\xff",
+			Count: searchScanCount,
+		}).Result()
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range names {
+			if w.add(name) {
+				return w.matches, nil
+			}
+		}
+		if len(names) < searchScanCount {
+			return w.matches, nil
+		}
+		from = "(" + names[len(names)-1]
+	}
+}
+
+// SearchSubstring scans the name index for visible pages containing query,
+// returning up to limit matches after skipping offset. ZSCAN may return a
+// member more than once, so matches are deduplicated.
+func (r *RedisClient) SearchSubstring(ctx context.Context, query string, hidden map[string]bool, offset, limit int64) ([]string, error) {
+	pattern := "*" + escapeGlob(query) + "*"
+	w := newSearchWindow(hidden, offset, limit)
+	var cursor uint64
+	for {
+		entries, next, err := r.client.ZScan(ctx, pageNamesKey, cursor, pattern, searchScanCount).Result()
+		if err != nil {
+			return nil, err
+		}
+		// ZSCAN returns member/score pairs
+		for i := 0; i < len(entries); i += 2 {
+			if w.add(entries[i]) {
+				return w.matches, nil
+			}
+		}
+		if cursor = next; cursor == 0 {
+			return w.matches, nil
+		}
+	}
+}
+
+// SearchFuzzy queries the RediSearch index, allowing one edit per term, for
+// up to limit visible pages after skipping offset. Results are fetched in
+// batches until the page is full or the matches run out.
+func (r *RedisClient) SearchFuzzy(ctx context.Context, query string, hidden map[string]bool, offset, limit int64) ([]string, error) {
+	term := escapeSearchQuery(query)
+	expr := fmt.Sprintf("%s* | %%%s%%", term, term)
+	w := newSearchWindow(hidden, offset, limit)
+	for from := int64(0); ; from += searchScanCount {
+		reply, err := r.client.Do(ctx, "FT.SEARCH", searchIndex, expr,
+			"NOCONTENT", "LIMIT", from, searchScanCount).Result()
+		if err != nil {
+			return nil, err
+		}
+		ids := parseSearchIDs(reply)
+		for _, id := range ids {
+			if w.add(strings.TrimPrefix(id, searchDocPrefix)) {
+				return w.matches, nil
+			}
+		}
+		if len(ids) < searchScanCount {
+			return w.matches, nil
+		}
+	}
+}
+
+// parseSearchIDs extracts document IDs from an FT.SEARCH NOCONTENT reply,
+// which is [total, id...] in RESP2 or a map with a results array in RESP3
+func parseSearchIDs(reply interface{}) []string {
+	var ids []string
+	switch r := reply.(type) {
+	case []interface{}:
+		for _, v := range r[min(1, len(r)):] {
+			if id, ok := v.(string); ok {
+				ids = append(ids, id)
+			}
+		}
+	case map[interface{}]interface{}:
+		results, _ := r["results"].([]interface{})
+		for _, v := range results {
+			if doc, ok := v.(map[interface{}]interface{}); ok {
+				if id, ok := doc["id"].(string); ok {
+					ids = append(ids, id)
+				}
+			}
+		}
+	}
+	return ids
+}
+
+// searchCounts returns the visit counts for the matched pages
+func (s *Server) searchCounts(ctx context.Context, pages []string) ([]PageCount, error) {
+	type pending struct {
+		page        string
+		approximate bool
+		cmd         *redis.Cmd
+	}
+	pipe := s.redis.client.Pipeline()
+	var queued []pending
+	for _, page := range pages {
+		p := pending{page: page, approximate: s.isApproximatePage(page)}
+		if p.approximate {
+			p.cmd = pipe.Do(ctx, "CMS.QUERY", cmsKey, page)
+		} else {
+			p.cmd = pipe.Do(ctx, "GET", key("visits", page))
+		}
+		queued = append(queued, p)
+	}
+
+	counts := make([]PageCount, 0, len(queued))
+	if len(queued) == 0 {
+		return counts, nil
+	}
+	if _, err := pipe.Exec(ctx); ignoreMissing(err) != nil {
+		return nil, err
+	}
+	for _, p := range queued {
+		var visits int64
+		var err error
+		if p.approximate {
+			visits, err = firstInt64(p.cmd)
+		} else {
+			visits, err = p.cmd.Int64()
+		}
+		if ignoreMissing(err) != nil {
+			return nil, err
+		}
+		counts = append(counts, PageCount{Page: p.page, Visits: visits})
+	}
+	return counts, nil
+}
+
+// handleSearchPages finds pages by name prefix (default), substring, or, when
+// RediSearch is available, fuzzy match
+func (s *Server) handleSearchPages(c *gin.Context) {
+	query := c.Query("q")
+	if query == "" || len(query) > 100 {
+		respondError(c, http.StatusBadRequest, "invalid_request", "q must be 1-100 characters")
+		return
+	}
+	limit, okLimit := queryInt(c, "limit", 20, 1, 100)
+	offset, okOffset := queryInt(c, "offset", 0, 0, maxSearchOffset)
+	if !okLimit || !okOffset {
+		respondError(c, http.StatusBadRequest, "invalid_request", "limit must be 1-100 and offset 0-10000")
+		return
+	}
+
+	match := c.Query("match")
+	if match == "" {
+		match = "prefix"
+		if s.redis.search {
+			match = "fuzzy"
+		}
+	}
+
+	var search func(context.Context, string, map[string]bool, int64, int64) ([]string, error)
+	switch match {
+	case "prefix":
+		search = s.redis.SearchPrefix
+	case "substring":
+		search = s.redis.SearchSubstring
+	case "fuzzy":
+		if !s.redis.search {
+			respondError(c, http.StatusBadRequest, "invalid_request", "Fuzzy search requires RediSearch")
+			return
+		}
+		search = s.redis.SearchFuzzy
+	default:
+		respondError(c, http.StatusBadRequest, "invalid_request", `match must be "prefix", "substring", or "fuzzy"`)
+		return
+	}
+
+	hidden, err := s.hiddenPages(c)
+	if err != nil {
+		log.Printf("Error loading private pages: %v", err)
+		respondStoreError(c, err, "Failed to search pages")
+		return
+	}
+	ctx := c.Request.Context()
+	// Fetch one extra visible match to know whether there is a next page
+	pages, err := search(ctx, query, hidden, offset, limit+1)
+	if err != nil {
+		log.Printf("Error searching pages: %v", err)
+		respondStoreError(c, err, "Failed to search pages")
+		return
+	}
+
+	response := SearchResponse{Query: query, Match: match}
+	if int64(len(pages)) > limit {
+		pages = pages[:limit]
+		response.NextOffset = offset + limit
+	}
+	if response.Pages, err = s.searchCounts(ctx, pages); err != nil {
+		log.Printf("Error getting search counts: %v", err)
+		respondStoreError(c, err, "Failed to search pages")
+		return
+	}
+
+	respondJSON(c, http.StatusOK, response)
+}
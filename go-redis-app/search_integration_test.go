@@ -0,0 +1,36 @@
+//go:build integration
+
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestFuzzySearchWithRediSearch(t *testing.T) {
+	redisClient := newRedisStackClient(t)
+	t.Cleanup(func() {
+		ctx := context.Background()
+		redisClient.client.Del(ctx, "visits:fuzzy-pricing", searchDocPrefix+"fuzzy-pricing")
+		redisClient.client.ZRem(ctx, pageNamesKey, "fuzzy-pricing")
+		redisClient.client.ZRem(ctx, leaderboardKey, "fuzzy-pricing")
+	})
+	router := newTestServer(t, testConfig(), redisClient).Router()
+	if !redisClient.search {
+		t.Fatal("Expected RediSearch to be detected")
+	}
+
+	doRequest(router, "GET", "/visit/fuzzy-pricing", "", nil)
+
+	resp := searchPages(t, router, "q=pricng")
+	if resp.Match != "fuzzy" {
+		t.Errorf("Expected fuzzy match by default, got %q", resp.Match)
+	}
+	found := false
+	for _, p := range resp.Pages {
+		found = found || p.Page == "fuzzy-pricing" && p.Visits >= 1
+	}
+	if !found {
+		t.Errorf("Expected fuzzy-pricing in %v", pageNames(resp.Pages))
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func searchPages(t *testing.T, h http.Handler, query string) SearchResponse {
+	t.Helper()
+	w := doRequest(h, "GET", "/pages/search?"+query, "", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200 for %q, got %d: %s", query, w.Code, w.Body.String())
+	}
+	var resp SearchResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("Failed to decode search response: %v", err)
+	}
+	return resp
+}
+
+func TestSearchPages(t *testing.T) {
+	_, redisClient := newTestRedis(t)
+	router := newTestServer(t, testConfig(), redisClient).Router()
+
+	for _, page := range []string{"blog", "blog-go", "blog-go", "blog-redis", "my-blog", "about", "a*b", "a[1]", "axb"} {
+		doRequest(router, "GET", "/visit/"+url.PathEscape(page), "", nil)
+	}
+
+	t.Run("prefix", func(t *testing.T) {
+		resp := searchPages(t, router, "q=blog")
+		if got := pageNames(resp.Pages); len(got) != 3 || got[0] != "blog" || got[1] != "blog-go" || got[2] != "blog-redis" {
+			t.Errorf("Unexpected prefix matches: %v", got)
+		}
+		if resp.Match != "prefix" || resp.Pages[1].Visits != 2 {
+			t.Errorf("Expected prefix match with counts, got %+v", resp)
+		}
+	})
+
+	t.Run("substring", func(t *testing.T) {
+		resp := searchPages(t, router, "q=blog&match=substring")
+		if len(resp.Pages) != 4 {
+			t.Errorf("Expected 4 substring matches, got %v", pageNames(resp.Pages))
+		}
+	})
+
+	t.Run("pagination", func(t *testing.T) {
+		first := searchPages(t, router, "q=blog&limit=2")
+		if len(first.Pages) != 2 || first.NextOffset != 2 {
+			t.Fatalf("Expected first page of 2 with next_offset 2, got %+v", first)
+		}
+		second := searchPages(t, router, "q=blog&limit=2&offset=2")
+		if got := pageNames(second.Pages); len(got) != 1 || got[0] != "blog-redis" || second.NextOffset != 0 {
+			t.Errorf("Unexpected second page: %+v", second)
+		}
+	})
+
+	t.Run("special characters", func(t *testing.T) {
+		resp := searchPages(t, router, "q="+url.QueryEscape("*")+"&match=substring")
+		if got := pageNames(resp.Pages); len(got) != 1 || got[0] != "a*b" {
+			t.Errorf("Expected only the literal match for *, got %v", got)
+		}
+		resp = searchPages(t, router, "q="+url.QueryEscape("[1]")+"&match=substring")
+		if got := pageNames(resp.Pages); len(got) != 1 || got[0] != "a[1]" {
+			t.Errorf("Expected only the literal match for [1], got %v", got)
+		}
+		resp = searchPages(t, router, "q="+url.QueryEscape("a?b")+"&match=substring")
+		if len(resp.Pages) != 0 {
+			t.Errorf("Expected ? to match literally, got %v", pageNames(resp.Pages))
+		}
+	})
+
+	t.Run("validation", func(t *testing.T) {
+		for _, query := range []string{"", "q=blog&match=regex", "q=blog&match=fuzzy", "q=blog&limit=0"} {
+			if w := doRequest(router, "GET", "/pages/search?"+query, "", nil); w.Code != http.StatusBadRequest {
+				t.Errorf("Expected 400 for %q, got %d", query, w.Code)
+			}
+		}
+	})
+}
+
+func TestSearchSkipsPrivatePages(t *testing.T) {
+	mr, redisClient := newTestRedis(t)
+	router := newTestServer(t, testConfig(), redisClient).Router()
+	// More names than one batch of the name index, with every other one of
+	// the first ten private
+	for i := 0; i < 600; i++ {
+		page := fmt.Sprintf("doc-%03d", i)
+		mr.ZAdd(pageNamesKey, 0, page)
+		if i < 10 && i%2 == 0 {
+			mr.SAdd(privatePagesKey, page)
+		}
+	}
+
+	for _, match := range []string{"prefix", "substring"} {
+		t.Run(match, func(t *testing.T) {
+			first := searchPages(t, router, "q=doc&limit=3&match="+match)
+			second := searchPages(t, router, "q=doc&limit=3&offset=3&match="+match)
+			if match == "prefix" {
+				if got := pageNames(first.Pages); !reflect.DeepEqual(got, []string{"doc-001", "doc-003", "doc-005"}) || first.NextOffset != 3 {
+					t.Errorf("Expected a full first page of public pages, got %v next %d", got, first.NextOffset)
+				}
+				if got := pageNames(second.Pages); !reflect.DeepEqual(got, []string{"doc-007", "doc-009", "doc-010"}) {
+					t.Errorf("Expected the next public pages, got %v", got)
+				}
+			}
+			if len(first.Pages) != 3 || len(second.Pages) != 3 {
+				t.Errorf("Expected full pages, got %v and %v", pageNames(first.Pages), pageNames(second.Pages))
+			}
+
+			// 595 public pages, past the first batch
+			last := searchPages(t, router, "q=doc&limit=20&offset=590&match="+match)
+			if len(last.Pages) != 5 || last.NextOffset != 0 {
+				t.Errorf("Expected the last 5 public pages without a next page, got %d next %d", len(last.Pages), last.NextOffset)
+			}
+			for _, p := range append(append(first.Pages, second.Pages...), last.Pages...) {
+				if private, _ := mr.IsMember(privatePagesKey, p.Page); private {
+					t.Errorf("Expected private page %s to be hidden", p.Page)
+				}
+			}
+		})
+	}
+
+	if w := doRequest(router, "GET", fmt.Sprintf("/pages/search?q=doc&offset=%d", maxSearchOffset+1), "", nil); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an offset past the cap, got %d", w.Code)
+	}
+}
+
+func TestSearchWindow(t *testing.T) {
+	w := newSearchWindow(map[string]bool{"b": true}, 1, 2)
+	// A repeated member, as ZSCAN may return, is counted once
+	for _, page := range []string{"a", "a", "b", "c", "c", "d", "e"} {
+		if w.add(page) {
+			break
+		}
+	}
+	if !reflect.DeepEqual(w.matches, []string{"c", "d"}) {
+		t.Errorf("Expected c and d after skipping a, got %v", w.matches)
+	}
+}
+
+func TestEscapeGlob(t *testing.T) {
+	tests := map[string]string{
+		"blog":   "blog",
+		"a*b":    `a\*b`,
+		"[x]?":   `\[x\]\?`,
+		`back\s`: `back\\s`,
+	}
+	for in, want := range tests {
+		if got := escapeGlob(in); got != want {
+			t.Errorf("escapeGlob(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestParseSearchIDs(t *testing.T) {
+	resp2 := []interface{}{int64(2), "visits:search:blog", "visits:search:blob"}
+	resp3 := map[interface{}]interface{}{
+		"total_results": int64(1),
+		"results":       []interface{}{map[interface{}]interface{}{"id": "visits:search:blog"}},
+	}
+	if got := parseSearchIDs(resp2); len(got) != 2 || got[1] != "visits:search:blob" {
+		t.Errorf("Unexpected RESP2 IDs: %v", got)
+	}
+	if got := parseSearchIDs(resp3); len(got) != 1 || got[0] != "visits:search:blog" {
+		t.Errorf("Unexpected RESP3 IDs: %v", got)
+	}
+}
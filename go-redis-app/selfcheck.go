@@ -0,0 +1,344 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Self-check names, as used in SELFCHECK_SOFT
+const (
+	checkRedis      = "redis"
+	checkRedisWrite = "redis_write"
+	checkModules    = "modules"
+	checkListen     = "listen"
+	checkTLS        = "tls"
+)
+
+// selfCheckNames lists every self-check in the order they run
+var selfCheckNames = []string{checkRedis, checkRedisWrite, checkModules, checkListen, checkTLS}
+
+// defaultSoftChecks are the checks whose failures only warn unless
+// SELFCHECK_SOFT says otherwise: missing modules degrade features, they
+// don't stop the service
+var defaultSoftChecks = []string{checkModules}
+
+// parseSelfCheckSoft parses the comma-separated SELFCHECK_SOFT list. Empty
+// means the defaults; "none" makes every check hard.
+func parseSelfCheckSoft(value string) ([]string, error) {
+	value = strings.TrimSpace(value)
+	switch value {
+	case "":
+		return defaultSoftChecks, nil
+	case "none":
+		return nil, nil
+	}
+	var names []string
+	for _, name := range strings.Split(value, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		known := false
+		for _, check := range selfCheckNames {
+			known = known || name == check
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown check %q, expected one of %s", name, strings.Join(selfCheckNames, ", "))
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// selfCheckTimeout bounds each Redis round trip of the self-check
+const selfCheckTimeout = 2 * time.Second
+
+// Self-check statuses
+const (
+	checkPass = "PASS"
+	checkWarn = "WARN" // a soft check failed
+	checkFail = "FAIL"
+	checkSkip = "SKIP" // not applicable, or blocked by an earlier failure
+)
+
+// CheckResult is the outcome of one startup self-check
+type CheckResult struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Detail string `json:"detail"`
+	Hint   string `json:"hint,omitempty"`
+}
+
+// SelfCheckReport is the outcome of a self-check run. Passed is false when a
+// hard check failed.
+type SelfCheckReport struct {
+	Passed    bool          `json:"passed"`
+	Checks    []CheckResult `json:"checks"`
+	CheckedAt Timestamp     `json:"checked_at"`
+}
+
+// SelfCheck validates the environment the server is about to run in: Redis
+// reachability and write access, the modules enabled features need, the
+// listen ports and the TLS files. The report is kept for /debug/selfcheck.
+func (s *Server) SelfCheck(ctx context.Context) SelfCheckReport {
+	report := SelfCheckReport{Passed: true, CheckedAt: Timestamp{Time: s.clock.Now(), Format: s.cfg.TimestampFormat}}
+	soft := make(map[string]bool, len(s.cfg.SelfCheckSoft))
+	for _, name := range s.cfg.SelfCheckSoft {
+		soft[name] = true
+	}
+	add := func(result CheckResult) {
+		if result.Status == checkFail && soft[result.Name] {
+			result.Status = checkWarn
+		}
+		if result.Status == checkFail {
+			report.Passed = false
+		}
+		report.Checks = append(report.Checks, result)
+	}
+
+	reachable := s.checkRedis(ctx)
+	add(reachable)
+	if reachable.Status == checkPass {
+		if s.cfg.ReadOnly {
+			add(CheckResult{Name: checkRedisWrite, Status: checkSkip, Detail: "READ_ONLY is set"})
+		} else {
+			add(s.checkRedisWrite(ctx))
+		}
+		add(s.checkModules(ctx))
+	} else {
+		add(CheckResult{Name: checkRedisWrite, Status: checkSkip, Detail: "Redis is unreachable"})
+		add(CheckResult{Name: checkModules, Status: checkSkip, Detail: "Redis is unreachable"})
+	}
+	add(checkListenAddrs(s.cfg))
+	add(checkTLSFiles(s.cfg))
+
+	s.selfCheck.Store(&report)
+	return report
+}
+
+// checkRedis pings Redis, reporting the round trip time
+func (s *Server) checkRedis(ctx context.Context) CheckResult {
+	ctx, cancel := context.WithTimeout(ctx, selfCheckTimeout)
+	defer cancel()
+
+	addr := net.JoinHostPort(s.cfg.RedisHost, s.cfg.RedisPort)
+	start := s.clock.Now()
+	if err := s.redis.Ping(ctx); err != nil {
+		return CheckResult{
+			Name:   checkRedis,
+			Status: checkFail,
+			Detail: fmt.Sprintf("%s: %v", addr, err),
+			Hint:   "Start Redis (./dev.sh start) or point REDIS_HOST/REDIS_PORT at a reachable server",
+		}
+	}
+	rtt := s.clock.Now().Sub(start)
+	return CheckResult{Name: checkRedis, Status: checkPass, Detail: fmt.Sprintf("%s DB %d, rtt %s", addr, s.cfg.RedisDB, rtt.Round(time.Microsecond))}
+}
+
+// checkRedisWrite sets and deletes a probe key with a short expiry, so a
+// failed DEL doesn't leave it behind
+func (s *Server) checkRedisWrite(ctx context.Context) CheckResult {
+	ctx, cancel := context.WithTimeout(ctx, selfCheckTimeout)
+	defer cancel()
+
+	id, err := newVisitorID()
+	if err != nil {
+		return CheckResult{Name: checkRedisWrite, Status: checkFail, Detail: err.Error()}
+	}
+	probe := key("selfcheck", "probe", id)
+	err = s.redis.client.Set(ctx, probe, "1", time.Minute).Err()
+	if err == nil {
+		err = s.redis.client.Del(ctx, probe).Err()
+	}
+	if err != nil {
+		return CheckResult{
+			Name:   checkRedisWrite,
+			Status: checkFail,
+			Detail: err.Error(),
+			Hint:   "Point REDIS_HOST at the primary rather than a replica, and grant the user SET and DEL",
+		}
+	}
+	return CheckResult{Name: checkRedisWrite, Status: checkPass, Detail: "SET/DEL " + probe}
+}
+
+// checkModules verifies the modules required by enabled features are loaded.
+// Modules the service only uses opportunistically are listed but not required.
+func (s *Server) checkModules(ctx context.Context) CheckResult {
+	ctx, cancel := context.WithTimeout(ctx, selfCheckTimeout)
+	defer cancel()
+
+	required := map[string]string{}
+	if len(s.cfg.ApproximatePagePrefixes) > 0 {
+		required["bf"] = "APPROXIMATE_PAGE_PREFIXES needs RedisBloom"
+	}
+
+	modules, err := s.redis.Modules(ctx)
+	if err != nil {
+		if len(required) == 0 {
+			return CheckResult{Name: checkModules, Status: checkPass, Detail: "none required; module detection unavailable: " + err.Error()}
+		}
+		return CheckResult{
+			Name:   checkModules,
+			Status: checkFail,
+			Detail: "module detection unavailable: " + err.Error(),
+			Hint:   "Allow the MODULE command for this user, or unset the features that need modules",
+		}
+	}
+
+	var missing []string
+	for module, reason := range required {
+		if !modules[module] {
+			missing = append(missing, reason)
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return CheckResult{
+			Name:   checkModules,
+			Status: checkFail,
+			Detail: strings.Join(missing, "; "),
+			Hint:   "Run redis/redis-stack-server, or load the module with --loadmodule",
+		}
+	}
+
+	loaded := make([]string, 0, len(modules))
+	for module := range modules {
+		loaded = append(loaded, module)
+	}
+	sort.Strings(loaded)
+	if len(loaded) == 0 {
+		return CheckResult{Name: checkModules, Status: checkPass, Detail: "none loaded, none required"}
+	}
+	return CheckResult{Name: checkModules, Status: checkPass, Detail: "loaded: " + strings.Join(loaded, ", ")}
+}
+
+// selfCheckAddrs returns the addresses the server will listen on, the same
+// ones openListeners and main open. Sockets inherited from systemd are
+// already bound and are not checked.
+func selfCheckAddrs(cfg Config) []string {
+	addrs := cfg.Listen
+	if len(addrs) == 0 && os.Getenv("LISTEN_FDS") == "" {
+		addrs = []string{":" + cfg.Port}
+	}
+	if !cfg.SinglePort {
+		addrs = append(addrs[:len(addrs):len(addrs)], ":"+cfg.InternalPort)
+	}
+	return addrs
+}
+
+// checkListenAddrs binds and immediately releases each listen address
+func checkListenAddrs(cfg Config) CheckResult {
+	addrs := selfCheckAddrs(cfg)
+	var failed []string
+	for _, addr := range addrs {
+		if err := probeListenAddr(addr); err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", addr, err))
+		}
+	}
+	if len(failed) > 0 {
+		return CheckResult{
+			Name:   checkListen,
+			Status: checkFail,
+			Detail: strings.Join(failed, "; "),
+			Hint:   "Stop the process holding the port (lsof -i :<port>) or change PORT, INTERNAL_PORT or LISTEN",
+		}
+	}
+	return CheckResult{Name: checkListen, Status: checkPass, Detail: strings.Join(addrs, ", ")}
+}
+
+// probeListenAddr checks a single listen address can be bound. Unix sockets
+// only need an existing directory and no live server on the path.
+func probeListenAddr(addr string) error {
+	spec, err := parseListenAddr(addr)
+	if err != nil {
+		return err
+	}
+	if spec.Network == "unix" {
+		if _, err := os.Stat(filepath.Dir(spec.Address)); err != nil {
+			return err
+		}
+		if conn, err := net.Dial("unix", spec.Address); err == nil {
+			conn.Close()
+			return fmt.Errorf("%s is in use by another server", spec.Address)
+		}
+		return nil
+	}
+	l, err := net.Listen("tcp", spec.Address)
+	if err != nil {
+		return err
+	}
+	return l.Close()
+}
+
+// checkTLSFiles loads the certificate and key when a tls:// address is
+// configured
+func checkTLSFiles(cfg Config) CheckResult {
+	usesTLS := false
+	for _, addr := range cfg.Listen {
+		if spec, err := parseListenAddr(addr); err == nil && spec.TLS {
+			usesTLS = true
+		}
+	}
+	if !usesTLS {
+		return CheckResult{Name: checkTLS, Status: checkSkip, Detail: "no tls:// address in LISTEN"}
+	}
+
+	for _, file := range []struct{ env, path string }{{"TLS_CERT_FILE", cfg.TLSCertFile}, {"TLS_KEY_FILE", cfg.TLSKeyFile}} {
+		if _, err := os.ReadFile(file.path); err != nil {
+			return CheckResult{
+				Name:   checkTLS,
+				Status: checkFail,
+				Detail: fmt.Sprintf("%s: %v", file.env, err),
+				Hint:   "Set " + file.env + " to a file readable by the service user",
+			}
+		}
+	}
+	if _, err := tls.LoadX509KeyPair(cfg.TLSCertFile, cfg.TLSKeyFile); err != nil {
+		return CheckResult{
+			Name:   checkTLS,
+			Status: checkFail,
+			Detail: err.Error(),
+			Hint:   "TLS_CERT_FILE and TLS_KEY_FILE must be a matching PEM certificate and key",
+		}
+	}
+	return CheckResult{Name: checkTLS, Status: checkPass, Detail: cfg.TLSCertFile}
+}
+
+// writeSelfCheck prints the report as a table, with the remediation hint
+// under each check that did not pass
+func writeSelfCheck(w io.Writer, report SelfCheckReport) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "CHECK\tSTATUS\tDETAIL")
+	for _, check := range report.Checks {
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", check.Name, check.Status, check.Detail)
+		if check.Hint != "" {
+			fmt.Fprintf(tw, "\t\t-> %s\n", check.Hint)
+		}
+	}
+	return tw.Flush()
+}
+
+// handleSelfCheck returns the report of the startup self-check. It is not
+// rerun on demand: the listen check would fail on the server's own ports.
+func (s *Server) handleSelfCheck(c *gin.Context) {
+	report := s.selfCheck.Load()
+	if report == nil {
+		respondError(c, http.StatusNotFound, "not_found", "No self-check has run")
+		return
+	}
+	response := *report
+	response.CheckedAt = stamp(c, report.CheckedAt.Time)
+	respondJSON(c, http.StatusOK, response)
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// readOnlyRedis rejects writes the way a replica does, letting reads through
+type readOnlyRedis struct{}
+
+func (readOnlyRedis) DialHook(next redis.DialHook) redis.DialHook { return next }
+
+func (readOnlyRedis) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		if name := cmd.Name(); name == "set" || name == "del" {
+			return errors.New("READONLY You can't write against a read only replica.")
+		}
+		return next(ctx, cmd)
+	}
+}
+
+func (readOnlyRedis) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return next
+}
+
+// selfCheckConfig listens on ephemeral ports so the listen check passes
+func selfCheckConfig() Config {
+	cfg := testConfig()
+	cfg.Port = "0"
+	cfg.InternalPort = "0"
+	return cfg
+}
+
+// checkResult returns the named check of a report
+func checkResult(t *testing.T, report SelfCheckReport, name string) CheckResult {
+	t.Helper()
+	for _, check := range report.Checks {
+		if check.Name == name {
+			return check
+		}
+	}
+	t.Fatalf("No %s check in %+v", name, report.Checks)
+	return CheckResult{}
+}
+
+// writeTLSPair writes a self-signed certificate and its key to dir
+func writeTLSPair(t *testing.T, dir string) (certFile, keyFile string) {
+	t.Helper()
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{SerialNumber: big.NewInt(1), NotBefore: time.Now(), NotAfter: time.Now().Add(time.Hour)}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &priv.PublicKey, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600)
+	return certFile, keyFile
+}
+
+func TestParseSelfCheckSoft(t *testing.T) {
+	tests := map[string][]string{
+		"":                   defaultSoftChecks,
+		"none":               nil,
+		"redis":              {"redis"},
+		" modules , listen ": {"modules", "listen"},
+	}
+	for value, want := range tests {
+		if got, err := parseSelfCheckSoft(value); err != nil || !reflect.DeepEqual(got, want) {
+			t.Errorf("parseSelfCheckSoft(%q) = %v, %v, want %v", value, got, err, want)
+		}
+	}
+	if _, err := parseSelfCheckSoft("redis,disk"); err == nil {
+		t.Error("Expected an error for an unknown check")
+	}
+}
+
+func TestSelfCheckPasses(t *testing.T) {
+	mr, redisClient := newTestRedis(t)
+	cfg := selfCheckConfig()
+	cfg.Listen = []string{"tcp://127.0.0.1:0", "unix://" + filepath.Join(t.TempDir(), "visits.sock")}
+	report := NewServer(cfg, redisClient, systemClock{}, nil).SelfCheck(context.Background())
+	if !report.Passed {
+		t.Fatalf("Expected the self-check to pass, got %+v", report.Checks)
+	}
+	for _, name := range selfCheckNames {
+		if check := checkResult(t, report, name); check.Status == checkFail || check.Hint != "" {
+			t.Errorf("Expected %s to pass, got %+v", name, check)
+		}
+	}
+	if status := checkResult(t, report, checkTLS).Status; status != checkSkip {
+		t.Errorf("Expected the TLS check skipped without a tls:// address, got %s", status)
+	}
+	if keys := mr.Keys(); len(keys) != 0 {
+		t.Errorf("Expected the write probe removed, got %v", keys)
+	}
+}
+
+func TestSelfCheckFailures(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeTLSPair(t, dir)
+	garbage := filepath.Join(dir, "garbage.pem")
+	os.WriteFile(garbage, []byte("not a certificate"), 0o600)
+
+	occupied, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer occupied.Close()
+
+	tests := []struct {
+		name  string
+		check string
+		setup func(t *testing.T, cfg *Config) *RedisClient
+	}{
+		{"redis unreachable", checkRedis, func(t *testing.T, cfg *Config) *RedisClient {
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			l.Close()
+			cfg.RedisHost, cfg.RedisPort, _ = net.SplitHostPort(l.Addr().String())
+			return NewRedisClientFromConfig(*cfg)
+		}},
+		{"redis read only", checkRedisWrite, func(t *testing.T, cfg *Config) *RedisClient {
+			_, redisClient := newTestRedis(t)
+			redisClient.client.AddHook(readOnlyRedis{})
+			return redisClient
+		}},
+		{"module missing", checkModules, func(t *testing.T, cfg *Config) *RedisClient {
+			// miniredis has no modules, nor the MODULE command
+			cfg.ApproximatePagePrefixes = []string{"tag-"}
+			_, redisClient := newTestRedis(t)
+			return redisClient
+		}},
+		{"port in use", checkListen, func(t *testing.T, cfg *Config) *RedisClient {
+			cfg.Listen = []string{"tcp://" + occupied.Addr().String()}
+			_, redisClient := newTestRedis(t)
+			return redisClient
+		}},
+		{"tls file missing", checkTLS, func(t *testing.T, cfg *Config) *RedisClient {
+			cfg.Listen = []string{"tls://127.0.0.1:0"}
+			cfg.TLSCertFile, cfg.TLSKeyFile = filepath.Join(dir, "missing.pem"), keyFile
+			_, redisClient := newTestRedis(t)
+			return redisClient
+		}},
+		{"tls file invalid", checkTLS, func(t *testing.T, cfg *Config) *RedisClient {
+			cfg.Listen = []string{"tls://127.0.0.1:0"}
+			cfg.TLSCertFile, cfg.TLSKeyFile = certFile, garbage
+			_, redisClient := newTestRedis(t)
+			return redisClient
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := selfCheckConfig()
+			redisClient := tt.setup(t, &cfg)
+			report := NewServer(cfg, redisClient, systemClock{}, nil).SelfCheck(context.Background())
+			if report.Passed {
+				t.Errorf("Expected the self-check to fail, got %+v", report.Checks)
+			}
+			check := checkResult(t, report, tt.check)
+			if check.Status != checkFail || check.Detail == "" || check.Hint == "" {
+				t.Errorf("Expected %s to fail with a hint, got %+v", tt.check, check)
+			}
+			for _, other := range report.Checks {
+				if other.Name != tt.check && other.Status == checkFail {
+					t.Errorf("Expected only %s to fail, got %+v", tt.check, other)
+				}
+			}
+		})
+	}
+
+	cfg := selfCheckConfig()
+	cfg.Listen = []string{"tls://127.0.0.1:0"}
+	cfg.TLSCertFile, cfg.TLSKeyFile = certFile, keyFile
+	_, redisClient := newTestRedis(t)
+	if check := checkResult(t, NewServer(cfg, redisClient, systemClock{}, nil).SelfCheck(context.Background()), checkTLS); check.Status != checkPass {
+		t.Errorf("Expected a valid certificate to pass, got %+v", check)
+	}
+}
+
+func TestSelfCheckUnreachableSkipsRedisChecks(t *testing.T) {
+	cfg := selfCheckConfig()
+	cfg.RedisHost, cfg.RedisPort = "127.0.0.1", "1"
+	report := NewServer(cfg, NewRedisClientFromConfig(cfg), systemClock{}, nil).SelfCheck(context.Background())
+	for _, name := range []string{checkRedisWrite, checkModules} {
+		if status := checkResult(t, report, name).Status; status != checkSkip {
+			t.Errorf("Expected %s skipped while Redis is down, got %s", name, status)
+		}
+	}
+}
+
+func TestSelfCheckSoftFailures(t *testing.T) {
+	occupied, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer occupied.Close()
+
+	_, redisClient := newTestRedis(t)
+	cfg := selfCheckConfig()
+	cfg.Listen = []string{occupied.Addr().String()}
+	cfg.ApproximatePagePrefixes = []string{"tag-"}
+	cfg.SelfCheckSoft = []string{checkListen, checkModules}
+	report := NewServer(cfg, redisClient, systemClock{}, nil).SelfCheck(context.Background())
+	if !report.Passed {
+		t.Errorf("Expected soft failures not to fail the self-check, got %+v", report.Checks)
+	}
+	for _, name := range cfg.SelfCheckSoft {
+		if check := checkResult(t, report, name); check.Status != checkWarn || check.Hint == "" {
+			t.Errorf("Expected %s to warn, got %+v", name, check)
+		}
+	}
+}
+
+func TestWriteSelfCheck(t *testing.T) {
+	var buf bytes.Buffer
+	writeSelfCheck(&buf, SelfCheckReport{Checks: []CheckResult{
+		{Name: checkRedis, Status: checkPass, Detail: "localhost:6379 DB 0, rtt 120µs"},
+		{Name: checkListen, Status: checkFail, Detail: ":8080: address already in use", Hint: "Stop the other server"},
+	}})
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 4 || !strings.HasPrefix(lines[0], "CHECK") {
+		t.Fatalf("Expected a header, two checks and a hint, got:\n%s", buf.String())
+	}
+	if !strings.Contains(lines[2], "listen") || !strings.Contains(lines[2], "FAIL") || !strings.Contains(lines[3], "-> Stop the other server") {
+		t.Errorf("Expected the failure followed by its hint, got:\n%s", buf.String())
+	}
+}
+
+func TestDebugSelfCheck(t *testing.T) {
+	_, redisClient := newTestRedis(t)
+	server := newTestServer(t, selfCheckConfig(), redisClient)
+	router := server.Router()
+	if w := doRequest(router, "GET", "/debug/selfcheck", "", nil); w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 before a self-check, got %d", w.Code)
+	}
+
+	server.SelfCheck(context.Background())
+	w := doRequest(router, "GET", "/debug/selfcheck?ts=unix", "", nil)
+	var report struct {
+		Passed    bool          `json:"passed"`
+		Checks    []CheckResult `json:"checks"`
+		CheckedAt int64         `json:"checked_at"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("Expected the self-check report, got %d: %s", w.Code, w.Body.String())
+	}
+	if !report.Passed || len(report.Checks) != len(selfCheckNames) || report.CheckedAt == 0 {
+		t.Errorf("Expected every check reported, got %+v", report)
+	}
+}
@@ -0,0 +1,692 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Server holds the dependencies shared by the HTTP handlers
+type Server struct {
+	cfg   Config
+	redis *RedisClient
+	clock Clock
+	geo   GeoResolver
+	flags *FlagStore
+	jwt   *JWTAuth
+	meta  MetadataStore
+
+	metaCache     *metaCache
+	groups        *GroupStore
+	aliases       *AliasStore
+	goals         *GoalStore
+	optOuts       *OptOuts
+	metrics       *Metrics
+	aggregates    *aggregateCache
+	shared        *sharedCache
+	pageWebhook   *Webhook
+	webhookClient *http.Client
+	hasher        *identifierHasher
+	events        EventBus
+	waiters       *visitWaiters
+	shadow        *shadowCounters
+	coalescer     *readCoalescer
+	sampler       *counterSampler
+	shedder       *LoadShedder
+	inflight      *InFlightTracker
+	anomalies     *AnomalyDetector
+	watchdog      *RuntimeWatchdog
+	archive       *BucketArchive
+	pageMetrics   *aggregateCache
+	replication   *replicationAcks
+	quotas        *quotaCache
+	quotaMetrics  *quotaMetrics
+	pageTokens    *PageTokens
+
+	// chaos holds the injected faults, nil unless CHAOS_ENABLED is set
+	chaos *Chaos
+
+	// burst drops repeated requests, nil unless BURST_DEDUP_WINDOW is set
+	burst *BurstDedup
+
+	// absent caches pages without visits, nil unless NEGATIVE_CACHE_TTL is
+	// set
+	absent *AbsentPages
+
+	// sinks publishes visit events, nil unless EVENT_SINKS is set
+	sinks *EventDispatcher
+
+	// canary wraps meta when METADATA_CANARY_ADDR is set
+	canary *CanaryMetadataStore
+
+	// journal holds visits while Redis is out of memory, nil when
+	// OOM_JOURNAL_MAX_ENTRIES is 0
+	journal *VisitJournal
+
+	// lifetime is the context passed to Start, done at shutdown
+	lifetime context.Context
+
+	flushMu  sync.Mutex
+	flushers []namedFlusher
+
+	// selfCheck is the last SelfCheck report, served at /debug/selfcheck
+	selfCheck atomic.Pointer[SelfCheckReport]
+
+	// deadlineWarnings throttles the warnings about skewed gateway deadlines
+	deadlineWarnings deadlineWarnings
+
+	// skew is the Redis clock's offset measured by the skew watchdog
+	skew clockSkew
+}
+
+// ErrorResponse represents the error envelope returned by all endpoints
+type ErrorResponse struct {
+	Error string `json:"error"`
+	Code  string `json:"code"`
+}
+
+// NewServer creates a server backed by the given Redis client, reading the
+// time from clock and visitor countries from geo, which may be nil
+func NewServer(cfg Config, redisClient *RedisClient, clock Clock, geo GeoResolver) *Server {
+	alerts := NewWebhook(cfg.AlertWebhookURL)
+	s := &Server{
+		cfg:   cfg,
+		redis: redisClient,
+		clock: clock,
+		geo:   geo,
+		flags: NewFlagStore(redisClient, cfg.FlagsPollInterval),
+		jwt:   NewJWTAuth(cfg, clock),
+		meta:  NewRedisMetadataStore(redisClient),
+
+		metaCache:     newMetaCache(),
+		groups:        NewGroupStore(redisClient),
+		aliases:       NewAliasStore(redisClient),
+		goals:         NewGoalStore(redisClient),
+		optOuts:       NewOptOuts(redisClient),
+		metrics:       NewMetrics(clock),
+		aggregates:    newAggregateCache(cfg.CacheTTL, clock),
+		shared:        newSharedCache(cfg, redisClient),
+		pageWebhook:   NewWebhook(cfg.NewPageWebhookURL),
+		webhookClient: newWebhookClient(),
+		hasher:        newIdentifierHasher(redisClient, cfg.IPHashSalt, cfg.IPHashRotation == rotationDaily),
+		events:        newEventBus(cfg, redisClient),
+		shadow:        newShadowCounters(),
+		coalescer:     newReadCoalescer(),
+		sampler:       newCounterSampler(int(cfg.CounterSampleMaxKeys)),
+		shedder:       newServerShedder(cfg, redisClient),
+		inflight:      newInFlightTracker(cfg, clock, alerts),
+		anomalies:     newAnomalyDetector(cfg, alerts),
+		watchdog:      newRuntimeWatchdog(cfg, clock),
+		archive:       newBucketArchive(cfg.ArchiveDir),
+		pageTokens:    newPageTokens(cfg.PageTokenSecret),
+		pageMetrics:   newAggregateCache(cfg.PageMetricsCacheTTL, clock),
+		replication:   &replicationAcks{},
+		quotas:        newQuotaCache(cfg.QuotaCacheTTL),
+		quotaMetrics:  newQuotaMetrics(cfg),
+		burst:         newBurstDedup(cfg.BurstDedupWindow, burstShards),
+		absent:        newAbsentPages(cfg.NegativeCacheTTL, int(cfg.NegativeCacheSize)),
+		sinks:         newServerEventDispatcher(cfg, redisClient),
+		journal:       newVisitJournal(redisClient, clock, int(cfg.OOMJournalMaxEntries)),
+	}
+	if s.events != nil {
+		s.waiters = newVisitWaiters(s.events, int(cfg.WaitMaxWaiters))
+	}
+	s.flags.follow(s.groups.Refresh)
+	s.flags.follow(s.aliases.Refresh)
+	s.flags.follow(s.goals.Refresh)
+	s.flags.follow(s.optOuts.Refresh)
+	if cfg.ReadOnly {
+		redisClient.enableReadOnly()
+	}
+	if cfg.ChaosEnabled {
+		s.chaos = newChaos(clock)
+		redisClient.client.AddHook(chaosHook{chaos: s.chaos})
+	}
+	return s
+}
+
+// Start launches the background workers used by the server
+func (s *Server) Start(ctx context.Context) error {
+	s.lifetime = ctx
+	if s.cfg.ReadOnly {
+		log.Println("READ_ONLY is set, serving reads only with background writers off")
+	} else {
+		s.checkLastShutdown(ctx)
+	}
+	if err := s.flags.Start(ctx); err != nil {
+		return err
+	}
+
+	modules, err := s.redis.Modules(ctx)
+	if err != nil {
+		// Servers without MODULE support (or ACL access to it) get the defaults
+		log.Printf("Module detection unavailable, using exact counts and hash metadata: %v", err)
+	}
+	if s.cfg.MigrateOnStart && !s.cfg.ReadOnly {
+		s.migrateSchema(ctx, modules)
+	}
+	if modules["rejson"] {
+		s.meta = NewJSONMetadataStore(s.redis)
+		log.Println("RedisJSON detected, storing page metadata as JSON documents")
+	}
+	if s.cfg.MetadataCanaryAddr != "" {
+		s.canary = NewCanaryMetadataStore(s.meta, newCanaryStore(s.cfg.MetadataCanaryAddr, s.cfg.MetadataCanaryFormat), s.clock)
+		s.meta = s.canary
+		log.Printf("Comparing page metadata with the %s store at %s", s.cfg.MetadataCanaryFormat, s.cfg.MetadataCanaryAddr)
+	}
+	if sketches, err := s.redis.EnableSketches(ctx, modules, s.cfg.TrendingHalfLife); err != nil {
+		log.Printf("Failed to enable sketches, using exact counts: %v", err)
+	} else if sketches {
+		log.Println("RedisBloom detected, using Top-K and Count-Min Sketch")
+	}
+	if search, err := s.redis.EnableSearch(ctx, modules); err != nil {
+		log.Printf("Failed to enable RediSearch, using name index search: %v", err)
+	} else if search {
+		log.Println("RediSearch detected, enabling fuzzy page search")
+	}
+	runPeriodic(ctx, "Counter sampling", s.cfg.CounterSampleInterval, s.sampleCounters)
+	runPeriodic(ctx, "Runtime watchdog", s.cfg.RuntimeSampleInterval, s.watchdog.check)
+	if s.cfg.InFlightSoftLimit > 0 {
+		runPeriodic(ctx, "Saturation check", inFlightCheckInterval, s.inflight.check)
+	}
+	if s.cfg.ClockSkewInterval > 0 {
+		// Measure once up front, so bucket times are corrected from the start
+		if err := s.checkClockSkew(ctx); err != nil {
+			log.Printf("Clock skew check failed: %v", err)
+		}
+		runPeriodic(ctx, "Clock skew check", s.cfg.ClockSkewInterval, s.checkClockSkew)
+	}
+	// Read replicas answer from their negative cache too, so they follow
+	// page creations even with the writers off
+	if s.absent != nil && s.events != nil {
+		if err := s.watchCreatedPages(ctx); err != nil {
+			log.Printf("Failed to subscribe to page events, negative cache entries on other replicas expire after NEGATIVE_CACHE_TTL: %v", err)
+		}
+	}
+	if !s.cfg.ReadOnly {
+		s.startWriters(ctx)
+	}
+	return nil
+}
+
+// startWriters starts the background jobs that write to Redis, which
+// READ_ONLY mode leaves off
+func (s *Server) startWriters(ctx context.Context) {
+	runPeriodic(ctx, "Trending decay", s.cfg.TrendingDecayInterval, s.decayTrending)
+	if s.cfg.Retention.Enabled() {
+		runPeriodic(ctx, "Retention", s.cfg.RetentionInterval, s.retentionWorker)
+	}
+	runPeriodic(ctx, "Reconcile", s.cfg.ReconcileInterval, s.reconcileWorker)
+	runPeriodic(ctx, "Anomaly detection", s.cfg.AnomalyInterval, s.anomalyWorker)
+	s.startEventConsumers(ctx)
+	s.startEventSinks(ctx)
+	s.startOutbox(ctx)
+	if s.journal != nil {
+		runPeriodic(ctx, "Visit journal replay", s.cfg.OOMJournalReplayInterval, s.replayJournal)
+		s.RegisterFlusher("visit journal", s.journal)
+	}
+}
+
+// Router builds a single Gin engine with both the public and internal routes,
+// used when SINGLE_PORT is set
+func (s *Server) Router() *gin.Engine {
+	r := s.newEngine()
+	routes := newRouteGroup(r)
+	s.registerPublic(routes)
+	s.registerInternal(routes)
+	s.finishEngine(r, routes)
+	return r
+}
+
+// PublicRouter builds the engine served on the public port, with only the
+// visit and read routes
+func (s *Server) PublicRouter() *gin.Engine {
+	r := s.newEngine()
+	routes := newRouteGroup(r)
+	s.registerPublic(routes)
+	s.finishEngine(r, routes)
+	return r
+}
+
+// InternalRouter builds the engine served on INTERNAL_PORT, with the admin,
+// probe, metrics and debug routes
+func (s *Server) InternalRouter() *gin.Engine {
+	r := s.newEngine()
+	routes := newRouteGroup(r)
+	s.registerInternal(routes)
+	s.finishEngine(r, routes)
+	return r
+}
+
+// finishEngine checks the engine's routes, records them for /debug/routes
+// and answers OPTIONS on each of them
+func (s *Server) finishEngine(r *gin.Engine, routes *RouteGroup) {
+	if err := routes.table.verify(); err != nil {
+		panic(err)
+	}
+	s.metrics.addRoutes(routes.table.routes)
+	registerOptions(r)
+}
+
+// newEngine creates a Gin engine with the middleware shared by both ports
+func (s *Server) newEngine() *gin.Engine {
+	r := gin.New()
+	r.Use(newAccessLogger(s.cfg, s.clock, gin.DefaultWriter).handle, gin.CustomRecoveryWithWriter(nil, recoverPanic))
+	if err := r.SetTrustedProxies(s.cfg.TrustedProxies); err != nil {
+		log.Printf("Invalid TRUSTED_PROXIES, trusting none: %v", err)
+		r.SetTrustedProxies(nil)
+	}
+	r.Use(requestID)
+	if s.cfg.RedisCommandBudget > 0 || s.cfg.DebugHeaders {
+		r.Use(s.countRedisOps)
+	}
+	r.Use(s.metrics.instrument, s.inflight.track, s.applyDeadline)
+	if s.chaos != nil {
+		r.Use(s.chaos.dropRequests)
+	}
+	if s.cfg.ReadOnly {
+		r.Use(s.rejectWrites)
+	}
+	r.Use(headResponse)
+	r.Use(s.resolveTimestampFormat)
+
+	// Add CORS middleware; preflight requests are answered per route by
+	// registerOptions
+	r.Use(func(c *gin.Context) {
+		c.Header("Access-Control-Allow-Origin", "*")
+		c.Header("Access-Control-Allow-Methods", "GET, HEAD, POST, PUT, OPTIONS")
+		c.Header("Access-Control-Allow-Headers", "Authorization, Content-Type, X-API-Key, X-Request-ID, X-Signature, X-Timestamp")
+		c.Next()
+	})
+	r.Use(s.authenticate)
+	return r
+}
+
+// registerPublic registers the visit and read routes
+func (s *Server) registerPublic(r *RouteGroup) {
+	r.Match(getHead, "/health", s.handleHealth)
+	r.Match(getHead, "/", s.handleRoot)
+
+	write := r.Group("/", requirePermission(PermWrite), s.resolveAlias)
+	write.Match(getHead, "/visit/:page", s.shedLoad, s.enforceQuota, s.rejectArchived, s.handleVisit)
+	write.POST("/goals", s.handleCreateGoal)
+	write.POST("/resolve", s.handleResolve)
+
+	read := r.Group("/", requirePermission(PermRead), s.resolveAlias)
+	read.Reserve(getHead, "/visits/aggregate", s.handleAggregateVisits)
+	read.POST(queryRoute, s.handleQueryVisits)
+	read.Match(getHead, "/visits/:page", s.rejectArchived, s.handleGetVisits)
+	read.Match(getHead, "/visits/:page/variants", s.rejectArchived, s.handleGetVariants)
+	read.Match(getHead, "/visits/:page/range", s.rejectArchived, s.handleGetRange)
+	read.Match(getHead, "/visits/:page/heatmap", s.rejectArchived, s.handleHeatmap)
+	read.Match(getHead, "/visits/:page/delta", s.rejectArchived, s.handleGetDelta)
+	read.Match(getHead, "/visits/:page/countries", s.rejectArchived, s.handleGetCountries)
+	read.Match(getHead, "/visits/:page/interarrival", s.rejectArchived, s.handleGetInterarrival)
+	read.Match(getHead, "/visits/:page/wait", s.rejectArchived, s.handleWaitVisits)
+	read.Match(getHead, "/pages", s.handleListPages)
+	read.Match(getHead, "/pages/top", s.handleTopPages)
+	read.Match(getHead, "/pages/search", s.handleSearchPages)
+	read.Match(getHead, "/stream/counters", s.handleStreamCounters)
+	read.Match(getHead, "/export/history", s.handleExportHistory)
+	read.Match(getHead, "/trending", s.handleTrending)
+	read.GET("/events", s.handleEvents)
+	read.Match(getHead, "/pages/:page/meta", s.rejectArchived, s.handleGetMeta)
+	read.Match(getHead, "/pages/:page/url", s.handleGetPageURL)
+	read.Match(getHead, "/pages/:page/annotations", s.rejectArchived, s.handleGetAnnotations)
+	read.Match(getHead, "/goals/:name", s.handleGetGoal)
+}
+
+// registerInternal registers the admin, probe, metrics and debug routes
+func (s *Server) registerInternal(r *RouteGroup) {
+	r.Match(getHead, "/livez", s.handleLivez)
+	r.Match(getHead, "/readyz", s.handleReadyz)
+	r.Match(getHead, "/metrics", s.handleMetrics)
+	r.Match(getHead, "/debug/routes", s.handleDebugRoutes)
+	r.Match(getHead, "/debug/selfcheck", s.handleSelfCheck)
+	r.Match(getHead, "/debug/redis-stats", s.handleRedisStats)
+	r.Match(getHead, "/debug/loadshed", s.handleLoadShed)
+	r.Match(getHead, "/debug/inflight", s.handleInFlight)
+	r.Match(getHead, "/debug/canary", s.handleCanary)
+	if s.watchdog.captures != nil {
+		r.Match(getHead, "/debug/captures", s.handleListCaptures)
+		r.Match(getHead, "/debug/captures/:file", s.handleGetCapture)
+	}
+	if s.cfg.DebugEcho {
+		r.POST("/debug/echo-visit", s.handleEchoVisit)
+	}
+	if s.chaos != nil {
+		r.Match(getHead, chaosPrefix, s.handleGetChaos)
+		r.POST(chaosPrefix+"/:fault", s.handleInjectChaos)
+		r.DELETE(chaosPrefix, s.handleClearChaos)
+	}
+
+	if s.adminUnauthenticated() {
+		log.Println("ADMIN_API_KEYS is not set, admin endpoints are unauthenticated")
+	}
+	admin := r.Group("/admin", s.requireAllowedIP, s.requireAdminKey, s.auditAdmin)
+	admin.Match(getHead, "/flags", s.handleGetFlags)
+	admin.Match(getHead, "/metrics/pages", s.handlePageMetrics)
+	admin.PUT("/flags", s.handlePutFlags)
+	admin.Match(getHead, "/audit", s.handleGetAudit)
+	admin.Match(getHead, "/shadow-report", s.handleShadowReport)
+	admin.Match(getHead, "/webhooks/deadletter", s.handleGetDeadLetters)
+	admin.POST("/webhooks/deadletter/requeue", s.handleRequeueDeadLetters)
+	admin.PUT("/pages/:page/meta", s.handlePutMeta)
+	admin.Match(getHead, "/groups", s.handleListGroups)
+	admin.POST("/groups", s.handleCreateGroup)
+	admin.PUT("/groups/:group", s.handlePutGroup)
+	admin.DELETE("/groups/:group", s.handleDeleteGroup)
+	admin.Match(getHead, "/pages/:page/webhook", s.handleGetPageWebhook)
+	admin.PUT("/pages/:page/webhook", s.handlePutPageWebhook)
+	admin.DELETE("/pages/:page/webhook", s.handleDeletePageWebhook)
+	admin.Match(getHead, "/quotas/:caller", s.handleGetQuota)
+	admin.PUT("/quotas/:caller", s.handlePutQuota)
+	admin.POST("/backfill/:page", s.handleBackfill)
+	admin.POST("/retention", s.handleRunRetention)
+	admin.POST("/reconcile", s.handleReconcile)
+	admin.Match(getHead, "/ttl-audit", s.handleTTLAudit)
+	admin.POST("/ttl-audit/fix", s.handleFixTTLs)
+	admin.POST("/migrate", s.handleMigrate)
+	if s.cfg.KeyPrefixMigrating {
+		admin.GET("/key-prefix", s.handleKeyPrefixStatus)
+	}
+	admin.POST("/privacy/purge", s.handlePrivacyPurge)
+	admin.Match(getHead, "/optout", s.handleCountOptOuts)
+	admin.POST("/optout", s.handleAddOptOut)
+	admin.DELETE("/optout", s.handleRemoveOptOut)
+	if s.cfg.VisitorCookie {
+		admin.Match(getHead, "/visitors/:id/journey", s.handleGetJourney)
+	}
+	admin.POST("/pages/:page/annotations", s.resolveAlias, s.rejectArchived, s.handleAddAnnotation)
+	admin.POST("/pages/:page/archive", s.handleArchivePage)
+	admin.POST("/pages/:page/unarchive", s.handleUnarchivePage)
+	admin.Match(getHead, "/archive", s.handleListArchive)
+	if s.archive != nil {
+		admin.Match(getHead, "/archive/files", s.handleListArchiveFiles)
+		admin.Match(getHead, "/archive/files/:name", s.handleGetArchiveFile)
+		admin.Match(getHead, "/archive/pages/:page/range", s.rejectArchived, s.handleGetArchivedRange)
+	}
+	admin.Match(getHead, "/aliases", s.handleListAliases)
+	admin.PUT("/aliases/:alias", s.handlePutAlias)
+	admin.DELETE("/aliases/:alias", s.handleDeleteAlias)
+	admin.POST("/pages/batch", s.rateLimit("batch", s.cfg.BatchRateLimit, time.Minute), s.handleBatchPages)
+}
+
+// requestIDKey is the context key holding the request ID
+const requestIDKey = "request_id"
+
+// requestID propagates X-Request-ID, generating one when absent
+func requestID(c *gin.Context) {
+	id := c.GetHeader("X-Request-ID")
+	if id == "" {
+		buf := make([]byte, 8)
+		rand.Read(buf)
+		id = hex.EncodeToString(buf)
+	}
+	c.Set(requestIDKey, id)
+	c.Header("X-Request-ID", id)
+	c.Next()
+}
+
+// respondError aborts the request with the standard error envelope, its
+// message in the language the request accepts
+func respondError(c *gin.Context, status int, code, message string) {
+	c.AbortWithStatusJSON(status, ErrorResponse{Error: localize(c, message), Code: code})
+}
+
+// handleHealth reports the service and Redis health
+func (s *Server) handleHealth(c *gin.Context) {
+	redisStatus := "healthy"
+	if err := s.redis.Ping(c.Request.Context()); err != nil {
+		redisStatus = "unhealthy"
+	}
+
+	response := HealthResponse{
+		Status:    "healthy",
+		Redis:     redisStatus,
+		ClockSkew: s.healthSkew(),
+		ReadOnly:  s.cfg.ReadOnly,
+		Timestamp: stamp(c, s.clock.Now()),
+	}
+	if s.journal != nil {
+		if since, ok := s.journal.degraded(); ok {
+			visits, _ := s.journal.status()
+			response.Status = "degraded"
+			response.OutOfMemory = &OutOfMemoryStatus{Since: stamp(c, since), JournaledVisits: visits}
+		}
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+// livezBody is the constant /livez response, encoded once since probes hit
+// it every few seconds
+var livezBody = []byte(`{"status":"ok"}`)
+
+// handleLivez reports that the process is up, without checking dependencies
+func (s *Server) handleLivez(c *gin.Context) {
+	c.Data(http.StatusOK, "application/json; charset=utf-8", livezBody)
+}
+
+// handleReadyz reports whether the server can take traffic, returning 503
+// while Redis is unreachable
+func (s *Server) handleReadyz(c *gin.Context) {
+	response := HealthResponse{Status: "ready", Redis: "healthy", Timestamp: stamp(c, s.clock.Now())}
+	status := http.StatusOK
+	if err := s.redis.Ping(c.Request.Context()); err != nil {
+		response.Status, response.Redis = "not_ready", "unhealthy"
+		status = http.StatusServiceUnavailable
+	}
+	c.JSON(status, response)
+}
+
+// handleVisit records a visit and returns the new count. HEAD requests
+// return the current count without recording a visit.
+func (s *Server) handleVisit(c *gin.Context) {
+	page := c.Param("page")
+	if page == "" {
+		page = "home"
+	}
+	if c.Request.Method == http.MethodHead {
+		s.handleGetVisits(c)
+		return
+	}
+	budget := s.startBudget(c, requestPhases)
+	defer budget.finish()
+
+	budget.enter(phaseValidate)
+	weight, err := parseVisitWeight(c.Query("weight"))
+	if err != nil {
+		respondError(c, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+	if weight > 0 && s.isApproximatePage(page) {
+		respondError(c, http.StatusBadRequest, "invalid_request", "weight is not supported on approximate pages")
+		return
+	}
+
+	view, ok := parseVisitView(c)
+	if !ok {
+		return
+	}
+	variant, ok := s.resolveVariant(c, page)
+	if !ok {
+		return
+	}
+
+	budget.enter(phaseRedis)
+	result, err := s.recordVisit(c, page, visitOptions{Variant: variant, Weight: weight})
+	if err != nil {
+		log.Printf("Error incrementing visit count: %v", err)
+		respondStoreError(c, err, "Failed to increment visit count")
+		return
+	}
+	s.chargeQuota(c, result)
+
+	response := VisitResponse{
+		Page:           page,
+		ResolvedFrom:   c.GetString(resolvedFromKey),
+		Visits:         result.Visits,
+		Sessions:       result.Sessions,
+		WeightedVisits: result.Weighted,
+		Variant:        variant,
+		Approximate:    result.Approximate,
+		Counted:        &result.Counted,
+		Reason:         result.Reason,
+		Sampled:        result.SampleRate > 0,
+		SampleRate:     result.SampleRate,
+		FirstVisit:     result.FirstVisit,
+		Replicated:     result.Replicated,
+		Timestamp:      stamp(c, s.clock.Now()),
+	}
+	budget.enter(phaseEnrich)
+	// The visit is recorded, so failing to read the extra fields only
+	// leaves them out
+	if err := s.shapeVisit(c.Request.Context(), &response, view); err != nil {
+		log.Printf("Error getting included visit fields: %v", err)
+	}
+
+	status := http.StatusOK
+	if s.cfg.WriteWaitStrict && result.Replicated != nil && !*result.Replicated {
+		// Counted, but a failover could still lose it
+		status = http.StatusAccepted
+	}
+	writeJSON(c, status, response)
+}
+
+// handleGetVisits returns the visit count without incrementing it
+func (s *Server) handleGetVisits(c *gin.Context) {
+	page := c.Param("page")
+	if page == "" {
+		page = "home"
+	}
+	view, ok := parseVisitView(c)
+	if !ok {
+		return
+	}
+	expand, ok := parseExpansions(c)
+	if !ok {
+		return
+	}
+	expand = s.enabledExpansions(expand)
+
+	hidden, err := s.pageHidden(c, page)
+	if err != nil {
+		log.Printf("Error getting page metadata: %v", err)
+		respondStoreError(c, err, "Failed to get visit count")
+		return
+	}
+	if hidden {
+		respondError(c, http.StatusNotFound, "not_found", "Page not found")
+		return
+	}
+	// Checked after the visibility, which can change while a page is
+	// cached. An unvisited page can still have metadata and annotations.
+	if s.absent != nil && !expand.any() && s.absent.absent(page, s.clock.Now()) {
+		s.respondAbsentPage(c, page, view)
+		return
+	}
+
+	pending := s.startExpansion(c, page, expand)
+	if view.snapshot && !s.isApproximatePage(page) {
+		s.respondVisitSnapshot(c, page, view, pending)
+		return
+	}
+	counts, err := s.readPageCounts(c.Request.Context(), page)
+	if err != nil {
+		log.Printf("Error getting visit count: %v", err)
+		respondStoreError(c, err, "Failed to get visit count")
+		return
+	}
+
+	response := VisitResponse{
+		Page:           page,
+		ResolvedFrom:   c.GetString(resolvedFromKey),
+		Visits:         counts.Visits,
+		Sessions:       counts.Sessions,
+		WeightedVisits: counts.Weighted,
+		Approximate:    counts.Approximate,
+		Timestamp:      stamp(c, s.clock.Now()),
+	}
+	if err := s.shapeVisit(c.Request.Context(), &response, view); err != nil {
+		log.Printf("Error getting included visit fields: %v", err)
+		respondStoreError(c, err, "Failed to get visit count")
+		return
+	}
+	if !s.expandVisit(c, &response, pending) {
+		return
+	}
+	s.rememberAbsent(c, response)
+
+	respondJSON(c, http.StatusOK, response)
+}
+
+// expandVisit adds the expansions started for a visit response, if any,
+// responding with the error and returning false when they can't be read
+func (s *Server) expandVisit(c *gin.Context, response *VisitResponse, pending *pendingExpansion) bool {
+	if pending == nil {
+		return true
+	}
+	expanded, err := pending.wait()
+	if err != nil {
+		log.Printf("Error getting visit expansions: %v", err)
+		respondStoreError(c, err, "Failed to get visit count")
+		return false
+	}
+	response.Expanded = expanded
+	return true
+}
+
+// respondVisitSnapshot answers GET /visits/:page?include=all with every
+// field read in one snapshot. Approximate pages are counted in the sketch
+// and keep the pipelined reads.
+func (s *Server) respondVisitSnapshot(c *gin.Context, page string, view visitView, pending *pendingExpansion) {
+	snapshot, err := s.readPageSnapshot(c.Request.Context(), page)
+	if err != nil {
+		log.Printf("Error getting visit snapshot: %v", err)
+		respondStoreError(c, err, "Failed to get visit count")
+		return
+	}
+	response := VisitResponse{
+		Page:           page,
+		ResolvedFrom:   c.GetString(resolvedFromKey),
+		Visits:         snapshot.Visits,
+		Sessions:       snapshot.Sessions,
+		WeightedVisits: snapshot.Weighted,
+		Rank:           snapshot.Rank,
+		Unique:         &snapshot.Unique,
+		Timestamp:      stamp(c, s.clock.Now()),
+		view:           view,
+	}
+	if !s.expandVisit(c, &response, pending) {
+		return
+	}
+	s.rememberAbsent(c, response)
+	respondJSON(c, http.StatusOK, response)
+}
+
+// handleRoot returns basic service info
+func (s *Server) handleRoot(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"message":     localize(c, "Go Redis Microservice"),
+		"version":     "1.0.0",
+		"environment": s.cfg.EnvName,
+		"read_only":   s.cfg.ReadOnly,
+		"endpoints": gin.H{
+			"health":   "/health",
+			"visit":    "/visit/:page",
+			"visits":   "/visits/:page",
+			"pages":    "/pages",
+			"top":      "/pages/top",
+			"search":   "/pages/search",
+			"trending": "/trending",
+		},
+	})
+}
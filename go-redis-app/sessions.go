@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// sessionScript starts a session when the visitor has none for the page,
+// incrementing the session counters, and otherwise optionally extends the
+// current session. It returns the page's session count.
+//
+// KEYS[1] session marker, KEYS[2] session counter, KEYS[3] daily bucket (optional)
+// ARGV[1] window in seconds, ARGV[2] "1" to refresh on activity, ARGV[3]
+// session start as Unix time (stored in the marker)
+var sessionScript = redis.NewScript(`
+if redis.call('SET', KEYS[1], ARGV[3], 'NX', 'EX', ARGV[1]) then
+	local sessions = redis.call('INCR', KEYS[2])
+	if KEYS[3] then
+		redis.call('INCR', KEYS[3])
+	end
+	return sessions
+end
+if ARGV[2] == '1' then
+	redis.call('EXPIRE', KEYS[1], ARGV[1])
+end
+return tonumber(redis.call('GET', KEYS[2]) or '0')
+`)
+
+// sessionsKey returns the session counter key for a page
+func sessionsKey(page string) string {
+	return key("visits", "sessions", page)
+}
+
+// sessionsDailyKey returns the daily session bucket key for a page
+func sessionsDailyKey(page string, t time.Time) string {
+	return key("visits", "sessions", page, "daily", t.UTC().Format("2006-01-02"))
+}
+
+// TrackSession counts a new session when the visitor has been inactive on the
+// page for longer than the window, returning the page's session count
+func (r *RedisClient) TrackSession(ctx context.Context, page, visitor string, window time.Duration, refresh, rollup bool, now time.Time) (int64, error) {
+	keys := []string{
+		fmt.Sprintf("visits:session:%s:%s", page, visitor),
+		sessionsKey(page),
+	}
+	if rollup {
+		keys = append(keys, sessionsDailyKey(page, now))
+	}
+	refreshArg := "0"
+	if refresh {
+		refreshArg = "1"
+	}
+	seconds := int64(window / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+	return sessionScript.Run(ctx, r.client, keys, seconds, refreshArg, now.Unix()).Int64()
+}
+
+// GetCounts returns the visit and session counts for a page, and its
+// weighted total when it has one
+func (r *RedisClient) GetCounts(ctx context.Context, page string) (int64, int64, *float64, error) {
+	values, err := r.client.MGet(ctx, key("visits", page), sessionsKey(page), weightedKey(page)).Result()
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	var counts [2]int64
+	for i, v := range values[:2] {
+		if s, ok := v.(string); ok {
+			if counts[i], err = strconv.ParseInt(s, 10, 64); err != nil {
+				return 0, 0, nil, err
+			}
+		}
+	}
+	var weighted *float64
+	if s, ok := values[2].(string); ok {
+		if weighted, err = parseWeighted(s); err != nil {
+			return 0, 0, nil, err
+		}
+	}
+	return counts[0], counts[1], weighted, nil
+}
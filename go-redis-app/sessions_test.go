@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"go-redis-app/internal/clocktest"
+)
+
+func TestSessionsAcrossManyHits(t *testing.T) {
+	mr, redisClient := newTestRedis(t)
+	clock := clocktest.New(time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC))
+	cfg := testConfig()
+	cfg.VisitorCookie = true
+	server := newTestServerWithClock(t, cfg, redisClient, clock)
+	router := server.Router()
+	server.flags.Set(context.Background(), map[string]bool{"rollups": true})
+
+	var resp VisitResponse
+	for i := 0; i < 10; i++ {
+		resp = decodeVisit(t, doRequest(router, "GET", "/visit/blog", "", nil).Body.Bytes())
+	}
+	if resp.Visits != 10 || resp.Sessions != 1 {
+		t.Fatalf("Expected 10 visits in 1 session, got %+v", resp)
+	}
+
+	// The session expires after 30 minutes of inactivity
+	mr.FastForward(31 * time.Minute)
+	clock.Advance(31 * time.Minute)
+	resp = decodeVisit(t, doRequest(router, "GET", "/visit/blog", "", nil).Body.Bytes())
+	if resp.Sessions != 2 {
+		t.Errorf("Expected a new session after expiry, got %+v", resp)
+	}
+
+	// Another visitor starts their own session
+	vid, _ := newVisitorID()
+	req := httptest.NewRequest("GET", "/visit/blog", nil)
+	req.AddCookie(&http.Cookie{Name: visitorCookieName, Value: vid})
+	router.ServeHTTP(httptest.NewRecorder(), req)
+
+	read := decodeVisit(t, doRequest(router, "GET", "/visits/blog", "", nil).Body.Bytes())
+	if read.Sessions != 3 || read.Visits != 12 {
+		t.Errorf("Expected read endpoint to report sessions, got %+v", read)
+	}
+
+	if got, _ := mr.Get(sessionsDailyKey("blog", clock.Now())); got != "3" {
+		t.Errorf("Expected daily session bucket of 3, got %q", got)
+	}
+}
+
+func TestSessionRefreshOnActivity(t *testing.T) {
+	for _, refresh := range []bool{true, false} {
+		mr, redisClient := newTestRedis(t)
+		cfg := testConfig()
+		cfg.SessionWindow = 30 * time.Minute
+		cfg.SessionRefresh = refresh
+		router := newTestServer(t, cfg, redisClient).Router()
+
+		// Hits every 20 minutes stay within one session only when refreshed
+		var resp VisitResponse
+		for i := 0; i < 3; i++ {
+			resp = decodeVisit(t, doRequest(router, "GET", "/visit/docs", "", nil).Body.Bytes())
+			mr.FastForward(20 * time.Minute)
+		}
+
+		want := int64(1)
+		if !refresh {
+			want = 2
+		}
+		if resp.Sessions != want {
+			t.Errorf("refresh=%t: expected %d sessions, got %d", refresh, want, resp.Sessions)
+		}
+	}
+}
+
+func TestSessionsDisabled(t *testing.T) {
+	mr, redisClient := newTestRedis(t)
+	cfg := testConfig()
+	cfg.SessionWindow = 0
+	router := newTestServer(t, cfg, redisClient).Router()
+
+	resp := decodeVisit(t, doRequest(router, "GET", "/visit/docs", "", nil).Body.Bytes())
+	if resp.Sessions != 0 || mr.Exists(sessionsKey("docs")) {
+		t.Errorf("Expected no session tracking, got %+v", resp)
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+// Features that can run in shadow mode, named as their flags
+const (
+	featureBotFiltering = "bot_filtering"
+	featureDedupe       = "dedupe"
+	featureSampling     = "sampling"
+)
+
+// shadowFeatures lists the shadow-capable features in report order
+var shadowFeatures = []string{featureBotFiltering, featureDedupe, featureSampling}
+
+// shadowKey returns the hash of a feature's shadow decisions: evaluated
+// visits, those it would_drop, and the visits it would_count
+func shadowKey(feature string) string {
+	return key("shadow", feature)
+}
+
+// shadowDecision is what a feature in shadow mode would have done with a
+// visit that was counted regardless
+type shadowDecision struct {
+	Feature string
+	Drop    bool
+
+	// Weight is what the visit would have counted for when kept: 1, or the
+	// sample weight for sampling
+	Weight int64
+}
+
+// RecordShadow adds shadow decisions to the features' shadow counters
+func (r *RedisClient) RecordShadow(ctx context.Context, decisions []shadowDecision) error {
+	_, err := r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, d := range decisions {
+			k := shadowKey(d.Feature)
+			pipe.HIncrBy(ctx, k, "evaluated", 1)
+			if d.Drop {
+				pipe.HIncrBy(ctx, k, "would_drop", 1)
+			} else {
+				pipe.HIncrBy(ctx, k, "would_count", d.Weight)
+			}
+		}
+		return nil
+	})
+	return err
+}
+
+// shadowCounters counts shadow decisions in this process for /metrics
+type shadowCounters struct {
+	mu     sync.Mutex
+	counts map[[2]string]int64
+}
+
+func newShadowCounters() *shadowCounters {
+	return &shadowCounters{counts: make(map[[2]string]int64)}
+}
+
+func (sc *shadowCounters) add(decisions []shadowDecision) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	for _, d := range decisions {
+		decision := "keep"
+		if d.Drop {
+			decision = "drop"
+		}
+		sc.counts[[2]string{d.Feature, decision}]++
+	}
+}
+
+// write writes the shadow_decisions_total series, sorted by feature and
+// decision
+func (sc *shadowCounters) write(b *strings.Builder, env string) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	keys := make([][2]string, 0, len(sc.counts))
+	for k := range sc.counts {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i][0] != keys[j][0] {
+			return keys[i][0] < keys[j][0]
+		}
+		return keys[i][1] < keys[j][1]
+	})
+	b.WriteString("# HELP shadow_decisions_total Decisions of features in shadow mode, by what they would have done.\n")
+	b.WriteString("# TYPE shadow_decisions_total counter\n")
+	for _, k := range keys {
+		labels := fmt.Sprintf("feature=%s,decision=%s", strconv.Quote(k[0]), strconv.Quote(k[1]))
+		if env != "" {
+			labels = "env=" + strconv.Quote(env) + "," + labels
+		}
+		fmt.Fprintf(b, "shadow_decisions_total{%s} %d\n", labels, sc.counts[k])
+	}
+}
+
+// recordShadow stores the shadow decisions of a visit. Failures are only
+// logged: shadow mode must never affect the visit itself.
+func (s *Server) recordShadow(ctx context.Context, decisions []shadowDecision) {
+	if len(decisions) == 0 {
+		return
+	}
+	s.shadow.add(decisions)
+	if err := s.redis.RecordShadow(ctx, decisions); err != nil {
+		log.Printf("Failed to record shadow decisions: %v", err)
+	}
+}
+
+// ShadowFeatureReport compares what a feature would have counted with what
+// was counted for the visits it evaluated in shadow mode
+type ShadowFeatureReport struct {
+	Feature    string      `json:"feature"`
+	Mode       FeatureMode `json:"mode"`
+	Evaluated  int64       `json:"evaluated"`
+	WouldDrop  int64       `json:"would_drop"`
+	WouldCount int64       `json:"would_count"`
+
+	// DivergencePercent is how far would_count is from evaluated, the visits
+	// actually counted, as a percentage of evaluated
+	DivergencePercent float64 `json:"divergence_percent"`
+}
+
+// ShadowReport represents the /admin/shadow-report API response
+type ShadowReport struct {
+	Features []ShadowFeatureReport `json:"features"`
+}
+
+// ShadowReport summarizes every feature's shadow counters
+func (r *RedisClient) ShadowReport(ctx context.Context, modes FeatureModes) (ShadowReport, error) {
+	cmds := make([]*redis.MapStringStringCmd, len(shadowFeatures))
+	_, err := r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, feature := range shadowFeatures {
+			cmds[i] = pipe.HGetAll(ctx, shadowKey(feature))
+		}
+		return nil
+	})
+	if err != nil {
+		return ShadowReport{}, err
+	}
+
+	report := ShadowReport{Features: make([]ShadowFeatureReport, len(shadowFeatures))}
+	for i, feature := range shadowFeatures {
+		values := cmds[i].Val()
+		f := ShadowFeatureReport{Feature: feature, Mode: *modeFields[feature](&modes)}
+		for field, dst := range map[string]*int64{"evaluated": &f.Evaluated, "would_drop": &f.WouldDrop, "would_count": &f.WouldCount} {
+			if values[field] == "" {
+				continue
+			}
+			if *dst, err = strconv.ParseInt(values[field], 10, 64); err != nil {
+				return ShadowReport{}, fmt.Errorf("%s %s: %w", shadowKey(feature), field, err)
+			}
+		}
+		if f.Evaluated > 0 {
+			f.DivergencePercent = math.Round(math.Abs(float64(f.Evaluated-f.WouldCount))*10000/float64(f.Evaluated)) / 100
+		}
+		report.Features[i] = f
+	}
+	return report, nil
+}
+
+// handleShadowReport returns the shadow-mode divergence of each feature
+func (s *Server) handleShadowReport(c *gin.Context) {
+	report, err := s.redis.ShadowReport(c.Request.Context(), s.flags.Flags().Modes)
+	if err != nil {
+		log.Printf("Error getting shadow report: %v", err)
+		respondStoreError(c, err, "Failed to get shadow report")
+		return
+	}
+	respondJSON(c, http.StatusOK, report)
+}
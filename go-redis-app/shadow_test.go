@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// shadowTraffic sends bot, repeated, and sampled visits
+func shadowTraffic(t *testing.T, router http.Handler) {
+	t.Helper()
+	doRequest(router, "PUT", "/admin/pages/feed/meta", `{"sample_rate": 0.25}`, nil)
+	browser := map[string]string{"User-Agent": "Mozilla/5.0"}
+	bot := map[string]string{"User-Agent": "Googlebot/2.1"}
+	for i := 0; i < 3; i++ {
+		doRequest(router, "GET", "/visit/home", "", browser)
+	}
+	doRequest(router, "GET", "/visit/home", "", bot)
+	for i := 0; i < 40; i++ {
+		doRequest(router, "GET", "/visit/feed", "", browser)
+	}
+}
+
+func TestParseFeatureMode(t *testing.T) {
+	valid := map[string]FeatureMode{"off": ModeOff, "shadow": ModeShadow, "enforce": ModeEnforce, "true": ModeEnforce, "false": ModeOff}
+	for value, want := range valid {
+		if got, err := parseFeatureMode(value); err != nil || got != want {
+			t.Errorf("parseFeatureMode(%q) = %q, %v, want %q", value, got, err, want)
+		}
+	}
+	for _, value := range []string{"", "Shadow", "dry-run"} {
+		if _, err := parseFeatureMode(value); err == nil {
+			t.Errorf("parseFeatureMode(%q): expected an error", value)
+		}
+	}
+}
+
+func TestPutFlagModes(t *testing.T) {
+	_, redisClient := newTestRedis(t)
+	router := newTestServer(t, testConfig(), redisClient).Router()
+
+	var flags Flags
+	json.Unmarshal(doRequest(router, "GET", "/admin/flags", "", nil).Body.Bytes(), &flags)
+	if flags.Modes != defaultModes {
+		t.Errorf("Expected the default modes, got %+v", flags.Modes)
+	}
+
+	w := doRequest(router, "PUT", "/admin/flags", `{"bot_filtering": "shadow", "dedupe": true, "sampling": "off"}`, nil)
+	if err := json.Unmarshal(w.Body.Bytes(), &flags); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	want := FeatureModes{BotFiltering: ModeShadow, Dedupe: ModeEnforce, Sampling: ModeOff}
+	if flags.Modes != want || flags.BotFiltering || !flags.Dedupe {
+		t.Errorf("Expected %+v with only dedupe enforced, got %+v", want, flags)
+	}
+
+	for _, body := range []string{`{"rollups": "shadow"}`, `{"dedupe": "sometimes"}`, `{"dedupe": 1}`} {
+		if w := doRequest(router, "PUT", "/admin/flags", body, nil); w.Code != http.StatusBadRequest {
+			t.Errorf("Expected 400 for %s, got %d", body, w.Code)
+		}
+	}
+}
+
+func TestShadowModeLeavesCountsUnchanged(t *testing.T) {
+	counters := func(modes string) map[string]string {
+		mr, redisClient := newTestRedis(t)
+		router := newTestServer(t, testConfig(), redisClient).Router()
+		if w := doRequest(router, "PUT", "/admin/flags", modes, nil); w.Code != http.StatusOK {
+			t.Fatalf("Expected 200 setting %s, got %d", modes, w.Code)
+		}
+		shadowTraffic(t, router)
+		values := make(map[string]string)
+		for _, k := range mr.Keys() {
+			if strings.HasPrefix(k, "shadow:") || strings.HasPrefix(k, "visits:dedupe:") || k == flagsKey || strings.HasPrefix(k, "pages:meta") || strings.HasPrefix(k, "admin:") {
+				continue
+			}
+			// Session markers hold the second of the visit, which differs
+			// between the runs
+			if typ := mr.Type(k); typ == "string" && !strings.HasPrefix(k, "visits:session:") {
+				values[k], _ = mr.Get(k)
+			} else {
+				values[k] = typ
+			}
+		}
+		return values
+	}
+
+	off := counters(`{"bot_filtering": "off", "dedupe": "off", "sampling": "off"}`)
+	shadow := counters(`{"bot_filtering": "shadow", "dedupe": "shadow", "sampling": "shadow"}`)
+	if !reflect.DeepEqual(off, shadow) {
+		t.Errorf("Expected shadow mode to count exactly like off:\noff:    %v\nshadow: %v", off, shadow)
+	}
+	if off["visits:home"] != "4" || off["visits:feed"] != "40" {
+		t.Errorf("Expected every visit counted, got %v", off)
+	}
+}
+
+func TestShadowReport(t *testing.T) {
+	mr, redisClient := newTestRedis(t)
+	server := newTestServer(t, testConfig(), redisClient)
+	router := server.Router()
+	doRequest(router, "PUT", "/admin/flags", `{"bot_filtering": "shadow", "dedupe": "shadow", "sampling": "shadow"}`, nil)
+	shadowTraffic(t, router)
+
+	w := doRequest(router, "GET", "/admin/shadow-report", "", nil)
+	var report ShadowReport
+	if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("Expected the shadow report, got %d: %s", w.Code, w.Body.String())
+	}
+	byFeature := make(map[string]ShadowFeatureReport)
+	for _, f := range report.Features {
+		byFeature[f.Feature] = f
+	}
+
+	bots := byFeature[featureBotFiltering]
+	if bots.Mode != ModeShadow || bots.Evaluated != 44 || bots.WouldDrop != 1 || bots.WouldCount != 43 || bots.DivergencePercent != 2.27 {
+		t.Errorf("Expected one of 44 visits dropped by the bot filter, got %+v", bots)
+	}
+	// One visitor: one first visit per page, the rest repeats
+	dedupe := byFeature[featureDedupe]
+	if dedupe.Evaluated != 44 || dedupe.WouldDrop != 42 || dedupe.WouldCount != 2 {
+		t.Errorf("Expected dedupe to keep the first visit of each page, got %+v", dedupe)
+	}
+	// Sampling keeps about a quarter of feed visits at weight 4, and all of home
+	sampling := byFeature[featureSampling]
+	if sampling.Evaluated != 44 || sampling.WouldCount != 4+4*(40-sampling.WouldDrop) {
+		t.Errorf("Expected sampled-in feed visits weighted 4, got %+v", sampling)
+	}
+	if sampling.WouldDrop == 0 || sampling.WouldDrop == 40 {
+		t.Errorf("Expected sampling to drop some but not all feed visits, got %+v", sampling)
+	}
+	if got := mr.HGet(shadowKey(featureBotFiltering), "would_drop"); got != "1" {
+		t.Errorf("Expected the shadow counters in %s, got %q", shadowKey(featureBotFiltering), got)
+	}
+
+	metrics := doRequest(router, "GET", "/metrics", "", nil).Body.String()
+	for _, series := range []string{`shadow_decisions_total{feature="bot_filtering",decision="drop"} 1`, `shadow_decisions_total{feature="dedupe",decision="keep"} 2`} {
+		if !strings.Contains(metrics, series) {
+			t.Errorf("Expected %s in the metrics", series)
+		}
+	}
+}
+
+func TestEnforceRecordsNoShadow(t *testing.T) {
+	mr, redisClient := newTestRedis(t)
+	router := newTestServer(t, testConfig(), redisClient).Router()
+	doRequest(router, "PUT", "/admin/flags", `{"bot_filtering": "enforce", "dedupe": "enforce"}`, nil)
+	shadowTraffic(t, router)
+	for _, feature := range shadowFeatures {
+		if mr.Exists(shadowKey(feature)) {
+			t.Errorf("Expected no shadow counters for %s outside shadow mode", feature)
+		}
+	}
+	if got, _ := mr.Get(key("visits", "home")); got != "1" {
+		t.Errorf("Expected enforced dedupe and bot filtering to count home once, got %q", got)
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"strconv"
+	"time"
+)
+
+const (
+	// sharedCacheGenerationKey is bumped by every invalidation, so blobs
+	// computed before it are ignored by every replica
+	sharedCacheGenerationKey = "cache:generation"
+
+	// sharedCachePoll is how often a replica waiting on another's
+	// recomputation checks for its blob
+	sharedCachePoll = 20 * time.Millisecond
+)
+
+// sharedCacheKey holds the blob of an aggregation, named by its cache key
+func sharedCacheKey(name string) string {
+	return key("cache", "shared", name)
+}
+
+// sharedCacheLockKey is held by the replica recomputing an aggregation
+func sharedCacheLockKey(name string) string {
+	return key("cache", "lock", name)
+}
+
+// sharedBlob is an aggregation as stored in Redis, with the generation it
+// was computed in
+type sharedBlob struct {
+	Generation int64           `json:"generation"`
+	Value      json.RawMessage `json:"value"`
+}
+
+// SharedCacheGet returns the stored blob of an aggregation, nil when there
+// is none or it predates the last invalidation, and the current generation
+func (r *RedisClient) SharedCacheGet(ctx context.Context, name string) ([]byte, int64, error) {
+	values, err := r.client.MGet(ctx, sharedCacheGenerationKey, sharedCacheKey(name)).Result()
+	if err != nil {
+		return nil, 0, err
+	}
+	var generation int64
+	if s, ok := values[0].(string); ok {
+		if generation, err = strconv.ParseInt(s, 10, 64); err != nil {
+			return nil, 0, err
+		}
+	}
+	s, ok := values[1].(string)
+	if !ok {
+		return nil, generation, nil
+	}
+	var blob sharedBlob
+	if err := json.Unmarshal([]byte(s), &blob); err != nil || blob.Generation != generation {
+		return nil, generation, nil
+	}
+	return blob.Value, generation, nil
+}
+
+// SharedCacheSet stores the blob of an aggregation computed in generation
+func (r *RedisClient) SharedCacheSet(ctx context.Context, name string, generation int64, value []byte, ttl time.Duration) error {
+	blob, err := json.Marshal(sharedBlob{Generation: generation, Value: value})
+	if err != nil {
+		return err
+	}
+	return r.client.Set(ctx, sharedCacheKey(name), blob, ttl).Err()
+}
+
+// SharedCacheInvalidate starts a new generation, retiring every stored blob
+func (r *RedisClient) SharedCacheInvalidate(ctx context.Context) error {
+	return r.client.Incr(ctx, sharedCacheGenerationKey).Err()
+}
+
+// sharedCache keeps aggregations in Redis as JSON for ttl, so that replicas
+// share one recomputation per window instead of each running their own: the
+// replica taking an aggregation's lock recomputes it while the others wait
+// for its blob. A nil sharedCache leaves loads as they are.
+type sharedCache struct {
+	redis *RedisClient
+	ttl   time.Duration
+}
+
+// newSharedCache creates the shared cache when CACHE_SHARED is set
+func newSharedCache(cfg Config, redisClient *RedisClient) *sharedCache {
+	if !cfg.CacheShared || cfg.CacheTTL <= 0 || cfg.ReadOnly {
+		return nil
+	}
+	return &sharedCache{redis: redisClient, ttl: cfg.CacheTTL}
+}
+
+// wrap returns load backed by the shared cache under name, which must
+// include every parameter of the aggregation. decode turns a stored blob
+// back into the value load returns.
+func (c *sharedCache) wrap(name string, decode func([]byte) (any, error), load func(context.Context) (any, error)) func(context.Context) (any, error) {
+	if c == nil {
+		return load
+	}
+	return func(ctx context.Context) (any, error) {
+		blob, generation, err := c.redis.SharedCacheGet(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		if blob != nil {
+			return decode(blob)
+		}
+		release, ok, err := c.redis.acquireLock(ctx, sharedCacheLockKey(name), cacheRefreshTimeout)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return c.await(ctx, name, decode, load)
+		}
+		defer release()
+		value, err := load(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if blob, err := json.Marshal(value); err != nil {
+			log.Printf("Error encoding shared cache %s: %v", name, err)
+		} else if err := c.redis.SharedCacheSet(ctx, name, generation, blob, c.ttl); err != nil {
+			log.Printf("Error storing shared cache %s: %v", name, err)
+		}
+		return value, nil
+	}
+}
+
+// await waits for the replica holding name's lock to store its blob,
+// recomputing locally if the lock is released or expires without one
+func (c *sharedCache) await(ctx context.Context, name string, decode func([]byte) (any, error), load func(context.Context) (any, error)) (any, error) {
+	ticker := time.NewTicker(sharedCachePoll)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-ticker.C:
+		}
+		blob, _, err := c.redis.SharedCacheGet(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		if blob != nil {
+			return decode(blob)
+		}
+		held, err := c.redis.client.Exists(ctx, sharedCacheLockKey(name)).Result()
+		if err != nil {
+			return nil, err
+		}
+		if held == 0 {
+			return load(ctx)
+		}
+	}
+}
+
+// invalidateAggregates drops the cached aggregations, on every replica when
+// the cache is shared, and the pages this replica knows to have no visits
+func (s *Server) invalidateAggregates(ctx context.Context) {
+	s.aggregates.Invalidate()
+	if s.absent != nil {
+		s.absent.clear()
+	}
+	if s.shared == nil {
+		return
+	}
+	if err := s.redis.SharedCacheInvalidate(ctx); err != nil {
+		log.Printf("Error invalidating shared cache: %v", err)
+	}
+}
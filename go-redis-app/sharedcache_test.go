@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"go-redis-app/internal/clocktest"
+)
+
+// leaderboardReads counts the leaderboard reads behind top pages, slowing
+// each down so that recomputations on different replicas overlap
+type leaderboardReads struct {
+	calls *atomic.Int64
+}
+
+func (h leaderboardReads) DialHook(next redis.DialHook) redis.DialHook { return next }
+
+func (h leaderboardReads) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		if cmd.Name() == "zrevrange" {
+			h.calls.Add(1)
+			time.Sleep(50 * time.Millisecond)
+		}
+		return next(ctx, cmd)
+	}
+}
+
+func (h leaderboardReads) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return next
+}
+
+func TestSharedCacheAcrossReplicas(t *testing.T) {
+	mr, _ := newTestRedis(t)
+	cfg := testConfig()
+	cfg.CacheTTL = time.Minute
+	cfg.CacheShared = true
+	clock := clocktest.New(time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC))
+	var recomputations atomic.Int64
+	replicas := make([]http.Handler, 2)
+	for i := range replicas {
+		redisClient := newTestRedisClient(t, mr)
+		redisClient.client.AddHook(leaderboardReads{calls: &recomputations})
+		replicas[i] = newTestServerWithClock(t, cfg, redisClient, clock).Router()
+	}
+	doRequest(replicas[0], "GET", "/visit/home", "", nil)
+
+	// top requests the top pages from every replica at once, returning the
+	// totals they answered
+	top := func(query string) []int {
+		t.Helper()
+		var wg sync.WaitGroup
+		totals := make([]int, 10)
+		for i := range totals {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				w := doRequest(replicas[i%len(replicas)], "GET", "/pages/top"+query, "", nil)
+				var resp PagesResponse
+				if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || w.Code != http.StatusOK {
+					t.Errorf("Expected the top pages, got %d: %s", w.Code, w.Body.String())
+				}
+				totals[i] = resp.Total
+			}(i)
+		}
+		wg.Wait()
+		return totals
+	}
+
+	top("")
+	if n := recomputations.Load(); n != 1 {
+		t.Errorf("Expected one recomputation across both replicas, got %d", n)
+	}
+	// Parameters are part of the key
+	top("?limit=5")
+	if n := recomputations.Load(); n != 2 {
+		t.Errorf("Expected another limit recomputed once, got %d in all", n)
+	}
+
+	// The next window, after both the local and the shared copies expire,
+	// is recomputed once again
+	doRequest(replicas[1], "GET", "/visit/about", "", nil)
+	clock.Advance(3 * time.Minute)
+	mr.FastForward(3 * time.Minute)
+	for _, total := range top("") {
+		if total != 2 {
+			t.Errorf("Expected the new window's 2 pages, got %d", total)
+		}
+	}
+	if n := recomputations.Load(); n != 3 {
+		t.Errorf("Expected one recomputation for the window, got %d in all", n)
+	}
+
+	// An invalidation on one replica retires the shared copy for all
+	doRequest(replicas[0], "PUT", "/admin/pages/home/meta", `{"visibility": "private"}`, nil)
+	clock.Advance(3 * time.Minute)
+	for _, total := range top("") {
+		if total != 1 {
+			t.Errorf("Expected the private page hidden, got %d pages", total)
+		}
+	}
+	if n := recomputations.Load(); n != 4 {
+		t.Errorf("Expected one recomputation after the invalidation, got %d in all", n)
+	}
+}
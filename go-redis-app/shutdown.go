@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Shutdown marker values
+const (
+	instanceRunning = "running"
+	instanceClean   = "clean"
+)
+
+// shutdownMarkerTTL expires the markers of instances that don't come back,
+// such as replicas with generated host names
+const shutdownMarkerTTL = 30 * 24 * time.Hour
+
+// shutdownMarkerKey returns the key recording whether an instance, named by
+// INSTANCE_NAME, is running or shut down cleanly
+func shutdownMarkerKey(instance string) string {
+	return key("server", "lifecycle", instance)
+}
+
+// MarkRunning records that the instance started, returning the previous
+// marker: instanceClean after a clean shutdown, instanceRunning when the last
+// run exited without one, and "" on the instance's first start
+func (r *RedisClient) MarkRunning(ctx context.Context, instance string) (string, error) {
+	previous, err := r.client.SetArgs(ctx, shutdownMarkerKey(instance), instanceRunning, redis.SetArgs{Get: true, TTL: shutdownMarkerTTL}).Result()
+	if isMissing(err) {
+		return "", nil
+	}
+	return previous, err
+}
+
+// MarkClean records that the instance shut down cleanly
+func (r *RedisClient) MarkClean(ctx context.Context, instance string) error {
+	return r.client.Set(ctx, shutdownMarkerKey(instance), instanceClean, shutdownMarkerTTL).Err()
+}
+
+// checkLastShutdown marks the instance running, warning when its previous run
+// did not shut down cleanly. It reports whether that was the case.
+func (s *Server) checkLastShutdown(ctx context.Context) bool {
+	previous, err := s.redis.MarkRunning(ctx, s.cfg.InstanceName)
+	if err != nil {
+		log.Printf("Failed to record startup, unclean exits will go undetected: %v", err)
+		return false
+	}
+	if previous == instanceRunning {
+		log.Printf("WARNING: instance %q did not shut down cleanly last time; state buffered in memory may have been lost", s.cfg.InstanceName)
+		return true
+	}
+	return false
+}
+
+// namedFlusher is a Flusher with the name its results are logged under
+type namedFlusher struct {
+	name    string
+	flusher Flusher
+}
+
+// FlushResult is the outcome of one flusher at shutdown
+type FlushResult struct {
+	Name     string
+	Err      error
+	Duration time.Duration
+}
+
+// RegisterFlusher adds a flusher to run at shutdown
+func (s *Server) RegisterFlusher(name string, f Flusher) {
+	s.flushMu.Lock()
+	defer s.flushMu.Unlock()
+	s.flushers = append(s.flushers, namedFlusher{name: name, flusher: f})
+}
+
+// Flush runs every registered flusher concurrently, giving up on those still
+// running after FLUSH_TIMEOUT, and returns their results sorted by name
+func (s *Server) Flush(ctx context.Context) []FlushResult {
+	s.flushMu.Lock()
+	flushers := append([]namedFlusher(nil), s.flushers...)
+	s.flushMu.Unlock()
+
+	ctx, cancel := context.WithTimeout(ctx, s.cfg.FlushTimeout)
+	defer cancel()
+	type indexed struct {
+		i int
+		FlushResult
+	}
+	results := make(chan indexed, len(flushers))
+	for i, f := range flushers {
+		go func(i int, f namedFlusher) {
+			start := time.Now()
+			err := f.flusher.Flush(ctx)
+			results <- indexed{i, FlushResult{Name: f.name, Err: err, Duration: time.Since(start)}}
+		}(i, f)
+	}
+
+	collected := make([]FlushResult, len(flushers))
+	finished := make([]bool, len(flushers))
+collect:
+	for remaining := len(flushers); remaining > 0; remaining-- {
+		select {
+		case r := <-results:
+			collected[r.i], finished[r.i] = r.FlushResult, true
+		case <-ctx.Done():
+			// Report the stragglers instead of waiting on them
+			for i, f := range flushers {
+				if !finished[i] {
+					collected[i] = FlushResult{Name: f.name, Err: fmt.Errorf("timed out after %s", s.cfg.FlushTimeout), Duration: s.cfg.FlushTimeout}
+				}
+			}
+			break collect
+		}
+	}
+	sort.Slice(collected, func(i, j int) bool { return collected[i].Name < collected[j].Name })
+	return collected
+}
+
+// Shutdown flushes buffered state and, when every flusher succeeded, writes
+// the clean shutdown marker. Call it once the listeners have drained.
+func (s *Server) Shutdown(ctx context.Context) error {
+	clean := true
+	for _, r := range s.Flush(ctx) {
+		if r.Err != nil {
+			clean = false
+			log.Printf("Flush %s failed after %s: %v", r.Name, r.Duration.Round(time.Millisecond), r.Err)
+		} else {
+			log.Printf("Flushed %s in %s", r.Name, r.Duration.Round(time.Millisecond))
+		}
+	}
+	if !clean {
+		return fmt.Errorf("flush failed; not marking the shutdown clean")
+	}
+	if s.cfg.ReadOnly {
+		return nil
+	}
+	return s.redis.MarkClean(ctx, s.cfg.InstanceName)
+}
+
+// Serve serves the endpoints until ctx is done, then drains the listeners
+// within SHUTDOWN_TIMEOUT and shuts the server down
+func (s *Server) Serve(ctx context.Context, endpoints ...Endpoint) error {
+	serveErr := Serve(ctx, s.cfg.ShutdownTimeout, endpoints...)
+	if err := s.Shutdown(context.Background()); err != nil {
+		log.Printf("Unclean shutdown: %v", err)
+	}
+	return serveErr
+}
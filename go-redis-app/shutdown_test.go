@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestShutdownFlushesAfterListenerDrains(t *testing.T) {
+	mr, redisClient := newTestRedis(t)
+	cfg := testConfig()
+	cfg.ShutdownTimeout = 5 * time.Second
+	server := newTestServer(t, cfg, redisClient)
+
+	var mu sync.Mutex
+	var order []string
+	record := func(event string) {
+		mu.Lock()
+		defer mu.Unlock()
+		order = append(order, event)
+	}
+	started, release := make(chan struct{}), make(chan struct{})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		record("request")
+	})
+	server.RegisterFlusher("buffer", FlusherFunc(func(context.Context) error {
+		record("flush")
+		return nil
+	}))
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- server.Serve(ctx, Endpoint{Handler: handler, Listeners: []net.Listener{l}}) }()
+
+	responded := make(chan error, 1)
+	go func() {
+		resp, err := http.Get("http://" + l.Addr().String())
+		if err == nil {
+			resp.Body.Close()
+		}
+		responded <- err
+	}()
+	<-started
+	cancel()
+
+	// The flush waits for the in-flight request
+	time.Sleep(50 * time.Millisecond)
+	mu.Lock()
+	if len(order) != 0 {
+		t.Errorf("Expected nothing flushed while a request is in flight, got %v", order)
+	}
+	mu.Unlock()
+	close(release)
+
+	if err := <-done; err != nil {
+		t.Fatalf("Serve failed: %v", err)
+	}
+	if err := <-responded; err != nil {
+		t.Errorf("Expected the in-flight request to complete, got %v", err)
+	}
+	if want := []string{"request", "flush"}; !reflect.DeepEqual(order, want) {
+		t.Errorf("Expected %v, got %v", want, order)
+	}
+	if got, _ := mr.Get(shutdownMarkerKey("test")); got != instanceClean {
+		t.Errorf("Expected the clean shutdown marker, got %q", got)
+	}
+}
+
+func TestFlushConcurrentWithTimeout(t *testing.T) {
+	mr, redisClient := newTestRedis(t)
+	cfg := testConfig()
+	cfg.FlushTimeout = 100 * time.Millisecond
+	server := newTestServer(t, cfg, redisClient)
+
+	// a and b only finish if they run at the same time
+	var barrier sync.WaitGroup
+	barrier.Add(2)
+	meet := FlusherFunc(func(ctx context.Context) error {
+		barrier.Done()
+		barrier.Wait()
+		return nil
+	})
+	stuck := make(chan struct{})
+	defer close(stuck)
+	server.RegisterFlusher("b", meet)
+	server.RegisterFlusher("a", meet)
+	server.RegisterFlusher("failing", FlusherFunc(func(context.Context) error { return errors.New("redis down") }))
+	server.RegisterFlusher("stuck", FlusherFunc(func(context.Context) error {
+		<-stuck
+		return nil
+	}))
+
+	start := time.Now()
+	results := server.Flush(context.Background())
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected the flush bounded by FLUSH_TIMEOUT, took %s", elapsed)
+	}
+	if len(results) != 4 {
+		t.Fatalf("Expected 4 results, got %+v", results)
+	}
+	for i, want := range []string{"a", "b", "failing", "stuck"} {
+		if results[i].Name != want {
+			t.Errorf("Expected %s at %d, got %+v", want, i, results[i])
+		}
+	}
+	if results[0].Err != nil || results[1].Err != nil {
+		t.Errorf("Expected a and b to flush concurrently, got %+v", results[:2])
+	}
+	if results[2].Err == nil || results[3].Err == nil || !strings.Contains(results[3].Err.Error(), "timed out") {
+		t.Errorf("Expected the failure and the timeout reported, got %+v", results[2:])
+	}
+
+	barrier.Add(2)
+	if err := server.Shutdown(context.Background()); err == nil {
+		t.Error("Expected Shutdown to report the failed flush")
+	}
+	if got, _ := mr.Get(shutdownMarkerKey("test")); got != instanceRunning {
+		t.Errorf("Expected no clean marker after a failed flush, got %q", got)
+	}
+}
+
+func TestUncleanShutdownDetection(t *testing.T) {
+	mr, redisClient := newTestRedis(t)
+	ctx := context.Background()
+	cfg := testConfig()
+
+	first := NewServer(cfg, redisClient, systemClock{}, nil)
+	if first.checkLastShutdown(ctx) {
+		t.Error("Expected no warning on the instance's first start")
+	}
+	if ttl := mr.TTL(shutdownMarkerKey("test")); ttl != shutdownMarkerTTL {
+		t.Errorf("Expected the marker to expire after %s, got %s", shutdownMarkerTTL, ttl)
+	}
+
+	// The first run exits without shutting down
+	second := NewServer(cfg, redisClient, systemClock{}, nil)
+	if !second.checkLastShutdown(ctx) {
+		t.Error("Expected an unclean exit detected")
+	}
+	if err := second.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown failed: %v", err)
+	}
+	if NewServer(cfg, redisClient, systemClock{}, nil).checkLastShutdown(ctx) {
+		t.Error("Expected no warning after a clean shutdown")
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCanonicalRequest(t *testing.T) {
+	got := string(CanonicalRequest("PUT", "/admin/flags?x=1", "1700000000", []byte(`{"a":1}`)))
+	want := "PUT\n/admin/flags?x=1\n1700000000\n{\"a\":1}"
+	if got != want {
+		t.Errorf("Expected %q, got %q", want, got)
+	}
+}
+
+func TestSignedAdminRequests(t *testing.T) {
+	_, redisClient := newTestRedis(t)
+	cfg := testConfig()
+	cfg.AdminHMACSecret = "shared-secret"
+	router := newTestServer(t, cfg, redisClient).Router()
+	secret := []byte(cfg.AdminHMACSecret)
+
+	send := func(req *http.Request) int {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+	newReq := func(body string) *http.Request {
+		req := httptest.NewRequest("PUT", "/admin/flags", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		return req
+	}
+
+	tests := []struct {
+		name   string
+		build  func() *http.Request
+		status int
+	}{
+		{"valid signature", func() *http.Request {
+			req := newReq(`{"dedupe": true}`)
+			SignRequest(req, secret, time.Now())
+			return req
+		}, http.StatusOK},
+		{"small clock skew", func() *http.Request {
+			req := newReq(`{"dedupe": true}`)
+			SignRequest(req, secret, time.Now().Add(2*time.Minute))
+			return req
+		}, http.StatusOK},
+		{"expired timestamp", func() *http.Request {
+			req := newReq(`{"dedupe": true}`)
+			SignRequest(req, secret, time.Now().Add(-6*time.Minute))
+			return req
+		}, http.StatusUnauthorized},
+		{"future timestamp", func() *http.Request {
+			req := newReq(`{"dedupe": true}`)
+			SignRequest(req, secret, time.Now().Add(6*time.Minute))
+			return req
+		}, http.StatusUnauthorized},
+		{"tampered body", func() *http.Request {
+			req := newReq(`{"dedupe": true}`)
+			SignRequest(req, secret, time.Now())
+			tampered := newReq(`{"dedupe": false}`)
+			tampered.Header = req.Header
+			return tampered
+		}, http.StatusUnauthorized},
+		{"tampered timestamp", func() *http.Request {
+			req := newReq(`{"dedupe": true}`)
+			SignRequest(req, secret, time.Now())
+			req.Header.Set(timestampHeader, strconv.FormatInt(time.Now().Unix()+1, 10))
+			return req
+		}, http.StatusUnauthorized},
+		{"wrong secret", func() *http.Request {
+			req := newReq(`{"dedupe": true}`)
+			SignRequest(req, []byte("other"), time.Now())
+			return req
+		}, http.StatusUnauthorized},
+		{"unsigned", func() *http.Request {
+			return newReq(`{"dedupe": true}`)
+		}, http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := send(tt.build()); got != tt.status {
+				t.Errorf("Expected %d, got %d", tt.status, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// EVENT_SINKS names
+const (
+	sinkStream = "stream"
+	sinkLog    = "log"
+	sinkKafka  = "kafka"
+)
+
+// EVENT_SINK_OVERFLOW policies
+const (
+	overflowDrop  = "drop"
+	overflowBlock = "block"
+)
+
+// visitEventsStreamKey holds the visit events of the stream sink, apart
+// from the live events of EVENTS_BACKEND=stream
+var visitEventsStreamKey = key("events", "visits")
+
+// VisitEvent describes a counted visit, as published to the event sinks
+type VisitEvent struct {
+	Page       string    `json:"page"`
+	Visits     int64     `json:"visits"`
+	Visitor    string    `json:"visitor"`
+	Variant    string    `json:"variant,omitempty"`
+	Country    string    `json:"country,omitempty"`
+	Weight     float64   `json:"weight,omitempty"`
+	SampleRate float64   `json:"sample_rate,omitempty"`
+	FirstVisit bool      `json:"first_visit,omitempty"`
+	RequestID  string    `json:"request_id,omitempty"`
+	Timestamp  time.Time `json:"timestamp"`
+}
+
+// EventSink receives every counted visit. Publish is called from one
+// dispatcher goroutine, never from the visit request, so a slow sink only
+// fills the dispatcher's buffer. Sinks that buffer events themselves also
+// implement Flusher, and io.Closer to release their connections.
+type EventSink interface {
+	Publish(ctx context.Context, event VisitEvent) error
+}
+
+// logSink writes each visit event to the log as JSON
+type logSink struct{}
+
+// Publish implements EventSink
+func (logSink) Publish(_ context.Context, event VisitEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	log.Printf("Visit event: %s", data)
+	return nil
+}
+
+// streamSink appends visit events to a Redis Stream capped at about maxLen
+// entries, for consumers reading it with XREAD or a consumer group
+type streamSink struct {
+	redis  *RedisClient
+	maxLen int64
+}
+
+// Publish implements EventSink
+func (s *streamSink) Publish(ctx context.Context, event VisitEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	return s.redis.client.XAdd(ctx, &redis.XAddArgs{
+		Stream: visitEventsStreamKey,
+		MaxLen: s.maxLen,
+		Approx: true,
+		Values: []interface{}{"data", data},
+	}).Err()
+}
+
+// namedSink is a sink with the EVENT_SINKS name it is reported under
+type namedSink struct {
+	name string
+	sink EventSink
+}
+
+// EventDispatcher hands visit events to the sinks through a bounded buffer.
+// When the buffer is full, the drop policy drops the event and the block
+// policy holds the visit until there is room or its request ends.
+type EventDispatcher struct {
+	events chan VisitEvent
+	sinks  []namedSink
+	block  bool
+	done   chan struct{}
+
+	// closeMu guards closing events against visits still sending to it
+	closeMu sync.RWMutex
+	closed  bool
+
+	mu        sync.Mutex
+	dropped   int64
+	published map[string]int64
+	failed    map[string]int64
+}
+
+// newEventDispatcher creates a dispatcher buffering up to buffer events for
+// sinks, blocking visits on overflow when block is set
+func newEventDispatcher(sinks []namedSink, buffer int, block bool) *EventDispatcher {
+	return &EventDispatcher{
+		events:    make(chan VisitEvent, buffer),
+		sinks:     sinks,
+		block:     block,
+		done:      make(chan struct{}),
+		published: make(map[string]int64),
+		failed:    make(map[string]int64),
+	}
+}
+
+// newServerEventDispatcher builds the sinks of EVENT_SINKS, nil when none
+// are configured
+func newServerEventDispatcher(cfg Config, redisClient *RedisClient) *EventDispatcher {
+	if len(cfg.EventSinks) == 0 {
+		return nil
+	}
+	sinks := make([]namedSink, 0, len(cfg.EventSinks))
+	for _, name := range cfg.EventSinks {
+		switch name {
+		case sinkStream:
+			sinks = append(sinks, namedSink{name, &streamSink{redis: redisClient, maxLen: cfg.EventsStreamMaxLen}})
+		case sinkLog:
+			sinks = append(sinks, namedSink{name, logSink{}})
+		case sinkKafka:
+			sinks = append(sinks, namedSink{name, newKafkaSink(newKafkaWriter(cfg), int(cfg.KafkaBatchSize), cfg.KafkaBatchTimeout)})
+		}
+	}
+	return newEventDispatcher(sinks, int(cfg.EventSinkBuffer), cfg.EventSinkOverflow == overflowBlock)
+}
+
+// start runs the dispatcher until Flush closes it. Events keep ctx's values
+// but not its cancellation, so those still buffered at shutdown are sent.
+func (d *EventDispatcher) start(ctx context.Context) {
+	for _, s := range d.sinks {
+		if k, ok := s.sink.(*kafkaSink); ok {
+			k.start(ctx)
+		}
+	}
+	ctx = context.WithoutCancel(ctx)
+	go func() {
+		defer close(d.done)
+		for event := range d.events {
+			for _, s := range d.sinks {
+				err := s.sink.Publish(ctx, event)
+				d.mu.Lock()
+				if err != nil {
+					d.failed[s.name]++
+				} else {
+					d.published[s.name]++
+				}
+				d.mu.Unlock()
+				if err != nil {
+					log.Printf("Event sink %s failed to publish a visit of %s: %v", s.name, event.Page, err)
+				}
+			}
+		}
+	}()
+}
+
+// enqueue buffers a visit event for the sinks, reporting whether it was
+// accepted
+func (d *EventDispatcher) enqueue(ctx context.Context, event VisitEvent) bool {
+	d.closeMu.RLock()
+	defer d.closeMu.RUnlock()
+	if d.closed {
+		return d.drop()
+	}
+	select {
+	case d.events <- event:
+		return true
+	default:
+	}
+	if !d.block {
+		return d.drop()
+	}
+	select {
+	case d.events <- event:
+		return true
+	case <-ctx.Done():
+		return d.drop()
+	}
+}
+
+// drop counts an event that did not fit in the buffer
+func (d *EventDispatcher) drop() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.dropped++
+	return false
+}
+
+// Flush implements Flusher, sending the buffered events and then flushing
+// and closing the sinks. Later visits' events are dropped.
+func (d *EventDispatcher) Flush(ctx context.Context) error {
+	d.closeMu.Lock()
+	if !d.closed {
+		d.closed = true
+		close(d.events)
+	}
+	d.closeMu.Unlock()
+
+	select {
+	case <-d.done:
+	case <-ctx.Done():
+		return fmt.Errorf("%d events still buffered: %w", len(d.events), ctx.Err())
+	}
+	var errs []error
+	for _, s := range d.sinks {
+		if f, ok := s.sink.(Flusher); ok {
+			if err := f.Flush(ctx); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", s.name, err))
+			}
+		}
+		if c, ok := s.sink.(interface{ Close() error }); ok {
+			if err := c.Close(); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", s.name, err))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// write writes the event_sink_* series and those of the Kafka sink
+func (d *EventDispatcher) write(b *strings.Builder, env string) {
+	labels := func(pairs string) string {
+		if env != "" {
+			pairs = strings.TrimSuffix("env="+strconv.Quote(env)+","+pairs, ",")
+		}
+		if pairs == "" {
+			return ""
+		}
+		return "{" + pairs + "}"
+	}
+
+	d.mu.Lock()
+	b.WriteString("# HELP event_sink_events_total Visit events handed to each sink, by result.\n")
+	b.WriteString("# TYPE event_sink_events_total counter\n")
+	for _, s := range d.sinks {
+		for _, result := range []struct {
+			name string
+			n    int64
+		}{{"published", d.published[s.name]}, {"failed", d.failed[s.name]}} {
+			fmt.Fprintf(b, "event_sink_events_total%s %d\n", labels("sink="+strconv.Quote(s.name)+",result="+strconv.Quote(result.name)), result.n)
+		}
+	}
+	b.WriteString("# HELP event_sink_dropped_total Visit events dropped because the sink buffer was full.\n")
+	b.WriteString("# TYPE event_sink_dropped_total counter\n")
+	fmt.Fprintf(b, "event_sink_dropped_total%s %d\n", labels(""), d.dropped)
+	d.mu.Unlock()
+
+	b.WriteString("# HELP event_sink_buffered Visit events waiting for the sinks.\n")
+	b.WriteString("# TYPE event_sink_buffered gauge\n")
+	fmt.Fprintf(b, "event_sink_buffered%s %d\n", labels(""), len(d.events))
+
+	for _, s := range d.sinks {
+		if k, ok := s.sink.(*kafkaSink); ok {
+			k.write(b, labels)
+		}
+	}
+}
+
+// startEventSinks starts the event dispatcher and has it drained at
+// shutdown
+func (s *Server) startEventSinks(ctx context.Context) {
+	if s.sinks == nil {
+		return
+	}
+	s.sinks.start(ctx)
+	s.RegisterFlusher("event sinks", s.sinks)
+}
+
+// errUnknownEventSink is returned by parseEventSinks
+var errUnknownEventSink = errors.New("must list stream, log or kafka")
+
+// parseEventSinks validates EVENT_SINKS, dropping duplicates
+func parseEventSinks(names []string) ([]string, error) {
+	seen := make(map[string]bool, len(names))
+	var sinks []string
+	for _, name := range names {
+		switch name {
+		case sinkStream, sinkLog, sinkKafka:
+		default:
+			return nil, fmt.Errorf("%w, got %q", errUnknownEventSink, name)
+		}
+		if !seen[name] {
+			seen[name] = true
+			sinks = append(sinks, name)
+		}
+	}
+	return sinks, nil
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// gatedSink records the events it is handed, holding each Publish until
+// the test releases it
+type gatedSink struct {
+	received chan VisitEvent
+	release  chan struct{}
+	fail     bool
+
+	mu     sync.Mutex
+	events []VisitEvent
+}
+
+func newGatedSink() *gatedSink {
+	return &gatedSink{received: make(chan VisitEvent, 100), release: make(chan struct{})}
+}
+
+func (s *gatedSink) Publish(_ context.Context, event VisitEvent) error {
+	s.received <- event
+	<-s.release
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = append(s.events, event)
+	if s.fail {
+		return errors.New("sink down")
+	}
+	return nil
+}
+
+func (s *gatedSink) published() []VisitEvent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]VisitEvent(nil), s.events...)
+}
+
+// fillDispatcher starts d with sink holding the first event, then fills the
+// buffer behind it
+func fillDispatcher(t *testing.T, d *EventDispatcher, sink *gatedSink) {
+	t.Helper()
+	d.start(context.Background())
+	if !d.enqueue(context.Background(), VisitEvent{Page: "held"}) {
+		t.Fatal("Expected the first event accepted")
+	}
+	<-sink.received
+	for i := 0; i < cap(d.events); i++ {
+		if !d.enqueue(context.Background(), VisitEvent{Page: "buffered"}) {
+			t.Fatalf("Expected event %d to fit in the buffer", i)
+		}
+	}
+}
+
+func TestEventDispatcherDropsOnOverflow(t *testing.T) {
+	sink := newGatedSink()
+	d := newEventDispatcher([]namedSink{{"gated", sink}}, 2, false)
+	fillDispatcher(t, d, sink)
+
+	start := time.Now()
+	if d.enqueue(context.Background(), VisitEvent{Page: "overflow"}) {
+		t.Error("Expected the event past the buffer dropped")
+	}
+	if time.Since(start) > 100*time.Millisecond {
+		t.Error("Expected dropping not to wait for the sink")
+	}
+
+	close(sink.release)
+	if err := d.Flush(context.Background()); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	if got := sink.published(); len(got) != 3 || got[0].Page != "held" || got[2].Page != "buffered" {
+		t.Errorf("Expected the held and buffered events published, got %+v", got)
+	}
+	if d.enqueue(context.Background(), VisitEvent{Page: "late"}) {
+		t.Error("Expected events after the flush dropped")
+	}
+
+	var b strings.Builder
+	d.write(&b, "")
+	for _, want := range []string{
+		`event_sink_events_total{sink="gated",result="published"} 3`,
+		`event_sink_events_total{sink="gated",result="failed"} 0`,
+		"event_sink_dropped_total 2",
+		"event_sink_buffered 0",
+	} {
+		if !strings.Contains(b.String(), want+"\n") {
+			t.Errorf("Expected %s in\n%s", want, b.String())
+		}
+	}
+}
+
+func TestEventDispatcherBlocksOnOverflow(t *testing.T) {
+	sink := newGatedSink()
+	d := newEventDispatcher([]namedSink{{"gated", sink}}, 1, true)
+	fillDispatcher(t, d, sink)
+
+	accepted := make(chan bool)
+	go func() { accepted <- d.enqueue(context.Background(), VisitEvent{Page: "blocked"}) }()
+	select {
+	case <-accepted:
+		t.Fatal("Expected the visit held while the buffer is full")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// A visit whose request ends gives up
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if d.enqueue(ctx, VisitEvent{Page: "abandoned"}) {
+		t.Error("Expected the abandoned visit's event dropped")
+	}
+
+	sink.release <- struct{}{}
+	if !<-accepted {
+		t.Error("Expected the held visit's event accepted once there was room")
+	}
+	close(sink.release)
+	d.Flush(context.Background())
+	if got := sink.published(); len(got) != 3 || got[2].Page != "blocked" {
+		t.Errorf("Expected the blocked event published last, got %+v", got)
+	}
+	var b strings.Builder
+	d.write(&b, "staging")
+	if !strings.Contains(b.String(), `event_sink_dropped_total{env="staging"} 1`+"\n") {
+		t.Errorf("Expected only the abandoned event dropped, got\n%s", b.String())
+	}
+}
+
+func TestEventDispatcherFailures(t *testing.T) {
+	failing, working := newGatedSink(), newGatedSink()
+	failing.fail = true
+	close(failing.release)
+	close(working.release)
+	d := newEventDispatcher([]namedSink{{"failing", failing}, {"working", working}}, 10, false)
+	d.start(context.Background())
+	d.enqueue(context.Background(), VisitEvent{Page: "home"})
+	d.Flush(context.Background())
+
+	if len(working.published()) != 1 {
+		t.Error("Expected a failing sink not to hold back the others")
+	}
+	var b strings.Builder
+	d.write(&b, "")
+	for _, want := range []string{
+		`event_sink_events_total{sink="failing",result="failed"} 1`,
+		`event_sink_events_total{sink="working",result="published"} 1`,
+	} {
+		if !strings.Contains(b.String(), want+"\n") {
+			t.Errorf("Expected %s in\n%s", want, b.String())
+		}
+	}
+}
+
+func TestStreamSinkVisits(t *testing.T) {
+	_, redisClient := newTestRedis(t)
+	cfg := testConfig()
+	cfg.EventSinks = []string{sinkStream, sinkLog}
+	cfg.EventSinkBuffer = 16
+	cfg.EventsStreamMaxLen = 100
+	server := newTestServer(t, cfg, redisClient)
+	router := server.Router()
+	doRequest(router, "GET", "/visit/home", "", map[string]string{"X-Request-ID": "req-1"})
+	doRequest(router, "GET", "/visit/home", "", nil)
+
+	if err := server.sinks.Flush(context.Background()); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	entries, err := redisClient.client.XRange(context.Background(), visitEventsStreamKey, "-", "+").Result()
+	if err != nil || len(entries) != 2 {
+		t.Fatalf("Expected both visits in the stream, got %v, %v", entries, err)
+	}
+	var event VisitEvent
+	json.Unmarshal([]byte(entries[0].Values["data"].(string)), &event)
+	if event.Page != "home" || event.Visits != 1 || !event.FirstVisit || event.RequestID != "req-1" || event.Visitor == "" {
+		t.Errorf("Unexpected event %+v", event)
+	}
+	w := doRequest(router, "GET", "/metrics", "", nil)
+	if !strings.Contains(w.Body.String(), `event_sink_events_total{sink="stream",result="published"} 2`) {
+		t.Errorf("Expected the sink series in the metrics, got\n%s", w.Body.String())
+	}
+}
+
+func TestParseEventSinks(t *testing.T) {
+	sinks, err := parseEventSinks([]string{"kafka", "log", "kafka"})
+	if err != nil || len(sinks) != 2 || sinks[0] != sinkKafka || sinks[1] != sinkLog {
+		t.Errorf("Expected kafka and log once each, got %v, %v", sinks, err)
+	}
+	if _, err := parseEventSinks([]string{"stdout"}); !errors.Is(err, errUnknownEventSink) {
+		t.Errorf("Expected an unknown sink rejected, got %v", err)
+	}
+}
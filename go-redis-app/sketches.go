@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	topKKey = "visits:topk"
+	cmsKey  = "visits:cms"
+
+	// topKSize bounds the approximate leaderboard
+	topKSize = 1000
+
+	// trendingTopKPrefix holds a Top-K of each trending window, named by
+	// the window's start in Unix seconds
+	trendingTopKPrefix = "visits:topk:trending:"
+
+	// trendingWindowsPerHalfLife is how many trending windows a half-life
+	// spans
+	trendingWindowsPerHalfLife = 2
+
+	// trendingTopKWindows is how many windows are merged, the oldest
+	// weighted about trendingMinScore
+	trendingTopKWindows = 14
+)
+
+// trendingTopKScript adds a visit to the Top-K of its trending window,
+// reserving it on the window's first visit with an expiry past the last
+// read that merges it.
+//
+// KEYS[1] the window's Top-K; ARGV[1] page, ARGV[2] weight, ARGV[3] Top-K
+// size, ARGV[4] expiry in milliseconds
+var trendingTopKScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	redis.call('TOPK.RESERVE', KEYS[1], ARGV[3], 8, 7, 0.925)
+	redis.call('PEXPIRE', KEYS[1], ARGV[4])
+end
+return redis.call('TOPK.INCRBY', KEYS[1], ARGV[1], ARGV[2])
+`)
+
+// parseModuleList extracts module names from a MODULE LIST reply, which is
+// an array of name/value pair arrays in RESP2 or an array of maps in RESP3
+func parseModuleList(reply interface{}) map[string]bool {
+	modules := make(map[string]bool)
+	entries, _ := reply.([]interface{})
+	for _, entry := range entries {
+		switch e := entry.(type) {
+		case []interface{}:
+			for i := 0; i+1 < len(e); i += 2 {
+				if key, _ := e[i].(string); key == "name" {
+					if name, ok := e[i+1].(string); ok {
+						modules[strings.ToLower(name)] = true
+					}
+				}
+			}
+		case map[interface{}]interface{}:
+			if name, ok := e["name"].(string); ok {
+				modules[strings.ToLower(name)] = true
+			}
+		}
+	}
+	return modules
+}
+
+// Modules returns the names of the modules loaded on the Redis server
+func (r *RedisClient) Modules(ctx context.Context) (map[string]bool, error) {
+	reply, err := r.client.Do(ctx, "MODULE", "LIST").Result()
+	if err != nil {
+		return nil, err
+	}
+	return parseModuleList(reply), nil
+}
+
+// EnableSketches switches the top pages and approximate counts to RedisBloom
+// Top-K and Count-Min Sketch structures when the module is loaded, reporting
+// whether sketches are in use. Trending is then counted in a Top-K per
+// window, decayed by halfLife when merged.
+func (r *RedisClient) EnableSketches(ctx context.Context, modules map[string]bool, halfLife time.Duration) (bool, error) {
+	if !modules["bf"] {
+		return false, nil
+	}
+	r.trendingHalfLife = halfLife
+	if r.readOnly {
+		// Use the structures only if a writable instance created them
+		n, err := r.client.Exists(ctx, topKKey, cmsKey).Result()
+		if err != nil {
+			return false, fmt.Errorf("checking sketches: %w", err)
+		}
+		r.sketches = n == 2
+		return r.sketches, nil
+	}
+
+	if err := r.client.Do(ctx, "TOPK.RESERVE", topKKey, topKSize, 8, 7, 0.925).Err(); err != nil && !isItemExists(err) {
+		return false, fmt.Errorf("reserving top-k: %w", err)
+	}
+	if err := r.client.Do(ctx, "CMS.INITBYPROB", cmsKey, 0.0001, 0.001).Err(); err != nil && !isItemExists(err) {
+		return false, fmt.Errorf("initializing count-min sketch: %w", err)
+	}
+
+	r.sketches = true
+	return true, nil
+}
+
+// isItemExists reports whether a RedisBloom create failed because the key exists
+func isItemExists(err error) bool {
+	return strings.Contains(strings.ToLower(err.Error()), "item exists") ||
+		strings.Contains(strings.ToLower(err.Error()), "key already exists")
+}
+
+// isApproximatePage reports whether the page is counted only in the sketch
+func (s *Server) isApproximatePage(page string) bool {
+	if !s.redis.sketches {
+		return false
+	}
+	for _, prefix := range s.cfg.ApproximatePagePrefixes {
+		if strings.HasPrefix(page, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// queueSketchVisit adds the sketch updates for a visit at now to the
+// pipeline, returning the CMS count command when the page is approximate
+func (r *RedisClient) queueSketchVisit(ctx context.Context, pipe redis.Pipeliner, page string, approximate bool, weight int64, now time.Time) *redis.Cmd {
+	pipe.Do(ctx, "TOPK.INCRBY", topKKey, page, weight)
+	window := r.trendingWindow()
+	expiry := (trendingTopKWindows + 1) * window
+	trendingTopKScript.Eval(ctx, pipe, []string{trendingTopKKey(now.Truncate(window))}, page, weight, topKSize, expiry.Milliseconds())
+	if approximate {
+		return pipe.Do(ctx, "CMS.INCRBY", cmsKey, page, weight)
+	}
+	return nil
+}
+
+// ApproximateCount returns the Count-Min Sketch estimate for a page
+func (r *RedisClient) ApproximateCount(ctx context.Context, page string) (int64, error) {
+	counts, err := r.client.Do(ctx, "CMS.QUERY", cmsKey, page).Int64Slice()
+	if err != nil {
+		return 0, err
+	}
+	if len(counts) == 0 {
+		return 0, nil
+	}
+	return counts[0], nil
+}
+
+// topKPages returns the Top-K list with estimated counts
+func (r *RedisClient) topKPages(ctx context.Context, limit int64, exclude map[string]bool) ([]PageCount, error) {
+	reply, err := r.client.Do(ctx, "TOPK.LIST", topKKey, "WITHCOUNT").Slice()
+	if err != nil {
+		return nil, err
+	}
+	pages := make([]PageCount, 0, limit)
+	for i := 0; i+1 < len(reply) && int64(len(pages)) < limit; i += 2 {
+		page, _ := reply[i].(string)
+		count, _ := reply[i+1].(int64)
+		if page == "" || exclude[page] {
+			continue
+		}
+		pages = append(pages, PageCount{Page: page, Visits: count})
+	}
+	return pages, nil
+}
+
+// trendingWindow returns the length of a trending Top-K window
+func (r *RedisClient) trendingWindow() time.Duration {
+	return r.trendingHalfLife / trendingWindowsPerHalfLife
+}
+
+// trendingTopKKey returns the Top-K of the trending window starting at start
+func trendingTopKKey(start time.Time) string {
+	return trendingTopKPrefix + strconv.FormatInt(start.Unix(), 10)
+}
+
+// trendingTopKPages merges the Top-K of the last trendingTopKWindows
+// windows into up to limit pages, skipping excluded pages. Each window's
+// counts are decayed by its age, the current window's by none, so the
+// scores follow the sorted set's decay a window at a time.
+func (r *RedisClient) trendingTopKPages(ctx context.Context, now time.Time, limit int64, exclude map[string]bool) ([]TrendingPage, error) {
+	window := r.trendingWindow()
+	start := now.Truncate(window)
+	pipe := r.client.Pipeline()
+	lists := make([]*redis.Cmd, trendingTopKWindows)
+	for i := range lists {
+		lists[i] = pipe.Do(ctx, "TOPK.LIST", trendingTopKKey(start.Add(-time.Duration(i)*window)), "WITHCOUNT")
+	}
+	// Errors are checked per window, as one without visits is missing
+	pipe.Exec(ctx)
+
+	scores := make(map[string]float64)
+	for i, list := range lists {
+		reply, err := list.Slice()
+		if isMissingSketch(err) {
+			continue
+		}
+		if err != nil {
+			return nil, wrapError(err)
+		}
+		factor := decayFactor(time.Duration(i)*window, r.trendingHalfLife)
+		for j := 0; j+1 < len(reply); j += 2 {
+			page, _ := reply[j].(string)
+			count, _ := reply[j+1].(int64)
+			if page != "" && !exclude[page] {
+				scores[page] += float64(count) * factor
+			}
+		}
+	}
+
+	pages := make([]TrendingPage, 0, len(scores))
+	for page, score := range scores {
+		if score >= trendingMinScore {
+			pages = append(pages, TrendingPage{Page: page, Score: score})
+		}
+	}
+	sort.Slice(pages, func(i, j int) bool {
+		if pages[i].Score != pages[j].Score {
+			return pages[i].Score > pages[j].Score
+		}
+		return pages[i].Page < pages[j].Page
+	})
+	if int64(len(pages)) > limit {
+		pages = pages[:limit]
+	}
+	return pages, nil
+}
+
+// isMissingSketch reports whether a RedisBloom command failed because its
+// key does not exist
+func isMissingSketch(err error) bool {
+	return err != nil && strings.Contains(strings.ToLower(err.Error()), "does not exist")
+}
+
+// firstInt64 returns the first element of an integer array reply
+func firstInt64(cmd *redis.Cmd) (int64, error) {
+	values, err := cmd.Int64Slice()
+	if err != nil {
+		return 0, err
+	}
+	if len(values) == 0 {
+		return 0, nil
+	}
+	return values[0], nil
+}
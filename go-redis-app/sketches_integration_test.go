@@ -0,0 +1,89 @@
+//go:build integration
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"testing"
+	"time"
+
+	"go-redis-app/internal/clocktest"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Run against Redis Stack with:
+//
+//	REDIS_STACK_ADDR=localhost:6379 go test -tags integration -run Sketch
+func newRedisStackClient(t *testing.T) *RedisClient {
+	t.Helper()
+	addr := os.Getenv("REDIS_STACK_ADDR")
+	if addr == "" {
+		t.Skip("REDIS_STACK_ADDR is not set")
+	}
+	rdb := redis.NewClient(&redis.Options{Addr: addr})
+	t.Cleanup(func() {
+		windows, _ := rdb.Keys(context.Background(), trendingTopKPrefix+"*").Result()
+		rdb.Del(context.Background(), append(windows, topKKey, cmsKey, "visits:sketch-exact", "visits:sketch-approx")...)
+		rdb.Close()
+	})
+	rdb.Del(context.Background(), topKKey, cmsKey, "visits:sketch-exact")
+	return newRedisClient(rdb)
+}
+
+func TestSketchesWithRedisBloom(t *testing.T) {
+	redisClient := newRedisStackClient(t)
+	cfg := testConfig()
+	cfg.ApproximatePagePrefixes = []string{"sketch-approx"}
+	server := newTestServer(t, cfg, redisClient)
+	router := server.Router()
+
+	if !redisClient.sketches {
+		t.Fatal("Expected RedisBloom to be detected")
+	}
+
+	for i := 0; i < 3; i++ {
+		doRequest(router, "GET", "/visit/sketch-approx", "", nil)
+	}
+	doRequest(router, "GET", "/visit/sketch-exact", "", nil)
+
+	resp := decodeVisit(t, doRequest(router, "GET", "/visits/sketch-approx", "", nil).Body.Bytes())
+	if !resp.Approximate || resp.Visits < 3 {
+		t.Errorf("Expected approximate count of at least 3, got %+v", resp)
+	}
+	if exists, _ := redisClient.client.Exists(context.Background(), "visits:sketch-approx").Result(); exists != 0 {
+		t.Error("Expected approximate page to have no exact counter")
+	}
+
+	var top PagesResponse
+	json.Unmarshal(doRequest(router, "GET", "/pages/top", "", nil).Body.Bytes(), &top)
+	if !top.Approximate || len(top.Pages) == 0 || top.Pages[0].Page != "sketch-approx" {
+		t.Errorf("Expected Top-K results, got %+v", top)
+	}
+}
+
+func TestTrendingTopKDecays(t *testing.T) {
+	redisClient := newRedisStackClient(t)
+	clock := clocktest.New(time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC))
+	router := newTestServerWithClock(t, testConfig(), redisClient, clock).Router()
+
+	for i := 0; i < 8; i++ {
+		doRequest(router, "GET", "/visit/sketch-old", "", nil)
+	}
+	// Three half-lives later the old visits weigh an eighth
+	clock.Advance(3 * time.Hour)
+	for i := 0; i < 2; i++ {
+		doRequest(router, "GET", "/visit/sketch-new", "", nil)
+	}
+
+	var trending TrendingResponse
+	json.Unmarshal(doRequest(router, "GET", "/trending", "", nil).Body.Bytes(), &trending)
+	if !trending.Approximate || trending.HalfLife != "1h0m0s" || len(trending.Pages) != 2 {
+		t.Fatalf("Expected both pages from the trending windows, got %+v", trending)
+	}
+	if trending.Pages[0].Page != "sketch-new" || trending.Pages[0].Score != 2 || trending.Pages[1].Score != 1 {
+		t.Errorf("Expected the recent page first and the old one decayed to 1, got %+v", trending.Pages)
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+)
+
+func TestParseModuleList(t *testing.T) {
+	resp2 := []interface{}{
+		[]interface{}{"name", "bf", "ver", int64(20612)},
+		[]interface{}{"name", "ReJSON", "ver", int64(20606)},
+	}
+	resp3 := []interface{}{
+		map[interface{}]interface{}{"name": "search", "ver": int64(20809)},
+	}
+
+	tests := []struct {
+		name  string
+		reply interface{}
+		want  []string
+	}{
+		{"resp2", resp2, []string{"bf", "rejson"}},
+		{"resp3", resp3, []string{"search"}},
+		{"empty", []interface{}{}, nil},
+		{"unexpected", "OK", nil},
+	}
+	for _, tt := range tests {
+		got := parseModuleList(tt.reply)
+		if len(got) != len(tt.want) {
+			t.Errorf("%s: expected %v, got %v", tt.name, tt.want, got)
+		}
+		for _, name := range tt.want {
+			if !got[name] {
+				t.Errorf("%s: expected module %q in %v", tt.name, name, got)
+			}
+		}
+	}
+}
+
+func TestSketchFallbackWithoutModule(t *testing.T) {
+	_, redisClient := newTestRedis(t)
+	cfg := testConfig()
+	cfg.ApproximatePagePrefixes = []string{"search-"}
+	server := newTestServer(t, cfg, redisClient)
+	router := server.Router()
+
+	// miniredis has no MODULE command, so exact counts are used
+	if _, err := redisClient.Modules(context.Background()); err == nil {
+		t.Fatal("Expected module detection to fail on miniredis")
+	}
+	if redisClient.sketches {
+		t.Fatal("Expected sketches to be disabled")
+	}
+
+	doRequest(router, "GET", "/visit/search-foo", "", nil)
+	resp := decodeVisit(t, doRequest(router, "GET", "/visit/search-foo", "", nil).Body.Bytes())
+	if resp.Visits != 2 || resp.Approximate {
+		t.Errorf("Expected exact count for search-foo, got %+v", resp)
+	}
+
+	var top PagesResponse
+	json.Unmarshal(doRequest(router, "GET", "/pages/top", "", nil).Body.Bytes(), &top)
+	if top.Approximate || len(top.Pages) != 1 || top.Pages[0].Visits != 2 {
+		t.Errorf("Expected exact top pages, got %+v", top)
+	}
+
+	var trending TrendingResponse
+	json.Unmarshal(doRequest(router, "GET", "/trending", "", nil).Body.Bytes(), &trending)
+	if trending.Approximate || trending.HalfLife == "" {
+		t.Errorf("Expected exact trending, got %+v", trending)
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Bucket time sources, chosen by BUCKET_TIME_SOURCE
+const (
+	bucketTimeLocal = "local"
+	bucketTimeRedis = "redis"
+)
+
+// clockSkew holds the last measured offset of the Redis clock from ours
+type clockSkew struct {
+	mu      sync.Mutex
+	skew    time.Duration
+	checked bool
+}
+
+// set records a measured skew
+func (k *clockSkew) set(skew time.Duration) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.skew, k.checked = skew, true
+}
+
+// get returns the last measured skew, and false before the first check
+func (k *clockSkew) get() (time.Duration, bool) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.skew, k.checked
+}
+
+// Time returns the Redis server's clock
+func (r *RedisClient) Time(ctx context.Context) (time.Time, error) {
+	return r.client.Time(ctx).Result()
+}
+
+// checkClockSkew is the clock skew watchdog: it compares Redis TIME with
+// our clock, taking the midpoint of the round trip as the local instant the
+// reply was made, and warns when they are further apart than
+// CLOCK_SKEW_THRESHOLD
+func (s *Server) checkClockSkew(ctx context.Context) error {
+	before := s.clock.Now()
+	remote, err := s.redis.Time(ctx)
+	if err != nil {
+		return err
+	}
+	after := s.clock.Now()
+	skew := remote.Sub(before.Add(after.Sub(before) / 2))
+	s.skew.set(skew)
+	if exceedsSkew(skew, s.cfg.ClockSkewThreshold) {
+		log.Printf("WARNING: Redis clock is %s off ours (threshold %s); daily buckets and TTLs may be misaligned", skew.Round(time.Millisecond), s.cfg.ClockSkewThreshold)
+	}
+	return nil
+}
+
+// exceedsSkew reports whether skew is larger than threshold either way
+func exceedsSkew(skew, threshold time.Duration) bool {
+	return skew > threshold || -skew > threshold
+}
+
+// bucketNow is the time visits are recorded at: our clock, or with
+// BUCKET_TIME_SOURCE=redis our clock moved by the last measured skew, so
+// replicas with drifting clocks agree with Redis on which bucket a visit
+// falls in
+func (s *Server) bucketNow() time.Time {
+	now := s.clock.Now()
+	if s.cfg.BucketTimeSource != bucketTimeRedis {
+		return now
+	}
+	if skew, ok := s.skew.get(); ok {
+		return now.Add(skew)
+	}
+	return now
+}
+
+// healthSkew returns the skew to report in /health: nil unless it exceeds
+// the threshold
+func (s *Server) healthSkew() *float64 {
+	skew, ok := s.skew.get()
+	if !ok || !exceedsSkew(skew, s.cfg.ClockSkewThreshold) {
+		return nil
+	}
+	seconds := skew.Seconds()
+	return &seconds
+}
+
+// write writes the clock_skew_seconds gauge, once a check has run
+func (k *clockSkew) write(b *strings.Builder, env string) {
+	skew, ok := k.get()
+	if !ok {
+		return
+	}
+	labels := ""
+	if env != "" {
+		labels = "{env=" + strconv.Quote(env) + "}"
+	}
+	b.WriteString("# HELP clock_skew_seconds Redis clock minus the local clock at the last check.\n")
+	b.WriteString("# TYPE clock_skew_seconds gauge\n")
+	fmt.Fprintf(b, "clock_skew_seconds%s %g\n", labels, skew.Seconds())
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"go-redis-app/internal/clocktest"
+)
+
+// skewedTime answers TIME with the clock moved by skew, standing in for a
+// Redis whose clock is off ours
+type skewedTime struct {
+	clock Clock
+	skew  time.Duration
+}
+
+func (h skewedTime) DialHook(next redis.DialHook) redis.DialHook { return next }
+
+func (h skewedTime) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		if cmd, ok := cmd.(*redis.TimeCmd); ok {
+			cmd.SetVal(h.clock.Now().Add(h.skew))
+			return nil
+		}
+		return next(ctx, cmd)
+	}
+}
+
+func (h skewedTime) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return next
+}
+
+// newSkewedServer starts a server on a fake clock just before midnight, on
+// a Redis whose clock is skew ahead
+func newSkewedServer(t *testing.T, skew time.Duration, source string) (*Server, http.Handler, *RedisClient) {
+	t.Helper()
+	_, redisClient := newTestRedis(t)
+	clock := clocktest.New(time.Date(2024, 3, 1, 23, 59, 58, 0, time.UTC))
+	redisClient.client.AddHook(skewedTime{clock: clock, skew: skew})
+	cfg := testConfig()
+	cfg.ClockSkewInterval = time.Hour
+	cfg.ClockSkewThreshold = 2 * time.Second
+	cfg.BucketTimeSource = source
+	server := newTestServerWithClock(t, cfg, redisClient, clock)
+	return server, server.Router(), redisClient
+}
+
+func TestClockSkewWarning(t *testing.T) {
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	_, router, _ := newSkewedServer(t, 5*time.Second, bucketTimeLocal)
+	if !strings.Contains(logs.String(), "WARNING: Redis clock is 5s off ours") {
+		t.Errorf("Expected a skew warning, got %q", logs.String())
+	}
+	var health map[string]interface{}
+	json.Unmarshal(doRequest(router, "GET", "/health", "", nil).Body.Bytes(), &health)
+	if health["clock_skew_seconds"] != float64(5) {
+		t.Errorf("Expected the skew in /health, got %v", health)
+	}
+	if w := doRequest(router, "GET", "/metrics", "", nil); !strings.Contains(w.Body.String(), "\nclock_skew_seconds 5\n") {
+		t.Errorf("Expected the clock_skew_seconds gauge, got %s", w.Body.String())
+	}
+
+	// Within the threshold there is neither a warning nor a /health field
+	logs.Reset()
+	_, router, _ = newSkewedServer(t, time.Second, bucketTimeLocal)
+	if strings.Contains(logs.String(), "WARNING") {
+		t.Errorf("Expected no warning, got %q", logs.String())
+	}
+	if w := doRequest(router, "GET", "/health", "", nil); strings.Contains(w.Body.String(), "clock_skew") {
+		t.Errorf("Expected no skew in /health, got %s", w.Body.String())
+	}
+}
+
+func TestBucketTimeSource(t *testing.T) {
+	// Our clock says 23:59:58 on March 1st; Redis says it is already March 2nd
+	for _, tt := range []struct {
+		source string
+		day    int
+	}{
+		{bucketTimeLocal, 1},
+		{bucketTimeRedis, 2},
+	} {
+		t.Run(tt.source, func(t *testing.T) {
+			_, router, redisClient := newSkewedServer(t, 5*time.Second, tt.source)
+			doRequest(router, "PUT", "/admin/flags", `{"rollups": true}`, nil)
+			doRequest(router, "GET", "/visit/home", "", nil)
+			day := time.Date(2024, 3, tt.day, 0, 0, 0, 0, time.UTC)
+			if n, err := redisClient.client.Get(context.Background(), dailyKey("home", day)).Int64(); err != nil || n != 1 {
+				t.Errorf("Expected the visit in the %s bucket, got %d, %v", day.Format(dayLayout), n, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// streamScanCount is the ZSCAN batch size for counter streaming
+	streamScanCount = 200
+
+	// streamFlushEvery is how many lines are written between flushes
+	streamFlushEvery = 50
+)
+
+// StreamSummary is the trailing line of a counter stream
+type StreamSummary struct {
+	Summary bool  `json:"summary"`
+	Total   int64 `json:"total"`
+}
+
+// scanLeaderboard walks the leaderboard for pages starting with prefix and
+// calls fn with each batch of page names. It stops when fn returns an error
+// or ctx is done.
+func (r *RedisClient) scanLeaderboard(ctx context.Context, prefix string, fn func([]string) error) error {
+	pattern := escapeGlob(prefix) + "*"
+	var cursor uint64
+	for {
+		entries, next, err := r.client.ZScan(ctx, leaderboardKey, cursor, pattern, streamScanCount).Result()
+		if err != nil {
+			return err
+		}
+
+		// ZSCAN returns member/score pairs
+		pages := make([]string, 0, len(entries)/2)
+		for i := 0; i < len(entries); i += 2 {
+			pages = append(pages, entries[i])
+		}
+		if len(pages) > 0 {
+			if err := fn(pages); err != nil {
+				return err
+			}
+		}
+
+		if cursor = next; cursor == 0 {
+			return nil
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+	}
+}
+
+// ScanCounters walks the leaderboard for pages starting with prefix and
+// calls emit with each batch of page counters read from their counter keys.
+// It stops when emit returns an error or ctx is done.
+func (r *RedisClient) ScanCounters(ctx context.Context, prefix string, emit func([]PageCount) error) error {
+	return r.scanLeaderboard(ctx, prefix, func(pages []string) error {
+		keys := make([]string, len(pages))
+		for i, page := range pages {
+			keys[i] = key("visits", page)
+		}
+		values, err := r.client.MGet(ctx, keys...).Result()
+		if err != nil {
+			return err
+		}
+		batch := make([]PageCount, len(pages))
+		for i, page := range pages {
+			batch[i] = PageCount{Page: page}
+			if str, ok := values[i].(string); ok {
+				batch[i].Visits, _ = strconv.ParseInt(str, 10, 64)
+			}
+		}
+		return emit(batch)
+	})
+}
+
+// handleStreamCounters writes every page counter as newline-delimited JSON
+// while scanning, so large exports never buffer in memory
+func (s *Server) handleStreamCounters(c *gin.Context) {
+	hidden, err := s.hiddenPages(c)
+	if err != nil {
+		log.Printf("Error loading private pages: %v", err)
+		respondStoreError(c, err, "Failed to stream counters")
+		return
+	}
+
+	ctx := c.Request.Context()
+	c.Header("Content-Type", "application/x-ndjson")
+	c.Status(http.StatusOK)
+	enc := json.NewEncoder(c.Writer)
+
+	var total, unflushed int64
+	err = s.redis.ScanCounters(ctx, c.Query("prefix"), func(batch []PageCount) error {
+		for _, pc := range batch {
+			if hidden[pc.Page] {
+				continue
+			}
+			if err := enc.Encode(pc); err != nil {
+				return err
+			}
+			total++
+			if unflushed++; unflushed == streamFlushEvery {
+				c.Writer.Flush()
+				unflushed = 0
+				// Stop scanning as soon as the client goes away
+				if err := ctx.Err(); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		if ctx.Err() == nil {
+			log.Printf("Error streaming counters: %v", err)
+		}
+		// Headers are already sent, so the stream simply ends early
+		return
+	}
+
+	if c.Query("summary") == "true" {
+		enc.Encode(StreamSummary{Summary: true, Total: total})
+	}
+	c.Writer.Flush()
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/redis/go-redis/v9"
+)
+
+func seedCounters(t *testing.T, redisClient *RedisClient, prefix string, n int) {
+	t.Helper()
+	ctx := context.Background()
+	for i := 0; i < n; i++ {
+		page := fmt.Sprintf("%s%03d", prefix, i)
+		redisClient.client.Set(ctx, "visits:"+page, i+1, 0)
+		redisClient.client.ZAdd(ctx, leaderboardKey, redis.Z{Member: page, Score: float64(i + 1)})
+	}
+}
+
+func TestStreamCounters(t *testing.T) {
+	_, redisClient := newTestRedis(t)
+	seedCounters(t, redisClient, "blog-", 120)
+	seedCounters(t, redisClient, "docs-", 5)
+	ts := httptest.NewServer(newTestServer(t, testConfig(), redisClient).Router())
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/stream/counters?prefix=blog-&summary=true")
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "application/x-ndjson" {
+		t.Errorf("Expected application/x-ndjson, got %q", ct)
+	}
+
+	var lines []string
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	if len(lines) != 121 {
+		t.Fatalf("Expected 120 counters and a summary, got %d lines", len(lines))
+	}
+
+	seen := make(map[string]int64)
+	for _, line := range lines[:120] {
+		var pc PageCount
+		if err := json.Unmarshal([]byte(line), &pc); err != nil {
+			t.Fatalf("Invalid line %q: %v", line, err)
+		}
+		if !strings.HasPrefix(pc.Page, "blog-") {
+			t.Errorf("Unexpected page %q for prefix blog-", pc.Page)
+		}
+		seen[pc.Page] = pc.Visits
+	}
+	if len(seen) != 120 || seen["blog-009"] != 10 {
+		t.Errorf("Expected 120 distinct counters with blog-009=10, got %d, %d", len(seen), seen["blog-009"])
+	}
+
+	var summary StreamSummary
+	json.Unmarshal([]byte(lines[120]), &summary)
+	if !summary.Summary || summary.Total != 120 {
+		t.Errorf("Unexpected summary %q", lines[120])
+	}
+}
+
+func TestStreamCountersEscapesPrefix(t *testing.T) {
+	_, redisClient := newTestRedis(t)
+	seedCounters(t, redisClient, "a", 3)
+	router := newTestServer(t, testConfig(), redisClient).Router()
+
+	w := doRequest(router, "GET", "/stream/counters?prefix=*", "", nil)
+	if body := strings.TrimSpace(w.Body.String()); body != "" {
+		t.Errorf("Expected no matches for a literal * prefix, got %q", body)
+	}
+}
+
+// disconnectingWriter cancels the request after the first flush, as if the
+// client hung up mid-stream
+type disconnectingWriter struct {
+	*httptest.ResponseRecorder
+	cancel  context.CancelFunc
+	flushes int
+}
+
+func (w *disconnectingWriter) Flush() {
+	w.flushes++
+	w.ResponseRecorder.Flush()
+	w.cancel()
+}
+
+func TestStreamCountersStopsOnDisconnect(t *testing.T) {
+	_, redisClient := newTestRedis(t)
+	seedCounters(t, redisClient, "page-", 3*streamFlushEvery)
+	router := newTestServer(t, testConfig(), redisClient).Router()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req := httptest.NewRequest("GET", "/stream/counters?summary=true", nil).WithContext(ctx)
+	w := &disconnectingWriter{ResponseRecorder: httptest.NewRecorder(), cancel: cancel}
+	router.ServeHTTP(w, req)
+
+	lines := strings.Split(strings.TrimSpace(w.Body.String()), "\n")
+	if len(lines) != streamFlushEvery {
+		t.Errorf("Expected the stream to stop after %d lines, got %d", streamFlushEvery, len(lines))
+	}
+	if w.flushes != 1 {
+		t.Errorf("Expected a single flush before stopping, got %d", w.flushes)
+	}
+	if strings.Contains(w.Body.String(), `"summary"`) {
+		t.Error("Expected no summary after a disconnect")
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+// strictWatchAttempts bounds the retries of a WATCHed transaction aborted by
+// a concurrent write before it fails with a conflict
+const strictWatchAttempts = 3
+
+// errNotAtomic is returned by the operations STRICT_CONSISTENCY refuses
+// because they cannot be applied atomically
+var errNotAtomic = errors.New("the operation cannot be applied atomically with STRICT_CONSISTENCY=true")
+
+// txPipelinedFunc runs a MULTI/EXEC transaction, on a client or within a
+// WATCH
+type txPipelinedFunc func(context.Context, func(redis.Pipeliner) error) ([]redis.Cmder, error)
+
+// writePipeline returns the pipeline for an update spanning several keys:
+// a MULTI/EXEC transaction in strict mode, so a client that dies halfway
+// through leaves none of it applied, and a plain pipeline otherwise
+func (r *RedisClient) writePipeline() redis.Pipeliner {
+	if r.strict {
+		return r.client.TxPipeline()
+	}
+	return r.client.Pipeline()
+}
+
+// watched runs fn, which reads keys and then writes with the TxPipelined it
+// is given. In strict mode the keys are WATCHed, so the write is aborted
+// and fn retried when they change in between; fn must not write otherwise.
+func (r *RedisClient) watched(ctx context.Context, fn func(txPipelinedFunc) error, keys ...string) error {
+	if !r.strict {
+		return fn(r.client.TxPipelined)
+	}
+	return r.watch(ctx, func(tx *redis.Tx) error {
+		return fn(tx.TxPipelined)
+	}, keys...)
+}
+
+// watch runs fn with keys WATCHed in every mode, retrying it up to
+// strictWatchAttempts times while a concurrent write aborts its EXEC
+func (r *RedisClient) watch(ctx context.Context, fn func(*redis.Tx) error, keys ...string) error {
+	var err error
+	for attempt := 0; attempt < strictWatchAttempts; attempt++ {
+		err = r.client.Watch(ctx, fn, keys...)
+		if !errors.Is(err, redis.TxFailedErr) {
+			return err
+		}
+	}
+	return err
+}
+
+// respondNotAtomic reports whether err is errNotAtomic, responding 409 if so
+func respondNotAtomic(c *gin.Context, err error) bool {
+	if !errors.Is(err, errNotAtomic) {
+		return false
+	}
+	respondError(c, http.StatusConflict, "strict_consistency", "This operation can't be applied atomically and is disabled by STRICT_CONSISTENCY")
+	return true
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+var errClientKilled = errors.New("client killed")
+
+// killHook stands in for a client that dies partway through a pipeline: it
+// sends only the first keep commands (MULTI included) on a connection of its
+// own, closes it before reading a reply, and fails the whole pipeline
+type killHook struct {
+	addr string
+	keep int
+}
+
+func (h killHook) DialHook(next redis.DialHook) redis.DialHook { return next }
+
+func (h killHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook { return next }
+
+func (h killHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		rdb := redis.NewClient(&redis.Options{Addr: h.addr, PoolSize: 1})
+		pipe := rdb.Pipeline()
+		for _, cmd := range cmds[:min(h.keep, len(cmds))] {
+			pipe.Do(ctx, cmd.Args()...)
+		}
+		pipe.Exec(ctx)
+		rdb.Close()
+		for _, cmd := range cmds {
+			cmd.SetErr(errClientKilled)
+		}
+		return errClientKilled
+	}
+}
+
+// newKilledRedis returns a client whose pipelines die after keep commands
+func newKilledRedis(t *testing.T, mr *miniredis.Miniredis, keep int, strict bool) *RedisClient {
+	t.Helper()
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { rdb.Close() })
+	rdb.AddHook(killHook{addr: mr.Addr(), keep: keep})
+	r := newRedisClient(rdb)
+	r.strict = strict
+	return r
+}
+
+func TestStrictVisitSurvivesKilledClient(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	for _, strict := range []bool{false, true} {
+		t.Run(fmt.Sprintf("strict=%t", strict), func(t *testing.T) {
+			mr, redisClient := newTestRedis(t)
+			killed := newKilledRedis(t, mr, 3, strict)
+			if _, err := killed.RecordVisit(context.Background(), VisitWrite{Page: "home", Visitor: "v1", Now: now, Rollup: true}); !errors.Is(err, errClientKilled) {
+				t.Fatalf("Expected the visit to fail, got %v", err)
+			}
+
+			counter, _ := mr.Get("visits:home")
+			_, bucketErr := mr.Get(dailyKey("home", now))
+			score, scoreErr := redisClient.client.ZScore(context.Background(), leaderboardKey, "home").Result()
+			if !strict {
+				// The counter and leaderboard were updated, the daily bucket never was
+				if counter != "1" || scoreErr != nil || score != 1 || bucketErr == nil {
+					t.Errorf("Expected the pipeline half applied, got counter %q, score %v (%v), bucket %v", counter, score, scoreErr, bucketErr)
+				}
+				return
+			}
+			// MULTI without EXEC: nothing was applied
+			if keys := mr.Keys(); len(keys) != 0 {
+				t.Errorf("Expected nothing written, got %v", keys)
+			}
+		})
+	}
+}
+
+// visitOnRead records a visit to page, through another client, the first
+// time the client it is added to runs MGET, as a visit landing between a
+// backfill's reads and its write would
+type visitOnRead struct {
+	once  sync.Once
+	other *RedisClient
+	page  string
+	now   time.Time
+}
+
+func (h *visitOnRead) DialHook(next redis.DialHook) redis.DialHook { return next }
+
+func (h *visitOnRead) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		if cmd.Name() == "mget" {
+			h.once.Do(func() {
+				h.other.RecordVisit(ctx, VisitWrite{Page: h.page, Visitor: "v1", Now: h.now, Rollup: true})
+			})
+		}
+		return next(ctx, cmd)
+	}
+}
+
+func (h *visitOnRead) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return next
+}
+
+func TestStrictBackfillWatchesCounter(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	rows := []backfillRow{{Day: time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC), Count: 10}}
+	for _, strict := range []bool{false, true} {
+		t.Run(fmt.Sprintf("strict=%t", strict), func(t *testing.T) {
+			mr, other := newTestRedis(t)
+			redisClient := newTestRedisClient(t, mr)
+			redisClient.strict = strict
+			mr.Set(dailyKey("home", time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)), "5")
+			redisClient.client.AddHook(&visitOnRead{other: other, page: "home", now: now})
+
+			total, err := redisClient.Backfill(context.Background(), "home", backfillModeSet, rows, nil, now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Strict mode retries the backfill; otherwise the script sums the
+			// visit's new bucket with the others
+			counter, _ := mr.Get("visits:home")
+			if total != 16 || counter != "16" {
+				t.Errorf("Expected the visit in the total, got %d and %q", total, counter)
+			}
+		})
+	}
+}
+
+func TestStrictRefusesMigration(t *testing.T) {
+	_, redisClient := newTestRedis(t)
+	redisClient.strict = true
+	router := newTestServer(t, testConfig(), redisClient).Router()
+
+	w := doRequest(router, "POST", "/admin/migrate", `{"source_prefix": "visits:", "target_prefix": "v2:"}`, nil)
+	var resp ErrorResponse
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if w.Code != http.StatusConflict || resp.Code != "strict_consistency" {
+		t.Errorf("Expected the migration refused, got %d: %s", w.Code, w.Body.String())
+	}
+	w = doRequest(router, "POST", "/admin/migrate", `{"source_prefix": "visits:", "target_prefix": "v2:", "dry_run": true}`, nil)
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected a dry run allowed, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+// BenchmarkRecordVisit compares the visit write path sent as a pipeline and
+// as a strict mode transaction
+func BenchmarkRecordVisit(b *testing.B) {
+	mr := miniredis.RunT(b)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	b.Cleanup(func() { rdb.Close() })
+	redisClient := newRedisClient(rdb)
+	ctx := context.Background()
+	for _, strict := range []bool{false, true} {
+		name := "pipelined"
+		if strict {
+			name = "strict"
+		}
+		b.Run(name, func(b *testing.B) {
+			redisClient.strict = strict
+			w := VisitWrite{Page: "home", Visitor: "v1", Now: time.Now(), Rollup: true}
+			for i := 0; i < b.N; i++ {
+				if _, err := redisClient.RecordVisit(ctx, w); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// TimestampFormat selects how response timestamps are encoded
+type TimestampFormat int
+
+const (
+	TimestampRFC3339 TimestampFormat = iota
+	TimestampUnix
+	TimestampUnixMs
+)
+
+// timestampFormatKey is the context key holding the request's TimestampFormat
+const timestampFormatKey = "timestamp_format"
+
+// ParseTimestampFormat maps a TIMESTAMP_FORMAT or ?ts= value to a format
+func ParseTimestampFormat(value string) (TimestampFormat, error) {
+	switch value {
+	case "rfc3339":
+		return TimestampRFC3339, nil
+	case "unix":
+		return TimestampUnix, nil
+	case "unix_ms":
+		return TimestampUnixMs, nil
+	}
+	return TimestampRFC3339, fmt.Errorf("unknown timestamp format %q, valid formats: rfc3339, unix, unix_ms", value)
+}
+
+// Timestamp is a time that marshals in the format chosen for the response
+type Timestamp struct {
+	Time   time.Time
+	Format TimestampFormat
+}
+
+// MarshalJSON encodes the time as an RFC3339 string or a Unix number
+func (t Timestamp) MarshalJSON() ([]byte, error) {
+	return t.appendJSON(nil), nil
+}
+
+// appendJSON appends the encoded time; RFC3339 output never needs escaping,
+// so it is quoted directly
+func (t Timestamp) appendJSON(b []byte) []byte {
+	switch t.Format {
+	case TimestampUnix:
+		return strconv.AppendInt(b, t.Time.Unix(), 10)
+	case TimestampUnixMs:
+		return strconv.AppendInt(b, t.Time.UnixMilli(), 10)
+	}
+	b = append(b, '"')
+	b = t.Time.AppendFormat(b, time.RFC3339)
+	return append(b, '"')
+}
+
+// UnmarshalJSON accepts an RFC3339 string or a Unix number; numbers above
+// 1e11 are taken as milliseconds
+func (t *Timestamp) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		parsed, err := time.Parse(time.RFC3339, s)
+		*t = Timestamp{Time: parsed, Format: TimestampRFC3339}
+		return err
+	}
+	n, err := strconv.ParseInt(string(b), 10, 64)
+	if err != nil {
+		return fmt.Errorf("timestamp must be a string or integer: %w", err)
+	}
+	if n > 1e11 {
+		*t = Timestamp{Time: time.UnixMilli(n).UTC(), Format: TimestampUnixMs}
+	} else {
+		*t = Timestamp{Time: time.Unix(n, 0).UTC(), Format: TimestampUnix}
+	}
+	return nil
+}
+
+// resolveTimestampFormat picks the request's timestamp format: ?ts= when
+// given, otherwise TIMESTAMP_FORMAT
+func (s *Server) resolveTimestampFormat(c *gin.Context) {
+	format := s.cfg.TimestampFormat
+	if ts := c.Query("ts"); ts != "" {
+		var err error
+		if format, err = ParseTimestampFormat(ts); err != nil {
+			respondError(c, http.StatusBadRequest, "invalid_request", "ts: "+err.Error())
+			return
+		}
+	}
+	c.Set(timestampFormatKey, format)
+	c.Next()
+}
+
+// stamp returns t in the request's timestamp format
+func stamp(c *gin.Context, t time.Time) Timestamp {
+	format, _ := c.Get(timestampFormatKey)
+	f, _ := format.(TimestampFormat)
+	return Timestamp{Time: t, Format: f}
+}
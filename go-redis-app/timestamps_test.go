@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"go-redis-app/internal/clocktest"
+)
+
+func TestTimestampMarshal(t *testing.T) {
+	at := time.Date(2024, 3, 1, 12, 30, 0, 250e6, time.UTC)
+	tests := map[TimestampFormat]string{
+		TimestampRFC3339: `"2024-03-01T12:30:00Z"`,
+		TimestampUnix:    `1709296200`,
+		TimestampUnixMs:  `1709296200250`,
+	}
+	for format, want := range tests {
+		b, err := json.Marshal(Timestamp{Time: at, Format: format})
+		if err != nil || string(b) != want {
+			t.Errorf("Format %d: expected %s, got %s, %v", format, want, b, err)
+		}
+		var back Timestamp
+		if err := json.Unmarshal(b, &back); err != nil || back.Format != format || back.Time.Unix() != at.Unix() {
+			t.Errorf("Format %d: round trip gave %+v, %v", format, back, err)
+		}
+	}
+
+	if _, err := ParseTimestampFormat("iso"); err == nil {
+		t.Error("Expected an error for an unknown format")
+	}
+}
+
+// rawTimestamp returns the JSON-encoded timestamp field of a response
+func rawTimestamp(t *testing.T, body []byte, field string) string {
+	t.Helper()
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(body, &raw); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	return string(raw[field])
+}
+
+func TestTimestampFormatPrecedence(t *testing.T) {
+	_, redisClient := newTestRedis(t)
+	clock := clocktest.New(time.Date(2024, 3, 1, 12, 30, 0, 250e6, time.UTC))
+	router := newTestServerWithClock(t, testConfig(), redisClient, clock).Router()
+
+	// Default is RFC3339
+	if ts := rawTimestamp(t, doRequest(router, "GET", "/visit/home", "", nil).Body.Bytes(), "timestamp"); ts != `"2024-03-01T12:30:00Z"` {
+		t.Errorf("Expected an RFC3339 string by default, got %s", ts)
+	}
+
+	// The global setting applies to every response
+	cfg := testConfig()
+	cfg.TimestampFormat = TimestampUnixMs
+	router = newTestServerWithClock(t, cfg, redisClient, clock).Router()
+	if ts := rawTimestamp(t, doRequest(router, "GET", "/health", "", nil).Body.Bytes(), "timestamp"); ts != "1709296200250" {
+		t.Errorf("Expected a Unix millisecond health timestamp, got %s", ts)
+	}
+
+	// ?ts= overrides it
+	clock.Advance(time.Minute)
+	if ts := rawTimestamp(t, doRequest(router, "GET", "/visits/home?ts=unix", "", nil).Body.Bytes(), "timestamp"); ts != "1709296260" {
+		t.Errorf("Expected a Unix second timestamp, got %s", ts)
+	}
+	if ts := rawTimestamp(t, doRequest(router, "GET", "/visits/home?ts=rfc3339", "", nil).Body.Bytes(), "timestamp"); ts != `"2024-03-01T12:31:00Z"` {
+		t.Errorf("Expected ?ts=rfc3339 to override unix_ms, got %s", ts)
+	}
+
+	if w := doRequest(router, "GET", "/visits/home?ts=iso", "", nil); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an invalid ts, got %d", w.Code)
+	}
+}
+
+func TestAuditTimestampFormat(t *testing.T) {
+	_, redisClient := newTestRedis(t)
+	clock := clocktest.New(time.Date(2024, 3, 1, 12, 30, 0, 0, time.UTC))
+	router := newTestServerWithClock(t, testConfig(), redisClient, clock).Router()
+	doRequest(router, "PUT", "/admin/flags", `{"dedupe": true}`, nil)
+
+	var resp struct {
+		Entries []struct{ Timestamp int64 } `json:"entries"`
+	}
+	json.Unmarshal(doRequest(router, "GET", "/admin/audit?ts=unix_ms", "", nil).Body.Bytes(), &resp)
+	if len(resp.Entries) != 1 || resp.Entries[0].Timestamp != clock.Now().UnixMilli() {
+		t.Errorf("Expected a Unix millisecond audit timestamp of %d, got %+v", clock.Now().UnixMilli(), resp.Entries)
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	trendingKey          = "visits:trending"
+	trendingDecayedAtKey = "visits:trending:decayed_at"
+
+	// trendingMinScore drops pages whose score has decayed to noise
+	trendingMinScore = 0.01
+)
+
+// TrendingPage is a page with its decayed activity score
+type TrendingPage struct {
+	Page  string  `json:"page"`
+	Score float64 `json:"score"`
+}
+
+// TrendingResponse represents the trending pages list
+type TrendingResponse struct {
+	Pages       []TrendingPage `json:"pages"`
+	HalfLife    string         `json:"half_life,omitempty"`
+	Approximate bool           `json:"approximate,omitempty"`
+}
+
+// decayFactor returns the multiplier applied to scores after elapsed time
+// with the given half-life
+func decayFactor(elapsed, halfLife time.Duration) float64 {
+	if elapsed <= 0 || halfLife <= 0 {
+		return 1
+	}
+	return math.Pow(0.5, elapsed.Seconds()/halfLife.Seconds())
+}
+
+// DecayTrending scales every trending score by the decay accumulated since
+// the previous run. Callers must hold the maintenance lock.
+func (r *RedisClient) DecayTrending(ctx context.Context, now time.Time, halfLife time.Duration) error {
+	last, err := r.client.Get(ctx, trendingDecayedAtKey).Int64()
+	if ignoreMissing(err) != nil {
+		return err
+	}
+
+	if err == nil {
+		factor := decayFactor(now.Sub(time.UnixMilli(last)), halfLife)
+		pipe := r.client.TxPipeline()
+		pipe.ZUnionStore(ctx, trendingKey, &redis.ZStore{Keys: []string{trendingKey}, Weights: []float64{factor}})
+		pipe.ZRemRangeByScore(ctx, trendingKey, "-inf", "("+strconv.FormatFloat(trendingMinScore, 'f', -1, 64))
+		if _, err := pipe.Exec(ctx); err != nil {
+			return err
+		}
+	}
+	return r.client.Set(ctx, trendingDecayedAtKey, now.UnixMilli(), 0).Err()
+}
+
+// TrendingPages returns up to limit pages by trending score at now,
+// skipping excluded pages. With sketches enabled the scores are merged from
+// the trending Top-K windows.
+func (r *RedisClient) TrendingPages(ctx context.Context, now time.Time, limit int64, exclude map[string]bool) ([]TrendingPage, bool, error) {
+	if r.sketches {
+		pages, err := r.trendingTopKPages(ctx, now, limit, exclude)
+		return pages, true, err
+	}
+
+	entries, err := r.client.ZRevRangeWithScores(ctx, trendingKey, 0, limit+int64(len(exclude))-1).Result()
+	if err != nil {
+		return nil, false, err
+	}
+	pages := make([]TrendingPage, 0, limit)
+	for _, z := range entries {
+		page, _ := z.Member.(string)
+		if exclude[page] {
+			continue
+		}
+		if int64(len(pages)) == limit {
+			break
+		}
+		pages = append(pages, TrendingPage{Page: page, Score: z.Score})
+	}
+	return pages, false, nil
+}
+
+// decayTrending runs one decay step under the maintenance lock
+func (s *Server) decayTrending(ctx context.Context) error {
+	release, ok, err := s.redis.AcquireMaintenanceLock(ctx, time.Minute)
+	if err != nil || !ok {
+		return err
+	}
+	defer release()
+	return s.redis.DecayTrending(ctx, s.clock.Now(), s.cfg.TrendingHalfLife)
+}
+
+// handleTrending returns the pages with the most recent activity
+func (s *Server) handleTrending(c *gin.Context) {
+	limit, ok := queryInt(c, "limit", 10, 1, 1000)
+	if !ok {
+		respondError(c, http.StatusBadRequest, "invalid_request", "limit must be between 1 and 1000")
+		return
+	}
+
+	hidden, err := s.hiddenPages(c)
+	if err != nil {
+		log.Printf("Error loading private pages: %v", err)
+		respondStoreError(c, err, "Failed to get trending pages")
+		return
+	}
+	pages, approximate, err := s.redis.TrendingPages(c.Request.Context(), s.clock.Now(), limit, hidden)
+	if err != nil {
+		log.Printf("Error getting trending pages: %v", err)
+		respondStoreError(c, err, "Failed to get trending pages")
+		return
+	}
+
+	response := TrendingResponse{Pages: pages, HalfLife: s.cfg.TrendingHalfLife.String(), Approximate: approximate}
+	respondJSON(c, http.StatusOK, response)
+}
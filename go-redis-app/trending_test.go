@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestDecayFactor(t *testing.T) {
+	tests := []struct {
+		elapsed, halfLife time.Duration
+		want              float64
+	}{
+		{0, time.Hour, 1},
+		{time.Hour, time.Hour, 0.5},
+		{2 * time.Hour, time.Hour, 0.25},
+		{30 * time.Minute, time.Hour, math.Sqrt(0.5)},
+		{-time.Minute, time.Hour, 1},
+		{time.Hour, 0, 1},
+	}
+	for _, tt := range tests {
+		if got := decayFactor(tt.elapsed, tt.halfLife); math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("decayFactor(%s, %s) = %f, want %f", tt.elapsed, tt.halfLife, got, tt.want)
+		}
+	}
+}
+
+func TestTrendingFavorsRecentActivity(t *testing.T) {
+	_, redisClient := newTestRedis(t)
+	router := newTestServer(t, testConfig(), redisClient).Router()
+	ctx := context.Background()
+	now := time.Now()
+
+	// The first run only records the baseline timestamp
+	if err := redisClient.DecayTrending(ctx, now, time.Hour); err != nil {
+		t.Fatalf("DecayTrending: %v", err)
+	}
+
+	for i := 0; i < 100; i++ {
+		doRequest(router, "GET", "/visit/old-hit", "", nil)
+	}
+
+	// Five hours later the old page has decayed to ~3 visits' worth
+	for h := 1; h <= 5; h++ {
+		if err := redisClient.DecayTrending(ctx, now.Add(time.Duration(h)*time.Hour), time.Hour); err != nil {
+			t.Fatalf("DecayTrending: %v", err)
+		}
+	}
+	for i := 0; i < 10; i++ {
+		doRequest(router, "GET", "/visit/new-hot", "", nil)
+	}
+
+	var resp TrendingResponse
+	json.Unmarshal(doRequest(router, "GET", "/trending?limit=10", "", nil).Body.Bytes(), &resp)
+	if len(resp.Pages) != 2 || resp.Pages[0].Page != "new-hot" || resp.Pages[1].Page != "old-hit" {
+		t.Fatalf("Expected new-hot ahead of old-hit, got %+v", resp.Pages)
+	}
+	if math.Abs(resp.Pages[1].Score-100.0/32) > 1e-3 {
+		t.Errorf("Expected old-hit score of 100/32, got %f", resp.Pages[1].Score)
+	}
+
+	// Lifetime leaderboard is unchanged
+	var top PagesResponse
+	json.Unmarshal(doRequest(router, "GET", "/pages/top", "", nil).Body.Bytes(), &top)
+	if top.Pages[0].Page != "old-hit" {
+		t.Errorf("Expected old-hit to lead lifetime counts, got %+v", top.Pages)
+	}
+
+	// Fully decayed pages are dropped
+	redisClient.DecayTrending(ctx, now.Add(30*time.Hour), time.Hour)
+	json.Unmarshal(doRequest(router, "GET", "/trending", "", nil).Body.Bytes(), &resp)
+	if len(resp.Pages) != 0 {
+		t.Errorf("Expected decayed pages to be removed, got %+v", resp.Pages)
+	}
+}
+
+func TestDecayTrendingHoldsMaintenanceLock(t *testing.T) {
+	mr, redisClient := newTestRedis(t)
+	server := newTestServer(t, testConfig(), redisClient)
+	ctx := context.Background()
+
+	release, ok, err := redisClient.AcquireMaintenanceLock(ctx, time.Minute)
+	if err != nil || !ok {
+		t.Fatalf("Expected to acquire lock: %v", err)
+	}
+
+	// Another replica's decay is skipped while the lock is held
+	if err := server.decayTrending(ctx); err != nil {
+		t.Fatalf("decayTrending: %v", err)
+	}
+	if mr.Exists(trendingDecayedAtKey) {
+		t.Error("Expected decay to be skipped while the lock is held")
+	}
+
+	release()
+	if err := server.decayTrending(ctx); err != nil {
+		t.Fatalf("decayTrending: %v", err)
+	}
+	if !mr.Exists(trendingDecayedAtKey) {
+		t.Error("Expected decay to run once the lock is released")
+	}
+	if mr.Exists(maintenanceLockKey) {
+		t.Error("Expected the lock to be released after decay")
+	}
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+// ttlAuditMaxEntries caps the pages listed per category; the counts still
+// cover every page
+const ttlAuditMaxEntries = 100
+
+// TTLAuditEntry is a page whose counter TTL is in a reported category
+type TTLAuditEntry struct {
+	Page string `json:"page"`
+	// TTLSeconds is the counter's TTL when audited, 0 for a persistent one
+	TTLSeconds int64 `json:"ttl_seconds"`
+	Fixed      bool  `json:"fixed,omitempty"`
+}
+
+// TTLAuditCategory lists the pages of one category of a TTL audit
+type TTLAuditCategory struct {
+	Count     int             `json:"count"`
+	Pages     []TTLAuditEntry `json:"pages"`
+	Truncated bool            `json:"truncated,omitempty"`
+}
+
+func (c *TTLAuditCategory) add(entry TTLAuditEntry) {
+	c.Count++
+	if len(c.Pages) < ttlAuditMaxEntries {
+		c.Pages = append(c.Pages, entry)
+	} else {
+		c.Truncated = true
+	}
+}
+
+// TTLAuditReport sorts the page counters whose TTL differs from the policy,
+// and those about to expire as they should
+type TTLAuditReport struct {
+	Scanned int `json:"scanned"`
+	// ShouldExpire are persistent counters under COUNTER_EXPIRING_PREFIXES
+	// or in a group with a ttl
+	ShouldExpire TTLAuditCategory `json:"persistent_should_expire"`
+	// ShouldPersist are expiring counters of every other page
+	ShouldPersist TTLAuditCategory `json:"expiring_should_persist"`
+	// ExpiringSoon are counters meant to expire with less than SoonSeconds left
+	ExpiringSoon TTLAuditCategory `json:"expiring_soon"`
+	SoonSeconds  int64            `json:"soon_seconds"`
+	Fix          bool             `json:"fix"`
+	Fixed        int              `json:"fixed"`
+}
+
+// counterShouldExpire reports whether the policy gives the page's counter a TTL
+func (s *Server) counterShouldExpire(page string) bool {
+	for _, prefix := range s.cfg.CounterExpiringPrefixes {
+		if strings.HasPrefix(page, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// counterTTLs returns the TTL the policy gives each page's counter, 0 for
+// counters that should persist: their own or their group's ttl, else
+// COUNTER_TTL under COUNTER_EXPIRING_PREFIXES
+func (s *Server) counterTTLs(ctx context.Context) (func(page string) time.Duration, error) {
+	policies, err := s.policyTTLs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return func(page string) time.Duration {
+		if ttl, ok := policies[page]; ok {
+			return ttl
+		}
+		if s.counterShouldExpire(page) {
+			return s.cfg.CounterTTL
+		}
+		return 0
+	}, nil
+}
+
+// AuditCounterTTLs checks every page counter's TTL against ttlFor, one SCAN
+// batch at a time. With fix set it PERSISTs counters that should not expire
+// (a ttlFor of 0) and gives the others their TTL; counters already expiring
+// as they should are left alone, even when soon. Callers fixing must hold
+// the maintenance lock.
+func (r *RedisClient) AuditCounterTTLs(ctx context.Context, ttlFor func(page string) time.Duration, soon time.Duration, fix bool) (TTLAuditReport, error) {
+	report := TTLAuditReport{SoonSeconds: int64(soon / time.Second), Fix: fix}
+	for _, category := range []*TTLAuditCategory{&report.ShouldExpire, &report.ShouldPersist, &report.ExpiringSoon} {
+		category.Pages = []TTLAuditEntry{}
+	}
+	err := r.scanKeysOfType(ctx, "visits:*", "string", func(keys []string) error {
+		var pages, counters []string
+		for _, key := range keys {
+			if page, ok := counterPage(key); ok {
+				pages = append(pages, page)
+				counters = append(counters, key)
+			}
+		}
+		if len(pages) == 0 {
+			return nil
+		}
+
+		pipe := r.client.Pipeline()
+		ttls := make([]*redis.DurationCmd, len(pages))
+		for i := range pages {
+			ttls[i] = pipe.PTTL(ctx, counters[i])
+		}
+		if _, err := pipe.Exec(ctx); err != nil {
+			return err
+		}
+
+		// The entry of each repair, the index -1 past ttlAuditMaxEntries
+		type listed struct {
+			category *TTLAuditCategory
+			index    int
+		}
+		repair := r.client.Pipeline()
+		var repairs []*redis.BoolCmd
+		var repaired []listed
+		queue := func(category *TTLAuditCategory, entry TTLAuditEntry, cmd *redis.BoolCmd) {
+			category.add(entry)
+			if cmd == nil {
+				return
+			}
+			index := -1
+			if !category.Truncated {
+				index = len(category.Pages) - 1
+			}
+			repairs = append(repairs, cmd)
+			repaired = append(repaired, listed{category, index})
+		}
+		for i, page := range pages {
+			left := ttls[i].Val()
+			if left == -2 {
+				// Expired or deleted since the SCAN
+				continue
+			}
+			report.Scanned++
+			entry := TTLAuditEntry{Page: page}
+			if left > 0 {
+				entry.TTLSeconds = int64(left / time.Second)
+			}
+			ttl := ttlFor(page)
+			expiring, should := left > 0, ttl > 0
+			var cmd *redis.BoolCmd
+			switch {
+			case should && !expiring:
+				if fix {
+					cmd = repair.Expire(ctx, counters[i], ttl)
+				}
+				queue(&report.ShouldExpire, entry, cmd)
+			case !should && expiring:
+				if fix {
+					cmd = repair.Persist(ctx, counters[i])
+				}
+				queue(&report.ShouldPersist, entry, cmd)
+			case expiring && left < soon:
+				queue(&report.ExpiringSoon, entry, nil)
+			}
+		}
+		if len(repairs) == 0 {
+			return nil
+		}
+		if _, err := repair.Exec(ctx); err != nil {
+			return err
+		}
+		for i, cmd := range repairs {
+			// False when the key expired in between
+			if cmd.Val() {
+				report.Fixed++
+				if at := repaired[i]; at.index >= 0 {
+					at.category.Pages[at.index].Fixed = true
+				}
+			}
+		}
+		return nil
+	})
+	return report, err
+}
+
+// handleTTLAudit reports page counters whose TTL does not match
+// COUNTER_EXPIRING_PREFIXES or their group's ttl. It only reads; fixing
+// them is POST /admin/ttl-audit/fix.
+func (s *Server) handleTTLAudit(c *gin.Context) {
+	if c.Query("fix") != "" {
+		respondError(c, http.StatusBadRequest, "invalid_request", "fix is done by POST /admin/ttl-audit/fix")
+		return
+	}
+	s.auditTTLs(c, false)
+}
+
+// handleFixTTLs is handleTTLAudit correcting the counters it reports,
+// under the maintenance lock
+func (s *Server) handleFixTTLs(c *gin.Context) {
+	s.auditTTLs(c, true)
+}
+
+// auditTTLs responds with the TTL audit, fixing the counters when fix is
+// set. soon overrides TTL_AUDIT_SOON.
+func (s *Server) auditTTLs(c *gin.Context, fix bool) {
+	soon := s.cfg.TTLAuditSoon
+	if raw := c.Query("soon"); raw != "" {
+		d, err := time.ParseDuration(raw)
+		if err != nil || d < 0 {
+			respondError(c, http.StatusBadRequest, "invalid_soon", "soon must be a non-negative duration such as 24h")
+			return
+		}
+		soon = d
+	}
+
+	ctx := c.Request.Context()
+	if fix {
+		release, ok, err := s.redis.AcquireMaintenanceLock(ctx, 10*time.Minute)
+		if err != nil {
+			log.Printf("Error taking the maintenance lock: %v", err)
+			respondStoreError(c, err, "Failed to audit counter TTLs")
+			return
+		}
+		if !ok {
+			respondError(c, http.StatusConflict, "conflict", "Maintenance is already running on another replica")
+			return
+		}
+		defer release()
+	}
+
+	ttlFor, err := s.counterTTLs(ctx)
+	if err != nil {
+		log.Printf("Error reading group TTLs: %v", err)
+		respondStoreError(c, err, "Failed to audit counter TTLs")
+		return
+	}
+	report, err := s.redis.AuditCounterTTLs(ctx, ttlFor, soon, fix)
+	if err != nil {
+		log.Printf("Error auditing counter TTLs: %v", err)
+		respondStoreError(c, err, "Failed to audit counter TTLs")
+		return
+	}
+	if report.Fixed > 0 {
+		log.Printf("TTL audit fixed %d of %d counters", report.Fixed, report.Scanned)
+	}
+	c.JSON(http.StatusOK, report)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func decodeTTLAudit(t *testing.T, body []byte) TTLAuditReport {
+	t.Helper()
+	var report TTLAuditReport
+	if err := json.Unmarshal(body, &report); err != nil {
+		t.Fatalf("Failed to decode TTL audit: %v", err)
+	}
+	return report
+}
+
+func auditedPages(category TTLAuditCategory) map[string]TTLAuditEntry {
+	pages := make(map[string]TTLAuditEntry, len(category.Pages))
+	for _, entry := range category.Pages {
+		pages[entry.Page] = entry
+	}
+	return pages
+}
+
+func TestTTLAuditClassifiesAndFixes(t *testing.T) {
+	mr, redisClient := newTestRedis(t)
+	cfg := testConfig()
+	cfg.CounterExpiringPrefixes = []string{"tmp/"}
+	cfg.CounterTTL = 72 * time.Hour
+	cfg.TTLAuditSoon = time.Hour
+	router := newTestServer(t, cfg, redisClient).Router()
+
+	for _, page := range []string{"home", "about", "tmp/draft", "tmp/preview", "tmp/launch"} {
+		mr.Set(key("visits", page), "5")
+	}
+	mr.SetTTL(key("visits", "about"), 48*time.Hour)         // should persist
+	mr.SetTTL(key("visits", "tmp/preview"), 10*time.Minute) // expiring soon
+	mr.SetTTL(key("visits", "tmp/launch"), 48*time.Hour)    // as it should
+	// Not counters
+	mr.Set(key("visits", "home", "daily", "2024-03-01"), "5")
+	mr.Set(key("visits", "dedupe", "home", "ip", "abc"), "1")
+	mr.SetTTL(key("visits", "dedupe", "home", "ip", "abc"), time.Minute)
+
+	w := doRequest(router, "GET", "/admin/ttl-audit", "", nil)
+	report := decodeTTLAudit(t, w.Body.Bytes())
+	if w.Code != http.StatusOK || report.Scanned != 5 || report.Fixed != 0 || report.SoonSeconds != 3600 {
+		t.Fatalf("Expected 5 counters audited without fixes, got %d: %s", w.Code, w.Body.String())
+	}
+	if pages := auditedPages(report.ShouldExpire); report.ShouldExpire.Count != 1 || pages["tmp/draft"].TTLSeconds != 0 {
+		t.Errorf("Expected tmp/draft persistent but meant to expire, got %+v", report.ShouldExpire)
+	}
+	if pages := auditedPages(report.ShouldPersist); report.ShouldPersist.Count != 1 || pages["about"].TTLSeconds != 48*3600 {
+		t.Errorf("Expected about expiring but meant to persist, got %+v", report.ShouldPersist)
+	}
+	if pages := auditedPages(report.ExpiringSoon); report.ExpiringSoon.Count != 1 || pages["tmp/preview"].TTLSeconds != 600 {
+		t.Errorf("Expected tmp/preview expiring soon, got %+v", report.ExpiringSoon)
+	}
+	if mr.TTL(key("visits", "about")) == 0 || mr.TTL(key("visits", "tmp/draft")) != 0 {
+		t.Error("Expected the audit alone to change nothing")
+	}
+	// The GET stays read-only
+	if w := doRequest(router, "GET", "/admin/ttl-audit?fix=true", "", nil); w.Code != http.StatusBadRequest || mr.TTL(key("visits", "about")) == 0 {
+		t.Errorf("Expected fix rejected on the GET, got %d", w.Code)
+	}
+
+	// A wider threshold takes in tmp/launch too
+	w = doRequest(router, "GET", "/admin/ttl-audit?soon=72h", "", nil)
+	if report := decodeTTLAudit(t, w.Body.Bytes()); report.ExpiringSoon.Count != 2 {
+		t.Errorf("Expected 2 pages expiring within 72h, got %s", w.Body.String())
+	}
+	if w := doRequest(router, "GET", "/admin/ttl-audit?soon=tomorrow", "", nil); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected an invalid threshold rejected, got %d", w.Code)
+	}
+
+	w = doRequest(router, "POST", "/admin/ttl-audit/fix", "", nil)
+	report = decodeTTLAudit(t, w.Body.Bytes())
+	if w.Code != http.StatusOK || report.Fixed != 2 || !report.Fix {
+		t.Fatalf("Expected 2 counters fixed, got %d: %s", w.Code, w.Body.String())
+	}
+	if !auditedPages(report.ShouldExpire)["tmp/draft"].Fixed || !auditedPages(report.ShouldPersist)["about"].Fixed {
+		t.Errorf("Expected the fixed pages marked, got %s", w.Body.String())
+	}
+	if ttl := mr.TTL(key("visits", "about")); ttl != 0 {
+		t.Errorf("Expected about persisted, got TTL %s", ttl)
+	}
+	if ttl := mr.TTL(key("visits", "tmp/draft")); ttl != 72*time.Hour {
+		t.Errorf("Expected tmp/draft given COUNTER_TTL, got %s", ttl)
+	}
+	if ttl := mr.TTL(key("visits", "tmp/preview")); ttl != 10*time.Minute {
+		t.Errorf("Expected the expiring-soon page left alone, got %s", ttl)
+	}
+	if ttl := mr.TTL(key("visits", "dedupe", "home", "ip", "abc")); ttl != time.Minute {
+		t.Errorf("Expected non-counter keys left alone, got %s", ttl)
+	}
+
+	w = doRequest(router, "GET", "/admin/ttl-audit", "", nil)
+	if report := decodeTTLAudit(t, w.Body.Bytes()); report.ShouldExpire.Count != 0 || report.ShouldPersist.Count != 0 {
+		t.Errorf("Expected nothing left to fix, got %s", w.Body.String())
+	}
+}
+
+func TestTTLAuditFixNeedsMaintenanceLock(t *testing.T) {
+	mr, redisClient := newTestRedis(t)
+	cfg := testConfig()
+	cfg.CounterTTL = time.Hour
+	router := newTestServer(t, cfg, redisClient).Router()
+	mr.Set(key("visits", "home"), "5")
+	mr.SetTTL(key("visits", "home"), time.Hour)
+
+	release, ok, err := redisClient.AcquireMaintenanceLock(context.Background(), time.Minute)
+	if err != nil || !ok {
+		t.Fatalf("Failed to take the lock: %v", err)
+	}
+	if w := doRequest(router, "POST", "/admin/ttl-audit/fix", "", nil); w.Code != http.StatusConflict {
+		t.Errorf("Expected 409 while maintenance runs, got %d", w.Code)
+	}
+	// The audit itself does not need the lock
+	if w := doRequest(router, "GET", "/admin/ttl-audit", "", nil); w.Code != http.StatusOK {
+		t.Errorf("Expected the audit served, got %d", w.Code)
+	}
+	release()
+	if mr.TTL(key("visits", "home")) != time.Hour {
+		t.Error("Expected nothing fixed while locked out")
+	}
+}
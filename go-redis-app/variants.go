@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// otherVariant collects unregistered variants in lenient mode
+const otherVariant = "other"
+
+// VARIANT_MODE values
+const (
+	variantModeStrict  = "strict"
+	variantModeLenient = "lenient"
+)
+
+// variantPattern restricts variant names to safe key segments
+var variantPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,32}$`)
+
+// VariantCount is one variant's share of a page's visits
+type VariantCount struct {
+	Variant    string  `json:"variant"`
+	Visits     int64   `json:"visits"`
+	Proportion float64 `json:"proportion"`
+}
+
+// VariantsResponse represents the per-variant counts for a page
+type VariantsResponse struct {
+	Page     string         `json:"page"`
+	Total    int64          `json:"total"`
+	Variants []VariantCount `json:"variants"`
+}
+
+// variantKey returns the counter key for one variant of a page
+func variantKey(page, variant string) string {
+	return key("visits", page, "variant", variant)
+}
+
+// resolveVariant validates ?variant= against the page's registered variants.
+// Unregistered variants are rejected in strict mode or counted as "other" in
+// lenient mode. It responds with an error and returns false when invalid.
+func (s *Server) resolveVariant(c *gin.Context, page string) (string, bool) {
+	variant := c.Query("variant")
+	if variant == "" {
+		return "", true
+	}
+
+	meta, err := s.meta.GetMeta(c.Request.Context(), page)
+	if err != nil {
+		log.Printf("Error getting page metadata: %v", err)
+		respondStoreError(c, err, "Failed to increment visit count")
+		return "", false
+	}
+	if registeredVariant(meta, variant) {
+		return variant, true
+	}
+
+	if s.cfg.StrictVariants {
+		respondError(c, http.StatusBadRequest, "unknown_variant",
+			fmt.Sprintf("Variant %q is not registered for this page, valid variants: %v", variant, meta.Variants))
+		return "", false
+	}
+	return otherVariant, true
+}
+
+// registeredVariant reports whether variant is one of the page's variants
+func registeredVariant(meta PageMeta, variant string) bool {
+	for _, registered := range meta.Variants {
+		if variant == registered {
+			return true
+		}
+	}
+	return false
+}
+
+// VariantCounts returns the counts for the given variants of a page
+func (r *RedisClient) VariantCounts(ctx context.Context, page string, variants []string) ([]int64, error) {
+	if len(variants) == 0 {
+		return nil, nil
+	}
+	keys := make([]string, len(variants))
+	for i, v := range variants {
+		keys[i] = variantKey(page, v)
+	}
+	values, err := r.client.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+	counts := make([]int64, len(values))
+	for i, v := range values {
+		if str, ok := v.(string); ok {
+			counts[i], _ = strconv.ParseInt(str, 10, 64)
+		}
+	}
+	return counts, nil
+}
+
+// variantProportions builds the response entries, each variant's share of
+// the total across all variants
+func variantProportions(variants []string, counts []int64) ([]VariantCount, int64) {
+	var total int64
+	for _, n := range counts {
+		total += n
+	}
+	result := make([]VariantCount, len(variants))
+	for i, v := range variants {
+		result[i] = VariantCount{Variant: v, Visits: counts[i]}
+		if total > 0 {
+			result[i].Proportion = float64(counts[i]) / float64(total)
+		}
+	}
+	return result, total
+}
+
+// handleGetVariants returns per-variant counts and proportions for a page
+func (s *Server) handleGetVariants(c *gin.Context) {
+	page := c.Param("page")
+	hidden, err := s.pageHidden(c, page)
+	if err != nil {
+		log.Printf("Error getting page metadata: %v", err)
+		respondStoreError(c, err, "Failed to get variant counts")
+		return
+	}
+	if hidden {
+		respondError(c, http.StatusNotFound, "not_found", "Page not found")
+		return
+	}
+
+	meta, err := s.meta.GetMeta(c.Request.Context(), page)
+	if err != nil {
+		log.Printf("Error getting page metadata: %v", err)
+		respondStoreError(c, err, "Failed to get variant counts")
+		return
+	}
+	variants := append([]string{}, meta.Variants...)
+	if !s.cfg.StrictVariants {
+		variants = append(variants, otherVariant)
+	}
+
+	counts, err := s.readVariantCounts(c.Request.Context(), page, variants)
+	if err != nil {
+		log.Printf("Error getting variant counts: %v", err)
+		respondStoreError(c, err, "Failed to get variant counts")
+		return
+	}
+
+	entries, total := variantProportions(variants, counts)
+	respondJSON(c, http.StatusOK, VariantsResponse{Page: page, Total: total, Variants: entries})
+}
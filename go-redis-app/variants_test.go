@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"testing"
+)
+
+func TestVariantProportions(t *testing.T) {
+	entries, total := variantProportions([]string{"a", "b", "other"}, []int64{3, 1, 0})
+	if total != 4 {
+		t.Fatalf("Expected total 4, got %d", total)
+	}
+	want := []float64{0.75, 0.25, 0}
+	for i, e := range entries {
+		if math.Abs(e.Proportion-want[i]) > 1e-9 {
+			t.Errorf("%s: expected %f, got %f", e.Variant, want[i], e.Proportion)
+		}
+	}
+
+	entries, total = variantProportions([]string{"a"}, []int64{0})
+	if total != 0 || entries[0].Proportion != 0 {
+		t.Errorf("Expected zero proportion with no visits, got %+v", entries)
+	}
+}
+
+func getVariants(t *testing.T, h http.Handler, page string) VariantsResponse {
+	t.Helper()
+	var resp VariantsResponse
+	w := doRequest(h, "GET", "/visits/"+page+"/variants", "", nil)
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("Failed to decode variants: %v", err)
+	}
+	return resp
+}
+
+func TestVariantCountingStrict(t *testing.T) {
+	_, redisClient := newTestRedis(t)
+	router := newTestServer(t, testConfig(), redisClient).Router()
+	doRequest(router, "PUT", "/admin/pages/landing/meta", `{"variants": ["a", "b"]}`, nil)
+
+	for _, v := range []string{"a", "a", "b"} {
+		if w := doRequest(router, "GET", "/visit/landing?variant="+v, "", nil); w.Code != http.StatusOK {
+			t.Fatalf("Expected 200 for variant %s, got %d", v, w.Code)
+		}
+	}
+	if w := doRequest(router, "GET", "/visit/landing?variant=c", "", nil); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for unregistered variant, got %d", w.Code)
+	}
+	doRequest(router, "GET", "/visit/landing", "", nil)
+
+	resp := getVariants(t, router, "landing")
+	if resp.Total != 3 || len(resp.Variants) != 2 {
+		t.Fatalf("Unexpected variants response: %+v", resp)
+	}
+	if resp.Variants[0].Visits != 2 || resp.Variants[1].Visits != 1 {
+		t.Errorf("Unexpected variant counts: %+v", resp.Variants)
+	}
+
+	// The main counter includes every visit
+	if v := decodeVisit(t, doRequest(router, "GET", "/visits/landing", "", nil).Body.Bytes()); v.Visits != 4 {
+		t.Errorf("Expected 4 total visits, got %d", v.Visits)
+	}
+}
+
+func TestVariantCountingLenient(t *testing.T) {
+	_, redisClient := newTestRedis(t)
+	cfg := testConfig()
+	cfg.StrictVariants = false
+	router := newTestServer(t, cfg, redisClient).Router()
+	doRequest(router, "PUT", "/admin/pages/landing/meta", `{"variants": ["a"]}`, nil)
+
+	doRequest(router, "GET", "/visit/landing?variant=a", "", nil)
+	w := doRequest(router, "GET", "/visit/landing?variant=zzz", "", nil)
+	if resp := decodeVisit(t, w.Body.Bytes()); w.Code != http.StatusOK || resp.Variant != otherVariant {
+		t.Errorf("Expected unregistered variant to fold into other, got %d %+v", w.Code, resp)
+	}
+
+	resp := getVariants(t, router, "landing")
+	if len(resp.Variants) != 2 || resp.Variants[1].Variant != otherVariant || resp.Variants[1].Proportion != 0.5 {
+		t.Errorf("Unexpected variants response: %+v", resp)
+	}
+
+	if w := doRequest(router, "PUT", "/admin/pages/landing/meta", `{"variants": ["other"]}`, nil); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected reserved variant name to be rejected, got %d", w.Code)
+	}
+}
+
+func TestVariantModeConfig(t *testing.T) {
+	for mode, strict := range map[string]bool{"": true, "strict": true, "lenient": false} {
+		t.Setenv("VARIANT_MODE", mode)
+		cfg, err := LoadConfig()
+		if err != nil || cfg.StrictVariants != strict {
+			t.Errorf("VARIANT_MODE=%q: expected strict=%t, got %t, %v", mode, strict, cfg.StrictVariants, err)
+		}
+	}
+
+	t.Setenv("VARIANT_MODE", "lenent")
+	if _, err := LoadConfig(); err == nil || err.Error() != `VARIANT_MODE: must be strict or lenient, got "lenent"` {
+		t.Errorf("Expected a misspelled mode to be rejected, got %v", err)
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+// Visit response views, chosen by ?view=
+const (
+	viewVerbose = "verbose"
+	viewCompact = "compact"
+)
+
+// Optional visit response fields, requested with ?include=
+const (
+	includeRank     = "rank"
+	includeUnique   = "unique"
+	includeSessions = "sessions"
+
+	// includeAll includes every field, read in one atomic snapshot by the
+	// read endpoint
+	includeAll = "all"
+)
+
+// visitIncludes lists the ?include= names
+var visitIncludes = []string{includeRank, includeUnique, includeSessions, includeAll}
+
+// visitView is how a visit response is serialized: verbose, the default,
+// or compact, with the optional fields ?include= asked for. The zero view is
+// the verbose response existing clients get.
+type visitView struct {
+	compact  bool
+	rank     bool
+	unique   bool
+	sessions bool
+
+	// snapshot is set by include=all: the counts and fields are read together
+	snapshot bool
+}
+
+// uniqueKey is the HyperLogLog of a page's visitors
+func uniqueKey(page string) string {
+	return key("visits", "unique", page)
+}
+
+// parseVisitView reads ?view= and ?include=, responding 400 when invalid.
+// ?fields= names verbose fields, so it can't be combined with view=compact.
+func parseVisitView(c *gin.Context) (visitView, bool) {
+	var view visitView
+	switch c.DefaultQuery("view", viewVerbose) {
+	case viewVerbose:
+	case viewCompact:
+		if c.Query("fields") != "" {
+			respondError(c, http.StatusBadRequest, "invalid_request", "fields cannot be combined with view=compact")
+			return view, false
+		}
+		view.compact = true
+	default:
+		respondError(c, http.StatusBadRequest, "invalid_request", fmt.Sprintf("view must be %q or %q", viewVerbose, viewCompact))
+		return view, false
+	}
+	if include := c.Query("include"); include != "" {
+		for _, name := range strings.Split(include, ",") {
+			switch name {
+			case includeRank:
+				view.rank = true
+			case includeUnique:
+				view.unique = true
+			case includeSessions:
+				view.sessions = true
+			case includeAll:
+				view.rank, view.unique, view.sessions, view.snapshot = true, true, true, true
+			default:
+				respondError(c, http.StatusBadRequest, "invalid_request",
+					fmt.Sprintf("unknown include %q, valid: %s", name, strings.Join(visitIncludes, ",")))
+				return view, false
+			}
+		}
+	}
+	return view, true
+}
+
+// VisitFields returns a page's leaderboard rank, 1 for the most visited,
+// and its estimated unique visitors, reading only those asked for. The rank
+// is nil for pages not on the leaderboard, such as approximate pages.
+func (r *RedisClient) VisitFields(ctx context.Context, page string, rank, unique bool) (*int64, *int64, error) {
+	var rankCmd, uniqueCmd *redis.IntCmd
+	_, err := r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		if rank {
+			rankCmd = pipe.ZRevRank(ctx, leaderboardKey, page)
+		}
+		if unique {
+			uniqueCmd = pipe.PFCount(ctx, uniqueKey(page))
+		}
+		return nil
+	})
+	if ignoreMissing(err) != nil {
+		return nil, nil, err
+	}
+	var rankOut, uniqueOut *int64
+	if rankCmd != nil && rankCmd.Err() == nil {
+		n := rankCmd.Val() + 1
+		rankOut = &n
+	}
+	if uniqueCmd != nil {
+		n := uniqueCmd.Val()
+		uniqueOut = &n
+	}
+	return rankOut, uniqueOut, nil
+}
+
+// snapshotScript reads the counts and fields of a page's detail view in one
+// atomic step, so a concurrent visit is either in all of them or in none:
+// a rank is never reported for a count of 0. Missing values are nil.
+//
+// KEYS[1] counter, KEYS[2] session counter, KEYS[3] weighted total,
+// KEYS[4] leaderboard, KEYS[5] unique visitors; ARGV[1] page
+var snapshotScript = redis.NewScript(`
+return {
+	redis.call('GET', KEYS[1]),
+	redis.call('GET', KEYS[2]),
+	redis.call('GET', KEYS[3]),
+	redis.call('ZREVRANK', KEYS[4], ARGV[1]),
+	redis.call('PFCOUNT', KEYS[5])
+}
+`)
+
+// PageSnapshot is what a page's detail view reads: its counts, leaderboard
+// rank and unique visitors, as they were at one moment
+type PageSnapshot struct {
+	Visits   int64
+	Sessions int64
+	Weighted *float64
+	Rank     *int64
+	Unique   int64
+}
+
+// PageSnapshot reads a page's counts and fields with snapshotScript. A
+// visit's writes are only applied together in strict mode, so a pipelined
+// visit may still be seen halfway, in its counter but not yet its rank. The
+// script only reads, so it runs with EVALSHA_RO and is served on read
+// replicas.
+func (r *RedisClient) PageSnapshot(ctx context.Context, page string) (PageSnapshot, error) {
+	keys := []string{key("visits", page), sessionsKey(page), weightedKey(page), leaderboardKey, uniqueKey(page)}
+	values, err := snapshotScript.RunRO(ctx, r.client, keys, page).Slice()
+	if err != nil {
+		return PageSnapshot{}, err
+	}
+	if len(values) != 5 {
+		return PageSnapshot{}, fmt.Errorf("snapshot returned %d values, want 5", len(values))
+	}
+	var snapshot PageSnapshot
+	for i, count := range []*int64{&snapshot.Visits, &snapshot.Sessions} {
+		if s, ok := values[i].(string); ok {
+			if *count, err = strconv.ParseInt(s, 10, 64); err != nil {
+				return PageSnapshot{}, err
+			}
+		}
+	}
+	if s, ok := values[2].(string); ok {
+		if snapshot.Weighted, err = parseWeighted(s); err != nil {
+			return PageSnapshot{}, err
+		}
+	}
+	if rank, ok := values[3].(int64); ok {
+		rank++
+		snapshot.Rank = &rank
+	}
+	snapshot.Unique, _ = values[4].(int64)
+	return snapshot, nil
+}
+
+// shapeVisit sets the response's view and fills in the optional fields it
+// includes
+func (s *Server) shapeVisit(ctx context.Context, response *VisitResponse, view visitView) error {
+	response.view = view
+	if !view.rank && !view.unique {
+		return nil
+	}
+	var err error
+	response.Rank, response.Unique, err = s.redis.VisitFields(ctx, response.Page, view.rank, view.unique)
+	return err
+}
+
+// appendCompactJSON encodes the compact view: the page as "p" and its
+// visits as "v", then the included rank "r", unique visitors "u" and
+// sessions "s"
+func (v VisitResponse) appendCompactJSON(b []byte) []byte {
+	b = append(b, `{"p":`...)
+	b = appendJSONString(b, v.Page)
+	b = append(b, `,"v":`...)
+	b = strconv.AppendInt(b, v.Visits, 10)
+	if v.Rank != nil {
+		b = append(b, `,"r":`...)
+		b = strconv.AppendInt(b, *v.Rank, 10)
+	}
+	if v.Unique != nil {
+		b = append(b, `,"u":`...)
+		b = strconv.AppendInt(b, *v.Unique, 10)
+	}
+	if v.view.sessions {
+		b = append(b, `,"s":`...)
+		b = strconv.AppendInt(b, v.Sessions, 10)
+	}
+	return append(b, '}')
+}
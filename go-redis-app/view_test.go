@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+
+	"go-redis-app/internal/clocktest"
+)
+
+func TestVisitViews(t *testing.T) {
+	_, redisClient := newTestRedis(t)
+	clock := clocktest.New(time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC))
+	router := newTestServerWithClock(t, testConfig(), redisClient, clock).Router()
+	for _, page := range []string{"home", "home", "docs", "home"} {
+		doRequest(router, "GET", "/visit/"+page, "", nil)
+	}
+
+	tests := []struct {
+		path, want string
+	}{
+		// The default is unchanged for existing clients
+		{"/visits/home?ts=unix", `{"page":"home","visits":3,"sessions":1,"timestamp":1709294400}`},
+		{"/visits/home?view=verbose&include=rank,unique&ts=unix", `{"page":"home","visits":3,"sessions":1,"rank":1,"unique":1,"timestamp":1709294400}`},
+		{"/visits/docs?include=rank&fields=page,rank", `{"page":"docs","rank":2}`},
+		{"/visits/home?view=compact", `{"p":"home","v":3}`},
+		{"/visits/docs?view=compact&include=sessions,unique,rank", `{"p":"docs","v":1,"r":2,"u":1,"s":1}`},
+		// Pages off the leaderboard have no rank
+		{"/visits/none?view=compact&include=rank,unique", `{"p":"none","v":0,"u":0}`},
+		// include=all reads everything in one snapshot
+		{"/visits/home?include=all&ts=unix", `{"page":"home","visits":3,"sessions":1,"rank":1,"unique":1,"timestamp":1709294400}`},
+		{"/visits/docs?view=compact&include=all", `{"p":"docs","v":1,"r":2,"u":1,"s":1}`},
+		{"/visits/none?view=compact&include=all", `{"p":"none","v":0,"u":0,"s":0}`},
+		{"/visit/docs?view=compact", `{"p":"docs","v":2}`},
+		{"/visit/home?view=compact&include=rank", `{"p":"home","v":4,"r":1}`},
+	}
+	for _, tt := range tests {
+		w := doRequest(router, "GET", tt.path, "", nil)
+		if w.Code != http.StatusOK || w.Body.String() != tt.want {
+			t.Errorf("GET %s: expected %s, got %d: %s", tt.path, tt.want, w.Code, w.Body.String())
+		}
+	}
+
+	for _, path := range []string{"/visits/home?view=tiny", "/visits/home?include=rank,bogus", "/visits/home?view=compact&fields=visits", "/visit/home?view=tiny"} {
+		if w := doRequest(router, "GET", path, "", nil); w.Code != http.StatusBadRequest {
+			t.Errorf("GET %s: expected 400, got %d", path, w.Code)
+		}
+	}
+	if w := doRequest(router, "GET", "/visits/home?view=compact", "", nil); w.Body.String() != `{"p":"home","v":4}` {
+		t.Errorf("Expected the rejected visit not counted, got %s", w.Body.String())
+	}
+}
+
+func TestVisitViewIncludesZeroSessions(t *testing.T) {
+	_, redisClient := newTestRedis(t)
+	cfg := testConfig()
+	cfg.SessionWindow = 0
+	router := newTestServer(t, cfg, redisClient).Router()
+	doRequest(router, "GET", "/visit/home", "", nil)
+
+	tests := map[string]string{
+		"/visits/home?fields=page,visits,sessions":                  `{"page":"home","visits":1}`,
+		"/visits/home?include=sessions&fields=page,visits,sessions": `{"page":"home","visits":1,"sessions":0}`,
+		"/visits/home?view=compact&include=sessions":                `{"p":"home","v":1,"s":0}`,
+	}
+	for path, want := range tests {
+		if w := doRequest(router, "GET", path, "", nil); w.Body.String() != want {
+			t.Errorf("GET %s: expected %s, got %s", path, want, w.Body.String())
+		}
+	}
+}
+
+func TestVisitViewOnReadReplica(t *testing.T) {
+	mr, redisClient := newTestRedis(t)
+	router := newTestServer(t, testConfig(), redisClient).Router()
+	doRequest(router, "GET", "/visit/home", "", nil)
+	doRequest(router, "GET", "/visit/home", "", nil)
+
+	cfg := testConfig()
+	cfg.ReadOnly = true
+	replica := newTestServer(t, cfg, newTestRedisClient(t, mr)).Router()
+	w := doRequest(replica, "GET", "/visits/home?view=compact&include=all", "", nil)
+	if w.Code != http.StatusOK || w.Body.String() != `{"p":"home","v":2,"r":1,"u":1,"s":1}` {
+		t.Errorf("Expected the snapshot served read-only, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestVisitSnapshotConsistency(t *testing.T) {
+	const writers, visitsEach, readers = 8, 10, 4
+	mr, redisClient := newTestRedis(t)
+	// Strict mode applies each visit's writes together, so a snapshot sees
+	// all of a visit or none of it
+	redisClient.strict = true
+	router := newTestServer(t, testConfig(), redisClient).Router()
+	// Other pages at every half count, so each visit moves home up a rank
+	// and no count ties with a score
+	others := writers * visitsEach
+	for i := 0; i < others; i++ {
+		mr.ZAdd(leaderboardKey, float64(i)+0.5, fmt.Sprintf("other-%d", i))
+	}
+
+	// check reads the snapshot, reporting whether it is consistent
+	check := func() bool {
+		w := doRequest(router, "GET", "/visits/home?include=all", "", nil)
+		var resp VisitResponse
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		switch {
+		case w.Code != http.StatusOK || resp.Unique == nil:
+			t.Errorf("Snapshot read: %d %s", w.Code, w.Body.String())
+		case resp.Visits == 0 && (resp.Rank != nil || *resp.Unique != 0 || resp.Sessions != 0):
+			t.Errorf("Expected nothing for a page without visits, got %s", w.Body.String())
+		case resp.Visits == 0:
+			return true
+		case resp.Rank == nil || *resp.Rank != int64(others)-resp.Visits+1:
+			t.Errorf("Expected rank %d for %d visits, got %s", int64(others)-resp.Visits+1, resp.Visits, w.Body.String())
+		case *resp.Unique != 1 || resp.Sessions > 1:
+			t.Errorf("Expected one visitor and at most one session, got %s", w.Body.String())
+		default:
+			return true
+		}
+		return false
+	}
+
+	var writing, reading sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		writing.Add(1)
+		go func() {
+			defer writing.Done()
+			for j := 0; j < visitsEach; j++ {
+				doRequest(router, "GET", "/visit/home", "", nil)
+			}
+		}()
+	}
+	done := make(chan struct{})
+	for i := 0; i < readers; i++ {
+		reading.Add(1)
+		go func() {
+			defer reading.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+					if !check() {
+						return
+					}
+				}
+			}
+		}()
+	}
+	writing.Wait()
+	close(done)
+	reading.Wait()
+
+	if check() {
+		var final VisitResponse
+		json.Unmarshal(doRequest(router, "GET", "/visits/home?include=all", "", nil).Body.Bytes(), &final)
+		if final.Visits != int64(others) || *final.Rank != 1 {
+			t.Errorf("Expected all %d visits ranked first, got %+v", others, final)
+		}
+	}
+}
+
+// BenchmarkPageDetail compares reading the page detail view as the counts
+// followed by a pipeline of the included fields, as ?include=rank,unique,sessions
+// does, with the one-script snapshot of ?include=all. miniredis interprets
+// Lua slowly; compare against a real Redis with
+//
+//	REDIS_STACK_ADDR=localhost:6379 go test -run xxx -bench PageDetail .
+func BenchmarkPageDetail(b *testing.B) {
+	addr := os.Getenv("REDIS_STACK_ADDR")
+	if addr == "" {
+		mr := miniredis.RunT(b)
+		registerReadOnlyScripts(mr)
+		addr = mr.Addr()
+	}
+	rdb := redis.NewClient(&redis.Options{Addr: addr})
+	const page = "bench-detail"
+	keys := []string{key("visits", page), sessionsKey(page), weightedKey(page), uniqueKey(page)}
+	ctx := context.Background()
+	b.Cleanup(func() {
+		rdb.Del(ctx, keys...)
+		rdb.ZRem(ctx, leaderboardKey, page)
+		rdb.Close()
+	})
+	redisClient := newRedisClient(rdb)
+	if _, err := redisClient.RecordVisit(ctx, VisitWrite{Page: page, Visitor: "v1", Now: time.Now()}); err != nil {
+		b.Fatal(err)
+	}
+
+	b.Run("pipelined", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, _, _, err := redisClient.GetCounts(ctx, page); err != nil {
+				b.Fatal(err)
+			}
+			if _, _, err := redisClient.VisitFields(ctx, page, true, true); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("snapshot", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := redisClient.PageSnapshot(ctx, page); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
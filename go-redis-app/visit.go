@@ -0,0 +1,516 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+// botUserAgentMarkers are substrings identifying crawler user agents
+var botUserAgentMarkers = []string{"bot", "crawler", "spider", "slurp", "headless"}
+
+// isBotUserAgent reports whether the user agent looks like an automated client
+func isBotUserAgent(userAgent string) bool {
+	ua := strings.ToLower(userAgent)
+	for _, marker := range botUserAgentMarkers {
+		if strings.Contains(ua, marker) {
+			return true
+		}
+	}
+	return false
+}
+
+// visitResult is the outcome of recording a visit
+type visitResult struct {
+	Visits   int64
+	Sessions int64
+	Counted  bool
+
+	// Approximate is set when the count is a Count-Min Sketch estimate
+	Approximate bool
+
+	// SampleRate is the effective rate when the page is sampled
+	SampleRate float64
+
+	// FirstVisit is set on the visit that created the page's counter
+	FirstVisit bool
+
+	// Weighted is the weighted total, set for pages that had weighted visits
+	Weighted *float64
+
+	// Replicated is set with WRITE_CONSISTENCY=replicated on visits written
+	// to Redis, to whether replicas confirmed them
+	Replicated *bool
+
+	// Reason explains an uncounted visit the caller should know about
+	Reason string
+}
+
+// visitOptions holds the per-request visit parameters
+type visitOptions struct {
+	Variant string
+
+	// Weight is ?weight=, 0 for an unweighted visit
+	Weight float64
+}
+
+// recordVisit applies the enabled counting features and increments the page
+// counter, reporting whether the visit was counted. Features in shadow mode
+// only record what they would have done.
+func (s *Server) recordVisit(c *gin.Context, page string, opts visitOptions) (_ visitResult, err error) {
+	ctx := c.Request.Context()
+	flags := s.flags.Flags()
+	// Opted-out visitors are checked first, so nothing is derived from them
+	optedOut, err := s.requestOptedOut(c)
+	if err != nil {
+		return visitResult{}, err
+	}
+	if optedOut {
+		result, err := s.uncountedVisit(ctx, page)
+		result.Reason = reasonOptOut
+		return result, err
+	}
+	var written bool
+	if s.burst != nil {
+		key, at := burstKey(c.ClientIP(), page, c.Request.UserAgent()), s.clock.Now()
+		if !s.burst.first(key, at) {
+			return s.uncountedVisit(ctx, page)
+		}
+		// A visit failing before it is written doesn't hold its burst, so
+		// the client's retry is counted
+		defer func() {
+			if err != nil && !written {
+				s.burst.release(key, at)
+			}
+		}()
+	}
+	visitor, err := s.visitorID(c)
+	if err != nil {
+		return visitResult{}, err
+	}
+	now := s.bucketNow()
+	var shadow []shadowDecision
+	defer func() { s.recordShadow(ctx, shadow) }()
+
+	// The policy's metadata read only fails visits that need the sample
+	// rate; otherwise the global settings apply
+	policy, policyErr := s.pagePolicy(ctx, page, flags)
+	if policyErr != nil && flags.Modes.Sampling == ModeEnforce {
+		return visitResult{}, policyErr
+	}
+
+	switch policy.BotFiltering {
+	case ModeEnforce:
+		if isBotUserAgent(c.Request.UserAgent()) {
+			return s.uncountedVisit(ctx, page)
+		}
+	case ModeShadow:
+		shadow = append(shadow, shadowDecision{Feature: featureBotFiltering, Drop: isBotUserAgent(c.Request.UserAgent()), Weight: 1})
+	}
+
+	weight := int64(1)
+	draw := sampleDraw()
+	if flags.Modes.Sampling != ModeOff {
+		sampleW := sampleWeight(policy.SampleRate)
+		in := sampledIn(draw, sampleW)
+		switch {
+		case policyErr != nil:
+			log.Printf("Skipping shadow sampling decision: %v", policyErr)
+		case flags.Modes.Sampling == ModeEnforce:
+			weight = sampleW
+		case in:
+			shadow = append(shadow, shadowDecision{Feature: featureSampling, Weight: sampleW})
+		default:
+			shadow = append(shadow, shadowDecision{Feature: featureSampling, Drop: true})
+		}
+	}
+	var effectiveRate float64
+	if weight > 1 {
+		effectiveRate = 1 / float64(weight)
+	}
+	if !sampledIn(draw, weight) {
+		// Sampled-out requests skip dedupe and sessions, which need every visit
+		result, err := s.uncountedVisit(ctx, page)
+		result.SampleRate = effectiveRate
+		return result, err
+	}
+	// journal counts the visit in memory while Redis is out of memory
+	journal := func() (visitResult, error) {
+		if s.absent != nil {
+			s.absent.forget(page)
+		}
+		result, err := s.journalVisit(ctx, page, now, weight, flags.Rollups)
+		result.SampleRate = effectiveRate
+		return result, err
+	}
+	if s.journaling() {
+		return journal()
+	}
+
+	switch flags.Modes.Dedupe {
+	case ModeEnforce:
+		first, err := s.redis.MarkVisitor(ctx, page, visitor, policy.DedupeWindow, now)
+		if s.outOfMemory(err) {
+			return journal()
+		}
+		if err != nil {
+			return visitResult{}, err
+		}
+		if !first {
+			result, err := s.uncountedVisit(ctx, page)
+			result.SampleRate = effectiveRate
+			return result, err
+		}
+	case ModeShadow:
+		if first, err := s.redis.MarkVisitor(ctx, page, visitor, policy.DedupeWindow, now); err != nil {
+			log.Printf("Skipping shadow dedupe decision: %v", err)
+		} else {
+			shadow = append(shadow, shadowDecision{Feature: featureDedupe, Drop: !first, Weight: 1})
+		}
+	}
+
+	outbox, err := s.newPageOutboxEntry(page, now)
+	if err != nil {
+		return visitResult{}, err
+	}
+	approximate := s.isApproximatePage(page)
+	country := s.visitCountry(c)
+	recorded, err := s.redis.RecordVisit(ctx, VisitWrite{
+		Page:        page,
+		Visitor:     visitor,
+		Now:         now,
+		Rollup:      flags.Rollups,
+		Variant:     opts.Variant,
+		Approximate: approximate,
+		Weight:      weight,
+		Value:       opts.Weight,
+		Country:     country,
+		Outbox:      outbox,
+		Journey:     s.cfg.VisitorCookie,
+		Minutes:     s.anomalies != nil,
+		Goals:       s.goals.ForPage(page),
+		Wait:        s.replicaWait(),
+	})
+	if s.outOfMemory(err) {
+		return journal()
+	}
+	if err != nil {
+		return visitResult{}, err
+	}
+	if recorded.Incomplete != nil {
+		// Counted already, so only the visits after this one are journaled
+		log.Printf("Visit to %s counted without some of its writes: %v", page, recorded.Incomplete)
+		s.outOfMemory(recorded.Incomplete)
+	}
+	written = true
+	result := visitResult{
+		Visits:      recorded.Visits,
+		Counted:     true,
+		Approximate: approximate,
+		SampleRate:  effectiveRate,
+		FirstVisit:  recorded.First,
+		Weighted:    recorded.Weighted,
+		Replicated:  recorded.Replicated,
+	}
+	if recorded.Replicated != nil {
+		s.replication.observe(*recorded.Replicated)
+	}
+	if recorded.First && s.absent != nil {
+		s.absent.forget(page)
+	}
+	s.publishVisit(ctx, page, recorded.Visits, recorded.First, now)
+	if !recorded.Previous.IsZero() {
+		s.recordInterarrival(ctx, page, now.Sub(recorded.Previous))
+	}
+	event := VisitEvent{
+		Page:       page,
+		Visits:     recorded.Visits,
+		Visitor:    visitor,
+		Variant:    opts.Variant,
+		Country:    country,
+		Weight:     opts.Weight,
+		SampleRate: effectiveRate,
+		FirstVisit: recorded.First,
+		RequestID:  c.GetString(requestIDKey),
+		Timestamp:  now.UTC(),
+	}
+	s.queuePageWebhook(ctx, PageVisitEvent{Event: eventPageVisited, VisitEvent: event})
+	if s.sinks != nil {
+		s.sinks.enqueue(ctx, event)
+	}
+
+	if s.cfg.SessionWindow > 0 {
+		result.Sessions, err = s.redis.TrackSession(ctx, page, visitor, s.cfg.SessionWindow, s.cfg.SessionRefresh, flags.Rollups, now)
+		if s.outOfMemory(err) {
+			// The visit is counted, only its session is not
+			return result, nil
+		}
+		if err != nil {
+			return visitResult{}, err
+		}
+	}
+	return result, nil
+}
+
+// uncountedVisit returns the current counts for a visit that was not counted
+func (s *Server) uncountedVisit(ctx context.Context, page string) (visitResult, error) {
+	return s.pageCounts(ctx, page)
+}
+
+// pageCounts returns the visit, session and weighted counts, using the
+// sketch estimate for approximate pages
+func (s *Server) pageCounts(ctx context.Context, page string) (visitResult, error) {
+	visits, sessions, weighted, err := s.redis.GetCounts(ctx, page)
+	counts := visitResult{Visits: visits, Sessions: sessions, Weighted: weighted}
+	if err != nil || !s.isApproximatePage(page) {
+		return counts, err
+	}
+	counts.Approximate = true
+	counts.Visits, err = s.redis.ApproximateCount(ctx, page)
+	return counts, err
+}
+
+// MarkVisitor records a visitor for a page within the dedupe window,
+// returning false if the visitor was already seen. The marker holds the time
+// it was set, for privacy purges by age.
+func (r *RedisClient) MarkVisitor(ctx context.Context, page, visitor string, window time.Duration, now time.Time) (bool, error) {
+	return r.client.SetNX(ctx, dedupeKey(page, visitor), now.Unix(), window).Result()
+}
+
+// dedupeKey returns the marker of a visitor seen on a page
+func dedupeKey(page, visitor string) string {
+	return fmt.Sprintf("visits:dedupe:%s:%s", page, visitor)
+}
+
+// VisitWrite describes the keys updated for a counted visit
+type VisitWrite struct {
+	Page    string
+	Visitor string
+	Now     time.Time
+	Rollup  bool
+	Variant string
+
+	// Approximate pages are only counted in the Count-Min Sketch
+	Approximate bool
+
+	// Weight is how many visits this one counts for on sampled pages
+	Weight int64
+
+	// Value is the visit's ?weight=, 0 when unweighted. The weighted total
+	// grows by Value times Weight, or by Weight for unweighted visits to
+	// pages that have one.
+	Value float64
+
+	// Country is the visit's country bucket, "" when not tracked
+	Country string
+
+	// Outbox is the webhook outbox entry queued if this visit creates the
+	// page, "" for none
+	Outbox string
+
+	// Journey adds the visit to the visitor's journey
+	Journey bool
+
+	// Minutes increments the minute bucket read by anomaly detection
+	Minutes bool
+
+	// Goals are the goals whose source or target is the page
+	Goals []pageGoal
+
+	// Wait, when set, ends the pipeline with a WAIT for replicas
+	Wait *ReplicaWait
+}
+
+// RecordedVisit is the outcome of RecordVisit
+type RecordedVisit struct {
+	Visits int64
+	First  bool
+
+	// Weighted is the weighted total, nil for pages never visited with a
+	// weight
+	Weighted *float64
+
+	// Previous is the page's last visit before this one, zero for a first
+	// visit and for approximate pages
+	Previous time.Time
+
+	// Replicated reports whether the write's WAIT was confirmed, nil
+	// without one
+	Replicated *bool
+
+	// Incomplete is the out of memory error of a plain pipeline that
+	// counted the visit but failed some of its other writes. The visit
+	// must not be journaled then, as the journal would count it twice.
+	Incomplete error
+}
+
+// RecordVisit increments the visit count, leaderboard and trending scores,
+// marks the page's last visit and adds the visitor to its unique count (or
+// the Top-K and Count-Min sketches when enabled), variant and country
+// counters, indexes the page name for search, adds the visit to the
+// visitor's journey, advances any goals involving the page, and, with
+// rollups enabled, increments the daily bucket and hour histograms, all in
+// one pipeline, which strict mode sends as a transaction. Counts are
+// incremented by the write's sample weight, and the weighted total, when
+// the page has one, by the visit's value.
+// It also reports whether this visit created the page: INCRBY returning the
+// weight means the counter did not exist, which only one concurrent visit
+// can observe. Approximate pages have no counter, so adding the name to the
+// index is used instead. The outbox entry, if any, is queued by the same
+// command that creates the page. The previous last visit is returned for the
+// inter-arrival histogram. With a Wait, the pipeline ends with WAIT, whose
+// failure only leaves the visit unconfirmed.
+func (r *RedisClient) RecordVisit(ctx context.Context, w VisitWrite) (RecordedVisit, error) {
+	weight := max(w.Weight, 1)
+	pipe := r.writePipeline()
+	// counter returns the counter's new value, nil for approximate pages
+	var counter func() (int64, error)
+	// counted is the command whose success counts the visit
+	var counted redis.Cmder
+	var cms, weighted *redis.Cmd
+	var created, enqueued *queuedScript
+	var previous *redis.FloatCmd
+	if r.sketches {
+		cms = r.queueSketchVisit(ctx, pipe, w.Page, w.Approximate, weight, w.Now)
+		counted = cms
+	}
+	if !w.Approximate {
+		if w.Outbox != "" {
+			enqueued = queueScript(ctx, pipe, createdScript, []string{key("visits", w.Page), outboxKey}, weight, w.Outbox)
+			counter, counted = enqueued.Int64, enqueued.Cmd
+		} else {
+			incr := pipe.IncrBy(ctx, key("visits", w.Page), weight)
+			counter, counted = incr.Result, incr
+		}
+		pipe.ZIncrBy(ctx, leaderboardKey, float64(weight), w.Page)
+		// Read before the ZADD in the same pipeline, so it is the previous visit
+		previous = pipe.ZScore(ctx, lastVisitKey, w.Page)
+		pipe.ZAdd(ctx, lastVisitKey, redis.Z{Member: w.Page, Score: float64(w.Now.UnixMilli())})
+		pipe.PFAdd(ctx, uniqueKey(w.Page), w.Visitor)
+
+		value, valued := w.Value, "1"
+		if value == 0 {
+			value, valued = 1, "0"
+		}
+		increment := strconv.FormatFloat(value*float64(weight), 'f', -1, 64)
+		weighted = weightedScript.Eval(ctx, pipe, []string{weightedKey(w.Page), key("visits", w.Page)}, increment, weight, valued)
+	}
+	if !r.sketches {
+		pipe.ZIncrBy(ctx, trendingKey, float64(weight), w.Page)
+	}
+	if w.Rollup {
+		pipe.IncrBy(ctx, dailyKey(w.Page, w.Now), weight)
+		queueHourly(ctx, pipe, w.Page, w.Now, weight)
+	}
+	if w.Variant != "" {
+		pipe.IncrBy(ctx, variantKey(w.Page, w.Variant), weight)
+	}
+	if w.Country != "" {
+		pipe.HIncrBy(ctx, geoKey(w.Page), w.Country, weight)
+	}
+	if w.Approximate && w.Outbox != "" {
+		created = queueScript(ctx, pipe, indexCreatedScript, []string{pageNamesKey, outboxKey}, w.Page, w.Outbox)
+	}
+	if w.Journey {
+		queueJourney(ctx, pipe, w.Visitor, w.Page, w.Now)
+	}
+	if w.Minutes {
+		queueMinute(ctx, pipe, w.Page, w.Now, weight)
+	}
+	indexed := r.queueIndexPage(ctx, pipe, w.Page)
+	goals := queueGoals(ctx, pipe, w.Goals, w.Visitor, w.Now)
+	var ack *redis.IntCmd
+	if w.Wait != nil {
+		ack = w.Wait.queueWait(ctx, pipe)
+	}
+	// A failed WAIT leaves the visit written, and only the weighted total
+	// and the previous visit may be missing
+	var incomplete error
+	if cmds, err := pipe.Exec(ctx); err != nil {
+		for _, script := range []*queuedScript{enqueued, created, goals} {
+			script.rerun(ctx, r.client)
+		}
+		if err := pipelineError(cmds, ack, previous, weighted); err != nil {
+			// Out of memory, a plain pipeline may still have counted the
+			// visit; a transaction is aborted, counter included
+			if !errors.Is(err, ErrOutOfMemory) || counted == nil || counted.Err() != nil {
+				return RecordedVisit{}, err
+			}
+			incomplete = err
+		}
+	}
+	recorded := RecordedVisit{First: indexed.Val() == 1, Incomplete: incomplete}
+	if ack != nil {
+		replicated := w.Wait.confirmed(ack)
+		recorded.Replicated = &replicated
+	}
+	if created != nil {
+		added, err := created.Int64()
+		if err != nil && incomplete == nil {
+			return RecordedVisit{}, err
+		}
+		recorded.First = added == 1
+	}
+	if counter != nil {
+		visits, err := counter()
+		if err != nil {
+			return RecordedVisit{}, err
+		}
+		recorded.Visits = visits
+		recorded.First = visits == weight
+		if ms, err := previous.Result(); err == nil {
+			recorded.Previous = time.UnixMilli(int64(ms))
+		}
+		if total, err := weighted.Text(); err == nil {
+			if recorded.Weighted, err = parseWeighted(total); err != nil {
+				return RecordedVisit{}, err
+			}
+		} else if !isMissing(err) && incomplete == nil {
+			return RecordedVisit{}, err
+		}
+	}
+	if cms != nil {
+		var err error
+		recorded.Visits, err = firstInt64(cms)
+		return recorded, err
+	}
+	return recorded, nil
+}
+
+// queuedScript is a script queued on a pipeline as EVALSHA, which fails
+// with NOSCRIPT until Redis has loaded the script, such as after a restart
+type queuedScript struct {
+	*redis.Cmd
+	script *redis.Script
+	keys   []string
+	args   []any
+}
+
+// queueScript queues script on pipe with EVALSHA
+func queueScript(ctx context.Context, pipe redis.Pipeliner, script *redis.Script, keys []string, args ...any) *queuedScript {
+	return &queuedScript{Cmd: script.EvalSha(ctx, pipe, keys, args...), script: script, keys: keys, args: args}
+}
+
+// rerun runs the script on its own with Script.Run, which loads it, when
+// its EVALSHA failed with NOSCRIPT, storing the outcome in its command. The
+// rest of the pipeline was applied without it.
+func (q *queuedScript) rerun(ctx context.Context, c redis.Scripter) {
+	if q == nil || !redis.HasErrorPrefix(q.Err(), "NOSCRIPT") {
+		return
+	}
+	cmd := q.script.Run(ctx, c, q.keys, q.args...)
+	q.SetVal(cmd.Val())
+	q.SetErr(cmd.Err())
+}
+
+// dailyKey returns the daily bucket key for a page
+func dailyKey(page string, t time.Time) string {
+	return key("visits", page, "daily", t.UTC().Format("2006-01-02"))
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"testing"
+)
+
+func TestConcurrentFirstVisit(t *testing.T) {
+	_, redisClient := newTestRedis(t)
+	router := newTestServer(t, testConfig(), redisClient).Router()
+
+	const visitors = 20
+	var wg sync.WaitGroup
+	firsts := make(chan bool, visitors)
+	for i := 0; i < visitors; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var resp VisitResponse
+			json.Unmarshal(doRequest(router, "GET", "/visit/brand-new", "", nil).Body.Bytes(), &resp)
+			firsts <- resp.FirstVisit
+		}()
+	}
+	wg.Wait()
+	close(firsts)
+
+	count := 0
+	for first := range firsts {
+		if first {
+			count++
+		}
+	}
+	if count != 1 {
+		t.Errorf("Expected exactly one first_visit, got %d", count)
+	}
+
+	var resp VisitResponse
+	json.Unmarshal(doRequest(router, "GET", "/visit/brand-new", "", nil).Body.Bytes(), &resp)
+	if resp.FirstVisit || resp.Visits != visitors+1 {
+		t.Errorf("Expected a later visit not to be first, got %+v", resp)
+	}
+}
+
+func TestFirstVisitApproximatePage(t *testing.T) {
+	_, redisClient := newTestRedis(t)
+	cfg := testConfig()
+	cfg.ApproximatePagePrefixes = []string{"tag-"}
+	router := newTestServer(t, cfg, redisClient).Router()
+
+	var first, second VisitResponse
+	json.Unmarshal(doRequest(router, "GET", "/visit/tag-go", "", nil).Body.Bytes(), &first)
+	json.Unmarshal(doRequest(router, "GET", "/visit/tag-go", "", nil).Body.Bytes(), &second)
+	if !first.FirstVisit || second.FirstVisit {
+		t.Errorf("Expected only the first visit to be flagged, got %t then %t", first.FirstVisit, second.FirstVisit)
+	}
+}
+
+func TestVisitWriteErrorAfterNilReply(t *testing.T) {
+	mr, redisClient := newTestRedis(t)
+	router := newTestServer(t, testConfig(), redisClient).Router()
+	doRequest(router, "PUT", "/admin/pages/home/meta", `{"variants": ["a"]}`, nil)
+
+	// The first visit's previous visit is nil, queued before the failing
+	// variant counter
+	mr.Lpush(variantKey("home", "a"), "not a counter")
+	if w := doRequest(router, "GET", "/visit/home?variant=a", "", nil); w.Code < http.StatusInternalServerError {
+		t.Errorf("Expected the WRONGTYPE error reported, got %d %s", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	visitorCookieName   = "vid"
+	visitorCookieMaxAge = 365 * 24 * time.Hour
+)
+
+// visitorID identifies the visitor for unique counting features. With
+// VISITOR_COOKIE enabled a valid vid cookie is preferred; otherwise the
+// client IP is used. Either is salted and hashed, so neither reaches Redis.
+// A new cookie is issued for later requests unless the client sends DNT: 1.
+// The current request keeps the IP hash so cookie-less clients cannot mint a
+// new identity on every request.
+func (s *Server) visitorID(c *gin.Context) (string, error) {
+	ctx := c.Request.Context()
+	if vid := s.visitorCookie(c.Request); vid != "" {
+		return s.hashedVisitor(ctx, "c", vid)
+	}
+
+	if s.cfg.VisitorCookie && c.GetHeader("DNT") != "1" {
+		if vid, err := newVisitorID(); err == nil {
+			http.SetCookie(c.Writer, &http.Cookie{
+				Name:     visitorCookieName,
+				Value:    vid,
+				Path:     "/",
+				MaxAge:   int(visitorCookieMaxAge.Seconds()),
+				Expires:  s.clock.Now().Add(visitorCookieMaxAge),
+				HttpOnly: true,
+				SameSite: http.SameSiteLaxMode,
+			})
+		}
+	}
+
+	return s.hashedVisitor(ctx, "ip", c.ClientIP())
+}
+
+// visitorCookie returns the request's valid vid cookie, or "" without one.
+// It is ignored with VISITOR_COOKIE off, so clients can't pick their own
+// identity where the service never issues one.
+func (s *Server) visitorCookie(r *http.Request) string {
+	if !s.cfg.VisitorCookie {
+		return ""
+	}
+	cookie, err := r.Cookie(visitorCookieName)
+	if err != nil || !isValidVisitorID(cookie.Value) {
+		return ""
+	}
+	return cookie.Value
+}
+
+// newVisitorID generates a random 128-bit hex visitor ID
+func newVisitorID() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// isValidVisitorID reports whether id looks like a generated visitor ID
+func isValidVisitorID(id string) bool {
+	if len(id) != 32 {
+		return false
+	}
+	_, err := hex.DecodeString(id)
+	return err == nil
+}
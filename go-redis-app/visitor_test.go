@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func visitWithHeaders(t *testing.T, h http.Handler, page string, headers map[string]string, cookies ...*http.Cookie) (*httptest.ResponseRecorder, VisitResponse) {
+	t.Helper()
+	req := httptest.NewRequest("GET", "/visit/"+page, nil)
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	for _, cookie := range cookies {
+		req.AddCookie(cookie)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w, decodeVisit(t, w.Body.Bytes())
+}
+
+func visitorCookie(w *httptest.ResponseRecorder) *http.Cookie {
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == visitorCookieName {
+			return cookie
+		}
+	}
+	return nil
+}
+
+func TestVisitorCookieIssuanceAndReuse(t *testing.T) {
+	_, redisClient := newTestRedis(t)
+	cfg := testConfig()
+	cfg.VisitorCookie = true
+	server := newTestServer(t, cfg, redisClient)
+	router := server.Router()
+	server.flags.Set(context.Background(), map[string]bool{"dedupe": true})
+
+	w, resp := visitWithHeaders(t, router, "home", nil)
+	cookie := visitorCookie(w)
+	if cookie == nil {
+		t.Fatal("Expected a vid cookie to be issued")
+	}
+	if !isValidVisitorID(cookie.Value) || !cookie.HttpOnly || cookie.SameSite != http.SameSiteLaxMode {
+		t.Errorf("Unexpected cookie attributes: %+v", cookie)
+	}
+	if cookie.MaxAge < int((364 * 24 * time.Hour).Seconds()) {
+		t.Errorf("Expected a one-year cookie, got max-age %d", cookie.MaxAge)
+	}
+	if !*resp.Counted {
+		t.Error("Expected first visit to count")
+	}
+
+	// The cookie is a new identity, so the first cookie visit counts once
+	w, resp = visitWithHeaders(t, router, "home", nil, cookie)
+	if visitorCookie(w) != nil {
+		t.Error("Expected no new cookie when one is presented")
+	}
+	if !*resp.Counted {
+		t.Error("Expected first cookie-identified visit to count")
+	}
+	_, resp = visitWithHeaders(t, router, "home", nil, cookie)
+	if *resp.Counted {
+		t.Error("Expected repeat visit with the same cookie to be deduped")
+	}
+
+	// A different visitor behind the same IP is counted separately
+	other, _ := newVisitorID()
+	_, resp = visitWithHeaders(t, router, "home", nil, &http.Cookie{Name: visitorCookieName, Value: other})
+	if !*resp.Counted {
+		t.Error("Expected a different vid behind the same IP to count")
+	}
+}
+
+func TestVisitorCookieFallback(t *testing.T) {
+	_, redisClient := newTestRedis(t)
+	cfg := testConfig()
+	cfg.VisitorCookie = true
+	server := newTestServer(t, cfg, redisClient)
+	router := server.Router()
+	server.flags.Set(context.Background(), map[string]bool{"dedupe": true})
+
+	// DNT suppresses the cookie and falls back to the IP hash
+	w, resp := visitWithHeaders(t, router, "home", map[string]string{"DNT": "1"})
+	if visitorCookie(w) != nil {
+		t.Error("Expected no cookie when DNT is set")
+	}
+	if !*resp.Counted {
+		t.Error("Expected first visit to count")
+	}
+	_, resp = visitWithHeaders(t, router, "home", map[string]string{"DNT": "1"})
+	if *resp.Counted {
+		t.Error("Expected repeat visit from the same IP to be deduped")
+	}
+
+	// Malformed cookies are ignored in favor of the IP hash
+	_, resp = visitWithHeaders(t, router, "home", nil, &http.Cookie{Name: visitorCookieName, Value: "visits:*"})
+	if *resp.Counted {
+		t.Error("Expected malformed cookie to fall back to the IP hash")
+	}
+}
+
+func TestVisitorCookieDisabled(t *testing.T) {
+	_, redisClient := newTestRedis(t)
+	server := newTestServer(t, testConfig(), redisClient)
+	router := server.Router()
+	server.flags.Set(context.Background(), map[string]bool{"dedupe": true})
+
+	if w, _ := visitWithHeaders(t, router, "home", nil); visitorCookie(w) != nil {
+		t.Error("Expected no cookie when VISITOR_COOKIE is disabled")
+	}
+	// A cookie of the client's choosing is no new identity
+	vid, _ := newVisitorID()
+	if _, resp := visitWithHeaders(t, router, "home", nil, &http.Cookie{Name: visitorCookieName, Value: vid}); *resp.Counted {
+		t.Error("Expected the cookie ignored and the visit deduped by IP")
+	}
+}
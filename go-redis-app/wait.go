@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// waitDefaultTimeout is how long GET /visits/:page/wait blocks without
+	// a timeout parameter
+	waitDefaultTimeout = 30 * time.Second
+
+	// waitMaxTimeout bounds the timeout parameter, below common proxy idle
+	// timeouts
+	waitMaxTimeout = 60 * time.Second
+)
+
+// errTooManyWaiters is returned when WAIT_MAX_WAITERS long-polls are
+// already waiting
+var errTooManyWaiters = errors.New("too many waiters")
+
+// visitWaiters shares one event subscription among a process's long-polls,
+// fanning each visit out to the waiters on its page. It subscribes with the
+// first waiter and unsubscribes with the last.
+type visitWaiters struct {
+	events EventBus
+	limit  int
+
+	mu    sync.Mutex
+	pages map[string]map[*visitWaiter]struct{}
+	count int
+	// sub is the current subscription, nil while there is none
+	sub *waitSubscription
+}
+
+// waitSubscription is one subscription of visitWaiters. done is closed when
+// it ends, cancelled or failed.
+type waitSubscription struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// visitWaiter is one long-poll. visits holds the page's latest count seen
+// on the feed; done is its subscription's.
+type visitWaiter struct {
+	page   string
+	visits chan int64
+	done   <-chan struct{}
+}
+
+// newVisitWaiters returns waiters on events, at most limit at a time
+func newVisitWaiters(events EventBus, limit int) *visitWaiters {
+	return &visitWaiters{events: events, limit: limit, pages: make(map[string]map[*visitWaiter]struct{})}
+}
+
+// add registers a waiter on page, subscribing if it is the first, or
+// returns errTooManyWaiters
+func (w *visitWaiters) add(page string) (*visitWaiter, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.count >= w.limit {
+		return nil, errTooManyWaiters
+	}
+	if w.sub == nil {
+		ctx, cancel := context.WithCancel(context.Background())
+		events, err := w.events.Subscribe(ctx, "")
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		w.sub = &waitSubscription{cancel: cancel, done: make(chan struct{})}
+		go w.fanOut(w.sub, events)
+	}
+	waiter := &visitWaiter{page: page, visits: make(chan int64, 1), done: w.sub.done}
+	if w.pages[page] == nil {
+		w.pages[page] = make(map[*visitWaiter]struct{})
+	}
+	w.pages[page][waiter] = struct{}{}
+	w.count++
+	return waiter, nil
+}
+
+// remove unregisters a waiter, unsubscribing after the last
+func (w *visitWaiters) remove(waiter *visitWaiter) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, ok := w.pages[waiter.page][waiter]; !ok {
+		return
+	}
+	delete(w.pages[waiter.page], waiter)
+	if len(w.pages[waiter.page]) == 0 {
+		delete(w.pages, waiter.page)
+	}
+	if w.count--; w.count == 0 && w.sub != nil {
+		w.sub.cancel()
+		w.sub = nil
+	}
+}
+
+// fanOut hands each visit event to the waiters on its page, replacing any
+// count they haven't read yet, until the subscription ends
+func (w *visitWaiters) fanOut(sub *waitSubscription, events <-chan Event) {
+	for event := range events {
+		if event.Type != eventVisit {
+			continue
+		}
+		w.mu.Lock()
+		for waiter := range w.pages[event.Page] {
+			select {
+			case <-waiter.visits:
+			default:
+			}
+			waiter.visits <- event.Visits
+		}
+		w.mu.Unlock()
+	}
+	// A failed subscription is replaced by the next waiter's
+	w.mu.Lock()
+	if w.sub == sub {
+		sub.cancel()
+		w.sub = nil
+	}
+	w.mu.Unlock()
+	close(sub.done)
+}
+
+// handleWaitVisits long-polls a page's count: it answers at once when the
+// count is already past since, and otherwise waits on the event feed for
+// the next visit, answering 304 if none comes before the timeout. Past
+// WAIT_MAX_WAITERS waiting clients it answers 503.
+func (s *Server) handleWaitVisits(c *gin.Context) {
+	if s.events == nil {
+		respondError(c, http.StatusNotFound, "not_found", "Live events are disabled; set EVENTS_BACKEND")
+		return
+	}
+	page := c.Param("page")
+	since, ok := queryInt(c, "since", 0, 0, 1<<62)
+	if !ok {
+		respondError(c, http.StatusBadRequest, "invalid_request", "since must be a visit count")
+		return
+	}
+	timeout := waitDefaultTimeout
+	if value := c.Query("timeout"); value != "" {
+		d, err := time.ParseDuration(value)
+		if err != nil || d <= 0 || d > waitMaxTimeout {
+			respondError(c, http.StatusBadRequest, "invalid_request", fmt.Sprintf("timeout must be a duration up to %s", waitMaxTimeout))
+			return
+		}
+		timeout = d
+	}
+
+	hidden, err := s.pageHidden(c, page)
+	if err != nil {
+		log.Printf("Error getting page metadata: %v", err)
+		respondStoreError(c, err, "Failed to get visit count")
+		return
+	}
+	if hidden {
+		respondError(c, http.StatusNotFound, "not_found", "Page not found")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), timeout)
+	defer cancel()
+	if s.lifetime != nil {
+		// Answer at shutdown rather than holding the drain open
+		stop := context.AfterFunc(s.lifetime, cancel)
+		defer stop()
+	}
+	// Wait before reading the count, so a visit in between still wakes it
+	waiter, err := s.waiters.add(page)
+	if errors.Is(err, errTooManyWaiters) {
+		c.Header("Retry-After", strconv.Itoa(int(waitDefaultTimeout/time.Second)))
+		respondError(c, http.StatusServiceUnavailable, "overloaded", "Too many clients are waiting; try again later")
+		return
+	}
+	if err != nil {
+		log.Printf("Error subscribing to events: %v", err)
+		respondStoreError(c, err, "Failed to get visit count")
+		return
+	}
+	defer s.waiters.remove(waiter)
+	counts, err := s.readPageCounts(ctx, page)
+	if err != nil {
+		log.Printf("Error getting visit count: %v", err)
+		respondStoreError(c, err, "Failed to get visit count")
+		return
+	}
+
+	visits := counts.Visits
+	for visits <= since {
+		select {
+		case <-ctx.Done():
+			c.Status(http.StatusNotModified)
+			return
+		case <-waiter.done:
+			c.Status(http.StatusNotModified)
+			return
+		case n := <-waiter.visits:
+			visits = max(visits, n)
+		}
+	}
+	respondJSON(c, http.StatusOK, VisitResponse{
+		Page:         page,
+		ResolvedFrom: c.GetString(resolvedFromKey),
+		Visits:       visits,
+		Timestamp:    stamp(c, s.clock.Now()),
+	})
+}
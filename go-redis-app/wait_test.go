@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWaitVisits(t *testing.T) {
+	mr, redisClient := newTestRedis(t)
+	cfg := testConfig()
+	cfg.EventsBackend = eventsBackendPubSub
+	router := newTestServer(t, cfg, redisClient).Router()
+	doRequest(router, "GET", "/visit/home", "", nil)
+
+	// Already past since: no waiting
+	w := doRequest(router, "GET", "/visits/home/wait?since=0", "", nil)
+	if v := decodeVisit(t, w.Body.Bytes()); w.Code != http.StatusOK || v.Visits != 1 {
+		t.Errorf("Expected the count at once, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// Woken by the next visit to the page, not by others
+	done := make(chan *httptest.ResponseRecorder)
+	go func() { done <- doRequest(router, "GET", "/visits/home/wait?since=1&timeout=5s", "", nil) }()
+	waitFor(t, 2*time.Second, func() bool { return mr.PubSubNumSub(eventsChannel)[eventsChannel] == 1 })
+	doRequest(router, "GET", "/visit/about", "", nil)
+	doRequest(router, "GET", "/visit/home", "", nil)
+	select {
+	case w := <-done:
+		if v := decodeVisit(t, w.Body.Bytes()); w.Code != http.StatusOK || v.Visits != 2 {
+			t.Errorf("Expected the new count, got %d: %s", w.Code, w.Body.String())
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("Expected the wait to end with the visit")
+	}
+
+	// Nothing before the timeout
+	start := time.Now()
+	if w := doRequest(router, "GET", "/visits/home/wait?since=2&timeout=50ms", "", nil); w.Code != http.StatusNotModified || time.Since(start) < 50*time.Millisecond {
+		t.Errorf("Expected 304 after the timeout, got %d after %s", w.Code, time.Since(start))
+	}
+
+	for _, query := range []string{"since=-1", "timeout=2m", "timeout=soon"} {
+		if w := doRequest(router, "GET", "/visits/home/wait?"+query, "", nil); w.Code != http.StatusBadRequest {
+			t.Errorf("Expected 400 for %s, got %d", query, w.Code)
+		}
+	}
+	waitFor(t, 2*time.Second, func() bool { return mr.PubSubNumSub(eventsChannel)[eventsChannel] == 0 })
+}
+
+func TestWaitVisitsShareSubscription(t *testing.T) {
+	mr, redisClient := newTestRedis(t)
+	cfg := testConfig()
+	cfg.EventsBackend = eventsBackendPubSub
+	cfg.WaitMaxWaiters = 2
+	server := newTestServer(t, cfg, redisClient)
+	router := server.Router()
+	waiting := func() int {
+		server.waiters.mu.Lock()
+		defer server.waiters.mu.Unlock()
+		return server.waiters.count
+	}
+
+	done := make(chan *httptest.ResponseRecorder, 2)
+	for _, page := range []string{"home", "about"} {
+		go func(page string) { done <- doRequest(router, "GET", "/visits/"+page+"/wait?timeout=5s", "", nil) }(page)
+	}
+	waitFor(t, 2*time.Second, func() bool { return waiting() == 2 })
+	if n := mr.PubSubNumSub(eventsChannel)[eventsChannel]; n != 1 {
+		t.Errorf("Expected the waiters to share one subscription, got %d", n)
+	}
+	w := doRequest(router, "GET", "/visits/docs/wait?timeout=5s", "", nil)
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") == "" {
+		t.Errorf("Expected 503 past WAIT_MAX_WAITERS, got %d", w.Code)
+	}
+
+	doRequest(router, "GET", "/visit/home", "", nil)
+	doRequest(router, "GET", "/visit/about", "", nil)
+	for i := 0; i < 2; i++ {
+		select {
+		case w := <-done:
+			if v := decodeVisit(t, w.Body.Bytes()); w.Code != http.StatusOK || v.Visits != 1 {
+				t.Errorf("Expected the new count, got %d: %s", w.Code, w.Body.String())
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatal("Expected both waits to end with their visits")
+		}
+	}
+	waitFor(t, 2*time.Second, func() bool { return mr.PubSubNumSub(eventsChannel)[eventsChannel] == 0 })
+}
+
+func TestWaitVisitsDisconnect(t *testing.T) {
+	mr, redisClient := newTestRedis(t)
+	cfg := testConfig()
+	cfg.EventsBackend = eventsBackendPubSub
+	router := newTestServer(t, cfg, redisClient).Router()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		req := httptest.NewRequest("GET", "/visits/home/wait?timeout=30s", nil).WithContext(ctx)
+		router.ServeHTTP(httptest.NewRecorder(), req)
+	}()
+	waitFor(t, 2*time.Second, func() bool { return mr.PubSubNumSub(eventsChannel)[eventsChannel] == 1 })
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("Expected the wait to end with the client")
+	}
+	waitFor(t, 2*time.Second, func() bool { return mr.PubSubNumSub(eventsChannel)[eventsChannel] == 0 })
+}
+
+func TestWaitVisitsEventsDisabled(t *testing.T) {
+	_, redisClient := newTestRedis(t)
+	router := newTestServer(t, testConfig(), redisClient).Router()
+	if w := doRequest(router, "GET", "/visits/home/wait", "", nil); w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 without EVENTS_BACKEND, got %d", w.Code)
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// NewPageEvent is the payload posted to NEW_PAGE_WEBHOOK_URL
+type NewPageEvent struct {
+	Event     string    `json:"event"`
+	Page      string    `json:"page"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// webhookTimeout bounds each webhook request
+const webhookTimeout = 5 * time.Second
+
+// Webhook posts events to a URL in the background; a nil Webhook drops them
+type Webhook struct {
+	url    string
+	client *http.Client
+}
+
+// NewWebhook creates a webhook for url, or returns nil when url is empty
+func NewWebhook(url string) *Webhook {
+	if url == "" {
+		return nil
+	}
+	return &Webhook{url: url, client: newWebhookClient()}
+}
+
+// newWebhookClient returns the HTTP client webhooks are posted with
+func newWebhookClient() *http.Client {
+	return &http.Client{Timeout: webhookTimeout}
+}
+
+// Alert posts an alert payload to ALERT_WEBHOOK_URL without blocking,
+// logging failures as the named alert's
+func (w *Webhook) Alert(name string, payload any) {
+	if w == nil {
+		return
+	}
+	go func() {
+		body, err := json.Marshal(payload)
+		if err == nil {
+			err = w.post(body)
+		}
+		if err != nil {
+			log.Printf("%s alert failed: %v", name, err)
+		}
+	}()
+}
+
+// Deliver posts a new-page event and waits for the response
+func (w *Webhook) Deliver(page string, at time.Time) error {
+	body, err := json.Marshal(NewPageEvent{Event: "page.created", Page: page, Timestamp: at.UTC()})
+	if err != nil {
+		return fmt.Errorf("encoding new page event: %w", err)
+	}
+	return w.post(body)
+}
+
+func (w *Webhook) post(body []byte) error {
+	resp, err := w.client.Post(w.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestNewPageWebhook(t *testing.T) {
+	var mu sync.Mutex
+	var events []NewPageEvent
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event NewPageEvent
+		json.NewDecoder(r.Body).Decode(&event)
+		mu.Lock()
+		events = append(events, event)
+		mu.Unlock()
+	}))
+	defer hook.Close()
+
+	_, redisClient := newTestRedis(t)
+	cfg := testConfig()
+	cfg.NewPageWebhookURL = hook.URL
+	router := newTestServer(t, cfg, redisClient).Router()
+
+	doRequest(router, "GET", "/visit/launch", "", nil)
+	doRequest(router, "GET", "/visit/launch", "", nil)
+
+	waitFor(t, time.Second, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(events) > 0
+	})
+	time.Sleep(50 * time.Millisecond)
+	mu.Lock()
+	defer mu.Unlock()
+	if len(events) != 1 || events[0].Page != "launch" || events[0].Event != "page.created" {
+		t.Errorf("Expected one page.created event for launch, got %+v", events)
+	}
+}
+
+func TestNilWebhookIsNoop(t *testing.T) {
+	if NewWebhook("") != nil {
+		t.Fatal("Expected no webhook without a URL")
+	}
+	var w *Webhook
+	w.Alert("test", nil)
+}
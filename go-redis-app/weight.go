@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// maxVisitWeight bounds ?weight= on the visit endpoint
+const maxVisitWeight = 1000
+
+// weightScale is the precision of visit weights and weighted totals:
+// weights have at most three decimals, and totals are rounded to three so
+// the binary error INCRBYFLOAT accumulates never shows
+const weightScale = 1000
+
+// weightedScript adds a visit to a page's weighted total. The total is
+// created by the page's first weighted visit, seeded with the visits counted
+// before it at weight 1; until then unweighted visits leave it alone, so
+// pages that never use weights have no weighted key. It runs after the
+// counter INCRBY in the same pipeline, so the counter already includes this
+// visit. It returns the new total, or nil for unweighted pages.
+//
+// KEYS[1] weighted total, KEYS[2] counter; ARGV[1] increment, ARGV[2] the
+// visit's sample weight, ARGV[3] "1" when the visit carries a weight
+var weightedScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	if ARGV[3] ~= '1' then
+		return false
+	end
+	local prior = tonumber(redis.call('GET', KEYS[2]) or '0') - tonumber(ARGV[2])
+	if prior > 0 then
+		redis.call('INCRBYFLOAT', KEYS[1], prior)
+	end
+end
+return redis.call('INCRBYFLOAT', KEYS[1], ARGV[1])
+`)
+
+// weightedKey holds a page's weighted visit total
+func weightedKey(page string) string {
+	return key("visits", page, "weighted")
+}
+
+// parseVisitWeight parses ?weight=, returning 0 when it is not given
+func parseVisitWeight(value string) (float64, error) {
+	if value == "" {
+		return 0, nil
+	}
+	w, err := strconv.ParseFloat(value, 64)
+	if err != nil || math.IsNaN(w) || math.IsInf(w, 0) || w <= 0 || w > maxVisitWeight {
+		return 0, fmt.Errorf("weight must be a number greater than 0 and at most %d", maxVisitWeight)
+	}
+	if scaled := w * weightScale; math.Abs(scaled-math.Round(scaled)) > 1e-6 {
+		return 0, fmt.Errorf("weight must have at most 3 decimal places")
+	}
+	return w, nil
+}
+
+// roundWeighted rounds a weighted total to the precision of the weights
+func roundWeighted(total float64) float64 {
+	return math.Round(total*weightScale) / weightScale
+}
+
+// parseWeighted parses a weighted total read from Redis
+func parseWeighted(value string) (*float64, error) {
+	total, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return nil, err
+	}
+	total = roundWeighted(total)
+	return &total, nil
+}
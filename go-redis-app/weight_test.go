@@ -0,0 +1,132 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestParseVisitWeight(t *testing.T) {
+	valid := map[string]float64{"": 0, "1": 1, "2.5": 2.5, "0.001": 0.001, "10": 10, "999.999": 999.999, "1000": 1000, "1e2": 100}
+	for value, want := range valid {
+		if got, err := parseVisitWeight(value); err != nil || got != want {
+			t.Errorf("parseVisitWeight(%q) = %v, %v, want %v", value, got, err, want)
+		}
+	}
+	for _, value := range []string{"0", "-1", "-0.5", "1000.001", "1e4", "0.0001", "2.5555", "abc", "NaN", "Inf", "-Inf", "1e400", "0x10"} {
+		if got, err := parseVisitWeight(value); err == nil {
+			t.Errorf("parseVisitWeight(%q) = %v, want an error", value, got)
+		}
+	}
+}
+
+func TestRoundWeighted(t *testing.T) {
+	tests := map[float64]float64{
+		0.1 + 0.2:          0.3,
+		1.0000000000000002: 1,
+		2.4999999999999996: 2.5,
+		123456.78900000001: 123456.789,
+	}
+	for total, want := range tests {
+		if got := roundWeighted(total); got != want {
+			t.Errorf("roundWeighted(%v) = %v, want %v", total, got, want)
+		}
+	}
+}
+
+func TestWeightedVisits(t *testing.T) {
+	mr, redisClient := newTestRedis(t)
+	router := newTestServer(t, testConfig(), redisClient).Router()
+
+	// Unweighted pages keep integer counts and no weighted total
+	for i := 0; i < 3; i++ {
+		doRequest(router, "GET", "/visit/checkout", "", nil)
+	}
+	body := doRequest(router, "GET", "/visits/checkout", "", nil).Body.String()
+	if strings.Contains(body, "weighted_visits") || mr.Exists(weightedKey("checkout")) {
+		t.Fatalf("Expected no weighted total before a weighted visit, got %s", body)
+	}
+
+	// The first weighted visit counts the earlier visits at weight 1
+	resp := decodeVisit(t, doRequest(router, "GET", "/visit/checkout?weight=2.5", "", nil).Body.Bytes())
+	if resp.Visits != 4 || resp.WeightedVisits == nil || *resp.WeightedVisits != 5.5 {
+		t.Fatalf("Expected 4 visits weighing 5.5, got %+v", resp)
+	}
+
+	// Unweighted visits to a weighted page weigh 1
+	resp = decodeVisit(t, doRequest(router, "GET", "/visit/checkout", "", nil).Body.Bytes())
+	if resp.Visits != 5 || resp.WeightedVisits == nil || *resp.WeightedVisits != 6.5 {
+		t.Errorf("Expected 5 visits weighing 6.5, got %+v", resp)
+	}
+
+	read := decodeVisit(t, doRequest(router, "GET", "/visits/checkout", "", nil).Body.Bytes())
+	if read.Visits != 5 || read.WeightedVisits == nil || *read.WeightedVisits != 6.5 {
+		t.Errorf("Expected the read endpoint to report both counts, got %+v", read)
+	}
+	if raw, _ := mr.Get(key("visits", "checkout")); raw != "5" {
+		t.Errorf("Expected the raw hit counter to stay an integer, got %q", raw)
+	}
+	if score, _ := mr.ZScore(leaderboardKey, "checkout"); score != 5 {
+		t.Errorf("Expected the leaderboard to rank by hits, got %v", score)
+	}
+}
+
+func TestWeightedVisitsPrecision(t *testing.T) {
+	_, redisClient := newTestRedis(t)
+	router := newTestServer(t, testConfig(), redisClient).Router()
+
+	steps := []struct {
+		weight string
+		times  int
+		want   float64
+	}{
+		{"0.1", 10, 1},
+		{"0.7", 3, 3.1},
+		{"0.001", 999, 4.099},
+		{"0.333", 3, 5.098},
+		{"1000", 2, 2005.098},
+	}
+	var resp VisitResponse
+	for _, step := range steps {
+		for i := 0; i < step.times; i++ {
+			resp = decodeVisit(t, doRequest(router, "GET", "/visit/donate?weight="+step.weight, "", nil).Body.Bytes())
+		}
+		if resp.WeightedVisits == nil || *resp.WeightedVisits != step.want {
+			t.Fatalf("After %d visits weighing %s, expected a weighted total of %v, got %+v", step.times, step.weight, step.want, resp)
+		}
+	}
+	if resp.Visits != 1017 {
+		t.Errorf("Expected 1017 hits, got %d", resp.Visits)
+	}
+}
+
+func TestWeightedVisitsValidation(t *testing.T) {
+	mr, redisClient := newTestRedis(t)
+	router := newTestServer(t, testConfig(), redisClient).Router()
+	for _, weight := range []string{"0", "-2", "1000.5", "0.0005", "lots", "NaN"} {
+		if w := doRequest(router, "GET", "/visit/checkout?weight="+weight, "", nil); w.Code != http.StatusBadRequest {
+			t.Errorf("Expected 400 for weight=%s, got %d", weight, w.Code)
+		}
+	}
+	if mr.Exists(key("visits", "checkout")) || mr.Exists(weightedKey("checkout")) {
+		t.Error("Expected rejected visits not to be counted")
+	}
+
+	if w := doRequest(router, "GET", "/visit/checkout?weight=1000", "", nil); w.Code != http.StatusOK {
+		t.Errorf("Expected the maximum weight to be accepted, got %d", w.Code)
+	}
+}
+
+func TestWeightedTotalFollowsPage(t *testing.T) {
+	mr, redisClient := newTestRedis(t)
+	router := newTestServer(t, testConfig(), redisClient).Router()
+	doRequest(router, "GET", "/visit/checkout?weight=3", "", nil)
+
+	if page, ok := counterPage(weightedKey("checkout")); ok {
+		t.Errorf("Expected the weighted total not to be taken for a counter, got page %q", page)
+	}
+	doRequest(router, "POST", "/admin/pages/batch", `{"operation": "reset", "pages": ["checkout"]}`, nil)
+	if mr.Exists(weightedKey("checkout")) {
+		t.Error("Expected a reset to drop the weighted total")
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// runPeriodic calls fn every interval until ctx is done, logging failures
+func runPeriodic(ctx context.Context, name string, interval time.Duration, fn func(context.Context) error) {
+	if interval <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := fn(ctx); err != nil && ctx.Err() == nil {
+					log.Printf("%s failed: %v", name, err)
+				}
+			}
+		}
+	}()
+}
+
+// Flusher persists state a worker holds in memory. Flushers registered with
+// Server.RegisterFlusher run once at shutdown, after the HTTP listeners have
+// drained, so no request can add to the state while it is flushed.
+type Flusher interface {
+	Flush(ctx context.Context) error
+}
+
+// FlusherFunc adapts a function to Flusher
+type FlusherFunc func(ctx context.Context) error
+
+// Flush implements Flusher
+func (f FlusherFunc) Flush(ctx context.Context) error { return f(ctx) }